@@ -0,0 +1,97 @@
+package bank
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxDecimals is the most decimal places which amounts can have, which is the
+// precision of amounts on stellar.
+//
+// Amounts in a Bank are always integers. A currency with decimal places has
+// its amounts held in units of its smallest decimal place, e.g. with 2
+// decimals a balance of 150 is 1.50 of the currency. The Bank doesn't know or
+// care how many decimals there are, it's up to the caller to be consistent.
+const MaxDecimals = 7
+
+// Unit returns how many of the smallest unit of a currency with the given
+// number of decimal places make up one whole unit of it.
+func Unit(decimals int) int {
+	unit := 1
+	for i := 0; i < decimals; i++ {
+		unit *= 10
+	}
+	return unit
+}
+
+// FormatDecimal formats an amount, which is in the smallest unit of a currency
+// with the given number of decimal places, as a decimal number, e.g. an amount
+// of 150 with 2 decimals is "1.5". Trailing zeros are left off, so whole
+// amounts have no decimal point.
+func FormatDecimal(amount, decimals int) string {
+	var sign string
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	unit := Unit(decimals)
+	str := sign + strconv.Itoa(amount/unit)
+	if frac := amount % unit; frac > 0 {
+		fracStr := strconv.Itoa(frac)
+		fracStr = strings.Repeat("0", decimals-len(fracStr)) + fracStr
+		str += "." + strings.TrimRight(fracStr, "0")
+	}
+	return str
+}
+
+// ErrTooPrecise is returned from ParseDecimal when the amount has more decimal
+// places than the currency does.
+var ErrTooPrecise = errors.New("has too many decimal places")
+
+// ParseDecimal parses a decimal number, e.g. "1.5", into the smallest unit of
+// a currency with the given number of decimal places. Trailing zeros past the
+// currency's decimal places are allowed, e.g. stellar's "1.5000000" can be
+// parsed with 2 decimals, but anything else past them returns ErrTooPrecise.
+func ParseDecimal(str string, decimals int) (int, error) {
+	origStr := str
+	var neg bool
+	if strings.HasPrefix(str, "-") {
+		neg, str = true, str[1:]
+	}
+
+	whole, frac := str, ""
+	if i := strings.Index(str, "."); i >= 0 {
+		whole, frac = str[:i], str[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("%q is not a number", origStr)
+	}
+	for _, s := range []string{whole, frac} {
+		if strings.TrimLeft(s, "0123456789") != "" {
+			return 0, fmt.Errorf("%q is not a number", origStr)
+		}
+	}
+
+	if len(frac) > decimals {
+		if strings.TrimRight(frac[decimals:], "0") != "" {
+			return 0, fmt.Errorf("%q %w", origStr, ErrTooPrecise)
+		}
+		frac = frac[:decimals]
+	}
+	frac += strings.Repeat("0", decimals-len(frac))
+
+	digits := whole + frac
+	if digits == "" {
+		digits = "0"
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number: %w", origStr, err)
+	}
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
@@ -0,0 +1,48 @@
+package bank
+
+import (
+	"errors"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestDecimal(t *T) {
+	type test struct {
+		str      string
+		decimals int
+		amount   int
+	}
+
+	for _, test := range []test{
+		{"0", 0, 0},
+		{"12", 0, 12},
+		{"-12", 0, -12},
+		{"1.5", 2, 150},
+		{"0.05", 2, 5},
+		{"-0.05", 2, -5},
+		{"0.0000001", 7, 1},
+		{"123.4567891", 7, 1234567891},
+	} {
+		amount, err := ParseDecimal(test.str, test.decimals)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(test.amount, amount),
+			massert.Equal(test.str, FormatDecimal(test.amount, test.decimals)),
+		)
+	}
+
+	// stellar pads its amounts with zeros, which can be dropped.
+	amount, err := ParseDecimal("3.5000000", 1)
+	massert.Require(t, massert.Nil(err), massert.Equal(35, amount))
+	amount, err = ParseDecimal("3.0000000", 0)
+	massert.Require(t, massert.Nil(err), massert.Equal(3, amount))
+
+	_, err = ParseDecimal("3.25", 1)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrTooPrecise)))
+
+	for _, str := range []string{"", ".", "-", "1.2.3", "abc", "1e5", "+1"} {
+		_, err := ParseDecimal(str, 2)
+		massert.Require(t, massert.Equal(true, err != nil))
+	}
+}
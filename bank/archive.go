@@ -0,0 +1,341 @@
+package bank
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// ExportRecord is an Export as it was submitted, along with the ID which
+// SubmitExport returned for it and when it was submitted.
+type ExportRecord struct {
+	ID     string
+	Time   time.Time
+	Export Export
+}
+
+// trimExportsPageSize is how many exports TrimExports removes from the stream
+// at a time.
+const trimExportsPageSize = 500
+
+// archivedExport is how exports are written to archive files. The export is in
+// the same versioned encoding it had in the stream, so that archives stay
+// readable as Export changes.
+//
+// Time was added once there were backends whose IDs aren't redis stream IDs,
+// so if it's missing then the time is taken from the ID.
+type archivedExport struct {
+	ID   string          `json:"id"`
+	Time *time.Time      `json:"time,omitempty"`
+	JSON json.RawMessage `json:"json"`
+}
+
+// time returns when the archived export was submitted.
+func (a archivedExport) time() (time.Time, error) {
+	if a.Time != nil {
+		return a.Time.UTC(), nil
+	}
+	id, err := parseStreamEntryID(a.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return streamEntryTime(id), nil
+}
+
+// exportArchive keeps exports which have been trimmed from the stream in JSONL
+// files in a directory, one file per day (UTC) named like
+// "exports-2006-01-02.jsonl".
+type exportArchive struct {
+	dir string
+}
+
+func (ea exportArchive) fileName(t time.Time) string {
+	return filepath.Join(ea.dir, "exports-"+t.UTC().Format("2006-01-02")+".jsonl")
+}
+
+func (ea exportArchive) writeStreamEntries(entries []radix.StreamEntry) error {
+	archived := make([]archivedExport, len(entries))
+	for i, entry := range entries {
+		t := streamEntryTime(entry.ID)
+		archived[i] = archivedExport{
+			ID:   entry.ID.String(),
+			Time: &t,
+			JSON: json.RawMessage(entry.Fields["json"]),
+		}
+	}
+	return ea.write(archived)
+}
+
+func (ea exportArchive) write(archived []archivedExport) error {
+	files := map[string][]archivedExport{}
+	for _, a := range archived {
+		name := ea.fileName(*a.Time)
+		files[name] = append(files[name], a)
+	}
+
+	for name, archived := range files {
+		if err := ea.writeFile(name, archived); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ea exportArchive) writeFile(name string, archived []archivedExport) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", name, err)
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, a := range archived {
+		if err := enc.Encode(a); err != nil {
+			return fmt.Errorf("writing to %q: %w", name, err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing to %q: %w", name, err)
+	} else if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %q: %w", name, err)
+	}
+	return nil
+}
+
+// read returns all archived exports submitted at or after start and before
+// end, in no particular order.
+func (ea exportArchive) read(start, end time.Time) ([]ExportRecord, error) {
+	var records []ExportRecord
+	for day := start.UTC().Truncate(24 * time.Hour); day.Before(end); day = day.Add(24 * time.Hour) {
+		dayRecords, err := ea.readFile(ea.fileName(day), start, end)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, dayRecords...)
+	}
+	return records, nil
+}
+
+func (ea exportArchive) readFile(name string, start, end time.Time) ([]ExportRecord, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", name, err)
+	}
+	defer f.Close()
+
+	var records []ExportRecord
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var a archivedExport
+		if err := json.Unmarshal(s.Bytes(), &a); err != nil {
+			return nil, fmt.Errorf("unmarshaling line of %q: %w", name, err)
+		}
+		t, err := a.time()
+		if err != nil {
+			return nil, err
+		} else if t.Before(start) || !t.Before(end) {
+			continue
+		}
+		export, err := decodeExport(a.JSON)
+		if err != nil {
+			return nil, fmt.Errorf("decoding archived export %q: %w", a.ID, err)
+		}
+		records = append(records, ExportRecord{ID: a.ID, Time: t, Export: export})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading %q: %w", name, err)
+	}
+	return records, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// streamEntryTime returns when the stream entry with the given ID was added.
+func streamEntryTime(id radix.StreamEntryID) time.Time {
+	return time.Unix(0, int64(id.Time)*int64(time.Millisecond)).UTC()
+}
+
+// streamEntryIDBefore returns the greatest possible stream entry ID which is
+// less than the given one.
+func streamEntryIDBefore(id radix.StreamEntryID) radix.StreamEntryID {
+	if id.Seq > 0 {
+		id.Seq--
+		return id
+	}
+	return radix.StreamEntryID{Time: id.Time - 1, Seq: ^uint64(0)}
+}
+
+// exportsTrimLimit returns the ID of the oldest export which hasn't been Ack'd
+// by every consumer group, so everything before it is safe to trim. It returns
+// false if there are no consumer groups, in which case nothing has been
+// consumed and nothing is safe to trim.
+func (b *redisBank) exportsTrimLimit() (radix.StreamEntryID, bool, error) {
+	// XINFO errors if the stream doesn't exist.
+	var exists int
+	if err := b.Do(radix.Cmd(&exists, "EXISTS", b.exportsKey())); err != nil {
+		return radix.StreamEntryID{}, false, fmt.Errorf("checking if exports stream exists: %w", err)
+	} else if exists == 0 {
+		return radix.StreamEntryID{}, false, nil
+	}
+
+	var groups []map[string]string
+	if err := b.Do(radix.Cmd(&groups, "XINFO", "GROUPS", b.exportsKey())); err != nil {
+		return radix.StreamEntryID{}, false, fmt.Errorf("getting export consumer groups: %w", err)
+	} else if len(groups) == 0 {
+		return radix.StreamEntryID{}, false, nil
+	}
+
+	var limit radix.StreamEntryID
+	for i, group := range groups {
+		// everything up to and including the last delivered ID has been
+		// delivered, and of that everything before the oldest pending ID has
+		// been Ack'd.
+		groupLimit, err := parseStreamEntryID(group["last-delivered-id"])
+		if err != nil {
+			return radix.StreamEntryID{}, false, err
+		}
+		groupLimit.Seq++
+
+		if pending, _ := strconv.Atoi(group["pending"]); pending > 0 {
+			var res []interface{}
+			if err := b.Do(radix.Cmd(&res, "XPENDING", b.exportsKey(), group["name"])); err != nil {
+				return radix.StreamEntryID{}, false, fmt.Errorf("getting pending exports of group %q: %w", group["name"], err)
+			} else if len(res) < 2 {
+				return radix.StreamEntryID{}, false, fmt.Errorf("unexpected XPENDING response: %v", res)
+			}
+			oldestPending, err := parseStreamEntryID(fmt.Sprintf("%s", res[1]))
+			if err != nil {
+				return radix.StreamEntryID{}, false, err
+			} else if oldestPending.Before(groupLimit) {
+				groupLimit = oldestPending
+			}
+		}
+
+		if i == 0 || groupLimit.Before(limit) {
+			limit = groupLimit
+		}
+	}
+	return limit, true, nil
+}
+
+func (b *redisBank) TrimExports(before time.Time) (int, error) {
+	limit := radix.StreamEntryID{Time: uint64(before.UnixNano() / int64(time.Millisecond))}
+	if groupsLimit, ok, err := b.exportsTrimLimit(); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, nil
+	} else if groupsLimit.Before(limit) {
+		limit = groupsLimit
+	}
+	if limit.Time == 0 && limit.Seq == 0 {
+		return 0, nil
+	}
+	end := streamEntryIDBefore(limit).String()
+
+	var trimmed int
+	for {
+		var entries []radix.StreamEntry
+		err := b.Do(radix.Cmd(&entries, "XRANGE", b.exportsKey(), "-", end,
+			"COUNT", strconv.Itoa(trimExportsPageSize)))
+		if err != nil {
+			return trimmed, fmt.Errorf("getting exports to trim: %w", err)
+		} else if len(entries) == 0 {
+			return trimmed, nil
+		}
+
+		// exports are archived before they're deleted, so if deleting fails
+		// they'll be archived again next time, which ExportHistory handles.
+		if b.archive != nil {
+			if err := b.archive.writeStreamEntries(entries); err != nil {
+				return trimmed, fmt.Errorf("archiving exports: %w", err)
+			}
+		}
+
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = entry.ID.String()
+		}
+		if err := b.Do(radix.Cmd(nil, "XDEL", append([]string{b.exportsKey()}, ids...)...)); err != nil {
+			return trimmed, fmt.Errorf("deleting trimmed exports: %w", err)
+		}
+		trimmed += len(entries)
+	}
+}
+
+func (b *redisBank) ExportHistory(start, end time.Time) ([]ExportRecord, error) {
+	if !start.Before(end) {
+		return nil, errors.New("start must be before end")
+	}
+
+	var records []ExportRecord
+	if b.archive != nil {
+		var err error
+		if records, err = b.archive.read(start, end); err != nil {
+			return nil, err
+		}
+	}
+
+	// XRANGE's end is inclusive, and a millisecond timestamp on its own covers
+	// every entry in that millisecond.
+	cursor := strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	endStr := strconv.FormatInt(end.UnixNano()/int64(time.Millisecond)-1, 10)
+	for {
+		var entries []radix.StreamEntry
+		err := b.Do(radix.Cmd(&entries, "XRANGE", b.exportsKey(), cursor, endStr,
+			"COUNT", strconv.Itoa(trimExportsPageSize)))
+		if err != nil {
+			return nil, fmt.Errorf("getting exports from redis: %w", err)
+		} else if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			export, err := decodeExport([]byte(entry.Fields["json"]))
+			if err != nil {
+				return nil, fmt.Errorf("decoding export %q: %w", entry.ID, err)
+			}
+			records = append(records, ExportRecord{
+				ID:     entry.ID.String(),
+				Time:   streamEntryTime(entry.ID),
+				Export: export,
+			})
+		}
+
+		next := entries[len(entries)-1].ID
+		next.Seq++
+		cursor = next.String()
+	}
+
+	// the same export can be in both the archive and the stream, if it was
+	// archived but deleting it from the stream failed, or in the archive
+	// twice, if that then happened again.
+	ids := make(map[string]radix.StreamEntryID, len(records))
+	deduped := records[:0]
+	for _, record := range records {
+		if _, ok := ids[record.ID]; ok {
+			continue
+		}
+		id, err := parseStreamEntryID(record.ID)
+		if err != nil {
+			return nil, err
+		}
+		ids[record.ID] = id
+		deduped = append(deduped, record)
+	}
+	sort.Slice(deduped, func(i, j int) bool {
+		return ids[deduped[i].ID].Before(ids[deduped[j].ID])
+	})
+	return deduped, nil
+}
@@ -0,0 +1,120 @@
+package bank
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/mediocregopher/radix/v3"
+)
+
+func TestExportArchive(t *T) {
+	dir, err := ioutil.TempDir("", "bank-archive")
+	massert.Require(t, massert.Nil(err))
+	defer os.RemoveAll(dir)
+	archive := exportArchive{dir: dir}
+
+	day1 := time.Date(2020, 1, 6, 23, 59, 0, 0, time.UTC)
+	day2 := day1.Add(time.Hour)
+	exports := []Export{
+		{FromUserID: "U1", Amount: 1, Payload: testPayload{Data: "a"}},
+		{FromUserID: "U2", Amount: 2, Payload: testPayload{Data: "b"}},
+	}
+
+	var entries []radix.StreamEntry
+	for i, tm := range []time.Time{day1, day2} {
+		exportJSON, err := encodeExport(exports[i])
+		massert.Require(t, massert.Nil(err))
+		entries = append(entries, radix.StreamEntry{
+			ID:     radix.StreamEntryID{Time: uint64(tm.UnixNano() / int64(time.Millisecond))},
+			Fields: map[string]string{"json": string(exportJSON)},
+		})
+	}
+	massert.Require(t, massert.Nil(archive.writeStreamEntries(entries)))
+
+	records, err := archive.read(day1, day2.Add(time.Second))
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(records, 2),
+		massert.HasValue(records, ExportRecord{ID: entries[0].ID.String(), Time: day1, Export: exports[0]}),
+		massert.HasValue(records, ExportRecord{ID: entries[1].ID.String(), Time: day2, Export: exports[1]}),
+	)
+
+	// end is exclusive, and days without a file are fine.
+	records, err = archive.read(day1.Add(-48*time.Hour), day2)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal([]ExportRecord{{ID: entries[0].ID.String(), Time: day1, Export: exports[0]}}, records),
+	)
+
+	// IDs which aren't stream IDs are fine, since the time is written too.
+	exportJSON, err := encodeExport(exports[0])
+	massert.Require(t, massert.Nil(err))
+	day3 := day2.Add(24 * time.Hour)
+	massert.Require(t, massert.Nil(archive.write([]archivedExport{
+		{ID: "42", Time: &day3, JSON: exportJSON},
+	})))
+	records, err = archive.read(day3, day3.Add(time.Second))
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal([]ExportRecord{{ID: "42", Time: day3, Export: exports[0]}}, records),
+	)
+}
+
+func TestTrimExports(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+	userID := mrand.Hex(8)
+
+	dir, err := ioutil.TempDir("", "bank-archive")
+	massert.Require(t, massert.Nil(err))
+	defer os.RemoveAll(dir)
+
+	mtest.Run(cmp, t, func() {
+		rb := bank.(*redisBank)
+		rb.keyPrefix = "test:bank-" + mrand.Hex(8)
+		rb.archive = &exportArchive{dir: dir}
+
+		_, err := bank.Incr(userID, 10)
+		massert.Require(t, massert.Nil(err))
+
+		start := time.Now()
+		var ids []string
+		for i := 0; i < 3; i++ {
+			id, err := bank.SubmitExport(Export{FromUserID: userID, Amount: 1, Payload: testPayload{Data: mrand.Hex(8)}})
+			massert.Require(t, massert.Nil(err))
+			ids = append(ids, id)
+		}
+
+		// nothing has been consumed, so nothing can be trimmed.
+		n, err := bank.TrimExports(time.Now().Add(time.Hour))
+		massert.Require(t, massert.Nil(err), massert.Equal(0, n))
+
+		// consume and ack only the first two.
+		ch := make(chan ExportInProgress)
+		ctx, cancel := context.WithCancel(context.Background())
+		go bank.ConsumeExports(ctx, ch)
+		for i := 0; i < 3; i++ {
+			ep := <-ch
+			if ep.ID != ids[2] {
+				massert.Require(t, massert.Nil(ep.Ack()))
+			}
+		}
+		cancel()
+
+		n, err = bank.TrimExports(time.Now().Add(time.Hour))
+		massert.Require(t, massert.Nil(err), massert.Equal(2, n))
+
+		// history includes both the archived and the remaining exports.
+		records, err := bank.ExportHistory(start.Add(-time.Second), time.Now().Add(time.Second))
+		massert.Require(t, massert.Nil(err), massert.Length(records, 3))
+		for i, record := range records {
+			massert.Require(t, massert.Equal(ids[i], record.ID))
+		}
+	})
+}
@@ -3,13 +3,23 @@
 package bank
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
 	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
 	"github.com/mediocregopher/mediocre-go-lib/mdb/mredis"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
 	"github.com/mediocregopher/radix/v3"
 )
 
@@ -17,29 +27,341 @@ var (
 	// ErrNotEnoughFunds is returned when a user does not have enough funds in
 	// their account to perform some action.
 	ErrNotEnoughFunds = errors.New("you aint got that kind of scratch, kid")
+
+	// ErrUnavailable is returned when redis couldn't be reached at all, as
+	// opposed to it returning an error.
+	ErrUnavailable = errors.New("bank is unavailable")
+
+	// ErrDuplicate is returned when an operation is given an idempotency key
+	// which has already been used, see IncrOnce.
+	ErrDuplicate = errors.New("operation has already been done")
+
+	// ErrQuotaExceeded is returned when using a quota would take it over its
+	// max, see UseQuota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrHoldNotFound is returned when a hold doesn't exist, or has already
+	// been captured or released, see Hold.
+	ErrHoldNotFound = errors.New("hold not found")
+
+	// ErrHoldExpired is returned when capturing a hold which has expired. It
+	// can still be released.
+	ErrHoldExpired = errors.New("hold expired")
+
+	// ErrScheduledPaymentNotFound is returned when a scheduled payment doesn't
+	// exist, or has already been made or canceled, see SchedulePayment.
+	ErrScheduledPaymentNotFound = errors.New("scheduled payment not found")
 )
 
+// idempotencyKeyTTL is how long an idempotency key is remembered for after
+// being used. It only needs to cover how long an operation might be retried.
+const idempotencyKeyTTL = 24 * time.Hour
+
 func translateRedisErr(err error) error {
+	var netErr net.Error
 	if err == nil {
 		return nil
+	} else if errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
 	}
 	switch err.Error() {
 	case ErrNotEnoughFunds.Error():
 		return ErrNotEnoughFunds
+	case ErrDuplicate.Error():
+		return ErrDuplicate
+	case ErrQuotaExceeded.Error():
+		return ErrQuotaExceeded
+	case ErrHoldNotFound.Error():
+		return ErrHoldNotFound
+	case ErrHoldExpired.Error():
+		return ErrHoldExpired
+	case errExportHoldAmount.Error():
+		return errExportHoldAmount
 	default:
 		return err
 	}
 }
 
-// Bank describes a thread-safe store of user funds.
+// Bank describes a thread-safe store of user funds, as well as of arbitrary
+// metadata about each user's account. Funds are accounted for as a
+// double-entry ledger, see JournalEntry.
 type Bank interface {
 	Balance(userID string) (int, error)
 	Incr(userID string, by int) (newBalance int, err error)
 	Transfer(dstUserID, srcUserID string, amount int) (newDstBalance, newSrcBalanc int, err error)
+
+	// IncrAs and TransferAs are like Incr and Transfer, but the change is
+	// recorded in the journal, and the users' histories, as the given source,
+	// e.g. JournalSourceEarn.
+	IncrAs(userID string, by int, source string) (newBalance int, err error)
+	TransferAs(dstUserID, srcUserID string, amount int, source string) (newDstBalance, newSrcBalance int, err error)
+
+	// TransferMulti transfers each of the given amounts from the source user
+	// to the destination user it's keyed by, atomically: if the source
+	// doesn't have enough for all of them then ErrNotEnoughFunds is returned
+	// and nothing is transferred. Amounts must be positive, and the source
+	// can't also be a destination. The new balances of the destinations are
+	// returned, keyed by user, along with the new balance of the source.
+	TransferMulti(srcUserID string, dsts map[string]int) (newDstBalances map[string]int, newSrcBalance int, err error)
+
+	// TransferMultiAs is like TransferMulti, but the transfers are recorded as
+	// the given source, like TransferAs.
+	TransferMultiAs(srcUserID string, dsts map[string]int, source string) (newDstBalances map[string]int, newSrcBalance int, err error)
+
+	// TransferWithReason and TransferMultiWithReason are like TransferAs and
+	// TransferMultiAs, but the given reason is recorded along with the source,
+	// see JournalEntry.Reason.
+	TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (newDstBalance, newSrcBalance int, err error)
+	TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (newDstBalances map[string]int, newSrcBalance int, err error)
+
+	// IncrOnce, TransferOnce and TransferMultiOnce are like IncrAs,
+	// TransferWithReason and TransferMultiWithReason, but are only done once
+	// for the given idempotency key, so that retrying them, e.g. because the
+	// event which caused them was delivered twice, can't change a balance
+	// twice. If the key has already been used, within the last day, then
+	// ErrDuplicate is returned and nothing is changed. The key is only used
+	// up if the operation succeeds. An empty key is the same as not giving
+	// one.
+	IncrOnce(idempotencyKey, userID string, by int, source string) (newBalance int, err error)
+	TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (newDstBalance, newSrcBalance int, err error)
+	TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (newDstBalances map[string]int, newSrcBalance int, err error)
+
+	// Hold takes the given amount, which must be positive, out of the user's
+	// balance and holds it, so that it can't be spent, returning the ID of the
+	// hold. The held funds stay held until they're either captured by Capture
+	// or given back to the user by Release. If the user doesn't have enough
+	// then ErrNotEnoughFunds is returned. If ttl is non-zero then the hold
+	// expires after it, after which it can only be released, see ExpiredHolds.
+	Hold(userID string, amount int, ttl time.Duration) (holdID string, newBalance int, err error)
+
+	// Capture moves held funds to the given user, who must hold the same
+	// currency, and Release moves them back to the user they were held from.
+	// Only one of them can happen to a hold, and only once, after which
+	// ErrHoldNotFound is returned for it. Both return the hold which was
+	// finished. Capture returns ErrHoldExpired for a hold which has expired.
+	Capture(holdID, dstUserID string) (hold Hold, newDstBalance int, err error)
+	Release(holdID string) (hold Hold, newBalance int, err error)
+
+	// ExpiredHolds returns up to limit holds which had expired as of the given
+	// time, soonest expired first. Expired holds stay held until they're
+	// released, which whatever calls this is expected to do.
+	ExpiredHolds(now time.Time, limit int) ([]Hold, error)
+
+	// SchedulePayment stores a payment of the given amount, which must be
+	// positive, from one user to another holding the same currency, to be made
+	// at the given time, returning the ID of the payment. Nothing is held, so
+	// a payment can still fail for lack of funds once it's due. Payments are
+	// made by PayScheduledPayment, which whatever calls DueScheduledPayments
+	// is expected to do.
+	SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (paymentID string, err error)
+
+	// ScheduledPayments returns all payments scheduled from the given user,
+	// and DueScheduledPayments up to limit payments from anyone which were due
+	// as of the given time. Both are soonest first.
+	ScheduledPayments(srcUserID string) ([]ScheduledPayment, error)
+	DueScheduledPayments(now time.Time, limit int) ([]ScheduledPayment, error)
+
+	// PayScheduledPayment makes the scheduled payment, recorded as
+	// JournalSourceScheduled, and CancelScheduledPayment drops it. Only one of
+	// them can happen to a payment, and only once, after which
+	// ErrScheduledPaymentNotFound is returned for it. If the payer doesn't
+	// have enough then PayScheduledPayment returns ErrNotEnoughFunds, and the
+	// payment stays scheduled. Both return the payment.
+	PayScheduledPayment(paymentID string) (payment ScheduledPayment, newDstBalance, newSrcBalance int, err error)
+	CancelScheduledPayment(paymentID string) (ScheduledPayment, error)
+
+	// ApplyInterest changes the balance of every user's account holding the
+	// given currency by the given rate of it, out of InterestRateScale and
+	// rounded towards zero, in one atomic operation, so that nothing can be
+	// moved between accounts part way through. A negative rate takes from
+	// balances, i.e. it's demurrage. Only positive balances are changed, and
+	// never those of HoldsAccountID or the excluded users. The changes are
+	// journaled against LedgerAccountIssuance as JournalSourceInterest, and
+	// like IncrOnce they're only made once for the idempotency key. The
+	// change made to each account is returned, keyed by user, leaving out
+	// those which didn't change.
+	ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (changes map[string]int, err error)
+
+	// Burn records that the given amount of the currency, which must be
+	// positive, has been destroyed outside of the bank, e.g. by being sent
+	// back to its issuer on stellar. No user's balance changes: the amount is
+	// journaled from LedgerAccountExports to LedgerAccountBurned, holding the
+	// currency, as JournalSourceBurn, so that TotalSupply no longer counts it
+	// as exported. Like IncrOnce it's only done once for the idempotency key.
+	Burn(idempotencyKey, currency string, amount int) error
+
+	// UseQuota adds the given amount to how much of the quota with the given
+	// key has been used, returning the new total, unless it would take it over
+	// max, in which case ErrQuotaExceeded is returned and nothing changes. A
+	// negative amount gives back what was used, though never below zero. A
+	// quota starts at zero, and is forgotten ttl after it's first used, so
+	// keys should be made per period, e.g. per day, with a ttl of at least as
+	// long.
+	UseQuota(key string, amount, max int, ttl time.Duration) (used int, err error)
+
+	// CanTransfer returns the error which Transfer would return if it were
+	// called with the same arguments, e.g. ErrNotEnoughFunds, without actually
+	// transferring anything. Since nothing is held, a nil error doesn't
+	// guarantee that a following Transfer will succeed.
+	CanTransfer(dstUserID, srcUserID string, amount int) error
+
+	// GetMeta returns the value of the given metadata key for the user, or
+	// empty string if it has not been set.
+	GetMeta(userID, key string) (string, error)
+
+	// SetMeta sets the value of the given metadata key for the user. Setting
+	// the value to empty string unsets it.
+	SetMeta(userID, key, value string) error
+
+	// AllMeta returns the value of the given metadata key for all users which
+	// have it set, keyed by user ID.
+	AllMeta(key string) (map[string]string, error)
+
+	// Owed returns how much the user owes, which future increments of their
+	// balance will pay off before going into it. This will only ever be
+	// non-zero under the NegativeBalanceOwe policy.
+	Owed(userID string) (int, error)
+
+	// Overdraft returns how far below zero the user's balance can be taken,
+	// by Incr, Transfer, TransferMulti, Hold and the like, before
+	// ErrNotEnoughFunds is returned, or before the negative balance policy
+	// applies in the case of Incr. It's the user's own overdraft, if
+	// SetOverdraft has given them one, otherwise the bank's default, which is
+	// zero unless configured. Exports never take a balance below zero, so an
+	// overdraft can't be withdrawn.
+	Overdraft(userID string) (int, error)
+
+	// SetOverdraft gives the user their own overdraft, see Overdraft. A
+	// negative overdraft removes it, so that the bank's default applies again.
+	SetOverdraft(userID string, overdraft int) error
+
+	// ListAccounts returns a page of accounts, starting at the given cursor.
+	// An empty cursor starts from the beginning, and an empty nextCursor is
+	// returned once there are no more pages. Pages are roughly limit in
+	// size, but may be smaller or larger, and accounts are in no particular
+	// order.
+	ListAccounts(cursor string, limit int) (accounts []Account, nextCursor string, err error)
+
+	// Top returns the n accounts with the highest balances, highest first,
+	// with accounts whose balances are equal ordered by user ID. Only users'
+	// accounts holding the DefaultCurrency with a non-zero balance are
+	// included, i.e. not HoldsAccountID. The redis and SQL banks keep an index
+	// of balances for this, so it doesn't have to read every account.
+	Top(n int) ([]Account, error)
+
+	// BalanceEvents returns the IDs of users whose balances have changed since
+	// the given cursor, oldest first, for keeping caches of balances up to
+	// date. A user is returned once for each change. Given an empty cursor no
+	// users are returned, only a cursor for the current point in time. Only
+	// the most recent changes are kept, so callers should poll often, and have
+	// some other way of expiring what they've cached in case they fall behind.
+	BalanceEvents(cursor string, limit int) (userIDs []string, nextCursor string, err error)
+
+	// Journal returns the entries which every change to a balance has been
+	// recorded as, oldest first, starting after the given cursor. An empty
+	// cursor starts from the very first entry. nextCursor is the ID of the
+	// last entry returned, or the given cursor if there weren't any, so it can
+	// be polled for new entries. Entries are never removed. See Reconcile.
+	Journal(cursor string, limit int) (entries []JournalEntry, nextCursor string, err error)
+
+	// History returns a page of the changes to the user's balance, newest
+	// first, starting after the given cursor. An empty cursor starts from the
+	// newest change, and an empty nextCursor is returned once there are no
+	// more pages. Changes are recorded as they're made, and only those made
+	// since the journal was opened are included, not the opening balance.
+	History(userID string, cursor string, limit int) (entries []HistoryEntry, nextCursor string, err error)
+
+	// TopGivers returns the users who gave the most to others during the
+	// month containing the given time, most generous first. Only transfers
+	// made with JournalSourceGive count. Totals are kept up to date as gives
+	// are journaled, rather than being computed from the journal.
+	TopGivers(month time.Time, limit int) ([]GiveTotal, error)
+
+	// Supply returns how much was moved into and out of users' balances on
+	// each day from the one containing since up to and including today,
+	// oldest first. As with TopGivers, the totals are kept up to date as
+	// entries are journaled.
+	Supply(since time.Time) ([]SupplyDay, error)
+}
+
+// Account describes a single user's account in a Bank.
+type Account struct {
+	UserID  string
+	Balance int
+}
+
+// transferMultiDsts checks the destinations given to TransferMulti, returning
+// their user IDs sorted, which is the order they're transferred to in.
+func transferMultiDsts(srcUserID string, dsts map[string]int) ([]string, error) {
+	dstUserIDs := make([]string, 0, len(dsts))
+	for dstUserID, amount := range dsts {
+		if dstUserID == srcUserID {
+			return nil, fmt.Errorf("can't transfer from %q to itself", srcUserID)
+		} else if amount <= 0 {
+			return nil, fmt.Errorf("malformed amount %d for %q", amount, dstUserID)
+		}
+		dstUserIDs = append(dstUserIDs, dstUserID)
+	}
+	sort.Strings(dstUserIDs)
+	return dstUserIDs, nil
 }
 
+// topAccounts returns at most n of the given accounts which Top would include,
+// highest balance first, for banks which don't keep an index of balances.
+func topAccounts(accounts []Account, n int) []Account {
+	top := make([]Account, 0, len(accounts))
+	for _, account := range accounts {
+		if _, currency := SplitCurrencyAccountID(account.UserID); currency == DefaultCurrency &&
+			account.Balance != 0 && account.UserID != HoldsAccountID {
+			top = append(top, account)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Balance != top[j].Balance {
+			return top[i].Balance > top[j].Balance
+		}
+		return top[i].UserID < top[j].UserID
+	})
+	if n < 0 {
+		n = 0
+	}
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// AliasMetaKey is the metadata key under which the display name of an
+// account's user is kept, so that the account can be shown by name even once
+// the user has left the workspace. It's kept by buckaroo-banzai, and only read
+// by anything else.
+const AliasMetaKey = "alias"
+
 ///////////////////////////////////////////////////////////////////////////////
 
+// Policies for what happens when Incr would take a balance below its floor,
+// which is zero unless the account has an overdraft, see Bank.Overdraft.
+const (
+	// NegativeBalanceRefuse returns ErrNotEnoughFunds.
+	NegativeBalanceRefuse = "refuse"
+
+	// NegativeBalanceClamp sets the balance to the floor.
+	NegativeBalanceClamp = "clamp"
+
+	// NegativeBalanceAllow lets the balance go below the floor, down to a
+	// limit, past which ErrNotEnoughFunds is returned.
+	NegativeBalanceAllow = "allow"
+
+	// NegativeBalanceOwe sets the balance to the floor and records the rest
+	// as owed, which is paid off by future increments before they go into
+	// the balance.
+	NegativeBalanceOwe = "owe"
+)
+
+// redisBankReadTimeout is the read timeout on redis connections. It's a
+// backstop rather than something which should be tuned, and mredis fixes dial
+// options when it's instantiated, before configuration has been loaded, so it
+// isn't configurable. Blocking reads must stay within it.
 const redisBankReadTimeout = 10 * time.Second
 
 type redisBank struct {
@@ -47,65 +369,410 @@ type redisBank struct {
 	keyPrefix string
 	*mredis.Redis
 
+	// how long reads of the export stream block for while waiting for new
+	// exports.
+	blockTimeout time.Duration
+
 	// used for ExportingBank
 	instanceID string
+
+	// what Incr does when it would take a balance below its floor, how far
+	// below the floor it can go under NegativeBalanceAllow, and the default
+	// overdraft, see Bank.Overdraft.
+	negativePolicy string
+	negativeLimit  int
+	overdraft      int
+
+	// optional, where exports trimmed from the stream are kept.
+	archive *exportArchive
 }
 
+// DefaultKeyPrefix is the default prefix of all redis keys used by the bank.
+const DefaultKeyPrefix = "buckaroo-banzai:bank"
+
 // Inst instantiates a Bank which will be configured and initialized when the
 // Init hook is run.
 func Inst(parent *mcmp.Component) ExportingBank {
+	return InstWithKeyPrefix(parent, DefaultKeyPrefix)
+}
+
+// InstWithKeyPrefix is like Inst, but the key-prefix param defaults to the
+// given prefix rather than DefaultKeyPrefix. It's for tools, like load tests,
+// which shouldn't touch real data unless they're explicitly told to.
+func InstWithKeyPrefix(parent *mcmp.Component, defaultKeyPrefix string) ExportingBank {
 	cmp := parent.Child("bank")
-	return &redisBank{
-		cmp:       cmp,
-		keyPrefix: "buckaroo-banzai:bank",
+	b := &redisBank{
+		cmp:            cmp,
+		keyPrefix:      defaultKeyPrefix,
+		blockTimeout:   redisBankReadTimeout / 2,
+		negativePolicy: NegativeBalanceRefuse,
 		Redis: mredis.InstRedis(cmp, mredis.RedisDialOpts(
 			radix.DialReadTimeout(redisBankReadTimeout),
 		)),
 	}
+
+	keyPrefix := mcfg.String(cmp, "key-prefix",
+		mcfg.ParamDefault(b.keyPrefix),
+		mcfg.ParamUsage("Prefix of all redis keys used by the bank. Useful for keeping e.g. load tests away from real data."))
+	blockTimeout := mcfg.String(cmp, "block-timeout",
+		mcfg.ParamDefault(b.blockTimeout.String()),
+		mcfg.ParamUsage("How long reads of the export stream block for while waiting for new exports. Must be less than "+redisBankReadTimeout.String()))
+	negativeBalance := negativeBalanceParams(cmp)
+	archiveDir := mcfg.String(cmp, "archive-dir",
+		mcfg.ParamUsage("Optional directory which exports trimmed from redis are archived to, as daily JSONL files. Archived exports are still included in export history."))
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		if *keyPrefix == "" {
+			return errors.New("key-prefix can't be empty")
+		}
+		b.keyPrefix = *keyPrefix
+
+		d, err := time.ParseDuration(*blockTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing block-timeout: %w", err)
+		} else if d <= 0 || d >= redisBankReadTimeout {
+			return fmt.Errorf("block-timeout must be between 0 and %s", redisBankReadTimeout)
+		}
+		b.blockTimeout = d
+
+		if b.negativePolicy, b.negativeLimit, b.overdraft, err = negativeBalance(); err != nil {
+			return err
+		}
+		cmp.Annotate("negativeBalancePolicy", b.negativePolicy)
+
+		if *archiveDir != "" {
+			if err := os.MkdirAll(*archiveDir, 0755); err != nil {
+				return fmt.Errorf("creating archive-dir: %w", err)
+			}
+			b.archive = &exportArchive{dir: *archiveDir}
+		}
+
+		n, err := b.openJournal()
+		if err != nil {
+			return err
+		} else if n > 0 {
+			mlog.From(cmp).Info("opened journal with existing balances", mctx.Annotate(ctx, "numAccounts", n))
+		}
+
+		if n, err = b.indexTop(); err != nil {
+			return err
+		} else if n > 0 {
+			mlog.From(cmp).Info("indexed existing balances", mctx.Annotate(ctx, "numAccounts", n))
+		}
+		return nil
+	})
+
+	return b
+}
+
+// negativeBalanceParams declares the params which configure how far below zero
+// balances can go, and what Incr does when it would take one further. The
+// returned function must be called during init, and returns the policy, limit
+// and default overdraft.
+func negativeBalanceParams(cmp *mcmp.Component) func() (string, int, int, error) {
+	overdraft := mcfg.Int(cmp, "overdraft",
+		mcfg.ParamUsage("How far below zero any balance can be taken, e.g. by gives, unless the account has been given its own overdraft. Withdrawals never take a balance below zero."))
+	policy := mcfg.String(cmp, "negative-balance-policy",
+		mcfg.ParamDefault(NegativeBalanceRefuse),
+		mcfg.ParamUsage("What to do when a balance would go below its overdraft, e.g. when a reaction is removed after its earnings were spent. \""+
+			NegativeBalanceRefuse+"\" leaves the balance as-is, \""+
+			NegativeBalanceClamp+"\" sets it to zero, \""+
+			NegativeBalanceAllow+"\" lets it go negative down to --bank-negative-balance-limit, and \""+
+			NegativeBalanceOwe+"\" sets it to zero and records the rest as owed, to be paid off by future earnings."))
+	limit := mcfg.Int(cmp, "negative-balance-limit",
+		mcfg.ParamDefault(10),
+		mcfg.ParamUsage("How far below its overdraft a balance can go, when --bank-negative-balance-policy is \""+NegativeBalanceAllow+"\""))
+
+	return func() (string, int, int, error) {
+		switch *policy {
+		case NegativeBalanceRefuse, NegativeBalanceClamp, NegativeBalanceAllow, NegativeBalanceOwe:
+		default:
+			return "", 0, 0, fmt.Errorf("unknown negative-balance-policy %q", *policy)
+		}
+		if *limit < 0 {
+			return "", 0, 0, errors.New("negative-balance-limit can't be negative")
+		} else if *overdraft < 0 {
+			return "", 0, 0, errors.New("overdraft can't be negative")
+		}
+		return *policy, *limit, *overdraft, nil
+	}
 }
 
 func (b *redisBank) key(suffix string) string {
 	return fmt.Sprintf("%s:%s", b.keyPrefix, suffix)
 }
 
+// Do shadows the method on the embedded Redis so that all errors coming out of
+// redis get translated.
+func (b *redisBank) Do(a radix.Action) error {
+	return translateRedisErr(b.Redis.Do(a))
+}
+
 func (b *redisBank) balancesKey() string { return b.key("balances") }
 
+// topKey is a sorted set of the balance of each account holding the
+// DefaultCurrency, kept up to date alongside balancesKey, which Top reads from.
+// Accounts with a zero balance, and HoldsAccountID, are left out of it.
+func (b *redisBank) topKey() string { return b.key("top") }
+
+func (b *redisBank) owedKey() string { return b.key("owed") }
+
+// overdraftsKey is a hash of the overdraft of each user who has been given
+// their own, see SetOverdraft.
+func (b *redisBank) overdraftsKey() string { return b.key("overdrafts") }
+
+// minBalanceLua returns a lua expression which evaluates to the lowest balance
+// which the given user can be taken to, given the index of overdraftsKey in
+// KEYS and the default overdraft.
+func minBalanceLua(overdraftsKeyIdx int, user, defaultOverdraft string) string {
+	return fmt.Sprintf(`-(tonumber(redis.call("HGET", KEYS[%d], %s)) or tonumber(%s))`,
+		overdraftsKeyIdx, user, defaultOverdraft)
+}
+
+func (b *redisBank) balanceEventsKey() string { return b.key("balanceEvents") }
+
+func (b *redisBank) journalKey() string { return b.key("journal") }
+
+func (b *redisBank) historyKey(userID string) string { return b.key("history:" + userID) }
+
+// givesKey is a sorted set of how much each user gave during the month, and
+// giveCountsKey is a hash of how many times they did. month is as returned by
+// givesMonth.
+func (b *redisBank) givesKey(month string) string { return b.key("gives:" + month) }
+
+func (b *redisBank) giveCountsKey(month string) string { return b.key("giveCounts:" + month) }
+
+// supplyKey is a hash of how much each journal source moved into and out of
+// users' balances during the day, with fields like "in:earn". day is as
+// returned by supplyDayStr.
+func (b *redisBank) supplyKey(day string) string { return b.key("supply:" + day) }
+
+// balanceEventsMaxLen is roughly how many balance events are kept, see
+// BalanceEvents. It only needs to cover the time between polls of the
+// slowest reader.
+const balanceEventsMaxLen = 10000
+
+// balanceEventLua is a lua snippet which records that the balance of the user
+// in the given lua expression has changed, to the stream in the given KEYS
+// index.
+func balanceEventLua(keyIdx int, userExpr string) string {
+	return fmt.Sprintf(
+		`redis.call("XADD", KEYS[%d], "MAXLEN", "~", "%d", "*", "user", %s)`,
+		keyIdx, balanceEventsMaxLen, userExpr,
+	)
+}
+
 func (b *redisBank) Balance(userID string) (int, error) {
 	var amount int
 	err := b.Do(radix.Cmd(&amount, "HGET", b.balancesKey(), userID))
-	err = translateRedisErr(err)
 	if err != nil {
 		return 0, fmt.Errorf("error retriving balance from redis: %w", err)
 	}
 	return amount, nil
 }
 
-// Keys:[balancesKey] Args:[user, amount]
-// TODO should this just HSET to 0 if the new balance would be less than zero?
-var incrCmd = radix.NewEvalScript(1, `
+// topLua is a lua snippet which records the new balance, in the given lua
+// expression, of the user in the given lua expression to the top sorted set in
+// the given KEYS index. See topKey.
+func topLua(keyIdx int, userExpr, balanceExpr string) string {
+	return fmt.Sprintf(`
+	if string.sub(%[2]s, 1, 1) ~= "`+currencyAccountPrefix+`" and %[2]s ~= "`+HoldsAccountID+`" then
+		if tonumber(%[3]s) == 0 then
+			redis.call("ZREM", KEYS[%[1]d], %[2]s)
+		else
+			redis.call("ZADD", KEYS[%[1]d], %[3]s, %[2]s)
+		end
+	end`, keyIdx, userExpr, balanceExpr)
+}
+
+// journalLua is a lua snippet which records the balance of the user in the
+// given lua expression changing by the amount in the given lua expression,
+// with the other side against the account in the given lua expression, to the
+// journal stream in the given KEYS index. It's the equivalent of journalEntry.
+//
+// The change is also added to the history streams of the user and the other
+// account in the given KEYS indexes, with the same ID as the journal entry.
+// Those indexes are lua expressions, so that they can be computed, and either
+// can be empty to not add to that history, e.g. because the other account is a
+// ledger account. If the other account is a ledger account then the supply
+// hash in the given KEYS index should be given, and the change is totaled in
+// it, otherwise it should be 0.
+//
+// If the reason lua expression isn't empty then the reason it evaluates to is
+// recorded in the journal and history entries too, see JournalEntry.Reason.
+func journalLua(keyIdx int, userHistoryKeyIdx, otherHistoryKeyIdx string, supplyKeyIdx int, userExpr, byExpr, otherExpr, sourceExpr, reasonExpr string) string {
+	fields := `"source", ` + sourceExpr
+	if reasonExpr != "" {
+		fields += `, "reason", ` + reasonExpr
+	}
+	lua := fmt.Sprintf(`
+	if %[2]s ~= 0 then
+		local id
+		if %[2]s > 0 then
+			id = redis.call("XADD", KEYS[%[1]d], "*", "from", %[4]s, "to", %[3]s, "amount", %[2]s, %[5]s)
+		else
+			id = redis.call("XADD", KEYS[%[1]d], "*", "from", %[3]s, "to", %[4]s, "amount", -(%[2]s), %[5]s)
+		end`, keyIdx, byExpr, userExpr, otherExpr, fields)
+	if userHistoryKeyIdx != "" {
+		lua += fmt.Sprintf(`
+		redis.call("XADD", KEYS[%s], id, "amount", %s, "counterparty", %s, %s)`,
+			userHistoryKeyIdx, byExpr, otherExpr, fields)
+	}
+	if otherHistoryKeyIdx != "" {
+		lua += fmt.Sprintf(`
+		redis.call("XADD", KEYS[%s], id, "amount", -(%s), "counterparty", %s, %s)`,
+			otherHistoryKeyIdx, byExpr, userExpr, fields)
+	}
+	if supplyKeyIdx > 0 {
+		lua += fmt.Sprintf(`
+		if %[2]s > 0 then
+			redis.call("HINCRBY", KEYS[%[1]d], "`+SupplyIn+`:" .. %[3]s, %[2]s)
+		else
+			redis.call("HINCRBY", KEYS[%[1]d], "`+SupplyOut+`:" .. %[3]s, -(%[2]s))
+		end`, supplyKeyIdx, byExpr, sourceExpr)
+	}
+	return lua + `
+	end`
+}
+
+// idempotencyKey returns the key which records that the given idempotency key
+// has been used, or empty string if none was given. See IncrOnce.
+func (b *redisBank) idempotencyKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return b.key("idempotency:" + key)
+}
+
+// checkIdempotencyLua is a lua snippet which returns ErrDuplicate if the
+// idempotency key in the given KEYS index has been used, and useIdempotencyLua
+// is one which marks it as used. Both do nothing if the key is empty. Redis
+// doesn't undo what a script did before it errored, so the key is checked
+// before anything is changed, and only used once nothing else can fail.
+func checkIdempotencyLua(keyIdx int) string {
+	return fmt.Sprintf(`
+	if KEYS[%d] ~= "" and redis.call("EXISTS", KEYS[%d]) == 1 then
+		return redis.error_reply("`+ErrDuplicate.Error()+`")
+	end`, keyIdx, keyIdx)
+}
+
+func useIdempotencyLua(keyIdx int) string {
+	return fmt.Sprintf(`
+	if KEYS[%d] ~= "" then
+		redis.call("SET", KEYS[%d], "1", "EX", "%d")
+	end`, keyIdx, keyIdx, int(idempotencyKeyTTL.Seconds()))
+}
+
+// Keys:[balancesKey, owedKey, balanceEventsKey, journalKey, historyKey, supplyKey, topKey, idempotencyKey, overdraftsKey] Args:[user, amount, negativePolicy, negativeLimit, source, overdraft]
+var incrCmd = radix.NewEvalScript(9, `
+	`+checkIdempotencyLua(8)+`
 	local toIncr = tonumber(ARGV[2])
+	local policy = ARGV[3]
 	local balance = tonumber(redis.call("HGET", KEYS[1], ARGV[1]))
 	if not balance then balance = 0 end
-	if balance + toIncr < 0 then
+	local minBalance = `+minBalanceLua(9, "ARGV[1]", "ARGV[6]")+`
+
+	if policy == "`+NegativeBalanceOwe+`" then
+		local owed = tonumber(redis.call("HGET", KEYS[2], ARGV[1]))
+		if not owed then owed = 0 end
+		local newOwed = owed
+
+		if toIncr > 0 then
+			local settled = math.min(owed, toIncr)
+			newOwed = owed - settled
+			toIncr = toIncr - settled
+		elseif balance + toIncr < minBalance then
+			local applied = math.min(0, minBalance - balance)
+			newOwed = owed + (applied - toIncr)
+			toIncr = applied
+		end
+
+		if newOwed > 0 then
+			redis.call("HSET", KEYS[2], ARGV[1], newOwed)
+		elseif owed > 0 then
+			redis.call("HDEL", KEYS[2], ARGV[1])
+		end
+
+	elseif balance + toIncr >= minBalance or toIncr >= 0 then
+		-- nothing to do
+
+	elseif policy == "`+NegativeBalanceClamp+`" then
+		toIncr = math.min(0, minBalance - balance)
+
+	elseif policy == "`+NegativeBalanceAllow+`" then
+		if balance + toIncr < minBalance - tonumber(ARGV[4]) then
+			return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
+		end
+
+	else
 		return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
 	end
+	`+useIdempotencyLua(8)+`
 
-	return redis.call("HINCRBY", KEYS[1], ARGV[1], toIncr)
+	if toIncr ~= 0 then
+		`+balanceEventLua(3, "ARGV[1]")+`
+	end
+	`+journalLua(4, "5", "", 6, "ARGV[1]", "toIncr", fmt.Sprintf("%q", LedgerAccountIssuance), "ARGV[5]", "")+`
+	local newBalance = redis.call("HINCRBY", KEYS[1], ARGV[1], toIncr)
+	`+topLua(7, "ARGV[1]", "newBalance")+`
+	return newBalance
 `)
 
 func (b *redisBank) Incr(userID string, by int) (int, error) {
+	return b.IncrAs(userID, by, JournalSourceIncr)
+}
+
+func (b *redisBank) IncrAs(userID string, by int, source string) (int, error) {
+	return b.IncrOnce("", userID, by, source)
+}
+
+func (b *redisBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
 	var newBalance int
-	err := b.Do(incrCmd.Cmd(&newBalance, b.balancesKey(), userID, strconv.Itoa(by)))
-	err = translateRedisErr(err)
+	err := b.Do(incrCmd.Cmd(
+		&newBalance, b.balancesKey(), b.owedKey(), b.balanceEventsKey(), b.journalKey(), b.historyKey(userID),
+		b.supplyKey(supplyDayStr(time.Now())), b.topKey(), b.idempotencyKey(idempotencyKey), b.overdraftsKey(),
+		userID, strconv.Itoa(by), b.negativePolicy, strconv.Itoa(b.negativeLimit), source, strconv.Itoa(b.overdraft),
+	))
 	if err != nil {
 		return 0, fmt.Errorf("incrementing balance in redis: %w", err)
 	}
 	return newBalance, nil
 }
 
-// Keys:[balancesKey] Args:[dstUser, srcUser, amount]
+func (b *redisBank) Owed(userID string) (int, error) {
+	var owed int
+	mn := radix.MaybeNil{Rcv: &owed}
+	if err := b.Do(radix.Cmd(&mn, "HGET", b.owedKey(), userID)); err != nil {
+		return 0, fmt.Errorf("error retrieving owed amount from redis: %w", err)
+	}
+	return owed, nil
+}
+
+func (b *redisBank) Overdraft(userID string) (int, error) {
+	overdraft := b.overdraft
+	mn := radix.MaybeNil{Rcv: &overdraft}
+	if err := b.Do(radix.Cmd(&mn, "HGET", b.overdraftsKey(), userID)); err != nil {
+		return 0, fmt.Errorf("getting overdraft from redis: %w", err)
+	}
+	return overdraft, nil
+}
+
+func (b *redisBank) SetOverdraft(userID string, overdraft int) error {
+	var err error
+	if overdraft < 0 {
+		err = b.Do(radix.Cmd(nil, "HDEL", b.overdraftsKey(), userID))
+	} else {
+		err = b.Do(radix.FlatCmd(nil, "HSET", b.overdraftsKey(), userID, overdraft))
+	}
+	if err != nil {
+		return fmt.Errorf("setting overdraft in redis: %w", err)
+	}
+	return nil
+}
+
+// Keys:[balancesKey, balanceEventsKey, journalKey, dstHistoryKey, srcHistoryKey, givesKey, giveCountsKey, topKey, idempotencyKey, overdraftsKey] Args:[dstUser, srcUser, amount, source, reason, overdraft]
 // a negative amount can be transferred, technically, so check for that case.
-var transferCmd = radix.NewEvalScript(1, `
+var transferCmd = radix.NewEvalScript(10, `
+	`+checkIdempotencyLua(9)+`
 	local toTransfer = tonumber(ARGV[3])
 
 	local balances = redis.call("HMGET", KEYS[1], ARGV[1], ARGV[2])
@@ -113,23 +780,493 @@ var transferCmd = radix.NewEvalScript(1, `
 	local srcBalance = tonumber(balances[2])
 	if not dstBalance then dstBalance = 0 end
 	if not srcBalance then srcBalance = 0 end
-	if srcBalance - toTransfer < 0 or dstBalance + toTransfer < 0 then
+	if srcBalance - toTransfer < `+minBalanceLua(10, "ARGV[2]", "ARGV[6]")+` or
+		dstBalance + toTransfer < `+minBalanceLua(10, "ARGV[1]", "ARGV[6]")+` then
 		return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
 	end
+	`+useIdempotencyLua(9)+`
 
 	local newDstBalance = redis.call("HINCRBY", KEYS[1], ARGV[1], toTransfer)
 	local newSrcBalance = redis.call("HINCRBY", KEYS[1], ARGV[2], -1*toTransfer)
+	`+topLua(8, "ARGV[1]", "newDstBalance")+`
+	`+topLua(8, "ARGV[2]", "newSrcBalance")+`
+	`+balanceEventLua(2, "ARGV[1]")+`
+	`+balanceEventLua(2, "ARGV[2]")+`
+	if ARGV[1] ~= ARGV[2] then
+		`+journalLua(3, "4", "5", 0, "ARGV[1]", "toTransfer", "ARGV[2]", "ARGV[4]", "ARGV[5]")+`
+		if ARGV[4] == "`+JournalSourceGive+`" and toTransfer ~= 0 then
+			local giver, given = ARGV[2], toTransfer
+			if given < 0 then giver, given = ARGV[1], -given end
+			redis.call("ZINCRBY", KEYS[6], given, giver)
+			redis.call("HINCRBY", KEYS[7], giver, 1)
+		end
+	end
 	return {newDstBalance, newSrcBalance}
 `)
 
 func (b *redisBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	return b.TransferAs(dstUserID, srcUserID, amount, JournalSourceTransfer)
+}
+
+func (b *redisBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	return b.TransferWithReason(dstUserID, srcUserID, amount, source, "")
+}
+
+func (b *redisBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	return b.TransferOnce("", dstUserID, srcUserID, amount, source, reason)
+}
+
+func (b *redisBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
 	var newBalances []int
+	month := givesMonth(time.Now())
 	err := b.Do(transferCmd.Cmd(
-		&newBalances, b.balancesKey(), dstUserID, srcUserID, strconv.Itoa(amount),
+		&newBalances, b.balancesKey(), b.balanceEventsKey(), b.journalKey(),
+		b.historyKey(dstUserID), b.historyKey(srcUserID),
+		b.givesKey(month), b.giveCountsKey(month), b.topKey(), b.idempotencyKey(idempotencyKey), b.overdraftsKey(),
+		dstUserID, srcUserID, strconv.Itoa(amount), source, reason, strconv.Itoa(b.overdraft),
 	))
-	err = translateRedisErr(err)
 	if err != nil {
 		return 0, 0, fmt.Errorf("transfering amount in redis: %w", err)
 	}
 	return newBalances[0], newBalances[1], nil
 }
+
+// Keys:[balancesKey, balanceEventsKey, journalKey, srcHistoryKey, givesKey, giveCountsKey, topKey, overdraftsKey, idempotencyKey, dstHistoryKey...] Args:[srcUser, source, reason, overdraft, dstUser, amount, ...]
+// each destination's history key is in the same position in KEYS, after the
+// first 9, as the destination is in ARGV, after the first 4. The number of keys
+// depends on the number of destinations, so the script is made with
+// radix.NewEvalScript on each call.
+var transferMultiLua = checkIdempotencyLua(9) + `
+	local src, source, reason = ARGV[1], ARGV[2], ARGV[3]
+	local dsts, amounts, total = {}, {}, 0
+	for i = 5, #ARGV, 2 do
+		table.insert(dsts, ARGV[i])
+		table.insert(amounts, tonumber(ARGV[i+1]))
+		total = total + tonumber(ARGV[i+1])
+	end
+
+	local srcBalance = tonumber(redis.call("HGET", KEYS[1], src))
+	if not srcBalance then srcBalance = 0 end
+	if srcBalance - total < ` + minBalanceLua(8, "src", "ARGV[4]") + ` then
+		return redis.error_reply("` + ErrNotEnoughFunds.Error() + `")
+	end
+	` + useIdempotencyLua(9) + `
+
+	local newBalances = {}
+	for i, dst in ipairs(dsts) do
+		local amount, dstHistoryIdx = amounts[i], 9 + i
+		local newDstBalance = redis.call("HINCRBY", KEYS[1], dst, amount)
+		` + balanceEventLua(2, "dst") + `
+		` + topLua(7, "dst", "newDstBalance") + `
+		` + journalLua(3, "dstHistoryIdx", "4", 0, "dst", "amount", "src", "source", "reason") + `
+		if source == "` + JournalSourceGive + `" then
+			redis.call("ZINCRBY", KEYS[5], amount, src)
+			redis.call("HINCRBY", KEYS[6], src, 1)
+		end
+		table.insert(newBalances, newDstBalance)
+	end
+
+	local newSrcBalance = redis.call("HINCRBY", KEYS[1], src, -total)
+	` + balanceEventLua(2, "src") + `
+	` + topLua(7, "src", "newSrcBalance") + `
+	table.insert(newBalances, newSrcBalance)
+	return newBalances
+`
+
+func (b *redisBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	return b.TransferMultiAs(srcUserID, dsts, JournalSourceTransfer)
+}
+
+func (b *redisBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	return b.TransferMultiWithReason(srcUserID, dsts, source, "")
+}
+
+func (b *redisBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	return b.TransferMultiOnce("", srcUserID, dsts, source, reason)
+}
+
+func (b *redisBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	dstUserIDs, err := transferMultiDsts(srcUserID, dsts)
+	if err != nil {
+		return nil, 0, err
+	} else if len(dstUserIDs) == 0 {
+		srcBalance, err := b.Balance(srcUserID)
+		return map[string]int{}, srcBalance, err
+	}
+
+	month := givesMonth(time.Now())
+	keys := []string{
+		b.balancesKey(), b.balanceEventsKey(), b.journalKey(), b.historyKey(srcUserID),
+		b.givesKey(month), b.giveCountsKey(month), b.topKey(), b.overdraftsKey(), b.idempotencyKey(idempotencyKey),
+	}
+	args := []string{srcUserID, source, reason, strconv.Itoa(b.overdraft)}
+	for _, dstUserID := range dstUserIDs {
+		keys = append(keys, b.historyKey(dstUserID))
+		args = append(args, dstUserID, strconv.Itoa(dsts[dstUserID]))
+	}
+
+	var newBalances []int
+	cmd := radix.NewEvalScript(len(keys), transferMultiLua)
+	if err := b.Do(cmd.Cmd(&newBalances, append(keys, args...)...)); errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("transfering amounts in redis: %w", err)
+	} else if len(newBalances) != len(dstUserIDs)+1 {
+		return nil, 0, fmt.Errorf("unexpected number of balances returned: %v", newBalances)
+	}
+
+	newDstBalances := make(map[string]int, len(dstUserIDs))
+	for i, dstUserID := range dstUserIDs {
+		newDstBalances[dstUserID] = newBalances[i]
+	}
+	return newDstBalances, newBalances[len(dstUserIDs)], nil
+}
+
+// Keys:[balancesKey, overdraftsKey] Args:[dstUser, srcUser, amount, overdraft]
+// the same check as transferCmd, without the transfer.
+var canTransferCmd = radix.NewEvalScript(2, `
+	local toTransfer = tonumber(ARGV[3])
+
+	local balances = redis.call("HMGET", KEYS[1], ARGV[1], ARGV[2])
+	local dstBalance = tonumber(balances[1])
+	local srcBalance = tonumber(balances[2])
+	if not dstBalance then dstBalance = 0 end
+	if not srcBalance then srcBalance = 0 end
+	if srcBalance - toTransfer < `+minBalanceLua(2, "ARGV[2]", "ARGV[4]")+` or
+		dstBalance + toTransfer < `+minBalanceLua(2, "ARGV[1]", "ARGV[4]")+` then
+		return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
+	end
+	return 1
+`)
+
+func (b *redisBank) CanTransfer(dstUserID, srcUserID string, amount int) error {
+	err := b.Do(canTransferCmd.Cmd(
+		nil, b.balancesKey(), b.overdraftsKey(), dstUserID, srcUserID, strconv.Itoa(amount), strconv.Itoa(b.overdraft),
+	))
+	if errors.Is(err, ErrNotEnoughFunds) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("checking transfer in redis: %w", err)
+	}
+	return nil
+}
+
+// ListAccounts uses HSCAN, rather than HGETALL, so that enumerating all
+// accounts doesn't block redis on large workspaces.
+func (b *redisBank) ListAccounts(cursor string, limit int) ([]Account, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	var res []interface{}
+	err := b.Do(radix.Cmd(&res, "HSCAN", b.balancesKey(), cursor, "COUNT", strconv.Itoa(limit)))
+	if err != nil {
+		return nil, "", fmt.Errorf("scanning balances in redis: %w", err)
+	} else if len(res) != 2 {
+		return nil, "", fmt.Errorf("unexpected HSCAN response: %v", res)
+	}
+
+	fields, _ := res[1].([]interface{})
+	accounts := make([]Account, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		balanceStr := fmt.Sprintf("%s", fields[i+1])
+		balance, err := strconv.Atoi(balanceStr)
+		if err != nil {
+			return nil, "", fmt.Errorf("parsing balance %q: %w", balanceStr, err)
+		}
+		accounts = append(accounts, Account{
+			UserID:  fmt.Sprintf("%s", fields[i]),
+			Balance: balance,
+		})
+	}
+
+	if cursor = fmt.Sprintf("%s", res[0]); cursor == "0" {
+		cursor = ""
+	}
+	return accounts, cursor, nil
+}
+
+func parseStreamEntryID(str string) (radix.StreamEntryID, error) {
+	var id radix.StreamEntryID
+	parts := strings.SplitN(str, "-", 2)
+	if len(parts) != 2 {
+		return id, fmt.Errorf("malformed stream entry ID %q", str)
+	}
+	var err error
+	if id.Time, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return id, fmt.Errorf("parsing time of stream entry ID %q: %w", str, err)
+	} else if id.Seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return id, fmt.Errorf("parsing sequence of stream entry ID %q: %w", str, err)
+	}
+	return id, nil
+}
+
+func (b *redisBank) BalanceEvents(cursor string, limit int) ([]string, string, error) {
+	if cursor == "" {
+		var entries []radix.StreamEntry
+		err := b.Do(radix.Cmd(&entries, "XREVRANGE", b.balanceEventsKey(), "+", "-", "COUNT", "1"))
+		if err != nil {
+			return nil, "", fmt.Errorf("getting latest balance event from redis: %w", err)
+		} else if len(entries) == 0 {
+			return nil, "0-0", nil
+		}
+		return nil, entries[0].ID.String(), nil
+	}
+
+	// XRANGE's start is inclusive, so start from just after the cursor.
+	start, err := parseStreamEntryID(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	start.Seq++
+
+	var entries []radix.StreamEntry
+	err = b.Do(radix.Cmd(&entries, "XRANGE", b.balanceEventsKey(),
+		start.String(), "+", "COUNT", strconv.Itoa(limit)))
+	if err != nil {
+		return nil, "", fmt.Errorf("getting balance events from redis: %w", err)
+	}
+
+	userIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		userIDs = append(userIDs, entry.Fields["user"])
+		cursor = entry.ID.String()
+	}
+	return userIDs, cursor, nil
+}
+
+// Keys:[balancesKey, journalKey]
+var openJournalCmd = radix.NewEvalScript(2, `
+	if redis.call("EXISTS", KEYS[2]) == 1 then
+		return 0
+	end
+	local balances = redis.call("HGETALL", KEYS[1])
+	local n = 0
+	for i = 1, #balances, 2 do
+		local user = balances[i]
+		local balance = tonumber(balances[i+1])
+		`+journalLua(2, "", "", 0, "user", "balance", fmt.Sprintf("%q", LedgerAccountOpening), fmt.Sprintf("%q", JournalSourceOpening), "")+`
+		if balance ~= 0 then
+			n = n + 1
+		end
+	end
+	return n
+`)
+
+// openJournal records the balances which users already have as opening journal
+// entries, if the journal hasn't been started yet, and returns how many were
+// recorded. Balances were kept without a journal before it was introduced, so
+// this gives it somewhere to start from. Any instances running code from before
+// then must be stopped first, since their changes won't be journaled.
+func (b *redisBank) openJournal() (int, error) {
+	var n int
+	if err := b.Do(openJournalCmd.Cmd(&n, b.balancesKey(), b.journalKey())); err != nil {
+		return 0, fmt.Errorf("opening journal in redis: %w", err)
+	}
+	return n, nil
+}
+
+// Keys:[balancesKey, topKey]
+var indexTopCmd = radix.NewEvalScript(2, `
+	if redis.call("EXISTS", KEYS[2]) == 1 then
+		return 0
+	end
+	local balances = redis.call("HGETALL", KEYS[1])
+	for i = 1, #balances, 2 do
+		local user = balances[i]
+		local balance = balances[i+1]
+		`+topLua(2, "user", "balance")+`
+	end
+	return redis.call("ZCARD", KEYS[2])
+`)
+
+// indexTop builds the top sorted set out of the balances which users already
+// have, if it hasn't been built yet, and returns how many balances went into
+// it. Like openJournal, any instances running code from before the sorted set
+// was introduced must be stopped first, since their changes won't be indexed.
+func (b *redisBank) indexTop() (int, error) {
+	var n int
+	if err := b.Do(indexTopCmd.Cmd(&n, b.balancesKey(), b.topKey())); err != nil {
+		return 0, fmt.Errorf("indexing top balances in redis: %w", err)
+	}
+	return n, nil
+}
+
+func (b *redisBank) Journal(cursor string, limit int) ([]JournalEntry, string, error) {
+	start := "-"
+	if cursor != "" {
+		// XRANGE's start is inclusive, so start from just after the cursor.
+		id, err := parseStreamEntryID(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		id.Seq++
+		start = id.String()
+	}
+
+	var streamEntries []radix.StreamEntry
+	err := b.Do(radix.Cmd(&streamEntries, "XRANGE", b.journalKey(),
+		start, "+", "COUNT", strconv.Itoa(limit)))
+	if err != nil {
+		return nil, "", fmt.Errorf("getting journal entries from redis: %w", err)
+	}
+
+	entries := make([]JournalEntry, 0, len(streamEntries))
+	for _, streamEntry := range streamEntries {
+		amount, err := strconv.Atoi(streamEntry.Fields["amount"])
+		if err != nil {
+			return nil, "", fmt.Errorf("parsing amount of journal entry %q: %w", streamEntry.ID, err)
+		}
+		cursor = streamEntry.ID.String()
+		entries = append(entries, JournalEntry{
+			ID:     cursor,
+			Time:   time.Unix(0, int64(streamEntry.ID.Time)*int64(time.Millisecond)),
+			From:   streamEntry.Fields["from"],
+			To:     streamEntry.Fields["to"],
+			Amount: amount,
+			Source: streamEntry.Fields["source"],
+			Reason: streamEntry.Fields["reason"],
+		})
+	}
+	return entries, cursor, nil
+}
+
+func (b *redisBank) History(userID string, cursor string, limit int) ([]HistoryEntry, string, error) {
+	end := "+"
+	if cursor != "" {
+		// XREVRANGE's end is inclusive, so end just before the cursor.
+		id, err := parseStreamEntryID(cursor)
+		if err != nil {
+			return nil, "", err
+		} else if id.Seq > 0 {
+			id.Seq--
+		} else if id.Time > 0 {
+			id.Time, id.Seq = id.Time-1, math.MaxUint64
+		} else {
+			return nil, "", nil
+		}
+		end = id.String()
+	}
+
+	var streamEntries []radix.StreamEntry
+	err := b.Do(radix.Cmd(&streamEntries, "XREVRANGE", b.historyKey(userID),
+		end, "-", "COUNT", strconv.Itoa(limit)))
+	if err != nil {
+		return nil, "", fmt.Errorf("getting history from redis: %w", err)
+	}
+
+	entries := make([]HistoryEntry, 0, len(streamEntries))
+	for _, streamEntry := range streamEntries {
+		amount, err := strconv.Atoi(streamEntry.Fields["amount"])
+		if err != nil {
+			return nil, "", fmt.Errorf("parsing amount of history entry %q: %w", streamEntry.ID, err)
+		}
+		entries = append(entries, HistoryEntry{
+			ID:           streamEntry.ID.String(),
+			Time:         time.Unix(0, int64(streamEntry.ID.Time)*int64(time.Millisecond)),
+			Source:       streamEntry.Fields["source"],
+			Amount:       amount,
+			Counterparty: streamEntry.Fields["counterparty"],
+			Reason:       streamEntry.Fields["reason"],
+		})
+	}
+
+	if len(entries) < limit {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].ID, nil
+}
+
+func (b *redisBank) TopGivers(month time.Time, limit int) ([]GiveTotal, error) {
+	monthStr := givesMonth(month)
+	var res []string
+	err := b.Do(radix.Cmd(&res, "ZREVRANGE", b.givesKey(monthStr),
+		"0", strconv.Itoa(limit-1), "WITHSCORES"))
+	if err != nil {
+		return nil, fmt.Errorf("getting top givers from redis: %w", err)
+	} else if len(res) == 0 {
+		return nil, nil
+	}
+
+	totals := make([]GiveTotal, 0, len(res)/2)
+	userIDs := make([]string, 0, len(res)/2)
+	for i := 0; i+1 < len(res); i += 2 {
+		amount, err := strconv.Atoi(res[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing amount given by %q: %w", res[i], err)
+		}
+		totals = append(totals, GiveTotal{UserID: res[i], Amount: amount})
+		userIDs = append(userIDs, res[i])
+	}
+
+	var counts []string
+	err = b.Do(radix.Cmd(&counts, "HMGET", append([]string{b.giveCountsKey(monthStr)}, userIDs...)...))
+	if err != nil {
+		return nil, fmt.Errorf("getting give counts from redis: %w", err)
+	}
+	for i := range totals {
+		if i < len(counts) {
+			totals[i].NumGives, _ = strconv.Atoi(counts[i])
+		}
+	}
+	return topGiveTotals(totals, limit), nil
+}
+
+func (b *redisBank) Top(n int) ([]Account, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	var res []string
+	err := b.Do(radix.Cmd(&res, "ZREVRANGE", b.topKey(),
+		"0", strconv.Itoa(n-1), "WITHSCORES"))
+	if err != nil {
+		return nil, fmt.Errorf("getting top balances from redis: %w", err)
+	}
+
+	accounts := make([]Account, 0, len(res)/2)
+	for i := 0; i+1 < len(res); i += 2 {
+		balance, err := strconv.Atoi(res[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing top balance of %q: %w", res[i], err)
+		}
+		accounts = append(accounts, Account{UserID: res[i], Balance: balance})
+	}
+
+	// ZREVRANGE orders equal balances by user ID backwards, so of those with
+	// the lowest balance returned, it may have left out ones which should
+	// have been included. They're read again in the right order.
+	if len(accounts) == n {
+		lowest := accounts[n-1].Balance
+		var tied []string
+		err := b.Do(radix.FlatCmd(&tied, "ZRANGEBYSCORE", b.topKey(), lowest, lowest, "LIMIT", 0, n))
+		if err != nil {
+			return nil, fmt.Errorf("getting top balances from redis: %w", err)
+		}
+		for len(accounts) > 0 && accounts[len(accounts)-1].Balance == lowest {
+			accounts = accounts[:len(accounts)-1]
+		}
+		for _, userID := range tied {
+			accounts = append(accounts, Account{UserID: userID, Balance: lowest})
+		}
+	}
+	return topAccounts(accounts, n), nil
+}
+
+func (b *redisBank) Supply(since time.Time) ([]SupplyDay, error) {
+	days := newSupplyDays(since, time.Now())
+	for _, day := range days {
+		var fields map[string]string
+		if err := b.Do(radix.Cmd(&fields, "HGETALL", b.supplyKey(supplyDayStr(day.Day)))); err != nil {
+			return nil, fmt.Errorf("getting supply from redis: %w", err)
+		}
+		for field, amountStr := range fields {
+			parts := strings.SplitN(field, ":", 2)
+			amount, err := strconv.Atoi(amountStr)
+			if len(parts) != 2 || err != nil {
+				return nil, fmt.Errorf("malformed supply field %q: %q", field, amountStr)
+			}
+			day.add(parts[0], parts[1], amount)
+		}
+	}
+	return days, nil
+}
@@ -2,11 +2,15 @@ package bank
 
 import (
 	"errors"
+	"net"
+	"sort"
 	. "testing"
+	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/mrand"
 	"github.com/mediocregopher/mediocre-go-lib/mtest"
 	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/mediocregopher/radix/v3"
 )
 
 func TestPersistentBank(t *T) {
@@ -32,12 +36,18 @@ func TestPersistentBank(t *T) {
 		)
 	}
 
+	// CanTransfer is checked first, and should always agree with Transfer.
 	assertTransfer := func(to, from string, amount int, expDstBalance, expSrcBalance int) massert.Assertion {
+		canErr := bank.CanTransfer(to, from, amount)
 		newDstBalance, newSrcBalance, err := bank.Transfer(to, from, amount)
 		if expDstBalance < 0 || expSrcBalance < 0 {
-			return massert.Equal(true, errors.Is(err, ErrNotEnoughFunds))
+			return massert.All(
+				massert.Equal(true, errors.Is(canErr, ErrNotEnoughFunds)),
+				massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)),
+			)
 		}
 		return massert.All(
+			massert.Nil(canErr),
 			massert.Nil(err),
 			massert.Equal(expDstBalance, newDstBalance),
 			massert.Equal(expSrcBalance, newSrcBalance),
@@ -96,3 +106,656 @@ func TestPersistentBank(t *T) {
 		)
 	})
 }
+
+func TestListAccounts(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		expAccounts := map[string]int{}
+		for i := 1; i <= 25; i++ {
+			userID := mrand.Hex(8)
+			_, err := bank.Incr(userID, i)
+			massert.Require(t, massert.Nil(err))
+			expAccounts[userID] = i
+		}
+
+		accounts := map[string]int{}
+		var cursor string
+		for {
+			page, nextCursor, err := bank.ListAccounts(cursor, 10)
+			massert.Require(t, massert.Nil(err))
+			for _, account := range page {
+				accounts[account.UserID] = account.Balance
+			}
+			if cursor = nextCursor; cursor == "" {
+				break
+			}
+		}
+		massert.Require(t, massert.Equal(expAccounts, accounts))
+	})
+}
+
+func TestTop(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		b := bank.(*redisBank)
+		b.keyPrefix = "test:bank-" + mrand.Hex(8)
+		userA, userB, userC := mrand.Hex(8), mrand.Hex(8), mrand.Hex(8)
+
+		_, err := b.Incr(userA, 10)
+		massert.Require(t, massert.Nil(err))
+		_, err = b.Incr(userB, 5)
+		massert.Require(t, massert.Nil(err))
+		_, _, err = b.Transfer(userC, userA, 7)
+		massert.Require(t, massert.Nil(err))
+		_, err = b.SubmitExport(Export{FromUserID: userB, Amount: 5, Payload: testPayload{Data: "a"}})
+		massert.Require(t, massert.Nil(err))
+		// other currencies aren't included.
+		_, err = b.Incr(CurrencyAccountID(userB, "SEASON"), 100)
+		massert.Require(t, massert.Nil(err))
+
+		expTop := []Account{{UserID: userC, Balance: 7}, {UserID: userA, Balance: 3}}
+		top, err := b.Top(10)
+		massert.Require(t, massert.Nil(err), massert.Equal(expTop, top))
+		top, err = b.Top(1)
+		massert.Require(t, massert.Nil(err), massert.Equal(expTop[:1], top))
+
+		// the index is rebuilt from the balances if it's missing.
+		massert.Require(t, massert.Nil(b.Do(radix.Cmd(nil, "DEL", b.topKey()))))
+		n, err := b.indexTop()
+		massert.Require(t, massert.Nil(err), massert.Equal(2, n))
+		top, err = b.Top(10)
+		massert.Require(t, massert.Nil(err), massert.Equal(expTop, top))
+
+		// equal balances are ordered by user ID, including when only some of
+		// them make the cut.
+		tied := []string{userA, mrand.Hex(8), mrand.Hex(8)}
+		for _, userID := range tied[1:] {
+			_, err := b.Incr(userID, 3)
+			massert.Require(t, massert.Nil(err))
+		}
+		sort.Strings(tied)
+		top, err = b.Top(3)
+		massert.Require(t, massert.Nil(err), massert.Equal([]Account{
+			{UserID: userC, Balance: 7}, {UserID: tied[0], Balance: 3}, {UserID: tied[1], Balance: 3},
+		}, top))
+	})
+}
+
+func TestTransferMulti(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		for _, bank := range []Bank{rb, NewInMem()} {
+			userA, userB, userC := mrand.Hex(8), mrand.Hex(8), mrand.Hex(8)
+			_, err := bank.Incr(userA, 5)
+			massert.Require(t, massert.Nil(err))
+
+			// nothing is transferred if not everything can be.
+			_, _, err = bank.TransferMulti(userA, map[string]int{userB: 3, userC: 3})
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+			balance, err := bank.Balance(userB)
+			massert.Require(t, massert.Nil(err), massert.Equal(0, balance))
+
+			newDstBalances, newSrcBalance, err := bank.TransferMultiWithReason(userA, map[string]int{userB: 3, userC: 1}, JournalSourceGive, "for lunch")
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal(map[string]int{userB: 3, userC: 1}, newDstBalances),
+				massert.Equal(1, newSrcBalance),
+			)
+
+			_, _, err = bank.TransferMulti(userA, map[string]int{userA: 1})
+			massert.Require(t, massert.Not(massert.Nil(err)))
+			_, _, err = bank.TransferMulti(userA, map[string]int{userB: -1})
+			massert.Require(t, massert.Not(massert.Nil(err)))
+
+			// each transfer is journaled, and is in both users' histories.
+			rec, err := Reconcile(bank)
+			massert.Require(t, massert.Nil(err), massert.Length(rec.Discrepancies, 0))
+			history, _, err := bank.History(userA, "", 10)
+			massert.Require(t, massert.Nil(err), massert.Length(history, 3))
+			history, _, err = bank.History(userC, "", 10)
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Length(history, 1),
+				massert.Equal(1, history[0].Amount),
+				massert.Equal(userA, history[0].Counterparty),
+				massert.Equal(JournalSourceGive, history[0].Source),
+				massert.Equal("for lunch", history[0].Reason),
+			)
+		}
+	})
+}
+
+func TestIdempotencyKeys(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		for _, bank := range []ExportingBank{rb, NewInMem()} {
+			userA, userB := mrand.Hex(8), mrand.Hex(8)
+			incrKey, transferKey, multiKey, exportKey := mrand.Hex(8), mrand.Hex(8), mrand.Hex(8), mrand.Hex(8)
+
+			newBalance, err := bank.IncrOnce(incrKey, userA, 5, JournalSourceMint)
+			massert.Require(t, massert.Nil(err), massert.Equal(5, newBalance))
+			_, err = bank.IncrOnce(incrKey, userA, 5, JournalSourceMint)
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+
+			// a key isn't used up by an operation which fails.
+			_, _, err = bank.TransferOnce(transferKey, userB, userA, 6, JournalSourceGive, "")
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+			newDstBalance, newSrcBalance, err := bank.TransferOnce(transferKey, userB, userA, 2, JournalSourceGive, "")
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal(2, newDstBalance),
+				massert.Equal(3, newSrcBalance),
+			)
+			_, _, err = bank.TransferOnce(transferKey, userB, userA, 2, JournalSourceGive, "")
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+
+			_, _, err = bank.TransferMultiOnce(multiKey, userA, map[string]int{userB: 4}, JournalSourceGive, "")
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+			newDstBalances, newSrcBalance, err := bank.TransferMultiOnce(multiKey, userA, map[string]int{userB: 1}, JournalSourceGive, "")
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal(map[string]int{userB: 3}, newDstBalances),
+				massert.Equal(2, newSrcBalance),
+			)
+			_, _, err = bank.TransferMultiOnce(multiKey, userA, map[string]int{userB: 1}, JournalSourceGive, "")
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+
+			export := Export{FromUserID: userA, Amount: 1, Payload: testPayload{Data: "a"}, IdempotencyKey: exportKey}
+			_, err = bank.SubmitExport(export)
+			massert.Require(t, massert.Nil(err))
+			_, err = bank.SubmitExport(export)
+			massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+
+			// an empty key is the same as not giving one.
+			_, err = bank.IncrOnce("", userB, 1, JournalSourceMint)
+			massert.Require(t, massert.Nil(err))
+			_, err = bank.IncrOnce("", userB, 1, JournalSourceMint)
+			massert.Require(t, massert.Nil(err))
+
+			balanceA, err := bank.Balance(userA)
+			massert.Require(t, massert.Nil(err), massert.Equal(1, balanceA))
+			balanceB, err := bank.Balance(userB)
+			massert.Require(t, massert.Nil(err), massert.Equal(5, balanceB))
+		}
+	})
+}
+
+// testHolds runs the basics of holding funds against the given bank.
+func testHolds(t *T, bank Bank) {
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+	season := CurrencyAccountID(userA, "SEASON")
+	for _, userID := range []string{userA, season} {
+		_, err := bank.Incr(userID, 5)
+		massert.Require(t, massert.Nil(err))
+	}
+
+	_, _, err := bank.Hold(userA, 6, 0)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+	holdID, newBalance, err := bank.Hold(userA, 3, 0)
+	massert.Require(t, massert.Nil(err), massert.Equal(2, newBalance))
+
+	// held funds can't be spent, but are still owed to someone.
+	_, _, err = bank.Transfer(userB, userA, 3)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+	held, err := bank.Balance(HoldsAccountID)
+	massert.Require(t, massert.Nil(err), massert.Equal(3, held))
+
+	hold, newDstBalance, err := bank.Capture(holdID, userB)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(holdID, hold.ID),
+		massert.Equal(userA, hold.UserID),
+		massert.Equal(3, hold.Amount),
+		massert.Equal(true, hold.Expires.IsZero()),
+		massert.Equal(3, newDstBalance),
+	)
+	_, _, err = bank.Release(holdID)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrHoldNotFound)))
+
+	// held funds can only be captured to an account of the same currency.
+	holdID, _, err = bank.Hold(season, 1, 0)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = bank.Capture(holdID, userB)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+	hold, newBalance, err = bank.Release(holdID)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(1, hold.Amount),
+		massert.Equal(5, newBalance),
+	)
+
+	// other currencies are held separately, and holds can expire.
+	holdID, _, err = bank.Hold(season, 4, time.Millisecond)
+	massert.Require(t, massert.Nil(err))
+	laterHoldID, _, err := bank.Hold(userA, 1, time.Hour)
+	massert.Require(t, massert.Nil(err))
+	time.Sleep(5 * time.Millisecond)
+	_, _, err = bank.Capture(holdID, CurrencyAccountID(userB, "SEASON"))
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrHoldExpired)))
+	expired, err := bank.ExpiredHolds(time.Now(), 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(expired, 1),
+		massert.Equal(holdID, expired[0].ID),
+		massert.Equal(season, expired[0].UserID),
+		massert.Equal(4, expired[0].Amount),
+	)
+	expired, err = bank.ExpiredHolds(time.Now().Add(2*time.Hour), 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(expired, 2),
+		massert.Equal(laterHoldID, expired[1].ID),
+	)
+	_, _, err = bank.Release(laterHoldID)
+	massert.Require(t, massert.Nil(err))
+
+	held, err = bank.Balance(CurrencyAccountID(HoldsAccountID, "SEASON"))
+	massert.Require(t, massert.Nil(err), massert.Equal(4, held))
+	hold, newBalance, err = bank.Release(holdID)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(season, hold.UserID),
+		massert.Equal(5, newBalance),
+	)
+	_, _, err = bank.Capture(holdID, userB)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrHoldNotFound)))
+	expired, err = bank.ExpiredHolds(time.Now(), 10)
+	massert.Require(t, massert.Nil(err), massert.Length(expired, 0))
+
+	rec, err := Reconcile(bank)
+	massert.Require(t, massert.Nil(err), massert.Length(rec.Discrepancies, 0))
+	history, _, err := bank.History(userB, "", 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(history, 1),
+		massert.Equal(JournalSourceCapture, history[0].Source),
+		massert.Equal(HoldsAccountID, history[0].Counterparty),
+	)
+}
+
+func TestHolds(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testHolds(t, rb)
+		testHolds(t, NewInMem())
+	})
+}
+
+func TestNegativeBalancePolicy(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	assertIncr := func(userID string, by, expBalance, expOwed int) massert.Assertion {
+		newBalance, err := bank.Incr(userID, by)
+		owed, owedErr := bank.Owed(userID)
+		return massert.Comment(massert.All(
+			massert.Nil(err),
+			massert.Nil(owedErr),
+			massert.Equal(expBalance, newBalance),
+			massert.Equal(expOwed, owed),
+		), "by:%d", by)
+	}
+
+	mtest.Run(cmp, t, func() {
+		rb := bank.(*redisBank)
+		rb.keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		rb.negativePolicy = NegativeBalanceClamp
+		userA := mrand.Hex(8)
+		massert.Require(t,
+			assertIncr(userA, 2, 2, 0),
+			assertIncr(userA, -5, 0, 0),
+			assertIncr(userA, 1, 1, 0),
+		)
+
+		rb.negativePolicy, rb.negativeLimit = NegativeBalanceAllow, 3
+		userB := mrand.Hex(8)
+		massert.Require(t,
+			assertIncr(userB, 1, 1, 0),
+			assertIncr(userB, -3, -2, 0),
+			assertIncr(userB, -1, -3, 0),
+		)
+		_, err := bank.Incr(userB, -1)
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+		massert.Require(t, assertIncr(userB, 5, 2, 0))
+
+		rb.negativePolicy = NegativeBalanceOwe
+		userC := mrand.Hex(8)
+		massert.Require(t,
+			assertIncr(userC, 2, 2, 0),
+			assertIncr(userC, -5, 0, 3),
+			assertIncr(userC, -1, 0, 4),
+			assertIncr(userC, 3, 0, 1),
+			assertIncr(userC, 3, 2, 0),
+		)
+
+		// policies apply below the overdraft, rather than below zero.
+		rb.negativePolicy = NegativeBalanceClamp
+		userD := mrand.Hex(8)
+		massert.Require(t,
+			massert.Nil(bank.SetOverdraft(userD, 2)),
+			assertIncr(userD, 1, 1, 0),
+			assertIncr(userD, -5, -2, 0),
+		)
+	})
+}
+
+func testOverdraft(t *T, bank Bank) {
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+	isNotEnoughFunds := func(err error) massert.Assertion {
+		return massert.Equal(true, errors.Is(err, ErrNotEnoughFunds))
+	}
+
+	overdraft, err := bank.Overdraft(userA)
+	massert.Require(t, massert.Nil(err), massert.Equal(0, overdraft))
+	_, _, err = bank.Transfer(userB, userA, 1)
+	massert.Require(t, isNotEnoughFunds(err))
+
+	massert.Require(t, massert.Nil(bank.SetOverdraft(userA, 5)))
+	overdraft, err = bank.Overdraft(userA)
+	massert.Require(t, massert.Nil(err), massert.Equal(5, overdraft))
+
+	newDstBalance, newSrcBalance, err := bank.Transfer(userB, userA, 3)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(3, newDstBalance),
+		massert.Equal(-3, newSrcBalance),
+		massert.Nil(bank.CanTransfer(userB, userA, 2)),
+		isNotEnoughFunds(bank.CanTransfer(userB, userA, 3)),
+	)
+	_, _, err = bank.Transfer(userB, userA, 3)
+	massert.Require(t, isNotEnoughFunds(err))
+
+	// the overdraft is only the user's own, and applies to holds and multiple
+	// transfers too.
+	_, _, err = bank.Transfer(userA, userB, 4)
+	massert.Require(t, isNotEnoughFunds(err))
+	holdID, newBalance, err := bank.Hold(userA, 2, 0)
+	massert.Require(t, massert.Nil(err), massert.Equal(-5, newBalance))
+	_, _, err = bank.Hold(userA, 1, 0)
+	massert.Require(t, isNotEnoughFunds(err))
+	_, newBalance, err = bank.Release(holdID)
+	massert.Require(t, massert.Nil(err), massert.Equal(-3, newBalance))
+	_, newSrcBalance, err = bank.TransferMulti(userA, map[string]int{userB: 2})
+	massert.Require(t, massert.Nil(err), massert.Equal(-5, newSrcBalance))
+	_, _, err = bank.TransferMulti(userA, map[string]int{userB: 1})
+	massert.Require(t, isNotEnoughFunds(err))
+	_, err = bank.Incr(userA, -1)
+	massert.Require(t, isNotEnoughFunds(err))
+
+	// removing it leaves the balance where it is, but it can't go any lower.
+	massert.Require(t, massert.Nil(bank.SetOverdraft(userA, -1)))
+	overdraft, err = bank.Overdraft(userA)
+	massert.Require(t, massert.Nil(err), massert.Equal(0, overdraft))
+	newBalance, err = bank.Incr(userA, 1)
+	massert.Require(t, massert.Nil(err), massert.Equal(-4, newBalance))
+	_, _, err = bank.Transfer(userB, userA, 1)
+	massert.Require(t, isNotEnoughFunds(err))
+}
+
+func TestOverdraft(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testOverdraft(t, rb)
+		testOverdraft(t, NewInMem())
+	})
+}
+
+func testScheduledPayments(t *T, bank Bank) {
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+	_, err := bank.Incr(userA, 5)
+	massert.Require(t, massert.Nil(err))
+
+	now := time.Now()
+	_, err = bank.SchedulePayment(userA, userA, 1, now)
+	massert.Require(t, massert.Equal(true, err != nil))
+	_, err = bank.SchedulePayment(userA, CurrencyAccountID(userB, "SEASON"), 1, now)
+	massert.Require(t, massert.Equal(true, err != nil))
+
+	laterID, err := bank.SchedulePayment(userA, userB, 2, now.Add(time.Hour))
+	massert.Require(t, massert.Nil(err))
+	soonerID, err := bank.SchedulePayment(userA, userB, 4, now)
+	massert.Require(t, massert.Nil(err))
+	tooMuchID, err := bank.SchedulePayment(userA, userB, 10, now)
+	massert.Require(t, massert.Nil(err))
+
+	// nothing is held, or paid, until the payment is made.
+	balance, err := bank.Balance(userA)
+	massert.Require(t, massert.Nil(err), massert.Equal(5, balance))
+	payments, err := bank.ScheduledPayments(userA)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(payments, 3),
+		massert.Equal(laterID, payments[2].ID),
+		massert.Equal(userB, payments[2].DstUserID),
+		massert.Equal(2, payments[2].Amount),
+		massert.Equal(true, payments[2].At.Equal(now.Add(time.Hour).Truncate(time.Millisecond))),
+	)
+	payments, err = bank.ScheduledPayments(userB)
+	massert.Require(t, massert.Nil(err), massert.Length(payments, 0))
+	due, err := bank.DueScheduledPayments(now, 10)
+	massert.Require(t, massert.Nil(err), massert.Length(due, 2))
+
+	p, newDstBalance, newSrcBalance, err := bank.PayScheduledPayment(soonerID)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(soonerID, p.ID),
+		massert.Equal(userA, p.SrcUserID),
+		massert.Equal(4, newDstBalance),
+		massert.Equal(1, newSrcBalance),
+	)
+	_, _, _, err = bank.PayScheduledPayment(soonerID)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrScheduledPaymentNotFound)))
+	_, err = bank.CancelScheduledPayment(soonerID)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrScheduledPaymentNotFound)))
+
+	// a payment which can't be afforded stays scheduled until it's canceled.
+	_, _, _, err = bank.PayScheduledPayment(tooMuchID)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+	p, err = bank.CancelScheduledPayment(tooMuchID)
+	massert.Require(t, massert.Nil(err), massert.Equal(10, p.Amount))
+	_, _, _, err = bank.PayScheduledPayment(tooMuchID)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrScheduledPaymentNotFound)))
+
+	due, err = bank.DueScheduledPayments(now, 10)
+	massert.Require(t, massert.Nil(err), massert.Length(due, 0))
+	payments, err = bank.ScheduledPayments(userA)
+	massert.Require(t, massert.Nil(err), massert.Length(payments, 1))
+
+	history, _, err := bank.History(userB, "", 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(history, 1),
+		massert.Equal(JournalSourceScheduled, history[0].Source),
+		massert.Equal(userA, history[0].Counterparty),
+	)
+}
+
+func TestScheduledPayments(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testScheduledPayments(t, rb)
+		testScheduledPayments(t, NewInMem())
+	})
+}
+
+func testInterest(t *T, bank Bank) {
+	userA, userB, userC := mrand.Hex(8), mrand.Hex(8), mrand.Hex(8)
+	seasonA := CurrencyAccountID(userA, "SEASON")
+	for userID, amount := range map[string]int{userA: 1000, userB: 10, userC: 1000, seasonA: 1000} {
+		_, err := bank.Incr(userID, amount)
+		massert.Require(t, massert.Nil(err))
+	}
+	balanceOf := func(userID string) int {
+		balance, err := bank.Balance(userID)
+		massert.Require(t, massert.Nil(err))
+		return balance
+	}
+
+	_, err := bank.ApplyInterest("", DefaultCurrency, 0)
+	massert.Require(t, massert.Equal(true, err != nil))
+	_, err = bank.ApplyInterest("", DefaultCurrency, -InterestRateScale)
+	massert.Require(t, massert.Equal(true, err != nil))
+
+	// 1% interest, which rounds down to nothing for userB, and doesn't apply
+	// to excluded users or other currencies.
+	key := mrand.Hex(8)
+	changes, err := bank.ApplyInterest(key, DefaultCurrency, InterestRateScale/100, userC)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(10, changes[userA]),
+		massert.Equal(1010, balanceOf(userA)),
+		massert.Equal(10, balanceOf(userB)),
+		massert.Equal(1000, balanceOf(userC)),
+		massert.Equal(1000, balanceOf(seasonA)),
+	)
+	_, inChanges := changes[userB]
+	massert.Require(t, massert.Equal(false, inChanges))
+
+	_, err = bank.ApplyInterest(key, DefaultCurrency, InterestRateScale/100, userC)
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, ErrDuplicate)),
+		massert.Equal(1010, balanceOf(userA)),
+	)
+
+	// 50% demurrage.
+	changes, err = bank.ApplyInterest(mrand.Hex(8), DefaultCurrency, -InterestRateScale/2)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(-505, changes[userA]),
+		massert.Equal(-5, changes[userB]),
+		massert.Equal(-500, changes[userC]),
+		massert.Equal(505, balanceOf(userA)),
+		massert.Equal(5, balanceOf(userB)),
+		massert.Equal(500, balanceOf(userC)),
+	)
+
+	history, _, err := bank.History(userA, "", 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(history, 3),
+		massert.Equal(JournalSourceInterest, history[0].Source),
+		massert.Equal(-505, history[0].Amount),
+		massert.Equal(JournalSourceInterest, history[1].Source),
+		massert.Equal(10, history[1].Amount),
+	)
+}
+
+func TestInterest(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testInterest(t, rb)
+		testInterest(t, NewInMem())
+	})
+}
+
+func testBurn(t *T, bank Bank) {
+	userA := mrand.Hex(8)
+	_, err := bank.IncrAs(userA, 10, JournalSourceDeposit)
+	massert.Require(t, massert.Nil(err))
+
+	massert.Require(t, massert.Equal(true, bank.Burn("", DefaultCurrency, 0) != nil))
+
+	key := mrand.Hex(8)
+	massert.Require(t,
+		massert.Nil(bank.Burn(key, DefaultCurrency, 3)),
+		massert.Equal(true, errors.Is(bank.Burn(key, DefaultCurrency, 3), ErrDuplicate)),
+		massert.Nil(bank.Burn(mrand.Hex(8), "SEASON", 2)),
+	)
+
+	// burns don't touch anyone's balance or history.
+	balance, err := bank.Balance(userA)
+	massert.Require(t, massert.Nil(err), massert.Equal(10, balance))
+	history, _, err := bank.History(userA, "", 10)
+	massert.Require(t, massert.Nil(err), massert.Length(history, 1))
+
+	totals, err := TotalSupply(bank, DefaultCurrency)
+	massert.Require(t, massert.Nil(err), massert.Equal(3, totals.Burned))
+	totals, err = TotalSupply(bank, "SEASON")
+	massert.Require(t, massert.Nil(err), massert.Equal(2, totals.Burned))
+}
+
+func TestBurn(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testBurn(t, rb)
+		testBurn(t, NewInMem())
+	})
+}
+
+func testQuota(t *T, bank Bank) {
+	key := mrand.Hex(8)
+	_, err := bank.UseQuota(key, 1, 10, 0)
+	massert.Require(t, massert.Equal(true, err != nil))
+
+	used, err := bank.UseQuota(key, 4, 10, time.Hour)
+	massert.Require(t, massert.Nil(err), massert.Equal(4, used))
+	used, err = bank.UseQuota(key, 6, 10, time.Hour)
+	massert.Require(t, massert.Nil(err), massert.Equal(10, used))
+	_, err = bank.UseQuota(key, 1, 10, time.Hour)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrQuotaExceeded)))
+
+	// giving back never goes below zero, and other keys are separate.
+	used, err = bank.UseQuota(key, -3, 10, time.Hour)
+	massert.Require(t, massert.Nil(err), massert.Equal(7, used))
+	used, err = bank.UseQuota(key, -20, 10, time.Hour)
+	massert.Require(t, massert.Nil(err), massert.Equal(0, used))
+	used, err = bank.UseQuota(mrand.Hex(8), 10, 10, time.Hour)
+	massert.Require(t, massert.Nil(err), massert.Equal(10, used))
+
+	// once the quota expires it starts again from zero.
+	key = mrand.Hex(8)
+	_, err = bank.UseQuota(key, 10, 10, 100*time.Millisecond)
+	massert.Require(t, massert.Nil(err))
+	time.Sleep(200 * time.Millisecond)
+	used, err = bank.UseQuota(key, 5, 10, 100*time.Millisecond)
+	massert.Require(t, massert.Nil(err), massert.Equal(5, used))
+}
+
+func TestQuota(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testQuota(t, rb)
+		testQuota(t, NewInMem())
+	})
+}
+
+func TestTranslateRedisErr(t *T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	massert.Require(t,
+		massert.Nil(translateRedisErr(nil)),
+		massert.Equal(ErrNotEnoughFunds, translateRedisErr(errors.New(ErrNotEnoughFunds.Error()))),
+		massert.Equal(true, errors.Is(translateRedisErr(netErr), ErrUnavailable)),
+		massert.Equal(false, errors.Is(translateRedisErr(errors.New("ERR syntax error")), ErrUnavailable)),
+	)
+}
@@ -0,0 +1,302 @@
+// Package bench implements a load-testing harness for banks. It runs a mix of
+// Incr, Transfer and SubmitExport operations against a bank.ExportingBank from
+// many goroutines at once, and reports the throughput and latency of each, so
+// that changes to the bank's lua scripts can be checked for performance
+// regressions.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"buckaroo-banzai/bank"
+)
+
+// Names of the operations which are run.
+const (
+	OpIncr         = "Incr"
+	OpTransfer     = "Transfer"
+	OpSubmitExport = "SubmitExport"
+)
+
+// ExportProtocol is the protocol of Exports submitted by Run. Their Payload is
+// a Payload.
+const ExportProtocol = "bench"
+
+// Payload is the Payload of Exports submitted by Run. It's roughly the size
+// of a real withdrawal's, so that encoding it costs about the same.
+type Payload struct {
+	Data string
+}
+
+// ExportProtocol implements the method for bank.ExportPayload.
+func (Payload) ExportProtocol() string { return ExportProtocol }
+
+func init() {
+	bank.RegisterExportProtocol(ExportProtocol, bank.ExportProtocol{
+		Unmarshal: func(b []byte) (bank.ExportPayload, error) {
+			var p Payload
+			err := json.Unmarshal(b, &p)
+			return p, err
+		},
+	})
+}
+
+// Opts describe how Run loads the bank.
+type Opts struct {
+	// Concurrency is how many goroutines run operations at once.
+	Concurrency int
+
+	// Duration is how long operations are run for. Run also stops if its
+	// Context is canceled.
+	Duration time.Duration
+
+	// Users is how many distinct users operations are spread across. Fewer
+	// users means more contention on each one's balance.
+	Users int
+
+	// IncrWeight, TransferWeight and SubmitExportWeight are the relative
+	// frequencies of each operation. An operation with zero weight isn't
+	// run.
+	IncrWeight, TransferWeight, SubmitExportWeight int
+
+	// InitialBalance is given to each user before operations start, so that
+	// Transfers and SubmitExports aren't mostly refused for lack of funds,
+	// which is much cheaper than them succeeding.
+	InitialBalance int
+
+	// UserPrefix is prepended to the ID of every user which is operated on,
+	// so that they don't clash with real ones. Defaults to "bench-".
+	UserPrefix string
+}
+
+func (o Opts) withDefaults() Opts {
+	if o.UserPrefix == "" {
+		o.UserPrefix = "bench-"
+	}
+	return o
+}
+
+func (o Opts) validate() error {
+	if o.Concurrency <= 0 {
+		return errors.New("Concurrency must be greater than 0")
+	} else if o.Duration <= 0 {
+		return errors.New("Duration must be greater than 0")
+	} else if o.Users < 2 {
+		return errors.New("Users must be at least 2, so there's someone to transfer to")
+	} else if o.InitialBalance < 0 {
+		return errors.New("InitialBalance can't be negative")
+	} else if o.IncrWeight < 0 || o.TransferWeight < 0 || o.SubmitExportWeight < 0 {
+		return errors.New("weights can't be negative")
+	} else if o.IncrWeight+o.TransferWeight+o.SubmitExportWeight == 0 {
+		return errors.New("at least one weight must be greater than 0")
+	}
+	return nil
+}
+
+// OpReport describes how one kind of operation performed during a Run.
+type OpReport struct {
+	Op string
+
+	// Count is how many times the operation was run, and Errors is how many
+	// of those returned an error. Running out of funds isn't counted as an
+	// error, since it's expected with a random mix of operations.
+	Count, Errors int
+
+	// Throughput is in operations per second.
+	Throughput float64
+
+	P50, P95, P99, Max time.Duration
+}
+
+// Report describes the results of a Run.
+type Report struct {
+	Opts     Opts
+	Duration time.Duration
+
+	// Ops has an entry for each operation which was run, in the order they
+	// appear in Opts.
+	Ops []OpReport
+}
+
+// WriteTo writes the Report as a human readable table.
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	printf := func(str string, args ...interface{}) error {
+		m, err := fmt.Fprintf(w, str, args...)
+		n += int64(m)
+		return err
+	}
+
+	if err := printf("%d goroutines, %d users, ran for %s\n\n",
+		r.Opts.Concurrency, r.Opts.Users, r.Duration.Round(time.Millisecond)); err != nil {
+		return n, err
+	}
+	if err := printf("%-14s %10s %8s %12s %10s %10s %10s %10s\n",
+		"op", "count", "errors", "ops/sec", "p50", "p95", "p99", "max"); err != nil {
+		return n, err
+	}
+	for _, op := range r.Ops {
+		err := printf("%-14s %10d %8d %12.1f %10s %10s %10s %10s\n",
+			op.Op, op.Count, op.Errors, op.Throughput,
+			op.P50.Round(time.Microsecond), op.P95.Round(time.Microsecond),
+			op.P99.Round(time.Microsecond), op.Max.Round(time.Microsecond))
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// opStats is what a single goroutine records about a single operation.
+type opStats struct {
+	latencies []time.Duration
+	errors    int
+}
+
+type runner struct {
+	b    bank.ExportingBank
+	opts Opts
+
+	// ops is made up of each operation repeated by its weight, so that picking
+	// one at random gives the right mix.
+	ops []string
+}
+
+func (r runner) userN(n int) string {
+	return fmt.Sprintf("%s%d", r.opts.UserPrefix, n)
+}
+
+func (r runner) user(rnd *rand.Rand) string {
+	return r.userN(rnd.Intn(r.opts.Users))
+}
+
+func (r runner) run(op string, rnd *rand.Rand) error {
+	var err error
+	switch op {
+	case OpIncr:
+		_, err = r.b.Incr(r.user(rnd), 1+rnd.Intn(10))
+	case OpTransfer:
+		src, dst := r.user(rnd), r.user(rnd)
+		_, _, err = r.b.Transfer(dst, src, 1+rnd.Intn(5))
+	case OpSubmitExport:
+		_, err = r.b.SubmitExport(bank.Export{
+			FromUserID: r.user(rnd),
+			Amount:     1 + rnd.Intn(5),
+			Payload:    Payload{Data: fmt.Sprintf("%0256x", rnd.Int63())},
+		})
+	default:
+		panic(fmt.Sprintf("unknown op %q", op))
+	}
+	if errors.Is(err, bank.ErrNotEnoughFunds) {
+		return nil
+	}
+	return err
+}
+
+func (r runner) worker(ctx context.Context, seed int64) map[string]*opStats {
+	rnd := rand.New(rand.NewSource(seed))
+	stats := map[string]*opStats{}
+	for ctx.Err() == nil {
+		op := r.ops[rnd.Intn(len(r.ops))]
+		s, ok := stats[op]
+		if !ok {
+			s = new(opStats)
+			stats[op] = s
+		}
+
+		start := time.Now()
+		err := r.run(op, rnd)
+		s.latencies = append(s.latencies, time.Since(start))
+		if err != nil {
+			s.errors++
+		}
+	}
+	return stats
+}
+
+// percentile returns the latency at the given percentile of the sorted
+// latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// Run loads the bank as described by the Opts, returning a Report of how it
+// performed. Exports which are submitted are left in the bank's export stream,
+// and should be consumed by something which can handle the ExportProtocol, or
+// better, Run should be pointed at a bank which is used for nothing else.
+func Run(ctx context.Context, b bank.ExportingBank, opts Opts) (Report, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return Report{}, err
+	}
+
+	r := runner{b: b, opts: opts}
+	allOps := []string{OpIncr, OpTransfer, OpSubmitExport}
+	weights := []int{opts.IncrWeight, opts.TransferWeight, opts.SubmitExportWeight}
+	for i, op := range allOps {
+		for j := 0; j < weights[i]; j++ {
+			r.ops = append(r.ops, op)
+		}
+	}
+
+	if opts.InitialBalance > 0 {
+		for i := 0; i < opts.Users; i++ {
+			if _, err := b.Incr(r.userN(i), opts.InitialBalance); err != nil {
+				return Report{}, fmt.Errorf("giving initial balance to %q: %w", r.userN(i), err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	results := make([]map[string]*opStats, opts.Concurrency)
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.worker(ctx, start.UnixNano()+int64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Opts: opts, Duration: time.Since(start)}
+	for i, op := range allOps {
+		if weights[i] == 0 {
+			continue
+		}
+
+		var latencies []time.Duration
+		opReport := OpReport{Op: op}
+		for _, stats := range results {
+			if s, ok := stats[op]; ok {
+				latencies = append(latencies, s.latencies...)
+				opReport.Errors += s.errors
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		opReport.Count = len(latencies)
+		opReport.Throughput = float64(opReport.Count) / report.Duration.Seconds()
+		opReport.P50 = percentile(latencies, 0.50)
+		opReport.P95 = percentile(latencies, 0.95)
+		opReport.P99 = percentile(latencies, 0.99)
+		opReport.Max = percentile(latencies, 1)
+		report.Ops = append(report.Ops, opReport)
+	}
+	return report, nil
+}
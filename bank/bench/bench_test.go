@@ -0,0 +1,73 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+)
+
+// fakeBank implements the parts of bank.ExportingBank which Run uses, failing
+// every SubmitExport.
+type fakeBank struct {
+	bank.ExportingBank
+
+	l        sync.Mutex
+	balances map[string]int
+}
+
+func (fb *fakeBank) Incr(userID string, by int) (int, error) {
+	fb.l.Lock()
+	defer fb.l.Unlock()
+	fb.balances[userID] += by
+	return fb.balances[userID], nil
+}
+
+func (fb *fakeBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	fb.l.Lock()
+	defer fb.l.Unlock()
+	if fb.balances[srcUserID] < amount {
+		return 0, 0, bank.ErrNotEnoughFunds
+	}
+	fb.balances[srcUserID] -= amount
+	fb.balances[dstUserID] += amount
+	return fb.balances[dstUserID], fb.balances[srcUserID], nil
+}
+
+func (fb *fakeBank) SubmitExport(bank.Export) (string, error) {
+	return "", errors.New("nope")
+}
+
+func TestRun(t *T) {
+	fb := &fakeBank{balances: map[string]int{}}
+	report, err := Run(context.Background(), fb, Opts{
+		Concurrency:        4,
+		Duration:           50 * time.Millisecond,
+		Users:              10,
+		IncrWeight:         1,
+		SubmitExportWeight: 1,
+		InitialBalance:     100,
+	})
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(report.Ops, 2),
+	)
+
+	incr, export := report.Ops[0], report.Ops[1]
+	massert.Require(t,
+		massert.Equal(OpIncr, incr.Op),
+		massert.Equal(0, incr.Errors),
+		massert.Equal(true, incr.Count > 0),
+		massert.Equal(true, incr.Max >= incr.P50),
+		massert.Equal(OpSubmitExport, export.Op),
+		massert.Equal(export.Count, export.Errors),
+	)
+
+	_, err = Run(context.Background(), fb, Opts{Concurrency: 1, Duration: time.Second, Users: 10})
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
@@ -0,0 +1,117 @@
+package bank
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+)
+
+// These benchmarks run against a real redis, like the tests, and report p99
+// latency alongside the usual ns/op. For longer runs with a mix of operations
+// see the bank/bench package, and cmd/bank-bench.
+
+// benchUsers is how many users operations in the benchmarks are spread
+// across.
+const benchUsers = 1000
+
+// benchBank initializes a bank with its own key prefix, for use in a
+// benchmark, returning it and a function which shuts it down. mtest.Run only
+// takes a *T, so the component is initialized directly.
+func benchBank(b *B) (*redisBank, func()) {
+	cmp := mtest.Component()
+	bank := Inst(cmp).(*redisBank)
+	ctx := context.Background()
+	if err := mrun.Init(ctx, cmp); err != nil {
+		b.Fatal(err)
+	}
+	bank.keyPrefix = "test:bench-" + mrand.Hex(8)
+	return bank, func() {
+		if err := mrun.Shutdown(ctx, cmp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchUser(i int) string {
+	return fmt.Sprintf("user-%d", i%benchUsers)
+}
+
+// runParallel is like b.RunParallel, but records the latency of each call to
+// fn and reports the p99. fn is given a number unique to that call.
+func runParallel(b *B, fn func(i int) error) {
+	var l sync.Mutex
+	var latencies []time.Duration
+	var n int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *PB) {
+		var myLatencies []time.Duration
+		for pb.Next() {
+			i := int(atomic.AddInt64(&n, 1))
+			start := time.Now()
+			if err := fn(i); err != nil {
+				b.Fatal(err)
+			}
+			myLatencies = append(myLatencies, time.Since(start))
+		}
+		l.Lock()
+		latencies = append(latencies, myLatencies...)
+		l.Unlock()
+	})
+	b.StopTimer()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99 := latencies[int(float64(len(latencies)-1)*0.99)]
+		b.ReportMetric(float64(p99.Nanoseconds()), "p99-ns/op")
+	}
+}
+
+func BenchmarkIncr(b *B) {
+	bank, shutdown := benchBank(b)
+	defer shutdown()
+	runParallel(b, func(i int) error {
+		_, err := bank.Incr(benchUser(i), 1)
+		return err
+	})
+}
+
+func BenchmarkTransfer(b *B) {
+	bank, shutdown := benchBank(b)
+	defer shutdown()
+	for i := 0; i < benchUsers; i++ {
+		if _, err := bank.Incr(benchUser(i), 1000000); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runParallel(b, func(i int) error {
+		_, _, err := bank.Transfer(benchUser(i+1), benchUser(i), 1)
+		return err
+	})
+}
+
+func BenchmarkSubmitExport(b *B) {
+	bank, shutdown := benchBank(b)
+	defer shutdown()
+	for i := 0; i < benchUsers; i++ {
+		if _, err := bank.Incr(benchUser(i), 1000000); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runParallel(b, func(i int) error {
+		_, err := bank.SubmitExport(Export{
+			FromUserID: benchUser(i),
+			Amount:     1,
+			Payload:    testPayload{Data: mrand.Hex(128)},
+		})
+		return err
+	})
+}
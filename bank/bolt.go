@@ -0,0 +1,1962 @@
+//go:build bolt
+// +build bolt
+
+package bank
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets used by boltBank. Meta, earn caps and stream groups have a
+// nested bucket for each meta key, cap key and stream respectively.
+var (
+	boltBalances      = []byte("balances")
+	boltMeta          = []byte("meta")
+	boltBalanceEvents = []byte("balanceEvents")
+	boltJournal       = []byte("journal")
+	boltIdempotency   = []byte("idempotency")
+	boltHolds         = []byte("holds")
+	boltEarnEvents    = []byte("earnEvents")
+	boltEarnCaps      = []byte("earnCaps")
+	boltEarns         = []byte("earns")
+	boltExports       = []byte("exports")
+	boltStreamGroups  = []byte("streamGroups")
+
+	// boltHistory holds a bucket for each user, keyed by the sequence numbers
+	// of the journal entries which changed their balance.
+	boltHistory = []byte("history")
+
+	// boltGives holds a bucket for each month, keyed by user ID, of what each
+	// user gave, see TopGivers.
+	boltGives = []byte("gives")
+
+	// boltSupply holds a bucket for each day, which holds a bucket for each
+	// direction, keyed by journal source, of how much was moved in that
+	// direction, see Supply.
+	boltSupply = []byte("supply")
+
+	// boltHoldExpiries is keyed by the expiry of each hold which expires
+	// followed by its ID, so that holds are ordered by when they expire.
+	boltHoldExpiries = []byte("holdExpiries")
+
+	// boltOverdrafts is keyed by the ID of each user who has been given their
+	// own overdraft, see SetOverdraft.
+	boltOverdrafts = []byte("overdrafts")
+
+	// boltScheduledPayments holds each scheduled payment JSON encoded, keyed
+	// by its ID, and boltScheduledPaymentTimes is keyed by when each one is to
+	// be made followed by its ID, so that they're ordered by when they're due.
+	boltScheduledPayments     = []byte("scheduledPayments")
+	boltScheduledPaymentTimes = []byte("scheduledPaymentTimes")
+
+	// boltQuotas holds each quota JSON encoded, keyed by its key, see
+	// UseQuota.
+	boltQuotas = []byte("quotas")
+)
+
+// boltBank is an ExportingBank which keeps everything in a single bbolt file,
+// see InstBolt.
+//
+// It's laid out much like sqlBank. The export and earn streams are buckets
+// keyed by sequence number, and each consumer group of a stream has a bucket of
+// the entries it has yet to Ack, along with when each one's claim expires.
+// bbolt only allows one write transaction at a time, so nothing else needs
+// locking.
+type boltBank struct {
+	cmp *mcmp.Component
+	db  *bolt.DB
+
+	// how often consumers check for new entries when there's nothing pending,
+	// and how long an entry stays claimed by a consumer before it's
+	// redelivered.
+	pollInterval time.Duration
+	claimTimeout time.Duration
+
+	negativePolicy string
+	negativeLimit  int
+	overdraft      int
+
+	// optional, where exports trimmed from the file are kept.
+	archive *exportArchive
+}
+
+// boltBalance is how a user's balance is stored in the balances bucket.
+type boltBalance struct {
+	Balance int `json:"balance"`
+	Owed    int `json:"owed,omitempty"`
+}
+
+// boltQuota is how a quota is stored in the quotas bucket.
+type boltQuota struct {
+	Used      int       `json:"used"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// boltJournalEntry is how an entry is stored in the journal bucket, which is
+// keyed by sequence number.
+type boltJournalEntry struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Amount int       `json:"amount"`
+	Source string    `json:"source"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// boltGiveTotal is how a user's GiveTotal is stored in a month's bucket in the
+// gives bucket.
+type boltGiveTotal struct {
+	Amount   int `json:"amount"`
+	NumGives int `json:"numGives"`
+}
+
+// boltStreamEntry is how an entry is stored in the earns and exports buckets.
+type boltStreamEntry struct {
+	Time time.Time       `json:"time"`
+	JSON json.RawMessage `json:"json"`
+}
+
+// InstBolt instantiates an ExportingBank backed by a bbolt database file,
+// which will be configured and initialized when the Init hook is run. It's for
+// tiny deployments, e.g. on a Raspberry Pi, which don't want to run redis or a
+// database, and it's pure Go so it can be cross-compiled. It uses the same
+// "bank" component, and so the same negative-balance params, as Inst does.
+//
+// bbolt holds a lock on the file while it's open, so only one buckaroo
+// instance can use it at a time.
+func InstBolt(parent *mcmp.Component) ExportingBank {
+	cmp := parent.Child("bank")
+	b := &boltBank{cmp: cmp}
+
+	path := mcfg.String(cmp, "path",
+		mcfg.ParamDefault("buckaroo-banzai.bolt"),
+		mcfg.ParamUsage("Path of the bbolt database file, which is created if it doesn't exist"))
+	pollInterval := mcfg.String(cmp, "poll-interval",
+		mcfg.ParamDefault("1s"),
+		mcfg.ParamUsage("How often consumers of exports and earns check for new ones when there aren't any"))
+	claimTimeout := mcfg.String(cmp, "claim-timeout",
+		mcfg.ParamDefault("5m"),
+		mcfg.ParamUsage("How long an export or earn can be held by a consumer without being Ack'd before it's given to another"))
+	negativeBalance := negativeBalanceParams(cmp)
+	archiveDir := mcfg.String(cmp, "archive-dir",
+		mcfg.ParamUsage("Optional directory which exports trimmed from the database are archived to, as daily JSONL files. Archived exports are still included in export history."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if b.pollInterval, err = time.ParseDuration(*pollInterval); err != nil {
+			return fmt.Errorf("parsing poll-interval: %w", err)
+		} else if b.pollInterval <= 0 {
+			return errors.New("poll-interval must be greater than 0")
+		} else if b.claimTimeout, err = time.ParseDuration(*claimTimeout); err != nil {
+			return fmt.Errorf("parsing claim-timeout: %w", err)
+		} else if b.claimTimeout <= 0 {
+			return errors.New("claim-timeout must be greater than 0")
+		} else if b.negativePolicy, b.negativeLimit, b.overdraft, err = negativeBalance(); err != nil {
+			return err
+		}
+		cmp.Annotate("negativeBalancePolicy", b.negativePolicy, "path", *path)
+
+		if *archiveDir != "" {
+			if err := os.MkdirAll(*archiveDir, 0755); err != nil {
+				return fmt.Errorf("creating archive-dir: %w", err)
+			}
+			b.archive = &exportArchive{dir: *archiveDir}
+		}
+
+		// without a timeout Open blocks forever if another process has the
+		// file open.
+		b.db, err = bolt.Open(*path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if errors.Is(err, bolt.ErrTimeout) {
+			return fmt.Errorf("opening %q: it's already open in another process", *path)
+		} else if err != nil {
+			return fmt.Errorf("opening %q: %w", *path, err)
+		}
+		if err := b.createBuckets(); err != nil {
+			return err
+		}
+
+		n, err := b.openJournal()
+		if err != nil {
+			return err
+		} else if n > 0 {
+			mlog.From(cmp).Info("opened journal with existing balances", mctx.Annotate(ctx, "numAccounts", n))
+		}
+		return nil
+	})
+	mrun.ShutdownHook(cmp, func(context.Context) error {
+		if b.db == nil {
+			return nil
+		}
+		return b.db.Close()
+	})
+
+	return b
+}
+
+func (b *boltBank) createBuckets() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			boltBalances, boltMeta, boltBalanceEvents, boltJournal, boltHistory, boltGives, boltSupply,
+			boltIdempotency, boltHolds, boltHoldExpiries, boltEarnEvents, boltEarnCaps, boltEarns, boltExports, boltStreamGroups,
+			boltOverdrafts, boltScheduledPayments, boltScheduledPaymentTimes, boltQuotas,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("creating bucket %q: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// boltID encodes a sequence number as a key, such that keys sort in the same
+// order as their sequence numbers.
+func boltID(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func boltTime(t time.Time) []byte {
+	return boltID(uint64(t.UnixNano()))
+}
+
+func parseBoltTime(v []byte) time.Time {
+	if len(v) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+}
+
+func getBalance(tx *bolt.Tx, userID string) (boltBalance, error) {
+	var bal boltBalance
+	v := tx.Bucket(boltBalances).Get([]byte(userID))
+	if v == nil {
+		return bal, nil
+	} else if err := json.Unmarshal(v, &bal); err != nil {
+		return bal, fmt.Errorf("unmarshaling balance of %q: %w", userID, err)
+	}
+	return bal, nil
+}
+
+// setBalance stores the user's balance, and records a balance event if it
+// changed.
+func setBalance(tx *bolt.Tx, userID string, old, bal boltBalance) error {
+	v, err := json.Marshal(bal)
+	if err != nil {
+		return err
+	} else if err := tx.Bucket(boltBalances).Put([]byte(userID), v); err != nil {
+		return err
+	} else if old.Balance == bal.Balance {
+		return nil
+	}
+
+	events := tx.Bucket(boltBalanceEvents)
+	id, err := events.NextSequence()
+	if err != nil {
+		return err
+	} else if err := events.Put(boltID(id), []byte(userID)); err != nil {
+		return err
+	} else if id%sqlTrimEvery != 0 || id <= balanceEventsMaxLen {
+		return nil
+	}
+	return deleteUpTo(events, id-balanceEventsMaxLen)
+}
+
+// addJournalEntry adds the entry to the journal, unless its Amount is zero,
+// and to the history of each user it's for.
+func addJournalEntry(tx *bolt.Tx, e JournalEntry) error {
+	if e.Amount == 0 {
+		return nil
+	}
+	now := time.Now()
+	v, err := json.Marshal(boltJournalEntry{
+		Time:   now,
+		From:   e.From,
+		To:     e.To,
+		Amount: e.Amount,
+		Source: e.Source,
+		Reason: e.Reason,
+	})
+	if err != nil {
+		return err
+	}
+	journal := tx.Bucket(boltJournal)
+	id, err := journal.NextSequence()
+	if err != nil {
+		return err
+	} else if err := journal.Put(boltID(id), v); err != nil {
+		return err
+	} else if e.Source == JournalSourceOpening {
+		return nil
+	}
+
+	for _, accountID := range []string{e.From, e.To} {
+		if IsLedgerAccount(accountID) {
+			continue
+		}
+		history, err := tx.Bucket(boltHistory).CreateBucketIfNotExists([]byte(accountID))
+		if err != nil {
+			return err
+		} else if err := history.Put(boltID(id), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	if e.Source == JournalSourceGive {
+		if err := addGive(tx, now, e.From, e.Amount); err != nil {
+			return err
+		}
+	}
+	if direction, ok := supplyDirection(e); ok {
+		return addSupply(tx, now, direction, e.Source, e.Amount)
+	}
+	return nil
+}
+
+// addSupply adds the amount moved by the source in the given direction to the
+// day's total.
+func addSupply(tx *bolt.Tx, now time.Time, direction, source string, amount int) error {
+	day, err := tx.Bucket(boltSupply).CreateBucketIfNotExists([]byte(supplyDayStr(now)))
+	if err != nil {
+		return err
+	}
+	totals, err := day.CreateBucketIfNotExists([]byte(direction))
+	if err != nil {
+		return err
+	}
+	var total int
+	if v := totals.Get([]byte(source)); v != nil {
+		if total, err = strconv.Atoi(string(v)); err != nil {
+			return fmt.Errorf("parsing supply total of %q: %w", source, err)
+		}
+	}
+	return totals.Put([]byte(source), []byte(strconv.Itoa(total+amount)))
+}
+
+// addGive adds a give of the given amount to the user's total for the month.
+func addGive(tx *bolt.Tx, now time.Time, userID string, amount int) error {
+	gives, err := tx.Bucket(boltGives).CreateBucketIfNotExists([]byte(givesMonth(now)))
+	if err != nil {
+		return err
+	}
+	var total boltGiveTotal
+	if v := gives.Get([]byte(userID)); v != nil {
+		if err := json.Unmarshal(v, &total); err != nil {
+			return fmt.Errorf("decoding give total of %q: %w", userID, err)
+		}
+	}
+	total.Amount += amount
+	total.NumGives++
+	v, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	return gives.Put([]byte(userID), v)
+}
+
+// openJournal is the equivalent of redisBank's.
+func (b *boltBank) openJournal() (int, error) {
+	var n int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(boltJournal).Cursor().First(); k != nil {
+			return nil
+		}
+		return tx.Bucket(boltBalances).ForEach(func(k, v []byte) error {
+			var bal boltBalance
+			if err := json.Unmarshal(v, &bal); err != nil {
+				return fmt.Errorf("unmarshaling balance of %q: %w", k, err)
+			}
+			e := journalEntry(string(k), bal.Balance, LedgerAccountOpening, JournalSourceOpening)
+			if e.Amount != 0 {
+				n++
+			}
+			return addJournalEntry(tx, e)
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("opening journal in database: %w", err)
+	}
+	return n, nil
+}
+
+// deleteUpTo deletes all entries in the bucket, which must be keyed by
+// boltID, whose IDs are at or below the given one.
+func deleteUpTo(bucket *bolt.Bucket, maxID uint64) error {
+	// deleting while iterating with a cursor can skip entries, so keys are
+	// collected first.
+	var keys [][]byte
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= maxID; k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltBank) Balance(userID string) (int, error) {
+	var bal boltBalance
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		bal, err = getBalance(tx, userID)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving balance from database: %w", err)
+	}
+	return bal.Balance, nil
+}
+
+// useIdempotencyKey is the equivalent of sqlBank's, where boltIdempotency
+// holds the expiry of each key.
+func useIdempotencyKey(tx *bolt.Tx, key string) error {
+	if key == "" {
+		return nil
+	}
+	now := time.Now()
+	keys := tx.Bucket(boltIdempotency)
+	if v := keys.Get([]byte(key)); v != nil && parseBoltTime(v).After(now) {
+		return ErrDuplicate
+	}
+	return keys.Put([]byte(key), boltTime(now.Add(idempotencyKeyTTL)))
+}
+
+func (b *boltBank) Incr(userID string, by int) (int, error) {
+	return b.IncrAs(userID, by, JournalSourceIncr)
+}
+
+func (b *boltBank) IncrAs(userID string, by int, source string) (int, error) {
+	return b.IncrOnce("", userID, by, source)
+}
+
+func (b *boltBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	var newBal boltBalance
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		bal, err := getBalance(tx, userID)
+		if err != nil {
+			return err
+		}
+		minBalance, err := b.minBalance(tx, userID)
+		if err != nil {
+			return err
+		}
+		if newBal.Balance, newBal.Owed, err = applyIncr(b.negativePolicy, b.negativeLimit, minBalance, bal.Balance, bal.Owed, by); err != nil {
+			return err
+		} else if err := setBalance(tx, userID, bal, newBal); err != nil {
+			return err
+		}
+		return addJournalEntry(tx, journalEntry(userID, newBal.Balance-bal.Balance, LedgerAccountIssuance, source))
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("incrementing balance in database: %w", err)
+	}
+	return newBal.Balance, nil
+}
+
+func (b *boltBank) Owed(userID string) (int, error) {
+	var bal boltBalance
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		bal, err = getBalance(tx, userID)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving owed amount from database: %w", err)
+	}
+	return bal.Owed, nil
+}
+
+// overdraftOf returns the user's overdraft, see Bank.Overdraft.
+func (b *boltBank) overdraftOf(tx *bolt.Tx, userID string) (int, error) {
+	v := tx.Bucket(boltOverdrafts).Get([]byte(userID))
+	if v == nil {
+		return b.overdraft, nil
+	}
+	overdraft, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("malformed overdraft %q of %q: %w", v, userID, err)
+	}
+	return overdraft, nil
+}
+
+// minBalance returns the lowest balance which the user can be taken to.
+func (b *boltBank) minBalance(tx *bolt.Tx, userID string) (int, error) {
+	overdraft, err := b.overdraftOf(tx, userID)
+	return -overdraft, err
+}
+
+func (b *boltBank) Overdraft(userID string) (int, error) {
+	var overdraft int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		overdraft, err = b.overdraftOf(tx, userID)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getting overdraft from database: %w", err)
+	}
+	return overdraft, nil
+}
+
+func (b *boltBank) SetOverdraft(userID string, overdraft int) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltOverdrafts)
+		if overdraft < 0 {
+			return bucket.Delete([]byte(userID))
+		}
+		return bucket.Put([]byte(userID), []byte(strconv.Itoa(overdraft)))
+	})
+	if err != nil {
+		return fmt.Errorf("setting overdraft in database: %w", err)
+	}
+	return nil
+}
+
+func (b *boltBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	return b.TransferAs(dstUserID, srcUserID, amount, JournalSourceTransfer)
+}
+
+func (b *boltBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	return b.TransferWithReason(dstUserID, srcUserID, amount, source, "")
+}
+
+func (b *boltBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	return b.TransferOnce("", dstUserID, srcUserID, amount, source, reason)
+}
+
+func (b *boltBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	var newDstBalance, newSrcBalance int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		var err error
+		newDstBalance, newSrcBalance, err = b.transfer(tx, dstUserID, srcUserID, amount, source, reason)
+		return err
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return 0, 0, err
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("transfering amount in database: %w", err)
+	}
+	return newDstBalance, newSrcBalance, nil
+}
+
+// transfer makes a transfer within the given transaction, returning the new
+// balances of the destination and source users.
+func (b *boltBank) transfer(tx *bolt.Tx, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	dst, err := getBalance(tx, dstUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	src, err := getBalance(tx, srcUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dstMin, err := b.minBalance(tx, dstUserID); err != nil {
+		return 0, 0, err
+	} else if srcMin, err := b.minBalance(tx, srcUserID); err != nil {
+		return 0, 0, err
+	} else if src.Balance-amount < srcMin || dst.Balance+amount < dstMin {
+		return 0, 0, ErrNotEnoughFunds
+	}
+
+	// as with transferCmd, transferring to yourself leaves the balance as it
+	// was.
+	if dstUserID == srcUserID {
+		return dst.Balance + amount, src.Balance, nil
+	}
+	newDst, newSrc := dst, src
+	newDst.Balance, newSrc.Balance = dst.Balance+amount, src.Balance-amount
+	if err := setBalance(tx, dstUserID, dst, newDst); err != nil {
+		return 0, 0, err
+	} else if err := setBalance(tx, srcUserID, src, newSrc); err != nil {
+		return 0, 0, err
+	} else if err := addJournalEntry(tx, transferJournalEntry(dstUserID, srcUserID, amount, source, reason)); err != nil {
+		return 0, 0, err
+	}
+	return newDst.Balance, newSrc.Balance, nil
+}
+
+func (b *boltBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	return b.TransferMultiAs(srcUserID, dsts, JournalSourceTransfer)
+}
+
+func (b *boltBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	return b.TransferMultiWithReason(srcUserID, dsts, source, "")
+}
+
+func (b *boltBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	return b.TransferMultiOnce("", srcUserID, dsts, source, reason)
+}
+
+func (b *boltBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	dstUserIDs, err := transferMultiDsts(srcUserID, dsts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	newDstBalances := make(map[string]int, len(dstUserIDs))
+	var newSrcBalance int
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if err := useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		src, err := getBalance(tx, srcUserID)
+		if err != nil {
+			return err
+		}
+		var total int
+		for _, amount := range dsts {
+			total += amount
+		}
+		if srcMin, err := b.minBalance(tx, srcUserID); err != nil {
+			return err
+		} else if newSrcBalance = src.Balance - total; newSrcBalance < srcMin {
+			return ErrNotEnoughFunds
+		}
+
+		for _, dstUserID := range dstUserIDs {
+			dst, err := getBalance(tx, dstUserID)
+			if err != nil {
+				return err
+			}
+			amount := dsts[dstUserID]
+			newDst := dst
+			newDst.Balance = dst.Balance + amount
+			newDstBalances[dstUserID] = newDst.Balance
+			if err := setBalance(tx, dstUserID, dst, newDst); err != nil {
+				return err
+			} else if err := addJournalEntry(tx, transferJournalEntry(dstUserID, srcUserID, amount, source, reason)); err != nil {
+				return err
+			}
+		}
+		newSrc := src
+		newSrc.Balance = newSrcBalance
+		return setBalance(tx, srcUserID, src, newSrc)
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("transfering amounts in database: %w", err)
+	}
+	return newDstBalances, newSrcBalance, nil
+}
+
+// boltHoldExpiryKey returns the hold's key in boltHoldExpiries.
+func boltHoldExpiryKey(hold Hold) []byte {
+	return append(boltTime(hold.Expires), hold.ID...)
+}
+
+func (b *boltBank) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	hold, err := newHold(userID, amount, ttl)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var newBalance int
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		holdsAccount := holdsAccountID(userID)
+		bal, err := getBalance(tx, userID)
+		if err != nil {
+			return err
+		}
+		held, err := getBalance(tx, holdsAccount)
+		if err != nil {
+			return err
+		}
+		if minBalance, err := b.minBalance(tx, userID); err != nil {
+			return err
+		} else if bal.Balance-amount < minBalance {
+			return ErrNotEnoughFunds
+		}
+
+		v, err := json.Marshal(hold)
+		if err != nil {
+			return err
+		} else if err := tx.Bucket(boltHolds).Put([]byte(hold.ID), v); err != nil {
+			return err
+		} else if !hold.Expires.IsZero() {
+			if err := tx.Bucket(boltHoldExpiries).Put(boltHoldExpiryKey(hold), nil); err != nil {
+				return err
+			}
+		}
+		newBal, newHeld := bal, held
+		newBal.Balance, newHeld.Balance = bal.Balance-amount, held.Balance+amount
+		newBalance = newBal.Balance
+		if err := setBalance(tx, userID, bal, newBal); err != nil {
+			return err
+		} else if err := setBalance(tx, holdsAccount, held, newHeld); err != nil {
+			return err
+		}
+		return addJournalEntry(tx, journalEntry(userID, -amount, holdsAccount, JournalSourceHold))
+	})
+	if errors.Is(err, ErrNotEnoughFunds) {
+		return "", 0, err
+	} else if err != nil {
+		return "", 0, fmt.Errorf("holding amount in database: %w", err)
+	}
+	return hold.ID, newBalance, nil
+}
+
+// finishHold is the equivalent of redisBank's, where boltHolds holds each
+// hold JSON encoded.
+func (b *boltBank) finishHold(holdID, dstUserID, source string) (Hold, int, error) {
+	var hold Hold
+	var newBalance int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if hold, err = getHold(tx, holdID); err != nil {
+			return err
+		} else if source == JournalSourceCapture && hold.expired(time.Now()) {
+			return ErrHoldExpired
+		} else if dstUserID == "" {
+			dstUserID = hold.UserID
+		} else if err := checkHoldDst(hold, dstUserID); err != nil {
+			return err
+		}
+		newBalance, err = moveHeld(tx, hold, dstUserID, source)
+		return err
+	})
+	if errors.Is(err, ErrHoldNotFound) || errors.Is(err, ErrHoldExpired) {
+		return Hold{}, 0, err
+	} else if err != nil {
+		return Hold{}, 0, fmt.Errorf("finishing hold in database: %w", err)
+	}
+	return hold, newBalance, nil
+}
+
+// getHold returns the hold with the given ID, or ErrHoldNotFound if there isn't
+// one.
+func getHold(tx *bolt.Tx, holdID string) (Hold, error) {
+	var hold Hold
+	v := tx.Bucket(boltHolds).Get([]byte(holdID))
+	if v == nil {
+		return Hold{}, ErrHoldNotFound
+	} else if err := json.Unmarshal(v, &hold); err != nil {
+		return Hold{}, fmt.Errorf("unmarshaling hold %q: %w", holdID, err)
+	}
+	return hold, nil
+}
+
+// moveHeld deletes the hold and moves its funds to the given user, returning
+// their new balance.
+func moveHeld(tx *bolt.Tx, hold Hold, dstUserID, source string) (int, error) {
+	if err := tx.Bucket(boltHolds).Delete([]byte(hold.ID)); err != nil {
+		return 0, err
+	} else if !hold.Expires.IsZero() {
+		if err := tx.Bucket(boltHoldExpiries).Delete(boltHoldExpiryKey(hold)); err != nil {
+			return 0, err
+		}
+	}
+
+	holdsAccount := holdsAccountID(hold.UserID)
+	dst, err := getBalance(tx, dstUserID)
+	if err != nil {
+		return 0, err
+	}
+	held, err := getBalance(tx, holdsAccount)
+	if err != nil {
+		return 0, err
+	}
+
+	newDst, newHeld := dst, held
+	newDst.Balance, newHeld.Balance = dst.Balance+hold.Amount, held.Balance-hold.Amount
+	if err := setBalance(tx, dstUserID, dst, newDst); err != nil {
+		return 0, err
+	} else if err := setBalance(tx, holdsAccount, held, newHeld); err != nil {
+		return 0, err
+	}
+	return newDst.Balance, addJournalEntry(tx, journalEntry(dstUserID, hold.Amount, holdsAccount, source))
+}
+
+func (b *boltBank) Capture(holdID, dstUserID string) (Hold, int, error) {
+	if dstUserID == "" {
+		return Hold{}, 0, errCaptureNoUser
+	}
+	return b.finishHold(holdID, dstUserID, JournalSourceCapture)
+}
+
+func (b *boltBank) Release(holdID string) (Hold, int, error) {
+	return b.finishHold(holdID, "", JournalSourceRelease)
+}
+
+func (b *boltBank) ExpiredHolds(now time.Time, limit int) ([]Hold, error) {
+	var holds []Hold
+	err := b.db.View(func(tx *bolt.Tx) error {
+		holdsBucket := tx.Bucket(boltHolds)
+		c := tx.Bucket(boltHoldExpiries).Cursor()
+		for k, _ := c.First(); k != nil && len(holds) < limit; k, _ = c.Next() {
+			if parseBoltTime(k[:8]).After(now) {
+				break
+			}
+			holdID := k[8:]
+			var hold Hold
+			if err := json.Unmarshal(holdsBucket.Get(holdID), &hold); err != nil {
+				return fmt.Errorf("unmarshaling hold %q: %w", holdID, err)
+			}
+			holds = append(holds, hold)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting expired holds from database: %w", err)
+	}
+	return holds, nil
+}
+
+// boltScheduledPaymentTimeKey returns the payment's key in
+// boltScheduledPaymentTimes.
+func boltScheduledPaymentTimeKey(p ScheduledPayment) []byte {
+	return append(boltTime(p.At), p.ID...)
+}
+
+func (b *boltBank) SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (string, error) {
+	p, err := newScheduledPayment(srcUserID, dstUserID, amount, at)
+	if err != nil {
+		return "", err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(p)
+		if err != nil {
+			return err
+		} else if err := tx.Bucket(boltScheduledPayments).Put([]byte(p.ID), v); err != nil {
+			return err
+		}
+		return tx.Bucket(boltScheduledPaymentTimes).Put(boltScheduledPaymentTimeKey(p), nil)
+	})
+	if err != nil {
+		return "", fmt.Errorf("scheduling payment in database: %w", err)
+	}
+	return p.ID, nil
+}
+
+// scheduledPaymentsWhere returns scheduled payments which match the given
+// function, soonest first, until one is due after the given time or limit
+// have been found. A zero time or negative limit is no bound. There's no index of payments by user, so finding a user's
+// reads every payment, which is fine at the size of deployment bbolt is for.
+func (b *boltBank) scheduledPaymentsWhere(before time.Time, limit int, fn func(ScheduledPayment) bool) ([]ScheduledPayment, error) {
+	var payments []ScheduledPayment
+	err := b.db.View(func(tx *bolt.Tx) error {
+		paymentsBucket := tx.Bucket(boltScheduledPayments)
+		c := tx.Bucket(boltScheduledPaymentTimes).Cursor()
+		for k, _ := c.First(); k != nil && (limit < 0 || len(payments) < limit); k, _ = c.Next() {
+			if !before.IsZero() && parseBoltTime(k[:8]).After(before) {
+				break
+			}
+			paymentID := k[8:]
+			var p ScheduledPayment
+			if err := json.Unmarshal(paymentsBucket.Get(paymentID), &p); err != nil {
+				return fmt.Errorf("unmarshaling scheduled payment %q: %w", paymentID, err)
+			} else if fn(p) {
+				payments = append(payments, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting scheduled payments from database: %w", err)
+	}
+	return payments, nil
+}
+
+func (b *boltBank) ScheduledPayments(srcUserID string) ([]ScheduledPayment, error) {
+	return b.scheduledPaymentsWhere(time.Time{}, -1, func(p ScheduledPayment) bool {
+		return p.SrcUserID == srcUserID
+	})
+}
+
+func (b *boltBank) DueScheduledPayments(now time.Time, limit int) ([]ScheduledPayment, error) {
+	if limit < 0 {
+		limit = 0
+	}
+	return b.scheduledPaymentsWhere(now, limit, func(ScheduledPayment) bool { return true })
+}
+
+// takeScheduledPayment removes the scheduled payment within the given
+// transaction and returns it.
+func takeScheduledPayment(tx *bolt.Tx, paymentID string) (ScheduledPayment, error) {
+	payments := tx.Bucket(boltScheduledPayments)
+	v := payments.Get([]byte(paymentID))
+	var p ScheduledPayment
+	if v == nil {
+		return ScheduledPayment{}, ErrScheduledPaymentNotFound
+	} else if err := json.Unmarshal(v, &p); err != nil {
+		return ScheduledPayment{}, fmt.Errorf("unmarshaling scheduled payment %q: %w", paymentID, err)
+	} else if err := payments.Delete([]byte(paymentID)); err != nil {
+		return ScheduledPayment{}, err
+	} else if err := tx.Bucket(boltScheduledPaymentTimes).Delete(boltScheduledPaymentTimeKey(p)); err != nil {
+		return ScheduledPayment{}, err
+	}
+	return p, nil
+}
+
+func (b *boltBank) PayScheduledPayment(paymentID string) (ScheduledPayment, int, int, error) {
+	var p ScheduledPayment
+	var newDstBalance, newSrcBalance int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if p, err = takeScheduledPayment(tx, paymentID); err != nil {
+			return err
+		}
+		newDstBalance, newSrcBalance, err = b.transfer(tx, p.DstUserID, p.SrcUserID, p.Amount, JournalSourceScheduled, "")
+		return err
+	})
+	if errors.Is(err, ErrScheduledPaymentNotFound) || errors.Is(err, ErrNotEnoughFunds) {
+		return ScheduledPayment{}, 0, 0, err
+	} else if err != nil {
+		return ScheduledPayment{}, 0, 0, fmt.Errorf("making scheduled payment in database: %w", err)
+	}
+	return p, newDstBalance, newSrcBalance, nil
+}
+
+func (b *boltBank) CancelScheduledPayment(paymentID string) (ScheduledPayment, error) {
+	var p ScheduledPayment
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		p, err = takeScheduledPayment(tx, paymentID)
+		return err
+	})
+	if errors.Is(err, ErrScheduledPaymentNotFound) {
+		return ScheduledPayment{}, err
+	} else if err != nil {
+		return ScheduledPayment{}, fmt.Errorf("canceling scheduled payment in database: %w", err)
+	}
+	return p, nil
+}
+
+func (b *boltBank) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	if err := checkInterestRate(rate); err != nil {
+		return nil, err
+	}
+
+	exclude := interestExclusions(excludeUserIDs)
+	changes := map[string]int{}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+
+		// balances can't be changed while iterating over them, so the
+		// changes are worked out first.
+		var userIDs []string
+		bals := map[string]boltBalance{}
+		err := tx.Bucket(boltBalances).ForEach(func(k, v []byte) error {
+			userID := string(k)
+			if !interestAccount(userID, currency, exclude) {
+				return nil
+			}
+			var bal boltBalance
+			if err := json.Unmarshal(v, &bal); err != nil {
+				return fmt.Errorf("unmarshaling balance of %q: %w", userID, err)
+			} else if change := interestOn(bal.Balance, rate); change != 0 {
+				userIDs = append(userIDs, userID)
+				bals[userID] = bal
+				changes[userID] = change
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, userID := range userIDs {
+			bal, newBal := bals[userID], bals[userID]
+			newBal.Balance += changes[userID]
+			if err := setBalance(tx, userID, bal, newBal); err != nil {
+				return err
+			} else if err := addJournalEntry(tx, journalEntry(userID, changes[userID], LedgerAccountIssuance, JournalSourceInterest)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrDuplicate) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("applying interest in database: %w", err)
+	}
+	return changes, nil
+}
+
+func (b *boltBank) Burn(idempotencyKey, currency string, amount int) error {
+	e, err := burnJournalEntry(currency, amount)
+	if err != nil {
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if err := useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		return addJournalEntry(tx, e)
+	})
+	if errors.Is(err, ErrDuplicate) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("burning in database: %w", err)
+	}
+	return nil
+}
+
+func (b *boltBank) UseQuota(key string, amount, max int, ttl time.Duration) (int, error) {
+	if err := checkQuotaTTL(ttl); err != nil {
+		return 0, err
+	}
+
+	var quota boltQuota
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		quotas := tx.Bucket(boltQuotas)
+		if v := quotas.Get([]byte(key)); v != nil {
+			if err := json.Unmarshal(v, &quota); err != nil {
+				return fmt.Errorf("unmarshaling quota %q: %w", key, err)
+			}
+		}
+		if !quota.ExpiresAt.After(now) {
+			quota = boltQuota{ExpiresAt: now.Add(ttl)}
+		}
+
+		var err error
+		if quota.Used, err = applyQuota(quota.Used, amount, max); err != nil {
+			return err
+		}
+		v, err := json.Marshal(quota)
+		if err != nil {
+			return err
+		}
+		return quotas.Put([]byte(key), v)
+	})
+	if errors.Is(err, ErrQuotaExceeded) {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("using quota in database: %w", err)
+	}
+	return quota.Used, nil
+}
+
+func (b *boltBank) CanTransfer(dstUserID, srcUserID string, amount int) error {
+	dstBalance, err := b.Balance(dstUserID)
+	if err != nil {
+		return err
+	}
+	srcBalance, err := b.Balance(srcUserID)
+	if err != nil {
+		return err
+	}
+	dstOverdraft, err := b.Overdraft(dstUserID)
+	if err != nil {
+		return err
+	}
+	srcOverdraft, err := b.Overdraft(srcUserID)
+	if err != nil {
+		return err
+	} else if srcBalance-amount < -srcOverdraft || dstBalance+amount < -dstOverdraft {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
+// ListAccounts pages through accounts ordered by user ID, with the cursor
+// being the last user ID of the previous page.
+func (b *boltBank) ListAccounts(cursor string, limit int) ([]Account, string, error) {
+	var accounts []Account
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBalances).Cursor()
+		k, v := c.First()
+		if cursor != "" {
+			if k, v = c.Seek([]byte(cursor)); k != nil && string(k) == cursor {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(accounts) < limit; k, v = c.Next() {
+			var bal boltBalance
+			if err := json.Unmarshal(v, &bal); err != nil {
+				return fmt.Errorf("unmarshaling balance of %q: %w", k, err)
+			}
+			accounts = append(accounts, Account{UserID: string(k), Balance: bal.Balance})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("listing balances in database: %w", err)
+	}
+
+	var nextCursor string
+	if len(accounts) > 0 && len(accounts) == limit {
+		nextCursor = accounts[len(accounts)-1].UserID
+	}
+	return accounts, nextCursor, nil
+}
+
+// Top reads every balance, since bolt has no secondary indexes to keep them
+// sorted in.
+func (b *boltBank) Top(n int) ([]Account, error) {
+	var accounts []Account
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBalances).ForEach(func(k, v []byte) error {
+			var bal boltBalance
+			if err := json.Unmarshal(v, &bal); err != nil {
+				return fmt.Errorf("unmarshaling balance of %q: %w", k, err)
+			}
+			accounts = append(accounts, Account{UserID: string(k), Balance: bal.Balance})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting top balances from database: %w", err)
+	}
+	return topAccounts(accounts, n), nil
+}
+
+func (b *boltBank) BalanceEvents(cursor string, limit int) ([]string, string, error) {
+	var after uint64
+	if cursor != "" {
+		var err error
+		if after, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("malformed balance events cursor %q", cursor)
+		}
+	}
+
+	var userIDs []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		events := tx.Bucket(boltBalanceEvents)
+		if cursor == "" {
+			after = events.Sequence()
+			return nil
+		}
+		userIDs = make([]string, 0, limit)
+		c := events.Cursor()
+		for k, v := c.Seek(boltID(after + 1)); k != nil && len(userIDs) < limit; k, v = c.Next() {
+			after = binary.BigEndian.Uint64(k)
+			userIDs = append(userIDs, string(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("getting balance events from database: %w", err)
+	}
+	return userIDs, strconv.FormatUint(after, 10), nil
+}
+
+func (b *boltBank) Journal(cursor string, limit int) ([]JournalEntry, string, error) {
+	var after uint64
+	if cursor != "" {
+		var err error
+		if after, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("malformed journal cursor %q", cursor)
+		}
+	}
+
+	entries := make([]JournalEntry, 0, limit)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltJournal).Cursor()
+		for k, v := c.Seek(boltID(after + 1)); k != nil && len(entries) < limit; k, v = c.Next() {
+			var e boltJournalEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("unmarshaling journal entry: %w", err)
+			}
+			cursor = strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+			entries = append(entries, JournalEntry{
+				ID:     cursor,
+				Time:   e.Time,
+				From:   e.From,
+				To:     e.To,
+				Amount: e.Amount,
+				Source: e.Source,
+				Reason: e.Reason,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("getting journal entries from database: %w", err)
+	}
+	return entries, cursor, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Meta
+
+func (b *boltBank) GetMeta(userID, key string) (string, error) {
+	var value string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if keyBucket := tx.Bucket(boltMeta).Bucket([]byte(key)); keyBucket != nil {
+			value = string(keyBucket.Get([]byte(userID)))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error retrieving meta %q from database: %w", key, err)
+	}
+	return value, nil
+}
+
+func (b *boltBank) SetMeta(userID, key, value string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if value == "" {
+			keyBucket := tx.Bucket(boltMeta).Bucket([]byte(key))
+			if keyBucket == nil {
+				return nil
+			}
+			return keyBucket.Delete([]byte(userID))
+		}
+		keyBucket, err := tx.Bucket(boltMeta).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		return keyBucket.Put([]byte(userID), []byte(value))
+	})
+	if err != nil {
+		return fmt.Errorf("error setting meta %q in database: %w", key, err)
+	}
+	return nil
+}
+
+func (b *boltBank) AllMeta(key string) (map[string]string, error) {
+	values := map[string]string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		keyBucket := tx.Bucket(boltMeta).Bucket([]byte(key))
+		if keyBucket == nil {
+			return nil
+		}
+		return keyBucket.ForEach(func(k, v []byte) error {
+			values[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving all meta %q from database: %w", key, err)
+	}
+	return values, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Streams
+
+// groups returns the bucket holding the consumer groups of the stream, or nil
+// if it has none and the transaction isn't writable.
+func groups(tx *bolt.Tx, stream []byte) (*bolt.Bucket, error) {
+	streamGroups := tx.Bucket(boltStreamGroups)
+	if !tx.Writable() {
+		return streamGroups.Bucket(stream), nil
+	}
+	return streamGroups.CreateBucketIfNotExists(stream)
+}
+
+// ensureGroup creates the consumer group on the stream if it doesn't exist,
+// giving it everything which is already in the stream.
+func (b *boltBank) ensureGroup(stream []byte, group string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		streamGroups, err := groups(tx, stream)
+		if err != nil {
+			return err
+		} else if streamGroups.Bucket([]byte(group)) != nil {
+			return nil
+		}
+		pending, err := streamGroups.CreateBucket([]byte(group))
+		if err != nil {
+			return err
+		}
+		now := boltTime(time.Now())
+		return tx.Bucket(stream).ForEach(func(k, _ []byte) error {
+			return pending.Put(k, now)
+		})
+	})
+}
+
+// addToStream adds the JSON to the stream, and makes it pending for every
+// consumer group of the stream, returning its ID.
+func addToStream(tx *bolt.Tx, stream []byte, jsonB []byte) (uint64, error) {
+	now := time.Now()
+	entry, err := json.Marshal(boltStreamEntry{Time: now.UTC(), JSON: jsonB})
+	if err != nil {
+		return 0, err
+	}
+
+	bucket := tx.Bucket(stream)
+	id, err := bucket.NextSequence()
+	if err != nil {
+		return 0, err
+	} else if err := bucket.Put(boltID(id), entry); err != nil {
+		return 0, err
+	}
+
+	streamGroups, err := groups(tx, stream)
+	if err != nil {
+		return 0, err
+	}
+	return id, streamGroups.ForEach(func(group, _ []byte) error {
+		return streamGroups.Bucket(group).Put(boltID(id), boltTime(now))
+	})
+}
+
+// claim claims the oldest entry pending for the group which isn't claimed by
+// another consumer, returning false if there isn't one.
+func (b *boltBank) claim(stream []byte, group string) (uint64, json.RawMessage, bool, error) {
+	var (
+		id    uint64
+		jsonB json.RawMessage
+		ok    bool
+	)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		streamGroups, err := groups(tx, stream)
+		if err != nil {
+			return err
+		}
+		pending := streamGroups.Bucket([]byte(group))
+		if pending == nil {
+			return fmt.Errorf("consumer group %q doesn't exist", group)
+		}
+
+		now := time.Now()
+		var trimmed [][]byte
+		c := pending.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if parseBoltTime(v).After(now) {
+				continue
+			}
+			entryB := tx.Bucket(stream).Get(k)
+			if entryB == nil {
+				// the entry was trimmed from the stream while it was
+				// pending, which only happens to earns, so there's nothing
+				// to deliver.
+				trimmed = append(trimmed, append([]byte(nil), k...))
+				continue
+			}
+			var entry boltStreamEntry
+			if err := json.Unmarshal(entryB, &entry); err != nil {
+				return fmt.Errorf("unmarshaling entry %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			id, jsonB, ok = binary.BigEndian.Uint64(k), entry.JSON, true
+			break
+		}
+
+		for _, k := range trimmed {
+			if err := pending.Delete(k); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			return nil
+		}
+		return pending.Put(boltID(id), boltTime(now.Add(b.claimTimeout)))
+	})
+	return id, jsonB, ok, err
+}
+
+func (b *boltBank) ack(stream []byte, group string, id uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		streamGroups, err := groups(tx, stream)
+		if err != nil {
+			return err
+		} else if pending := streamGroups.Bucket([]byte(group)); pending != nil {
+			return pending.Delete(boltID(id))
+		}
+		return nil
+	})
+}
+
+// nack makes the entry available to be claimed again straight away.
+func (b *boltBank) nack(stream []byte, group string, id uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		streamGroups, err := groups(tx, stream)
+		if err != nil {
+			return err
+		}
+		pending := streamGroups.Bucket([]byte(group))
+		if pending == nil || pending.Get(boltID(id)) == nil {
+			return nil
+		}
+		return pending.Put(boltID(id), boltTime(time.Now()))
+	})
+}
+
+// consume claims entries from the stream as part of the group and passes
+// them to fn, waiting for pollInterval whenever there are none, until the
+// context is canceled or fn returns an error.
+func (b *boltBank) consume(ctx context.Context, stream []byte, group string, fn func(id uint64, jsonB json.RawMessage) error) error {
+	if err := b.ensureGroup(stream, group); err != nil {
+		return fmt.Errorf("creating consumer group %q: %w", group, err)
+	}
+
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		id, jsonB, ok, err := b.claim(stream, group)
+		if err != nil {
+			return fmt.Errorf("claiming next entry of %q: %w", stream, err)
+		} else if !ok {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if err := fn(id, jsonB); err != nil {
+			return err
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Earns
+
+func (b *boltBank) SubmitEarn(e Earn) (string, error) {
+	if err := checkEarn(e); err != nil {
+		return "", err
+	}
+
+	earnJSON, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Earn %+v: %w", e, err)
+	}
+
+	var id uint64
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		events := tx.Bucket(boltEarnEvents)
+		if v := events.Get([]byte(e.EventID)); v != nil && parseBoltTime(v).After(now) {
+			return ErrDuplicateEarn
+		} else if err := events.Put([]byte(e.EventID), boltTime(now.Add(earnDedupTTL))); err != nil {
+			return err
+		}
+
+		// as with sqlBank, if any cap fails then the whole transaction is
+		// rolled back.
+		for _, earnCap := range e.Caps {
+			if err := applyBoltEarnCap(tx, now, e.Amount, earnCap); err != nil {
+				return err
+			}
+		}
+
+		if id, err = addToStream(tx, boltEarns, earnJSON); err != nil {
+			return err
+		} else if id%sqlTrimEvery != 0 {
+			return nil
+		}
+		return trimBoltEarns(tx, now, id)
+	})
+	if errors.Is(err, ErrDuplicateEarn) || errors.Is(err, ErrEarnCapped) {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("error submitting earn to database: %w", err)
+	}
+	return strconv.FormatUint(id, 10), nil
+}
+
+// applyBoltEarnCap is the equivalent of sqlBank's applyEarnCap, where the cap
+// key's bucket holds the expiry of each of its tokens.
+func applyBoltEarnCap(tx *bolt.Tx, now time.Time, amount int, earnCap EarnCap) error {
+	caps := tx.Bucket(boltEarnCaps)
+	capBucket, err := caps.CreateBucketIfNotExists([]byte(earnCap.Key))
+	if err != nil {
+		return err
+	}
+
+	// all tokens under a key share its expiry, so if one has expired they
+	// all have.
+	if _, v := capBucket.Cursor().First(); v != nil && !parseBoltTime(v).After(now) {
+		if err := caps.DeleteBucket([]byte(earnCap.Key)); err != nil {
+			return err
+		} else if capBucket, err = caps.CreateBucket([]byte(earnCap.Key)); err != nil {
+			return err
+		}
+	}
+
+	if amount <= 0 {
+		if capBucket.Get([]byte(earnCap.Token)) == nil && !earnCap.IgnoreNegative {
+			return ErrEarnCapped
+		}
+		return capBucket.Delete([]byte(earnCap.Token))
+	}
+
+	var tokens [][]byte
+	if err := capBucket.ForEach(func(k, _ []byte) error {
+		tokens = append(tokens, append([]byte(nil), k...))
+		return nil
+	}); err != nil {
+		return err
+	} else if capBucket.Get([]byte(earnCap.Token)) != nil || len(tokens) >= earnCap.Max {
+		return ErrEarnCapped
+	}
+
+	// as with redis, the TTL applies to the whole key.
+	expiresAt := boltTime(now.Add(earnCap.TTL))
+	for _, token := range append(tokens, []byte(earnCap.Token)) {
+		if err := capBucket.Put(token, expiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimBoltEarns removes expired dedup and cap entries, and all but the latest
+// earnsMaxLen earns. As with sqlBank's trimEarns, expired idempotency keys are
+// removed too.
+func trimBoltEarns(tx *bolt.Tx, now time.Time, latestID uint64) error {
+	var expired [][]byte
+	for _, bucket := range []*bolt.Bucket{tx.Bucket(boltEarnEvents), tx.Bucket(boltIdempotency)} {
+		expired = expired[:0]
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if !parseBoltTime(v).After(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	caps := tx.Bucket(boltEarnCaps)
+	expired = expired[:0]
+	if err := caps.ForEach(func(k, _ []byte) error {
+		if _, v := caps.Bucket(k).Cursor().First(); v == nil || !parseBoltTime(v).After(now) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := caps.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+
+	if latestID <= earnsMaxLen {
+		return nil
+	}
+	return deleteUpTo(tx.Bucket(boltEarns), latestID-earnsMaxLen)
+}
+
+func (b *boltBank) ConsumeEarns(ctx context.Context, ch chan<- EarnInProgress) error {
+	return b.consume(ctx, boltEarns, consumeEarnsGroup, func(id uint64, earnJSON json.RawMessage) error {
+		var earn Earn
+		if err := json.Unmarshal(earnJSON, &earn); err != nil {
+			return fmt.Errorf("error unmarshaling Earn %q: %w", earnJSON, err)
+		}
+
+		ch <- EarnInProgress{
+			ID:   strconv.FormatUint(id, 10),
+			Earn: earn,
+			Ack:  func() error { return b.ack(boltEarns, consumeEarnsGroup, id) },
+			Nack: func() error { return b.nack(boltEarns, consumeEarnsGroup, id) },
+		}
+		return nil
+	})
+}
+
+func (b *boltBank) ReplayEarns(since time.Time) error {
+	if err := b.ensureGroup(boltEarns, consumeEarnsGroup); err != nil {
+		return fmt.Errorf("creating earns consumer group: %w", err)
+	}
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		streamGroups, err := groups(tx, boltEarns)
+		if err != nil {
+			return err
+		}
+		pending := streamGroups.Bucket([]byte(consumeEarnsGroup))
+		now := boltTime(time.Now())
+		return tx.Bucket(boltEarns).ForEach(func(k, v []byte) error {
+			var entry boltStreamEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("unmarshaling earn %d: %w", binary.BigEndian.Uint64(k), err)
+			} else if entry.Time.Before(since) || pending.Get(k) != nil {
+				// earns which are still pending are left as they are,
+				// they'll be delivered anyway.
+				return nil
+			}
+			return pending.Put(k, now)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error replaying earns since %s: %w", since, err)
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Exports
+
+func (b *boltBank) SubmitExport(e Export) (string, error) {
+	if e.Amount <= 0 {
+		return "", fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	}
+
+	exportJSON, err := encodeExport(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Export %+v: %w", e, err)
+	}
+
+	var id uint64
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if err := useIdempotencyKey(tx, e.IdempotencyKey); err != nil {
+			return err
+		} else if e.HoldID != "" {
+			hold, err := getHold(tx, e.HoldID)
+			if err != nil {
+				return err
+			} else if err := checkExportHold(e, hold); err != nil {
+				return err
+			} else if _, err := moveHeld(tx, hold, e.FromUserID, JournalSourceRelease); err != nil {
+				return err
+			}
+		}
+		bal, err := getBalance(tx, e.FromUserID)
+		if err != nil {
+			return err
+		} else if e.HoldID == "" && bal.Balance < e.Amount {
+			return ErrNotEnoughFunds
+		}
+		newBal := bal
+		newBal.Balance -= e.Amount
+		if err := setBalance(tx, e.FromUserID, bal, newBal); err != nil {
+			return err
+		} else if err := addJournalEntry(tx, journalEntry(e.FromUserID, -e.Amount, LedgerAccountExports, JournalSourceExport)); err != nil {
+			return err
+		}
+		id, err = addToStream(tx, boltExports, exportJSON)
+		return err
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) || errors.Is(err, ErrHoldNotFound) {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("error submitting export to database: %w", err)
+	}
+	return strconv.FormatUint(id, 10), nil
+}
+
+func (b *boltBank) CanExport(e Export) error {
+	if e.Amount <= 0 {
+		return fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	} else if e.Payload != nil {
+		if _, err := encodeExport(e); err != nil {
+			return fmt.Errorf("could not marshal Export %+v: %w", e, err)
+		}
+	}
+
+	balance, err := b.Balance(e.FromUserID)
+	if err != nil {
+		return err
+	} else if balance < e.Amount {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
+func (b *boltBank) ConsumeExports(ctx context.Context, ch chan<- ExportInProgress) error {
+	return b.ConsumeExportsGroup(ctx, DefaultExportsGroup, ch)
+}
+
+func (b *boltBank) ConsumeExportsGroup(ctx context.Context, group string, ch chan<- ExportInProgress) error {
+	if group == "" {
+		return errors.New("export consumer group can't be empty")
+	}
+
+	return b.consume(ctx, boltExports, group, func(id uint64, exportJSON json.RawMessage) error {
+		export, err := decodeExport(exportJSON)
+		if errors.Is(err, errExportVersion) || errors.Is(err, errExportProtocol) {
+			// there's only ever one instance using the file, so this can only
+			// happen if buckaroo was downgraded. It's left claimed, so that
+			// it's tried again once the claim times out.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error unmarshaling Export %q: %w", exportJSON, err)
+		}
+
+		ch <- ExportInProgress{
+			ID:     strconv.FormatUint(id, 10),
+			Export: export,
+			Ack:    func() error { return b.ack(boltExports, group, id) },
+			Nack:   func() error { return b.nack(boltExports, group, id) },
+		}
+		return nil
+	})
+}
+
+func (b *boltBank) TrimExports(before time.Time) (int, error) {
+	var trimmed int
+	for {
+		var n int
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			// as with redis, if there are no consumer groups then nothing has
+			// been consumed, and nothing is safe to trim.
+			streamGroups, err := groups(tx, boltExports)
+			if err != nil {
+				return err
+			}
+			var pendings []*bolt.Bucket
+			if err := streamGroups.ForEach(func(group, _ []byte) error {
+				pendings = append(pendings, streamGroups.Bucket(group))
+				return nil
+			}); err != nil {
+				return err
+			} else if len(pendings) == 0 {
+				return nil
+			}
+
+			exports := tx.Bucket(boltExports)
+			var archived []archivedExport
+			c := exports.Cursor()
+			for k, v := c.First(); k != nil && len(archived) < trimExportsPageSize; k, v = c.Next() {
+				a, err := decodeBoltArchivedExport(k, v)
+				if err != nil {
+					return err
+				} else if !a.Time.Before(before) || isPending(pendings, k) {
+					continue
+				}
+				archived = append(archived, a)
+			}
+
+			// exports are archived before they're deleted, so if deleting
+			// fails they'll be archived again next time, which ExportHistory
+			// handles.
+			if b.archive != nil && len(archived) > 0 {
+				if err := b.archive.write(archived); err != nil {
+					return fmt.Errorf("archiving exports: %w", err)
+				}
+			}
+			for _, a := range archived {
+				id, _ := strconv.ParseUint(a.ID, 10, 64)
+				if err := exports.Delete(boltID(id)); err != nil {
+					return err
+				}
+			}
+			n = len(archived)
+			return nil
+		})
+		if err != nil {
+			return trimmed, fmt.Errorf("trimming exports: %w", err)
+		} else if n == 0 {
+			return trimmed, nil
+		}
+		trimmed += n
+	}
+}
+
+func isPending(pendings []*bolt.Bucket, k []byte) bool {
+	for _, pending := range pendings {
+		if pending.Get(k) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBoltArchivedExport decodes an entry of the exports bucket.
+func decodeBoltArchivedExport(k, v []byte) (archivedExport, error) {
+	var entry boltStreamEntry
+	if err := json.Unmarshal(v, &entry); err != nil {
+		return archivedExport{}, fmt.Errorf("unmarshaling export %d: %w", binary.BigEndian.Uint64(k), err)
+	}
+	t := entry.Time.UTC()
+	return archivedExport{
+		ID:   strconv.FormatUint(binary.BigEndian.Uint64(k), 10),
+		Time: &t,
+		JSON: entry.JSON,
+	}, nil
+}
+
+func (b *boltBank) ExportHistory(start, end time.Time) ([]ExportRecord, error) {
+	if !start.Before(end) {
+		return nil, errors.New("start must be before end")
+	}
+
+	var records []ExportRecord
+	if b.archive != nil {
+		var err error
+		if records, err = b.archive.read(start, end); err != nil {
+			return nil, err
+		}
+	}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltExports).ForEach(func(k, v []byte) error {
+			a, err := decodeBoltArchivedExport(k, v)
+			if err != nil {
+				return err
+			} else if a.Time.Before(start) || !a.Time.Before(end) {
+				return nil
+			}
+			export, err := decodeExport(a.JSON)
+			if err != nil {
+				return fmt.Errorf("decoding export %q: %w", a.ID, err)
+			}
+			records = append(records, ExportRecord{ID: a.ID, Time: *a.Time, Export: export})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting exports from database: %w", err)
+	}
+
+	// the same export can be in both the archive and the bucket, see
+	// TrimExports.
+	ids := make(map[string]uint64, len(records))
+	deduped := records[:0]
+	for _, record := range records {
+		if _, ok := ids[record.ID]; ok {
+			continue
+		}
+		id, err := strconv.ParseUint(record.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed export ID %q", record.ID)
+		}
+		ids[record.ID] = id
+		deduped = append(deduped, record)
+	}
+	sort.Slice(deduped, func(i, j int) bool {
+		return ids[deduped[i].ID] < ids[deduped[j].ID]
+	})
+	return deduped, nil
+}
+
+// History uses the sequence number of the last entry returned as the cursor,
+// the same as Journal.
+func (b *boltBank) History(userID string, cursor string, limit int) ([]HistoryEntry, string, error) {
+	var before uint64
+	if cursor != "" {
+		var err error
+		if before, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("malformed history cursor %q", cursor)
+		}
+	}
+
+	entries := make([]HistoryEntry, 0, limit)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltHistory).Bucket([]byte(userID))
+		if history == nil {
+			return nil
+		}
+
+		c := history.Cursor()
+		var k []byte
+		if before == 0 {
+			k, _ = c.Last()
+		} else if k, _ = c.Seek(boltID(before)); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		journal := tx.Bucket(boltJournal)
+		for ; k != nil && len(entries) < limit; k, _ = c.Prev() {
+			var e boltJournalEntry
+			if err := json.Unmarshal(journal.Get(k), &e); err != nil {
+				return fmt.Errorf("unmarshaling journal entry: %w", err)
+			}
+			entries = append(entries, historyEntry(userID, JournalEntry{
+				ID:     strconv.FormatUint(binary.BigEndian.Uint64(k), 10),
+				Time:   e.Time,
+				From:   e.From,
+				To:     e.To,
+				Amount: e.Amount,
+				Source: e.Source,
+				Reason: e.Reason,
+			}))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("getting history from database: %w", err)
+	}
+
+	if len(entries) < limit {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].ID, nil
+}
+
+func (b *boltBank) TopGivers(month time.Time, limit int) ([]GiveTotal, error) {
+	var totals []GiveTotal
+	err := b.db.View(func(tx *bolt.Tx) error {
+		gives := tx.Bucket(boltGives).Bucket([]byte(givesMonth(month)))
+		if gives == nil {
+			return nil
+		}
+		return gives.ForEach(func(k, v []byte) error {
+			var total boltGiveTotal
+			if err := json.Unmarshal(v, &total); err != nil {
+				return fmt.Errorf("decoding give total of %q: %w", k, err)
+			}
+			totals = append(totals, GiveTotal{
+				UserID:   string(k),
+				Amount:   total.Amount,
+				NumGives: total.NumGives,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting top givers from database: %w", err)
+	}
+	return topGiveTotals(totals, limit), nil
+}
+
+func (b *boltBank) Supply(since time.Time) ([]SupplyDay, error) {
+	days := newSupplyDays(since, time.Now())
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, day := range days {
+			dayBucket := tx.Bucket(boltSupply).Bucket([]byte(supplyDayStr(day.Day)))
+			if dayBucket == nil {
+				continue
+			}
+			for _, direction := range []string{SupplyIn, SupplyOut} {
+				totals := dayBucket.Bucket([]byte(direction))
+				if totals == nil {
+					continue
+				}
+				err := totals.ForEach(func(k, v []byte) error {
+					amount, err := strconv.Atoi(string(v))
+					if err != nil {
+						return fmt.Errorf("parsing supply total of %q: %w", k, err)
+					}
+					day.add(direction, string(k), amount)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting supply from database: %w", err)
+	}
+	return days, nil
+}
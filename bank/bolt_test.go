@@ -0,0 +1,26 @@
+//go:build bolt
+// +build bolt
+
+package bank
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+)
+
+func TestBoltBank(t *T) {
+	dir, err := ioutil.TempDir("", "bank-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmp := mtest.Component()
+	mtest.Env(cmp, "BANK_PATH", filepath.Join(dir, "bank.bolt"))
+	mtest.Env(cmp, "BANK_POLL_INTERVAL", "10ms")
+	testExportingBank(t, cmp, InstBolt(cmp))
+}
@@ -0,0 +1,48 @@
+package bank
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// JournalSourceBurn is the journal source of the entries made by Burn.
+const JournalSourceBurn = "burn"
+
+// burnJournalEntry returns the entry which Burn records for the given amount
+// of the currency, or an error if the amount can't be burned.
+func burnJournalEntry(currency string, amount int) (JournalEntry, error) {
+	if amount <= 0 {
+		return JournalEntry{}, fmt.Errorf("malformed burn amount %d", amount)
+	}
+	return JournalEntry{
+		From:   CurrencyAccountID(LedgerAccountExports, currency),
+		To:     CurrencyAccountID(LedgerAccountBurned, currency),
+		Amount: amount,
+		Source: JournalSourceBurn,
+	}, nil
+}
+
+// Keys:[journalKey, idempotencyKey] Args:[from, to, amount, source]
+var burnCmd = radix.NewEvalScript(2, `
+	`+checkIdempotencyLua(2)+`
+	`+useIdempotencyLua(2)+`
+	`+journalLua(1, "", "", 0, "ARGV[2]", "tonumber(ARGV[3])", "ARGV[1]", "ARGV[4]", "")+`
+	return 1
+`)
+
+func (b *redisBank) Burn(idempotencyKey, currency string, amount int) error {
+	e, err := burnJournalEntry(currency, amount)
+	if err != nil {
+		return err
+	}
+	err = b.Do(burnCmd.Cmd(nil,
+		b.journalKey(), b.idempotencyKey(idempotencyKey),
+		e.From, e.To, strconv.Itoa(e.Amount), e.Source,
+	))
+	if err != nil {
+		return fmt.Errorf("burning in redis: %w", err)
+	}
+	return nil
+}
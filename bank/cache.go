@@ -0,0 +1,251 @@
+package bank
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// balanceEventsPageSize is how many balance events BalanceCache reads at a
+// time.
+const balanceEventsPageSize = 500
+
+type cachedBalance struct {
+	balance int
+	expires time.Time
+}
+
+// BalanceCache wraps an ExportingBank, caching balances in-process so that
+// surfaces which read a lot of them don't each have to go to the Bank. Cached
+// balances are invalidated when they're changed through the BalanceCache, and
+// when they're changed anywhere else once Sync has seen the change in the
+// Bank's BalanceEvents. In case Sync falls behind, or isn't running, cached
+// balances also expire after a TTL.
+//
+// All other methods go straight to the wrapped ExportingBank.
+type BalanceCache struct {
+	ExportingBank
+	ttl time.Duration
+
+	l        sync.Mutex
+	balances map[string]cachedBalance
+	cursor   string
+}
+
+// NewBalanceCache returns a BalanceCache wrapping the given ExportingBank,
+// whose cached balances expire after the given TTL.
+func NewBalanceCache(b ExportingBank, ttl time.Duration) *BalanceCache {
+	return &BalanceCache{
+		ExportingBank: b,
+		ttl:           ttl,
+		balances:      map[string]cachedBalance{},
+	}
+}
+
+func (c *BalanceCache) invalidate(userIDs ...string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	for _, userID := range userIDs {
+		delete(c.balances, userID)
+	}
+}
+
+// Balance returns the user's cached balance, or gets it from the Bank and
+// caches it if it isn't cached.
+func (c *BalanceCache) Balance(userID string) (int, error) {
+	now := time.Now()
+	c.l.Lock()
+	cached, ok := c.balances[userID]
+	c.l.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.balance, nil
+	}
+
+	balance, err := c.ExportingBank.Balance(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	c.l.Lock()
+	c.balances[userID] = cachedBalance{balance: balance, expires: now.Add(c.ttl)}
+	c.l.Unlock()
+	return balance, nil
+}
+
+// Incr implements the method for Bank, invalidating the user's balance.
+func (c *BalanceCache) Incr(userID string, by int) (int, error) {
+	defer c.invalidate(userID)
+	return c.ExportingBank.Incr(userID, by)
+}
+
+// Transfer implements the method for Bank, invalidating both users' balances.
+func (c *BalanceCache) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	defer c.invalidate(dstUserID, srcUserID)
+	return c.ExportingBank.Transfer(dstUserID, srcUserID, amount)
+}
+
+// IncrAs implements the method for Bank, invalidating the user's balance.
+func (c *BalanceCache) IncrAs(userID string, by int, source string) (int, error) {
+	defer c.invalidate(userID)
+	return c.ExportingBank.IncrAs(userID, by, source)
+}
+
+// TransferAs implements the method for Bank, invalidating both users'
+// balances.
+func (c *BalanceCache) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	defer c.invalidate(dstUserID, srcUserID)
+	return c.ExportingBank.TransferAs(dstUserID, srcUserID, amount, source)
+}
+
+// TransferMulti implements the method for Bank, invalidating every user's
+// balance.
+func (c *BalanceCache) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	return c.TransferMultiAs(srcUserID, dsts, JournalSourceTransfer)
+}
+
+// TransferMultiAs implements the method for Bank, invalidating every user's
+// balance.
+func (c *BalanceCache) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	userIDs := []string{srcUserID}
+	for dstUserID := range dsts {
+		userIDs = append(userIDs, dstUserID)
+	}
+	defer c.invalidate(userIDs...)
+	return c.ExportingBank.TransferMultiAs(srcUserID, dsts, source)
+}
+
+// TransferWithReason implements the method for Bank, invalidating both users'
+// balances.
+func (c *BalanceCache) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	defer c.invalidate(dstUserID, srcUserID)
+	return c.ExportingBank.TransferWithReason(dstUserID, srcUserID, amount, source, reason)
+}
+
+// TransferMultiWithReason implements the method for Bank, invalidating every
+// user's balance.
+func (c *BalanceCache) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	userIDs := []string{srcUserID}
+	for dstUserID := range dsts {
+		userIDs = append(userIDs, dstUserID)
+	}
+	defer c.invalidate(userIDs...)
+	return c.ExportingBank.TransferMultiWithReason(srcUserID, dsts, source, reason)
+}
+
+// IncrOnce implements the method for Bank, invalidating the user's balance.
+func (c *BalanceCache) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	defer c.invalidate(userID)
+	return c.ExportingBank.IncrOnce(idempotencyKey, userID, by, source)
+}
+
+// TransferOnce implements the method for Bank, invalidating both users'
+// balances.
+func (c *BalanceCache) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	defer c.invalidate(dstUserID, srcUserID)
+	return c.ExportingBank.TransferOnce(idempotencyKey, dstUserID, srcUserID, amount, source, reason)
+}
+
+// TransferMultiOnce implements the method for Bank, invalidating every user's
+// balance.
+func (c *BalanceCache) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	userIDs := []string{srcUserID}
+	for dstUserID := range dsts {
+		userIDs = append(userIDs, dstUserID)
+	}
+	defer c.invalidate(userIDs...)
+	return c.ExportingBank.TransferMultiOnce(idempotencyKey, srcUserID, dsts, source, reason)
+}
+
+// Hold implements the method for Bank, invalidating the user's balance.
+func (c *BalanceCache) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	defer c.invalidate(userID)
+	return c.ExportingBank.Hold(userID, amount, ttl)
+}
+
+// Capture implements the method for Bank, invalidating the balances of the
+// user the funds were held from and the one they were captured to.
+func (c *BalanceCache) Capture(holdID, dstUserID string) (Hold, int, error) {
+	hold, newDstBalance, err := c.ExportingBank.Capture(holdID, dstUserID)
+	c.invalidate(dstUserID, hold.UserID)
+	return hold, newDstBalance, err
+}
+
+// Release implements the method for Bank, invalidating the balance of the
+// user the funds were held from.
+func (c *BalanceCache) Release(holdID string) (Hold, int, error) {
+	hold, newBalance, err := c.ExportingBank.Release(holdID)
+	c.invalidate(hold.UserID)
+	return hold, newBalance, err
+}
+
+// PayScheduledPayment implements the method for Bank, invalidating the
+// balances of the payment's source and destination users.
+func (c *BalanceCache) PayScheduledPayment(paymentID string) (ScheduledPayment, int, int, error) {
+	p, newDstBalance, newSrcBalance, err := c.ExportingBank.PayScheduledPayment(paymentID)
+	c.invalidate(p.DstUserID, p.SrcUserID)
+	return p, newDstBalance, newSrcBalance, err
+}
+
+// ApplyInterest implements the method for Bank, invalidating the balance of
+// every user it changed.
+func (c *BalanceCache) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	changes, err := c.ExportingBank.ApplyInterest(idempotencyKey, currency, rate, excludeUserIDs...)
+	userIDs := make([]string, 0, len(changes))
+	for userID := range changes {
+		userIDs = append(userIDs, userID)
+	}
+	c.invalidate(userIDs...)
+	return changes, err
+}
+
+// SubmitExport implements the method for ExportingBank, invalidating the
+// user's balance.
+func (c *BalanceCache) SubmitExport(e Export) (string, error) {
+	defer c.invalidate(e.FromUserID)
+	return c.ExportingBank.SubmitExport(e)
+}
+
+// Sync reads all BalanceEvents which have happened since it was last called,
+// and invalidates the balances of the users they're for. It should be called
+// periodically. The first call only establishes where to read from, and
+// invalidates nothing.
+func (c *BalanceCache) Sync() error {
+	c.l.Lock()
+	cursor := c.cursor
+	c.l.Unlock()
+
+	for {
+		userIDs, nextCursor, err := c.ExportingBank.BalanceEvents(cursor, balanceEventsPageSize)
+		if err != nil {
+			return fmt.Errorf("reading balance events: %w", err)
+		}
+
+		c.invalidate(userIDs...)
+		c.l.Lock()
+		c.cursor = nextCursor
+		c.l.Unlock()
+
+		if len(userIDs) < balanceEventsPageSize {
+			return nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// Run calls Sync every interval until the Context is canceled, calling onErr
+// with any errors it returns.
+func (c *BalanceCache) Run(ctx context.Context, interval time.Duration, onErr func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sync(); err != nil {
+			onErr(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package bank
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestBalanceEvents(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+		_, cursor, err := bank.BalanceEvents("", 10)
+		massert.Require(t, massert.Nil(err))
+
+		_, err = bank.Incr(userA, 2)
+		massert.Require(t, massert.Nil(err))
+		_, _, err = bank.Transfer(userB, userA, 1)
+		massert.Require(t, massert.Nil(err))
+
+		// a refused Incr doesn't change anything
+		_, err = bank.Incr(userB, -5)
+		massert.Require(t, massert.Not(massert.Nil(err)))
+
+		userIDs, cursor, err := bank.BalanceEvents(cursor, 2)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal([]string{userA, userB}, userIDs),
+		)
+
+		userIDs, cursor, err = bank.BalanceEvents(cursor, 2)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal([]string{userA}, userIDs),
+		)
+
+		userIDs, _, err = bank.BalanceEvents(cursor, 2)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(userIDs, 0),
+		)
+	})
+}
+
+func TestBalanceCache(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+		// two caches of the same bank, as if on two different instances.
+		cacheA := NewBalanceCache(bank, time.Hour)
+		cacheB := NewBalanceCache(bank, time.Hour)
+		massert.Require(t,
+			massert.Nil(cacheA.Sync()),
+			massert.Nil(cacheB.Sync()),
+		)
+
+		assertBalance := func(c *BalanceCache, userID string, exp int) massert.Assertion {
+			balance, err := c.Balance(userID)
+			return massert.All(massert.Nil(err), massert.Equal(exp, balance))
+		}
+
+		massert.Require(t,
+			assertBalance(cacheA, userA, 0),
+			assertBalance(cacheB, userA, 0),
+		)
+
+		// changes made through a cache are seen by it straight away, but only
+		// by the other once it's synced.
+		_, err := cacheA.Incr(userA, 3)
+		massert.Require(t,
+			massert.Nil(err),
+			assertBalance(cacheA, userA, 3),
+			assertBalance(cacheB, userA, 0),
+		)
+		massert.Require(t, massert.Nil(cacheB.Sync()))
+		massert.Require(t, assertBalance(cacheB, userA, 3))
+
+		_, _, err = cacheB.Transfer(userB, userA, 1)
+		massert.Require(t,
+			massert.Nil(err),
+			assertBalance(cacheB, userA, 2),
+			assertBalance(cacheB, userB, 1),
+			massert.Nil(cacheA.Sync()),
+		)
+		massert.Require(t,
+			assertBalance(cacheA, userA, 2),
+			assertBalance(cacheA, userB, 1),
+		)
+	})
+}
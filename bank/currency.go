@@ -0,0 +1,40 @@
+package bank
+
+import "strings"
+
+// DefaultCurrency is the code of the currency which an account ID holds a
+// balance in when it isn't for any other currency, i.e. the one buckaroo was
+// originally written for.
+const DefaultCurrency = ""
+
+// currencyAccountPrefix prefixes the IDs of accounts which hold a balance in a
+// currency other than the DefaultCurrency.
+const currencyAccountPrefix = "$"
+
+// CurrencyAccountID returns the ID of the account which holds the balance, in
+// the given currency, of whoever owns the given account ID. Each currency
+// being its own account means that everything which takes an account ID, e.g.
+// Balance, Transfer and Export's FromUserID, works on any currency. It's up to
+// the caller to not move funds between accounts of different currencies.
+//
+// The DefaultCurrency's account is the account ID itself, so balances from
+// before there were other currencies are left where they were.
+func CurrencyAccountID(accountID, currency string) string {
+	if currency == DefaultCurrency {
+		return accountID
+	}
+	return currencyAccountPrefix + currency + ":" + accountID
+}
+
+// SplitCurrencyAccountID is the inverse of CurrencyAccountID, returning the
+// account ID and currency which the given ID holds the balance of.
+func SplitCurrencyAccountID(id string) (accountID, currency string) {
+	if !strings.HasPrefix(id, currencyAccountPrefix) {
+		return id, DefaultCurrency
+	}
+	parts := strings.SplitN(strings.TrimPrefix(id, currencyAccountPrefix), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return id, DefaultCurrency
+	}
+	return parts[1], parts[0]
+}
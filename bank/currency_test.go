@@ -0,0 +1,40 @@
+package bank
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestCurrencyAccountID(t *T) {
+	type test struct {
+		accountID, currency, exp string
+	}
+
+	for _, test := range []test{
+		{"U1", DefaultCurrency, "U1"},
+		{"T1:U1", DefaultCurrency, "T1:U1"},
+		{"U1", "SEASON", "$SEASON:U1"},
+		{"T1:U1", "SEASON", "$SEASON:T1:U1"},
+	} {
+		id := CurrencyAccountID(test.accountID, test.currency)
+		accountID, currency := SplitCurrencyAccountID(id)
+		massert.Require(t,
+			massert.Equal(test.exp, id),
+			massert.Equal(test.accountID, accountID),
+			massert.Equal(test.currency, currency),
+		)
+	}
+
+	// each currency's balance is its own.
+	b := NewInMem()
+	_, err := b.Incr("U1", 5)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.Incr(CurrencyAccountID("U1", "SEASON"), 2)
+	massert.Require(t, massert.Nil(err))
+
+	balance, err := b.Balance("U1")
+	massert.Require(t, massert.Nil(err), massert.Equal(5, balance))
+	balance, err = b.Balance(CurrencyAccountID("U1", "SEASON"))
+	massert.Require(t, massert.Nil(err), massert.Equal(2, balance))
+}
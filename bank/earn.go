@@ -0,0 +1,286 @@
+package bank
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mdb/mredis"
+	"github.com/mediocregopher/radix/v3"
+)
+
+var (
+	// ErrDuplicateEarn is returned from SubmitEarn when an Earn with the same
+	// EventID has already been submitted.
+	ErrDuplicateEarn = errors.New("earn has already been submitted")
+
+	// ErrEarnCapped is returned from SubmitEarn when an Earn wasn't submitted
+	// due to its EarnCap.
+	ErrEarnCapped = errors.New("earn is capped")
+)
+
+// earnDedupTTL is how long an Earn's EventID is remembered for, for the purpose
+// of suppressing duplicates.
+const earnDedupTTL = 24 * time.Hour
+
+// earnsMaxLen is roughly how many Earns are kept in the journal, older ones
+// are discarded.
+const earnsMaxLen = 1000000
+
+// Earn describes a change to a user's balance which was caused by some
+// external event, e.g. a reaction being added to or removed from one of their
+// messages.
+type Earn struct {
+	// EventID uniquely identifies the event which caused the Earn, and is used
+	// to suppress duplicates.
+	EventID string
+
+	UserID string
+
+	// Amount may be negative, e.g. if a reaction was removed.
+	Amount int
+
+	// Caps are optional, and are only checked when the Earn is submitted. The
+	// Earn is capped if any one of them caps it, in which case none of them
+	// are changed. There can be at most maxEarnCaps of them.
+	Caps []EarnCap `json:"-"`
+}
+
+// maxEarnCaps is the most EarnCaps an Earn can have.
+const maxEarnCaps = 3
+
+// EarnCap limits how many Earns with a positive Amount can be outstanding for
+// some key at a time, e.g. so that a user reacting to the same message multiple
+// times only earns its author so much.
+//
+// Each Earn under a key has a Token (e.g. the reaction's emoji). An Earn with a
+// positive Amount is capped if Max other Tokens under the key are outstanding.
+// An Earn with a negative Amount is capped unless its Token is outstanding,
+// and it then stops being so.
+type EarnCap struct {
+	Key, Token string
+	Max        int
+
+	// TTL is how long the key is remembered for after the last positive Earn
+	// under it. Once it's forgotten Earns under it aren't capped at all.
+	TTL time.Duration
+
+	// IgnoreNegative means Earns with a negative Amount are never capped by
+	// this EarnCap, though they still stop their Token being outstanding. It's
+	// for caps whose Key changes over time, e.g. one per hour, where the
+	// positive Earn being taken back may have been counted under an older Key.
+	IgnoreNegative bool
+}
+
+// Annotate returns the given Context annotated with information about the
+// Earn.
+func (e Earn) Annotate(ctx context.Context) context.Context {
+	return mctx.Annotate(ctx,
+		"earnEventID", e.EventID,
+		"earnUserID", e.UserID,
+		"earnAmount", e.Amount,
+	)
+}
+
+// EarnInProgress describes an Earn which has yet to be successfully applied.
+type EarnInProgress struct {
+	ID string
+	Earn
+
+	// Ack and Nack work the same as they do on ExportInProgress.
+	Ack, Nack func() error
+}
+
+// Annotate returns the given Context annotated with information about the
+// EarnInProgress.
+func (ep EarnInProgress) Annotate(ctx context.Context) context.Context {
+	ctx = ep.Earn.Annotate(ctx)
+	return mctx.Annotate(ctx, "earnID", ep.ID)
+}
+
+// EarnJournal describes a durable journal of Earns. Earns are written to the
+// journal before being applied to the Bank, so that they aren't lost if
+// applying them fails, and so that they can be replayed if they were applied
+// incorrectly.
+type EarnJournal interface {
+	// SubmitEarn records that an Earn should be applied and returns a unique
+	// identifier for it. All submitted Earns will be made available via
+	// ConsumeEarns at least once. If an Earn with the same EventID was
+	// submitted recently then ErrDuplicateEarn is returned, and if the Earn's
+	// Cap prevents it then ErrEarnCapped is.
+	SubmitEarn(Earn) (string, error)
+
+	// ConsumeEarns writes submitted Earns into the given channel. It behaves
+	// the same as ConsumeExports.
+	ConsumeEarns(context.Context, chan<- EarnInProgress) error
+
+	// ReplayEarns causes all Earns submitted since the given time to be
+	// written to ConsumeEarns again, whether or not they were already Ack'd.
+	ReplayEarns(since time.Time) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (b *redisBank) earnsKey() string {
+	return b.key("earns")
+}
+
+func (b *redisBank) earnEventKey(eventID string) string {
+	return b.key("earn-events:" + eventID)
+}
+
+func (b *redisBank) earnCapKey(capKey string) string {
+	return b.key("earn-caps:" + capKey)
+}
+
+const consumeEarnsGroup = "redisBank.ConsumeEarns"
+
+// Keys:[eventKey, streamKey, capKeys...] Args:[ttlSeconds, maxLen, earnJSON, amount, capArgs...]
+//
+// There are always maxEarnCaps capKeys, an empty one meaning there's no cap in
+// that slot. capArgs are capToken, capMax, capTTLSeconds, capIgnoreNegative
+// for each capKey.
+var submitEarnCmd = radix.NewEvalScript(2+maxEarnCaps, `
+	if not redis.call("SET", KEYS[1], "1", "NX", "EX", ARGV[1]) then
+		return redis.error_reply("`+ErrDuplicateEarn.Error()+`")
+	end
+
+	local amount = tonumber(ARGV[4])
+
+	-- all caps are checked before any are changed, so that a capped earn
+	-- leaves them all as they were.
+	for i = 3, #KEYS do
+		local arg = 4 + (i-3)*4
+		if KEYS[i] ~= "" then
+			if amount > 0 then
+				if redis.call("SISMEMBER", KEYS[i], ARGV[arg+1]) == 1 or
+					redis.call("SCARD", KEYS[i]) >= tonumber(ARGV[arg+2]) then
+					return redis.error_reply("`+ErrEarnCapped.Error()+`")
+				end
+			elseif ARGV[arg+4] == "" and redis.call("SISMEMBER", KEYS[i], ARGV[arg+1]) == 0 then
+				return redis.error_reply("`+ErrEarnCapped.Error()+`")
+			end
+		end
+	end
+
+	for i = 3, #KEYS do
+		local arg = 4 + (i-3)*4
+		if KEYS[i] ~= "" then
+			if amount > 0 then
+				redis.call("SADD", KEYS[i], ARGV[arg+1])
+				redis.call("EXPIRE", KEYS[i], ARGV[arg+3])
+			else
+				redis.call("SREM", KEYS[i], ARGV[arg+1])
+			end
+		end
+	end
+
+	return redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[2], "*", "json", ARGV[3])
+`)
+
+// checkEarn returns an error if the Earn can't be submitted.
+func checkEarn(e Earn) error {
+	if e.EventID == "" {
+		return errors.New("Earn.EventID is required")
+	} else if len(e.Caps) > maxEarnCaps {
+		return fmt.Errorf("Earn can't have more than %d Caps", maxEarnCaps)
+	}
+	return nil
+}
+
+func (b *redisBank) SubmitEarn(e Earn) (string, error) {
+	if err := checkEarn(e); err != nil {
+		return "", err
+	}
+
+	earnJSON, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Earn %+v: %w", e, err)
+	}
+
+	capKeys := make([]string, maxEarnCaps)
+	capArgs := make([]string, 4*maxEarnCaps)
+	for i, earnCap := range e.Caps {
+		capKeys[i] = b.earnCapKey(earnCap.Key)
+		capArgs[i*4] = earnCap.Token
+		capArgs[i*4+1] = strconv.Itoa(earnCap.Max)
+		capArgs[i*4+2] = strconv.Itoa(int(earnCap.TTL.Seconds()))
+		if earnCap.IgnoreNegative {
+			capArgs[i*4+3] = "1"
+		}
+	}
+
+	args := append([]string{b.earnEventKey(e.EventID), b.earnsKey()}, capKeys...)
+	args = append(args,
+		strconv.Itoa(int(earnDedupTTL.Seconds())), strconv.Itoa(earnsMaxLen),
+		string(earnJSON), strconv.Itoa(e.Amount),
+	)
+	args = append(args, capArgs...)
+
+	var id radix.StreamEntryID
+	if err := b.Do(submitEarnCmd.Cmd(&id, args...)); err != nil {
+		switch err.Error() {
+		case ErrDuplicateEarn.Error():
+			return "", ErrDuplicateEarn
+		case ErrEarnCapped.Error():
+			return "", ErrEarnCapped
+		}
+		return "", fmt.Errorf("error performing earn command in redis: %w", err)
+	}
+	return id.String(), nil
+}
+
+func (b *redisBank) ConsumeEarns(ctx context.Context, ch chan<- EarnInProgress) error {
+	reader := mredis.NewStream(b.Redis, mredis.StreamOpts{
+		Key:           b.earnsKey(),
+		Group:         consumeEarnsGroup,
+		Consumer:      b.instanceID,
+		Block:         b.blockTimeout,
+		InitialCursor: "0",
+	})
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return ctx.Err()
+		}
+
+		entry, ok, err := reader.Next()
+		if err != nil {
+			return fmt.Errorf("error consuming next Earn from stream: %w", err)
+		} else if !ok {
+			continue
+		}
+
+		earnJSONStr := entry.Fields["json"]
+		var earn Earn
+		if err := json.Unmarshal([]byte(earnJSONStr), &earn); err != nil {
+			return fmt.Errorf("error unmarshaling Earn %q: %w", earnJSONStr, err)
+		}
+
+		ch <- EarnInProgress{
+			ID:   entry.ID.String(),
+			Earn: earn,
+			Ack:  entry.Ack,
+			Nack: func() error {
+				entry.Nack()
+				return nil
+			},
+		}
+	}
+}
+
+func (b *redisBank) ReplayEarns(since time.Time) error {
+	// stream IDs are prefixed with their millisecond timestamp, so moving the
+	// group's cursor to just before since will cause everything after it to be
+	// delivered again.
+	cursor := fmt.Sprintf("%d-0", since.UnixNano()/int64(time.Millisecond))
+	err := b.Do(radix.Cmd(nil, "XGROUP", "SETID", b.earnsKey(), consumeEarnsGroup, cursor))
+	if err != nil {
+		return fmt.Errorf("error moving earns cursor to %q: %w", cursor, err)
+	}
+	return nil
+}
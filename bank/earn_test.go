@@ -0,0 +1,111 @@
+package bank
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestEarnJournal(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+	userID := mrand.Hex(8)
+
+	earns := make([]Earn, 3)
+	for i := range earns {
+		earns[i] = Earn{
+			EventID: mrand.Hex(8),
+			UserID:  userID,
+			Amount:  i + 1,
+		}
+	}
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		start := time.Now()
+		ids := make([]string, len(earns))
+		for i := range earns {
+			var err error
+			ids[i], err = bank.SubmitEarn(earns[i])
+			massert.Require(t, massert.Nil(err))
+		}
+
+		// submitting the same event again should be suppressed
+		_, err := bank.SubmitEarn(earns[0])
+		massert.Require(t, massert.Equal(ErrDuplicateEarn, err))
+
+		ch := make(chan EarnInProgress, len(earns))
+		errCh := make(chan error, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			errCh <- bank.ConsumeEarns(ctx, ch)
+		}()
+
+		readEarns := func() {
+			var assertions []massert.Assertion
+			for i := range earns {
+				var got EarnInProgress
+				select {
+				case got = <-ch:
+				case <-time.After(1 * time.Second):
+					t.Fatal("timedout")
+				}
+				assertions = append(assertions,
+					massert.Equal(ids[i], got.ID),
+					massert.Equal(earns[i], got.Earn),
+					massert.Nil(got.Ack()),
+				)
+			}
+			massert.Require(t, assertions...)
+		}
+		readEarns()
+
+		// replaying should cause all of them to be consumed again, even though
+		// they were ack'd.
+		massert.Require(t, massert.Nil(bank.ReplayEarns(start.Add(-1*time.Second))))
+		readEarns()
+
+		cancel()
+		massert.Require(t, massert.Equal(context.Canceled, merr.Base(<-errCh)))
+	})
+}
+
+func TestEarnCap(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		capKey := mrand.Hex(8)
+		submit := func(token string, amount int) error {
+			_, err := bank.SubmitEarn(Earn{
+				EventID: mrand.Hex(8),
+				UserID:  "user",
+				Amount:  amount,
+				Caps:    []EarnCap{{Key: capKey, Token: token, Max: 2, TTL: time.Minute}},
+			})
+			return err
+		}
+
+		massert.Require(t,
+			massert.Nil(submit("a", 1)),
+			massert.Equal(ErrEarnCapped, submit("a", 1)),
+			massert.Nil(submit("b", 1)),
+			massert.Equal(ErrEarnCapped, submit("c", 1)),
+
+			// removing one which was never outstanding does nothing, but
+			// removing an outstanding one makes room for another.
+			massert.Equal(ErrEarnCapped, submit("c", -1)),
+			massert.Nil(submit("a", -1)),
+			massert.Equal(ErrEarnCapped, submit("a", -1)),
+			massert.Nil(submit("c", 1)),
+		)
+	})
+}
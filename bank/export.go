@@ -3,8 +3,10 @@ package bank
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/mctx"
 	"github.com/mediocregopher/mediocre-go-lib/mdb/mredis"
@@ -17,13 +19,123 @@ type Export struct {
 	FromUserID string
 	Amount     int
 
-	// The protocol the funds are being transferred to.
-	Protocol string
+	// Payload contains whatever data is required to transfer the funds to a
+	// particular protocol (e.g. a crypto chain). Its type is specific to the
+	// protocol, and must have been registered using RegisterExportProtocol.
+	Payload ExportPayload
 
-	// ProtocolPayload contains whatever data is required to transfer the funds
-	// to a particular protocol (e.g. a crypto chain). It's content is specific
-	// to the protocol.
-	ProtocolPayload string
+	// IdempotencyKey is optional, and makes SubmitExport only submit the
+	// Export once for the key, the same as IncrOnce. It isn't encoded, and so
+	// isn't set on Exports being consumed.
+	IdempotencyKey string
+
+	// HoldID is optional, and makes SubmitExport export the funds held by the
+	// hold, which must be of Amount from FromUserID, instead of taking them
+	// out of FromUserID's balance. The hold is released and its funds exported
+	// in one atomic operation, so nothing else can spend them in between. If
+	// the hold has already been captured or released then ErrHoldNotFound is
+	// returned. Like IdempotencyKey it isn't encoded.
+	HoldID string
+}
+
+// errExportHoldAmount is returned from SubmitExport when the Export's hold
+// isn't of the Export's amount.
+var errExportHoldAmount = errors.New("hold isn't of the export's amount")
+
+// checkExportHold returns an error if the given hold can't be exported by the
+// Export, see Export.HoldID.
+func checkExportHold(e Export, hold Hold) error {
+	if hold.UserID != e.FromUserID {
+		return ErrHoldNotFound
+	} else if hold.Amount != e.Amount {
+		return errExportHoldAmount
+	}
+	return nil
+}
+
+// Protocol returns the name of the protocol the funds are being transferred
+// to, or empty string if the Export has no Payload.
+func (e Export) Protocol() string {
+	if e.Payload == nil {
+		return ""
+	}
+	return e.Payload.ExportProtocol()
+}
+
+// exportVersion is the current version of the JSON encoding of Exports which
+// are written to the stream. It must be incremented whenever the encoding
+// changes in a way which older code couldn't make sense of, and decodeExport
+// must keep being able to decode all previous versions, since Exports written
+// by the previous deploy might still be in flight.
+//
+// Version 2 is Export's fields plus Version and Protocol, with the Payload
+// encoded as JSON. Version 1 had a string ProtocolPayload instead, and
+// Exports written before versioning are the same as version 1 but without
+// Version, and so are version 0.
+const exportVersion = 2
+
+// errExportVersion is returned from decodeExport when the Export was encoded
+// by newer code than this.
+var errExportVersion = errors.New("export was encoded by a newer version")
+
+// exportJSON is the encoding of an Export, covering all versions.
+type exportJSON struct {
+	Version    int
+	FromUserID string
+	Amount     int
+	Protocol   string
+
+	// version 2 and up.
+	Payload json.RawMessage `json:",omitempty"`
+
+	// version 1 and below.
+	ProtocolPayload string `json:",omitempty"`
+}
+
+func encodeExport(e Export) ([]byte, error) {
+	protocol := e.Protocol()
+	if _, err := exportProtocolByName(protocol); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling %q payload: %w", protocol, err)
+	}
+	return json.Marshal(exportJSON{
+		Version:    exportVersion,
+		FromUserID: e.FromUserID,
+		Amount:     e.Amount,
+		Protocol:   protocol,
+		Payload:    payload,
+	})
+}
+
+func decodeExport(b []byte) (Export, error) {
+	var ej exportJSON
+	if err := json.Unmarshal(b, &ej); err != nil {
+		return Export{}, err
+	} else if ej.Version > exportVersion {
+		return Export{}, fmt.Errorf("version %d is greater than %d: %w",
+			ej.Version, exportVersion, errExportVersion)
+	}
+
+	protocol, err := exportProtocolByName(ej.Protocol)
+	if err != nil {
+		return Export{}, err
+	}
+
+	e := Export{FromUserID: ej.FromUserID, Amount: ej.Amount}
+	if ej.Version >= 2 {
+		e.Payload, err = protocol.Unmarshal(ej.Payload)
+	} else if protocol.UnmarshalLegacy == nil {
+		err = fmt.Errorf("protocol %q can't decode version %d exports", ej.Protocol, ej.Version)
+	} else {
+		e.Payload, err = protocol.UnmarshalLegacy(ej.ProtocolPayload)
+	}
+	if err != nil {
+		return Export{}, fmt.Errorf("unmarshaling %q payload: %w", ej.Protocol, err)
+	}
+	return e, nil
 }
 
 // Annotate returns the given Context annotated with information about the
@@ -32,7 +144,7 @@ func (e Export) Annotate(ctx context.Context) context.Context {
 	return mctx.Annotate(ctx,
 		"exportFromUserID", e.FromUserID,
 		"exportAmount", e.Amount,
-		"exportProtocol", e.Protocol,
+		"exportProtocol", e.Protocol(),
 	)
 }
 
@@ -60,14 +172,25 @@ func (ep ExportInProgress) Annotate(ctx context.Context) context.Context {
 }
 
 // ExportingBank describes a Bank which is capable of enabling Export actions.
+// It also journals Earns, which makes the inflow of funds as durable as the
+// outflow.
 type ExportingBank interface {
 	Bank
+	EarnJournal
 
 	// SubmitExport records that an Export is desired and returns a unique
 	// identifier for it. All submitted Exports will be made available via
-	// ConsumeExports at least once.
+	// ConsumeExports at least once. If the Export's IdempotencyKey has
+	// already been used then ErrDuplicate is returned.
 	SubmitExport(Export) (string, error)
 
+	// CanExport returns the error which SubmitExport would return if it were
+	// called with the same Export, e.g. ErrNotEnoughFunds, without actually
+	// submitting it. The Payload may be nil, for checking whether an Export
+	// is possible before going to the trouble of creating one. As with
+	// CanTransfer, a nil error is no guarantee.
+	CanExport(Export) error
+
 	// ConsumeExports writes submitted Exports into the given channel. If
 	// multiple ConsumeExports run at the same time then submitted Exports will
 	// be divided between them.
@@ -78,25 +201,75 @@ type ExportingBank interface {
 	// This method will return when either the given Context is canceled or some
 	// other error is encountered. Either way it will never return nil, and does
 	// not close the given channel. It can be re-called if an error is returned.
+	//
+	// ConsumeExports is the same as calling ConsumeExportsGroup with
+	// DefaultExportsGroup.
 	ConsumeExports(context.Context, chan<- ExportInProgress) error
+
+	// ConsumeExportsGroup is like ConsumeExports, but Exports are consumed as
+	// part of the given group. Each group consumes every submitted Export, and
+	// keeps track of which it has Ack'd independently of all other groups, so
+	// different services can each process the full set of Exports (e.g. one
+	// submitting them to a crypto chain, another feeding them into analytics).
+	// Within a group Exports are divided between consumers, the same as with
+	// ConsumeExports.
+	//
+	// A group consuming for the first time starts from the very first Export
+	// which was ever submitted.
+	ConsumeExportsGroup(ctx context.Context, group string, ch chan<- ExportInProgress) error
+
+	// TrimExports removes Exports submitted before the given time from redis,
+	// returning how many were removed. Exports which haven't been Ack'd by
+	// every consumer group are never removed. If an archive is configured then
+	// removed Exports are written to it first.
+	TrimExports(before time.Time) (int, error)
+
+	// ExportHistory returns all Exports submitted at or after start and before
+	// end, oldest first, whether they're still in redis or have been trimmed
+	// to the archive.
+	ExportHistory(start, end time.Time) ([]ExportRecord, error)
 }
 
+// DefaultExportsGroup is the group which ConsumeExports consumes Exports as
+// part of. It's the group which buckaroo submits Exports to stellar from.
+const DefaultExportsGroup = "redisBank.ConsumeExports"
+
 ///////////////////////////////////////////////////////////////////////////////
 
 func (b *redisBank) exportsKey() string {
 	return b.key("exports")
 }
 
-// Keys:[balancesKey, streamKey] Args:[user, amount, exportJSON]
-var submitExportCmd = radix.NewEvalScript(2, `
+// Keys:[balancesKey, streamKey, balanceEventsKey, journalKey, historyKey, supplyKey, topKey, idempotencyKey, holdKey, holdExpiriesKey, holdsHistoryKey] Args:[user, amount, exportJSON, holdID, holdsAccount]
+var submitExportCmd = radix.NewEvalScript(11, `
+	`+checkIdempotencyLua(8)+`
 	local toTransfer = tonumber(ARGV[2])
-	local srcBalance = tonumber(redis.call("HGET", KEYS[1], ARGV[1]))
-	if not srcBalance then srcBalance = 0 end
-	if srcBalance < toTransfer then
-		return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
+	if KEYS[9] ~= "" then
+		local hold = redis.call("HMGET", KEYS[9], "user", "amount")
+		if not hold[1] or hold[1] ~= ARGV[1] then
+			return redis.error_reply("`+ErrHoldNotFound.Error()+`")
+		elseif tonumber(hold[2]) ~= toTransfer then
+			return redis.error_reply("`+errExportHoldAmount.Error()+`")
+		end
+		redis.call("DEL", KEYS[9])
+		redis.call("ZREM", KEYS[10], ARGV[4])
+		redis.call("HINCRBY", KEYS[1], ARGV[1], toTransfer)
+		redis.call("HINCRBY", KEYS[1], ARGV[5], -toTransfer)
+		`+balanceEventLua(3, "ARGV[5]")+`
+		`+journalLua(4, "5", "11", 0, "ARGV[1]", "toTransfer", "ARGV[5]", fmt.Sprintf("%q", JournalSourceRelease), "")+`
+	else
+		local srcBalance = tonumber(redis.call("HGET", KEYS[1], ARGV[1]))
+		if not srcBalance then srcBalance = 0 end
+		if srcBalance < toTransfer then
+			return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
+		end
 	end
+	`+useIdempotencyLua(8)+`
 
-	redis.call("HINCRBY", KEYS[1], ARGV[1], -1*toTransfer)
+	local newBalance = redis.call("HINCRBY", KEYS[1], ARGV[1], -1*toTransfer)
+	`+topLua(7, "ARGV[1]", "newBalance")+`
+	`+balanceEventLua(3, "ARGV[1]")+`
+	`+journalLua(4, "5", "", 6, "ARGV[1]", "-1*toTransfer", fmt.Sprintf("%q", LedgerAccountExports), fmt.Sprintf("%q", JournalSourceExport), "")+`
 	return redis.call("XADD", KEYS[2], "*", "json", ARGV[3])
 `)
 
@@ -105,32 +278,62 @@ func (b *redisBank) SubmitExport(e Export) (string, error) {
 		return "", fmt.Errorf("malformed Export.Amount: %d", e.Amount)
 	}
 
-	exportJSON, err := json.Marshal(e)
+	exportJSON, err := encodeExport(e)
 	if err != nil {
 		return "", fmt.Errorf("could not marshal Export %+v: %w", e, err)
 	}
 
+	holdsAccount := holdsAccountID(e.FromUserID)
+	var holdKey, holdExpiriesKey, holdsHistoryKey string
+	if e.HoldID != "" {
+		holdKey, holdExpiriesKey, holdsHistoryKey = b.holdKey(e.HoldID), b.holdExpiriesKey(), b.historyKey(holdsAccount)
+	}
+
 	var id radix.StreamEntryID
 	err = b.Do(submitExportCmd.Cmd(
-		&id, b.balancesKey(), b.exportsKey(), e.FromUserID,
-		strconv.Itoa(e.Amount), string(exportJSON),
+		&id, b.balancesKey(), b.exportsKey(), b.balanceEventsKey(), b.journalKey(), b.historyKey(e.FromUserID),
+		b.supplyKey(supplyDayStr(time.Now())), b.topKey(), b.idempotencyKey(e.IdempotencyKey),
+		holdKey, holdExpiriesKey, holdsHistoryKey,
+		e.FromUserID, strconv.Itoa(e.Amount), string(exportJSON), e.HoldID, holdsAccount,
 	))
-	err = translateRedisErr(err)
 	if err != nil {
 		return "", fmt.Errorf("error performing export command in redis: %w", err)
 	}
 	return id.String(), nil
 }
 
+func (b *redisBank) CanExport(e Export) error {
+	if e.Amount <= 0 {
+		return fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	} else if e.Payload != nil {
+		if _, err := encodeExport(e); err != nil {
+			return fmt.Errorf("could not marshal Export %+v: %w", e, err)
+		}
+	}
+
+	balance, err := b.Balance(e.FromUserID)
+	if err != nil {
+		return err
+	} else if balance < e.Amount {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
 func (b *redisBank) ConsumeExports(ctx context.Context, ch chan<- ExportInProgress) error {
-	key := b.exportsKey()
-	group := "redisBank.ConsumeExports"
+	return b.ConsumeExportsGroup(ctx, DefaultExportsGroup, ch)
+}
+
+func (b *redisBank) ConsumeExportsGroup(ctx context.Context, group string, ch chan<- ExportInProgress) error {
+	if group == "" {
+		return errors.New("export consumer group can't be empty")
+	}
 
 	reader := mredis.NewStream(b.Redis, mredis.StreamOpts{
-		Key:           key,
+		Key:           b.exportsKey(),
 		Group:         group,
 		Consumer:      b.instanceID,
-		Block:         redisBankReadTimeout / 2,
+		Block:         b.blockTimeout,
 		InitialCursor: "0",
 	})
 
@@ -147,8 +350,13 @@ func (b *redisBank) ConsumeExports(ctx context.Context, ch chan<- ExportInProgre
 		}
 
 		exportJSONStr := entry.Fields["json"]
-		var export Export
-		if err := json.Unmarshal([]byte(exportJSONStr), &export); err != nil {
+		export, err := decodeExport([]byte(exportJSONStr))
+		if errors.Is(err, errExportVersion) || errors.Is(err, errExportProtocol) {
+			// this can happen mid-deploy, when a newer instance has submitted
+			// the export. Leave it for one of those to consume.
+			entry.Nack()
+			continue
+		} else if err != nil {
 			return fmt.Errorf("error unmarshaling Export %q: %w", exportJSONStr, err)
 		}
 
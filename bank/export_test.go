@@ -2,6 +2,8 @@ package bank
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	. "testing"
 	"time"
 
@@ -11,6 +13,27 @@ import (
 	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
 )
 
+// testPayload is an ExportPayload for the "test" protocol, which is only
+// registered in tests.
+type testPayload struct {
+	Data string
+}
+
+func (testPayload) ExportProtocol() string { return "test" }
+
+func init() {
+	RegisterExportProtocol("test", ExportProtocol{
+		Unmarshal: func(b []byte) (ExportPayload, error) {
+			var p testPayload
+			err := json.Unmarshal(b, &p)
+			return p, err
+		},
+		UnmarshalLegacy: func(str string) (ExportPayload, error) {
+			return testPayload{Data: str}, nil
+		},
+	})
+}
+
 func TestExportingBank(t *T) {
 	cmp := mtest.Component()
 	bank := Inst(cmp)
@@ -22,10 +45,9 @@ func TestExportingBank(t *T) {
 	exports := make([]Export, 3)
 	for i := range exports {
 		exports[i] = Export{
-			FromUserID:      userID,
-			Amount:          i + 1,
-			Protocol:        mrand.Hex(8),
-			ProtocolPayload: mrand.Hex(8),
+			FromUserID: userID,
+			Amount:     i + 1,
+			Payload:    testPayload{Data: mrand.Hex(8)},
 		}
 		exportedAmount += exports[i].Amount
 	}
@@ -81,3 +103,138 @@ func TestExportingBank(t *T) {
 		)
 	})
 }
+
+func TestCanExport(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+	userID := mrand.Hex(8)
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		_, err := bank.Incr(userID, 2)
+		massert.Require(t, massert.Nil(err))
+
+		massert.Require(t,
+			massert.Nil(bank.CanExport(Export{FromUserID: userID, Amount: 2})),
+			massert.Nil(bank.CanExport(Export{FromUserID: userID, Amount: 1, Payload: testPayload{}})),
+			massert.Equal(true, errors.Is(bank.CanExport(Export{FromUserID: userID, Amount: 3}), ErrNotEnoughFunds)),
+			massert.Not(massert.Nil(bank.CanExport(Export{FromUserID: userID, Amount: 0}))),
+		)
+
+		// nothing should have been taken out
+		balance, err := bank.Balance(userID)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(2, balance),
+		)
+	})
+}
+
+func TestConsumeExportsGroup(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+	userID := mrand.Hex(8)
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		_, err := bank.Incr(userID, 10)
+		massert.Require(t, massert.Nil(err))
+		id, err := bank.SubmitExport(Export{FromUserID: userID, Amount: 1, Payload: testPayload{}})
+		massert.Require(t, massert.Nil(err))
+
+		// each group should get the export, regardless of whether the other
+		// has acked it.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for _, group := range []string{DefaultExportsGroup, "analytics"} {
+			ch := make(chan ExportInProgress, 1)
+			go bank.ConsumeExportsGroup(ctx, group, ch)
+			select {
+			case got := <-ch:
+				massert.Require(t,
+					massert.Equal(id, got.ID),
+					massert.Nil(got.Ack()),
+				)
+			case <-time.After(1 * time.Second):
+				t.Fatalf("timed out waiting for export in group %q", group)
+			}
+		}
+
+		massert.Require(t, massert.Not(massert.Nil(bank.ConsumeExportsGroup(ctx, "", nil))))
+	})
+}
+
+func TestDecodeExport(t *T) {
+	e := Export{FromUserID: "U1", Amount: 2, Payload: testPayload{Data: "data"}}
+	encoded, err := encodeExport(e)
+	massert.Require(t, massert.Nil(err))
+
+	decoded, err := decodeExport(encoded)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(e, decoded),
+	)
+
+	// exports from before payloads were typed, with and without a version
+	for _, v := range []string{``, `"Version":1,`} {
+		decoded, err = decodeExport([]byte(`{` + v + `"FromUserID":"U1","Amount":2,"Protocol":"test","ProtocolPayload":"data"}`))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(e, decoded),
+		)
+	}
+
+	_, err = decodeExport([]byte(`{"Version":99,"FromUserID":"U1"}`))
+	massert.Require(t, massert.Equal(true, errors.Is(err, errExportVersion)))
+
+	_, err = decodeExport([]byte(`{"Version":2,"FromUserID":"U1","Protocol":"carrier-pigeon"}`))
+	massert.Require(t, massert.Equal(true, errors.Is(err, errExportProtocol)))
+
+	_, err = encodeExport(Export{FromUserID: "U1", Amount: 1})
+	massert.Require(t, massert.Equal(true, errors.Is(err, errExportProtocol)))
+}
+
+// testHeldExports runs exporting held funds against the given bank.
+func testHeldExports(t *T, bank ExportingBank) {
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+	_, err := bank.Incr(userA, 5)
+	massert.Require(t, massert.Nil(err))
+	holdID, _, err := bank.Hold(userA, 4, 0)
+	massert.Require(t, massert.Nil(err))
+
+	// the held funds can't be spent, even though they're on their way back
+	// into the balance to be exported.
+	_, _, err = bank.Transfer(userB, userA, 2)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+
+	// the export must be of the whole hold, from the user it's held from.
+	_, err = bank.SubmitExport(Export{FromUserID: userA, Amount: 3, Payload: testPayload{}, HoldID: holdID})
+	massert.Require(t, massert.Equal(true, errors.Is(err, errExportHoldAmount)))
+	_, err = bank.SubmitExport(Export{FromUserID: userB, Amount: 4, Payload: testPayload{}, HoldID: holdID})
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrHoldNotFound)))
+
+	_, err = bank.SubmitExport(Export{FromUserID: userA, Amount: 4, Payload: testPayload{}, HoldID: holdID})
+	massert.Require(t, massert.Nil(err))
+	balance, err := bank.Balance(userA)
+	massert.Require(t, massert.Nil(err), massert.Equal(1, balance))
+	_, _, err = bank.Release(holdID)
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrHoldNotFound)))
+	_, err = bank.SubmitExport(Export{FromUserID: userA, Amount: 4, Payload: testPayload{}, HoldID: holdID})
+	massert.Require(t, massert.Equal(true, errors.Is(err, ErrHoldNotFound)))
+
+	rec, err := Reconcile(bank)
+	massert.Require(t, massert.Nil(err), massert.Length(rec.Discrepancies, 0))
+}
+
+func TestHeldExports(t *T) {
+	cmp := mtest.Component()
+	rb := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		testHeldExports(t, rb)
+		testHeldExports(t, NewInMem())
+	})
+}
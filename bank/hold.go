@@ -0,0 +1,252 @@
+package bank
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/radix/v3"
+)
+
+// HoldsAccountID is the account which held funds are kept in while they're
+// held, see Bank.Hold. There's one for each currency, see CurrencyAccountID.
+// Unlike the ledger accounts it has a balance, which is the total currently
+// held, so that held funds are still counted by Liabilities. It's never
+// included in Top.
+const HoldsAccountID = "@holds"
+
+// Journal sources of the entries made by Hold, Capture and Release.
+const (
+	JournalSourceHold    = "hold"
+	JournalSourceCapture = "capture"
+	JournalSourceRelease = "release"
+)
+
+// Hold describes funds which have been held from a user's balance, see
+// Bank.Hold.
+type Hold struct {
+	ID     string
+	UserID string
+	Amount int
+
+	// Expires is when the hold can no longer be captured, after which it's
+	// only waiting to be released, see ExpiredHolds. It's zero if the hold
+	// never expires.
+	Expires time.Time
+}
+
+// expired returns whether the hold has expired as of the given time.
+func (h Hold) expired(now time.Time) bool {
+	return !h.Expires.IsZero() && !now.Before(h.Expires)
+}
+
+var errCaptureNoUser = errors.New("no user to capture to given")
+
+// checkHoldDst returns an error if the hold's funds can't be moved to the given
+// user, because their account holds a different currency.
+func checkHoldDst(hold Hold, dstUserID string) error {
+	_, holdCurrency := SplitCurrencyAccountID(hold.UserID)
+	_, dstCurrency := SplitCurrencyAccountID(dstUserID)
+	if holdCurrency != dstCurrency {
+		return fmt.Errorf("can't capture hold %q of %q to %q, they hold different currencies", hold.ID, hold.UserID, dstUserID)
+	}
+	return nil
+}
+
+// holdsAccountID returns the HoldsAccountID of the currency which the given
+// user's account holds.
+func holdsAccountID(userID string) string {
+	_, currency := SplitCurrencyAccountID(userID)
+	return CurrencyAccountID(HoldsAccountID, currency)
+}
+
+// newHold checks the arguments given to Hold, returning the hold they
+// describe with a new ID. Expiry is kept to the millisecond, which is what the
+// redis bank stores it as.
+func newHold(userID string, amount int, ttl time.Duration) (Hold, error) {
+	if amount <= 0 {
+		return Hold{}, fmt.Errorf("malformed amount %d", amount)
+	} else if ttl < 0 {
+		return Hold{}, fmt.Errorf("malformed ttl %v", ttl)
+	} else if accountID, _ := SplitCurrencyAccountID(userID); accountID == HoldsAccountID {
+		return Hold{}, errors.New("can't hold funds which are already held")
+	}
+	hold := Hold{ID: mrand.Hex(16), UserID: userID, Amount: amount}
+	if ttl > 0 {
+		hold.Expires = time.Now().Add(ttl).Truncate(time.Millisecond)
+	}
+	return hold, nil
+}
+
+// holdKey is a hash of the user, amount and expiry (in unix milliseconds, or 0)
+// of the hold with the given ID. It's deleted once the hold is captured or
+// released.
+func (b *redisBank) holdKey(holdID string) string { return b.key("hold:" + holdID) }
+
+// holdExpiriesKey is a sorted set of the IDs of holds which expire, scored by
+// when they do in unix milliseconds.
+func (b *redisBank) holdExpiriesKey() string { return b.key("hold-expiries") }
+
+// unixMs returns the time as unix milliseconds, or 0 if it's zero.
+func unixMs(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// parseUnixMs is the inverse of unixMs.
+func parseUnixMs(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Keys:[balancesKey, balanceEventsKey, journalKey, historyKey, holdsHistoryKey, topKey, holdKey, holdExpiriesKey, overdraftsKey] Args:[user, holdsAccount, amount, expires, holdID, overdraft]
+var holdCmd = radix.NewEvalScript(9, `
+	local amount = tonumber(ARGV[3])
+	local balance = tonumber(redis.call("HGET", KEYS[1], ARGV[1]))
+	if not balance then balance = 0 end
+	if balance - amount < `+minBalanceLua(9, "ARGV[1]", "ARGV[6]")+` then
+		return redis.error_reply("`+ErrNotEnoughFunds.Error()+`")
+	end
+
+	redis.call("HSET", KEYS[7], "user", ARGV[1], "amount", amount, "expires", ARGV[4])
+	if ARGV[4] ~= "0" then
+		redis.call("ZADD", KEYS[8], ARGV[4], ARGV[5])
+	end
+	local newBalance = redis.call("HINCRBY", KEYS[1], ARGV[1], -amount)
+	redis.call("HINCRBY", KEYS[1], ARGV[2], amount)
+	`+topLua(6, "ARGV[1]", "newBalance")+`
+	`+balanceEventLua(2, "ARGV[1]")+`
+	`+balanceEventLua(2, "ARGV[2]")+`
+	local by = -amount
+	`+journalLua(3, "4", "5", 0, "ARGV[1]", "by", "ARGV[2]", `"`+JournalSourceHold+`"`, "")+`
+	return newBalance
+`)
+
+func (b *redisBank) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	hold, err := newHold(userID, amount, ttl)
+	if err != nil {
+		return "", 0, err
+	}
+	holdsAccount := holdsAccountID(userID)
+
+	var newBalance int
+	err = b.Do(holdCmd.Cmd(
+		&newBalance, b.balancesKey(), b.balanceEventsKey(), b.journalKey(),
+		b.historyKey(userID), b.historyKey(holdsAccount), b.topKey(), b.holdKey(hold.ID), b.holdExpiriesKey(), b.overdraftsKey(),
+		userID, holdsAccount, strconv.Itoa(amount), strconv.FormatInt(unixMs(hold.Expires), 10), hold.ID, strconv.Itoa(b.overdraft),
+	))
+	if errors.Is(err, ErrNotEnoughFunds) {
+		return "", 0, err
+	} else if err != nil {
+		return "", 0, fmt.Errorf("holding amount in redis: %w", err)
+	}
+	return hold.ID, newBalance, nil
+}
+
+// Keys:[balancesKey, balanceEventsKey, journalKey, dstHistoryKey, holdsHistoryKey, topKey, holdKey, holdExpiriesKey] Args:[dstUser, holdsAccount, user, source, holdID, now]
+var finishHoldCmd = radix.NewEvalScript(8, `
+	local hold = redis.call("HMGET", KEYS[7], "user", "amount", "expires")
+	if not hold[1] or hold[1] ~= ARGV[3] then
+		return redis.error_reply("`+ErrHoldNotFound.Error()+`")
+	end
+	local amount = tonumber(hold[2])
+	local expires = tonumber(hold[3]) or 0
+	if ARGV[4] == "`+JournalSourceCapture+`" and expires > 0 and expires <= tonumber(ARGV[6]) then
+		return redis.error_reply("`+ErrHoldExpired.Error()+`")
+	end
+	redis.call("DEL", KEYS[7])
+	redis.call("ZREM", KEYS[8], ARGV[5])
+
+	local newBalance = redis.call("HINCRBY", KEYS[1], ARGV[1], amount)
+	redis.call("HINCRBY", KEYS[1], ARGV[2], -amount)
+	`+topLua(6, "ARGV[1]", "newBalance")+`
+	`+balanceEventLua(2, "ARGV[1]")+`
+	`+balanceEventLua(2, "ARGV[2]")+`
+	`+journalLua(3, "4", "5", 0, "ARGV[1]", "amount", "ARGV[2]", "ARGV[4]", "")+`
+	return {newBalance, amount, expires}
+`)
+
+// finishHold moves the held funds to the given user, or back to the user they
+// were held from if none is given, recording it as the given source.
+func (b *redisBank) finishHold(holdID, dstUserID, source string) (Hold, int, error) {
+	// holds never change once made, so the user can be read before the
+	// script is run, which checks that the hold is still there.
+	hold := Hold{ID: holdID}
+	mn := radix.MaybeNil{Rcv: &hold.UserID}
+	if err := b.Do(radix.Cmd(&mn, "HGET", b.holdKey(holdID), "user")); err != nil {
+		return Hold{}, 0, fmt.Errorf("getting hold from redis: %w", err)
+	} else if mn.Nil {
+		return Hold{}, 0, ErrHoldNotFound
+	} else if dstUserID == "" {
+		dstUserID = hold.UserID
+	} else if err := checkHoldDst(hold, dstUserID); err != nil {
+		return Hold{}, 0, err
+	}
+	holdsAccount := holdsAccountID(hold.UserID)
+
+	var res []int64
+	err := b.Do(finishHoldCmd.Cmd(
+		&res, b.balancesKey(), b.balanceEventsKey(), b.journalKey(),
+		b.historyKey(dstUserID), b.historyKey(holdsAccount), b.topKey(), b.holdKey(holdID), b.holdExpiriesKey(),
+		dstUserID, holdsAccount, hold.UserID, source, holdID, strconv.FormatInt(unixMs(time.Now()), 10),
+	))
+	if errors.Is(err, ErrHoldNotFound) || errors.Is(err, ErrHoldExpired) {
+		return Hold{}, 0, err
+	} else if err != nil {
+		return Hold{}, 0, fmt.Errorf("finishing hold in redis: %w", err)
+	}
+	hold.Amount, hold.Expires = int(res[1]), parseUnixMs(res[2])
+	return hold, int(res[0]), nil
+}
+
+func (b *redisBank) Capture(holdID, dstUserID string) (Hold, int, error) {
+	if dstUserID == "" {
+		return Hold{}, 0, errCaptureNoUser
+	}
+	return b.finishHold(holdID, dstUserID, JournalSourceCapture)
+}
+
+func (b *redisBank) Release(holdID string) (Hold, int, error) {
+	return b.finishHold(holdID, "", JournalSourceRelease)
+}
+
+func (b *redisBank) ExpiredHolds(now time.Time, limit int) ([]Hold, error) {
+	var holdIDs []string
+	err := b.Do(radix.FlatCmd(&holdIDs, "ZRANGEBYSCORE", b.holdExpiriesKey(),
+		"-inf", unixMs(now), "LIMIT", 0, limit))
+	if err != nil {
+		return nil, fmt.Errorf("getting expired holds from redis: %w", err)
+	}
+
+	holds := make([]Hold, 0, len(holdIDs))
+	for _, holdID := range holdIDs {
+		var fields map[string]string
+		if err := b.Do(radix.Cmd(&fields, "HGETALL", b.holdKey(holdID))); err != nil {
+			return nil, fmt.Errorf("getting hold %q from redis: %w", holdID, err)
+		} else if fields["user"] == "" {
+			// finished since the set was read.
+			continue
+		}
+		amount, err := strconv.Atoi(fields["amount"])
+		if err != nil {
+			return nil, fmt.Errorf("malformed amount of hold %q: %w", holdID, err)
+		}
+		expires, err := strconv.ParseInt(fields["expires"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed expiry of hold %q: %w", holdID, err)
+		}
+		holds = append(holds, Hold{
+			ID:      holdID,
+			UserID:  fields["user"],
+			Amount:  amount,
+			Expires: parseUnixMs(expires),
+		})
+	}
+	return holds, nil
+}
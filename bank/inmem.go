@@ -0,0 +1,1097 @@
+package bank
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// inMemClaimTimeout is how long an entry stays claimed by a consumer of an
+// inMemBank stream, without being Ack'd or Nack'd, before it's redelivered.
+const inMemClaimTimeout = 5 * time.Minute
+
+// inMemEntry is a single entry in an inMemStream.
+type inMemEntry struct {
+	id   int64
+	time time.Time
+	json []byte
+}
+
+// inMemStream is the in-memory equivalent of a redis stream. Each consumer
+// group has the entries it has yet to Ack, along with when each one's claim
+// expires (zero if it's not claimed).
+type inMemStream struct {
+	lastID  int64
+	entries []inMemEntry
+	groups  map[string]map[int64]time.Time
+}
+
+func (s *inMemStream) add(now time.Time, jsonB []byte) int64 {
+	s.lastID++
+	s.entries = append(s.entries, inMemEntry{id: s.lastID, time: now, json: jsonB})
+	for _, pending := range s.groups {
+		pending[s.lastID] = time.Time{}
+	}
+	return s.lastID
+}
+
+func (s *inMemStream) ensureGroup(group string) {
+	if s.groups == nil {
+		s.groups = map[string]map[int64]time.Time{}
+	} else if _, ok := s.groups[group]; ok {
+		return
+	}
+	pending := map[int64]time.Time{}
+	for _, e := range s.entries {
+		pending[e.id] = time.Time{}
+	}
+	s.groups[group] = pending
+}
+
+// claim claims the oldest entry pending for the group which isn't claimed by
+// another consumer, returning false if there isn't one.
+func (s *inMemStream) claim(now time.Time, group string) (inMemEntry, bool) {
+	pending := s.groups[group]
+	for _, e := range s.entries {
+		if claimedUntil, ok := pending[e.id]; ok && !claimedUntil.After(now) {
+			pending[e.id] = now.Add(inMemClaimTimeout)
+			return e, true
+		}
+	}
+	return inMemEntry{}, false
+}
+
+// trim removes all but the latest maxLen entries, once there are enough over
+// that it's worth doing.
+func (s *inMemStream) trim(maxLen int) {
+	over := len(s.entries) - maxLen
+	if over < sqlTrimEvery {
+		return
+	}
+	for _, e := range s.entries[:over] {
+		for _, pending := range s.groups {
+			delete(pending, e.id)
+		}
+	}
+	s.entries = append([]inMemEntry(nil), s.entries[over:]...)
+}
+
+func (s *inMemStream) isPending(id int64) bool {
+	for _, pending := range s.groups {
+		if _, ok := pending[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inMemBank is an ExportingBank which keeps everything in memory, see
+// NewInMem.
+type inMemBank struct {
+	l sync.Mutex
+
+	// closed and replaced whenever something is added to a stream, or an
+	// entry is Nack'd, to wake up consumers.
+	wake chan struct{}
+
+	balances      map[string]int
+	meta          map[string]map[string]string
+	balanceEvents []string
+	// how many balance events have been trimmed from the front of
+	// balanceEvents, so the first one's ID is one more than this.
+	balanceEventsStart int64
+	journal            []JournalEntry
+	// month -> userID -> what they gave, see TopGivers.
+	gives map[string]map[string]GiveTotal
+	// day -> what was moved into and out of balances on it, see Supply.
+	supply map[string]SupplyDay
+	// idempotency key -> when it expires, see IncrOnce.
+	idempotencyKeys map[string]time.Time
+	// quota key -> how much of it is used, see UseQuota.
+	quotas map[string]inMemQuota
+	// hold ID -> the funds it holds, see Hold.
+	holds map[string]Hold
+	// userID -> their own overdraft, see SetOverdraft.
+	overdrafts map[string]int
+	// payment ID -> the payment, see SchedulePayment.
+	scheduledPayments map[string]ScheduledPayment
+
+	earnEvents map[string]time.Time
+	earnCaps   map[string]*inMemEarnCap
+	earns      inMemStream
+	exports    inMemStream
+}
+
+// inMemEarnCap is the tokens outstanding under an EarnCap's key, which all
+// expire together.
+type inMemEarnCap struct {
+	tokens    map[string]bool
+	expiresAt time.Time
+}
+
+// inMemQuota is how much of a quota has been used, see UseQuota.
+type inMemQuota struct {
+	used      int
+	expiresAt time.Time
+}
+
+// NewInMem returns an ExportingBank which keeps everything in memory, and so
+// needs no configuration or initialization. It's meant for tests, which can
+// use it in place of one backed by redis.
+//
+// It behaves the same as the redis backed ExportingBank, using the
+// NegativeBalanceRefuse policy, except that nothing is ever archived.
+func NewInMem() ExportingBank {
+	return &inMemBank{
+		wake:              make(chan struct{}),
+		balances:          map[string]int{},
+		meta:              map[string]map[string]string{},
+		gives:             map[string]map[string]GiveTotal{},
+		supply:            map[string]SupplyDay{},
+		idempotencyKeys:   map[string]time.Time{},
+		quotas:            map[string]inMemQuota{},
+		holds:             map[string]Hold{},
+		overdrafts:        map[string]int{},
+		scheduledPayments: map[string]ScheduledPayment{},
+		earnEvents:        map[string]time.Time{},
+		earnCaps:          map[string]*inMemEarnCap{},
+	}
+}
+
+// wakeConsumers must be called with the lock held.
+func (b *inMemBank) wakeConsumers() {
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// setBalance sets the user's balance, recording a balance event if it
+// changed. It must be called with the lock held.
+func (b *inMemBank) setBalance(userID string, balance int) {
+	if b.balances[userID] == balance {
+		return
+	}
+	b.balances[userID] = balance
+	b.balanceEvents = append(b.balanceEvents, userID)
+	if over := len(b.balanceEvents) - balanceEventsMaxLen; over >= sqlTrimEvery {
+		b.balanceEvents = append([]string(nil), b.balanceEvents[over:]...)
+		b.balanceEventsStart += int64(over)
+	}
+}
+
+// addJournalEntry adds the entry to the journal, unless its Amount is zero,
+// giving it an ID and time. It must be called with the lock held.
+func (b *inMemBank) addJournalEntry(e JournalEntry) {
+	if e.Amount == 0 {
+		return
+	}
+	e.ID = strconv.Itoa(len(b.journal) + 1)
+	e.Time = time.Now()
+	b.journal = append(b.journal, e)
+
+	if e.Source == JournalSourceGive {
+		month := givesMonth(e.Time)
+		if b.gives[month] == nil {
+			b.gives[month] = map[string]GiveTotal{}
+		}
+		total := b.gives[month][e.From]
+		total.UserID = e.From
+		total.Amount += e.Amount
+		total.NumGives++
+		b.gives[month][e.From] = total
+	}
+
+	if direction, ok := supplyDirection(e); ok {
+		day, ok := b.supply[supplyDayStr(e.Time)]
+		if !ok {
+			day = SupplyDay{In: map[string]int{}, Out: map[string]int{}}
+			b.supply[supplyDayStr(e.Time)] = day
+		}
+		day.add(direction, e.Source, e.Amount)
+	}
+}
+
+// checkIdempotencyKey returns ErrDuplicate if the idempotency key has been
+// used, and useIdempotencyKey marks it as used. Both do nothing if the key is
+// empty, and must be called with the lock held.
+func (b *inMemBank) checkIdempotencyKey(key string) error {
+	if expiresAt, ok := b.idempotencyKeys[key]; ok && expiresAt.After(time.Now()) {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (b *inMemBank) useIdempotencyKey(key string) {
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	b.idempotencyKeys[key] = now.Add(idempotencyKeyTTL)
+	if len(b.idempotencyKeys)%sqlTrimEvery == 0 {
+		for key, expiresAt := range b.idempotencyKeys {
+			if !expiresAt.After(now) {
+				delete(b.idempotencyKeys, key)
+			}
+		}
+	}
+}
+
+func (b *inMemBank) Balance(userID string) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.balances[userID], nil
+}
+
+func (b *inMemBank) Incr(userID string, by int) (int, error) {
+	return b.IncrAs(userID, by, JournalSourceIncr)
+}
+
+func (b *inMemBank) IncrAs(userID string, by int, source string) (int, error) {
+	return b.IncrOnce("", userID, by, source)
+}
+
+func (b *inMemBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if err := b.checkIdempotencyKey(idempotencyKey); err != nil {
+		return 0, err
+	}
+	newBalance, _, err := applyIncr(NegativeBalanceRefuse, 0, -b.overdrafts[userID], b.balances[userID], 0, by)
+	if err != nil {
+		return 0, err
+	}
+	b.useIdempotencyKey(idempotencyKey)
+	b.addJournalEntry(journalEntry(userID, newBalance-b.balances[userID], LedgerAccountIssuance, source))
+	b.setBalance(userID, newBalance)
+	return newBalance, nil
+}
+
+func (b *inMemBank) Owed(userID string) (int, error) {
+	return 0, nil
+}
+
+// Overdraft is zero unless the user has been given their own, since the
+// in-memory bank has no default.
+func (b *inMemBank) Overdraft(userID string) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.overdrafts[userID], nil
+}
+
+func (b *inMemBank) SetOverdraft(userID string, overdraft int) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if overdraft < 0 {
+		delete(b.overdrafts, userID)
+	} else {
+		b.overdrafts[userID] = overdraft
+	}
+	return nil
+}
+
+func (b *inMemBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	return b.TransferAs(dstUserID, srcUserID, amount, JournalSourceTransfer)
+}
+
+func (b *inMemBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	return b.TransferWithReason(dstUserID, srcUserID, amount, source, "")
+}
+
+func (b *inMemBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	return b.TransferOnce("", dstUserID, srcUserID, amount, source, reason)
+}
+
+func (b *inMemBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.transfer(idempotencyKey, dstUserID, srcUserID, amount, source, reason)
+}
+
+// transfer is TransferOnce, but must be called with the lock held.
+func (b *inMemBank) transfer(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	if err := b.checkIdempotencyKey(idempotencyKey); err != nil {
+		return 0, 0, err
+	}
+	dstBalance, srcBalance := b.balances[dstUserID], b.balances[srcUserID]
+	if srcBalance-amount < -b.overdrafts[srcUserID] || dstBalance+amount < -b.overdrafts[dstUserID] {
+		return 0, 0, ErrNotEnoughFunds
+	}
+	b.useIdempotencyKey(idempotencyKey)
+	if dstUserID == srcUserID {
+		// as with transferCmd, transferring to yourself leaves the balance
+		// as it was.
+		return dstBalance + amount, srcBalance, nil
+	}
+	b.setBalance(dstUserID, dstBalance+amount)
+	b.setBalance(srcUserID, srcBalance-amount)
+	b.addJournalEntry(transferJournalEntry(dstUserID, srcUserID, amount, source, reason))
+	return dstBalance + amount, srcBalance - amount, nil
+}
+
+func (b *inMemBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	return b.TransferMultiAs(srcUserID, dsts, JournalSourceTransfer)
+}
+
+func (b *inMemBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	return b.TransferMultiWithReason(srcUserID, dsts, source, "")
+}
+
+func (b *inMemBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	return b.TransferMultiOnce("", srcUserID, dsts, source, reason)
+}
+
+func (b *inMemBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	dstUserIDs, err := transferMultiDsts(srcUserID, dsts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if err := b.checkIdempotencyKey(idempotencyKey); err != nil {
+		return nil, 0, err
+	}
+	var total int
+	for _, amount := range dsts {
+		total += amount
+	}
+	srcBalance := b.balances[srcUserID]
+	if srcBalance-total < -b.overdrafts[srcUserID] {
+		return nil, 0, ErrNotEnoughFunds
+	}
+	b.useIdempotencyKey(idempotencyKey)
+
+	newDstBalances := make(map[string]int, len(dstUserIDs))
+	for _, dstUserID := range dstUserIDs {
+		amount := dsts[dstUserID]
+		newDstBalances[dstUserID] = b.balances[dstUserID] + amount
+		b.setBalance(dstUserID, newDstBalances[dstUserID])
+		b.addJournalEntry(transferJournalEntry(dstUserID, srcUserID, amount, source, reason))
+	}
+	b.setBalance(srcUserID, srcBalance-total)
+	return newDstBalances, srcBalance - total, nil
+}
+
+func (b *inMemBank) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	hold, err := newHold(userID, amount, ttl)
+	if err != nil {
+		return "", 0, err
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	balance := b.balances[userID]
+	if balance-amount < -b.overdrafts[userID] {
+		return "", 0, ErrNotEnoughFunds
+	}
+	holdsAccount := holdsAccountID(userID)
+	b.holds[hold.ID] = hold
+	b.setBalance(userID, balance-amount)
+	b.setBalance(holdsAccount, b.balances[holdsAccount]+amount)
+	b.addJournalEntry(journalEntry(userID, -amount, holdsAccount, JournalSourceHold))
+	return hold.ID, balance - amount, nil
+}
+
+// finishHold is the equivalent of redisBank's.
+func (b *inMemBank) finishHold(holdID, dstUserID, source string) (Hold, int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	hold, ok := b.holds[holdID]
+	if !ok {
+		return Hold{}, 0, ErrHoldNotFound
+	} else if source == JournalSourceCapture && hold.expired(time.Now()) {
+		return Hold{}, 0, ErrHoldExpired
+	} else if dstUserID == "" {
+		dstUserID = hold.UserID
+	} else if err := checkHoldDst(hold, dstUserID); err != nil {
+		return Hold{}, 0, err
+	}
+	return hold, b.moveHeld(hold, dstUserID, source), nil
+}
+
+// moveHeld deletes the hold and moves its funds to the given user, returning
+// their new balance. It must be called with the lock held.
+func (b *inMemBank) moveHeld(hold Hold, dstUserID, source string) int {
+	holdsAccount := holdsAccountID(hold.UserID)
+	delete(b.holds, hold.ID)
+	newBalance := b.balances[dstUserID] + hold.Amount
+	b.setBalance(dstUserID, newBalance)
+	b.setBalance(holdsAccount, b.balances[holdsAccount]-hold.Amount)
+	b.addJournalEntry(journalEntry(dstUserID, hold.Amount, holdsAccount, source))
+	return newBalance
+}
+
+func (b *inMemBank) Capture(holdID, dstUserID string) (Hold, int, error) {
+	if dstUserID == "" {
+		return Hold{}, 0, errCaptureNoUser
+	}
+	return b.finishHold(holdID, dstUserID, JournalSourceCapture)
+}
+
+func (b *inMemBank) Release(holdID string) (Hold, int, error) {
+	return b.finishHold(holdID, "", JournalSourceRelease)
+}
+
+func (b *inMemBank) ExpiredHolds(now time.Time, limit int) ([]Hold, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	var holds []Hold
+	for _, hold := range b.holds {
+		if hold.expired(now) {
+			holds = append(holds, hold)
+		}
+	}
+	sort.Slice(holds, func(i, j int) bool {
+		return holds[i].Expires.Before(holds[j].Expires)
+	})
+	if limit < 0 {
+		limit = 0
+	}
+	if len(holds) > limit {
+		holds = holds[:limit]
+	}
+	return holds, nil
+}
+
+func (b *inMemBank) SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (string, error) {
+	p, err := newScheduledPayment(srcUserID, dstUserID, amount, at)
+	if err != nil {
+		return "", err
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.scheduledPayments[p.ID] = p
+	return p.ID, nil
+}
+
+// scheduledPaymentsWhere returns up to limit scheduled payments which match
+// the given function, soonest first. It must be called with the lock held.
+func (b *inMemBank) scheduledPaymentsWhere(limit int, fn func(ScheduledPayment) bool) []ScheduledPayment {
+	var payments []ScheduledPayment
+	for _, p := range b.scheduledPayments {
+		if fn(p) {
+			payments = append(payments, p)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].At.Before(payments[j].At)
+	})
+	if limit >= 0 && len(payments) > limit {
+		payments = payments[:limit]
+	}
+	return payments
+}
+
+func (b *inMemBank) ScheduledPayments(srcUserID string) ([]ScheduledPayment, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.scheduledPaymentsWhere(-1, func(p ScheduledPayment) bool {
+		return p.SrcUserID == srcUserID
+	}), nil
+}
+
+func (b *inMemBank) DueScheduledPayments(now time.Time, limit int) ([]ScheduledPayment, error) {
+	if limit < 0 {
+		limit = 0
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.scheduledPaymentsWhere(limit, func(p ScheduledPayment) bool {
+		return !p.At.After(now)
+	}), nil
+}
+
+func (b *inMemBank) PayScheduledPayment(paymentID string) (ScheduledPayment, int, int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	p, ok := b.scheduledPayments[paymentID]
+	if !ok {
+		return ScheduledPayment{}, 0, 0, ErrScheduledPaymentNotFound
+	}
+	newDstBalance, newSrcBalance, err := b.transfer("", p.DstUserID, p.SrcUserID, p.Amount, JournalSourceScheduled, "")
+	if err != nil {
+		return ScheduledPayment{}, 0, 0, err
+	}
+	delete(b.scheduledPayments, paymentID)
+	return p, newDstBalance, newSrcBalance, nil
+}
+
+func (b *inMemBank) CancelScheduledPayment(paymentID string) (ScheduledPayment, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	p, ok := b.scheduledPayments[paymentID]
+	if !ok {
+		return ScheduledPayment{}, ErrScheduledPaymentNotFound
+	}
+	delete(b.scheduledPayments, paymentID)
+	return p, nil
+}
+
+func (b *inMemBank) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	if err := checkInterestRate(rate); err != nil {
+		return nil, err
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	if err := b.checkIdempotencyKey(idempotencyKey); err != nil {
+		return nil, err
+	}
+	b.useIdempotencyKey(idempotencyKey)
+
+	exclude := interestExclusions(excludeUserIDs)
+	userIDs := make([]string, 0, len(b.balances))
+	for userID := range b.balances {
+		if interestAccount(userID, currency, exclude) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+
+	changes := map[string]int{}
+	for _, userID := range userIDs {
+		balance := b.balances[userID]
+		if change := interestOn(balance, rate); change != 0 {
+			b.addJournalEntry(journalEntry(userID, change, LedgerAccountIssuance, JournalSourceInterest))
+			b.setBalance(userID, balance+change)
+			changes[userID] = change
+		}
+	}
+	return changes, nil
+}
+
+func (b *inMemBank) Burn(idempotencyKey, currency string, amount int) error {
+	e, err := burnJournalEntry(currency, amount)
+	if err != nil {
+		return err
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	if err := b.checkIdempotencyKey(idempotencyKey); err != nil {
+		return err
+	}
+	b.useIdempotencyKey(idempotencyKey)
+	b.addJournalEntry(e)
+	return nil
+}
+
+func (b *inMemBank) UseQuota(key string, amount, max int, ttl time.Duration) (int, error) {
+	if err := checkQuotaTTL(ttl); err != nil {
+		return 0, err
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	now := time.Now()
+	quota, ok := b.quotas[key]
+	if !ok || !quota.expiresAt.After(now) {
+		quota = inMemQuota{expiresAt: now.Add(ttl)}
+	}
+	var err error
+	if quota.used, err = applyQuota(quota.used, amount, max); err != nil {
+		return 0, err
+	}
+	b.quotas[key] = quota
+	return quota.used, nil
+}
+
+func (b *inMemBank) CanTransfer(dstUserID, srcUserID string, amount int) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.balances[srcUserID]-amount < -b.overdrafts[srcUserID] || b.balances[dstUserID]+amount < -b.overdrafts[dstUserID] {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
+// ListAccounts pages through accounts ordered by user ID, with the cursor
+// being the last user ID of the previous page.
+func (b *inMemBank) ListAccounts(cursor string, limit int) ([]Account, string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	userIDs := make([]string, 0, len(b.balances))
+	for userID := range b.balances {
+		if userID > cursor {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+	if len(userIDs) > limit {
+		userIDs = userIDs[:limit]
+	}
+
+	accounts := make([]Account, len(userIDs))
+	for i, userID := range userIDs {
+		accounts[i] = Account{UserID: userID, Balance: b.balances[userID]}
+	}
+	var nextCursor string
+	if len(accounts) > 0 && len(accounts) == limit {
+		nextCursor = accounts[len(accounts)-1].UserID
+	}
+	return accounts, nextCursor, nil
+}
+
+func (b *inMemBank) Top(n int) ([]Account, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	accounts := make([]Account, 0, len(b.balances))
+	for userID, balance := range b.balances {
+		accounts = append(accounts, Account{UserID: userID, Balance: balance})
+	}
+	return topAccounts(accounts, n), nil
+}
+
+func (b *inMemBank) BalanceEvents(cursor string, limit int) ([]string, string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	lastID := b.balanceEventsStart + int64(len(b.balanceEvents))
+	if cursor == "" {
+		return nil, strconv.FormatInt(lastID, 10), nil
+	}
+	after, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed balance events cursor %q", cursor)
+	}
+
+	// events which have been trimmed are skipped.
+	if after < b.balanceEventsStart {
+		after = b.balanceEventsStart
+	}
+	userIDs := make([]string, 0, limit)
+	for after < lastID && len(userIDs) < limit {
+		userIDs = append(userIDs, b.balanceEvents[after-b.balanceEventsStart])
+		after++
+	}
+	return userIDs, strconv.FormatInt(after, 10), nil
+}
+
+// Journal uses the index of the last entry returned as the cursor, which is
+// also its ID.
+func (b *inMemBank) Journal(cursor string, limit int) ([]JournalEntry, string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	var after int
+	if cursor != "" {
+		var err error
+		if after, err = strconv.Atoi(cursor); err != nil || after < 0 {
+			return nil, "", fmt.Errorf("malformed journal cursor %q", cursor)
+		}
+	}
+	if after >= len(b.journal) {
+		return nil, cursor, nil
+	}
+	end := after + limit
+	if end > len(b.journal) {
+		end = len(b.journal)
+	}
+	entries := append([]JournalEntry(nil), b.journal[after:end]...)
+	return entries, entries[len(entries)-1].ID, nil
+}
+
+// History scans the journal backwards from the cursor, which is the ID of the
+// last entry returned.
+func (b *inMemBank) History(userID string, cursor string, limit int) ([]HistoryEntry, string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	before := len(b.journal) + 1
+	if cursor != "" {
+		var err error
+		if before, err = strconv.Atoi(cursor); err != nil || before < 1 {
+			return nil, "", fmt.Errorf("malformed history cursor %q", cursor)
+		} else if before > len(b.journal)+1 {
+			before = len(b.journal) + 1
+		}
+	}
+
+	var entries []HistoryEntry
+	for i := before - 2; i >= 0 && len(entries) < limit; i-- {
+		if e := b.journal[i]; e.Source != JournalSourceOpening && (e.From == userID || e.To == userID) {
+			entries = append(entries, historyEntry(userID, e))
+		}
+	}
+	if len(entries) < limit {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].ID, nil
+}
+
+func (b *inMemBank) TopGivers(month time.Time, limit int) ([]GiveTotal, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	var totals []GiveTotal
+	for _, total := range b.gives[givesMonth(month)] {
+		totals = append(totals, total)
+	}
+	return topGiveTotals(totals, limit), nil
+}
+
+func (b *inMemBank) Supply(since time.Time) ([]SupplyDay, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	days := newSupplyDays(since, time.Now())
+	for _, day := range days {
+		supply := b.supply[supplyDayStr(day.Day)]
+		for source, amount := range supply.In {
+			day.add(SupplyIn, source, amount)
+		}
+		for source, amount := range supply.Out {
+			day.add(SupplyOut, source, amount)
+		}
+	}
+	return days, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Meta
+
+func (b *inMemBank) GetMeta(userID, key string) (string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.meta[key][userID], nil
+}
+
+func (b *inMemBank) SetMeta(userID, key, value string) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if value == "" {
+		delete(b.meta[key], userID)
+		return nil
+	} else if b.meta[key] == nil {
+		b.meta[key] = map[string]string{}
+	}
+	b.meta[key][userID] = value
+	return nil
+}
+
+func (b *inMemBank) AllMeta(key string) (map[string]string, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	values := make(map[string]string, len(b.meta[key]))
+	for userID, value := range b.meta[key] {
+		values[userID] = value
+	}
+	return values, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Streams
+
+// consume claims entries from the stream as part of the group and passes them
+// to fn, waiting whenever there are none, until the context is canceled or fn
+// returns an error.
+func (b *inMemBank) consume(ctx context.Context, s *inMemStream, group string, fn func(inMemEntry) error) error {
+	b.l.Lock()
+	s.ensureGroup(group)
+	b.l.Unlock()
+
+	// claims which expire don't wake anyone up, so this makes sure they're
+	// redelivered eventually.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		b.l.Lock()
+		entry, ok := s.claim(time.Now(), group)
+		wake := b.wake
+		b.l.Unlock()
+
+		if !ok {
+			select {
+			case <-wake:
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *inMemBank) ack(s *inMemStream, group string, id int64) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	delete(s.groups[group], id)
+	return nil
+}
+
+// nack makes the entry available to be claimed again straight away.
+func (b *inMemBank) nack(s *inMemStream, group string, id int64) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if _, ok := s.groups[group][id]; ok {
+		s.groups[group][id] = time.Time{}
+		b.wakeConsumers()
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Earns
+
+func (b *inMemBank) SubmitEarn(e Earn) (string, error) {
+	if err := checkEarn(e); err != nil {
+		return "", err
+	}
+
+	earnJSON, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Earn %+v: %w", e, err)
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := b.earnEvents[e.EventID]; ok && expiresAt.After(now) {
+		return "", ErrDuplicateEarn
+	}
+	for _, earnCap := range e.Caps {
+		if b.earnCapped(now, e.Amount, earnCap) {
+			return "", ErrEarnCapped
+		}
+	}
+	for _, earnCap := range e.Caps {
+		b.applyEarnCap(now, e.Amount, earnCap)
+	}
+	b.earnEvents[e.EventID] = now.Add(earnDedupTTL)
+
+	id := b.earns.add(now, earnJSON)
+	if id%sqlTrimEvery == 0 {
+		b.earns.trim(earnsMaxLen)
+		for eventID, expiresAt := range b.earnEvents {
+			if !expiresAt.After(now) {
+				delete(b.earnEvents, eventID)
+			}
+		}
+		for key, earnCap := range b.earnCaps {
+			if !earnCap.expiresAt.After(now) {
+				delete(b.earnCaps, key)
+			}
+		}
+	}
+	b.wakeConsumers()
+	return strconv.FormatInt(id, 10), nil
+}
+
+// earnCap returns the tokens outstanding under the EarnCap's key. It must be
+// called with the lock held.
+func (b *inMemBank) earnCap(now time.Time, earnCap EarnCap) *inMemEarnCap {
+	c, ok := b.earnCaps[earnCap.Key]
+	if !ok || !c.expiresAt.After(now) {
+		c = &inMemEarnCap{tokens: map[string]bool{}}
+	}
+	return c
+}
+
+// earnCapped is the equivalent of the checks in submitEarnCmd. It must be
+// called with the lock held.
+func (b *inMemBank) earnCapped(now time.Time, amount int, earnCap EarnCap) bool {
+	c := b.earnCap(now, earnCap)
+	if amount <= 0 {
+		return !c.tokens[earnCap.Token] && !earnCap.IgnoreNegative
+	}
+	return c.tokens[earnCap.Token] || len(c.tokens) >= earnCap.Max
+}
+
+// applyEarnCap is the equivalent of the changes made by submitEarnCmd, once
+// earnCapped has returned false for every EarnCap. It must be called with the
+// lock held.
+func (b *inMemBank) applyEarnCap(now time.Time, amount int, earnCap EarnCap) {
+	c := b.earnCap(now, earnCap)
+	if amount <= 0 {
+		delete(c.tokens, earnCap.Token)
+	} else {
+		// as with redis, the TTL applies to the whole key.
+		c.tokens[earnCap.Token] = true
+		c.expiresAt = now.Add(earnCap.TTL)
+	}
+	b.earnCaps[earnCap.Key] = c
+}
+
+func (b *inMemBank) ConsumeEarns(ctx context.Context, ch chan<- EarnInProgress) error {
+	return b.consume(ctx, &b.earns, consumeEarnsGroup, func(entry inMemEntry) error {
+		var earn Earn
+		if err := json.Unmarshal(entry.json, &earn); err != nil {
+			return fmt.Errorf("error unmarshaling Earn %q: %w", entry.json, err)
+		}
+
+		ch <- EarnInProgress{
+			ID:   strconv.FormatInt(entry.id, 10),
+			Earn: earn,
+			Ack:  func() error { return b.ack(&b.earns, consumeEarnsGroup, entry.id) },
+			Nack: func() error { return b.nack(&b.earns, consumeEarnsGroup, entry.id) },
+		}
+		return nil
+	})
+}
+
+func (b *inMemBank) ReplayEarns(since time.Time) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	b.earns.ensureGroup(consumeEarnsGroup)
+	pending := b.earns.groups[consumeEarnsGroup]
+	for _, e := range b.earns.entries {
+		// earns which are still pending are left as they are, they'll be
+		// delivered anyway.
+		if _, ok := pending[e.id]; !ok && !e.time.Before(since) {
+			pending[e.id] = time.Time{}
+		}
+	}
+	b.wakeConsumers()
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Exports
+
+func (b *inMemBank) SubmitExport(e Export) (string, error) {
+	if e.Amount <= 0 {
+		return "", fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	}
+
+	exportJSON, err := encodeExport(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Export %+v: %w", e, err)
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	if err := b.checkIdempotencyKey(e.IdempotencyKey); err != nil {
+		return "", err
+	} else if e.HoldID != "" {
+		hold, ok := b.holds[e.HoldID]
+		if !ok {
+			return "", ErrHoldNotFound
+		} else if err := checkExportHold(e, hold); err != nil {
+			return "", err
+		}
+		b.moveHeld(hold, e.FromUserID, JournalSourceRelease)
+	} else if b.balances[e.FromUserID] < e.Amount {
+		return "", ErrNotEnoughFunds
+	}
+	b.useIdempotencyKey(e.IdempotencyKey)
+	b.setBalance(e.FromUserID, b.balances[e.FromUserID]-e.Amount)
+	b.addJournalEntry(journalEntry(e.FromUserID, -e.Amount, LedgerAccountExports, JournalSourceExport))
+	id := b.exports.add(time.Now(), exportJSON)
+	b.wakeConsumers()
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (b *inMemBank) CanExport(e Export) error {
+	if e.Amount <= 0 {
+		return fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	} else if e.Payload != nil {
+		if _, err := encodeExport(e); err != nil {
+			return fmt.Errorf("could not marshal Export %+v: %w", e, err)
+		}
+	}
+
+	if balance, _ := b.Balance(e.FromUserID); balance < e.Amount {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
+func (b *inMemBank) ConsumeExports(ctx context.Context, ch chan<- ExportInProgress) error {
+	return b.ConsumeExportsGroup(ctx, DefaultExportsGroup, ch)
+}
+
+func (b *inMemBank) ConsumeExportsGroup(ctx context.Context, group string, ch chan<- ExportInProgress) error {
+	if group == "" {
+		return errors.New("export consumer group can't be empty")
+	}
+
+	return b.consume(ctx, &b.exports, group, func(entry inMemEntry) error {
+		export, err := decodeExport(entry.json)
+		if errors.Is(err, errExportVersion) || errors.Is(err, errExportProtocol) {
+			// it's left claimed, so that it's tried again once the claim
+			// times out.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error unmarshaling Export %q: %w", entry.json, err)
+		}
+
+		ch <- ExportInProgress{
+			ID:     strconv.FormatInt(entry.id, 10),
+			Export: export,
+			Ack:    func() error { return b.ack(&b.exports, group, entry.id) },
+			Nack:   func() error { return b.nack(&b.exports, group, entry.id) },
+		}
+		return nil
+	})
+}
+
+func (b *inMemBank) TrimExports(before time.Time) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	// as with redis, if there are no consumer groups then nothing has been
+	// consumed, and nothing is safe to trim.
+	if len(b.exports.groups) == 0 {
+		return 0, nil
+	}
+
+	kept := b.exports.entries[:0]
+	for _, e := range b.exports.entries {
+		if e.time.Before(before) && !b.exports.isPending(e.id) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	trimmed := len(b.exports.entries) - len(kept)
+	b.exports.entries = kept
+	return trimmed, nil
+}
+
+func (b *inMemBank) ExportHistory(start, end time.Time) ([]ExportRecord, error) {
+	if !start.Before(end) {
+		return nil, errors.New("start must be before end")
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	var records []ExportRecord
+	for _, e := range b.exports.entries {
+		if e.time.Before(start) || !e.time.Before(end) {
+			continue
+		}
+		export, err := decodeExport(e.json)
+		if err != nil {
+			return nil, fmt.Errorf("decoding export %d: %w", e.id, err)
+		}
+		records = append(records, ExportRecord{
+			ID:     strconv.FormatInt(e.id, 10),
+			Time:   e.time,
+			Export: export,
+		})
+	}
+	return records, nil
+}
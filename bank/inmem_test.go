@@ -0,0 +1,11 @@
+package bank
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+)
+
+func TestInMemBank(t *T) {
+	testExportingBank(t, mtest.Component(), NewInMem())
+}
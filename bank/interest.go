@@ -0,0 +1,133 @@
+package bank
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// JournalSourceInterest is the journal source of the changes made by
+// ApplyInterest.
+const JournalSourceInterest = "interest"
+
+// InterestRateScale is what ApplyInterest's rate is out of, i.e. it's in parts
+// per million, so that rates well under a percent can be given as integers.
+const InterestRateScale = 1000000
+
+// checkInterestRate returns an error if the rate can't be given to
+// ApplyInterest. A rate of -InterestRateScale or lower would take whole
+// balances, or more.
+func checkInterestRate(rate int) error {
+	if rate == 0 || rate <= -InterestRateScale {
+		return fmt.Errorf("malformed interest rate %d", rate)
+	}
+	return nil
+}
+
+// interestAccount returns whether ApplyInterest changes the balance of the
+// given user, which it only does for the users' accounts holding the given
+// currency which aren't excluded.
+func interestAccount(userID, currency string, exclude map[string]bool) bool {
+	if _, c := SplitCurrencyAccountID(userID); c != currency {
+		return false
+	}
+	return userID != HoldsAccountID && !exclude[userID]
+}
+
+func interestExclusions(excludeUserIDs []string) map[string]bool {
+	exclude := make(map[string]bool, len(excludeUserIDs))
+	for _, userID := range excludeUserIDs {
+		exclude[userID] = true
+	}
+	return exclude
+}
+
+// interestOn returns how much interest at the given rate changes the balance
+// by, rounded towards zero. Only positive balances earn, or pay, interest.
+func interestOn(balance, rate int) int {
+	if balance <= 0 {
+		return 0
+	}
+	return balance * rate / InterestRateScale
+}
+
+// Keys:[balancesKey, balanceEventsKey, journalKey, supplyKey, topKey, idempotencyKey, historyKey...] Args:[rate, source, user...]
+// each user's history key is in the same position in KEYS, after the first 6,
+// as the user is in ARGV, after the first 2. As with transferMultiLua the
+// script is made on each call. The users are listed before the script is run,
+// so any account opened in between isn't changed, but every balance which is
+// changed is read by the script itself.
+var applyInterestLua = `
+	` + checkIdempotencyLua(6) + `
+	` + useIdempotencyLua(6) + `
+	local rate, source = tonumber(ARGV[1]), ARGV[2]
+	local changes = {}
+	for i = 3, #ARGV do
+		local user, historyIdx = ARGV[i], 4 + i
+		local balance = tonumber(redis.call("HGET", KEYS[1], user)) or 0
+		local change = 0
+		if balance > 0 then
+			change = balance * rate / ` + strconv.Itoa(InterestRateScale) + `
+			if change > 0 then change = math.floor(change) else change = math.ceil(change) end
+		end
+		if change ~= 0 then
+			local newBalance = redis.call("HINCRBY", KEYS[1], user, change)
+			` + balanceEventLua(2, "user") + `
+			` + topLua(5, "user", "newBalance") + `
+			` + journalLua(3, "historyIdx", "", 4, "user", "change", fmt.Sprintf("%q", LedgerAccountIssuance), "source", "") + `
+			table.insert(changes, user)
+			table.insert(changes, change)
+		end
+	end
+	return changes
+`
+
+func (b *redisBank) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	if err := checkInterestRate(rate); err != nil {
+		return nil, err
+	}
+
+	var allUserIDs []string
+	if err := b.Do(radix.Cmd(&allUserIDs, "HKEYS", b.balancesKey())); err != nil {
+		return nil, fmt.Errorf("listing balances in redis: %w", err)
+	}
+	exclude := interestExclusions(excludeUserIDs)
+	var userIDs []string
+	for _, userID := range allUserIDs {
+		if interestAccount(userID, currency, exclude) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+
+	keys := []string{
+		b.balancesKey(), b.balanceEventsKey(), b.journalKey(),
+		b.supplyKey(supplyDayStr(time.Now())), b.topKey(), b.idempotencyKey(idempotencyKey),
+	}
+	args := []string{strconv.Itoa(rate), JournalSourceInterest}
+	for _, userID := range userIDs {
+		keys = append(keys, b.historyKey(userID))
+		args = append(args, userID)
+	}
+
+	var res []string
+	cmd := radix.NewEvalScript(len(keys), applyInterestLua)
+	if err := b.Do(cmd.Cmd(&res, append(keys, args...)...)); err != nil {
+		return nil, fmt.Errorf("applying interest in redis: %w", err)
+	} else if len(res)%2 != 0 {
+		return nil, fmt.Errorf("unexpected result applying interest: %v", res)
+	}
+
+	changes := make(map[string]int, len(res)/2)
+	for i := 0; i < len(res); i += 2 {
+		change, err := strconv.Atoi(res[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing interest paid to %q: %w", res[i], err)
+		}
+		changes[res[i]] = change
+	}
+	return changes, nil
+}
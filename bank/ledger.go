@@ -0,0 +1,438 @@
+package bank
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Accounts which aren't users' accounts, which the other side of each journal
+// entry moving funds into or out of the bank is recorded against. They don't
+// have balances of their own in the bank, their balances are only the sum of
+// their journal entries. Entries which are only between ledger accounts, like
+// those made by Burn, use the ledger accounts holding their currency, see
+// CurrencyAccountID.
+const (
+	// LedgerAccountIssuance is the source of funds which are created by Incr,
+	// and the destination of those destroyed by it.
+	LedgerAccountIssuance = "@issuance"
+
+	// LedgerAccountExports is the destination of funds which are exported.
+	LedgerAccountExports = "@exports"
+
+	// LedgerAccountOpening is the source of the balances which users already
+	// had when the journal was started.
+	LedgerAccountOpening = "@opening"
+
+	// LedgerAccountBurned is the destination of exported funds which have
+	// since been destroyed outside of the bank, see Bank.Burn.
+	LedgerAccountBurned = "@burned"
+)
+
+// Sources of journal entries, i.e. what made them. Incr and Transfer use
+// JournalSourceIncr and JournalSourceTransfer, but callers which know more
+// about why a balance is changing can give their own source to IncrAs and
+// TransferAs, e.g. JournalSourceEarn.
+const (
+	JournalSourceIncr     = "incr"
+	JournalSourceTransfer = "transfer"
+	JournalSourceExport   = "export"
+	JournalSourceOpening  = "opening"
+
+	JournalSourceEarn    = "earn"
+	JournalSourceDeposit = "deposit"
+	JournalSourceMint    = "mint"
+	JournalSourceGive    = "give"
+)
+
+// JournalEntry records funds moving from one account in the ledger to another.
+// Every change to a user's balance is recorded as a JournalEntry in the same
+// atomic operation as the change itself, so a user's balance is always the
+// sum of their entries. Amount is always greater than zero.
+type JournalEntry struct {
+	ID     string
+	Time   time.Time
+	From   string
+	To     string
+	Amount int
+	Source string
+
+	// Reason is free text given by whoever made the entry as to why, e.g. the
+	// message a user gave along with a give. It's only set on entries made by
+	// TransferWithReason and TransferMultiWithReason, and may be empty.
+	Reason string
+}
+
+// journalEntry returns the entry which records the given user's balance
+// changing by the given amount, with the other side of it against the given
+// ledger account. If the balance didn't change then the entry's Amount is zero,
+// and it shouldn't be recorded.
+func journalEntry(userID string, by int, ledgerAccount, source string) JournalEntry {
+	switch {
+	case by > 0:
+		return JournalEntry{From: ledgerAccount, To: userID, Amount: by, Source: source}
+	case by < 0:
+		return JournalEntry{From: userID, To: ledgerAccount, Amount: -by, Source: source}
+	default:
+		return JournalEntry{}
+	}
+}
+
+// transferJournalEntry is like journalEntry, but for a transfer between users,
+// which can have a reason.
+func transferJournalEntry(dstUserID, srcUserID string, amount int, source, reason string) JournalEntry {
+	if dstUserID == srcUserID {
+		return JournalEntry{}
+	}
+	e := journalEntry(dstUserID, amount, srcUserID, source)
+	e.Reason = reason
+	return e
+}
+
+// HistoryEntry is a single change to a user's balance, see Bank.History.
+type HistoryEntry struct {
+	ID     string
+	Time   time.Time
+	Source string
+
+	// Amount is positive if the user's balance went up, and negative if it
+	// went down.
+	Amount int
+
+	// Counterparty is the account on the other side of the change, either
+	// another user's or a ledger account.
+	Counterparty string
+
+	// Reason is that of the journal entry, see JournalEntry.Reason.
+	Reason string
+}
+
+// historyEntry returns the HistoryEntry of the given user for the journal
+// entry, which must be to or from them.
+func historyEntry(userID string, e JournalEntry) HistoryEntry {
+	h := HistoryEntry{ID: e.ID, Time: e.Time, Source: e.Source, Reason: e.Reason}
+	if e.To == userID {
+		h.Amount, h.Counterparty = e.Amount, e.From
+	} else {
+		h.Amount, h.Counterparty = -e.Amount, e.To
+	}
+	return h
+}
+
+// GiveTotal is how much a user gave to others over a month, see
+// Bank.TopGivers.
+type GiveTotal struct {
+	UserID string
+	Amount int
+
+	// NumGives is how many separate gives Amount was made up of.
+	NumGives int
+}
+
+// givesMonth returns the month which journal entries made at the given time
+// are totaled under by TopGivers.
+func givesMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// topGiveTotals sorts the totals most generous first, breaking ties by who gave
+// most often, and returns at most limit of them.
+func topGiveTotals(totals []GiveTotal, limit int) []GiveTotal {
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Amount != totals[j].Amount {
+			return totals[i].Amount > totals[j].Amount
+		} else if totals[i].NumGives != totals[j].NumGives {
+			return totals[i].NumGives > totals[j].NumGives
+		}
+		return totals[i].UserID < totals[j].UserID
+	})
+	if len(totals) > limit {
+		totals = totals[:limit]
+	}
+	return totals
+}
+
+// Directions which funds can move in, relative to users' balances as a whole,
+// which Supply totals journal entries under.
+const (
+	// SupplyIn is funds moved from a ledger account into a user's balance,
+	// e.g. by earning or depositing.
+	SupplyIn = "in"
+
+	// SupplyOut is funds moved from a user's balance into a ledger account,
+	// e.g. by withdrawing.
+	SupplyOut = "out"
+)
+
+// SupplyDay is how much was moved into and out of users' balances over a
+// single UTC day, see Bank.Supply. In and Out are keyed by journal source.
+// Transfers between users don't change the supply, so aren't included.
+type SupplyDay struct {
+	Day     time.Time
+	In, Out map[string]int
+}
+
+// supplyDirection returns which direction the journal entry moved funds in,
+// relative to users' balances as a whole, or false if it didn't change the
+// supply. Opening entries are only a record of what was already there, so they
+// don't.
+func supplyDirection(e JournalEntry) (string, bool) {
+	switch {
+	case e.Source == JournalSourceOpening:
+		return "", false
+	case IsLedgerAccount(e.From) && !IsLedgerAccount(e.To):
+		return SupplyIn, true
+	case !IsLedgerAccount(e.From) && IsLedgerAccount(e.To):
+		return SupplyOut, true
+	default:
+		return "", false
+	}
+}
+
+// supplyDayStr returns the day which journal entries made at the given time are
+// totaled under by Supply.
+func supplyDayStr(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// newSupplyDays returns an empty SupplyDay for every day from the one
+// containing since up to and including the one containing now, oldest first.
+func newSupplyDays(since, now time.Time) []SupplyDay {
+	since = since.UTC().Truncate(24 * time.Hour)
+	var days []SupplyDay
+	for day := since; !day.After(now); day = day.Add(24 * time.Hour) {
+		days = append(days, SupplyDay{Day: day, In: map[string]int{}, Out: map[string]int{}})
+	}
+	return days
+}
+
+// add adds the amount moved in the given direction by the source.
+func (d SupplyDay) add(direction, source string, amount int) {
+	switch direction {
+	case SupplyIn:
+		d.In[source] += amount
+	case SupplyOut:
+		d.Out[source] += amount
+	}
+}
+
+// Discrepancy is a user account whose balance doesn't match the sum of its
+// journal entries.
+type Discrepancy struct {
+	UserID         string
+	Balance        int
+	JournalBalance int
+}
+
+// Reconciliation is the result of Reconcile.
+type Reconciliation struct {
+	// NumEntries is how many journal entries were replayed.
+	NumEntries int
+
+	// LedgerBalances are the balances of the accounts which aren't users',
+	// e.g. -LedgerBalances[LedgerAccountIssuance] is how much has been
+	// created by Incr, net of what's been destroyed by it.
+	LedgerBalances map[string]int
+
+	// Discrepancies are ordered by user ID.
+	Discrepancies []Discrepancy
+}
+
+// IsLedgerAccount returns whether the account is one of the ledger accounts,
+// in any currency, rather than a user's.
+func IsLedgerAccount(accountID string) bool {
+	accountID, _ = SplitCurrencyAccountID(accountID)
+	switch accountID {
+	case LedgerAccountIssuance, LedgerAccountExports, LedgerAccountOpening, LedgerAccountBurned:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconcilePageSize is how many journal entries and accounts are read from the
+// bank at a time by Reconcile.
+const reconcilePageSize = 1000
+
+// Reconcile replays the whole of the bank's journal, and compares the balance
+// of each user's account with the sum of its entries. Balances which change
+// while this is running are likely to show up as discrepancies, so it should
+// be run again to confirm any it finds.
+func Reconcile(b Bank) (Reconciliation, error) {
+	balances := map[string]int{}
+	var numEntries int
+	var cursor string
+	for {
+		entries, nextCursor, err := b.Journal(cursor, reconcilePageSize)
+		if err != nil {
+			return Reconciliation{}, fmt.Errorf("reading journal: %w", err)
+		}
+		for _, e := range entries {
+			balances[e.From] -= e.Amount
+			balances[e.To] += e.Amount
+		}
+		numEntries += len(entries)
+		if len(entries) == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	rec := Reconciliation{NumEntries: numEntries, LedgerBalances: map[string]int{}}
+	for accountID, balance := range balances {
+		if IsLedgerAccount(accountID) {
+			rec.LedgerBalances[accountID] = balance
+			delete(balances, accountID)
+		}
+	}
+
+	cursor = ""
+	for {
+		accounts, nextCursor, err := b.ListAccounts(cursor, reconcilePageSize)
+		if err != nil {
+			return Reconciliation{}, fmt.Errorf("listing accounts: %w", err)
+		}
+		for _, account := range accounts {
+			if journalBalance := balances[account.UserID]; journalBalance != account.Balance {
+				rec.Discrepancies = append(rec.Discrepancies, Discrepancy{
+					UserID:         account.UserID,
+					Balance:        account.Balance,
+					JournalBalance: journalBalance,
+				})
+			}
+			delete(balances, account.UserID)
+		}
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+
+	// whatever's left has journal entries but no account at all.
+	for userID, journalBalance := range balances {
+		if journalBalance != 0 {
+			rec.Discrepancies = append(rec.Discrepancies, Discrepancy{
+				UserID:         userID,
+				JournalBalance: journalBalance,
+			})
+		}
+	}
+
+	sort.Slice(rec.Discrepancies, func(i, j int) bool {
+		return rec.Discrepancies[i].UserID < rec.Discrepancies[j].UserID
+	})
+	return rec, nil
+}
+
+// forEachAccount calls fn with every account in the bank, a page at a time.
+func forEachAccount(b Bank, fn func(Account)) error {
+	var cursor string
+	for {
+		accounts, nextCursor, err := b.ListAccounts(cursor, reconcilePageSize)
+		if err != nil {
+			return fmt.Errorf("listing accounts: %w", err)
+		}
+		for _, account := range accounts {
+			fn(account)
+		}
+		if cursor = nextCursor; cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Liabilities returns the sum of all users' balances in each currency, keyed by
+// currency code, i.e. what the bank owes its users. Balances below zero aren't
+// owed to anyone, and so aren't counted against the others.
+func Liabilities(b Bank) (map[string]int, error) {
+	liabilities := map[string]int{}
+	err := forEachAccount(b, func(account Account) {
+		if IsLedgerAccount(account.UserID) || account.Balance <= 0 {
+			return
+		}
+		_, currency := SplitCurrencyAccountID(account.UserID)
+		liabilities[currency] += account.Balance
+	})
+	if err != nil {
+		return nil, err
+	}
+	return liabilities, nil
+}
+
+// SupplyTotals is the result of TotalSupply.
+type SupplyTotals struct {
+	// Balances is the sum of every user's balance, i.e. how much of the
+	// currency exists inside the bank.
+	Balances int
+
+	// In and Out are how much each journal source has moved into and out of
+	// users' balances since the journal was started, like in SupplyDay.
+	In, Out map[string]int
+
+	// Burned is how much of what was exported has since been destroyed
+	// outside of the bank, see Bank.Burn. Burning doesn't touch any user's
+	// balance, so it isn't included in Out.
+	Burned int
+}
+
+// Exported returns how much has been exported out of the bank, net of what's
+// been deposited back into it or burned, i.e. how much exists outside of the
+// bank.
+func (t SupplyTotals) Exported() int {
+	return t.Out[JournalSourceExport] - t.In[JournalSourceDeposit] - t.Burned
+}
+
+// TotalSupply replays the whole of the bank's journal, totaling how much each
+// journal source has moved into and out of users' balances in the given
+// currency, and sums their balances. Unlike Supply, the totals cover every
+// entry ever journaled, and each currency is totaled separately.
+func TotalSupply(b Bank, currency string) (SupplyTotals, error) {
+	totals := SupplyTotals{In: map[string]int{}, Out: map[string]int{}}
+
+	var cursor string
+	for {
+		entries, nextCursor, err := b.Journal(cursor, reconcilePageSize)
+		if err != nil {
+			return SupplyTotals{}, fmt.Errorf("reading journal: %w", err)
+		}
+		for _, e := range entries {
+			if e.Source == JournalSourceBurn {
+				if _, entryCurrency := SplitCurrencyAccountID(e.To); entryCurrency == currency {
+					totals.Burned += e.Amount
+				}
+				continue
+			}
+			direction, ok := supplyDirection(e)
+			if !ok {
+				continue
+			}
+			userID := e.To
+			if direction == SupplyOut {
+				userID = e.From
+			}
+			if _, entryCurrency := SplitCurrencyAccountID(userID); entryCurrency != currency {
+				continue
+			}
+			switch direction {
+			case SupplyIn:
+				totals.In[e.Source] += e.Amount
+			case SupplyOut:
+				totals.Out[e.Source] += e.Amount
+			}
+		}
+		if len(entries) == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	err := forEachAccount(b, func(account Account) {
+		if _, accountCurrency := SplitCurrencyAccountID(account.UserID); accountCurrency == currency &&
+			!IsLedgerAccount(account.UserID) {
+			totals.Balances += account.Balance
+		}
+	})
+	if err != nil {
+		return SupplyTotals{}, err
+	}
+	return totals, nil
+}
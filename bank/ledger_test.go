@@ -0,0 +1,197 @@
+package bank
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestReconcile(t *T) {
+	b := NewInMem()
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+	_, err := b.Incr(userA, 10)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = b.Transfer(userB, userA, 4)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = b.Transfer(userB, userB, 1)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.Incr(userB, -1)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.SubmitExport(Export{FromUserID: userA, Amount: 2, Payload: testPayload{Data: "a"}})
+	massert.Require(t, massert.Nil(err))
+
+	rec, err := Reconcile(b)
+	massert.Require(t,
+		massert.Nil(err),
+		// transferring to yourself isn't journaled.
+		massert.Equal(4, rec.NumEntries),
+		massert.Equal(map[string]int{
+			LedgerAccountIssuance: -9,
+			LedgerAccountExports:  2,
+		}, rec.LedgerBalances),
+		massert.Length(rec.Discrepancies, 0),
+	)
+
+	entries, cursor, err := b.Journal("", 2)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(entries, 2),
+		massert.Equal(entries[1].ID, cursor),
+		massert.Equal(JournalEntry{
+			ID: entries[1].ID, Time: entries[1].Time,
+			From: userA, To: userB, Amount: 4, Source: JournalSourceTransfer,
+		}, entries[1]),
+	)
+
+	// a change which bypasses the journal shows up as a discrepancy.
+	inMem := b.(*inMemBank)
+	inMem.l.Lock()
+	inMem.setBalance(userB, 5)
+	inMem.l.Unlock()
+	rec, err = Reconcile(b)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal([]Discrepancy{{UserID: userB, Balance: 5, JournalBalance: 3}}, rec.Discrepancies),
+	)
+}
+
+func TestLiabilities(t *T) {
+	b := NewInMem()
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+	_, err := b.Incr(userA, 10)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = b.Transfer(userB, userA, 4)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.Incr(CurrencyAccountID(userA, "SEASON"), 3)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.SubmitExport(Export{FromUserID: userA, Amount: 2, Payload: testPayload{Data: "a"}})
+	massert.Require(t, massert.Nil(err))
+
+	liabilities, err := Liabilities(b)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(map[string]int{DefaultCurrency: 8, "SEASON": 3}, liabilities),
+	)
+}
+
+func TestTotalSupply(t *T) {
+	b := NewInMem()
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+	_, err := b.IncrAs(userA, 10, JournalSourceEarn)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.IncrAs(userB, 5, JournalSourceDeposit)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = b.TransferAs(userB, userA, 4, JournalSourceGive)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.IncrAs(userA, -1, JournalSourceMint)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.SubmitExport(Export{FromUserID: userB, Amount: 7, Payload: testPayload{Data: "a"}})
+	massert.Require(t, massert.Nil(err))
+	_, err = b.IncrAs(CurrencyAccountID(userA, "SEASON"), 3, JournalSourceMint)
+	massert.Require(t, massert.Nil(err))
+
+	totals, err := TotalSupply(b, DefaultCurrency)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(SupplyTotals{
+			Balances: 7,
+			In:       map[string]int{JournalSourceEarn: 10, JournalSourceDeposit: 5},
+			Out:      map[string]int{JournalSourceMint: 1, JournalSourceExport: 7},
+		}, totals),
+		massert.Equal(2, totals.Exported()),
+	)
+
+	massert.Require(t, massert.Nil(b.Burn("", DefaultCurrency, 1)))
+	totals, err = TotalSupply(b, DefaultCurrency)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(1, totals.Burned),
+		massert.Equal(1, totals.Exported()),
+	)
+
+	totals, err = TotalSupply(b, "SEASON")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(SupplyTotals{
+			Balances: 3,
+			In:       map[string]int{JournalSourceMint: 3},
+			Out:      map[string]int{},
+		}, totals),
+	)
+}
+
+func TestHistory(t *T) {
+	b := NewInMem()
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+	_, err := b.IncrAs(userA, 10, JournalSourceEarn)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = b.TransferAs(userB, userA, 4, JournalSourceGive)
+	massert.Require(t, massert.Nil(err))
+	_, _, err = b.TransferAs(userA, userA, 1, JournalSourceGive)
+	massert.Require(t, massert.Nil(err))
+
+	history, cursor, err := b.History(userA, "", 10)
+	massert.Require(t,
+		massert.Nil(err),
+		// transferring to yourself isn't journaled, so isn't in the history.
+		massert.Length(history, 2),
+		massert.Equal("", cursor),
+		massert.Equal(HistoryEntry{
+			ID: history[0].ID, Time: history[0].Time, Source: JournalSourceGive,
+			Amount: -4, Counterparty: userB,
+		}, history[0]),
+		massert.Equal(HistoryEntry{
+			ID: history[1].ID, Time: history[1].Time, Source: JournalSourceEarn,
+			Amount: 10, Counterparty: LedgerAccountIssuance,
+		}, history[1]),
+	)
+
+	history, _, err = b.History(userB, "", 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(history, 1),
+		massert.Equal(4, history[0].Amount),
+		massert.Equal(userA, history[0].Counterparty),
+	)
+}
+
+func TestTopGivers(t *T) {
+	b := NewInMem()
+	userA, userB, userC := mrand.Hex(8), mrand.Hex(8), mrand.Hex(8)
+
+	_, err := b.Incr(userA, 10)
+	massert.Require(t, massert.Nil(err))
+	_, err = b.Incr(userB, 10)
+	massert.Require(t, massert.Nil(err))
+
+	give := func(dst, src string, amount int, source string) {
+		_, _, err := b.TransferAs(dst, src, amount, source)
+		massert.Require(t, massert.Nil(err))
+	}
+	give(userC, userA, 2, JournalSourceGive)
+	give(userC, userA, 2, JournalSourceGive)
+	give(userC, userB, 5, JournalSourceGive)
+	// only gives count.
+	give(userC, userA, 3, JournalSourceTransfer)
+
+	totals, err := b.TopGivers(time.Now(), 10)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal([]GiveTotal{
+			{UserID: userB, Amount: 5, NumGives: 1},
+			{UserID: userA, Amount: 4, NumGives: 2},
+		}, totals),
+	)
+
+	totals, err = b.TopGivers(time.Now(), 1)
+	massert.Require(t, massert.Nil(err), massert.Length(totals, 1))
+
+	totals, err = b.TopGivers(time.Now().AddDate(0, 0, -40), 10)
+	massert.Require(t, massert.Nil(err), massert.Length(totals, 0))
+}
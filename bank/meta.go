@@ -0,0 +1,41 @@
+package bank
+
+import (
+	"fmt"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+func (b *redisBank) metaKey(key string) string {
+	return b.key("meta:" + key)
+}
+
+func (b *redisBank) GetMeta(userID, key string) (string, error) {
+	var value string
+	mn := radix.MaybeNil{Rcv: &value}
+	if err := b.Do(radix.Cmd(&mn, "HGET", b.metaKey(key), userID)); err != nil {
+		return "", fmt.Errorf("error retrieving meta %q from redis: %w", key, err)
+	}
+	return value, nil
+}
+
+func (b *redisBank) SetMeta(userID, key, value string) error {
+	var err error
+	if value == "" {
+		err = b.Do(radix.Cmd(nil, "HDEL", b.metaKey(key), userID))
+	} else {
+		err = b.Do(radix.Cmd(nil, "HSET", b.metaKey(key), userID, value))
+	}
+	if err != nil {
+		return fmt.Errorf("error setting meta %q in redis: %w", key, err)
+	}
+	return nil
+}
+
+func (b *redisBank) AllMeta(key string) (map[string]string, error) {
+	values := map[string]string{}
+	if err := b.Do(radix.Cmd(&values, "HGETALL", b.metaKey(key))); err != nil {
+		return nil, fmt.Errorf("error retrieving all meta %q from redis: %w", key, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,55 @@
+package bank
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestMeta(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	assertMeta := func(userID, key, expValue string) massert.Assertion {
+		value, err := bank.GetMeta(userID, key)
+		return massert.All(
+			massert.Nil(err),
+			massert.Equal(expValue, value),
+		)
+	}
+
+	assertAllMeta := func(key string, expValues map[string]string) massert.Assertion {
+		values, err := bank.AllMeta(key)
+		return massert.All(
+			massert.Nil(err),
+			massert.Equal(expValues, values),
+		)
+	}
+
+	mtest.Run(cmp, t, func() {
+		bank.(*redisBank).keyPrefix = "test:bank-" + mrand.Hex(8)
+		userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+		massert.Require(t,
+			assertMeta(userA, "foo", ""),
+			assertAllMeta("foo", map[string]string{}),
+		)
+
+		massert.Require(t, massert.Nil(bank.SetMeta(userA, "foo", "a")))
+		massert.Require(t, massert.Nil(bank.SetMeta(userB, "foo", "b")))
+		massert.Require(t,
+			assertMeta(userA, "foo", "a"),
+			assertMeta(userB, "foo", "b"),
+			assertMeta(userA, "bar", ""),
+			assertAllMeta("foo", map[string]string{userA: "a", userB: "b"}),
+		)
+
+		massert.Require(t, massert.Nil(bank.SetMeta(userA, "foo", "")))
+		massert.Require(t,
+			assertMeta(userA, "foo", ""),
+			assertAllMeta("foo", map[string]string{userB: "b"}),
+		)
+	})
+}
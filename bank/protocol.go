@@ -0,0 +1,60 @@
+package bank
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ExportPayload is the protocol specific part of an Export, describing how the
+// funds are to be transferred. Each protocol has its own type of payload, which
+// must be able to be marshaled to JSON and back.
+type ExportPayload interface {
+	// ExportProtocol returns the name of the protocol which the payload is for.
+	ExportProtocol() string
+}
+
+// ExportProtocol describes how to decode the ExportPayloads of a protocol.
+type ExportProtocol struct {
+	// Unmarshal decodes a payload which was marshaled as JSON.
+	Unmarshal func([]byte) (ExportPayload, error)
+
+	// UnmarshalLegacy is optional, and decodes a payload from an Export
+	// submitted before payloads were typed, when they were a plain string. If
+	// not set then those Exports can't be consumed.
+	UnmarshalLegacy func(string) (ExportPayload, error)
+}
+
+// errExportProtocol is returned when encoding or decoding an Export whose
+// protocol hasn't been registered.
+var errExportProtocol = errors.New("export protocol isn't registered")
+
+var (
+	exportProtocolsL sync.RWMutex
+	exportProtocols  = map[string]ExportProtocol{}
+)
+
+// RegisterExportProtocol registers the protocol of the given name, so that
+// Exports with its payloads can be submitted and consumed. It's intended to be
+// called from the init function of the package which implements the protocol,
+// and panics if the protocol is registered twice.
+func RegisterExportProtocol(name string, protocol ExportProtocol) {
+	exportProtocolsL.Lock()
+	defer exportProtocolsL.Unlock()
+	if _, ok := exportProtocols[name]; ok {
+		panic(fmt.Sprintf("export protocol %q registered twice", name))
+	} else if protocol.Unmarshal == nil {
+		panic(fmt.Sprintf("export protocol %q has no Unmarshal", name))
+	}
+	exportProtocols[name] = protocol
+}
+
+func exportProtocolByName(name string) (ExportProtocol, error) {
+	exportProtocolsL.RLock()
+	defer exportProtocolsL.RUnlock()
+	protocol, ok := exportProtocols[name]
+	if !ok {
+		return ExportProtocol{}, fmt.Errorf("%q: %w", name, errExportProtocol)
+	}
+	return protocol, nil
+}
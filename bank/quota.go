@@ -0,0 +1,66 @@
+package bank
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// checkQuotaTTL returns an error if the ttl can't be given to UseQuota.
+func checkQuotaTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("malformed quota ttl %s", ttl)
+	}
+	return nil
+}
+
+// applyQuota returns what a quota which had used of it used will have used
+// once amount more is, or ErrQuotaExceeded if that's over max. Giving back
+// never takes it below zero.
+func applyQuota(used, amount, max int) (int, error) {
+	newUsed := used + amount
+	if amount > 0 && newUsed > max {
+		return 0, ErrQuotaExceeded
+	} else if newUsed < 0 {
+		newUsed = 0
+	}
+	return newUsed, nil
+}
+
+func (b *redisBank) quotaKey(key string) string {
+	return b.key("quota:" + key)
+}
+
+// Keys:[quotaKey] Args:[amount, max, ttlMillis]
+var useQuotaCmd = radix.NewEvalScript(1, `
+	local amount, max = tonumber(ARGV[1]), tonumber(ARGV[2])
+	local exists = redis.call("EXISTS", KEYS[1]) == 1
+	local used = tonumber(redis.call("GET", KEYS[1])) or 0
+	local newUsed = used + amount
+	if amount > 0 and newUsed > max then
+		return redis.error_reply("`+ErrQuotaExceeded.Error()+`")
+	elseif newUsed < 0 then
+		newUsed = 0
+	end
+	redis.call("INCRBY", KEYS[1], newUsed - used)
+	if not exists then
+		redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	end
+	return newUsed
+`)
+
+func (b *redisBank) UseQuota(key string, amount, max int, ttl time.Duration) (int, error) {
+	if err := checkQuotaTTL(ttl); err != nil {
+		return 0, err
+	}
+	var used int
+	err := b.Do(useQuotaCmd.Cmd(&used, b.quotaKey(key),
+		strconv.Itoa(amount), strconv.Itoa(max), strconv.FormatInt(ttl.Milliseconds(), 10),
+	))
+	if err != nil {
+		return 0, fmt.Errorf("using quota in redis: %w", err)
+	}
+	return used, nil
+}
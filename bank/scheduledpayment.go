@@ -0,0 +1,236 @@
+package bank
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/radix/v3"
+)
+
+// JournalSourceScheduled is the journal source of the transfers made by
+// PayScheduledPayment.
+const JournalSourceScheduled = "scheduled"
+
+// ScheduledPayment describes a payment from one user to another which is to be
+// made at some time, see Bank.SchedulePayment.
+type ScheduledPayment struct {
+	ID        string
+	SrcUserID string
+	DstUserID string
+	Amount    int
+	At        time.Time
+}
+
+// newScheduledPayment checks the arguments given to SchedulePayment, returning
+// the payment they describe with a new ID. IDs are shorter than those of holds
+// since users see them, and the time is kept to the millisecond, which is what
+// the redis bank stores it as.
+func newScheduledPayment(srcUserID, dstUserID string, amount int, at time.Time) (ScheduledPayment, error) {
+	_, srcCurrency := SplitCurrencyAccountID(srcUserID)
+	_, dstCurrency := SplitCurrencyAccountID(dstUserID)
+	switch {
+	case amount <= 0:
+		return ScheduledPayment{}, fmt.Errorf("malformed amount %d", amount)
+	case srcUserID == dstUserID:
+		return ScheduledPayment{}, fmt.Errorf("can't schedule a payment from %q to itself", srcUserID)
+	case srcCurrency != dstCurrency:
+		return ScheduledPayment{}, fmt.Errorf("can't schedule a payment from %q to %q, they hold different currencies", srcUserID, dstUserID)
+	case at.IsZero():
+		return ScheduledPayment{}, errors.New("no time to make the payment at given")
+	}
+	return ScheduledPayment{
+		ID:        mrand.Hex(6),
+		SrcUserID: srcUserID,
+		DstUserID: dstUserID,
+		Amount:    amount,
+		At:        at.Truncate(time.Millisecond),
+	}, nil
+}
+
+// scheduledPaymentKey is a hash of the source and destination users, amount and
+// time (in unix milliseconds) of the scheduled payment with the given ID. It's
+// deleted once the payment is made or canceled.
+func (b *redisBank) scheduledPaymentKey(paymentID string) string {
+	return b.key("scheduled-payment:" + paymentID)
+}
+
+// scheduledPaymentsKey is a sorted set of the IDs of all scheduled payments,
+// and userScheduledPaymentsKey of those from the given user, both scored by
+// when they're to be made in unix milliseconds.
+func (b *redisBank) scheduledPaymentsKey() string { return b.key("scheduled-payments") }
+
+func (b *redisBank) userScheduledPaymentsKey(userID string) string {
+	return b.key("scheduled-payments:" + userID)
+}
+
+// scheduledPaymentIdempotencyKey is the idempotency key which a scheduled
+// payment is made with. Canceling a payment uses the key up too, so that
+// whichever of making and canceling it happens first is the only one which
+// does.
+func scheduledPaymentIdempotencyKey(paymentID string) string {
+	return "scheduled-payment:" + paymentID
+}
+
+// Keys:[scheduledPaymentKey, scheduledPaymentsKey, userScheduledPaymentsKey] Args:[srcUser, dstUser, amount, at, paymentID]
+var schedulePaymentCmd = radix.NewEvalScript(3, `
+	redis.call("HSET", KEYS[1], "src", ARGV[1], "dst", ARGV[2], "amount", ARGV[3], "at", ARGV[4])
+	redis.call("ZADD", KEYS[2], ARGV[4], ARGV[5])
+	redis.call("ZADD", KEYS[3], ARGV[4], ARGV[5])
+`)
+
+func (b *redisBank) SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (string, error) {
+	p, err := newScheduledPayment(srcUserID, dstUserID, amount, at)
+	if err != nil {
+		return "", err
+	}
+	err = b.Do(schedulePaymentCmd.Cmd(
+		nil, b.scheduledPaymentKey(p.ID), b.scheduledPaymentsKey(), b.userScheduledPaymentsKey(srcUserID),
+		srcUserID, dstUserID, strconv.Itoa(amount), strconv.FormatInt(unixMs(p.At), 10), p.ID,
+	))
+	if err != nil {
+		return "", fmt.Errorf("scheduling payment in redis: %w", err)
+	}
+	return p.ID, nil
+}
+
+// getScheduledPayment returns the scheduled payment with the given ID, or
+// ErrScheduledPaymentNotFound.
+func (b *redisBank) getScheduledPayment(paymentID string) (ScheduledPayment, error) {
+	var fields map[string]string
+	if err := b.Do(radix.Cmd(&fields, "HGETALL", b.scheduledPaymentKey(paymentID))); err != nil {
+		return ScheduledPayment{}, fmt.Errorf("getting scheduled payment %q from redis: %w", paymentID, err)
+	} else if fields["src"] == "" {
+		return ScheduledPayment{}, ErrScheduledPaymentNotFound
+	}
+	amount, err := strconv.Atoi(fields["amount"])
+	if err != nil {
+		return ScheduledPayment{}, fmt.Errorf("malformed amount of scheduled payment %q: %w", paymentID, err)
+	}
+	at, err := strconv.ParseInt(fields["at"], 10, 64)
+	if err != nil {
+		return ScheduledPayment{}, fmt.Errorf("malformed time of scheduled payment %q: %w", paymentID, err)
+	}
+	return ScheduledPayment{
+		ID:        paymentID,
+		SrcUserID: fields["src"],
+		DstUserID: fields["dst"],
+		Amount:    amount,
+		At:        parseUnixMs(at),
+	}, nil
+}
+
+// getScheduledPayments returns the scheduled payments with the given IDs,
+// leaving out any which were made or canceled since the IDs were read.
+func (b *redisBank) getScheduledPayments(paymentIDs []string) ([]ScheduledPayment, error) {
+	payments := make([]ScheduledPayment, 0, len(paymentIDs))
+	for _, paymentID := range paymentIDs {
+		p, err := b.getScheduledPayment(paymentID)
+		if errors.Is(err, ErrScheduledPaymentNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, nil
+}
+
+func (b *redisBank) ScheduledPayments(srcUserID string) ([]ScheduledPayment, error) {
+	var paymentIDs []string
+	if err := b.Do(radix.Cmd(&paymentIDs, "ZRANGE", b.userScheduledPaymentsKey(srcUserID), "0", "-1")); err != nil {
+		return nil, fmt.Errorf("getting scheduled payments of %q from redis: %w", srcUserID, err)
+	}
+	return b.getScheduledPayments(paymentIDs)
+}
+
+func (b *redisBank) DueScheduledPayments(now time.Time, limit int) ([]ScheduledPayment, error) {
+	var paymentIDs []string
+	err := b.Do(radix.FlatCmd(&paymentIDs, "ZRANGEBYSCORE", b.scheduledPaymentsKey(),
+		"-inf", unixMs(now), "LIMIT", 0, limit))
+	if err != nil {
+		return nil, fmt.Errorf("getting due scheduled payments from redis: %w", err)
+	}
+	return b.getScheduledPayments(paymentIDs)
+}
+
+// Keys:[scheduledPaymentKey, scheduledPaymentsKey, userScheduledPaymentsKey] Args:[paymentID]
+var removeScheduledPaymentCmd = radix.NewEvalScript(3, `
+	redis.call("DEL", KEYS[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	redis.call("ZREM", KEYS[3], ARGV[1])
+`)
+
+func (b *redisBank) removeScheduledPayment(p ScheduledPayment) error {
+	err := b.Do(removeScheduledPaymentCmd.Cmd(
+		nil, b.scheduledPaymentKey(p.ID), b.scheduledPaymentsKey(), b.userScheduledPaymentsKey(p.SrcUserID),
+		p.ID,
+	))
+	if err != nil {
+		return fmt.Errorf("removing scheduled payment %q from redis: %w", p.ID, err)
+	}
+	return nil
+}
+
+// PayScheduledPayment makes the transfer with the payment's idempotency key,
+// and only then removes the payment, so that if removing it fails the next
+// attempt to make it finds the key used and just removes it.
+func (b *redisBank) PayScheduledPayment(paymentID string) (ScheduledPayment, int, int, error) {
+	p, err := b.getScheduledPayment(paymentID)
+	if err != nil {
+		return ScheduledPayment{}, 0, 0, err
+	}
+
+	newDstBalance, newSrcBalance, err := b.TransferOnce(
+		scheduledPaymentIdempotencyKey(paymentID), p.DstUserID, p.SrcUserID, p.Amount, JournalSourceScheduled, "",
+	)
+	if errors.Is(err, ErrNotEnoughFunds) {
+		return ScheduledPayment{}, 0, 0, err
+	} else if errors.Is(err, ErrDuplicate) {
+		// made or canceled by someone else, who didn't get to removing it.
+		if err := b.removeScheduledPayment(p); err != nil {
+			return ScheduledPayment{}, 0, 0, err
+		}
+		return ScheduledPayment{}, 0, 0, ErrScheduledPaymentNotFound
+	} else if err != nil {
+		return ScheduledPayment{}, 0, 0, err
+	} else if err := b.removeScheduledPayment(p); err != nil {
+		return ScheduledPayment{}, 0, 0, err
+	}
+	return p, newDstBalance, newSrcBalance, nil
+}
+
+// Keys:[scheduledPaymentKey, scheduledPaymentsKey, userScheduledPaymentsKey, idempotencyKey] Args:[paymentID]
+var cancelScheduledPaymentCmd = radix.NewEvalScript(4, `
+	local canceled = redis.call("EXISTS", KEYS[1]) == 1 and redis.call("EXISTS", KEYS[4]) == 0
+	if canceled then
+		`+useIdempotencyLua(4)+`
+	end
+	redis.call("DEL", KEYS[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	redis.call("ZREM", KEYS[3], ARGV[1])
+	if canceled then return 1 end
+	return 0
+`)
+
+func (b *redisBank) CancelScheduledPayment(paymentID string) (ScheduledPayment, error) {
+	p, err := b.getScheduledPayment(paymentID)
+	if err != nil {
+		return ScheduledPayment{}, err
+	}
+
+	var canceled int
+	err = b.Do(cancelScheduledPaymentCmd.Cmd(
+		&canceled, b.scheduledPaymentKey(paymentID), b.scheduledPaymentsKey(), b.userScheduledPaymentsKey(p.SrcUserID),
+		b.idempotencyKey(scheduledPaymentIdempotencyKey(paymentID)),
+		paymentID,
+	))
+	if err != nil {
+		return ScheduledPayment{}, fmt.Errorf("canceling scheduled payment in redis: %w", err)
+	} else if canceled == 0 {
+		return ScheduledPayment{}, ErrScheduledPaymentNotFound
+	}
+	return p, nil
+}
@@ -0,0 +1,192 @@
+package bank
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/radix/v3"
+)
+
+// Snapshotter is implemented by banks which can write out everything they hold
+// and load it back in, for backing up and restoring them. Only the redis bank
+// implements it, the others should be backed up using their databases' own
+// tools.
+type Snapshotter interface {
+	// WriteSnapshot writes everything the bank holds to the given Writer,
+	// returning how many keys were written. Writes which happen while the
+	// snapshot is being written may or may not be included, so whatever is
+	// writing to the bank should be stopped first.
+	WriteSnapshot(w io.Writer) (int, error)
+
+	// RestoreSnapshot loads a snapshot written by WriteSnapshot into the bank,
+	// returning how many keys were loaded. The snapshot may have been written
+	// by a bank with a different key prefix. If any of the snapshot's keys
+	// already exist in the bank then an error is returned, and nothing is
+	// overwritten.
+	RestoreSnapshot(r io.Reader) (int, error)
+
+	// DrillSnapshot restores the snapshot into a bank with its own key prefix,
+	// on the same redis, and checks that the restored bank is consistent. The
+	// restored bank is removed again afterwards.
+	DrillSnapshot(r io.Reader) (Drill, error)
+}
+
+// Drill is the result of Snapshotter.DrillSnapshot.
+type Drill struct {
+	// KeyPrefix is the prefix which the snapshot was restored under.
+	KeyPrefix string
+
+	// NumKeys is how many keys were restored.
+	NumKeys int
+
+	// Liabilities and Reconciliation are those of the restored bank, see
+	// Liabilities and Reconcile.
+	Liabilities    map[string]int
+	Reconciliation Reconciliation
+}
+
+// snapshotKey is a single line of a snapshot, describing one redis key.
+type snapshotKey struct {
+	// Key is relative to the key prefix of the bank it came from, so that it
+	// can be restored under a different one.
+	Key string `json:"key"`
+
+	// TTL is in milliseconds, and is zero if the key doesn't expire.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// Dump is the key's value as returned by redis' DUMP.
+	Dump []byte `json:"dump"`
+}
+
+// snapshotScanCount is how many keys are asked for in each SCAN made while
+// writing a snapshot.
+const snapshotScanCount = 1000
+
+// scanKeys calls fn with every key under the bank's key prefix.
+func (b *redisBank) scanKeys(fn func(key string) error) error {
+	scanner := radix.NewScanner(b.Redis, radix.ScanOpts{
+		Command: "SCAN",
+		Pattern: b.key("*"),
+		Count:   snapshotScanCount,
+	})
+	var key string
+	for scanner.Next(&key) {
+		if err := fn(key); err != nil {
+			scanner.Close()
+			return err
+		}
+	}
+	if err := scanner.Close(); err != nil {
+		return fmt.Errorf("scanning keys in redis: %w", translateRedisErr(err))
+	}
+	return nil
+}
+
+func (b *redisBank) WriteSnapshot(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var n int
+	err := b.scanKeys(func(key string) error {
+		sk := snapshotKey{Key: strings.TrimPrefix(key, b.key(""))}
+		mn := radix.MaybeNil{Rcv: &sk.Dump}
+		if err := b.Do(radix.Cmd(&mn, "DUMP", key)); err != nil {
+			return fmt.Errorf("dumping %q: %w", key, err)
+		} else if mn.Nil {
+			// the key expired or was deleted since it was scanned.
+			return nil
+		}
+
+		var ttl int64
+		if err := b.Do(radix.Cmd(&ttl, "PTTL", key)); err != nil {
+			return fmt.Errorf("getting ttl of %q: %w", key, err)
+		} else if ttl == -2 {
+			return nil
+		} else if ttl > 0 {
+			sk.TTL = ttl
+		}
+
+		if err := enc.Encode(sk); err != nil {
+			return fmt.Errorf("writing %q: %w", key, err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	} else if err := bw.Flush(); err != nil {
+		return n, fmt.Errorf("writing snapshot: %w", err)
+	}
+	return n, nil
+}
+
+// readSnapshot reads all keys out of a snapshot written by WriteSnapshot.
+func readSnapshot(r io.Reader) ([]snapshotKey, error) {
+	var keys []snapshotKey
+	dec := json.NewDecoder(r)
+	for {
+		var sk snapshotKey
+		if err := dec.Decode(&sk); err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading snapshot: %w", err)
+		} else if sk.Key == "" {
+			return nil, fmt.Errorf("snapshot key %d has no name", len(keys))
+		}
+		keys = append(keys, sk)
+	}
+}
+
+func (b *redisBank) RestoreSnapshot(r io.Reader) (int, error) {
+	keys, err := readSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// checking up-front means that a partial restore can only happen if
+	// something else writes to the bank in the meantime.
+	for _, sk := range keys {
+		var exists int
+		if err := b.Do(radix.Cmd(&exists, "EXISTS", b.key(sk.Key))); err != nil {
+			return 0, fmt.Errorf("checking if %q exists: %w", sk.Key, err)
+		} else if exists > 0 {
+			return 0, fmt.Errorf("can't restore over existing key %q", b.key(sk.Key))
+		}
+	}
+
+	for i, sk := range keys {
+		if err := b.Do(radix.FlatCmd(nil, "RESTORE", b.key(sk.Key), sk.TTL, sk.Dump)); err != nil {
+			return i, fmt.Errorf("restoring %q: %w", sk.Key, err)
+		}
+	}
+	return len(keys), nil
+}
+
+func (b *redisBank) DrillSnapshot(r io.Reader) (Drill, error) {
+	// the prefix mustn't fall under the bank's own, or the drill's keys would
+	// end up in the bank's snapshots.
+	drillBank := *b
+	drillBank.keyPrefix = b.keyPrefix + "-drill-" + mrand.Hex(8)
+	drillBank.archive = nil
+
+	drill := Drill{KeyPrefix: drillBank.keyPrefix}
+	var err error
+	if drill.NumKeys, err = drillBank.RestoreSnapshot(r); err == nil {
+		if drill.Liabilities, err = Liabilities(&drillBank); err == nil {
+			drill.Reconciliation, err = Reconcile(&drillBank)
+		}
+	}
+
+	delErr := drillBank.scanKeys(func(key string) error {
+		return drillBank.Do(radix.Cmd(nil, "DEL", key))
+	})
+	if err != nil {
+		return Drill{}, err
+	} else if delErr != nil {
+		return Drill{}, fmt.Errorf("removing drill keys under %q: %w", drillBank.keyPrefix, delErr)
+	}
+	return drill, nil
+}
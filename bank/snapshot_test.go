@@ -0,0 +1,70 @@
+package bank
+
+import (
+	"bytes"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestSnapshot(t *T) {
+	cmp := mtest.Component()
+	bank := Inst(cmp)
+
+	mtest.Run(cmp, t, func() {
+		rb := bank.(*redisBank)
+		rb.keyPrefix = "test:bank-" + mrand.Hex(8)
+
+		userA, userB := mrand.Hex(8), mrand.Hex(8)
+		_, err := bank.Incr(userA, 10)
+		massert.Require(t, massert.Nil(err))
+		_, _, err = bank.Transfer(userB, userA, 4)
+		massert.Require(t, massert.Nil(err))
+		_, err = bank.SubmitExport(Export{FromUserID: userA, Amount: 2, Payload: testPayload{Data: "a"}})
+		massert.Require(t, massert.Nil(err))
+		massert.Require(t, massert.Nil(bank.SetMeta(userA, "foo", "bar")))
+
+		buf := new(bytes.Buffer)
+		n, err := rb.WriteSnapshot(buf)
+		massert.Require(t, massert.Nil(err), massert.Equal(true, n > 0))
+		snapshot := buf.Bytes()
+
+		restored := *rb
+		restored.keyPrefix = "test:bank-" + mrand.Hex(8)
+		restoredN, err := restored.RestoreSnapshot(bytes.NewReader(snapshot))
+		massert.Require(t, massert.Nil(err), massert.Equal(n, restoredN))
+
+		balanceA, errA := restored.Balance(userA)
+		balanceB, errB := restored.Balance(userB)
+		meta, errMeta := restored.GetMeta(userA, "foo")
+		massert.Require(t,
+			massert.Nil(errA), massert.Equal(4, balanceA),
+			massert.Nil(errB), massert.Equal(4, balanceB),
+			massert.Nil(errMeta), massert.Equal("bar", meta),
+		)
+
+		// restoring over the top of existing keys isn't allowed.
+		_, err = restored.RestoreSnapshot(bytes.NewReader(snapshot))
+		massert.Require(t, massert.Not(massert.Nil(err)))
+
+		drill, err := rb.DrillSnapshot(bytes.NewReader(snapshot))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(n, drill.NumKeys),
+			massert.Equal(map[string]int{DefaultCurrency: 8}, drill.Liabilities),
+			massert.Length(drill.Reconciliation.Discrepancies, 0),
+		)
+
+		// the drill's keys are gone afterwards.
+		drillBank := *rb
+		drillBank.keyPrefix = drill.KeyPrefix
+		var numDrillKeys int
+		massert.Require(t, massert.Nil(drillBank.scanKeys(func(string) error {
+			numDrillKeys++
+			return nil
+		})))
+		massert.Require(t, massert.Equal(0, numDrillKeys))
+	})
+}
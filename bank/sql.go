@@ -0,0 +1,2053 @@
+package bank
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+)
+
+// sqlDialect describes the differences between the SQL databases which sqlBank
+// supports.
+type sqlDialect struct {
+	// name of the database, for docs and errors.
+	name string
+
+	// defaults of the driver and dsn params. If defaultDSN is empty then the
+	// dsn param is required.
+	defaultDriver, defaultDSN, exampleDSN string
+
+	// column definition of auto-incrementing primary keys, and column type of
+	// timestamps. IDs must never be reused, even once the latest row is
+	// deleted.
+	serialType, timeType string
+
+	// appended to SELECTs which lock the rows they select, and which also skip
+	// rows locked by other transactions.
+	forUpdate, forUpdateSkipLocked string
+
+	// if set then the "$1" style placeholders which queries are written with
+	// are rewritten as "?1".
+	questionPlaceholders bool
+
+	// if greater than zero, the most connections which are opened to the
+	// database at once.
+	maxOpenConns int
+
+	// statements run once the tables have been created.
+	initStmts []string
+
+	// lockTable locks the table against inserts until the end of the
+	// transaction, and lockKey locks an arbitrary key until the end of the
+	// transaction.
+	lockTable func(tx *sql.Tx, table string) error
+	lockKey   func(tx *sql.Tx, key string) error
+}
+
+// sqlBank is an ExportingBank which keeps everything in a SQL database, see
+// InstPostgres and InstSQLite. It only uses database/sql, the driver must be
+// imported by the binary.
+//
+// The export and earn streams are tables, with a pending table alongside them
+// which has a row for each entry which a consumer group has yet to Ack.
+// Consumers claim pending rows using SELECT ... FOR UPDATE SKIP LOCKED, where
+// the database supports it, so they never block each other, and a claim
+// expires after claimTimeout so that entries claimed by a consumer which went
+// away are redelivered.
+//
+// All timestamps are written in UTC, so that databases which store them as
+// strings (i.e. SQLite) compare them correctly.
+type sqlBank struct {
+	cmp         *mcmp.Component
+	dialect     sqlDialect
+	db          *sql.DB
+	tablePrefix string
+
+	// how often consumers check for new entries when there's nothing pending,
+	// and how long an entry stays claimed by a consumer before it's
+	// redelivered.
+	pollInterval time.Duration
+	claimTimeout time.Duration
+
+	negativePolicy string
+	negativeLimit  int
+	overdraft      int
+
+	// optional, where exports trimmed from the table are kept.
+	archive *exportArchive
+}
+
+// Names of the streams which share the pending and groups tables.
+const (
+	sqlStreamExports = "exports"
+	sqlStreamEarns   = "earns"
+)
+
+// sqlTrimEvery is how many inserts into an append-only table happen between
+// trims of it, so that the cost of trimming is spread out.
+const sqlTrimEvery = 1000
+
+var sqlTablePrefixRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// sqlPlaceholderRegexp matches the "$1" style placeholders which queries are
+// written with.
+var sqlPlaceholderRegexp = regexp.MustCompile(`\$([0-9]+)`)
+
+func instSQL(parent *mcmp.Component, dialect sqlDialect) *sqlBank {
+	cmp := parent.Child("bank")
+	b := &sqlBank{cmp: cmp, dialect: dialect}
+
+	driverName := mcfg.String(cmp, "driver",
+		mcfg.ParamDefault(dialect.defaultDriver),
+		mcfg.ParamUsage("Name of the database/sql driver used to connect to "+dialect.name))
+	dsnOpts := []mcfg.ParamOption{
+		mcfg.ParamUsage("Connection string of the " + dialect.name + " database, e.g. \"" + dialect.exampleDSN + "\""),
+	}
+	if dialect.defaultDSN == "" {
+		dsnOpts = append(dsnOpts, mcfg.ParamRequired())
+	} else {
+		dsnOpts = append(dsnOpts, mcfg.ParamDefault(dialect.defaultDSN))
+	}
+	dsn := mcfg.String(cmp, "dsn", dsnOpts...)
+	tablePrefix := mcfg.String(cmp, "table-prefix",
+		mcfg.ParamDefault("buckaroo_"),
+		mcfg.ParamUsage("Prefix of all tables used by the bank, which are created if they don't exist"))
+	pollInterval := mcfg.String(cmp, "poll-interval",
+		mcfg.ParamDefault("1s"),
+		mcfg.ParamUsage("How often consumers of exports and earns check for new ones when there aren't any"))
+	claimTimeout := mcfg.String(cmp, "claim-timeout",
+		mcfg.ParamDefault("5m"),
+		mcfg.ParamUsage("How long an export or earn can be held by a consumer without being Ack'd before it's given to another"))
+	negativeBalance := negativeBalanceParams(cmp)
+	archiveDir := mcfg.String(cmp, "archive-dir",
+		mcfg.ParamUsage("Optional directory which exports trimmed from the database are archived to, as daily JSONL files. Archived exports are still included in export history."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		if !sqlTablePrefixRegexp.MatchString(*tablePrefix) {
+			return fmt.Errorf("table-prefix must match %s", sqlTablePrefixRegexp)
+		}
+		b.tablePrefix = *tablePrefix
+
+		var err error
+		if b.pollInterval, err = time.ParseDuration(*pollInterval); err != nil {
+			return fmt.Errorf("parsing poll-interval: %w", err)
+		} else if b.pollInterval <= 0 {
+			return errors.New("poll-interval must be greater than 0")
+		} else if b.claimTimeout, err = time.ParseDuration(*claimTimeout); err != nil {
+			return fmt.Errorf("parsing claim-timeout: %w", err)
+		} else if b.claimTimeout <= 0 {
+			return errors.New("claim-timeout must be greater than 0")
+		} else if b.negativePolicy, b.negativeLimit, b.overdraft, err = negativeBalance(); err != nil {
+			return err
+		}
+		cmp.Annotate("negativeBalancePolicy", b.negativePolicy)
+
+		if *archiveDir != "" {
+			if err := os.MkdirAll(*archiveDir, 0755); err != nil {
+				return fmt.Errorf("creating archive-dir: %w", err)
+			}
+			b.archive = &exportArchive{dir: *archiveDir}
+		}
+
+		if b.db, err = sql.Open(*driverName, *dsn); err != nil {
+			return fmt.Errorf("opening database: %w", err)
+		} else if dialect.maxOpenConns > 0 {
+			b.db.SetMaxOpenConns(dialect.maxOpenConns)
+		}
+		if err := b.db.PingContext(ctx); err != nil {
+			return fmt.Errorf("connecting to database: %w", translateSQLErr(err))
+		} else if err := b.createTables(ctx); err != nil {
+			return err
+		}
+
+		n, err := b.openJournal(ctx)
+		if err != nil {
+			return err
+		} else if n > 0 {
+			mlog.From(cmp).Info("opened journal with existing balances", mctx.Annotate(ctx, "numAccounts", n))
+		}
+		return nil
+	})
+	mrun.ShutdownHook(cmp, func(context.Context) error {
+		if b.db == nil {
+			return nil
+		}
+		return b.db.Close()
+	})
+
+	return b
+}
+
+// translateSQLErr is the equivalent of translateRedisErr.
+func translateSQLErr(err error) error {
+	var netErr net.Error
+	if err == nil {
+		return nil
+	} else if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	return err
+}
+
+// table returns the full name of the table with the given suffix.
+func (b *sqlBank) table(suffix string) string {
+	return b.tablePrefix + suffix
+}
+
+// query replaces each "{suffix}" in the query with the full name of that
+// table, along with the dialect's locking clauses and placeholders.
+func (b *sqlBank) query(q string) string {
+	for _, suffix := range []string{
+		"balances", "meta", "balance_events", "journal", "journal_reasons", "gives", "supply", "idempotency_keys", "quotas", "holds", "earn_events", "earn_caps", "overdrafts", "scheduled_payments",
+		"stream_groups", "stream_pending",
+		sqlStreamEarns, sqlStreamExports,
+	} {
+		q = strings.Replace(q, "{"+suffix+"}", b.table(suffix), -1)
+	}
+	q = strings.Replace(q, "{for_update_skip_locked}", b.dialect.forUpdateSkipLocked, -1)
+	q = strings.Replace(q, "{for_update}", b.dialect.forUpdate, -1)
+	q = strings.Replace(q, "{serial}", b.dialect.serialType, -1)
+	q = strings.Replace(q, "{time}", b.dialect.timeType, -1)
+	if b.dialect.questionPlaceholders {
+		q = sqlPlaceholderRegexp.ReplaceAllString(q, "?$1")
+	}
+	return q
+}
+
+func (b *sqlBank) createTables(ctx context.Context) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS {balances} (
+			user_id TEXT PRIMARY KEY,
+			balance BIGINT NOT NULL DEFAULT 0,
+			owed BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS {balances}_balance ON {balances} (balance)`,
+		`CREATE TABLE IF NOT EXISTS {meta} (
+			meta_key TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (meta_key, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {balance_events} (
+			id {serial},
+			user_id TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {journal} (
+			id {serial},
+			created_at {time} NOT NULL,
+			from_account TEXT NOT NULL,
+			to_account TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			source TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS {journal}_from_account ON {journal} (from_account, id)`,
+		`CREATE INDEX IF NOT EXISTS {journal}_to_account ON {journal} (to_account, id)`,
+		// reasons are kept apart from the journal, since most entries don't
+		// have one, and so that journals created before reasons existed don't
+		// need altering.
+		`CREATE TABLE IF NOT EXISTS {journal_reasons} (
+			journal_id BIGINT PRIMARY KEY,
+			reason TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {gives} (
+			month TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			num_gives BIGINT NOT NULL,
+			PRIMARY KEY (month, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {supply} (
+			day TEXT NOT NULL,
+			direction TEXT NOT NULL,
+			source TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			PRIMARY KEY (day, direction, source)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {idempotency_keys} (
+			idempotency_key TEXT PRIMARY KEY,
+			expires_at {time} NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {quotas} (
+			quota_key TEXT PRIMARY KEY,
+			used BIGINT NOT NULL,
+			expires_at {time} NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {holds} (
+			hold_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			expires_at {time}
+		)`,
+		`CREATE INDEX IF NOT EXISTS {holds}_expires_at ON {holds} (expires_at)`,
+		// like reasons, overdrafts are kept apart from balances so that
+		// tables created before they existed don't need altering.
+		`CREATE TABLE IF NOT EXISTS {overdrafts} (
+			user_id TEXT PRIMARY KEY,
+			overdraft BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {scheduled_payments} (
+			payment_id TEXT PRIMARY KEY,
+			src_user_id TEXT NOT NULL,
+			dst_user_id TEXT NOT NULL,
+			amount BIGINT NOT NULL,
+			pay_at {time} NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS {scheduled_payments}_pay_at ON {scheduled_payments} (pay_at)`,
+		`CREATE INDEX IF NOT EXISTS {scheduled_payments}_src_user_id ON {scheduled_payments} (src_user_id, pay_at)`,
+		`CREATE TABLE IF NOT EXISTS {earn_events} (
+			event_id TEXT PRIMARY KEY,
+			expires_at {time} NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {earn_caps} (
+			cap_key TEXT NOT NULL,
+			token TEXT NOT NULL,
+			expires_at {time} NOT NULL,
+			PRIMARY KEY (cap_key, token)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {earns} (
+			id {serial},
+			created_at {time} NOT NULL,
+			json TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS {earns}_created_at ON {earns} (created_at)`,
+		`CREATE TABLE IF NOT EXISTS {exports} (
+			id {serial},
+			created_at {time} NOT NULL,
+			json TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS {exports}_created_at ON {exports} (created_at)`,
+		`CREATE TABLE IF NOT EXISTS {stream_groups} (
+			stream TEXT NOT NULL,
+			group_name TEXT NOT NULL,
+			PRIMARY KEY (stream, group_name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS {stream_pending} (
+			stream TEXT NOT NULL,
+			group_name TEXT NOT NULL,
+			id BIGINT NOT NULL,
+			claimed_until {time} NOT NULL,
+			PRIMARY KEY (stream, group_name, id)
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := b.db.ExecContext(ctx, b.query(stmt)); err != nil {
+			return fmt.Errorf("creating tables: %w", translateSQLErr(err))
+		}
+	}
+	for _, stmt := range b.dialect.initStmts {
+		if _, err := b.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("running %q: %w", stmt, translateSQLErr(err))
+		}
+	}
+	return nil
+}
+
+// withTx runs fn within a transaction, which is committed if fn returns nil
+// and rolled back otherwise.
+func (b *sqlBank) withTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateSQLErr(err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return translateSQLErr(err)
+	}
+	return translateSQLErr(tx.Commit())
+}
+
+// lockBalance makes sure the user has a row in the balances table, locks it
+// for the rest of the transaction, and returns its balance and owed amount.
+func (b *sqlBank) lockBalance(tx *sql.Tx, userID string) (int, int, error) {
+	_, err := tx.Exec(b.query(
+		`INSERT INTO {balances} (user_id) VALUES ($1) ON CONFLICT DO NOTHING`,
+	), userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	var balance, owed int
+	err = tx.QueryRow(b.query(
+		`SELECT balance, owed FROM {balances} WHERE user_id = $1 {for_update}`,
+	), userID).Scan(&balance, &owed)
+	return balance, owed, err
+}
+
+// minBalance returns the lowest balance which the user can be taken to, see
+// Bank.Overdraft.
+func (b *sqlBank) minBalance(tx *sql.Tx, userID string) (int, error) {
+	overdraft := b.overdraft
+	err := tx.QueryRow(b.query(
+		`SELECT overdraft FROM {overdrafts} WHERE user_id = $1`,
+	), userID).Scan(&overdraft)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return -overdraft, nil
+}
+
+// setBalance sets the balance and owed amount of a user whose row was locked
+// with lockBalance, and records a balance event if the balance changed.
+func (b *sqlBank) setBalance(tx *sql.Tx, userID string, oldBalance, newBalance, owed int) error {
+	_, err := tx.Exec(b.query(
+		`UPDATE {balances} SET balance = $2, owed = $3 WHERE user_id = $1`,
+	), userID, newBalance, owed)
+	if err != nil || oldBalance == newBalance {
+		return err
+	}
+
+	// ids from a sequence aren't necessarily committed in order, so a reader
+	// of BalanceEvents can miss an event which commits after it has read past
+	// it. That's acceptable for keeping caches up to date, which have their
+	// own expiry.
+	var id int64
+	err = tx.QueryRow(b.query(
+		`INSERT INTO {balance_events} (user_id) VALUES ($1) RETURNING id`,
+	), userID).Scan(&id)
+	if err != nil || id%sqlTrimEvery != 0 {
+		return err
+	}
+	_, err = tx.Exec(b.query(
+		`DELETE FROM {balance_events} WHERE id <= $1`,
+	), id-balanceEventsMaxLen)
+	return err
+}
+
+// addJournalEntry adds the entry to the journal, unless its Amount is zero.
+func (b *sqlBank) addJournalEntry(tx *sql.Tx, e JournalEntry) error {
+	if e.Amount == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	var id int64
+	err := tx.QueryRow(b.query(
+		`INSERT INTO {journal} (created_at, from_account, to_account, amount, source)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+	), now, e.From, e.To, e.Amount, e.Source).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if e.Reason != "" {
+		_, err := tx.Exec(b.query(
+			`INSERT INTO {journal_reasons} (journal_id, reason) VALUES ($1, $2)`,
+		), id, e.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.Source == JournalSourceGive {
+		_, err := tx.Exec(b.query(
+			`INSERT INTO {gives} (month, user_id, amount, num_gives) VALUES ($1, $2, $3, 1)
+			ON CONFLICT (month, user_id) DO UPDATE SET
+				amount = {gives}.amount + EXCLUDED.amount,
+				num_gives = {gives}.num_gives + 1`,
+		), givesMonth(now), e.From, e.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	if direction, ok := supplyDirection(e); ok {
+		_, err := tx.Exec(b.query(
+			`INSERT INTO {supply} (day, direction, source, amount) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (day, direction, source) DO UPDATE SET
+				amount = {supply}.amount + EXCLUDED.amount`,
+		), supplyDayStr(now), direction, e.Source, e.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openJournal is the equivalent of redisBank's.
+func (b *sqlBank) openJournal(ctx context.Context) (int, error) {
+	var n int64
+	err := b.withTx(ctx, func(tx *sql.Tx) error {
+		// two instances starting at once mustn't both open it.
+		if err := b.dialect.lockTable(tx, b.table("journal")); err != nil {
+			return err
+		}
+		var id int64
+		err := tx.QueryRow(b.query(`SELECT id FROM {journal} LIMIT 1`)).Scan(&id)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		res, err := tx.Exec(b.query(
+			`INSERT INTO {journal} (created_at, from_account, to_account, amount, source)
+			SELECT $1,
+				CASE WHEN balance > 0 THEN $2 ELSE user_id END,
+				CASE WHEN balance > 0 THEN user_id ELSE $2 END,
+				ABS(balance), $3
+			FROM {balances} WHERE balance <> 0`,
+		), time.Now().UTC(), LedgerAccountOpening, JournalSourceOpening)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("opening journal in database: %w", err)
+	}
+	return int(n), nil
+}
+
+// applyIncr is the Go equivalent of incrCmd. It returns the new balance and
+// owed amount of a user who has the given balance and owed amount, after
+// incrementing their balance under the given negative balance policy, which
+// applies below the given minimum balance.
+func applyIncr(policy string, limit, minBalance, balance, owed, by int) (int, int, error) {
+	minInt := func(a, b int) int {
+		if a < b {
+			return a
+		}
+		return b
+	}
+
+	switch {
+	case policy == NegativeBalanceOwe:
+		if by > 0 {
+			settled := minInt(owed, by)
+			owed -= settled
+			by -= settled
+		} else if balance+by < minBalance {
+			applied := minInt(0, minBalance-balance)
+			owed += applied - by
+			by = applied
+		}
+	case balance+by >= minBalance || by >= 0:
+		// nothing to do
+	case policy == NegativeBalanceClamp:
+		by = minInt(0, minBalance-balance)
+	case policy == NegativeBalanceAllow:
+		if balance+by < minBalance-limit {
+			return 0, 0, ErrNotEnoughFunds
+		}
+	default:
+		return 0, 0, ErrNotEnoughFunds
+	}
+	return balance + by, owed, nil
+}
+
+func (b *sqlBank) Balance(userID string) (int, error) {
+	var balance int
+	err := b.db.QueryRow(b.query(
+		`SELECT balance FROM {balances} WHERE user_id = $1`,
+	), userID).Scan(&balance)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error retrieving balance from database: %w", translateSQLErr(err))
+	}
+	return balance, nil
+}
+
+// useIdempotencyKey marks the idempotency key as used within the transaction,
+// returning ErrDuplicate if it already was, see IncrOnce. If the transaction is
+// rolled back then so is the key being used. It does nothing if the key is
+// empty.
+func (b *sqlBank) useIdempotencyKey(tx *sql.Tx, key string) error {
+	if key == "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	_, err := tx.Exec(b.query(
+		`DELETE FROM {idempotency_keys} WHERE idempotency_key = $1 AND expires_at <= $2`,
+	), key, now)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(b.query(
+		`INSERT INTO {idempotency_keys} (idempotency_key, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+	), key, now.Add(idempotencyKeyTTL))
+	if err != nil {
+		return err
+	} else if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (b *sqlBank) Incr(userID string, by int) (int, error) {
+	return b.IncrAs(userID, by, JournalSourceIncr)
+}
+
+func (b *sqlBank) IncrAs(userID string, by int, source string) (int, error) {
+	return b.IncrOnce("", userID, by, source)
+}
+
+func (b *sqlBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	var newBalance int
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := b.useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		balance, owed, err := b.lockBalance(tx, userID)
+		if err != nil {
+			return err
+		}
+		minBalance, err := b.minBalance(tx, userID)
+		if err != nil {
+			return err
+		}
+		var newOwed int
+		if newBalance, newOwed, err = applyIncr(b.negativePolicy, b.negativeLimit, minBalance, balance, owed, by); err != nil {
+			return err
+		} else if err := b.setBalance(tx, userID, balance, newBalance, newOwed); err != nil {
+			return err
+		}
+		return b.addJournalEntry(tx, journalEntry(userID, newBalance-balance, LedgerAccountIssuance, source))
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("incrementing balance in database: %w", err)
+	}
+	return newBalance, nil
+}
+
+func (b *sqlBank) Owed(userID string) (int, error) {
+	var owed int
+	err := b.db.QueryRow(b.query(
+		`SELECT owed FROM {balances} WHERE user_id = $1`,
+	), userID).Scan(&owed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error retrieving owed amount from database: %w", translateSQLErr(err))
+	}
+	return owed, nil
+}
+
+func (b *sqlBank) Overdraft(userID string) (int, error) {
+	overdraft := b.overdraft
+	err := b.db.QueryRow(b.query(
+		`SELECT overdraft FROM {overdrafts} WHERE user_id = $1`,
+	), userID).Scan(&overdraft)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("getting overdraft from database: %w", translateSQLErr(err))
+	}
+	return overdraft, nil
+}
+
+func (b *sqlBank) SetOverdraft(userID string, overdraft int) error {
+	var err error
+	if overdraft < 0 {
+		_, err = b.db.Exec(b.query(
+			`DELETE FROM {overdrafts} WHERE user_id = $1`,
+		), userID)
+	} else {
+		_, err = b.db.Exec(b.query(
+			`INSERT INTO {overdrafts} (user_id, overdraft) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET overdraft = EXCLUDED.overdraft`,
+		), userID, overdraft)
+	}
+	if err != nil {
+		return fmt.Errorf("setting overdraft in database: %w", translateSQLErr(err))
+	}
+	return nil
+}
+
+func (b *sqlBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	return b.TransferAs(dstUserID, srcUserID, amount, JournalSourceTransfer)
+}
+
+func (b *sqlBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	return b.TransferWithReason(dstUserID, srcUserID, amount, source, "")
+}
+
+func (b *sqlBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	return b.TransferOnce("", dstUserID, srcUserID, amount, source, reason)
+}
+
+func (b *sqlBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	var newDstBalance, newSrcBalance int
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := b.useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		var err error
+		newDstBalance, newSrcBalance, err = b.transfer(tx, dstUserID, srcUserID, amount, source, reason)
+		return err
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return 0, 0, err
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("transfering amount in database: %w", err)
+	}
+	return newDstBalance, newSrcBalance, nil
+}
+
+// transfer makes a transfer within the given transaction, returning the new
+// balances of the destination and source users.
+func (b *sqlBank) transfer(tx *sql.Tx, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	// rows are always locked in the same order, so that two transfers between
+	// the same users in opposite directions can't deadlock.
+	userIDs := []string{dstUserID, srcUserID}
+	sort.Strings(userIDs)
+	balances := map[string]int{}
+	owed := map[string]int{}
+	for _, userID := range userIDs {
+		if _, ok := balances[userID]; ok {
+			continue
+		}
+		var err error
+		if balances[userID], owed[userID], err = b.lockBalance(tx, userID); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	dstBalance, srcBalance := balances[dstUserID], balances[srcUserID]
+	if dstMin, err := b.minBalance(tx, dstUserID); err != nil {
+		return 0, 0, err
+	} else if srcMin, err := b.minBalance(tx, srcUserID); err != nil {
+		return 0, 0, err
+	} else if srcBalance-amount < srcMin || dstBalance+amount < dstMin {
+		return 0, 0, ErrNotEnoughFunds
+	}
+
+	// as with transferCmd, transferring to yourself leaves the balance as it
+	// was.
+	if dstUserID == srcUserID {
+		return dstBalance + amount, srcBalance, nil
+	}
+	newDstBalance, newSrcBalance := dstBalance+amount, srcBalance-amount
+	if err := b.setBalance(tx, dstUserID, dstBalance, newDstBalance, owed[dstUserID]); err != nil {
+		return 0, 0, err
+	} else if err := b.setBalance(tx, srcUserID, srcBalance, newSrcBalance, owed[srcUserID]); err != nil {
+		return 0, 0, err
+	} else if err := b.addJournalEntry(tx, transferJournalEntry(dstUserID, srcUserID, amount, source, reason)); err != nil {
+		return 0, 0, err
+	}
+	return newDstBalance, newSrcBalance, nil
+}
+
+func (b *sqlBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	return b.TransferMultiAs(srcUserID, dsts, JournalSourceTransfer)
+}
+
+func (b *sqlBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	return b.TransferMultiWithReason(srcUserID, dsts, source, "")
+}
+
+func (b *sqlBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	return b.TransferMultiOnce("", srcUserID, dsts, source, reason)
+}
+
+func (b *sqlBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	dstUserIDs, err := transferMultiDsts(srcUserID, dsts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	newDstBalances := make(map[string]int, len(dstUserIDs))
+	var newSrcBalance int
+	err = b.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := b.useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+
+		// as in TransferAs, rows are always locked in the same order.
+		userIDs := append([]string{srcUserID}, dstUserIDs...)
+		sort.Strings(userIDs)
+		balances := map[string]int{}
+		owed := map[string]int{}
+		for _, userID := range userIDs {
+			var err error
+			if balances[userID], owed[userID], err = b.lockBalance(tx, userID); err != nil {
+				return err
+			}
+		}
+
+		var total int
+		for _, amount := range dsts {
+			total += amount
+		}
+		if srcMin, err := b.minBalance(tx, srcUserID); err != nil {
+			return err
+		} else if newSrcBalance = balances[srcUserID] - total; newSrcBalance < srcMin {
+			return ErrNotEnoughFunds
+		}
+
+		for _, dstUserID := range dstUserIDs {
+			amount := dsts[dstUserID]
+			newDstBalances[dstUserID] = balances[dstUserID] + amount
+			if err := b.setBalance(tx, dstUserID, balances[dstUserID], newDstBalances[dstUserID], owed[dstUserID]); err != nil {
+				return err
+			} else if err := b.addJournalEntry(tx, transferJournalEntry(dstUserID, srcUserID, amount, source, reason)); err != nil {
+				return err
+			}
+		}
+		return b.setBalance(tx, srcUserID, balances[srcUserID], newSrcBalance, owed[srcUserID])
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("transfering amounts in database: %w", err)
+	}
+	return newDstBalances, newSrcBalance, nil
+}
+
+func (b *sqlBank) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	hold, err := newHold(userID, amount, ttl)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var newBalance int
+	err = b.withTx(context.Background(), func(tx *sql.Tx) error {
+		// as in TransferAs, rows are always locked in the same order.
+		holdsAccount := holdsAccountID(userID)
+		userIDs := []string{userID, holdsAccount}
+		sort.Strings(userIDs)
+		balances := map[string]int{}
+		owed := map[string]int{}
+		for _, id := range userIDs {
+			var err error
+			if balances[id], owed[id], err = b.lockBalance(tx, id); err != nil {
+				return err
+			}
+		}
+
+		if minBalance, err := b.minBalance(tx, userID); err != nil {
+			return err
+		} else if newBalance = balances[userID] - amount; newBalance < minBalance {
+			return ErrNotEnoughFunds
+		}
+		_, err := tx.Exec(b.query(
+			`INSERT INTO {holds} (hold_id, user_id, amount, expires_at) VALUES ($1, $2, $3, $4)`,
+		), hold.ID, userID, amount, sqlNullTime(hold.Expires))
+		if err != nil {
+			return err
+		} else if err := b.setBalance(tx, userID, balances[userID], newBalance, owed[userID]); err != nil {
+			return err
+		} else if err := b.setBalance(tx, holdsAccount, balances[holdsAccount], balances[holdsAccount]+amount, owed[holdsAccount]); err != nil {
+			return err
+		}
+		return b.addJournalEntry(tx, journalEntry(userID, -amount, holdsAccount, JournalSourceHold))
+	})
+	if errors.Is(err, ErrNotEnoughFunds) {
+		return "", 0, err
+	} else if err != nil {
+		return "", 0, fmt.Errorf("holding amount in database: %w", err)
+	}
+	return hold.ID, newBalance, nil
+}
+
+// finishHold is the equivalent of redisBank's.
+func (b *sqlBank) finishHold(holdID, dstUserID, source string) (Hold, int, error) {
+	var hold Hold
+	var newBalance int
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		if hold, err = b.deleteHold(tx, holdID); err != nil {
+			return err
+		} else if source == JournalSourceCapture && hold.expired(time.Now()) {
+			return ErrHoldExpired
+		} else if dstUserID == "" {
+			dstUserID = hold.UserID
+		} else if err := checkHoldDst(hold, dstUserID); err != nil {
+			return err
+		}
+		newBalance, err = b.moveHeld(tx, hold, dstUserID, source)
+		return err
+	})
+	if errors.Is(err, ErrHoldNotFound) || errors.Is(err, ErrHoldExpired) {
+		return Hold{}, 0, err
+	} else if err != nil {
+		return Hold{}, 0, fmt.Errorf("finishing hold in database: %w", err)
+	}
+	return hold, newBalance, nil
+}
+
+// deleteHold deletes the hold with the given ID within the transaction,
+// returning it, or ErrHoldNotFound if there isn't one. Deleting the hold's row
+// is what makes sure it can only be finished once, since a concurrent
+// transaction deleting it blocks this one.
+func (b *sqlBank) deleteHold(tx *sql.Tx, holdID string) (Hold, error) {
+	hold := Hold{ID: holdID}
+	var expiresAt sql.NullTime
+	err := tx.QueryRow(b.query(
+		`SELECT user_id, amount, expires_at FROM {holds} WHERE hold_id = $1 {for_update}`,
+	), holdID).Scan(&hold.UserID, &hold.Amount, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Hold{}, ErrHoldNotFound
+	} else if err != nil {
+		return Hold{}, err
+	}
+	if expiresAt.Valid {
+		hold.Expires = expiresAt.Time
+	}
+	if res, err := tx.Exec(b.query(`DELETE FROM {holds} WHERE hold_id = $1`), holdID); err != nil {
+		return Hold{}, err
+	} else if n, err := res.RowsAffected(); err != nil {
+		return Hold{}, err
+	} else if n == 0 {
+		return Hold{}, ErrHoldNotFound
+	}
+	return hold, nil
+}
+
+// moveHeld moves the funds of a hold, which has been deleted, to the given
+// user within the transaction, returning their new balance.
+func (b *sqlBank) moveHeld(tx *sql.Tx, hold Hold, dstUserID, source string) (int, error) {
+	holdsAccount := holdsAccountID(hold.UserID)
+	userIDs := []string{dstUserID, holdsAccount}
+	sort.Strings(userIDs)
+	balances := map[string]int{}
+	owed := map[string]int{}
+	for _, userID := range userIDs {
+		var err error
+		if balances[userID], owed[userID], err = b.lockBalance(tx, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	newBalance := balances[dstUserID] + hold.Amount
+	if err := b.setBalance(tx, dstUserID, balances[dstUserID], newBalance, owed[dstUserID]); err != nil {
+		return 0, err
+	} else if err := b.setBalance(tx, holdsAccount, balances[holdsAccount], balances[holdsAccount]-hold.Amount, owed[holdsAccount]); err != nil {
+		return 0, err
+	}
+	return newBalance, b.addJournalEntry(tx, journalEntry(dstUserID, hold.Amount, holdsAccount, source))
+}
+
+func (b *sqlBank) Capture(holdID, dstUserID string) (Hold, int, error) {
+	if dstUserID == "" {
+		return Hold{}, 0, errCaptureNoUser
+	}
+	return b.finishHold(holdID, dstUserID, JournalSourceCapture)
+}
+
+func (b *sqlBank) Release(holdID string) (Hold, int, error) {
+	return b.finishHold(holdID, "", JournalSourceRelease)
+}
+
+// sqlNullTime returns the time for storing in a nullable column, where a zero
+// time is NULL.
+func sqlNullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+func (b *sqlBank) ExpiredHolds(now time.Time, limit int) ([]Hold, error) {
+	rows, err := b.db.Query(b.query(
+		`SELECT hold_id, user_id, amount, expires_at FROM {holds}
+		WHERE expires_at <= $1 ORDER BY expires_at LIMIT $2`,
+	), now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting expired holds from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		var hold Hold
+		if err := rows.Scan(&hold.ID, &hold.UserID, &hold.Amount, &hold.Expires); err != nil {
+			return nil, fmt.Errorf("scanning hold: %w", err)
+		}
+		holds = append(holds, hold)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getting expired holds from database: %w", translateSQLErr(err))
+	}
+	return holds, nil
+}
+
+func (b *sqlBank) SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (string, error) {
+	p, err := newScheduledPayment(srcUserID, dstUserID, amount, at)
+	if err != nil {
+		return "", err
+	}
+	_, err = b.db.Exec(b.query(
+		`INSERT INTO {scheduled_payments} (payment_id, src_user_id, dst_user_id, amount, pay_at) VALUES ($1, $2, $3, $4, $5)`,
+	), p.ID, p.SrcUserID, p.DstUserID, p.Amount, p.At.UTC())
+	if err != nil {
+		return "", fmt.Errorf("scheduling payment in database: %w", translateSQLErr(err))
+	}
+	return p.ID, nil
+}
+
+// queryScheduledPayments returns the scheduled payments selected by the given
+// query, which must select all of their columns.
+func (b *sqlBank) queryScheduledPayments(q string, args ...interface{}) ([]ScheduledPayment, error) {
+	rows, err := b.db.Query(b.query(q), args...)
+	if err != nil {
+		return nil, fmt.Errorf("getting scheduled payments from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	var payments []ScheduledPayment
+	for rows.Next() {
+		var p ScheduledPayment
+		if err := rows.Scan(&p.ID, &p.SrcUserID, &p.DstUserID, &p.Amount, &p.At); err != nil {
+			return nil, fmt.Errorf("scanning scheduled payment: %w", err)
+		}
+		payments = append(payments, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getting scheduled payments from database: %w", translateSQLErr(err))
+	}
+	return payments, nil
+}
+
+func (b *sqlBank) ScheduledPayments(srcUserID string) ([]ScheduledPayment, error) {
+	return b.queryScheduledPayments(
+		`SELECT payment_id, src_user_id, dst_user_id, amount, pay_at FROM {scheduled_payments}
+		WHERE src_user_id = $1 ORDER BY pay_at`,
+		srcUserID,
+	)
+}
+
+func (b *sqlBank) DueScheduledPayments(now time.Time, limit int) ([]ScheduledPayment, error) {
+	return b.queryScheduledPayments(
+		`SELECT payment_id, src_user_id, dst_user_id, amount, pay_at FROM {scheduled_payments}
+		WHERE pay_at <= $1 ORDER BY pay_at LIMIT $2`,
+		now.UTC(), limit,
+	)
+}
+
+// takeScheduledPayment deletes the scheduled payment within the given
+// transaction and returns it. As with holds, deleting its row is what makes
+// sure it can only be made or canceled once.
+func (b *sqlBank) takeScheduledPayment(tx *sql.Tx, paymentID string) (ScheduledPayment, error) {
+	p := ScheduledPayment{ID: paymentID}
+	err := tx.QueryRow(b.query(
+		`SELECT src_user_id, dst_user_id, amount, pay_at FROM {scheduled_payments} WHERE payment_id = $1 {for_update}`,
+	), paymentID).Scan(&p.SrcUserID, &p.DstUserID, &p.Amount, &p.At)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ScheduledPayment{}, ErrScheduledPaymentNotFound
+	} else if err != nil {
+		return ScheduledPayment{}, err
+	}
+
+	if res, err := tx.Exec(b.query(`DELETE FROM {scheduled_payments} WHERE payment_id = $1`), paymentID); err != nil {
+		return ScheduledPayment{}, err
+	} else if n, err := res.RowsAffected(); err != nil {
+		return ScheduledPayment{}, err
+	} else if n == 0 {
+		return ScheduledPayment{}, ErrScheduledPaymentNotFound
+	}
+	return p, nil
+}
+
+func (b *sqlBank) PayScheduledPayment(paymentID string) (ScheduledPayment, int, int, error) {
+	var p ScheduledPayment
+	var newDstBalance, newSrcBalance int
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		if p, err = b.takeScheduledPayment(tx, paymentID); err != nil {
+			return err
+		}
+		newDstBalance, newSrcBalance, err = b.transfer(tx, p.DstUserID, p.SrcUserID, p.Amount, JournalSourceScheduled, "")
+		return err
+	})
+	if errors.Is(err, ErrScheduledPaymentNotFound) || errors.Is(err, ErrNotEnoughFunds) {
+		return ScheduledPayment{}, 0, 0, err
+	} else if err != nil {
+		return ScheduledPayment{}, 0, 0, fmt.Errorf("making scheduled payment in database: %w", err)
+	}
+	return p, newDstBalance, newSrcBalance, nil
+}
+
+func (b *sqlBank) CancelScheduledPayment(paymentID string) (ScheduledPayment, error) {
+	var p ScheduledPayment
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		p, err = b.takeScheduledPayment(tx, paymentID)
+		return err
+	})
+	if errors.Is(err, ErrScheduledPaymentNotFound) {
+		return ScheduledPayment{}, err
+	} else if err != nil {
+		return ScheduledPayment{}, fmt.Errorf("canceling scheduled payment in database: %w", err)
+	}
+	return p, nil
+}
+
+// ApplyInterest locks every positive balance for the transaction, so nothing
+// can be moved in or out of them until all of them have been changed.
+func (b *sqlBank) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	if err := checkInterestRate(rate); err != nil {
+		return nil, err
+	}
+
+	exclude := interestExclusions(excludeUserIDs)
+	changes := map[string]int{}
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := b.useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(b.query(
+			`SELECT user_id, balance, owed FROM {balances} WHERE balance > 0 ORDER BY user_id {for_update}`,
+		))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		type account struct {
+			userID        string
+			balance, owed int
+		}
+		var accounts []account
+		for rows.Next() {
+			var a account
+			if err := rows.Scan(&a.userID, &a.balance, &a.owed); err != nil {
+				return err
+			} else if interestAccount(a.userID, currency, exclude) {
+				accounts = append(accounts, a)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, a := range accounts {
+			change := interestOn(a.balance, rate)
+			if change == 0 {
+				continue
+			} else if err := b.setBalance(tx, a.userID, a.balance, a.balance+change, a.owed); err != nil {
+				return err
+			} else if err := b.addJournalEntry(tx, journalEntry(a.userID, change, LedgerAccountIssuance, JournalSourceInterest)); err != nil {
+				return err
+			}
+			changes[a.userID] = change
+		}
+		return nil
+	})
+	if errors.Is(err, ErrDuplicate) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("applying interest in database: %w", err)
+	}
+	return changes, nil
+}
+
+func (b *sqlBank) Burn(idempotencyKey, currency string, amount int) error {
+	e, err := burnJournalEntry(currency, amount)
+	if err != nil {
+		return err
+	}
+	err = b.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := b.useIdempotencyKey(tx, idempotencyKey); err != nil {
+			return err
+		}
+		return b.addJournalEntry(tx, e)
+	})
+	if errors.Is(err, ErrDuplicate) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("burning in database: %w", err)
+	}
+	return nil
+}
+
+// UseQuota makes sure there's a row for the quota before locking it, so that
+// two transactions using a new quota at once can't both insert it.
+func (b *sqlBank) UseQuota(key string, amount, max int, ttl time.Duration) (int, error) {
+	if err := checkQuotaTTL(ttl); err != nil {
+		return 0, err
+	}
+
+	var used int
+	err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		if _, err := tx.Exec(b.query(
+			`DELETE FROM {quotas} WHERE quota_key = $1 AND expires_at <= $2`,
+		), key, now); err != nil {
+			return err
+		} else if _, err := tx.Exec(b.query(
+			`INSERT INTO {quotas} (quota_key, used, expires_at) VALUES ($1, 0, $2) ON CONFLICT DO NOTHING`,
+		), key, now.Add(ttl)); err != nil {
+			return err
+		} else if err := tx.QueryRow(b.query(
+			`SELECT used FROM {quotas} WHERE quota_key = $1 {for_update}`,
+		), key).Scan(&used); err != nil {
+			return err
+		} else if used, err = applyQuota(used, amount, max); err != nil {
+			return err
+		}
+		_, err := tx.Exec(b.query(
+			`UPDATE {quotas} SET used = $2 WHERE quota_key = $1`,
+		), key, used)
+		return err
+	})
+	if errors.Is(err, ErrQuotaExceeded) {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("using quota in database: %w", err)
+	}
+	return used, nil
+}
+
+func (b *sqlBank) CanTransfer(dstUserID, srcUserID string, amount int) error {
+	dstBalance, err := b.Balance(dstUserID)
+	if err != nil {
+		return err
+	}
+	srcBalance, err := b.Balance(srcUserID)
+	if err != nil {
+		return err
+	}
+	dstOverdraft, err := b.Overdraft(dstUserID)
+	if err != nil {
+		return err
+	}
+	srcOverdraft, err := b.Overdraft(srcUserID)
+	if err != nil {
+		return err
+	} else if srcBalance-amount < -srcOverdraft || dstBalance+amount < -dstOverdraft {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
+// ListAccounts pages through accounts ordered by user ID, with the cursor
+// being the last user ID of the previous page.
+func (b *sqlBank) ListAccounts(cursor string, limit int) ([]Account, string, error) {
+	rows, err := b.db.Query(b.query(
+		`SELECT user_id, balance FROM {balances} WHERE user_id > $1 ORDER BY user_id LIMIT $2`,
+	), cursor, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("listing balances in database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		if err := rows.Scan(&account.UserID, &account.Balance); err != nil {
+			return nil, "", fmt.Errorf("scanning balance: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("listing balances in database: %w", translateSQLErr(err))
+	}
+
+	var nextCursor string
+	if len(accounts) > 0 && len(accounts) == limit {
+		nextCursor = accounts[len(accounts)-1].UserID
+	}
+	return accounts, nextCursor, nil
+}
+
+func (b *sqlBank) Top(n int) ([]Account, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	rows, err := b.db.Query(b.query(
+		`SELECT user_id, balance FROM {balances}
+		WHERE balance <> 0 AND user_id NOT LIKE '`+currencyAccountPrefix+`%' AND user_id <> '`+HoldsAccountID+`'
+		ORDER BY balance DESC, user_id LIMIT $1`,
+	), n)
+	if err != nil {
+		return nil, fmt.Errorf("getting top balances from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		if err := rows.Scan(&account.UserID, &account.Balance); err != nil {
+			return nil, fmt.Errorf("scanning balance: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getting top balances from database: %w", translateSQLErr(err))
+	}
+	return accounts, nil
+}
+
+func (b *sqlBank) BalanceEvents(cursor string, limit int) ([]string, string, error) {
+	if cursor == "" {
+		var id int64
+		err := b.db.QueryRow(b.query(
+			`SELECT COALESCE(MAX(id), 0) FROM {balance_events}`,
+		)).Scan(&id)
+		if err != nil {
+			return nil, "", fmt.Errorf("getting latest balance event from database: %w", translateSQLErr(err))
+		}
+		return nil, strconv.FormatInt(id, 10), nil
+	}
+
+	after, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed balance events cursor %q", cursor)
+	}
+
+	rows, err := b.db.Query(b.query(
+		`SELECT id, user_id FROM {balance_events} WHERE id > $1 ORDER BY id LIMIT $2`,
+	), after, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting balance events from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	userIDs := make([]string, 0, limit)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&after, &userID); err != nil {
+			return nil, "", fmt.Errorf("scanning balance event: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("getting balance events from database: %w", translateSQLErr(err))
+	}
+	return userIDs, strconv.FormatInt(after, 10), nil
+}
+
+// Journal uses the id of the last entry returned as the cursor. As with
+// balance events, ids aren't necessarily committed in order, so something
+// polling for new entries might miss one. Reconcile reads the whole journal,
+// so it isn't affected.
+func (b *sqlBank) Journal(cursor string, limit int) ([]JournalEntry, string, error) {
+	var after int64
+	if cursor != "" {
+		var err error
+		if after, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("malformed journal cursor %q", cursor)
+		}
+	}
+
+	rows, err := b.db.Query(b.query(
+		`SELECT j.id, j.created_at, j.from_account, j.to_account, j.amount, j.source, COALESCE(r.reason, '')
+		FROM {journal} j LEFT JOIN {journal_reasons} r ON r.journal_id = j.id
+		WHERE j.id > $1 ORDER BY j.id LIMIT $2`,
+	), after, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting journal entries from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	entries := make([]JournalEntry, 0, limit)
+	for rows.Next() {
+		var e JournalEntry
+		var id int64
+		if err := rows.Scan(&id, &e.Time, &e.From, &e.To, &e.Amount, &e.Source, &e.Reason); err != nil {
+			return nil, "", fmt.Errorf("scanning journal entry: %w", err)
+		}
+		e.ID = strconv.FormatInt(id, 10)
+		cursor = e.ID
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("getting journal entries from database: %w", translateSQLErr(err))
+	}
+	return entries, cursor, nil
+}
+
+// History uses the id of the last entry returned as the cursor, the same as
+// Journal.
+func (b *sqlBank) History(userID string, cursor string, limit int) ([]HistoryEntry, string, error) {
+	before := int64(math.MaxInt64)
+	if cursor != "" {
+		var err error
+		if before, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("malformed history cursor %q", cursor)
+		}
+	}
+
+	rows, err := b.db.Query(b.query(
+		`SELECT j.id, j.created_at, j.from_account, j.to_account, j.amount, j.source, COALESCE(r.reason, '')
+		FROM {journal} j LEFT JOIN {journal_reasons} r ON r.journal_id = j.id
+		WHERE (j.from_account = $1 OR j.to_account = $1) AND j.source <> $2 AND j.id < $3
+		ORDER BY j.id DESC LIMIT $4`,
+	), userID, JournalSourceOpening, before, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting history from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	entries := make([]HistoryEntry, 0, limit)
+	for rows.Next() {
+		var e JournalEntry
+		var id int64
+		if err := rows.Scan(&id, &e.Time, &e.From, &e.To, &e.Amount, &e.Source, &e.Reason); err != nil {
+			return nil, "", fmt.Errorf("scanning history entry: %w", err)
+		}
+		e.ID = strconv.FormatInt(id, 10)
+		entries = append(entries, historyEntry(userID, e))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("getting history from database: %w", translateSQLErr(err))
+	}
+
+	if len(entries) < limit {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].ID, nil
+}
+
+func (b *sqlBank) TopGivers(month time.Time, limit int) ([]GiveTotal, error) {
+	rows, err := b.db.Query(b.query(
+		`SELECT user_id, amount, num_gives FROM {gives} WHERE month = $1
+		ORDER BY amount DESC, num_gives DESC, user_id LIMIT $2`,
+	), givesMonth(month), limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting top givers from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	var totals []GiveTotal
+	for rows.Next() {
+		var total GiveTotal
+		if err := rows.Scan(&total.UserID, &total.Amount, &total.NumGives); err != nil {
+			return nil, fmt.Errorf("scanning give total: %w", err)
+		}
+		totals = append(totals, total)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getting top givers from database: %w", translateSQLErr(err))
+	}
+	return totals, nil
+}
+
+func (b *sqlBank) Supply(since time.Time) ([]SupplyDay, error) {
+	days := newSupplyDays(since, time.Now())
+	byDay := map[string]SupplyDay{}
+	for _, day := range days {
+		byDay[supplyDayStr(day.Day)] = day
+	}
+
+	rows, err := b.db.Query(b.query(
+		`SELECT day, direction, source, amount FROM {supply} WHERE day >= $1`,
+	), supplyDayStr(since))
+	if err != nil {
+		return nil, fmt.Errorf("getting supply from database: %w", translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day, direction, source string
+		var amount int
+		if err := rows.Scan(&day, &direction, &source, &amount); err != nil {
+			return nil, fmt.Errorf("scanning supply: %w", err)
+		}
+		if d, ok := byDay[day]; ok {
+			d.add(direction, source, amount)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getting supply from database: %w", translateSQLErr(err))
+	}
+	return days, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Meta
+
+func (b *sqlBank) GetMeta(userID, key string) (string, error) {
+	var value string
+	err := b.db.QueryRow(b.query(
+		`SELECT value FROM {meta} WHERE meta_key = $1 AND user_id = $2`,
+	), key, userID).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("error retrieving meta %q from database: %w", key, translateSQLErr(err))
+	}
+	return value, nil
+}
+
+func (b *sqlBank) SetMeta(userID, key, value string) error {
+	var err error
+	if value == "" {
+		_, err = b.db.Exec(b.query(
+			`DELETE FROM {meta} WHERE meta_key = $1 AND user_id = $2`,
+		), key, userID)
+	} else {
+		_, err = b.db.Exec(b.query(
+			`INSERT INTO {meta} (meta_key, user_id, value) VALUES ($1, $2, $3)
+			ON CONFLICT (meta_key, user_id) DO UPDATE SET value = EXCLUDED.value`,
+		), key, userID, value)
+	}
+	if err != nil {
+		return fmt.Errorf("error setting meta %q in database: %w", key, translateSQLErr(err))
+	}
+	return nil
+}
+
+func (b *sqlBank) AllMeta(key string) (map[string]string, error) {
+	rows, err := b.db.Query(b.query(
+		`SELECT user_id, value FROM {meta} WHERE meta_key = $1`,
+	), key)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving all meta %q from database: %w", key, translateSQLErr(err))
+	}
+	defer rows.Close()
+
+	values := map[string]string{}
+	for rows.Next() {
+		var userID, value string
+		if err := rows.Scan(&userID, &value); err != nil {
+			return nil, fmt.Errorf("scanning meta %q: %w", key, err)
+		}
+		values[userID] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving all meta %q from database: %w", key, translateSQLErr(err))
+	}
+	return values, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Streams
+
+// ensureGroup creates the consumer group on the stream if it doesn't exist,
+// giving it everything which is already in the stream.
+func (b *sqlBank) ensureGroup(ctx context.Context, stream, group string) error {
+	return b.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec(b.query(
+			`INSERT INTO {stream_groups} (stream, group_name) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		), stream, group)
+		if err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+
+		// once the stream is locked, transactions which were adding to it
+		// have finished, and any new ones will see the new group. So nothing
+		// can be added to the stream without making it into the group.
+		if err := b.dialect.lockTable(tx, b.table(stream)); err != nil {
+			return err
+		}
+		_, err = tx.Exec(b.query(
+			`INSERT INTO {stream_pending} (stream, group_name, id, claimed_until)
+			SELECT $1, $2, id, $3 FROM {`+stream+`}`,
+		), stream, group, time.Now().UTC())
+		return err
+	})
+}
+
+// addToStream inserts the JSON into the stream, and makes it pending for every
+// consumer group of the stream, returning its ID.
+func (b *sqlBank) addToStream(tx *sql.Tx, stream string, jsonStr string) (int64, error) {
+	now := time.Now().UTC()
+	var id int64
+	err := tx.QueryRow(b.query(
+		`INSERT INTO {`+stream+`} (created_at, json) VALUES ($1, $2) RETURNING id`,
+	), now, jsonStr).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(b.query(
+		`INSERT INTO {stream_pending} (stream, group_name, id, claimed_until)
+		SELECT stream, group_name, $2, $3 FROM {stream_groups} WHERE stream = $1`,
+	), stream, id, now)
+	return id, err
+}
+
+// claim claims the oldest entry pending for the group which isn't claimed by
+// another consumer, returning false if there isn't one.
+func (b *sqlBank) claim(ctx context.Context, stream, group string) (int64, string, bool, error) {
+	for {
+		now := time.Now().UTC()
+		var id int64
+		err := b.db.QueryRowContext(ctx, b.query(
+			`UPDATE {stream_pending} SET claimed_until = $3
+			WHERE stream = $1 AND group_name = $2 AND id = (
+				SELECT id FROM {stream_pending}
+				WHERE stream = $1 AND group_name = $2 AND claimed_until <= $4
+				ORDER BY id LIMIT 1
+				{for_update_skip_locked}
+			)
+			RETURNING id`,
+		), stream, group, now.Add(b.claimTimeout), now).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", false, nil
+		} else if err != nil {
+			return 0, "", false, translateSQLErr(err)
+		}
+
+		var jsonStr string
+		err = b.db.QueryRowContext(ctx, b.query(
+			`SELECT json FROM {`+stream+`} WHERE id = $1`,
+		), id).Scan(&jsonStr)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the entry was trimmed from the stream while it was pending,
+			// which only happens to earns, so there's nothing to deliver.
+			if err := b.ack(stream, group, id); err != nil {
+				return 0, "", false, err
+			}
+			continue
+		} else if err != nil {
+			return 0, "", false, translateSQLErr(err)
+		}
+		return id, jsonStr, true, nil
+	}
+}
+
+func (b *sqlBank) ack(stream, group string, id int64) error {
+	_, err := b.db.Exec(b.query(
+		`DELETE FROM {stream_pending} WHERE stream = $1 AND group_name = $2 AND id = $3`,
+	), stream, group, id)
+	return translateSQLErr(err)
+}
+
+// nack makes the entry available to be claimed again straight away.
+func (b *sqlBank) nack(stream, group string, id int64) error {
+	_, err := b.db.Exec(b.query(
+		`UPDATE {stream_pending} SET claimed_until = $4
+		WHERE stream = $1 AND group_name = $2 AND id = $3`,
+	), stream, group, id, time.Now().UTC())
+	return translateSQLErr(err)
+}
+
+// consume claims entries from the stream as part of the group and passes
+// them to fn, waiting for pollInterval whenever there are none, until the
+// context is canceled or fn returns an error.
+func (b *sqlBank) consume(ctx context.Context, stream, group string, fn func(id int64, jsonStr string) error) error {
+	if err := b.ensureGroup(ctx, stream, group); err != nil {
+		return fmt.Errorf("creating consumer group %q: %w", group, err)
+	}
+
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		id, jsonStr, ok, err := b.claim(ctx, stream, group)
+		if err != nil {
+			return fmt.Errorf("claiming next entry of %q: %w", stream, err)
+		} else if !ok {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if err := fn(id, jsonStr); err != nil {
+			return err
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Earns
+
+func (b *sqlBank) SubmitEarn(e Earn) (string, error) {
+	if err := checkEarn(e); err != nil {
+		return "", err
+	}
+
+	earnJSON, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Earn %+v: %w", e, err)
+	}
+
+	var id int64
+	err = b.withTx(context.Background(), func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		_, err := tx.Exec(b.query(
+			`DELETE FROM {earn_events} WHERE event_id = $1 AND expires_at <= $2`,
+		), e.EventID, now)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(b.query(
+			`INSERT INTO {earn_events} (event_id, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		), e.EventID, now.Add(earnDedupTTL))
+		if err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrDuplicateEarn
+		}
+
+		// if any cap fails then the transaction is rolled back, undoing the
+		// others.
+		for _, earnCap := range e.Caps {
+			if err := b.applyEarnCap(tx, now, e.Amount, earnCap); err != nil {
+				return err
+			}
+		}
+
+		if id, err = b.addToStream(tx, sqlStreamEarns, string(earnJSON)); err != nil {
+			return err
+		} else if id%sqlTrimEvery != 0 {
+			return nil
+		}
+		return b.trimEarns(tx, now, id)
+	})
+	if errors.Is(err, ErrDuplicateEarn) || errors.Is(err, ErrEarnCapped) {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("error submitting earn to database: %w", err)
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// applyEarnCap is the equivalent of the cap handling in submitEarnCmd, where
+// the set is the non-expired rows of the cap key.
+func (b *sqlBank) applyEarnCap(tx *sql.Tx, now time.Time, amount int, earnCap EarnCap) error {
+	// concurrent earns under the same key would otherwise both be able to see
+	// room under Max.
+	if err := b.dialect.lockKey(tx, b.table("earn_caps")+":"+earnCap.Key); err != nil {
+		return err
+	}
+
+	if amount <= 0 {
+		res, err := tx.Exec(b.query(
+			`DELETE FROM {earn_caps} WHERE cap_key = $1 AND token = $2 AND expires_at > $3`,
+		), earnCap.Key, earnCap.Token, now)
+		if err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 && !earnCap.IgnoreNegative {
+			return ErrEarnCapped
+		}
+		return nil
+	}
+
+	_, err := tx.Exec(b.query(
+		`DELETE FROM {earn_caps} WHERE cap_key = $1 AND expires_at <= $2`,
+	), earnCap.Key, now)
+	if err != nil {
+		return err
+	}
+
+	var count, hasToken int
+	err = tx.QueryRow(b.query(
+		`SELECT COUNT(*), COALESCE(SUM(CASE WHEN token = $2 THEN 1 ELSE 0 END), 0)
+		FROM {earn_caps} WHERE cap_key = $1`,
+	), earnCap.Key, earnCap.Token).Scan(&count, &hasToken)
+	if err != nil {
+		return err
+	} else if hasToken > 0 || count >= earnCap.Max {
+		return ErrEarnCapped
+	}
+
+	// as with redis, the TTL applies to the whole key.
+	expiresAt := now.Add(earnCap.TTL)
+	if _, err := tx.Exec(b.query(
+		`INSERT INTO {earn_caps} (cap_key, token, expires_at) VALUES ($1, $2, $3)`,
+	), earnCap.Key, earnCap.Token, expiresAt); err != nil {
+		return err
+	}
+	_, err = tx.Exec(b.query(
+		`UPDATE {earn_caps} SET expires_at = $2 WHERE cap_key = $1`,
+	), earnCap.Key, expiresAt)
+	return err
+}
+
+// trimEarns removes expired dedup and cap rows, and all but the latest
+// earnsMaxLen earns. Expired idempotency keys and quotas are removed along with
+// them, since they'd otherwise only be removed when reused.
+func (b *sqlBank) trimEarns(tx *sql.Tx, now time.Time, latestID int64) error {
+	if _, err := tx.Exec(b.query(
+		`DELETE FROM {earn_events} WHERE expires_at <= $1`,
+	), now); err != nil {
+		return err
+	} else if _, err := tx.Exec(b.query(
+		`DELETE FROM {idempotency_keys} WHERE expires_at <= $1`,
+	), now); err != nil {
+		return err
+	} else if _, err := tx.Exec(b.query(
+		`DELETE FROM {earn_caps} WHERE expires_at <= $1`,
+	), now); err != nil {
+		return err
+	} else if _, err := tx.Exec(b.query(
+		`DELETE FROM {quotas} WHERE expires_at <= $1`,
+	), now); err != nil {
+		return err
+	}
+	_, err := tx.Exec(b.query(
+		`DELETE FROM {earns} WHERE id <= $1`,
+	), latestID-earnsMaxLen)
+	return err
+}
+
+func (b *sqlBank) ConsumeEarns(ctx context.Context, ch chan<- EarnInProgress) error {
+	return b.consume(ctx, sqlStreamEarns, consumeEarnsGroup, func(id int64, earnJSONStr string) error {
+		var earn Earn
+		if err := json.Unmarshal([]byte(earnJSONStr), &earn); err != nil {
+			return fmt.Errorf("error unmarshaling Earn %q: %w", earnJSONStr, err)
+		}
+
+		ch <- EarnInProgress{
+			ID:   strconv.FormatInt(id, 10),
+			Earn: earn,
+			Ack:  func() error { return b.ack(sqlStreamEarns, consumeEarnsGroup, id) },
+			Nack: func() error { return b.nack(sqlStreamEarns, consumeEarnsGroup, id) },
+		}
+		return nil
+	})
+}
+
+func (b *sqlBank) ReplayEarns(since time.Time) error {
+	ctx := context.Background()
+	if err := b.ensureGroup(ctx, sqlStreamEarns, consumeEarnsGroup); err != nil {
+		return fmt.Errorf("creating earns consumer group: %w", err)
+	}
+
+	// earns which are still pending are left as they are, they'll be
+	// delivered anyway.
+	_, err := b.db.Exec(b.query(
+		`INSERT INTO {stream_pending} (stream, group_name, id, claimed_until)
+		SELECT $1, $2, id, $4 FROM {earns} WHERE created_at >= $3
+		ON CONFLICT DO NOTHING`,
+	), sqlStreamEarns, consumeEarnsGroup, since.UTC(), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error replaying earns since %s: %w", since, translateSQLErr(err))
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Exports
+
+func (b *sqlBank) SubmitExport(e Export) (string, error) {
+	if e.Amount <= 0 {
+		return "", fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	}
+
+	exportJSON, err := encodeExport(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal Export %+v: %w", e, err)
+	}
+
+	var id int64
+	err = b.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := b.useIdempotencyKey(tx, e.IdempotencyKey); err != nil {
+			return err
+		} else if e.HoldID != "" {
+			hold, err := b.deleteHold(tx, e.HoldID)
+			if err != nil {
+				return err
+			} else if err := checkExportHold(e, hold); err != nil {
+				return err
+			} else if _, err := b.moveHeld(tx, hold, e.FromUserID, JournalSourceRelease); err != nil {
+				return err
+			}
+		}
+		balance, owed, err := b.lockBalance(tx, e.FromUserID)
+		if err != nil {
+			return err
+		} else if e.HoldID == "" && balance < e.Amount {
+			return ErrNotEnoughFunds
+		} else if err := b.setBalance(tx, e.FromUserID, balance, balance-e.Amount, owed); err != nil {
+			return err
+		} else if err := b.addJournalEntry(tx, journalEntry(e.FromUserID, -e.Amount, LedgerAccountExports, JournalSourceExport)); err != nil {
+			return err
+		}
+		id, err = b.addToStream(tx, sqlStreamExports, string(exportJSON))
+		return err
+	})
+	if errors.Is(err, ErrNotEnoughFunds) || errors.Is(err, ErrDuplicate) || errors.Is(err, ErrHoldNotFound) {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("error submitting export to database: %w", err)
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (b *sqlBank) CanExport(e Export) error {
+	if e.Amount <= 0 {
+		return fmt.Errorf("malformed Export.Amount: %d", e.Amount)
+	} else if e.Payload != nil {
+		if _, err := encodeExport(e); err != nil {
+			return fmt.Errorf("could not marshal Export %+v: %w", e, err)
+		}
+	}
+
+	balance, err := b.Balance(e.FromUserID)
+	if err != nil {
+		return err
+	} else if balance < e.Amount {
+		return ErrNotEnoughFunds
+	}
+	return nil
+}
+
+func (b *sqlBank) ConsumeExports(ctx context.Context, ch chan<- ExportInProgress) error {
+	return b.ConsumeExportsGroup(ctx, DefaultExportsGroup, ch)
+}
+
+func (b *sqlBank) ConsumeExportsGroup(ctx context.Context, group string, ch chan<- ExportInProgress) error {
+	if group == "" {
+		return errors.New("export consumer group can't be empty")
+	}
+
+	return b.consume(ctx, sqlStreamExports, group, func(id int64, exportJSONStr string) error {
+		export, err := decodeExport([]byte(exportJSONStr))
+		if errors.Is(err, errExportVersion) || errors.Is(err, errExportProtocol) {
+			// this can happen mid-deploy, when a newer instance has submitted
+			// the export. It's left claimed, so that it goes to another
+			// consumer once the claim times out.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error unmarshaling Export %q: %w", exportJSONStr, err)
+		}
+
+		ch <- ExportInProgress{
+			ID:     strconv.FormatInt(id, 10),
+			Export: export,
+			Ack:    func() error { return b.ack(sqlStreamExports, group, id) },
+			Nack:   func() error { return b.nack(sqlStreamExports, group, id) },
+		}
+		return nil
+	})
+}
+
+func (b *sqlBank) TrimExports(before time.Time) (int, error) {
+	// as with redis, if there are no consumer groups then nothing has been
+	// consumed, and nothing is safe to trim.
+	var numGroups int
+	err := b.db.QueryRow(b.query(
+		`SELECT COUNT(*) FROM {stream_groups} WHERE stream = $1`,
+	), sqlStreamExports).Scan(&numGroups)
+	if err != nil {
+		return 0, fmt.Errorf("getting export consumer groups: %w", translateSQLErr(err))
+	} else if numGroups == 0 {
+		return 0, nil
+	}
+
+	var trimmed int
+	for {
+		var n int
+		err := b.withTx(context.Background(), func(tx *sql.Tx) error {
+			rows, err := tx.Query(b.query(
+				`SELECT id, created_at, json FROM {exports} e
+				WHERE created_at < $1 AND NOT EXISTS (
+					SELECT 1 FROM {stream_pending} p WHERE p.stream = $2 AND p.id = e.id
+				)
+				ORDER BY id LIMIT $3
+				{for_update}`,
+			), before.UTC(), sqlStreamExports, trimExportsPageSize)
+			if err != nil {
+				return err
+			}
+			archived, err := scanArchivedExports(rows)
+			if err != nil {
+				return err
+			}
+
+			// exports are archived before they're deleted, so if deleting
+			// fails they'll be archived again next time, which ExportHistory
+			// handles.
+			if b.archive != nil && len(archived) > 0 {
+				if err := b.archive.write(archived); err != nil {
+					return fmt.Errorf("archiving exports: %w", err)
+				}
+			}
+			for _, a := range archived {
+				if _, err := tx.Exec(b.query(`DELETE FROM {exports} WHERE id = $1`), a.ID); err != nil {
+					return err
+				}
+			}
+			n = len(archived)
+			return nil
+		})
+		if err != nil {
+			return trimmed, fmt.Errorf("trimming exports: %w", err)
+		} else if n == 0 {
+			return trimmed, nil
+		}
+		trimmed += n
+	}
+}
+
+// scanArchivedExports reads rows of (id, created_at, json) from the exports
+// table, and closes them.
+func scanArchivedExports(rows *sql.Rows) ([]archivedExport, error) {
+	defer rows.Close()
+	var archived []archivedExport
+	for rows.Next() {
+		var (
+			id        int64
+			createdAt time.Time
+			jsonStr   string
+		)
+		if err := rows.Scan(&id, &createdAt, &jsonStr); err != nil {
+			return nil, fmt.Errorf("scanning export: %w", err)
+		}
+		createdAt = createdAt.UTC()
+		archived = append(archived, archivedExport{
+			ID:   strconv.FormatInt(id, 10),
+			Time: &createdAt,
+			JSON: json.RawMessage(jsonStr),
+		})
+	}
+	return archived, rows.Err()
+}
+
+func (b *sqlBank) ExportHistory(start, end time.Time) ([]ExportRecord, error) {
+	if !start.Before(end) {
+		return nil, errors.New("start must be before end")
+	}
+
+	var records []ExportRecord
+	if b.archive != nil {
+		var err error
+		if records, err = b.archive.read(start, end); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := b.db.Query(b.query(
+		`SELECT id, created_at, json FROM {exports}
+		WHERE created_at >= $1 AND created_at < $2 ORDER BY id`,
+	), start.UTC(), end.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("getting exports from database: %w", translateSQLErr(err))
+	}
+	archived, err := scanArchivedExports(rows)
+	if err != nil {
+		return nil, fmt.Errorf("getting exports from database: %w", translateSQLErr(err))
+	}
+	for _, a := range archived {
+		export, err := decodeExport(a.JSON)
+		if err != nil {
+			return nil, fmt.Errorf("decoding export %q: %w", a.ID, err)
+		}
+		records = append(records, ExportRecord{ID: a.ID, Time: *a.Time, Export: export})
+	}
+
+	// the same export can be in both the archive and the table, see
+	// TrimExports.
+	ids := make(map[string]int64, len(records))
+	deduped := records[:0]
+	for _, record := range records {
+		if _, ok := ids[record.ID]; ok {
+			continue
+		}
+		id, err := strconv.ParseInt(record.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed export ID %q", record.ID)
+		}
+		ids[record.ID] = id
+		deduped = append(deduped, record)
+	}
+	sort.Slice(deduped, func(i, j int) bool {
+		return ids[deduped[i].ID] < ids[deduped[j].ID]
+	})
+	return deduped, nil
+}
@@ -0,0 +1,8 @@
+//go:build postgres
+// +build postgres
+
+package bank
+
+import (
+	_ "github.com/lib/pq"
+)
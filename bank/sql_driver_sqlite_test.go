@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package bank
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
@@ -0,0 +1,265 @@
+package bank
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestApplyIncr(t *T) {
+	type test struct {
+		policy              string
+		minBalance          int
+		balance, owed, by   int
+		expBalance, expOwed int
+		expNotEnoughFunds   bool
+	}
+
+	tests := []test{
+		{policy: NegativeBalanceRefuse, balance: 2, by: 3, expBalance: 5},
+		{policy: NegativeBalanceRefuse, balance: 2, by: -2, expBalance: 0},
+		{policy: NegativeBalanceRefuse, balance: 2, by: -3, expNotEnoughFunds: true},
+
+		{policy: NegativeBalanceClamp, balance: 2, by: -5, expBalance: 0},
+		{policy: NegativeBalanceClamp, balance: 0, by: 1, expBalance: 1},
+
+		{policy: NegativeBalanceAllow, balance: 1, by: -3, expBalance: -2},
+		{policy: NegativeBalanceAllow, balance: -3, by: -1, expNotEnoughFunds: true},
+		{policy: NegativeBalanceAllow, balance: -3, by: 5, expBalance: 2},
+
+		{policy: NegativeBalanceOwe, balance: 2, by: -5, expBalance: 0, expOwed: 3},
+		{policy: NegativeBalanceOwe, balance: 0, owed: 3, by: -1, expBalance: 0, expOwed: 4},
+		{policy: NegativeBalanceOwe, balance: 0, owed: 4, by: 3, expBalance: 0, expOwed: 1},
+		{policy: NegativeBalanceOwe, balance: 0, owed: 1, by: 3, expBalance: 2, expOwed: 0},
+
+		// policies only apply below the minimum balance given by an
+		// overdraft.
+		{policy: NegativeBalanceRefuse, minBalance: -2, balance: 1, by: -3, expBalance: -2},
+		{policy: NegativeBalanceRefuse, minBalance: -2, balance: 1, by: -4, expNotEnoughFunds: true},
+		{policy: NegativeBalanceClamp, minBalance: -2, balance: 1, by: -5, expBalance: -2},
+		{policy: NegativeBalanceAllow, minBalance: -2, balance: 1, by: -6, expBalance: -5},
+		{policy: NegativeBalanceAllow, minBalance: -2, balance: 1, by: -7, expNotEnoughFunds: true},
+		{policy: NegativeBalanceOwe, minBalance: -2, balance: 1, by: -5, expBalance: -2, expOwed: 2},
+	}
+
+	for _, test := range tests {
+		balance, owed, err := applyIncr(test.policy, 3, test.minBalance, test.balance, test.owed, test.by)
+		if test.expNotEnoughFunds {
+			massert.Require(t, massert.Comment(
+				massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)),
+				"test:%+v", test,
+			))
+			continue
+		}
+		massert.Require(t, massert.Comment(massert.All(
+			massert.Nil(err),
+			massert.Equal(test.expBalance, balance),
+			massert.Equal(test.expOwed, owed),
+		), "test:%+v", test))
+	}
+}
+
+func TestSQLBankQuery(t *T) {
+	pg := &sqlBank{dialect: postgresDialect, tablePrefix: "b_"}
+	sqlite := &sqlBank{dialect: sqliteDialect, tablePrefix: "b_"}
+	q := `SELECT id FROM {exports} WHERE id > $1 AND id < $12 {for_update_skip_locked}`
+	massert.Require(t,
+		massert.Equal(
+			`SELECT id FROM b_exports WHERE id > $1 AND id < $12 FOR UPDATE SKIP LOCKED`,
+			pg.query(q),
+		),
+		massert.Equal(
+			`SELECT id FROM b_exports WHERE id > ?1 AND id < ?12 `,
+			sqlite.query(q),
+		),
+	)
+}
+
+// testSQLBank runs against a real database, and is skipped unless a driver
+// with the given name is registered, e.g. with `go test -tags postgres`.
+func testSQLBank(t *T, inst func(*mcmp.Component) ExportingBank, driverName, dsn string) {
+	var hasDriver bool
+	for _, name := range sql.Drivers() {
+		hasDriver = hasDriver || name == driverName
+	}
+	if dsn == "" || !hasDriver {
+		t.Skipf("no dsn given or no %q driver registered", driverName)
+	}
+
+	cmp := mtest.Component()
+	mtest.Env(cmp, "BANK_DSN", dsn)
+	mtest.Env(cmp, "BANK_TABLE_PREFIX", "test_"+mrand.Hex(4)+"_")
+	mtest.Env(cmp, "BANK_POLL_INTERVAL", "10ms")
+	testExportingBank(t, cmp, inst(cmp))
+}
+
+// testExportingBank runs the basics of an ExportingBank which isn't redis
+// based, which is instantiated on the given Component.
+func testExportingBank(t *T, cmp *mcmp.Component, bank ExportingBank) {
+	userA, userB := mrand.Hex(8), mrand.Hex(8)
+
+	mtest.Run(cmp, t, func() {
+		newBalance, err := bank.Incr(userA, 5)
+		massert.Require(t, massert.Nil(err), massert.Equal(5, newBalance))
+		_, err = bank.Incr(userA, -6)
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrNotEnoughFunds)))
+
+		newDst, newSrc, err := bank.TransferWithReason(userB, userA, 2, JournalSourceTransfer, "for lunch")
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(2, newDst),
+			massert.Equal(3, newSrc),
+			massert.Equal(true, errors.Is(bank.CanTransfer(userB, userA, 4), ErrNotEnoughFunds)),
+		)
+
+		massert.Require(t, massert.Nil(bank.SetMeta(userA, "foo", "bar")))
+		value, err := bank.GetMeta(userA, "foo")
+		massert.Require(t, massert.Nil(err), massert.Equal("bar", value))
+
+		// earns are deduplicated.
+		earn := Earn{EventID: mrand.Hex(8), UserID: userA, Amount: 1}
+		_, err = bank.SubmitEarn(earn)
+		massert.Require(t, massert.Nil(err))
+		_, err = bank.SubmitEarn(earn)
+		massert.Require(t, massert.Equal(ErrDuplicateEarn, err))
+
+		// an earn is capped if any of its caps cap it, and then none of them
+		// change.
+		capKey := mrand.Hex(8)
+		submitCapped := func(token string, amount int) error {
+			_, err := bank.SubmitEarn(Earn{
+				EventID: mrand.Hex(8), UserID: userB, Amount: amount,
+				Caps: []EarnCap{
+					{Key: capKey + "a", Token: token, Max: 2, TTL: time.Minute},
+					{Key: capKey + "b", Token: token, Max: 1, TTL: time.Minute, IgnoreNegative: true},
+				},
+			})
+			return err
+		}
+		massert.Require(t,
+			massert.Nil(submitCapped("a", 1)),
+			massert.Equal(ErrEarnCapped, submitCapped("b", 1)),
+			massert.Equal(ErrEarnCapped, submitCapped("b", -1)),
+			massert.Nil(submitCapped("a", -1)),
+			massert.Nil(submitCapped("b", 1)),
+		)
+
+		export := Export{FromUserID: userA, Amount: 3, Payload: testPayload{Data: "a"}}
+		id, err := bank.SubmitExport(export)
+		massert.Require(t, massert.Nil(err))
+		balance, err := bank.Balance(userA)
+		massert.Require(t, massert.Nil(err), massert.Equal(0, balance))
+
+		// every change above was journaled.
+		rec, err := Reconcile(bank)
+		massert.Require(t, massert.Nil(err), massert.Length(rec.Discrepancies, 0))
+
+		// history is newest first, and paged.
+		history, cursor, err := bank.History(userA, "", 2)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(history, 2),
+			massert.Equal(JournalSourceExport, history[0].Source),
+			massert.Equal(-3, history[0].Amount),
+			massert.Equal(userB, history[1].Counterparty),
+			massert.Equal(-2, history[1].Amount),
+			massert.Equal("for lunch", history[1].Reason),
+			massert.Equal("", history[0].Reason),
+		)
+		history, cursor, err = bank.History(userA, cursor, 2)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(history, 1),
+			massert.Equal(5, history[0].Amount),
+			massert.Equal("", cursor),
+		)
+
+		// transfers don't change the supply, but everything else does. Two
+		// days are asked for in case the test runs over midnight.
+		days, err := bank.Supply(time.Now().Add(-24 * time.Hour))
+		massert.Require(t, massert.Nil(err), massert.Length(days, 2))
+		in, out := map[string]int{}, map[string]int{}
+		for _, day := range days {
+			for source, amount := range day.In {
+				in[source] += amount
+			}
+			for source, amount := range day.Out {
+				out[source] += amount
+			}
+		}
+		massert.Require(t,
+			massert.Equal(map[string]int{JournalSourceIncr: 5}, in),
+			massert.Equal(map[string]int{JournalSourceExport: 3}, out),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch := make(chan ExportInProgress, 1)
+		go bank.ConsumeExports(ctx, ch)
+
+		// a Nack'd export is delivered again.
+		for i := 0; i < 2; i++ {
+			select {
+			case got := <-ch:
+				massert.Require(t,
+					massert.Equal(id, got.ID),
+					massert.Equal(export, got.Export),
+				)
+				if i == 0 {
+					massert.Require(t, massert.Nil(got.Nack()))
+				} else {
+					massert.Require(t, massert.Nil(got.Ack()))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for export")
+			}
+		}
+
+		records, err := bank.ExportHistory(time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(records, 1),
+			massert.Equal(id, records[0].ID),
+		)
+		n, err := bank.TrimExports(time.Now().Add(time.Minute))
+		massert.Require(t, massert.Nil(err), massert.Equal(1, n))
+
+		// operations given an idempotency key are only done once.
+		key := mrand.Hex(8)
+		newBalance, err = bank.IncrOnce(key, userB, 1, JournalSourceIncr)
+		massert.Require(t, massert.Nil(err), massert.Equal(3, newBalance))
+		_, err = bank.IncrOnce(key, userB, 1, JournalSourceIncr)
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+		_, _, err = bank.TransferOnce(key, userA, userB, 1, JournalSourceTransfer, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+		_, _, err = bank.TransferMultiOnce(key, userB, map[string]int{userA: 1}, JournalSourceTransfer, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrDuplicate)))
+		balance, err = bank.Balance(userB)
+		massert.Require(t, massert.Nil(err), massert.Equal(3, balance))
+
+		testHolds(t, bank)
+		testOverdraft(t, bank)
+		testScheduledPayments(t, bank)
+		testInterest(t, bank)
+		testBurn(t, bank)
+		testQuota(t, bank)
+		testHeldExports(t, bank)
+	})
+}
+
+// TestPostgresBank needs TEST_POSTGRES_DSN to be set.
+func TestPostgresBank(t *T) {
+	testSQLBank(t, InstPostgres, "postgres", os.Getenv("TEST_POSTGRES_DSN"))
+}
+
+func TestSQLiteBank(t *T) {
+	testSQLBank(t, InstSQLite, "sqlite3", ":memory:")
+}
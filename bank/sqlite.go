@@ -0,0 +1,35 @@
+package bank
+
+import (
+	"database/sql"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+)
+
+// sqliteDialect uses a single connection, so that every transaction runs on
+// its own, which means that no rows or tables ever need to be locked.
+var sqliteDialect = sqlDialect{
+	name:                 "SQLite",
+	defaultDriver:        "sqlite3",
+	defaultDSN:           "buckaroo-banzai.db",
+	exampleDSN:           "/var/lib/buckaroo/bank.db",
+	serialType:           "INTEGER PRIMARY KEY AUTOINCREMENT",
+	timeType:             "TIMESTAMP",
+	questionPlaceholders: true,
+	maxOpenConns:         1,
+	initStmts:            []string{"PRAGMA journal_mode=WAL"},
+	lockTable:            func(*sql.Tx, string) error { return nil },
+	lockKey:              func(*sql.Tx, string) error { return nil },
+}
+
+// InstSQLite instantiates an ExportingBank backed by a SQLite database file,
+// which will be configured and initialized when the Init hook is run. It's for
+// small, single host, deployments which don't want to run a database. It uses
+// the same "bank" component, and so the same negative-balance params, as Inst
+// does.
+//
+// The binary must import a database/sql driver for SQLite, e.g.
+// github.com/mattn/go-sqlite3. SQLite 3.35 or newer is required.
+func InstSQLite(parent *mcmp.Component) ExportingBank {
+	return instSQL(parent, sqliteDialect)
+}
@@ -0,0 +1,77 @@
+// Package bank-bench load tests a bank against a real redis, using the
+// bank/bench harness, and prints how it performed. By default it uses its own
+// key prefix, so that it doesn't touch real data, but it still shouldn't be
+// pointed at a production redis.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/m"
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/bank/bench"
+)
+
+func main() {
+	cmp := m.RootComponent()
+	b := bank.InstWithKeyPrefix(cmp, "buckaroo-banzai:bench")
+
+	concurrency := mcfg.Int(cmp, "concurrency",
+		mcfg.ParamDefault(100),
+		mcfg.ParamUsage("Number of goroutines running operations at once"))
+	duration := mcfg.String(cmp, "duration",
+		mcfg.ParamDefault("30s"),
+		mcfg.ParamUsage("How long to run operations for"))
+	users := mcfg.Int(cmp, "users",
+		mcfg.ParamDefault(1000),
+		mcfg.ParamUsage("Number of users operations are spread across. Fewer users means more contention."))
+	initialBalance := mcfg.Int(cmp, "initial-balance",
+		mcfg.ParamDefault(1000),
+		mcfg.ParamUsage("Balance given to each user before operations start"))
+	incrWeight := mcfg.Int(cmp, "incr-weight",
+		mcfg.ParamDefault(5),
+		mcfg.ParamUsage("Relative frequency of Incr operations"))
+	transferWeight := mcfg.Int(cmp, "transfer-weight",
+		mcfg.ParamDefault(3),
+		mcfg.ParamUsage("Relative frequency of Transfer operations"))
+	submitExportWeight := mcfg.Int(cmp, "submit-export-weight",
+		mcfg.ParamDefault(1),
+		mcfg.ParamUsage("Relative frequency of SubmitExport operations"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		d, err := time.ParseDuration(*duration)
+		if err != nil {
+			return fmt.Errorf("parsing --duration: %w", err)
+		}
+
+		opts := bench.Opts{
+			Concurrency:        *concurrency,
+			Duration:           d,
+			Users:              *users,
+			InitialBalance:     *initialBalance,
+			IncrWeight:         *incrWeight,
+			TransferWeight:     *transferWeight,
+			SubmitExportWeight: *submitExportWeight,
+		}
+		mlog.From(cmp).Info("running benchmark", mctx.Annotate(ctx,
+			"concurrency", opts.Concurrency, "duration", d, "users", opts.Users))
+		report, err := bench.Run(ctx, b, opts)
+		if err != nil {
+			return err
+		}
+		_, err = report.WriteTo(os.Stdout)
+		return err
+	})
+
+	m.MustInit(cmp)
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+}
@@ -0,0 +1,322 @@
+// Package buckaroo-admin is a collection of CLI utilities for operating a
+// buckaroo instance, currently backing up and restoring its state, and listing
+// its accounts.
+//
+// A backup is a directory holding a manifest.json, which describes the backup,
+// and a bank.jsonl, which is a snapshot of every key in the bank's redis (see
+// bank.Snapshotter). That includes balances, metadata, the journal, and the
+// exports stream along with how far each consumer group has gotten through
+// it, so pending exports are picked up again after a restore. The manifest
+// holds the cursor which buckaroo has read incoming payments up to, and,
+// if --version-url is given, the fingerprint of the running instance's
+// configuration, so that it can be checked that the restored instance is
+// configured the same.
+//
+// Restoring is only done into a fresh redis, and never overwrites anything.
+// Exports which were trimmed into --bank-archive-dir aren't in redis, so that
+// directory needs to be backed up separately.
+//
+// The drill sub-command is for practicing disaster recovery without touching
+// the live bank. It restores a backup under its own key prefix on the same
+// redis, checks that every key was restored, that the restored liabilities
+// match those recorded at backup time, and that every restored balance matches
+// the restored journal, then removes the restored keys again. Buckaroo should
+// be stopped while a backup is taken, otherwise the drill will likely find
+// differences caused by it writing to the bank during the backup.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/m"
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mdb/mredis"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/mediocregopher/radix/v3"
+
+	"buckaroo-banzai/bank"
+)
+
+// stellarLastCursorKey is where buckaroo keeps the cursor which it has read
+// incoming payments up to, in the stellar redis. See receivePayments in
+// cmd/buckaroo-banzai.
+const stellarLastCursorKey = "buckaroo-banzai:stellar:lastCursor"
+
+const (
+	manifestFile = "manifest.json"
+	snapshotFile = "bank.jsonl"
+)
+
+// manifest describes a backup.
+type manifest struct {
+	Time    time.Time `json:"time"`
+	NumKeys int       `json:"numKeys"`
+
+	// Liabilities are those of the bank at the time of the backup, see
+	// bank.Liabilities, for checking a restore against.
+	Liabilities map[string]int `json:"liabilities"`
+
+	LastCursor        string `json:"lastCursor,omitempty"`
+	GitRef            string `json:"gitRef,omitempty"`
+	ConfigFingerprint string `json:"configFingerprint,omitempty"`
+}
+
+func jsonDump(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		panic(fmt.Sprintf("couldn't json marshal %#v: %v", v, err))
+	}
+	fmt.Println(string(b))
+}
+
+func readManifest(dir string) (manifest, error) {
+	var man manifest
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return man, fmt.Errorf("reading manifest: %w", err)
+	} else if err := json.Unmarshal(b, &man); err != nil {
+		return man, fmt.Errorf("parsing manifest: %w", err)
+	}
+	return man, nil
+}
+
+// fetchVersion fills in the manifest's version fields from a running buckaroo's
+// version endpoint.
+func fetchVersion(ctx context.Context, url string, man *manifest) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+
+	var v struct {
+		GitRef            string `json:"gitRef"`
+		ConfigFingerprint string `json:"configFingerprint"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return fmt.Errorf("decoding version: %w", err)
+	}
+	man.GitRef, man.ConfigFingerprint = v.GitRef, v.ConfigFingerprint
+	return nil
+}
+
+func cmdBackup(cmp *mcmp.Component) {
+	b := bank.Inst(cmp)
+	stellarRedis := mredis.InstRedis(cmp.Child("stellar"))
+	out := mcfg.String(cmp, "out",
+		mcfg.ParamRequired(),
+		mcfg.ParamUsage("Directory to write the backup to. It mustn't already hold a backup."))
+	versionURL := mcfg.String(cmp, "version-url",
+		mcfg.ParamUsage("Optional URL of a running buckaroo's /api/version, whose config fingerprint is recorded in the manifest."))
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		s, ok := b.(bank.Snapshotter)
+		if !ok {
+			return errors.New("bank doesn't support snapshots")
+		} else if _, err := os.Stat(filepath.Join(*out, manifestFile)); err == nil {
+			return fmt.Errorf("%q already holds a backup", *out)
+		} else if err := os.MkdirAll(*out, 0700); err != nil {
+			return fmt.Errorf("creating %q: %w", *out, err)
+		}
+
+		man := manifest{Time: time.Now().UTC()}
+		if *versionURL != "" {
+			if err := fetchVersion(ctx, *versionURL, &man); err != nil {
+				return fmt.Errorf("fetching version from %q: %w", *versionURL, err)
+			}
+		}
+
+		mn := radix.MaybeNil{Rcv: &man.LastCursor}
+		if err := stellarRedis.Do(radix.Cmd(&mn, "GET", stellarLastCursorKey)); err != nil {
+			return fmt.Errorf("getting last cursor: %w", err)
+		}
+
+		var err error
+		if man.Liabilities, err = bank.Liabilities(b); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(filepath.Join(*out, snapshotFile), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("creating snapshot file: %w", err)
+		}
+		man.NumKeys, err = s.WriteSnapshot(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("writing snapshot: %w", err)
+		}
+
+		// the manifest is written last, so that its existence means the
+		// backup is complete.
+		manB, err := json.MarshalIndent(man, "", "    ")
+		if err != nil {
+			return err
+		} else if err := ioutil.WriteFile(filepath.Join(*out, manifestFile), manB, 0600); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+
+		mlog.From(cmp).Info("backup written", mctx.Annotate(ctx, "out", *out, "numKeys", man.NumKeys))
+		jsonDump(man)
+		return nil
+	})
+}
+
+func cmdRestore(cmp *mcmp.Component) {
+	b := bank.Inst(cmp)
+	stellarRedis := mredis.InstRedis(cmp.Child("stellar"))
+	in := mcfg.String(cmp, "in",
+		mcfg.ParamRequired(),
+		mcfg.ParamUsage("Directory of the backup to restore."))
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		s, ok := b.(bank.Snapshotter)
+		if !ok {
+			return errors.New("bank doesn't support snapshots")
+		}
+		man, err := readManifest(*in)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(filepath.Join(*in, snapshotFile))
+		if err != nil {
+			return fmt.Errorf("opening snapshot: %w", err)
+		}
+		defer f.Close()
+		n, err := s.RestoreSnapshot(f)
+		if err != nil {
+			return fmt.Errorf("restoring snapshot (%d keys restored): %w", n, err)
+		}
+
+		if man.LastCursor != "" {
+			var set string
+			mn := radix.MaybeNil{Rcv: &set}
+			if err := stellarRedis.Do(radix.Cmd(&mn, "SET", stellarLastCursorKey, man.LastCursor, "NX")); err != nil {
+				return fmt.Errorf("setting last cursor: %w", err)
+			} else if mn.Nil {
+				return errors.New("last cursor is already set, not overwriting it")
+			}
+		}
+
+		liabilities, err := bank.Liabilities(b)
+		if err != nil {
+			return err
+		} else if !reflect.DeepEqual(liabilities, man.Liabilities) {
+			return fmt.Errorf("restored liabilities %v don't match backed up %v", liabilities, man.Liabilities)
+		}
+
+		mlog.From(cmp).Info("backup restored", mctx.Annotate(ctx, "in", *in, "numKeys", n))
+		return nil
+	})
+}
+
+func cmdDrill(cmp *mcmp.Component) {
+	b := bank.Inst(cmp)
+	in := mcfg.String(cmp, "in",
+		mcfg.ParamRequired(),
+		mcfg.ParamUsage("Directory of the backup to drill with."))
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		s, ok := b.(bank.Snapshotter)
+		if !ok {
+			return errors.New("bank doesn't support snapshots")
+		}
+		man, err := readManifest(*in)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(filepath.Join(*in, snapshotFile))
+		if err != nil {
+			return fmt.Errorf("opening snapshot: %w", err)
+		}
+		defer f.Close()
+		drill, err := s.DrillSnapshot(f)
+		if err != nil {
+			return fmt.Errorf("drilling: %w", err)
+		}
+		jsonDump(drill)
+
+		switch {
+		case drill.NumKeys != man.NumKeys:
+			return fmt.Errorf("restored %d keys, but %d were backed up", drill.NumKeys, man.NumKeys)
+		case !reflect.DeepEqual(drill.Liabilities, man.Liabilities):
+			return fmt.Errorf("restored liabilities %v don't match backed up %v", drill.Liabilities, man.Liabilities)
+		case len(drill.Reconciliation.Discrepancies) > 0:
+			return fmt.Errorf("%d restored balances don't match the restored journal", len(drill.Reconciliation.Discrepancies))
+		}
+		mlog.From(cmp).Info("drill passed", mctx.Annotate(ctx, "in", *in, "keyPrefix", drill.KeyPrefix))
+		return nil
+	})
+}
+
+// accountsPageSize is how many accounts are asked for at a time while listing
+// them.
+const accountsPageSize = 100
+
+func cmdAccounts(cmp *mcmp.Component) {
+	b := bank.Inst(cmp)
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		aliases, err := b.AllMeta(bank.AliasMetaKey)
+		if err != nil {
+			return err
+		}
+
+		type account struct {
+			ID      string `json:"id"`
+			Alias   string `json:"alias,omitempty"`
+			Balance int    `json:"balance"`
+		}
+		accounts := []account{}
+		var cursor string
+		for {
+			page, next, err := b.ListAccounts(cursor, accountsPageSize)
+			if err != nil {
+				return err
+			}
+			for _, acc := range page {
+				accountID, _ := bank.SplitCurrencyAccountID(acc.UserID)
+				accounts = append(accounts, account{
+					ID:      acc.UserID,
+					Alias:   aliases[accountID],
+					Balance: acc.Balance,
+				})
+			}
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+		jsonDump(accounts)
+		return nil
+	})
+}
+
+func main() {
+	cmp := m.RootComponent()
+	mcfg.CLISubCommand(cmp, "backup", "Back up the bank and stellar cursor to a directory", cmdBackup)
+	mcfg.CLISubCommand(cmp, "restore", "Restore a backup into a fresh redis", cmdRestore)
+	mcfg.CLISubCommand(cmp, "accounts", "List every account in the bank, along with its alias and balance", cmdAccounts)
+	mcfg.CLISubCommand(cmp, "drill", "Restore a backup under its own key prefix, verify it, and remove it again", cmdDrill)
+
+	m.MustInit(cmp)
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+}
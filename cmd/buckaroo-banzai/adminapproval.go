@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Mints and buybacks of more than --approval-above aren't done straight away,
+// but are stored under pendingAdminActionMetaKey, keyed by their ID, until an
+// admin other than the one who asked for them approves them. That way a single
+// compromised admin account can't print or burn large amounts of currency.
+const pendingAdminActionMetaKey = "pendingAdminAction"
+
+// pendingAdminActionTTL is how long a pending admin action can be approved for.
+// Past that it has to be asked for again, so that something which was
+// forgotten about can't be approved long after it made any sense.
+const pendingAdminActionTTL = 24 * time.Hour
+
+const pendingUsage = "`pending approve <id>` to do one, `pending reject <id>` to drop it"
+
+// The kinds of admin action which can need approval.
+const (
+	adminActionMint    = "mint"
+	adminActionBuyback = "buyback"
+)
+
+// pendingAdminAction is an admin action which is waiting for a second admin to
+// approve it.
+type pendingAdminAction struct {
+	Kind   string `json:"kind"`
+	Amount int    `json:"amount"`
+
+	// Currency and DstAccountID are only set for mints, MaxPrice only for
+	// buybacks.
+	Currency     string  `json:"currency,omitempty"`
+	DstAccountID string  `json:"dstAccountID,omitempty"`
+	MaxPrice     float64 `json:"maxPrice,omitempty"`
+
+	RequestedBy string `json:"requestedBy"`
+
+	// IdempotencyKey is of the command which asked for the action, so that the
+	// command being delivered twice doesn't ask for approval twice, and so that
+	// an approved mint is only ever made once.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (a *app) getPendingAdminAction(id string) (pendingAdminAction, bool, error) {
+	str, err := a.bank.GetMeta(id, pendingAdminActionMetaKey)
+	if err != nil {
+		return pendingAdminAction{}, false, fmt.Errorf("getting pending admin action: %w", err)
+	} else if str == "" {
+		return pendingAdminAction{}, false, nil
+	}
+	var pa pendingAdminAction
+	if err := json.Unmarshal([]byte(str), &pa); err != nil {
+		return pendingAdminAction{}, false, fmt.Errorf("unmarshaling pending admin action: %w", err)
+	}
+	return pa, true, nil
+}
+
+func (a *app) setPendingAdminAction(id string, pa pendingAdminAction) error {
+	b, err := json.Marshal(pa)
+	if err != nil {
+		return err
+	} else if err := a.bank.SetMeta(id, pendingAdminActionMetaKey, string(b)); err != nil {
+		return fmt.Errorf("storing pending admin action: %w", err)
+	}
+	return nil
+}
+
+// allPendingAdminActions returns all pending admin actions, keyed by ID.
+func (a *app) allPendingAdminActions() (map[string]pendingAdminAction, error) {
+	all, err := a.bank.AllMeta(pendingAdminActionMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all pending admin actions: %w", err)
+	}
+	pas := make(map[string]pendingAdminAction, len(all))
+	for id, str := range all {
+		var pa pendingAdminAction
+		if err := json.Unmarshal([]byte(str), &pa); err != nil {
+			return nil, fmt.Errorf("unmarshaling pending admin action %q: %w", id, err)
+		}
+		pas[id] = pa
+	}
+	return pas, nil
+}
+
+// needsApproval returns whether an admin action of the given amount, in the
+// bank's units, needs a second admin to approve it.
+func (a *app) needsApproval(amount int) bool {
+	return a.approvalAbove > 0 && amount > a.approvalAbove*a.currency.unit()
+}
+
+// adminUserIDs returns the IDs of all admins, both those given by
+// configuration and those given the role via commands, sorted.
+func (a *app) adminUserIDs() ([]string, error) {
+	admins := map[string]bool{}
+	for userID, r := range a.configRoles {
+		if r >= roleAdmin {
+			admins[userID] = true
+		}
+	}
+
+	all, err := a.bank.AllMeta(roleMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all roles: %w", err)
+	}
+	for accountID, roleStr := range all {
+		if r, err := parseRole(roleStr); err == nil && r >= roleAdmin {
+			admins[userIDFromAccountID(accountID)] = true
+		}
+	}
+
+	userIDs := make([]string, 0, len(admins))
+	for userID := range admins {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
+
+// describeAdminAction returns what the action will do, for use in messages.
+func (a *app) describeAdminAction(pa pendingAdminAction) string {
+	if pa.Kind == adminActionBuyback {
+		return fmt.Sprintf("buy back and burn %s at up to %s XLM each",
+			a.formatAmount(pa.Amount, true), formatPrice(pa.MaxPrice))
+	}
+	return fmt.Sprintf("mint %s for <@%s>",
+		a.formatAmountIn(pa.Currency, pa.Amount, true), userIDFromAccountID(pa.DstAccountID))
+}
+
+// approvalMsg returns the message which admins are sent asking them to approve
+// a pending admin action.
+func (a *app) approvalMsg(id string, pa pendingAdminAction) *slackbot.Message {
+	msg := slackbot.NewMessage("<@%s> wants to %s, and needs a second admin to approve it :closed_lock_with_key:",
+		userIDFromAccountID(pa.RequestedBy), a.describeAdminAction(pa)).
+		Context("`pending approve %s` to do it, or `pending reject %s` to drop it. It can be approved for %s", id, id, pendingAdminActionTTL)
+	if a.slackClient != nil && a.slackClient.SigningSecret != "" {
+		msg.CommandButtons("Approve", "pending approve "+id, "Reject", "pending reject "+id)
+	}
+	return msg
+}
+
+// requestApproval stores the action to be done once another admin approves it,
+// and asks all the other admins to. If an action with the same idempotency key
+// is already pending then that one is returned instead.
+func (a *app) requestApproval(ctx context.Context, pa pendingAdminAction) (string, error) {
+	a.approvalL.Lock()
+	defer a.approvalL.Unlock()
+
+	pas, err := a.allPendingAdminActions()
+	if err != nil {
+		return "", err
+	}
+	for id, existing := range pas {
+		if pa.IdempotencyKey != "" && existing.IdempotencyKey == pa.IdempotencyKey {
+			return id, nil
+		}
+	}
+
+	adminUserIDs, err := a.adminUserIDs()
+	if err != nil {
+		return "", err
+	}
+	approverUserIDs := adminUserIDs[:0]
+	for _, userID := range adminUserIDs {
+		if userID != userIDFromAccountID(pa.RequestedBy) {
+			approverUserIDs = append(approverUserIDs, userID)
+		}
+	}
+	if len(approverUserIDs) == 0 {
+		return "", inputErrorf("that needs a second admin to approve it, and there aren't any other admins")
+	}
+
+	id, err := randHex(4)
+	if err != nil {
+		return "", fmt.Errorf("generating pending admin action ID: %w", err)
+	}
+	pa.CreatedAt = time.Now().UTC()
+	if err := a.setPendingAdminAction(id, pa); err != nil {
+		return "", err
+	}
+	a.audit(mctx.Annotate(ctx,
+		"pendingAdminActionID", id,
+		"kind", pa.Kind,
+		"amount", pa.Amount,
+	), "admin action awaiting approval")
+
+	for _, userID := range approverUserIDs {
+		if err := a.notifyOnce(userID, "admin-approval:"+id, a.approvalMsg(id, pa)); err != nil {
+			mlog.From(a.cmp).Warn("error asking admin to approve action",
+				mctx.Annotate(ctx, "adminUserID", userID), merr.Context(err))
+		}
+	}
+	return id, nil
+}
+
+// takePendingAdminAction removes the pending admin action with the given ID and
+// returns it, so that it can only be approved or rejected once.
+func (a *app) takePendingAdminAction(id string) (pendingAdminAction, error) {
+	pa, ok, err := a.getPendingAdminAction(id)
+	if err != nil {
+		return pendingAdminAction{}, err
+	} else if !ok {
+		return pendingAdminAction{}, inputErrorf("there isn't an action `%s` waiting for approval, `pending` will show you the ones which are", id)
+	} else if err := a.bank.SetMeta(id, pendingAdminActionMetaKey, ""); err != nil {
+		return pendingAdminAction{}, fmt.Errorf("removing pending admin action: %w", err)
+	}
+	return pa, nil
+}
+
+// approveAdminAction does the pending admin action with the given ID, which
+// must have been asked for by an admin other than the one approving it.
+func (a *app) approveAdminAction(ctx context.Context, req commandReq, id string) error {
+	a.approvalL.Lock()
+	defer a.approvalL.Unlock()
+
+	pa, ok, err := a.getPendingAdminAction(id)
+	if err != nil {
+		return err
+	} else if ok && pa.RequestedBy == req.accountID {
+		return inputErrorf("you asked for that one, so another admin has to approve it")
+	}
+
+	if pa, err = a.takePendingAdminAction(id); err != nil {
+		return err
+	}
+	ctx = mctx.Annotate(ctx,
+		"pendingAdminActionID", id,
+		"requestedBy", pa.RequestedBy,
+		"approvedBy", req.accountID,
+	)
+
+	if time.Since(pa.CreatedAt) > pendingAdminActionTTL {
+		a.audit(ctx, "admin action expired")
+		return inputErrorf("`%s` was asked for over %s ago, so it has to be asked for again", id, pendingAdminActionTTL)
+	}
+
+	// the action is only put back if it failed, so that it can be approved
+	// again once whatever went wrong is fixed.
+	if err := a.doAdminAction(ctx, req, pa); err != nil {
+		if restoreErr := a.setPendingAdminAction(id, pa); restoreErr != nil {
+			mlog.From(a.cmp).Error("error restoring pending admin action which failed", ctx, merr.Context(restoreErr))
+		}
+		return err
+	}
+	a.audit(ctx, "admin action approved")
+
+	requesterUserID := userIDFromAccountID(pa.RequestedBy)
+	msg := slackbot.NewMessage("<@%s> approved your request to %s, so it's been done :white_check_mark:",
+		req.user.ID, a.describeAdminAction(pa))
+	if err := a.notifyOnce(requesterUserID, "admin-approved:"+id, msg); err != nil {
+		mlog.From(a.cmp).Warn("error notifying admin of approved action", ctx, merr.Context(err))
+	}
+	return nil
+}
+
+// rejectAdminAction drops the pending admin action with the given ID. Any
+// admin can reject one, including the one who asked for it.
+func (a *app) rejectAdminAction(ctx context.Context, req commandReq, id string) error {
+	a.approvalL.Lock()
+	defer a.approvalL.Unlock()
+
+	pa, err := a.takePendingAdminAction(id)
+	if err != nil {
+		return err
+	}
+	ctx = mctx.Annotate(ctx,
+		"pendingAdminActionID", id,
+		"requestedBy", pa.RequestedBy,
+		"kind", pa.Kind,
+		"amount", pa.Amount,
+	)
+	a.audit(ctx, "admin action rejected")
+
+	a.reply(req, "I've dropped the request to %s", a.describeAdminAction(pa))
+	if pa.RequestedBy == req.accountID {
+		return nil
+	}
+	msg := slackbot.NewMessage("<@%s> rejected your request to %s, so it won't be done",
+		req.user.ID, a.describeAdminAction(pa))
+	if err := a.notifyOnce(userIDFromAccountID(pa.RequestedBy), "admin-rejected:"+id, msg); err != nil {
+		mlog.From(a.cmp).Warn("error notifying admin of rejected action", ctx, merr.Context(err))
+	}
+	return nil
+}
+
+// doAdminActionOrRequestApproval does the admin action straight away, unless
+// it's large enough that it needs a second admin to approve it first.
+func (a *app) doAdminActionOrRequestApproval(ctx context.Context, req commandReq, pa pendingAdminAction) error {
+	if !a.needsApproval(pa.Amount) {
+		return a.doAdminAction(ctx, req, pa)
+	}
+
+	pa.RequestedBy = req.accountID
+	pa.IdempotencyKey = req.idempotencyKey(pa.Kind)
+	id, err := a.requestApproval(ctx, pa)
+	if err != nil {
+		return err
+	}
+	a.replyMsg(req, slackbot.NewMessage("that's over %s, so another admin has to approve it before I %s :closed_lock_with_key: I've asked them to",
+		a.formatAmount(a.approvalAbove*a.currency.unit(), false), a.describeAdminAction(pa)).
+		Context("`pending reject %s` will drop it", id))
+	return nil
+}
+
+// doAdminAction does the given admin action, replying to the request with how
+// it went.
+func (a *app) doAdminAction(ctx context.Context, req commandReq, pa pendingAdminAction) error {
+	switch pa.Kind {
+	case adminActionMint:
+		idempotencyKey := pa.IdempotencyKey
+		if idempotencyKey == "" {
+			idempotencyKey = req.idempotencyKey("mint")
+		}
+		ctx = mctx.Annotate(ctx, "amount", pa.Amount, "dstAccountID", pa.DstAccountID, "currency", pa.Currency)
+		dstAccountID := bank.CurrencyAccountID(pa.DstAccountID, pa.Currency)
+		if _, err := a.bank.IncrOnce(idempotencyKey, dstAccountID, pa.Amount, bank.JournalSourceMint); err != nil {
+			return err
+		}
+		a.audit(ctx, "minted currency")
+
+		a.reply(req, "minted %s for <@%s> :printer:", a.formatAmountIn(pa.Currency, pa.Amount, true), userIDFromAccountID(pa.DstAccountID))
+		return nil
+
+	case adminActionBuyback:
+		ctx = mctx.Annotate(ctx, "amount", pa.Amount, "maxPrice", pa.MaxPrice)
+		ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+		defer cancel()
+		res, err := a.buyback(ctx, pa.Amount, pa.MaxPrice)
+		if err != nil {
+			return err
+		}
+		a.audit(ctx, "bought back and burned currency")
+
+		txLink := res.Links.Transaction.Href
+		a.replyMsg(req, slackbot.NewMessage("bought back and burned %s :fire:", a.formatAmount(pa.Amount, true)).
+			Button("view_tx", "View transaction", txLink))
+		a.announce(ctx, slackbot.NewMessage("%s were bought back off the DEX and burned :fire:", a.formatAmount(pa.Amount, true)).
+			Button("view_tx", "View transaction", txLink))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown admin action kind %q", pa.Kind)
+	}
+}
+
+// cmdPending lists the admin actions which are waiting for approval, and
+// approves or rejects them.
+func (a *app) cmdPending(ctx context.Context, req commandReq) error {
+	var subCmd string
+	if len(req.args) > 0 {
+		subCmd = strings.ToLower(req.args[0])
+	}
+
+	switch subCmd {
+	case "approve", "reject":
+		if len(req.args) < 2 {
+			a.reply(req, "usage: %s", pendingUsage)
+			return nil
+		} else if subCmd == "approve" {
+			return a.approveAdminAction(ctx, req, req.args[1])
+		}
+		return a.rejectAdminAction(ctx, req, req.args[1])
+	}
+
+	pas, err := a.allPendingAdminActions()
+	if err != nil {
+		return err
+	} else if len(pas) == 0 {
+		a.reply(req, "there aren't any admin actions waiting for approval")
+		return nil
+	}
+
+	ids := make([]string, 0, len(pas))
+	for id := range pas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return pas[ids[i]].CreatedAt.Before(pas[ids[j]].CreatedAt)
+	})
+
+	var loc *time.Location
+	if loc = a.userLocation(req.user.ID); loc == nil {
+		loc = time.UTC
+	}
+	strb := new(strings.Builder)
+	for _, id := range ids {
+		pa := pas[id]
+		fmt.Fprintf(strb, "`%s`: <@%s> wants to %s, asked %s\n",
+			id, userIDFromAccountID(pa.RequestedBy), a.describeAdminAction(pa),
+			pa.CreatedAt.In(loc).Format("Mon Jan 2 15:04 MST"))
+	}
+	a.replyMsg(req, slackbot.NewMessage("%s", strb.String()).Context("%s", pendingUsage))
+	return nil
+}
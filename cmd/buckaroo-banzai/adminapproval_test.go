@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestAdminApproval(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:           cmp,
+		bank:          bank.NewInMem(),
+		slack:         fs,
+		slackClient:   &slackbot.Client{BotTeamID: "T1"},
+		currencyName:  "BUCK",
+		configRoles:   map[string]role{"U1": roleAdmin, "U2": roleAdmin},
+		approvalAbove: 100,
+	}
+
+	mtest.Run(cmp, t, func() {
+		adminA := fs.AddUser("U1", "u1", "T1")
+		adminB := fs.AddUser("U2", "u2", "T1")
+		userC := fs.AddUser("U3", "u3", "T1")
+		channel := fs.AddChannel("D1", true)
+
+		ctx := context.Background()
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		pending := func() map[string]pendingAdminAction {
+			pas, err := a.allPendingAdminActions()
+			massert.Require(t, massert.Nil(err))
+			return pas
+		}
+		onlyID := func() string {
+			var id string
+			for id = range pending() {
+			}
+			return id
+		}
+		req := func(user *slack.User, messageTS string, args ...string) commandReq {
+			return commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      user,
+				accountID: user.ID,
+				role:      roleAdmin,
+				messageTS: messageTS,
+				args:      args,
+			}
+		}
+
+		// small mints go straight through, large ones wait for approval, and
+		// a message delivered twice only asks once.
+		massert.Require(t, massert.Nil(a.cmdMint(ctx, req(adminA, "1.0", "100", "U3"))))
+		massert.Require(t, massert.Equal(100, balanceOf(userC.ID)))
+		fs.Flush()
+		massert.Require(t, massert.Nil(a.cmdMint(ctx, req(adminA, "2.0", "500", "U3"))))
+		massert.Require(t, massert.Nil(a.cmdMint(ctx, req(adminA, "2.0", "500", "U3"))))
+		id := onlyID()
+		massert.Require(t,
+			massert.Length(pending(), 1),
+			massert.Equal(100, balanceOf(userC.ID)),
+			// a reply to each command, and one DM to the other admin.
+			massert.Length(fs.Flush(), 3),
+		)
+
+		// whoever asked for it can't approve it themselves.
+		_, isInputErr := a.cmdPending(ctx, req(adminA, "3.0", "approve", id)).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Length(pending(), 1),
+		)
+
+		massert.Require(t,
+			massert.Nil(a.cmdPending(ctx, req(adminB, "4.0", "approve", id))),
+			massert.Length(pending(), 0),
+			massert.Equal(600, balanceOf(userC.ID)),
+		)
+		_, isInputErr = a.cmdPending(ctx, req(adminB, "5.0", "approve", id)).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Equal(600, balanceOf(userC.ID)),
+		)
+
+		// either admin can reject one.
+		massert.Require(t, massert.Nil(a.cmdMint(ctx, req(adminB, "6.0", "500", "U3"))))
+		id = onlyID()
+		massert.Require(t,
+			massert.Nil(a.cmdPending(ctx, req(adminB, "7.0", "reject", id))),
+			massert.Length(pending(), 0),
+			massert.Equal(600, balanceOf(userC.ID)),
+		)
+
+		// with no other admin around large mints can't be done at all.
+		delete(a.configRoles, "U2")
+		_, isInputErr = a.cmdMint(ctx, req(adminA, "8.0", "500", "U3")).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Length(pending(), 0),
+		)
+	})
+}
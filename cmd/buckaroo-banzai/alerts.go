@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Kinds of alerts. Each kind is rate limited separately.
+const (
+	alertDepositGap         = "deposit-gap"
+	alertExportFailed       = "export-failed"
+	alertExportsPaused      = "exports-paused"
+	alertFeeTopUp           = "fee-top-up"
+	alertHorizonOutage      = "horizon-outage"
+	alertRedisError         = "redis-error"
+	alertStellarHealth      = "stellar-health"
+	alertSuspiciousActivity = "suspicious-activity"
+)
+
+// alerts posts alerts about serious conditions, which operators should know
+// about without having to watch the logs, into an ops channel and/or to a
+// webhook. Alerts of the same kind are rate limited, so that an outage doesn't
+// turn into a flood of messages. If neither a channel nor a webhook is
+// configured then alerts are only logged.
+type alerts struct {
+	cmp        *mcmp.Component
+	channelID  string
+	webhookURL string
+	interval   time.Duration
+
+	// set by the app once slack is available.
+	slack slackbot.API
+
+	httpClient *http.Client
+
+	l          sync.Mutex
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+}
+
+func instAlerts(parent *mcmp.Component) *alerts {
+	cmp := parent.Child("alerts")
+	al := &alerts{
+		cmp:        cmp,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		lastSent:   map[string]time.Time{},
+		suppressed: map[string]int{},
+	}
+
+	channelID := mcfg.String(cmp, "channel-id",
+		mcfg.ParamUsage("Optional slack channel ID which operator alerts will be posted into"))
+	webhookURL := mcfg.String(cmp, "webhook-url",
+		mcfg.ParamUsage("Optional URL which operator alerts will be POSTed to, in the format of a slack incoming webhook"))
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("10m"),
+		mcfg.ParamUsage("Minimum time between alerts of the same kind. Alerts within this time are counted and mentioned in the next one."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if al.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --alerts-interval: %w", err)
+		}
+		al.channelID = *channelID
+		al.webhookURL = *webhookURL
+		return nil
+	})
+
+	return al
+}
+
+// alert posts an alert of the given kind, unless one of the same kind was
+// posted recently. The error is optional. Posting happens in the background,
+// so this never blocks.
+func (al *alerts) alert(ctx context.Context, kind string, err error, str string, args ...interface{}) {
+	if al == nil {
+		return
+	}
+
+	text := fmt.Sprintf(str, args...)
+	ctx = mctx.Annotate(ctx, "alertKind", kind, "alert", text)
+	if err != nil {
+		text += fmt.Sprintf(": `%s`", err)
+	}
+
+	al.l.Lock()
+	if time.Since(al.lastSent[kind]) < al.interval {
+		al.suppressed[kind]++
+		al.l.Unlock()
+		return
+	}
+	suppressed := al.suppressed[kind]
+	al.lastSent[kind] = time.Now()
+	al.suppressed[kind] = 0
+	al.l.Unlock()
+
+	mlog.From(al.cmp).Warn("alerting operators", ctx)
+	msg := slackbot.NewMessage(":rotating_light: *%s* %s", kind, text)
+	if suppressed > 0 {
+		msg.Context("%d similar alerts were suppressed since the last one", suppressed)
+	}
+
+	go func() {
+		if err := al.send(msg); err != nil {
+			mlog.From(al.cmp).Error("error sending alert", ctx, merr.Context(err))
+		}
+	}()
+}
+
+func (al *alerts) send(msg *slackbot.Message) error {
+	if al.channelID != "" && al.slack != nil {
+		if err := al.slack.SendMessage(al.channelID, msg); err != nil {
+			return fmt.Errorf("sending alert to channel %q: %w", al.channelID, err)
+		}
+	}
+
+	if al.webhookURL != "" {
+		body, err := json.Marshal(map[string]interface{}{
+			"text":   msg.Text,
+			"blocks": msg.Blocks(),
+		})
+		if err != nil {
+			return fmt.Errorf("marshaling alert: %w", err)
+		}
+		resp, err := al.httpClient.Post(al.webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("posting alert to webhook: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("posting alert to webhook: got status %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
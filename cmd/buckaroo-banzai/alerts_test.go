@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestAlerts(t *T) {
+	fs := slackbottest.New()
+	al := instAlerts(mtest.Component())
+	al.slack = fs
+	al.channelID = "OPS"
+	al.interval = time.Hour
+	ctx := context.Background()
+
+	// alerts are sent in the background
+	waitSent := func(n int) []slackbottest.Msg {
+		var sent []slackbottest.Msg
+		for i := 0; i < 100 && len(sent) < n; i++ {
+			sent = append(sent, fs.Flush()...)
+			time.Sleep(10 * time.Millisecond)
+		}
+		return sent
+	}
+
+	al.alert(ctx, alertRedisError, errors.New("oh no"), "redis is %s", "down")
+	al.alert(ctx, alertRedisError, nil, "redis is still down")
+	al.alert(ctx, alertRedisError, nil, "redis is still down")
+	al.alert(ctx, alertHorizonOutage, nil, "horizon is down")
+
+	sent := waitSent(2)
+	massert.Require(t,
+		massert.Equal(2, len(sent)),
+		massert.HasValue(sent, slackbottest.Msg{ChannelID: "OPS", Text: ":rotating_light: *redis-error* redis is down: `oh no`"}),
+		massert.HasValue(sent, slackbottest.Msg{ChannelID: "OPS", Text: ":rotating_light: *horizon-outage* horizon is down"}),
+		massert.Equal(2, al.suppressed[alertRedisError]),
+	)
+
+	// once the interval has passed the next alert goes through, and the
+	// suppressed count is reset.
+	al.lastSent[alertRedisError] = time.Time{}
+	al.alert(ctx, alertRedisError, nil, "redis is back to being down")
+	massert.Require(t,
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "OPS", Text: ":rotating_light: *redis-error* redis is back to being down"},
+		}, waitSent(1)),
+		massert.Equal(0, al.suppressed[alertRedisError]),
+	)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+)
+
+// displayName returns the name which the user is shown as in slack.
+func displayName(user *slack.User) string {
+	switch {
+	case user.Profile.DisplayName != "":
+		return user.Profile.DisplayName
+	case user.RealName != "":
+		return user.RealName
+	default:
+		return user.Name
+	}
+}
+
+// recordAlias stores the user's display name as the alias of their account,
+// see bank.AliasMetaKey. Aliases which were already recorded by this process
+// aren't written again.
+func (a *app) recordAlias(accountID string, user *slack.User) error {
+	name := displayName(user)
+	if name == "" {
+		return nil
+	}
+
+	a.aliasesL.Lock()
+	defer a.aliasesL.Unlock()
+	if a.aliases[accountID] == name {
+		return nil
+	} else if err := a.bank.SetMeta(accountID, bank.AliasMetaKey, name); err != nil {
+		return fmt.Errorf("recording alias of %q: %w", accountID, err)
+	}
+
+	if a.aliases == nil {
+		a.aliases = map[string]string{}
+	}
+	a.aliases[accountID] = name
+	return nil
+}
+
+// lookupAlias returns the alias of the account, which may be a currency
+// account, out of the given aliases as returned by AllMeta, or empty string if
+// there isn't one.
+func lookupAlias(aliases map[string]string, accountID string) string {
+	accountID, _ = bank.SplitCurrencyAccountID(accountID)
+	return aliases[accountID]
+}
+
+// handleUser records the alias of a user who joined or changed their profile.
+func (a *app) handleUser(ctx context.Context, user slack.User) {
+	accountID, err := a.accountID(&user)
+	if errors.Is(err, errForeignTeam) {
+		return
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error getting account of changed user", ctx, merr.Context(err))
+		return
+	}
+
+	ctx = mctx.Annotate(ctx, "accountID", accountID)
+	if err := a.recordAlias(accountID, &user); err != nil {
+		mlog.From(a.cmp).Error("error recording alias", ctx, merr.Context(err))
+	}
+}
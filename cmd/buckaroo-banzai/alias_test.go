@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+func TestHandleUser(t *T) {
+	cmp := mtest.Component()
+	a := &app{
+		cmp:         cmp,
+		bank:        bank.NewInMem(),
+		slackClient: &slackbot.Client{BotTeamID: "T1"},
+	}
+
+	alias := func(accountID string) string {
+		aliases, err := a.bank.AllMeta(bank.AliasMetaKey)
+		massert.Require(t, massert.Nil(err))
+		return lookupAlias(aliases, accountID)
+	}
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+		user := slack.User{ID: "U1", Name: "alice", TeamID: "T1"}
+		a.handleUser(ctx, user)
+		massert.Require(t,
+			massert.Equal("alice", alias("U1")),
+			massert.Equal("alice", alias(bank.CurrencyAccountID("U1", "SEASON"))),
+		)
+
+		user.RealName = "Alice Smith"
+		a.handleUser(ctx, user)
+		user.Profile.DisplayName = "ali"
+		user.Deleted = true
+		a.handleUser(ctx, user)
+		massert.Require(t, massert.Equal("ali", alias("U1")))
+
+		// users of other teams aren't given aliases under the refuse policy.
+		a.handleUser(ctx, slack.User{ID: "U2", Name: "bob", TeamID: "T2"})
+		massert.Require(t, massert.Equal("", alias("U2")))
+	})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+const apiAllowancesPath = "/api/v1/allowances"
+
+// allowanceMetaKey is the bank metadata key which allowances are stored under,
+// keyed by their ID.
+const allowanceMetaKey = "allowance"
+
+// allowanceJournalSource is what paying an allowance is recorded as in the
+// bank's journal.
+const allowanceJournalSource = "allowance"
+
+// Periods which an allowance can be paid every one of.
+const (
+	allowanceDaily   = "daily"
+	allowanceWeekly  = "weekly"
+	allowanceMonthly = "monthly"
+)
+
+// allowance is a recurring credit, minted for a user, or for every member of
+// the team who has an account if User is empty, once every period.
+type allowance struct {
+	User      string `json:"user,omitempty"`
+	AccountID string `json:"accountID,omitempty"`
+	Amount    int    `json:"amount"`
+	Period    string `json:"period"`
+	Reason    string `json:"reason,omitempty"`
+
+	// Next is when the allowance is next due. It's only moved on once
+	// everyone has been paid for the period, see payAllowance.
+	Next time.Time `json:"next"`
+
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// IdempotencyKey is of the API request which created the allowance, so
+	// that retrying the request doesn't create it twice.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+}
+
+// allowanceNext returns when the period after the one starting at t starts.
+func allowanceNext(t time.Time, period string) time.Time {
+	switch period {
+	case allowanceDaily:
+		return t.AddDate(0, 0, 1)
+	case allowanceWeekly:
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+// allowanceWorker periodically pays allowances which are due.
+type allowanceWorker struct {
+	cmp        *mcmp.Component
+	interval   time.Duration
+	maxCatchUp int
+}
+
+func instAllowanceWorker(parent *mcmp.Component) *allowanceWorker {
+	cmp := parent.Child("allowances")
+	aw := &allowanceWorker{cmp: cmp}
+
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("How often to pay allowances which are due. 0 disables paying them."))
+	maxCatchUp := mcfg.Int(cmp, "max-catch-up",
+		mcfg.ParamDefault(4),
+		mcfg.ParamUsage("Most periods of an allowance which are paid at once, when catching up on those which were missed while buckaroo was down. Any missed before those are skipped."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if aw.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --allowances-interval: %w", err)
+		} else if aw.maxCatchUp = *maxCatchUp; aw.maxCatchUp < 1 {
+			return errors.New("--allowances-max-catch-up must be at least 1")
+		}
+		return nil
+	})
+
+	return aw
+}
+
+func (a *app) setAllowance(id string, al allowance) error {
+	b, err := json.Marshal(al)
+	if err != nil {
+		return err
+	} else if err := a.bank.SetMeta(id, allowanceMetaKey, string(b)); err != nil {
+		return fmt.Errorf("storing allowance: %w", err)
+	}
+	return nil
+}
+
+// allAllowances returns all allowances, keyed by ID.
+func (a *app) allAllowances() (map[string]allowance, error) {
+	all, err := a.bank.AllMeta(allowanceMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all allowances: %w", err)
+	}
+	als := make(map[string]allowance, len(all))
+	for id, str := range all {
+		var al allowance
+		if err := json.Unmarshal([]byte(str), &al); err != nil {
+			return nil, fmt.Errorf("unmarshaling allowance %q: %w", id, err)
+		}
+		als[id] = al
+	}
+	return als, nil
+}
+
+// allowanceAccountIDs returns the accounts which the allowance is paid to,
+// keyed by the slack user ID of their owner. An allowance for everyone is paid
+// to every account of a current, human member of the team.
+func (a *app) allowanceAccountIDs(al allowance) (map[string]string, error) {
+	if al.User != "" {
+		return map[string]string{al.User: al.AccountID}, nil
+	}
+
+	accountIDs := map[string]string{}
+	var cursor string
+	for {
+		accounts, nextCursor, err := a.bank.ListAccounts(cursor, accountsPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("listing accounts: %w", err)
+		}
+		for _, account := range accounts {
+			if _, currency := bank.SplitCurrencyAccountID(account.UserID); currency != bank.DefaultCurrency {
+				continue
+			}
+			// accounts which don't belong to a user, e.g. escrow, aren't
+			// found.
+			user, err := a.slack.GetUser(userIDFromAccountID(account.UserID))
+			if err != nil || user.IsBot || user.Deleted {
+				continue
+			} else if accountID, err := a.accountID(user); err != nil || accountID != account.UserID {
+				continue
+			}
+			accountIDs[user.ID] = account.UserID
+		}
+		if cursor = nextCursor; cursor == "" {
+			return accountIDs, nil
+		}
+	}
+}
+
+// payAllowance pays the allowance for the period which was due at the given
+// time. Each payment is made with an idempotency key of the allowance, period
+// and account, so if paying everyone fails part way through then trying
+// again, within a day, only pays those who weren't.
+func (a *app) payAllowance(ctx context.Context, id string, al allowance, due time.Time) error {
+	accountIDs, err := a.allowanceAccountIDs(al)
+	if err != nil {
+		return err
+	}
+
+	periodID := id + ":" + strconv.FormatInt(due.Unix(), 10)
+	var paid int
+	for userID, accountID := range accountIDs {
+		ctx := mctx.Annotate(ctx, "accountID", accountID)
+		balance, err := a.bank.IncrOnce("allowance:"+periodID+":"+accountID, accountID, al.Amount, allowanceJournalSource)
+		if errors.Is(err, bank.ErrDuplicate) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("paying allowance to %q: %w", accountID, err)
+		}
+		paid++
+
+		msg := slackbot.NewMessage("here's your %s allowance of %s :moneybag:", al.Period, a.formatAmount(al.Amount, true)).
+			Fields("Balance", a.formatAmount(balance, true))
+		if al.Reason != "" {
+			msg.Context("_%s_", al.Reason)
+		}
+		if err := a.notifyOnce(userID, "allowance:"+periodID, msg); err != nil {
+			mlog.From(a.cmp).Warn("error notifying user of allowance", ctx, merr.Context(err))
+		}
+	}
+
+	a.audit(mctx.Annotate(ctx, "paid", paid), "allowance paid")
+	return nil
+}
+
+// payDueAllowances pays every allowance which is due as of now, including any
+// periods which were missed while buckaroo was down, up to
+// --allowances-max-catch-up of them.
+func (a *app) payDueAllowances(ctx context.Context, now time.Time) error {
+	a.allowancesL.Lock()
+	defer a.allowancesL.Unlock()
+
+	als, err := a.allAllowances()
+	if err != nil {
+		return err
+	}
+
+	for id, al := range als {
+		ctx := mctx.Annotate(ctx, "allowanceID", id, "user", al.User, "amount", al.Amount, "period", al.Period)
+
+		var due []time.Time
+		for next := al.Next; !next.After(now); next = allowanceNext(next, al.Period) {
+			due = append(due, next)
+		}
+		if len(due) == 0 {
+			continue
+		} else if skip := len(due) - a.allowances.maxCatchUp; skip > 0 {
+			mlog.From(a.cmp).Warn("too many periods of allowance were missed, skipping the oldest", mctx.Annotate(ctx,
+				"skipped", skip, "skippedFrom", due[0].String()))
+			due = due[skip:]
+		}
+
+		for _, dueAt := range due {
+			if err := a.payAllowance(mctx.Annotate(ctx, "due", dueAt.String()), id, al, dueAt); err != nil {
+				return fmt.Errorf("paying allowance %q: %w", id, err)
+			}
+			al.Next = allowanceNext(dueAt, al.Period)
+			if err := a.setAllowance(id, al); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runAllowances pays due allowances every --allowances-interval, until the
+// Context is canceled.
+func (a *app) runAllowances(ctx context.Context) {
+	pay := func() {
+		if err := a.payDueAllowances(ctx, time.Now()); err != nil {
+			mlog.From(a.cmp).Error("error paying allowances", ctx, merr.Context(err))
+		}
+	}
+
+	pay()
+	ticker := time.NewTicker(a.allowances.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pay()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// allowanceReq is the body of a request to create an allowance. User is a
+// slack user ID, or empty for everyone. Start is when it's first paid, and
+// defaults to now.
+type allowanceReq struct {
+	User   string    `json:"user"`
+	Amount int       `json:"amount"`
+	Period string    `json:"period"`
+	Reason string    `json:"reason"`
+	Start  time.Time `json:"start"`
+}
+
+type allowanceJSON struct {
+	ID     string    `json:"id"`
+	User   string    `json:"user,omitempty"`
+	Amount int       `json:"amount"`
+	Period string    `json:"period"`
+	Reason string    `json:"reason,omitempty"`
+	Next   time.Time `json:"next"`
+}
+
+func newAllowanceJSON(id string, al allowance) allowanceJSON {
+	return allowanceJSON{
+		ID:     id,
+		User:   al.User,
+		Amount: al.Amount,
+		Period: al.Period,
+		Reason: al.Reason,
+		Next:   al.Next,
+	}
+}
+
+// apiAllowancesHandler lists allowances on GET, creates one on POST and
+// deletes the one given by the "id" query parameter on DELETE. Allowances are
+// minted, so all of these need the write:mint scope. Creating one needs an
+// Idempotency-Key header, and retries with the same key get back the
+// allowance the first created.
+func (a *app) apiAllowancesHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	internalErr := func(err error) {
+		mlog.From(a.cmp).Error("error handling allowances API request", ctx, merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+	}
+	writeJSON := func(status int, v interface{}) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(v)
+	}
+
+	a.allowancesL.Lock()
+	defer a.allowancesL.Unlock()
+
+	als, err := a.allAllowances()
+	if err != nil {
+		internalErr(err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		list := make([]allowanceJSON, 0, len(als))
+		for id, al := range als {
+			list = append(list, newAllowanceJSON(id, al))
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		writeJSON(http.StatusOK, struct {
+			Allowances []allowanceJSON `json:"allowances"`
+		}{list})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if _, ok := als[id]; !ok {
+			apiError(rw, http.StatusNotFound, fmt.Sprintf("there's no allowance %q", id))
+			return
+		} else if err := a.bank.SetMeta(id, allowanceMetaKey, ""); err != nil {
+			internalErr(fmt.Errorf("deleting allowance: %w", err))
+			return
+		}
+		a.audit(mctx.Annotate(ctx, "allowanceID", id), "allowance deleted via API")
+		writeJSON(http.StatusOK, newAllowanceJSON(id, als[id]))
+
+	case "POST":
+		k := apiKeyFromContext(ctx)
+		idemKey := r.Header.Get("Idempotency-Key")
+		if idemKey == "" {
+			apiError(rw, http.StatusBadRequest, "missing Idempotency-Key header")
+			return
+		}
+		idemKey = k.ID + ":" + idemKey
+		for id, al := range als {
+			if al.IdempotencyKey == idemKey {
+				rw.Header().Set("Idempotent-Replayed", "true")
+				writeJSON(http.StatusOK, newAllowanceJSON(id, al))
+				return
+			}
+		}
+
+		var req allowanceReq
+		if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<16)).Decode(&req); err != nil {
+			apiError(rw, http.StatusBadRequest, fmt.Sprintf("decoding request body: %s", err))
+			return
+		} else if req.Amount <= 0 {
+			apiError(rw, http.StatusBadRequest, "amount must be greater than 0")
+			return
+		} else if req.Period != allowanceDaily && req.Period != allowanceWeekly && req.Period != allowanceMonthly {
+			apiError(rw, http.StatusBadRequest, fmt.Sprintf("period must be %q, %q or %q", allowanceDaily, allowanceWeekly, allowanceMonthly))
+			return
+		}
+
+		now := time.Now().UTC()
+		al := allowance{
+			User:           req.User,
+			Amount:         req.Amount,
+			Period:         req.Period,
+			Reason:         req.Reason,
+			Next:           req.Start.UTC(),
+			CreatedBy:      k.ID,
+			CreatedAt:      now,
+			IdempotencyKey: idemKey,
+		}
+		if al.Next.IsZero() {
+			al.Next = now
+		}
+		if al.User != "" {
+			al.AccountID, err = a.accountIDByUserID(al.User)
+			if errors.Is(err, slackbot.ErrUserNotFound) || errors.Is(err, errForeignTeam) {
+				apiError(rw, http.StatusNotFound, fmt.Sprintf("user %q: %s", al.User, err))
+				return
+			} else if err != nil {
+				internalErr(err)
+				return
+			}
+		}
+
+		id, err := randHex(4)
+		if err != nil {
+			internalErr(fmt.Errorf("generating allowance ID: %w", err))
+			return
+		} else if err := a.setAllowance(id, al); err != nil {
+			internalErr(err)
+			return
+		}
+		a.audit(mctx.Annotate(ctx,
+			"allowanceID", id,
+			"user", al.User,
+			"amount", al.Amount,
+			"period", al.Period,
+			"next", al.Next.String()), "allowance created via API")
+		writeJSON(http.StatusCreated, newAllowanceJSON(id, al))
+
+	default:
+		apiError(rw, http.StatusMethodNotAllowed, "method must be GET, POST or DELETE")
+	}
+}
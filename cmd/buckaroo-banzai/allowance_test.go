@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestAllowances(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		slackClient:  &slackbot.Client{BotTeamID: "T1"},
+		currencyName: "BUCK",
+		allowances:   &allowanceWorker{maxCatchUp: 2},
+	}
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser("U1", "u1", "T1")
+		userB := fs.AddUser("U2", "u2", "T1")
+
+		// allowances for everyone only go to users who have an account, which
+		// the escrow account isn't.
+		_, err := a.bank.Incr(userA.ID, 1)
+		massert.Require(t, massert.Nil(err))
+		_, err = a.bank.Incr(userB.ID, 1)
+		massert.Require(t, massert.Nil(err))
+		_, err = a.bank.Incr(giftcardEscrowAccountID, 1)
+		massert.Require(t, massert.Nil(err))
+
+		ctx := context.Background()
+		_, key, err := a.createAPIKey(ctx, "ci", []string{scopeWriteMint}, 0, "UADMIN")
+		massert.Require(t, massert.Nil(err))
+
+		h := a.requireScope(scopeWriteMint, http.HandlerFunc(a.apiAllowancesHandler))
+		do := func(method, path, idemKey, body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, path, strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+key)
+			r.Header.Set("Idempotency-Key", idemKey)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, r)
+			return rw
+		}
+		create := func(idemKey, body string) (string, *httptest.ResponseRecorder) {
+			rw := do("POST", apiAllowancesPath, idemKey, body)
+			var res allowanceJSON
+			json.Unmarshal(rw.Body.Bytes(), &res)
+			return res.ID, rw
+		}
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		pay := func(now time.Time) {
+			massert.Require(t, massert.Nil(a.payDueAllowances(ctx, now)))
+		}
+
+		start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+		weekly := `{"user":"U1","amount":5,"period":"weekly","start":"2024-01-01T09:00:00Z"}`
+		weeklyID, rw := create("1", weekly)
+		massert.Require(t, massert.Equal(http.StatusCreated, rw.Code))
+
+		// retrying gets the same allowance back.
+		retryID, rw := create("1", weekly)
+		massert.Require(t,
+			massert.Equal(http.StatusOK, rw.Code),
+			massert.Equal("true", rw.Header().Get("Idempotent-Replayed")),
+			massert.Equal(weeklyID, retryID),
+		)
+
+		dailyID, rw := create("2", `{"amount":1,"period":"daily","start":"2024-01-01T09:00:00Z"}`)
+		massert.Require(t, massert.Equal(http.StatusCreated, rw.Code))
+
+		_, rw = create("3", `{"amount":1,"period":"hourly"}`)
+		massert.Require(t, massert.Equal(http.StatusBadRequest, rw.Code))
+
+		// nothing is paid until it's due, and then only once.
+		pay(start.Add(-time.Hour))
+		massert.Require(t, massert.Equal(1, balanceOf(userA.ID)))
+		pay(start)
+		pay(start)
+		massert.Require(t,
+			massert.Equal(7, balanceOf(userA.ID)),
+			massert.Equal(2, balanceOf(userB.ID)),
+			massert.Equal(1, balanceOf(giftcardEscrowAccountID)),
+		)
+
+		// after being down for 5 days only the last 2 are caught up on.
+		pay(start.Add(5 * 24 * time.Hour))
+		massert.Require(t,
+			massert.Equal(9, balanceOf(userA.ID)),
+			massert.Equal(4, balanceOf(userB.ID)),
+		)
+
+		// deleted allowances aren't paid again.
+		rw = do("DELETE", apiAllowancesPath+"?id="+dailyID, "", "")
+		massert.Require(t, massert.Equal(http.StatusOK, rw.Code))
+		pay(start.Add(7 * 24 * time.Hour))
+		massert.Require(t,
+			massert.Equal(14, balanceOf(userA.ID)),
+			massert.Equal(4, balanceOf(userB.ID)),
+		)
+
+		rw = do("GET", apiAllowancesPath, "", "")
+		var list struct {
+			Allowances []allowanceJSON `json:"allowances"`
+		}
+		massert.Require(t,
+			massert.Equal(http.StatusOK, rw.Code),
+			massert.Nil(json.Unmarshal(rw.Body.Bytes(), &list)),
+			massert.Length(list.Allowances, 1),
+			massert.Equal(weeklyID, list.Allowances[0].ID),
+		)
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/analytics"
+)
+
+// Sinks which analytics events can be mirrored to.
+const (
+	analyticsSinkNone    = ""
+	analyticsSinkWebhook = "webhook"
+	analyticsSinkFile    = "file"
+)
+
+// instAnalytics declares the params for the analytics exporter on a child of
+// the given component. The returned function must be called during init, after
+// the params have been populated, and returns nil if no sink is configured.
+func instAnalytics(parent *mcmp.Component) func() (*analytics.Exporter, error) {
+	cmp := parent.Child("analytics")
+
+	sink := mcfg.String(cmp, "sink",
+		mcfg.ParamUsage("Where ledger and audit events are mirrored to for long-term retention. \""+analyticsSinkWebhook+"\" POSTs batches of them as JSON to --analytics-webhook-url, \""+analyticsSinkFile+"\" appends them to daily JSONL files in --analytics-dir. If not set then events aren't mirrored."))
+	webhookURL := mcfg.String(cmp, "webhook-url",
+		mcfg.ParamUsage("URL which events are POSTed to, see --analytics-sink"))
+	dir := mcfg.String(cmp, "dir",
+		mcfg.ParamUsage("Directory which event files are written to, see --analytics-sink"))
+	batchSize := mcfg.Int(cmp, "batch-size",
+		mcfg.ParamDefault(100),
+		mcfg.ParamUsage("Most events written to the sink at once"))
+	flushInterval := mcfg.String(cmp, "flush-interval",
+		mcfg.ParamDefault("5s"),
+		mcfg.ParamUsage("Longest an event waits before being written to the sink"))
+	queueSize := mcfg.Int(cmp, "queue-size",
+		mcfg.ParamDefault(10000),
+		mcfg.ParamUsage("How many events can be waiting to be written to the sink, e.g. while it's unavailable"))
+	blockTimeout := mcfg.String(cmp, "block-timeout",
+		mcfg.ParamDefault("100ms"),
+		mcfg.ParamUsage("Once the queue is full, how long an operation waits for space in it before its event is dropped"))
+	retryBackoff := mcfg.String(cmp, "retry-backoff",
+		mcfg.ParamDefault("1s"),
+		mcfg.ParamUsage("How long to wait before retrying a batch which failed to be written. Each retry waits twice as long as the last, up to a minute."))
+
+	return func() (*analytics.Exporter, error) {
+		opts := analytics.Opts{
+			BatchSize: *batchSize,
+			QueueSize: *queueSize,
+		}
+		switch *sink {
+		case analyticsSinkNone:
+			return nil, nil
+		case analyticsSinkWebhook:
+			if *webhookURL == "" {
+				return nil, errors.New("--analytics-webhook-url is required by the webhook sink")
+			}
+			opts.Sink = analytics.WebhookSink{
+				URL:    *webhookURL,
+				Client: &http.Client{Timeout: 10 * time.Second},
+			}
+		case analyticsSinkFile:
+			if *dir == "" {
+				return nil, errors.New("--analytics-dir is required by the file sink")
+			} else if err := os.MkdirAll(*dir, 0755); err != nil {
+				return nil, fmt.Errorf("creating --analytics-dir: %w", err)
+			}
+			opts.Sink = analytics.FileSink{Dir: *dir}
+		default:
+			return nil, fmt.Errorf("unknown --analytics-sink %q", *sink)
+		}
+
+		var err error
+		if opts.BatchSize < 1 {
+			return nil, errors.New("--analytics-batch-size must be at least 1")
+		} else if opts.QueueSize < 1 {
+			return nil, errors.New("--analytics-queue-size must be at least 1")
+		} else if opts.FlushInterval, err = time.ParseDuration(*flushInterval); err != nil {
+			return nil, fmt.Errorf("parsing --analytics-flush-interval: %w", err)
+		} else if opts.FlushInterval <= 0 {
+			return nil, errors.New("--analytics-flush-interval must be greater than 0")
+		} else if opts.BlockTimeout, err = time.ParseDuration(*blockTimeout); err != nil {
+			return nil, fmt.Errorf("parsing --analytics-block-timeout: %w", err)
+		} else if opts.RetryBackoff, err = time.ParseDuration(*retryBackoff); err != nil {
+			return nil, fmt.Errorf("parsing --analytics-retry-backoff: %w", err)
+		} else if opts.RetryBackoff <= 0 {
+			return nil, errors.New("--analytics-retry-backoff must be greater than 0")
+		}
+		return analytics.New(cmp, opts), nil
+	}
+}
+
+// analyticsBank records an analytics event for each successful change to the
+// ledger.
+type analyticsBank struct {
+	bank.ExportingBank
+	e *analytics.Exporter
+}
+
+func wrapAnalyticsBank(b bank.ExportingBank, e *analytics.Exporter) bank.ExportingBank {
+	if e == nil {
+		return b
+	}
+	return analyticsBank{ExportingBank: b, e: e}
+}
+
+func (ab analyticsBank) recordIncr(userID string, by int) {
+	ab.e.Record(analytics.Event{Kind: analytics.KindIncr, UserID: userID, Amount: by})
+}
+
+func (ab analyticsBank) recordTransfer(dstUserID, srcUserID string, amount int) {
+	ab.e.Record(analytics.Event{
+		Kind:      analytics.KindTransfer,
+		UserID:    dstUserID,
+		SrcUserID: srcUserID,
+		Amount:    amount,
+	})
+}
+
+func (ab analyticsBank) Incr(userID string, by int) (int, error) {
+	newBalance, err := ab.ExportingBank.Incr(userID, by)
+	if err == nil {
+		ab.recordIncr(userID, by)
+	}
+	return newBalance, err
+}
+
+func (ab analyticsBank) IncrAs(userID string, by int, source string) (int, error) {
+	newBalance, err := ab.ExportingBank.IncrAs(userID, by, source)
+	if err == nil {
+		ab.recordIncr(userID, by)
+	}
+	return newBalance, err
+}
+
+func (ab analyticsBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	newDstBalance, newSrcBalance, err := ab.ExportingBank.Transfer(dstUserID, srcUserID, amount)
+	if err == nil {
+		ab.recordTransfer(dstUserID, srcUserID, amount)
+	}
+	return newDstBalance, newSrcBalance, err
+}
+
+func (ab analyticsBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	newDstBalance, newSrcBalance, err := ab.ExportingBank.TransferAs(dstUserID, srcUserID, amount, source)
+	if err == nil {
+		ab.recordTransfer(dstUserID, srcUserID, amount)
+	}
+	return newDstBalance, newSrcBalance, err
+}
+
+func (ab analyticsBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	newDstBalance, newSrcBalance, err := ab.ExportingBank.TransferWithReason(dstUserID, srcUserID, amount, source, reason)
+	if err == nil {
+		ab.recordTransfer(dstUserID, srcUserID, amount)
+	}
+	return newDstBalance, newSrcBalance, err
+}
+
+func (ab analyticsBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	newBalance, err := ab.ExportingBank.IncrOnce(idempotencyKey, userID, by, source)
+	if err == nil {
+		ab.recordIncr(userID, by)
+	}
+	return newBalance, err
+}
+
+func (ab analyticsBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	newDstBalance, newSrcBalance, err := ab.ExportingBank.TransferOnce(idempotencyKey, dstUserID, srcUserID, amount, source, reason)
+	if err == nil {
+		ab.recordTransfer(dstUserID, srcUserID, amount)
+	}
+	return newDstBalance, newSrcBalance, err
+}
+
+// Capture is recorded as a transfer from the user the funds were held from,
+// holding and releasing them don't change who has what.
+func (ab analyticsBank) Capture(holdID, dstUserID string) (bank.Hold, int, error) {
+	hold, newDstBalance, err := ab.ExportingBank.Capture(holdID, dstUserID)
+	if err == nil {
+		ab.recordTransfer(dstUserID, hold.UserID, hold.Amount)
+	}
+	return hold, newDstBalance, err
+}
+
+// PayScheduledPayment is recorded as a transfer, scheduling and canceling a
+// payment don't change who has what.
+func (ab analyticsBank) PayScheduledPayment(paymentID string) (bank.ScheduledPayment, int, int, error) {
+	p, newDstBalance, newSrcBalance, err := ab.ExportingBank.PayScheduledPayment(paymentID)
+	if err == nil {
+		ab.recordTransfer(p.DstUserID, p.SrcUserID, p.Amount)
+	}
+	return p, newDstBalance, newSrcBalance, err
+}
+
+// recordTransferMulti records each of the transfers made by a successful
+// TransferMulti.
+func (ab analyticsBank) recordTransferMulti(srcUserID string, dsts map[string]int, err error) {
+	if err != nil {
+		return
+	}
+	for dstUserID, amount := range dsts {
+		ab.recordTransfer(dstUserID, srcUserID, amount)
+	}
+}
+
+func (ab analyticsBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	newDstBalances, newSrcBalance, err := ab.ExportingBank.TransferMulti(srcUserID, dsts)
+	ab.recordTransferMulti(srcUserID, dsts, err)
+	return newDstBalances, newSrcBalance, err
+}
+
+func (ab analyticsBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	newDstBalances, newSrcBalance, err := ab.ExportingBank.TransferMultiAs(srcUserID, dsts, source)
+	ab.recordTransferMulti(srcUserID, dsts, err)
+	return newDstBalances, newSrcBalance, err
+}
+
+func (ab analyticsBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	newDstBalances, newSrcBalance, err := ab.ExportingBank.TransferMultiWithReason(srcUserID, dsts, source, reason)
+	ab.recordTransferMulti(srcUserID, dsts, err)
+	return newDstBalances, newSrcBalance, err
+}
+
+func (ab analyticsBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	newDstBalances, newSrcBalance, err := ab.ExportingBank.TransferMultiOnce(idempotencyKey, srcUserID, dsts, source, reason)
+	ab.recordTransferMulti(srcUserID, dsts, err)
+	return newDstBalances, newSrcBalance, err
+}
+
+func (ab analyticsBank) SubmitExport(e bank.Export) (string, error) {
+	id, err := ab.ExportingBank.SubmitExport(e)
+	if err == nil {
+		ab.e.Record(analytics.Event{
+			Kind:     analytics.KindExport,
+			UserID:   e.FromUserID,
+			Amount:   e.Amount,
+			Protocol: e.Protocol(),
+		})
+	}
+	return id, err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Scopes which API keys can be given. Each API endpoint requires one of them.
+const (
+	scopeReadBalances   = "read:balances"
+	scopeWriteTransfers = "write:transfers"
+	scopeWriteMint      = "write:mint"
+	scopeReadHistory    = "read:history"
+)
+
+var apiKeyScopes = []string{scopeReadBalances, scopeWriteTransfers, scopeWriteMint, scopeReadHistory}
+
+// apiKeyMetaKey is the bank metadata key which API keys are stored under.
+// They're keyed by the API key's ID, rather than by a user ID.
+const apiKeyMetaKey = "apiKey"
+
+// apiKey is a key which another system (a tenant) uses to call buckaroo's
+// HTTP API. The key itself is "<ID>.<secret>", and only a hash of the secret
+// is stored, so a key can't be recovered once it's been issued.
+type apiKey struct {
+	ID         string    `json:"-"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	SecretHash string    `json:"secretHash"`
+	CreatedBy  string    `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+
+	// CreditQuota is the most which can be credited using the key each day,
+	// see credit.go. Zero means the default quota is used.
+	CreditQuota int `json:"creditQuota,omitempty"`
+
+	// FundingAccountID is the only account which the key can transfer from,
+	// which is that of whoever created it. It's only set if the key has the
+	// write:transfers scope.
+	FundingAccountID string `json:"fundingAccountID,omitempty"`
+}
+
+func (k apiKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func randHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func parseAPIKeyScopes(str string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(str, ",") {
+		if scope = strings.TrimSpace(scope); scope == "" {
+			continue
+		}
+		var ok bool
+		for _, knownScope := range apiKeyScopes {
+			ok = ok || scope == knownScope
+		}
+		if !ok {
+			return nil, inputErrorf("unknown scope `%s`, it should be one of `%s`", scope, strings.Join(apiKeyScopes, "`, `"))
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, inputErrorf("an API key needs at least one scope")
+	}
+	return scopes, nil
+}
+
+// createAPIKey stores a new API key with the given name, scopes and credit
+// quota, and returns it along with the full key which should be given to the
+// tenant. If the key can transfer then it can only do so out of the createdBy
+// account.
+func (a *app) createAPIKey(ctx context.Context, name string, scopes []string, creditQuota int, createdBy string) (apiKey, string, error) {
+	id, err := randHex(4)
+	if err != nil {
+		return apiKey{}, "", fmt.Errorf("generating API key ID: %w", err)
+	}
+	secret, err := randHex(24)
+	if err != nil {
+		return apiKey{}, "", fmt.Errorf("generating API key secret: %w", err)
+	}
+
+	k := apiKey{
+		ID:          id,
+		Name:        name,
+		Scopes:      scopes,
+		SecretHash:  hashString(secret),
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now().UTC(),
+		CreditQuota: creditQuota,
+	}
+	if k.hasScope(scopeWriteTransfers) {
+		k.FundingAccountID = createdBy
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return apiKey{}, "", err
+	} else if err := a.bank.SetMeta(id, apiKeyMetaKey, string(b)); err != nil {
+		return apiKey{}, "", fmt.Errorf("storing API key: %w", err)
+	}
+	a.audit(mctx.Annotate(ctx, "apiKeyID", id, "apiKeyName", name, "apiKeyScopes", strings.Join(scopes, ",")), "API key created")
+	return k, id + "." + secret, nil
+}
+
+func (a *app) getAPIKey(id string) (apiKey, bool, error) {
+	str, err := a.bank.GetMeta(id, apiKeyMetaKey)
+	if err != nil {
+		return apiKey{}, false, fmt.Errorf("getting API key %q: %w", id, err)
+	} else if str == "" {
+		return apiKey{}, false, nil
+	}
+	k := apiKey{ID: id}
+	if err := json.Unmarshal([]byte(str), &k); err != nil {
+		return apiKey{}, false, fmt.Errorf("unmarshaling API key %q: %w", id, err)
+	}
+	return k, true, nil
+}
+
+// authAPIKey returns the API key which the given full key is for, or false if
+// it isn't a valid key.
+func (a *app) authAPIKey(key string) (apiKey, bool, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return apiKey{}, false, nil
+	}
+	k, ok, err := a.getAPIKey(parts[0])
+	if err != nil || !ok {
+		return apiKey{}, false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hashString(parts[1]))) != 1 {
+		return apiKey{}, false, nil
+	}
+	return k, true, nil
+}
+
+// listAPIKeys returns all API keys, oldest first.
+func (a *app) listAPIKeys() ([]apiKey, error) {
+	all, err := a.bank.AllMeta(apiKeyMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all API keys: %w", err)
+	}
+	keys := make([]apiKey, 0, len(all))
+	for id, str := range all {
+		k := apiKey{ID: id}
+		if err := json.Unmarshal([]byte(str), &k); err != nil {
+			return nil, fmt.Errorf("unmarshaling API key %q: %w", id, err)
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// revokeAPIKey deletes the API key with the given ID, returning false if there
+// wasn't one.
+func (a *app) revokeAPIKey(ctx context.Context, id string) (bool, error) {
+	k, ok, err := a.getAPIKey(id)
+	if err != nil || !ok {
+		return false, err
+	} else if err := a.bank.SetMeta(id, apiKeyMetaKey, ""); err != nil {
+		return false, fmt.Errorf("deleting API key %q: %w", id, err)
+	}
+	a.audit(mctx.Annotate(ctx, "apiKeyID", id, "apiKeyName", k.Name), "API key revoked")
+	return true, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type apiKeyCtxKey struct{}
+
+// apiKeyFromContext returns the API key which the request being handled was
+// authenticated with, see requireScope.
+func apiKeyFromContext(ctx context.Context) apiKey {
+	k, _ := ctx.Value(apiKeyCtxKey{}).(apiKey)
+	return k
+}
+
+// apiError writes an error response to an API request.
+func apiError(rw http.ResponseWriter, code int, msg string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// requireScope wraps the handler so that requests to it must be authenticated
+// with an API key which has the given scope, passed as a bearer token in the
+// Authorization header. The API key is available to the handler using
+// apiKeyFromContext.
+func (a *app) requireScope(scope string, h http.Handler) http.Handler {
+	return a.requireAnyScope([]string{scope}, h)
+}
+
+// requireAnyScope is like requireScope, but the API key only needs one of the
+// given scopes. The handler should check which it has.
+func (a *app) requireAnyScope(scopes []string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) {
+			apiError(rw, http.StatusUnauthorized, "missing API key")
+			return
+		}
+
+		k, ok, err := a.authAPIKey(strings.TrimPrefix(auth, prefix))
+		if err != nil {
+			mlog.From(a.cmp).Error("error authenticating API key", mctx.Annotate(r.Context(), "path", r.URL.Path), merr.Context(err))
+			apiError(rw, http.StatusInternalServerError, "internal error")
+			return
+		} else if !ok {
+			apiError(rw, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+
+		ctx := mctx.Annotate(r.Context(), "path", r.URL.Path, "apiKeyID", k.ID, "apiKeyName", k.Name)
+		var hasScope bool
+		for _, scope := range scopes {
+			hasScope = hasScope || k.hasScope(scope)
+		}
+		if !hasScope {
+			mlog.From(a.cmp).Warn("API key used without required scope", mctx.Annotate(ctx, "scopes", strings.Join(scopes, ",")))
+			apiError(rw, http.StatusForbidden, fmt.Sprintf("API key doesn't have any of the scopes %q", scopes))
+			return
+		}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(ctx, apiKeyCtxKey{}, k)))
+	})
+}
+
+const apiBalancePath = "/api/v1/balance"
+
+// apiBalanceHandler returns the balance of the user given by the "user" query
+// parameter, which is a slack user ID. Balance privacy isn't applied, since
+// whoever issued the API key decided the tenant can read balances.
+func (a *app) apiBalanceHandler(rw http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		apiError(rw, http.StatusBadRequest, "missing user parameter")
+		return
+	}
+
+	accountID, err := a.accountIDByUserID(userID)
+	if errors.Is(err, slackbot.ErrUserNotFound) {
+		apiError(rw, http.StatusNotFound, "user not found")
+		return
+	} else if errors.Is(err, errForeignTeam) {
+		apiError(rw, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error getting account for API request", r.Context(), merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	balance, err := a.bank.Balance(accountID)
+	if errors.Is(err, bank.ErrUnavailable) {
+		apiError(rw, http.StatusServiceUnavailable, "bank is unavailable")
+		return
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error getting balance for API request", r.Context(), merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		UserID  string `json:"userID"`
+		Balance int    `json:"balance"`
+	}{userID, balance})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+const apiKeyUsage = "usage: `apikey create <name> <scope>[,<scope>...] [<daily credit quota>]`, `apikey revoke <id>`, or `apikey list`. Scopes are `" +
+	scopeReadBalances + "`, `" + scopeWriteTransfers + "`, `" + scopeWriteMint + "` and `" + scopeReadHistory + "`"
+
+func (a *app) cmdAPIKey(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		a.reply(req, apiKeyUsage)
+		return nil
+	}
+
+	switch strings.ToLower(req.args[0]) {
+	case "create":
+		if len(req.args) < 3 {
+			a.reply(req, apiKeyUsage)
+			return nil
+		} else if req.channel == nil || !req.channel.IsIM {
+			// the key is only shown once, and shouldn't be shown to a whole
+			// channel.
+			a.reply(req, "API keys can only be created over DM, so nobody else sees them :shushing_face:")
+			return nil
+		}
+		scopes, err := parseAPIKeyScopes(req.args[2])
+		if err != nil {
+			return err
+		}
+		var creditQuota int
+		if len(req.args) > 3 {
+			if creditQuota, err = a.parseAmount(req.args[3]); err != nil {
+				return err
+			}
+		}
+		k, key, err := a.createAPIKey(ctx, req.args[1], scopes, creditQuota, req.accountID)
+		if err != nil {
+			return err
+		}
+		fields := []string{
+			"Scopes", "`" + strings.Join(k.Scopes, "`, `") + "`",
+			"Daily credit quota", a.formatAmount(a.creditQuota(k), true),
+		}
+		if k.FundingAccountID != "" {
+			fields = append(fields, "Transfers from", "<@"+userIDFromAccountID(k.FundingAccountID)+">")
+		}
+		a.replyMsg(req, slackbot.NewMessage("created API key `%s` for %s: `%s`", k.ID, k.Name, key).
+			Fields(fields...).
+			Context("This is the only time the key will be shown, so keep it somewhere safe. It's passed to the API as a bearer token."))
+
+	case "revoke":
+		if len(req.args) < 2 {
+			a.reply(req, apiKeyUsage)
+			return nil
+		}
+		ok, err := a.revokeAPIKey(ctx, req.args[1])
+		if err != nil {
+			return err
+		} else if !ok {
+			return inputErrorf("there's no API key with the ID `%s`", req.args[1])
+		}
+		a.reply(req, "API key `%s` has been revoked", req.args[1])
+
+	case "list":
+		keys, err := a.listAPIKeys()
+		if err != nil {
+			return err
+		} else if len(keys) == 0 {
+			a.reply(req, "there aren't any API keys")
+			return nil
+		}
+		strb := new(strings.Builder)
+		for _, k := range keys {
+			fmt.Fprintf(strb, "`%s` %s: `%s`, %s a day, created by <@%s> on %s\n",
+				k.ID, k.Name, strings.Join(k.Scopes, "`, `"), a.formatAmount(a.creditQuota(k), true),
+				userIDFromAccountID(k.CreatedBy), k.CreatedAt.Format("2006-01-02"))
+		}
+		a.reply(req, "%s", strb.String())
+
+	default:
+		a.reply(req, apiKeyUsage)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestParseAPIKeyScopes(t *T) {
+	scopes, err := parseAPIKeyScopes("read:balances, write:transfers,write:mint")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal([]string{scopeReadBalances, scopeWriteTransfers, scopeWriteMint}, scopes),
+	)
+
+	_, err = parseAPIKeyScopes("read:balances,write:everything")
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	_, err = parseAPIKeyScopes(",")
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
+
+func TestAPIKeys(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:         cmp,
+		bank:        bank.NewInMem(),
+		slack:       fs,
+		slackClient: &slackbot.Client{BotTeamID: "T1"},
+	}
+
+	mtest.Run(cmp, t, func() {
+		fs.AddUser("U1", "u1", "T1")
+		_, err := a.bank.Incr("U1", 3)
+		massert.Require(t, massert.Nil(err))
+
+		ctx := context.Background()
+		readKey, readSecret, err := a.createAPIKey(ctx, "reader", []string{scopeReadBalances}, 0, "UADMIN")
+		massert.Require(t, massert.Nil(err))
+		_, writeSecret, err := a.createAPIKey(ctx, "writer", []string{scopeWriteTransfers}, 0, "UADMIN")
+		massert.Require(t, massert.Nil(err))
+
+		h := a.requireScope(scopeReadBalances, http.HandlerFunc(a.apiBalanceHandler))
+		get := func(key, user string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", apiBalancePath+"?user="+user, nil)
+			if key != "" {
+				r.Header.Set("Authorization", "Bearer "+key)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, r)
+			return rw
+		}
+
+		rw := get(readSecret, "U1")
+		massert.Require(t,
+			massert.Equal(http.StatusOK, rw.Code),
+			massert.Equal(`{"userID":"U1","balance":3}`, strings.TrimSpace(rw.Body.String())),
+		)
+
+		badSecret := readKey.ID + ".nope"
+		massert.Require(t,
+			massert.Equal(http.StatusUnauthorized, get("", "U1").Code),
+			massert.Equal(http.StatusUnauthorized, get(badSecret, "U1").Code),
+			massert.Equal(http.StatusForbidden, get(writeSecret, "U1").Code),
+			massert.Equal(http.StatusNotFound, get(readSecret, "U2").Code),
+		)
+
+		ok, err := a.revokeAPIKey(ctx, readKey.ID)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(true, ok),
+			massert.Equal(http.StatusUnauthorized, get(readSecret, "U1").Code),
+		)
+
+		keys, err := a.listAPIKeys()
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(keys, 1),
+			massert.Equal("writer", keys[0].Name),
+		)
+	})
+}
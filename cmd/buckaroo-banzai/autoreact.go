@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/nlopes/slack"
+)
+
+// autoReactMaxMessages is the most messages whose reactions are tracked at
+// once. Past this the messages which were reacted to least recently are
+// forgotten.
+const autoReactMaxMessages = 10000
+
+// autoReactMessage is the reactions being tracked on a single message.
+type autoReactMessage struct {
+	// keyed by "<userID>:<emoji>", so that duplicate deliveries of the same
+	// reaction only count once.
+	reactions map[string]bool
+	lastSeen  time.Time
+	reacted   bool
+}
+
+// autoReact has the bot react to messages which have earned their author
+// something from at least threshold reactions, as a visible sign that the
+// message is earning.
+//
+// Reactions are counted in memory, from the point buckaroo started, so if
+// there's more than one instance each counts the reactions it handles
+// separately.
+//
+// All methods are no-ops on a nil autoReact.
+type autoReact struct {
+	threshold int
+	emoji     string
+
+	l        sync.Mutex
+	messages map[string]*autoReactMessage
+}
+
+func instAutoReact(parent *mcmp.Component) *autoReact {
+	cmp := parent.Child("auto-react")
+	ar := &autoReact{messages: map[string]*autoReactMessage{}}
+
+	threshold := mcfg.Int(cmp, "threshold",
+		mcfg.ParamUsage("If greater than zero, the bot reacts to a message once this many reactions to it have earned its author something"))
+	emoji := mcfg.String(cmp, "emoji",
+		mcfg.ParamUsage("Emoji which the bot reacts with, defaults to --currency-emoji"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		if ar.threshold = *threshold; ar.threshold < 0 {
+			return errors.New("--auto-react-threshold can't be negative")
+		}
+		ar.emoji = *emoji
+		return nil
+	})
+
+	return ar
+}
+
+// track records a reaction which was added to or removed from a message, and
+// returns true if the message has just reached the threshold.
+func (ar *autoReact) track(now time.Time, messageID, reactionKey string, delta int) bool {
+	if ar == nil || ar.threshold <= 0 {
+		return false
+	}
+	ar.l.Lock()
+	defer ar.l.Unlock()
+
+	msg, ok := ar.messages[messageID]
+	if !ok && delta < 0 {
+		return false
+	} else if !ok {
+		if len(ar.messages) >= autoReactMaxMessages {
+			ar.evictOldest()
+		}
+		msg = &autoReactMessage{reactions: map[string]bool{}}
+		ar.messages[messageID] = msg
+	}
+	msg.lastSeen = now
+
+	if delta < 0 {
+		delete(msg.reactions, reactionKey)
+		return false
+	}
+	msg.reactions[reactionKey] = true
+	if msg.reacted || len(msg.reactions) < ar.threshold {
+		return false
+	}
+	msg.reacted = true
+	return true
+}
+
+// evictOldest forgets the message which was reacted to least recently. It
+// must be called with the lock held.
+func (ar *autoReact) evictOldest() {
+	var oldestID string
+	var oldest time.Time
+	for id, msg := range ar.messages {
+		if oldestID == "" || msg.lastSeen.Before(oldest) {
+			oldestID, oldest = id, msg.lastSeen
+		}
+	}
+	delete(ar.messages, oldestID)
+}
+
+// autoReactEmoji returns the emoji which the bot reacts with, without colons,
+// or empty string if there isn't one.
+func (a *app) autoReactEmoji() string {
+	emoji := a.emoji()
+	if a.autoReact.emoji != "" {
+		emoji = a.autoReact.emoji
+	}
+	return strings.Trim(emoji, ":")
+}
+
+// trackAutoReact tracks a reaction which earned the message's author
+// something, and has the bot react to the message if it's reached the
+// threshold. Reactions to files aren't tracked.
+func (a *app) trackAutoReact(ctx context.Context, data slack.ReactionAddedEvent, delta int) {
+	if data.Item.Type != "message" {
+		return
+	}
+	messageID := data.Item.Channel + ":" + data.Item.Timestamp
+	reactionKey := data.User + ":" + data.Reaction
+	if !a.autoReact.track(time.Now(), messageID, reactionKey, delta) {
+		return
+	}
+
+	emoji := a.autoReactEmoji()
+	if emoji == "" {
+		return
+	}
+	ctx = mctx.Annotate(ctx, "channelID", data.Item.Channel, "messageTS", data.Item.Timestamp)
+	if err := a.slack.AddReaction(emoji, data.Item.Channel, data.Item.Timestamp); err != nil {
+		mlog.From(a.cmp).Warn("error auto-reacting to message", ctx, merr.Context(err))
+		return
+	}
+	mlog.From(a.cmp).Info("auto-reacted to message", ctx)
+}
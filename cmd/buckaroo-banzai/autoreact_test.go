@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestAutoReactTrack(t *T) {
+	ar := &autoReact{threshold: 2, messages: map[string]*autoReactMessage{}}
+	now := time.Now()
+
+	massert.Require(t,
+		massert.Equal(false, ar.track(now, "C1:1", "U1:fire", 1)),
+		// the same reaction again doesn't count twice.
+		massert.Equal(false, ar.track(now, "C1:1", "U1:fire", 1)),
+		// removing a reaction brings it back below the threshold.
+		massert.Equal(false, ar.track(now, "C1:1", "U1:fire", -1)),
+		massert.Equal(false, ar.track(now, "C1:1", "U2:fire", 1)),
+		massert.Equal(true, ar.track(now, "C1:1", "U1:tada", 1)),
+		// once reacted the bot doesn't react again.
+		massert.Equal(false, ar.track(now, "C1:1", "U3:tada", 1)),
+		// removals on messages which aren't tracked are ignored.
+		massert.Equal(false, ar.track(now, "C1:2", "U1:fire", -1)),
+		massert.Length(ar.messages, 1),
+	)
+
+	// once full the least recently reacted to message is forgotten.
+	for i := 0; i < autoReactMaxMessages; i++ {
+		ar.track(now.Add(time.Duration(i+1)*time.Second), "C2:"+strconv.Itoa(i), "U1:fire", 1)
+	}
+	_, ok := ar.messages["C1:1"]
+	massert.Require(t,
+		massert.Length(ar.messages, autoReactMaxMessages),
+		massert.Equal(false, ok),
+	)
+
+	var nilAR *autoReact
+	massert.Require(t, massert.Equal(false, nilAR.track(now, "C1:1", "U1:fire", 1)))
+}
+
+func TestTrackAutoReact(t *T) {
+	fs := slackbottest.New()
+	a := &app{
+		cmp:           mtest.Component(),
+		slack:         fs,
+		currencyEmoji: ":buck:",
+		autoReact:     &autoReact{threshold: 2, messages: map[string]*autoReactMessage{}},
+	}
+
+	reaction := func(userID string) slack.ReactionAddedEvent {
+		var data slack.ReactionAddedEvent
+		data.User = userID
+		data.Reaction = "fire"
+		data.Item.Type = "message"
+		data.Item.Channel = "C1"
+		data.Item.Timestamp = "1.1"
+		return data
+	}
+
+	a.trackAutoReact(context.Background(), reaction("U1"), 1)
+	massert.Require(t, massert.Length(fs.Reactions("C1", "1.1"), 0))
+	a.trackAutoReact(context.Background(), reaction("U2"), 1)
+	massert.Require(t, massert.Equal([]string{"buck"}, fs.Reactions("C1", "1.1")))
+
+	// --auto-react-emoji takes precedence over the currency's emoji.
+	a.autoReact.emoji = "moneybag"
+	data := reaction("U1")
+	data.Item.Timestamp = "2.2"
+	a.trackAutoReact(context.Background(), data, 1)
+	data.User = "U2"
+	a.trackAutoReact(context.Background(), data, 1)
+	massert.Require(t, massert.Equal([]string{"moneybag"}, fs.Reactions("C1", "2.2")))
+}
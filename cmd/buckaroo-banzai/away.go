@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// awayMetaKey is the bank metadata key which the time a user is away until is
+// stored under, keyed by their account ID and formatted as RFC3339. While a user is away their notifications
+// are held until they're back.
+const awayMetaKey = "awayUntil"
+
+const awayUsage = "usage: `away <duration>`, e.g. `away 2w` or `away 3d`, and `back` when you're back early"
+
+// parseAwayDuration parses durations like "2w" and "3d", as well as anything
+// time.ParseDuration accepts.
+func parseAwayDuration(str string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(str, "w"):
+		unit = 7 * 24 * time.Hour
+	case strings.HasSuffix(str, "d"):
+		unit = 24 * time.Hour
+	}
+
+	var d time.Duration
+	if unit == 0 {
+		var err error
+		if d, err = time.ParseDuration(str); err != nil {
+			return 0, inputErrorf("`%s` isn't a duration", str)
+		}
+	} else if n, err := strconv.Atoi(str[:len(str)-1]); err != nil {
+		return 0, inputErrorf("`%s` isn't a duration", str)
+	} else {
+		d = time.Duration(n) * unit
+	}
+
+	if d <= 0 {
+		return 0, inputErrorf("duration must be greater than 0")
+	}
+	return d, nil
+}
+
+// awayUntil returns when the user with the given account is away until, or the
+// zero time if they aren't away.
+func (a *app) awayUntil(accountID string) (time.Time, error) {
+	untilStr, err := a.bank.GetMeta(accountID, awayMetaKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("getting away time of %q: %w", accountID, err)
+	} else if untilStr == "" {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, untilStr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing away time %q of %q: %w", untilStr, accountID, err)
+	} else if !until.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// awayAccountIDs returns the IDs of the accounts whose users are away at the
+// given time.
+func (a *app) awayAccountIDs(at time.Time) ([]string, error) {
+	all, err := a.bank.AllMeta(awayMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting away times: %w", err)
+	}
+	var accountIDs []string
+	for accountID, untilStr := range all {
+		until, err := time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing away time %q of %q: %w", untilStr, accountID, err)
+		} else if until.After(at) {
+			accountIDs = append(accountIDs, accountID)
+		}
+	}
+	return accountIDs, nil
+}
+
+func awayScheduleKey(userID string) string {
+	return "away:" + userID
+}
+
+// deferAway schedules the notification to be sent once the slack user is
+// back, and returns true, or returns false if the user isn't away and it
+// should be sent now.
+func (a *app) deferAway(ctx context.Context, userID string, msg *slackbot.Message) bool {
+	if a.scheduler == nil {
+		return false
+	}
+	accountID, err := a.accountIDByUserID(userID)
+	if err != nil {
+		mlog.From(a.cmp).Warn("error getting account to check if user is away", ctx, merr.Context(err))
+		return false
+	}
+	until, err := a.awayUntil(accountID)
+	if err != nil {
+		// better to bother someone who's away than to lose the notification.
+		mlog.From(a.cmp).Warn("error checking if user is away", ctx, merr.Context(err))
+		return false
+	} else if until.IsZero() {
+		return false
+	}
+	mlog.From(a.cmp).Debug("holding notification until user is back",
+		mctx.Annotate(ctx, "until", until.Format(time.RFC3339)))
+	a.scheduler.atKey(awayScheduleKey(userID), until, func() {
+		if err := a.sendNotification(userID, msg); err != nil {
+			mlog.From(a.cmp).Warn("error sending held notification", ctx, merr.Context(err))
+		}
+	})
+	return true
+}
+
+func (a *app) cmdAway(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		until, err := a.awayUntil(req.accountID)
+		if err != nil {
+			return err
+		} else if until.IsZero() {
+			a.reply(req, "you aren't away. %s", awayUsage)
+		} else {
+			a.reply(req, "you're away until %s. %s", until.Format("Mon Jan 2 15:04 MST"), awayUsage)
+		}
+		return nil
+	}
+
+	d, err := parseAwayDuration(req.args[0])
+	if err != nil {
+		return err
+	}
+	until := time.Now().Add(d)
+	mlog.From(a.cmp).Info("setting user away",
+		mctx.Annotate(ctx, "until", until.Format(time.RFC3339)))
+	if err := a.bank.SetMeta(req.accountID, awayMetaKey, until.Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("setting away time of %q: %w", req.accountID, err)
+	}
+	a.reply(req, "enjoy your time away :palm_tree: I'll hold on to your notifications until %s, or until you tell me you're `back`", until.Format("Mon Jan 2 15:04 MST"))
+	return nil
+}
+
+func (a *app) cmdBack(ctx context.Context, req commandReq) error {
+	until, err := a.awayUntil(req.accountID)
+	if err != nil {
+		return err
+	} else if until.IsZero() {
+		a.reply(req, "you weren't away, but welcome back anyway :wave:")
+		return nil
+	}
+
+	mlog.From(a.cmp).Info("user is back", ctx)
+	if err := a.bank.SetMeta(req.accountID, awayMetaKey, ""); err != nil {
+		return fmt.Errorf("clearing away time of %q: %w", req.accountID, err)
+	}
+	a.reply(req, "welcome back :wave: I'll send over anything I was holding on to")
+	a.scheduler.flushKey(awayScheduleKey(req.user.ID))
+	return nil
+}
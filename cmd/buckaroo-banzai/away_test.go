@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestParseAwayDuration(t *T) {
+	for str, exp := range map[string]time.Duration{
+		"2w":  14 * 24 * time.Hour,
+		"3d":  3 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		d, err := parseAwayDuration(str)
+		massert.Require(t,
+			massert.Comment(massert.Nil(err), "str:%q", str),
+			massert.Comment(massert.Equal(exp, d), "str:%q", str),
+		)
+	}
+
+	for _, str := range []string{"", "w", "2x", "0d", "-1w", "soon"} {
+		_, err := parseAwayDuration(str)
+		massert.Require(t, massert.Comment(massert.Not(massert.Nil(err)), "str:%q", str))
+	}
+}
+
+func TestAwayForeignTeam(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:               cmp,
+		bank:              bank.NewInMem(),
+		slack:             fs,
+		slackClient:       &slackbot.Client{BotTeamID: "T1"},
+		foreignTeamPolicy: foreignTeamPolicyNamespace,
+		scheduler:         newScheduler(),
+	}
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+		user := fs.AddUser(mrand.Hex(8), "b", "T2")
+		channel := fs.AddChannel("IM-"+user.ID, true)
+		req := commandReq{
+			channelID: channel.ID,
+			channel:   channel,
+			user:      user,
+			accountID: "T2:" + user.ID,
+			args:      []string{"1d"},
+		}
+		massert.Require(t, massert.Nil(a.cmdAway(ctx, req)))
+		fs.Flush()
+
+		// notifications are sent to the slack user, but the user's away time
+		// is kept on their namespaced account.
+		massert.Require(t,
+			massert.Nil(a.notify(user.ID, slackbot.NewMessage("hi"))),
+			massert.Length(fs.Flush(), 0),
+		)
+
+		massert.Require(t, massert.Nil(a.cmdBack(ctx, req)))
+		massert.Require(t, massert.Equal([]slackbottest.Msg{
+			{ChannelID: channel.ID, Text: "welcome back :wave: I'll send over anything I was holding on to"},
+			{ChannelID: "IM-" + user.ID, Text: "hi"},
+		}, fs.Flush()))
+	})
+}
@@ -0,0 +1,12 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+import "buckaroo-banzai/bank"
+
+// building with the bolt tag keeps the bank in a bbolt database file rather
+// than redis.
+func init() {
+	instBank = bank.InstBolt
+}
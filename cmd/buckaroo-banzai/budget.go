@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// errorBudget tracks failures of some operation. Once more than max failures
+// have happened within window the budget is exhausted, and the operation
+// should be paused for cooldown.
+//
+// All methods are no-ops on a nil errorBudget, or one whose max is zero.
+type errorBudget struct {
+	max              int
+	window, cooldown time.Duration
+
+	l           sync.Mutex
+	failures    []time.Time
+	pausedUntil time.Time
+}
+
+// fail records a failure, and returns true if it exhausted the budget.
+func (eb *errorBudget) fail() bool {
+	if eb == nil || eb.max <= 0 {
+		return false
+	}
+
+	eb.l.Lock()
+	defer eb.l.Unlock()
+	now := time.Now()
+
+	// drop failures which have fallen out of the window
+	i := 0
+	for i < len(eb.failures) && now.Sub(eb.failures[i]) > eb.window {
+		i++
+	}
+	eb.failures = append(eb.failures[i:], now)
+
+	if len(eb.failures) <= eb.max || now.Before(eb.pausedUntil) {
+		return false
+	}
+	eb.pausedUntil = now.Add(eb.cooldown)
+	eb.failures = eb.failures[:0]
+	return true
+}
+
+// pausedFor returns how much longer the operation should be paused for, or 0
+// if it shouldn't be.
+func (eb *errorBudget) pausedFor() time.Duration {
+	if eb == nil {
+		return 0
+	}
+
+	eb.l.Lock()
+	defer eb.l.Unlock()
+	if d := time.Until(eb.pausedUntil); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestErrorBudget(t *T) {
+	eb := &errorBudget{max: 2, window: time.Hour, cooldown: time.Hour}
+	massert.Require(t,
+		massert.Equal(false, eb.fail()),
+		massert.Equal(false, eb.fail()),
+		massert.Equal(time.Duration(0), eb.pausedFor()),
+		massert.Equal(true, eb.fail()),
+		massert.Equal(true, eb.pausedFor() > 0),
+
+		// further failures while paused don't re-trip it
+		massert.Equal(false, eb.fail()),
+		massert.Equal(false, eb.fail()),
+		massert.Equal(false, eb.fail()),
+	)
+
+	// failures which have fallen out of the window don't count
+	eb = &errorBudget{max: 1, window: 10 * time.Millisecond, cooldown: time.Hour}
+	massert.Require(t, massert.Equal(false, eb.fail()))
+	time.Sleep(20 * time.Millisecond)
+	massert.Require(t,
+		massert.Equal(false, eb.fail()),
+		massert.Equal(true, eb.fail()),
+	)
+
+	// nil and disabled budgets never pause
+	eb = nil
+	massert.Require(t,
+		massert.Equal(false, eb.fail()),
+		massert.Equal(time.Duration(0), eb.pausedFor()),
+		massert.Equal(false, (&errorBudget{}).fail()),
+	)
+}
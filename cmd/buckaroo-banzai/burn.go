@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+// slackUsernameRegex matches anything which could be a slack username.
+var slackUsernameRegex = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// checkBurnMemo returns an error if the given burn memo is one which deposits
+// could be made to a user with, see accountIDByMemo, since they'd be burned
+// instead of credited.
+func checkBurnMemo(memo string) error {
+	name := strings.TrimPrefix(strings.TrimSpace(memo), "@")
+	name = strings.SplitN(name, "*", 2)[0]
+	if memo != "" && slackUsernameRegex.MatchString(strings.ToLower(name)) {
+		return fmt.Errorf("%q could be a slack username, deposits for whom would be burned", memo)
+	}
+	return nil
+}
+
+// buyback purchases the given amount of currency off the DEX, which is in the
+// bank's units, paying at most maxPrice XLM per whole unit, using the market
+// maker's distribution account. The
+// purchased currency is delivered straight to the issuer in the same path
+// payment, which burns it.
+//
+// Unless buckaroo is an anchor the issuer is buckaroo's own account, so the
+// burn is journaled when the payment comes in as a deposit with the burn memo.
+// Otherwise nothing will see it come in, so it's journaled here.
+func (a *app) buyback(ctx context.Context, amount int, maxPrice float64) (stellar.TransactionResult, error) {
+	if !a.marketMaker.enabled {
+		return stellar.TransactionResult{}, errors.New("buybacks require the market maker's distribution account to be configured")
+	} else if !a.stellar.isAnchor() && a.burnMemo == "" {
+		return stellar.TransactionResult{}, errors.New("buybacks require a burn memo to be configured, or they'd be taken for deposits")
+	}
+
+	asset := a.asset()
+	sendMax := formatPrice(float64(amount) / float64(a.currency.unit()) * maxPrice)
+	ctx = mctx.Annotate(ctx,
+		"buybackAmount", amount,
+		"buybackMaxPrice", formatPrice(maxPrice),
+		"buybackSendMax", sendMax,
+	)
+
+	op := &txnbuild.PathPayment{
+		SendAsset:   txnbuild.NativeAsset{},
+		SendMax:     sendMax,
+		Destination: asset.Issuer,
+		DestAsset:   asset.CreditAsset(),
+		DestAmount:  bank.FormatDecimal(amount, a.currency.decimals),
+	}
+
+	mlog.From(a.cmp).Info("constructing buyback XDR", ctx)
+	txXDR, err := a.stellar.client.MakeOpsXDR(ctx, a.marketMaker.kp, a.burnMemo, op)
+	if err != nil {
+		return stellar.TransactionResult{}, fmt.Errorf("making buyback tx: %w", err)
+	}
+
+	res, err := a.stellar.client.SubmitTransactionXDR(ctx, txXDR)
+	if err != nil {
+		return res, fmt.Errorf("submitting buyback tx: %w", err)
+	}
+
+	mlog.From(a.cmp).Info("buyback successfully submitted",
+		mctx.Annotate(ctx, "stellarTXLink", res.Links.Transaction.Href))
+
+	if a.stellar.isAnchor() {
+		if err := a.bank.Burn("buyback:"+res.Hash, bank.DefaultCurrency, amount); err != nil {
+			return res, fmt.Errorf("journaling buyback: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// announce posts the given message to the announcement channel, if one has been
+// configured. During quiet hours the announcement is held until they're over.
+func (a *app) announce(ctx context.Context, msg *slackbot.Message) {
+	if a.announceChannelID == "" {
+		return
+	}
+	ctx = mctx.Annotate(ctx, "announcement", msg.Text)
+	if a.deferQuiet(ctx, "", func() { a.sendAnnouncement(ctx, msg) }) {
+		return
+	}
+	a.sendAnnouncement(ctx, msg)
+}
+
+func (a *app) sendAnnouncement(ctx context.Context, msg *slackbot.Message) {
+	mlog.From(a.cmp).Info("making announcement", ctx)
+	if err := a.slack.SendMessage(a.announceChannelID, msg); err != nil {
+		mlog.From(a.cmp).Warn("error making announcement", ctx, merr.Context(err))
+	}
+}
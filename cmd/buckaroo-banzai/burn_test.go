@@ -0,0 +1,23 @@
+package main
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestCheckBurnMemo(t *T) {
+	for memo, ok := range map[string]bool{
+		"":               true,
+		"!burn":          true,
+		"burn it":        true,
+		"burn":           false,
+		"Burn":           false,
+		"@burn":          false,
+		"burn*buck.farm": false,
+		"burn.it_all-up": false,
+	} {
+		err := checkBurnMemo(memo)
+		massert.Require(t, massert.Comment(massert.Equal(ok, err == nil), "memo:%q err:%v", memo, err))
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/stellar/go/clients/horizonclient"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+// errChaos is the base of all errors which are injected by chaos.
+var errChaos = errors.New("chaos")
+
+// chaos is used to inject faults into buckaroo's dependencies, so that the
+// paths for handling them (retries, acks, refunds, etc...) can be exercised in
+// staging. It does nothing unless one of its rates is set, and should never be
+// enabled in production.
+type chaos struct {
+	cmp *mcmp.Component
+
+	redisErrorRate     float64
+	horizonTimeoutRate float64
+	slackSendErrorRate float64
+}
+
+func instChaos(parent *mcmp.Component) *chaos {
+	cmp := parent.Child("chaos")
+	c := &chaos{cmp: cmp}
+
+	redisErrorRate := mcfg.Float64(cmp, "redis-error-rate",
+		mcfg.ParamUsage("Fraction of bank calls, between 0 and 1, which will fail as if redis had errored. For testing only!"))
+	horizonTimeoutRate := mcfg.Float64(cmp, "horizon-timeout-rate",
+		mcfg.ParamUsage("Fraction of horizon requests, between 0 and 1, which will time out. For testing only!"))
+	slackSendErrorRate := mcfg.Float64(cmp, "slack-send-error-rate",
+		mcfg.ParamUsage("Fraction of slack messages, between 0 and 1, which will fail to send. For testing only!"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		rates := map[string]*float64{
+			"redis-error-rate":      redisErrorRate,
+			"horizon-timeout-rate":  horizonTimeoutRate,
+			"slack-send-error-rate": slackSendErrorRate,
+		}
+		for name, rate := range rates {
+			if *rate < 0 || *rate > 1 {
+				return fmt.Errorf("--chaos-%s must be between 0 and 1", name)
+			}
+		}
+
+		c.redisErrorRate = *redisErrorRate
+		c.horizonTimeoutRate = *horizonTimeoutRate
+		c.slackSendErrorRate = *slackSendErrorRate
+		if c.enabled() {
+			cmp.Annotate(
+				"redisErrorRate", c.redisErrorRate,
+				"horizonTimeoutRate", c.horizonTimeoutRate,
+				"slackSendErrorRate", c.slackSendErrorRate,
+			)
+			mlog.From(cmp).Warn("chaos is enabled, faults will be injected", ctx)
+		}
+		return nil
+	})
+
+	return c
+}
+
+func (c *chaos) enabled() bool {
+	return c.redisErrorRate > 0 || c.horizonTimeoutRate > 0 || c.slackSendErrorRate > 0
+}
+
+// strike returns true, at the given rate, if a fault should be injected.
+func (c *chaos) strike(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// wrapBank returns a Bank whose calls will fail at the configured redis error
+// rate.
+func (c *chaos) wrapBank(b bank.ExportingBank) bank.ExportingBank {
+	if c.redisErrorRate == 0 {
+		return b
+	}
+	return chaosBank{ExportingBank: b, c: c}
+}
+
+type chaosBank struct {
+	bank.ExportingBank
+	c *chaos
+}
+
+func (cb chaosBank) err(method string) error {
+	if !cb.c.strike(cb.c.redisErrorRate) {
+		return nil
+	}
+	return fmt.Errorf("%w: injected redis error in %s", errChaos, method)
+}
+
+func (cb chaosBank) Balance(userID string) (int, error) {
+	if err := cb.err("Balance"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.Balance(userID)
+}
+
+func (cb chaosBank) Incr(userID string, by int) (int, error) {
+	if err := cb.err("Incr"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.Incr(userID, by)
+}
+
+func (cb chaosBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	if err := cb.err("Transfer"); err != nil {
+		return 0, 0, err
+	}
+	return cb.ExportingBank.Transfer(dstUserID, srcUserID, amount)
+}
+
+func (cb chaosBank) IncrAs(userID string, by int, source string) (int, error) {
+	if err := cb.err("IncrAs"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.IncrAs(userID, by, source)
+}
+
+func (cb chaosBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	if err := cb.err("TransferAs"); err != nil {
+		return 0, 0, err
+	}
+	return cb.ExportingBank.TransferAs(dstUserID, srcUserID, amount, source)
+}
+
+func (cb chaosBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	if err := cb.err("TransferMulti"); err != nil {
+		return nil, 0, err
+	}
+	return cb.ExportingBank.TransferMulti(srcUserID, dsts)
+}
+
+func (cb chaosBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	if err := cb.err("TransferMultiAs"); err != nil {
+		return nil, 0, err
+	}
+	return cb.ExportingBank.TransferMultiAs(srcUserID, dsts, source)
+}
+
+func (cb chaosBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	if err := cb.err("TransferWithReason"); err != nil {
+		return 0, 0, err
+	}
+	return cb.ExportingBank.TransferWithReason(dstUserID, srcUserID, amount, source, reason)
+}
+
+func (cb chaosBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	if err := cb.err("TransferMultiWithReason"); err != nil {
+		return nil, 0, err
+	}
+	return cb.ExportingBank.TransferMultiWithReason(srcUserID, dsts, source, reason)
+}
+
+func (cb chaosBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	if err := cb.err("IncrOnce"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.IncrOnce(idempotencyKey, userID, by, source)
+}
+
+func (cb chaosBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	if err := cb.err("TransferOnce"); err != nil {
+		return 0, 0, err
+	}
+	return cb.ExportingBank.TransferOnce(idempotencyKey, dstUserID, srcUserID, amount, source, reason)
+}
+
+func (cb chaosBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	if err := cb.err("TransferMultiOnce"); err != nil {
+		return nil, 0, err
+	}
+	return cb.ExportingBank.TransferMultiOnce(idempotencyKey, srcUserID, dsts, source, reason)
+}
+
+func (cb chaosBank) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	if err := cb.err("Hold"); err != nil {
+		return "", 0, err
+	}
+	return cb.ExportingBank.Hold(userID, amount, ttl)
+}
+
+func (cb chaosBank) Capture(holdID, dstUserID string) (bank.Hold, int, error) {
+	if err := cb.err("Capture"); err != nil {
+		return bank.Hold{}, 0, err
+	}
+	return cb.ExportingBank.Capture(holdID, dstUserID)
+}
+
+func (cb chaosBank) Release(holdID string) (bank.Hold, int, error) {
+	if err := cb.err("Release"); err != nil {
+		return bank.Hold{}, 0, err
+	}
+	return cb.ExportingBank.Release(holdID)
+}
+
+func (cb chaosBank) ExpiredHolds(now time.Time, limit int) ([]bank.Hold, error) {
+	if err := cb.err("ExpiredHolds"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.ExpiredHolds(now, limit)
+}
+
+func (cb chaosBank) SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (string, error) {
+	if err := cb.err("SchedulePayment"); err != nil {
+		return "", err
+	}
+	return cb.ExportingBank.SchedulePayment(srcUserID, dstUserID, amount, at)
+}
+
+func (cb chaosBank) ScheduledPayments(srcUserID string) ([]bank.ScheduledPayment, error) {
+	if err := cb.err("ScheduledPayments"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.ScheduledPayments(srcUserID)
+}
+
+func (cb chaosBank) DueScheduledPayments(now time.Time, limit int) ([]bank.ScheduledPayment, error) {
+	if err := cb.err("DueScheduledPayments"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.DueScheduledPayments(now, limit)
+}
+
+func (cb chaosBank) PayScheduledPayment(paymentID string) (bank.ScheduledPayment, int, int, error) {
+	if err := cb.err("PayScheduledPayment"); err != nil {
+		return bank.ScheduledPayment{}, 0, 0, err
+	}
+	return cb.ExportingBank.PayScheduledPayment(paymentID)
+}
+
+func (cb chaosBank) CancelScheduledPayment(paymentID string) (bank.ScheduledPayment, error) {
+	if err := cb.err("CancelScheduledPayment"); err != nil {
+		return bank.ScheduledPayment{}, err
+	}
+	return cb.ExportingBank.CancelScheduledPayment(paymentID)
+}
+
+func (cb chaosBank) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	if err := cb.err("ApplyInterest"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.ApplyInterest(idempotencyKey, currency, rate, excludeUserIDs...)
+}
+
+func (cb chaosBank) Burn(idempotencyKey, currency string, amount int) error {
+	if err := cb.err("Burn"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.Burn(idempotencyKey, currency, amount)
+}
+
+func (cb chaosBank) UseQuota(key string, amount, max int, ttl time.Duration) (int, error) {
+	if err := cb.err("UseQuota"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.UseQuota(key, amount, max, ttl)
+}
+
+func (cb chaosBank) CanTransfer(dstUserID, srcUserID string, amount int) error {
+	if err := cb.err("CanTransfer"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.CanTransfer(dstUserID, srcUserID, amount)
+}
+
+func (cb chaosBank) GetMeta(userID, key string) (string, error) {
+	if err := cb.err("GetMeta"); err != nil {
+		return "", err
+	}
+	return cb.ExportingBank.GetMeta(userID, key)
+}
+
+func (cb chaosBank) SetMeta(userID, key, value string) error {
+	if err := cb.err("SetMeta"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.SetMeta(userID, key, value)
+}
+
+func (cb chaosBank) AllMeta(key string) (map[string]string, error) {
+	if err := cb.err("AllMeta"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.AllMeta(key)
+}
+
+func (cb chaosBank) Owed(userID string) (int, error) {
+	if err := cb.err("Owed"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.Owed(userID)
+}
+
+func (cb chaosBank) Overdraft(userID string) (int, error) {
+	if err := cb.err("Overdraft"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.Overdraft(userID)
+}
+
+func (cb chaosBank) SetOverdraft(userID string, overdraft int) error {
+	if err := cb.err("SetOverdraft"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.SetOverdraft(userID, overdraft)
+}
+
+func (cb chaosBank) ListAccounts(cursor string, limit int) ([]bank.Account, string, error) {
+	if err := cb.err("ListAccounts"); err != nil {
+		return nil, "", err
+	}
+	return cb.ExportingBank.ListAccounts(cursor, limit)
+}
+
+func (cb chaosBank) Top(n int) ([]bank.Account, error) {
+	if err := cb.err("Top"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.Top(n)
+}
+
+func (cb chaosBank) BalanceEvents(cursor string, limit int) ([]string, string, error) {
+	if err := cb.err("BalanceEvents"); err != nil {
+		return nil, "", err
+	}
+	return cb.ExportingBank.BalanceEvents(cursor, limit)
+}
+
+func (cb chaosBank) Journal(cursor string, limit int) ([]bank.JournalEntry, string, error) {
+	if err := cb.err("Journal"); err != nil {
+		return nil, "", err
+	}
+	return cb.ExportingBank.Journal(cursor, limit)
+}
+
+func (cb chaosBank) History(userID string, cursor string, limit int) ([]bank.HistoryEntry, string, error) {
+	if err := cb.err("History"); err != nil {
+		return nil, "", err
+	}
+	return cb.ExportingBank.History(userID, cursor, limit)
+}
+
+func (cb chaosBank) TopGivers(month time.Time, limit int) ([]bank.GiveTotal, error) {
+	if err := cb.err("TopGivers"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.TopGivers(month, limit)
+}
+
+func (cb chaosBank) Supply(since time.Time) ([]bank.SupplyDay, error) {
+	if err := cb.err("Supply"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.Supply(since)
+}
+
+func (cb chaosBank) SubmitEarn(e bank.Earn) (string, error) {
+	if err := cb.err("SubmitEarn"); err != nil {
+		return "", err
+	}
+	return cb.ExportingBank.SubmitEarn(e)
+}
+
+func (cb chaosBank) ConsumeEarns(ctx context.Context, ch chan<- bank.EarnInProgress) error {
+	if err := cb.err("ConsumeEarns"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.ConsumeEarns(ctx, ch)
+}
+
+func (cb chaosBank) ReplayEarns(since time.Time) error {
+	if err := cb.err("ReplayEarns"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.ReplayEarns(since)
+}
+
+func (cb chaosBank) SubmitExport(e bank.Export) (string, error) {
+	if err := cb.err("SubmitExport"); err != nil {
+		return "", err
+	}
+	return cb.ExportingBank.SubmitExport(e)
+}
+
+func (cb chaosBank) CanExport(e bank.Export) error {
+	if err := cb.err("CanExport"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.CanExport(e)
+}
+
+func (cb chaosBank) ConsumeExports(ctx context.Context, ch chan<- bank.ExportInProgress) error {
+	if err := cb.err("ConsumeExports"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.ConsumeExports(ctx, ch)
+}
+
+func (cb chaosBank) ConsumeExportsGroup(ctx context.Context, group string, ch chan<- bank.ExportInProgress) error {
+	if err := cb.err("ConsumeExportsGroup"); err != nil {
+		return err
+	}
+	return cb.ExportingBank.ConsumeExportsGroup(ctx, group, ch)
+}
+
+func (cb chaosBank) TrimExports(before time.Time) (int, error) {
+	if err := cb.err("TrimExports"); err != nil {
+		return 0, err
+	}
+	return cb.ExportingBank.TrimExports(before)
+}
+
+func (cb chaosBank) ExportHistory(start, end time.Time) ([]bank.ExportRecord, error) {
+	if err := cb.err("ExportHistory"); err != nil {
+		return nil, err
+	}
+	return cb.ExportingBank.ExportHistory(start, end)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// chaosHorizonTimeout is how long a horizon request which has been chosen to
+// time out will hang for, if its context doesn't have a deadline of its own.
+const chaosHorizonTimeout = 30 * time.Second
+
+// wrapStellarClient modifies the given stellar.API, if it's a Client, so that
+// its horizon requests will time out at the configured horizon timeout rate.
+// This must be called after the Client has been initialized.
+func (c *chaos) wrapStellarClient(api stellar.API) {
+	client, ok := api.(*stellar.Client)
+	if !ok || c.horizonTimeoutRate == 0 {
+		return
+	}
+	client.Client = &horizonclient.Client{
+		HorizonURL: client.Client.HorizonURL,
+		HTTP: &http.Client{
+			Transport: chaosRoundTripper{c: c, RoundTripper: http.DefaultTransport},
+		},
+	}
+}
+
+type chaosRoundTripper struct {
+	http.RoundTripper
+	c *chaos
+}
+
+func (rt chaosRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !rt.c.strike(rt.c.horizonTimeoutRate) {
+		return rt.RoundTripper.RoundTrip(r)
+	}
+
+	timer := time.NewTimer(chaosHorizonTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.Context().Done():
+		return nil, fmt.Errorf("%w: injected horizon timeout: %v", errChaos, r.Context().Err())
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: injected horizon timeout", errChaos)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// wrapSlack returns a slackbot.API whose messages will fail to send at the
+// configured slack send error rate.
+func (c *chaos) wrapSlack(s slackbot.API) slackbot.API {
+	if c.slackSendErrorRate == 0 {
+		return s
+	}
+	return chaosSlack{API: s, c: c}
+}
+
+type chaosSlack struct {
+	slackbot.API
+	c *chaos
+}
+
+func (cs chaosSlack) SendMessage(channelID string, msg *slackbot.Message) error {
+	if cs.c.strike(cs.c.slackSendErrorRate) {
+		return fmt.Errorf("%w: injected slack send error", errChaos)
+	}
+	return cs.API.SendMessage(channelID, msg)
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/nlopes/slack"
+	"github.com/stellar/go/strkey"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+// commandReq describes a command which a user has sent to buckaroo, either by
+// DM'ing or @'ing him.
+type commandReq struct {
+	channelID string
+	channel   *slack.Channel
+	user      *slack.User
+	accountID string
+	role      role
+
+	// messageTS is the slack timestamp of the message the command was sent
+	// in.
+	messageTS string
+
+	// args are the whitespace separated fields of the message, not including
+	// the command name itself.
+	args []string
+}
+
+// idempotencyKey returns the key which the given command's changes to balances
+// should be made once for, see bank.Bank.IncrOnce. It's identified by the
+// message the command was sent in, so that the message being delivered more
+// than once can't make them more than once. It's empty if the message isn't
+// known.
+func (req commandReq) idempotencyKey(command string) string {
+	if req.messageTS == "" {
+		return ""
+	}
+	return command + ":" + req.channelID + ":" + req.messageTS
+}
+
+// replyMsg sends a message to the channel which the command was sent from. If
+// the command wasn't sent via IM then the message is prefixed with an @ of the
+// user who sent it.
+func (a *app) replyMsg(req commandReq, msg *slackbot.Message) {
+	if !req.channel.IsIM {
+		msg.Mention(req.user.ID)
+	}
+	if err := a.slack.SendMessage(req.channelID, msg); err != nil {
+		mlog.From(a.cmp).Warn("error sending slack message",
+			mctx.Annotate(a.cmp.Context(), "channelID", req.channelID), merr.Context(err))
+	}
+}
+
+// reply is like replyMsg, but for plain text messages.
+func (a *app) reply(req commandReq, str string, args ...interface{}) {
+	a.replyMsg(req, slackbot.NewMessage(str, args...))
+}
+
+// dm sends a message directly to the given user.
+func (a *app) dm(userID string, msg *slackbot.Message) error {
+	imChannelID, err := a.slack.GetIMChannel(userID)
+	if err != nil {
+		return fmt.Errorf("getting IM channel for user %q: %w", userID, err)
+	}
+	return a.slack.SendMessage(imChannelID, msg)
+}
+
+// notify DMs the user about something which happened to them, as opposed to
+// replying to something they did. If the user is away then the message is
+// held until they're back. If it's quiet hours for the user then the
+// message is held until they're over. If DM digesting is enabled then the
+// message might be held for a bit, so it can be sent along with any others. If
+// DM retrying is enabled then failing to send the message isn't an error,
+// it'll be retried.
+func (a *app) notify(userID string, msg *slackbot.Message) error {
+	ctx := mctx.Annotate(a.cmp.Context(), "userID", userID)
+	if a.deferAway(ctx, userID, msg) {
+		return nil
+	} else if a.deferQuiet(ctx, userID, func() {
+		if err := a.sendNotification(userID, msg); err != nil {
+			mlog.From(a.cmp).Warn("error sending deferred notification", ctx, merr.Context(err))
+		}
+	}) {
+		return nil
+	}
+	return a.sendNotification(userID, msg)
+}
+
+func (a *app) sendNotification(userID string, msg *slackbot.Message) error {
+	if a.dmDigest != nil {
+		a.dmDigest.Send(userID, msg)
+		return nil
+	}
+
+	err := a.dm(userID, msg)
+	if err != nil && a.dmRetry != nil {
+		mlog.From(a.cmp).Warn("error sending notification DM, will retry",
+			mctx.Annotate(a.cmp.Context(), "userID", userID), merr.Context(err))
+		a.dmRetry.Retry(userID, msg)
+		return nil
+	}
+	return err
+}
+
+// replyUndelivered replies to the user with any notifications which couldn't
+// be DM'd to them, so that they find out about them eventually.
+func (a *app) replyUndelivered(req commandReq) {
+	if a.dmRetry == nil {
+		return
+	}
+	undelivered := a.dmRetry.TakeUndelivered(req.user.ID)
+	if undelivered == nil {
+		return
+	}
+	mlog.From(a.cmp).Info("replying with undelivered notifications",
+		mctx.Annotate(a.cmp.Context(), "userID", req.user.ID))
+	a.replyMsg(req, undelivered.Context("I couldn't DM you about this earlier, so here it is :mailbox_with_mail:"))
+}
+
+type command struct {
+	// the minimum role a user must have in order to use the command.
+	role role
+	fn   func(a *app, ctx context.Context, req commandReq) error
+}
+
+var commands map[string]command
+
+// horizonBudgets are the most calls to horizon which each command can make,
+// so that lots of users running commands at once can't get buckaroo rate
+// limited. Commands which aren't listed can make as many calls as they like,
+// but they're still counted in the metrics.
+var horizonBudgets = map[string]int{
+	// the source and destination accounts, plus building a trustline
+	// transaction if the destination doesn't have one.
+	"withdraw": 3,
+	"faucet":   1,
+}
+
+func init() {
+	commands = map[string]command{
+		"ref":         {roleUser, (*app).cmdVersion},
+		"version":     {roleUser, (*app).cmdVersion},
+		"help":        {roleUser, (*app).cmdHelp},
+		"balance":     {roleUser, (*app).cmdBalance},
+		"history":     {roleUser, (*app).cmdHistory},
+		"give":        {roleUser, (*app).cmdGive},
+		"generous":    {roleUser, (*app).cmdGenerous},
+		"leaderboard": {roleUser, (*app).cmdLeaderboard},
+		"economy":     {roleUser, (*app).cmdEconomy},
+		"giftcard":    {roleUser, (*app).cmdGiftcard},
+		"split":       {roleUser, (*app).cmdSplit},
+		"pay":         {roleUser, (*app).cmdPay},
+		"payments":    {roleUser, (*app).cmdPayments},
+		"withdraw":    {roleUser, (*app).cmdWithdraw},
+		"withdrawals": {roleUser, (*app).cmdWithdrawals},
+		"faucet":      {roleUser, (*app).cmdFaucet},
+		"role":        {roleUser, (*app).cmdRole},
+		"privacy":     {roleUser, (*app).cmdPrivacy},
+		"friend":      {roleUser, (*app).cmdFriend},
+		"unfriend":    {roleUser, (*app).cmdUnfriend},
+		"link":        {roleUser, (*app).cmdLink},
+		"unlink":      {roleUser, (*app).cmdUnlink},
+		"github":      {roleUser, (*app).cmdGitHub},
+		"away":        {roleUser, (*app).cmdAway},
+		"back":        {roleUser, (*app).cmdBack},
+		"mint":        {roleAdmin, (*app).cmdMint},
+		"buyback":     {roleAdmin, (*app).cmdBuyback},
+		"replay":      {roleAdmin, (*app).cmdReplay},
+		"whois":       {roleAdmin, (*app).cmdWhois},
+		"accounts":    {roleAdmin, (*app).cmdAccounts},
+		"reconcile":   {roleAdmin, (*app).cmdReconcile},
+		"overdraft":   {roleAdmin, (*app).cmdOverdraft},
+		"pending":     {roleAdmin, (*app).cmdPending},
+		"supply":      {roleAdmin, (*app).cmdSupply},
+		"apikey":      {roleAdmin, (*app).cmdAPIKey},
+		"setup":       {roleAdmin, (*app).cmdSetup},
+
+		// not in the help message, it only works against testnet.
+		"smoketest": {roleAdmin, (*app).cmdSmokeTest},
+	}
+}
+
+// editDistance returns the edit distance between the two strings, where
+// inserting, deleting, or changing a character, or swapping two adjacent ones,
+// each count as one edit.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	d := make([][]int, len(ar)+1)
+	for i := range d {
+		d[i] = make([]int, len(br)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	minOf := func(ii ...int) int {
+		m := ii[0]
+		for _, i := range ii[1:] {
+			if i < m {
+				m = i
+			}
+		}
+		return m
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			d[i][j] = minOf(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ar[i-1] == br[j-2] && ar[i-2] == br[j-1] {
+				d[i][j] = minOf(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ar)][len(br)]
+}
+
+// suggestCommand returns the name of the command closest to the given
+// unrecognized one, out of those the given role can use, or false if none are
+// close enough to be worth suggesting.
+func suggestCommand(name string, r role) (string, bool) {
+	// allow a typo or two, but not so many that short words match everything.
+	maxDist := len(name) / 3
+	if maxDist < 1 {
+		maxDist = 1
+	} else if maxDist > 2 {
+		maxDist = 2
+	}
+
+	names := make([]string, 0, len(commands))
+	for cmdName, cmd := range commands {
+		if r >= cmd.role {
+			names = append(names, cmdName)
+		}
+	}
+	sort.Strings(names)
+
+	var best string
+	bestDist := maxDist + 1
+	for _, cmdName := range names {
+		if dist := editDistance(name, cmdName); dist < bestDist {
+			best, bestDist = cmdName, dist
+		}
+	}
+	return best, best != ""
+}
+
+func memoOrNone(memo string) string {
+	if memo == "" {
+		return "_none_"
+	}
+	return fmt.Sprintf("%q", memo)
+}
+
+// parseAmount parses an amount of the currency given in a command, which must
+// be greater than zero and have no more decimal places than the currency,
+// into the bank's units.
+func (a *app) parseAmount(str string) (int, error) {
+	amount, err := bank.ParseDecimal(str, a.currency.decimals)
+	if err != nil && a.currency.decimals == 0 {
+		return 0, inputErrorf("`%s` isn't a whole number", str)
+	} else if err != nil {
+		return 0, inputErrorf("`%s` isn't a number with at most %d decimal places", str, a.currency.decimals)
+	} else if amount <= 0 {
+		return 0, inputErrorf("amount must be greater than 0")
+	}
+	return amount, nil
+}
+
+func (a *app) cmdHelp(ctx context.Context, req commandReq) error {
+	a.reply(req, a.fullHelpMsg())
+	return nil
+}
+
+func (a *app) cmdBalance(ctx context.Context, req commandReq) error {
+	if len(req.args) > 0 {
+		return a.cmdBalanceOf(ctx, req)
+	}
+
+	mlog.From(a.cmp).Info("getting user balance", ctx)
+	balance, err := a.bank.Balance(req.accountID)
+	if err != nil {
+		return err
+	}
+	owed, err := a.bank.Owed(req.accountID)
+	if err != nil {
+		return err
+	}
+	overdraft, err := a.bank.Overdraft(req.accountID)
+	if err != nil {
+		return err
+	}
+
+	var msg *slackbot.Message
+	if balance == 0 {
+		msg = slackbot.NewMessage("sorry champ, you don't have any %s :( if you're having trouble getting %s, try being cool!", a.currencyString(2, false), a.currencyString(2, false))
+	} else if balance < 0 {
+		msg = slackbot.NewMessage("you're %s in the red :chart_with_downwards_trend: your next earnings will go towards getting you back to zero", a.formatAmount(-balance, true))
+	} else {
+		msg = slackbot.NewMessage("you have %s !", a.formatAmount(balance, true))
+	}
+	if owed > 0 {
+		msg.Context("You owe %s from reactions which were taken back, your next earnings will pay that off first", a.formatAmount(owed, false))
+	}
+	if overdraft > 0 {
+		msg.Context("You can go up to %s into the red", a.formatAmount(overdraft, false))
+	}
+
+	for _, currency := range a.extraCurrencies {
+		extraBalance, err := a.bank.Balance(bank.CurrencyAccountID(req.accountID, currency))
+		if err != nil {
+			return err
+		} else if extraBalance != 0 {
+			msg.Fields(currency, a.formatNumber(extraBalance))
+		}
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
+
+// cmdBalanceOf handles the balance command when it's been given another user,
+// whose privacy setting decides if their balance is shown.
+func (a *app) cmdBalanceOf(ctx context.Context, req commandReq) error {
+	dstAccountID, err := a.accountIDByUserID(req.args[0])
+	if err != nil {
+		return err
+	}
+	dstUserID := userIDFromAccountID(dstAccountID)
+	ctx = mctx.Annotate(ctx, "dstAccountID", dstAccountID)
+
+	if ok, err := a.canSeeBalance(req, dstAccountID); err != nil {
+		return err
+	} else if !ok {
+		a.reply(req, "<@%s> keeps their balance private :zipper_mouth_face:", dstUserID)
+		return nil
+	}
+
+	mlog.From(a.cmp).Info("getting other user's balance", ctx)
+	balance, err := a.bank.Balance(dstAccountID)
+	if err != nil {
+		return err
+	}
+	a.reply(req, "<@%s> has %s", dstUserID, a.formatAmount(balance, true))
+	return nil
+}
+
+const giveUsage = "usage: `give <amount> [<currency>] @<user> [@<user>...] [<reason>]`, e.g. `give 5 @someone for lunch`"
+
+// maxGiveReasonLen is the longest reason which can be given along with a give,
+// in bytes.
+const maxGiveReasonLen = 200
+
+// splitGiveArgs returns the amount, user and reason arguments of the give
+// command. Older versions of buckaroo took `give <user> <amount>`, so either
+// order is accepted, going by which argument looks like a number. False is
+// returned if neither does. With the amount first, every mention following the
+// first user is another user to give to. Whatever follows the users is the
+// reason.
+func splitGiveArgs(args []string) (string, []string, string, bool) {
+	isNumber := func(str string) bool {
+		_, err := bank.ParseDecimal(str, bank.MaxDecimals)
+		return err == nil
+	}
+	if isNumber(args[0]) {
+		users, rest := []string{args[1]}, args[2:]
+		for len(rest) > 0 && strings.HasPrefix(rest[0], "<@") {
+			users, rest = append(users, rest[0]), rest[1:]
+		}
+		return args[0], users, strings.Join(rest, " "), true
+	} else if isNumber(args[1]) {
+		return args[1], args[:1], strings.Join(args[2:], " "), true
+	}
+	return "", nil, "", false
+}
+
+func (a *app) cmdGive(ctx context.Context, req commandReq) error {
+	// the currency can go anywhere, since it can't be mistaken for an amount
+	// or a user.
+	currency := bank.DefaultCurrency
+	for i, arg := range req.args {
+		if c, ok := a.extraCurrency(arg); ok {
+			currency = c
+			req.args = append(req.args[:i:i], req.args[i+1:]...)
+			break
+		}
+	}
+
+	if len(req.args) < 2 {
+		a.reply(req, giveUsage)
+		return nil
+	}
+
+	amountStr, dstUserIDs, reason, ok := splitGiveArgs(req.args)
+	if !ok {
+		a.reply(req, "neither `%s` nor `%s` is an amount. %s", req.args[0], req.args[1], giveUsage)
+		return nil
+	} else if len(reason) > maxGiveReasonLen {
+		return inputErrorf("the reason can't be longer than %d characters", maxGiveReasonLen)
+	}
+
+	ctx = mctx.Annotate(ctx, "amount", amountStr)
+	amount, err := a.parseAmount(amountStr)
+	if err != nil {
+		return err
+	}
+
+	// the same user mentioned twice is only given to once.
+	var dstUsers []*slack.User
+	var dstAccountIDs []string
+	seen := map[string]bool{}
+	for _, dstUserID := range dstUserIDs {
+		dstUser, err := a.slack.GetUser(dstUserID)
+		if err != nil {
+			return err
+		}
+		dstAccountID, err := a.accountID(dstUser)
+		if err != nil {
+			return err
+		} else if seen[dstAccountID] {
+			continue
+		}
+		seen[dstAccountID] = true
+		dstUsers = append(dstUsers, dstUser)
+		dstAccountIDs = append(dstAccountIDs, dstAccountID)
+	}
+
+	ctx = mctx.Annotate(ctx, "currency", currency)
+	var dstBalances map[string]int
+	if len(dstUsers) == 1 {
+		ctx = mctx.Annotate(ctx, "dstUser", dstUsers[0].Name, "dstUserID", dstUsers[0].ID)
+		var dstBalance int
+		dstBalance, err = a.economy.GiveOnce(ctx, req.idempotencyKey("give"), req.accountID, dstAccountIDs[0], currency, amount, reason)
+		dstBalances = map[string]int{dstAccountIDs[0]: dstBalance}
+	} else {
+		ctx = mctx.Annotate(ctx, "dstAccountIDs", strings.Join(dstAccountIDs, ","))
+		dstBalances, err = a.economy.GiveMultiOnce(ctx, req.idempotencyKey("give"), req.accountID, dstAccountIDs, currency, amount, reason)
+	}
+	if errors.Is(err, economy.ErrGiveToSelf) {
+		a.reply(req, "quit playing with yourself, kid")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	mentions := make([]string, len(dstUsers))
+	for i, dstUser := range dstUsers {
+		mentions[i] = "<@" + dstUser.ID + ">"
+	}
+	if len(dstUsers) == 1 {
+		a.reply(req, "you gave %s %s :money_with_wings:", mentions[0], a.formatAmountIn(currency, amount, true))
+	} else {
+		a.reply(req, "you gave %s and %s %s each :money_with_wings:",
+			strings.Join(mentions[:len(mentions)-1], ", "), mentions[len(mentions)-1],
+			a.formatAmountIn(currency, amount, true))
+	}
+
+	// the notification is identified by the message the command was sent in,
+	// which is all a give has to go on.
+	notificationID := req.idempotencyKey("give")
+	for i, dstUser := range dstUsers {
+		// don't dm a bot, it errors out
+		if dstUser.IsBot {
+			continue
+		}
+		msg := slackbot.NewMessage(
+			"gave you %s, giving you a total of %s",
+			a.formatAmountIn(currency, amount, true), a.formatNumber(dstBalances[dstAccountIDs[i]]),
+		).Mention(req.user.ID)
+		if reason != "" {
+			msg.Context("_%s_", reason)
+		}
+		if err := a.notifyOnce(dstUser.ID, notificationID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *app) cmdWithdraw(ctx context.Context, req commandReq) error {
+	if len(req.args) < 2 {
+		a.reply(req, helpMsg)
+		return nil
+	} else if strings.EqualFold(req.args[0], "confirm") {
+		return a.confirmWithdrawal(ctx, req, req.args[1])
+	}
+
+	amount, err := a.parseAmount(req.args[0])
+	if err != nil {
+		return err
+	}
+
+	// the currency can only come straight after the amount, since an address
+	// or memo might look like one.
+	currency := bank.DefaultCurrency
+	if c, ok := a.extraCurrency(req.args[1]); ok && len(req.args) > 2 {
+		currency = c
+		req.args = append(req.args[:1:1], req.args[2:]...)
+	}
+	ctx = mctx.Annotate(ctx, "currency", currency)
+
+	addr := req.args[1]
+	addr = slackUnFormatRegex.ReplaceAllString(addr, `${1}*${2}`)
+
+	var memo string
+	if len(req.args) == 3 {
+		memo = req.args[2]
+	}
+
+	// withdrawals made anywhere but a DM have to be confirmed in one first.
+	if !req.channel.IsIM {
+		return a.requestWithdrawalConfirmation(ctx, req, addr, memo, currency, amount)
+	}
+	return a.withdraw(ctx, req, req.idempotencyKey("withdraw"), addr, memo, currency, amount)
+}
+
+// withdraw withdraws the amount from the user who sent the command, delaying
+// it or holding it for review first if need be. idempotencyKey is of the
+// command which the withdrawal was asked for in, which isn't necessarily
+// req's, see confirmWithdrawal.
+func (a *app) withdraw(ctx context.Context, req commandReq, idempotencyKey, addr, memo, currency string, amount int) error {
+	review, err := a.suspiciousWithdrawal(req.accountID, currency, time.Now())
+	if err != nil {
+		return err
+	} else if review != "" || a.shouldDelayWithdrawal(amount) {
+		return a.cmdWithdrawDelayed(ctx, req, idempotencyKey, addr, memo, currency, amount, review)
+	}
+
+	if _, err := a.economy.WithdrawOnce(ctx, idempotencyKey, req.accountID, addr, memo, currency, amount); errors.Is(err, stellar.ErrNoTrustline) {
+		if err := a.dmTrustline(ctx, req.user.ID, addr, currency); err != nil {
+			return err
+		}
+		a.reply(req, "your stellar account doesn't trust %s yet, I've DM'd you how to fix that :point_right:", a.currencyStringIn(currency, 2, true))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	msg := slackbot.NewMessage("you withdrew %s :money_with_wings: :money_with_wings:", a.formatAmountIn(currency, amount, true)).
+		Fields("To", "`"+addr+"`", "Memo", memoOrNone(memo))
+	if paused := a.exportBudget.pausedFor(); paused > 0 {
+		msg.Context("Stellar is having a rough time, so withdrawals are paused for about %s. Yours is queued, and you'll get a DM once it's gone through", paused.Round(time.Minute))
+	} else {
+		msg.Context("You'll get a DM when the transaction has been successfully submitted to the network")
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
+
+// cmdFaucet funds a stellar address with testnet XLM from friendbot, so that
+// it can be given a trustline and withdrawn to.
+func (a *app) cmdFaucet(ctx context.Context, req commandReq) error {
+	if !a.testNet {
+		a.reply(req, "the faucet only works on testnet, you'll have to get your XLM the old fashioned way")
+		return nil
+	} else if len(req.args) < 1 {
+		a.reply(req, "usage: `faucet <stellar address>`")
+		return nil
+	}
+
+	addr := req.args[0]
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, addr); err != nil {
+		a.reply(req, "`%s` isn't a stellar address, it should look like `G...`", addr)
+		return nil
+	}
+
+	ctx = mctx.Annotate(ctx, "addr", addr)
+	mlog.From(a.cmp).Info("funding address from faucet", ctx)
+	stellarCtx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	defer cancel()
+	res, err := a.stellar.client.Fund(stellarCtx, addr)
+	if err != nil {
+		mlog.From(a.cmp).Warn("funding address from faucet failed", ctx, merr.Context(err))
+		a.replyMsg(req, slackbot.NewMessage("friendbot wouldn't fund `%s` :confused:", addr).
+			Context("It only funds accounts which don't exist yet. Error: %s", err))
+		return nil
+	}
+
+	a.replyMsg(req, slackbot.NewMessage("`%s` has been funded with some testnet XLM :droplet: add a trustline for `%s` and you're ready to withdraw", addr, a.currencyName).
+		Button("view_tx", "View transaction", res.Links.Transaction.Href))
+	return nil
+}
+
+func (a *app) cmdMint(ctx context.Context, req commandReq) error {
+	currency := bank.DefaultCurrency
+	if len(req.args) > 2 {
+		if c, ok := a.extraCurrency(req.args[1]); ok {
+			currency = c
+			req.args = append(req.args[:1:1], req.args[2:]...)
+		}
+	}
+
+	if len(req.args) < 2 {
+		a.reply(req, "usage: `mint <amount> [<currency>] @<user>`")
+		return nil
+	}
+
+	amount, err := a.parseAmount(req.args[0])
+	if err != nil {
+		return err
+	}
+
+	dstAccountID, err := a.accountIDByUserID(req.args[1])
+	if err != nil {
+		return err
+	}
+	return a.doAdminActionOrRequestApproval(ctx, req, pendingAdminAction{
+		Kind:         adminActionMint,
+		Amount:       amount,
+		Currency:     currency,
+		DstAccountID: dstAccountID,
+	})
+}
+
+func (a *app) cmdBuyback(ctx context.Context, req commandReq) error {
+	if len(req.args) < 2 {
+		a.reply(req, "usage: `buyback <amount> <max XLM price per %s>`", a.currencyString(1, false))
+		return nil
+	}
+
+	amount, err := a.parseAmount(req.args[0])
+	if err != nil {
+		return err
+	}
+
+	maxPrice, err := strconv.ParseFloat(req.args[1], 64)
+	if err != nil {
+		return err
+	} else if maxPrice <= 0 {
+		return inputErrorf("max price must be greater than 0")
+	}
+
+	return a.doAdminActionOrRequestApproval(ctx, req, pendingAdminAction{
+		Kind:     adminActionBuyback,
+		Amount:   amount,
+		MaxPrice: maxPrice,
+	})
+}
+
+func (a *app) cmdReplay(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		a.reply(req, "usage: `replay <duration, e.g. 2h>`")
+		return nil
+	}
+
+	d, err := time.ParseDuration(req.args[0])
+	if err != nil {
+		return err
+	} else if d <= 0 {
+		return inputErrorf("duration must be greater than 0")
+	}
+	since := time.Now().Add(-d)
+	ctx = mctx.Annotate(ctx, "since", since)
+
+	if err := a.bank.ReplayEarns(since); err != nil {
+		return err
+	}
+	a.audit(ctx, "replayed earns")
+
+	a.reply(req, "replaying all earnings since %s :rewind:", since.Format(time.RFC1123))
+	return nil
+}
+
+// cmdWhois shows which user, if any, deposits to a federation address would be
+// credited to. It's admin only because the federation server purposefully
+// doesn't reveal which users exist.
+func (a *app) cmdWhois(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		a.reply(req, "usage: `whois <username>*%s`", a.stellar.domain)
+		return nil
+	}
+
+	addr := slackUnFormatRegex.ReplaceAllString(strings.Trim(req.args[0], "`"), `${1}*${2}`)
+	if i := strings.Index(addr, "*"); i >= 0 && addr[i+1:] != a.stellar.domain {
+		a.reply(req, "`%s` isn't on my domain, deposits have to be sent to `<username>*%s`", addr, a.stellar.domain)
+		return nil
+	}
+
+	userName := a.federationUserName(addr)
+	ctx = mctx.Annotate(ctx, "userName", userName)
+	mlog.From(a.cmp).Info("looking up federation address", ctx)
+
+	user, err := a.slack.GetUserByName(userName)
+	if err != nil {
+		a.reply(req, "nobody goes by `%s` here, deposits to it won't be credited to anyone. usernames are case sensitive, and are what you @ someone with, not their display name", userName)
+		return nil
+	}
+
+	msg := slackbot.NewMessage("`%s*%s` belongs to <@%s>", userName, a.stellar.domain, user.ID)
+	accountID, err := a.accountID(user)
+	if err != nil {
+		msg.Context("but they can't receive deposits: %s", err)
+	} else if user.Deleted {
+		msg.Context("but their slack account has been deleted")
+	} else {
+		msg.Fields("Account", "`"+accountID+"`")
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
+
+// accountsPageSize is roughly how many accounts the accounts command lists at
+// a time.
+const accountsPageSize = 20
+
+func (a *app) cmdAccounts(ctx context.Context, req commandReq) error {
+	var cursor string
+	if len(req.args) > 0 {
+		cursor = req.args[0]
+	}
+
+	accounts, nextCursor, err := a.bank.ListAccounts(cursor, accountsPageSize)
+	if err != nil {
+		return err
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Balance > accounts[j].Balance
+	})
+
+	// aliases are shown alongside mentions, since mentions of users who have
+	// left the workspace don't show who they were.
+	aliases, err := a.bank.AllMeta(bank.AliasMetaKey)
+	if err != nil {
+		return err
+	}
+
+	strb := new(strings.Builder)
+	for _, account := range accounts {
+		fmt.Fprintf(strb, "<@%s> `%s`", userIDFromAccountID(account.UserID), account.UserID)
+		if alias := lookupAlias(aliases, account.UserID); alias != "" {
+			fmt.Fprintf(strb, " (%s)", alias)
+		}
+		fmt.Fprintf(strb, ": %s\n", a.formatNumber(account.Balance))
+	}
+	if len(accounts) == 0 {
+		strb.WriteString("no accounts in this page\n")
+	}
+
+	msg := slackbot.NewMessage("%s", strb.String())
+	if nextCursor != "" {
+		msg.Context("There's more, use `accounts %s` to see the next page", nextCursor)
+	} else {
+		msg.Context("That's all of them")
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
+
+func (a *app) cmdReconcile(ctx context.Context, req commandReq) error {
+	rec, err := bank.Reconcile(a.bank)
+	if err != nil {
+		return err
+	}
+	ctx = mctx.Annotate(ctx,
+		"numEntries", rec.NumEntries,
+		"numDiscrepancies", len(rec.Discrepancies))
+	a.audit(ctx, "reconciled ledger")
+
+	strb := new(strings.Builder)
+	for _, d := range rec.Discrepancies {
+		fmt.Fprintf(strb, "<@%s> `%s`: balance is %s, journal says %s\n",
+			userIDFromAccountID(d.UserID), d.UserID,
+			a.formatNumber(d.Balance),
+			a.formatNumber(d.JournalBalance))
+	}
+	if len(rec.Discrepancies) == 0 {
+		strb.WriteString("every balance matches the ledger :ledger:\n")
+	}
+
+	msg := slackbot.NewMessage("%s", strb.String()).Context(
+		"Replayed %s journal entries. Issued %s, exported %s.",
+		formatInt(rec.NumEntries, a.currency.thousandsSep),
+		a.formatNumber(-rec.LedgerBalances[bank.LedgerAccountIssuance]-rec.LedgerBalances[bank.LedgerAccountOpening]),
+		a.formatNumber(rec.LedgerBalances[bank.LedgerAccountExports]),
+	)
+	if len(rec.Discrepancies) > 0 {
+		msg.Context("Balances which changed while reconciling show up here too, so run it again to confirm")
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
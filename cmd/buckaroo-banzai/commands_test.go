@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestCmdGive(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		slackClient:  &slackbot.Client{BotTeamID: "T1"},
+		currencyName: "BUCK",
+	}
+	a.economy = economy.New(cmp, economy.Opts{Bank: a.bank})
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser(mrand.Hex(8), "a", "T1")
+		userB := fs.AddUser(mrand.Hex(8), "b", "T1")
+		channel := fs.AddChannel("C1", false)
+
+		_, err := a.bank.Incr(userA.ID, 5)
+		massert.Require(t, massert.Nil(err))
+
+		req := commandReq{
+			channelID: channel.ID,
+			channel:   channel,
+			user:      userA,
+			accountID: userA.ID,
+			args:      []string{"2", "<@" + userB.ID + ">"},
+		}
+		err = a.cmdGive(context.Background(), req)
+
+		balanceA, errA := a.bank.Balance(userA.ID)
+		balanceB, errB := a.bank.Balance(userB.ID)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Nil(errA),
+			massert.Nil(errB),
+			massert.Equal(3, balanceA),
+			massert.Equal(2, balanceB),
+			massert.Equal([]slackbottest.Msg{
+				{ChannelID: "C1", Text: "<@" + userA.ID + "> you gave <@" + userB.ID + "> 2 BUCKs :money_with_wings:"},
+				{ChannelID: "IM-" + userB.ID, Text: "<@" + userA.ID + "> gave you 2 BUCKs, giving you a total of 2"},
+			}, fs.Flush()),
+		)
+
+		// the old argument order works too
+		req.args = []string{"<@" + userB.ID + ">", "1"}
+		err = a.cmdGive(context.Background(), req)
+		balanceA, _ = a.bank.Balance(userA.ID)
+		balanceB, _ = a.bank.Balance(userB.ID)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(2, balanceA),
+			massert.Equal(3, balanceB),
+			massert.Equal(2, len(fs.Flush())),
+		)
+
+		// if neither argument is an amount then say so, rather than being
+		// unhelpful
+		req.args = []string{"<@" + userB.ID + ">", "lots"}
+		err = a.cmdGive(context.Background(), req)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal([]slackbottest.Msg{
+				{ChannelID: "C1", Text: "<@" + userA.ID + "> neither `<@" + userB.ID + ">` nor `lots` is an amount. " + giveUsage},
+			}, fs.Flush()),
+		)
+
+		// giving more than you have should fail without moving anything
+		req.args = []string{"4", "<@" + userB.ID + ">"}
+		err = a.cmdGive(context.Background(), req)
+		balanceA, _ = a.bank.Balance(userA.ID)
+		massert.Require(t,
+			massert.Equal(true, errors.Is(err, bank.ErrNotEnoughFunds)),
+			massert.Equal(2, balanceA),
+			massert.Equal(0, len(fs.Flush())),
+		)
+
+		req.args = []string{"1", "<@" + userA.ID + ">"}
+		massert.Require(t,
+			massert.Nil(a.cmdGive(context.Background(), req)),
+			massert.Equal([]slackbottest.Msg{
+				{ChannelID: "C1", Text: "<@" + userA.ID + "> quit playing with yourself, kid"},
+			}, fs.Flush()),
+		)
+
+		// several users can be given to at once, with anything after them
+		// being the reason, and either all of them are given to or none are.
+		userC := fs.AddUser(mrand.Hex(8), "c", "T1")
+		req.args = []string{"2", "<@" + userB.ID + ">", "<@" + userC.ID + ">"}
+		err = a.cmdGive(context.Background(), req)
+		massert.Require(t,
+			massert.Equal(true, errors.Is(err, bank.ErrNotEnoughFunds)),
+			massert.Equal(0, len(fs.Flush())),
+		)
+
+		req.args = []string{"1", "<@" + userB.ID + ">", "<@" + userC.ID + ">", "thanks!"}
+		err = a.cmdGive(context.Background(), req)
+		balanceA, _ = a.bank.Balance(userA.ID)
+		balanceB, _ = a.bank.Balance(userB.ID)
+		balanceC, _ := a.bank.Balance(userC.ID)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(0, balanceA),
+			massert.Equal(4, balanceB),
+			massert.Equal(1, balanceC),
+			massert.Equal([]slackbottest.Msg{
+				{ChannelID: "C1", Text: "<@" + userA.ID + "> you gave <@" + userB.ID + "> and <@" + userC.ID + "> 1 BUCK each :money_with_wings:"},
+				{ChannelID: "IM-" + userB.ID, Text: "<@" + userA.ID + "> gave you 1 BUCK, giving you a total of 4"},
+				{ChannelID: "IM-" + userC.ID, Text: "<@" + userA.ID + "> gave you 1 BUCK, giving you a total of 1"},
+			}, fs.Flush()),
+		)
+		history, _, err := a.bank.History(userC.ID, "", 1)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(history, 1),
+			massert.Equal("thanks!", history[0].Reason),
+		)
+
+		// a message which is delivered more than once only gives once.
+		_, err = a.bank.Incr(userA.ID, 2)
+		massert.Require(t, massert.Nil(err))
+		req.messageTS = "1.1"
+		req.args = []string{"1", "<@" + userB.ID + ">"}
+		massert.Require(t, massert.Nil(a.cmdGive(context.Background(), req)))
+		fs.Flush()
+		err = a.cmdGive(context.Background(), req)
+		balanceA, _ = a.bank.Balance(userA.ID)
+		balanceB, _ = a.bank.Balance(userB.ID)
+		massert.Require(t,
+			massert.Equal(true, errors.Is(err, bank.ErrDuplicate)),
+			massert.Equal(1, balanceA),
+			massert.Equal(5, balanceB),
+			massert.Equal(0, len(fs.Flush())),
+		)
+	})
+}
+
+func TestCmdBalanceOf(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		slackClient:  &slackbot.Client{BotTeamID: "T1"},
+		currencyName: "BUCK",
+	}
+	a.economy = economy.New(cmp, economy.Opts{Bank: a.bank})
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser(mrand.Hex(8), "a", "T1")
+		userB := fs.AddUser(mrand.Hex(8), "b", "T1")
+		channel := fs.AddChannel("C1", true)
+
+		_, err := a.bank.Incr(userB.ID, 3)
+		massert.Require(t, massert.Nil(err))
+
+		reqFor := func(user *slack.User, r role, args ...string) commandReq {
+			return commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      user,
+				accountID: user.ID,
+				role:      r,
+				args:      args,
+			}
+		}
+		assertBalanceOf := func(r role, exp string) {
+			err := a.cmdBalance(context.Background(), reqFor(userA, r, "<@"+userB.ID+">"))
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal([]slackbottest.Msg{{ChannelID: "C1", Text: exp}}, fs.Flush()),
+			)
+		}
+		private := "<@" + userB.ID + "> keeps their balance private :zipper_mouth_face:"
+		public := "<@" + userB.ID + "> has 3 BUCKs"
+
+		// private by default, except to admins
+		assertBalanceOf(roleUser, private)
+		assertBalanceOf(roleAdmin, public)
+
+		massert.Require(t, massert.Nil(a.cmdPrivacy(context.Background(), reqFor(userB, roleUser, "friends"))))
+		fs.Flush()
+		assertBalanceOf(roleUser, private)
+
+		massert.Require(t, massert.Nil(a.cmdFriend(context.Background(), reqFor(userB, roleUser, "<@"+userA.ID+">"))))
+		fs.Flush()
+		assertBalanceOf(roleUser, public)
+
+		massert.Require(t, massert.Nil(a.cmdUnfriend(context.Background(), reqFor(userB, roleUser, "<@"+userA.ID+">"))))
+		fs.Flush()
+		assertBalanceOf(roleUser, private)
+
+		massert.Require(t, massert.Nil(a.cmdPrivacy(context.Background(), reqFor(userB, roleUser, "public"))))
+		fs.Flush()
+		assertBalanceOf(roleUser, public)
+	})
+}
+
+func TestCmdWhois(t *T) {
+	fs := slackbottest.New()
+	a := &app{
+		cmp:         mtest.Component(),
+		slack:       fs,
+		slackClient: &slackbot.Client{BotTeamID: "T1"},
+		stellar:     &stellarServer{domain: "example.com"},
+	}
+	user := fs.AddUser("U1", "alice", "T1")
+	channel := fs.AddChannel("C1", true)
+
+	whois := func(addr string) []slackbottest.Msg {
+		err := a.cmdWhois(context.Background(), commandReq{
+			channelID: channel.ID,
+			channel:   channel,
+			user:      user,
+			accountID: user.ID,
+			args:      []string{addr},
+		})
+		massert.Require(t, massert.Nil(err))
+		return fs.Flush()
+	}
+
+	massert.Require(t,
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "`alice*example.com` belongs to <@U1>"},
+		}, whois("alice*<http://example.com|example.com>")),
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "`alice*example.com` belongs to <@U1>"},
+		}, whois("alice")),
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "`alice*other.com` isn't on my domain, deposits have to be sent to `<username>*example.com`"},
+		}, whois("alice*other.com")),
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "nobody goes by `Alice` here, deposits to it won't be credited to anyone. usernames are case sensitive, and are what you @ someone with, not their display name"},
+		}, whois("Alice*example.com")),
+	)
+}
+
+func TestCmdFaucet(t *T) {
+	const addr = "GAAZI4TCR3TY5OJHCTJC2A4QSY6CJWJH5IAJTGKIN2ER7LBNVKOCCWN7"
+	var funded []string
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          mtest.Component(),
+		slack:        fs,
+		slackClient:  &slackbot.Client{BotTeamID: "T1"},
+		currencyName: "BUCK",
+		stellar: &stellarServer{
+			timeout: time.Second,
+			client: &stellartest.Mock{
+				FundFn: func(_ context.Context, addr string) (stellar.TransactionResult, error) {
+					funded = append(funded, addr)
+					return stellar.TransactionResult{}, nil
+				},
+			},
+		},
+	}
+	user := fs.AddUser("U1", "alice", "T1")
+	channel := fs.AddChannel("C1", true)
+
+	faucet := func(args ...string) []slackbottest.Msg {
+		err := a.cmdFaucet(context.Background(), commandReq{
+			channelID: channel.ID,
+			channel:   channel,
+			user:      user,
+			accountID: user.ID,
+			args:      args,
+		})
+		massert.Require(t, massert.Nil(err))
+		return fs.Flush()
+	}
+
+	massert.Require(t,
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "the faucet only works on testnet, you'll have to get your XLM the old fashioned way"},
+		}, faucet(addr)),
+		massert.Length(funded, 0),
+	)
+
+	a.testNet = true
+	massert.Require(t,
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "`nope` isn't a stellar address, it should look like `G...`"},
+		}, faucet("nope")),
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "C1", Text: "`" + addr + "` has been funded with some testnet XLM :droplet: add a trustline for `BUCK` and you're ready to withdraw"},
+		}, faucet(addr)),
+		massert.Equal([]string{addr}, funded),
+	)
+}
+
+func TestNotifyUndelivered(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:     cmp,
+		slack:   fs,
+		dmRetry: slackbot.NewDMRetry(cmp, fs, time.Hour, 3),
+	}
+	user := fs.AddUser("U1", "alice", "T1")
+	channel := fs.AddChannel("C1", false)
+	req := commandReq{channelID: channel.ID, channel: channel, user: user, accountID: user.ID}
+
+	fs.FailSends("IM-U1", errors.New("ratelimited"))
+	massert.Require(t, massert.Nil(a.notify(user.ID, slackbot.NewMessage("you got bucks"))))
+
+	// flushing makes one last attempt, which fails, so it's given up on.
+	a.dmRetry.Flush()
+	massert.Require(t, massert.Length(fs.Flush(), 0))
+
+	a.replyUndelivered(req)
+	a.replyUndelivered(req)
+	massert.Require(t, massert.Equal([]slackbottest.Msg{
+		{ChannelID: "C1", Text: "<@U1> you got bucks"},
+	}, fs.Flush()))
+}
+
+func TestSuggestCommand(t *T) {
+	assertSuggest := func(name string, r role, exp string) massert.Assertion {
+		suggestion, ok := suggestCommand(name, r)
+		return massert.Comment(massert.All(
+			massert.Equal(exp != "", ok),
+			massert.Equal(exp, suggestion),
+		), "name:%q", name)
+	}
+
+	massert.Require(t,
+		assertSuggest("withdrew", roleUser, "withdraw"),
+		assertSuggest("balanse", roleUser, "balance"),
+		assertSuggest("hlep", roleUser, "help"),
+		assertSuggest("gvie", roleUser, "give"),
+		assertSuggest("sandwich", roleUser, ""),
+		assertSuggest("x", roleUser, ""),
+
+		// only commands the user can use are suggested
+		assertSuggest("mnt", roleUser, ""),
+		assertSuggest("mnt", roleAdmin, "mint"),
+	)
+}
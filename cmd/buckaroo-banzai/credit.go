@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+const apiCreditPath = "/api/v1/credit"
+
+// creditQuotaTTL is how long the bank keeps each API key's daily credit quota
+// for, which only needs to be past the end of the day it's for.
+const creditQuotaTTL = 48 * time.Hour
+
+// creditReq is the body of a request to the credit API. If From is set then the
+// amount is transferred from that user, otherwise it's minted. Users are given
+// as slack user IDs.
+type creditReq struct {
+	User   string `json:"user"`
+	From   string `json:"from"`
+	Amount int    `json:"amount"`
+
+	// Reason is shown to the user in the DM telling them about the credit.
+	Reason string `json:"reason"`
+}
+
+// creditRes is the body of a successful response from the credit API.
+type creditRes struct {
+	User    string `json:"user"`
+	Amount  int    `json:"amount"`
+	Balance int    `json:"balance"`
+	Minted  bool   `json:"minted"`
+}
+
+// creditQuota returns the most which can be credited using the API key each
+// day, in the bank's units.
+func (a *app) creditQuota(k apiKey) int {
+	if k.CreditQuota > 0 {
+		return k.CreditQuota
+	}
+	return a.apiCreditQuota * a.currency.unit()
+}
+
+// apiCreditHandler lets other systems (a bot rewarding merged PRs, CI rewarding
+// green builds, etc...) credit users, either by minting or by transferring
+// from another user. Minting requires the write:mint scope, and transferring
+// the write:transfers scope. A key can only transfer out of its funding
+// account, so that it can't be used to take anyone else's balance.
+//
+// Every request must have an Idempotency-Key header, which the credit is made
+// with in the bank, so that a retry of a request which went through is
+// answered as a replay rather than crediting again. The most each API key can
+// credit each day (UTC) is limited by its quota, which is used up in the bank
+// before crediting, and given back if the credit doesn't go through. Both are
+// atomic in the bank, so requests can be sent to any buckaroo instance. A
+// retry which would take the quota over is refused like any other request,
+// even if the original went through.
+func (a *app) apiCreditHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(rw, http.StatusMethodNotAllowed, "method must be POST")
+		return
+	}
+
+	k := apiKeyFromContext(r.Context())
+	idemKey := r.Header.Get("Idempotency-Key")
+	if idemKey == "" {
+		apiError(rw, http.StatusBadRequest, "missing Idempotency-Key header")
+		return
+	}
+
+	var req creditReq
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<16)).Decode(&req); err != nil {
+		apiError(rw, http.StatusBadRequest, fmt.Sprintf("decoding request body: %s", err))
+		return
+	} else if req.User == "" {
+		apiError(rw, http.StatusBadRequest, "user is required")
+		return
+	} else if req.Amount <= 0 {
+		apiError(rw, http.StatusBadRequest, "amount must be greater than 0")
+		return
+	} else if req.From == "" && !k.hasScope(scopeWriteMint) {
+		apiError(rw, http.StatusForbidden, fmt.Sprintf("minting requires the %q scope", scopeWriteMint))
+		return
+	} else if req.From != "" && !k.hasScope(scopeWriteTransfers) {
+		apiError(rw, http.StatusForbidden, fmt.Sprintf("transferring requires the %q scope", scopeWriteTransfers))
+		return
+	}
+
+	ctx := mctx.Annotate(r.Context(),
+		"idempotencyKey", idemKey, "user", req.User, "from", req.From, "amount", req.Amount)
+	internalErr := func(err error) {
+		mlog.From(a.cmp).Error("error handling credit API request", ctx, merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+	}
+
+	// users are looked up before anything is written, since a request for a
+	// user who doesn't exist will never succeed anyway.
+	accountID, err := a.accountIDByUserID(req.User)
+	if errors.Is(err, slackbot.ErrUserNotFound) || errors.Is(err, errForeignTeam) {
+		apiError(rw, http.StatusNotFound, fmt.Sprintf("user %q: %s", req.User, err))
+		return
+	} else if err != nil {
+		internalErr(err)
+		return
+	}
+	var fromAccountID string
+	if req.From != "" {
+		fromAccountID, err = a.accountIDByUserID(req.From)
+		if errors.Is(err, slackbot.ErrUserNotFound) || errors.Is(err, errForeignTeam) {
+			apiError(rw, http.StatusNotFound, fmt.Sprintf("from user %q: %s", req.From, err))
+			return
+		} else if err != nil {
+			internalErr(err)
+			return
+		} else if fromAccountID != k.FundingAccountID {
+			mlog.From(a.cmp).Warn("API key used to transfer from an account other than its funding account", ctx)
+			apiError(rw, http.StatusForbidden, fmt.Sprintf("this API key can't transfer from %q", req.From))
+			return
+		}
+	}
+
+	quotaKey := "apiCredit:" + k.ID + ":" + time.Now().UTC().Format("2006-01-02")
+	quota := a.creditQuota(k)
+	used, err := a.bank.UseQuota(quotaKey, req.Amount, quota, creditQuotaTTL)
+	if errors.Is(err, bank.ErrQuotaExceeded) {
+		apiError(rw, http.StatusTooManyRequests, fmt.Sprintf("this would take today's credits over the quota of %d", quota))
+		return
+	} else if err != nil {
+		internalErr(err)
+		return
+	}
+	ctx = mctx.Annotate(ctx, "quotaUsed", used)
+
+	reqKey := k.ID + ":" + idemKey
+	var balance int
+	if fromAccountID == "" {
+		balance, err = a.bank.IncrOnce("credit:"+reqKey, accountID, req.Amount, bank.JournalSourceMint)
+	} else {
+		balance, err = a.economy.GiveOnce(ctx, "credit:"+reqKey, fromAccountID, accountID, bank.DefaultCurrency, req.Amount, req.Reason)
+	}
+
+	if err != nil {
+		// nothing was credited, so nothing of the quota was used either. If
+		// giving it back fails then the key can credit that much less today,
+		// which is the safe way to be wrong.
+		if _, quotaErr := a.bank.UseQuota(quotaKey, -req.Amount, quota, creditQuotaTTL); quotaErr != nil {
+			mlog.From(a.cmp).Error("error giving back credit API quota", ctx, merr.Context(quotaErr))
+		}
+	}
+
+	res := creditRes{User: req.User, Amount: req.Amount, Balance: balance, Minted: fromAccountID == ""}
+	switch {
+	case errors.Is(err, bank.ErrDuplicate):
+		// the request already went through, so this is a retry of it.
+		mlog.From(a.cmp).Info("replaying credit API request", ctx)
+		if res.Balance, err = a.bank.Balance(accountID); err != nil {
+			internalErr(err)
+			return
+		}
+		rw.Header().Set("Idempotent-Replayed", "true")
+	case errors.Is(err, bank.ErrNotEnoughFunds), errors.Is(err, economy.ErrGiveToSelf):
+		apiError(rw, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		internalErr(err)
+		return
+	case fromAccountID == "":
+		a.audit(ctx, "minted currency via API")
+		a.notifyCredit(k, reqKey, req, balance)
+	default:
+		mlog.From(a.cmp).Info("transferred currency via API", ctx)
+		a.notifyCredit(k, reqKey, req, balance)
+	}
+
+	body, _ := json.Marshal(res)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
+
+// notifyCredit tells the user that they were credited through the API.
+// reqKey identifies the request, and balance is the user's balance after
+// it.
+func (a *app) notifyCredit(k apiKey, reqKey string, req creditReq, balance int) {
+	var msg *slackbot.Message
+	if req.From == "" {
+		msg = slackbot.NewMessage("%s gave you %s :tada:", k.Name, a.formatAmount(req.Amount, true))
+	} else {
+		msg = slackbot.NewMessage("%s sent you %s from <@%s> :tada:", k.Name, a.formatAmount(req.Amount, true), req.From)
+	}
+	fields := []string{"Balance", a.formatAmount(balance, true)}
+	if req.Reason != "" {
+		fields = append([]string{"Reason", req.Reason}, fields...)
+	}
+	msg.Fields(fields...)
+	if err := a.notifyOnce(req.User, "credit:"+reqKey, msg); err != nil {
+		mlog.From(a.cmp).Warn("could not tell user about credit",
+			mctx.Annotate(a.cmp.Context(), "user", req.User), merr.Context(err))
+	}
+}
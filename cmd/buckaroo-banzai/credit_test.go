@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestAPICredit(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:            cmp,
+		bank:           bank.NewInMem(),
+		slack:          fs,
+		slackClient:    &slackbot.Client{BotTeamID: "T1"},
+		currencyName:   "BUCK",
+		apiCreditQuota: 10,
+	}
+	a.economy = economy.New(cmp, economy.Opts{Bank: a.bank})
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser(mrand.Hex(8), "a", "T1")
+		userB := fs.AddUser(mrand.Hex(8), "b", "T1")
+		_, err := a.bank.Incr(userB.ID, 5)
+		massert.Require(t, massert.Nil(err))
+
+		ctx := context.Background()
+		_, minter, err := a.createAPIKey(ctx, "ci", []string{scopeWriteMint}, 0, "UADMIN")
+		massert.Require(t, massert.Nil(err))
+		_, transferer, err := a.createAPIKey(ctx, "github", []string{scopeWriteTransfers}, 3, userB.ID)
+		massert.Require(t, massert.Nil(err))
+
+		h := a.requireAnyScope([]string{scopeWriteMint, scopeWriteTransfers}, http.HandlerFunc(a.apiCreditHandler))
+		post := func(key, idemKey, body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", apiCreditPath, strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+key)
+			r.Header.Set("Idempotency-Key", idemKey)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, r)
+			return rw
+		}
+		balanceOf := func(userID string) int {
+			balance, err := a.bank.Balance(userID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+
+		mint := `{"user":"` + userA.ID + `","amount":4,"reason":"green build"}`
+		rw := post(minter, "1", mint)
+		massert.Require(t,
+			massert.Equal(http.StatusOK, rw.Code),
+			massert.Equal(`{"user":"`+userA.ID+`","amount":4,"balance":4,"minted":true}`, rw.Body.String()),
+			massert.Equal(4, balanceOf(userA.ID)),
+			massert.Equal([]slackbottest.Msg{
+				{ChannelID: "IM-" + userA.ID, Text: "ci gave you 4 BUCKs :tada:"},
+			}, fs.Flush()),
+		)
+
+		// retrying gets the same response, without minting again.
+		rw = post(minter, "1", mint)
+		massert.Require(t,
+			massert.Equal(http.StatusOK, rw.Code),
+			massert.Equal("true", rw.Header().Get("Idempotent-Replayed")),
+			massert.Equal(4, balanceOf(userA.ID)),
+			massert.Length(fs.Flush(), 0),
+		)
+
+		// the default quota is 10 a day.
+		massert.Require(t,
+			massert.Equal(http.StatusOK, post(minter, "2", mint).Code),
+			massert.Equal(http.StatusTooManyRequests, post(minter, "3", mint).Code),
+			massert.Equal(8, balanceOf(userA.ID)),
+		)
+
+		// the github key can only transfer, only from userB who created it,
+		// and only 3 a day. Transfers which don't go through don't count
+		// towards it.
+		userC := fs.AddUser(mrand.Hex(8), "c", "T1")
+		_, err = a.bank.Incr(userC.ID, 5)
+		massert.Require(t, massert.Nil(err))
+		transfer := `{"user":"` + userA.ID + `","from":"` + userB.ID + `","amount":2}`
+		massert.Require(t,
+			massert.Equal(http.StatusForbidden, post(transferer, "1", mint).Code),
+			massert.Equal(http.StatusOK, post(transferer, "2", transfer).Code),
+			massert.Equal(http.StatusForbidden, post(transferer, "3", `{"user":"`+userA.ID+`","from":"`+userC.ID+`","amount":1}`).Code),
+			massert.Equal(5, balanceOf(userC.ID)),
+			massert.Equal(http.StatusUnprocessableEntity, post(transferer, "3", `{"user":"`+userB.ID+`","from":"`+userB.ID+`","amount":1}`).Code),
+			massert.Equal(http.StatusTooManyRequests, post(transferer, "4", transfer).Code),
+			massert.Equal(http.StatusOK, post(transferer, "5", `{"user":"`+userA.ID+`","from":"`+userB.ID+`","amount":1}`).Code),
+			massert.Equal(11, balanceOf(userA.ID)),
+			massert.Equal(2, balanceOf(userB.ID)),
+		)
+
+		massert.Require(t,
+			massert.Equal(http.StatusBadRequest, post(minter, "", mint).Code),
+			massert.Equal(http.StatusNotFound, post(minter, "4", `{"user":"nobody","amount":1}`).Code),
+		)
+	})
+}
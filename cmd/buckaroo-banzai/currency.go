@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+
+	"buckaroo-banzai/bank"
+)
+
+// Where the currency's emoji goes when formatting an amount of it.
+const (
+	emojiPlacementReplace = "replace"
+	emojiPlacementBefore  = "before"
+	emojiPlacementAfter   = "after"
+)
+
+// currencyFormat describes how the currency is written in messages. Zero
+// values fall back to defaults based on the currency's name.
+type currencyFormat struct {
+	singular, plural string
+	thousandsSep     string
+	emojiPlacement   string
+
+	// how many decimal places amounts can have. Amounts in the bank are in
+	// units of the smallest of them, see bank.Unit.
+	decimals int
+}
+
+// unit returns how much one whole unit of the currency is in the bank.
+func (f currencyFormat) unit() int {
+	return bank.Unit(f.decimals)
+}
+
+// instCurrencyFormat declares the params for the currency's format on the given
+// component. The returned function must be called during init, after the
+// params have been populated.
+func instCurrencyFormat(cmp *mcmp.Component) func() (currencyFormat, error) {
+	singular := mcfg.String(cmp, "currency-singular",
+		mcfg.ParamUsage("How to write one of the currency in messages. Defaults to --currency-name."))
+	plural := mcfg.String(cmp, "currency-plural",
+		mcfg.ParamUsage("How to write more than one of the currency in messages, e.g. for currencies whose plural isn't just an \"s\" on the end. Defaults to --currency-singular with an \"s\" on the end."))
+	thousandsSep := mcfg.String(cmp, "currency-thousands-separator",
+		mcfg.ParamDefault(","),
+		mcfg.ParamUsage("Separator put between each group of three digits in large amounts, e.g. \"1,234\". Empty disables."))
+	emojiPlacement := mcfg.String(cmp, "currency-emoji-placement",
+		mcfg.ParamDefault(emojiPlacementReplace),
+		mcfg.ParamUsage("Where --currency-emoji goes in amounts. \""+emojiPlacementReplace+"\" uses it instead of the name (\"5 :buck:\"), \""+emojiPlacementBefore+"\" and \""+emojiPlacementAfter+"\" put it before or after the amount (\":buck: 5 BUCKs\", \"5 BUCKs :buck:\")."))
+	decimals := mcfg.Int(cmp, "currency-decimals",
+		mcfg.ParamUsage("How many decimal places amounts of the currency can have, at most 7 like stellar. Balances are kept in units of the smallest decimal place, so this can't be changed once the bank has balances in it."))
+
+	return func() (currencyFormat, error) {
+		switch *emojiPlacement {
+		case emojiPlacementReplace, emojiPlacementBefore, emojiPlacementAfter:
+		default:
+			return currencyFormat{}, fmt.Errorf("unknown --currency-emoji-placement %q", *emojiPlacement)
+		}
+		if *decimals < 0 || *decimals > bank.MaxDecimals {
+			return currencyFormat{}, fmt.Errorf("--currency-decimals must be between 0 and %d", bank.MaxDecimals)
+		}
+		return currencyFormat{
+			singular:       *singular,
+			plural:         *plural,
+			thousandsSep:   *thousandsSep,
+			emojiPlacement: *emojiPlacement,
+			decimals:       *decimals,
+		}, nil
+	}
+}
+
+// formatInt formats the integer with the given separator between each group of
+// three digits.
+func formatInt(i int, sep string) string {
+	return groupDigits(strconv.Itoa(i), sep)
+}
+
+// groupDigits puts the given separator between each group of three digits in
+// the given string of digits, which may start with a "-".
+func groupDigits(str, sep string) string {
+	if sep == "" {
+		return str
+	}
+
+	var sign string
+	if strings.HasPrefix(str, "-") {
+		sign, str = "-", str[1:]
+	}
+	for n := len(str) - 3; n > 0; n -= 3 {
+		str = str[:n] + sep + str[n:]
+	}
+	return sign + str
+}
+
+// formatNumber formats an amount of the currency from the bank as a number,
+// with the currency's thousands separator and decimal places, e.g. "1,234.5".
+// If the thousands separator is "." then the decimal mark is ",".
+func (a *app) formatNumber(amount int) string {
+	str := bank.FormatDecimal(amount, a.currency.decimals)
+	whole, frac := str, ""
+	if i := strings.Index(str, "."); i >= 0 {
+		whole, frac = str[:i], str[i+1:]
+	}
+
+	str = groupDigits(whole, a.currency.thousandsSep)
+	if frac != "" {
+		mark := "."
+		if a.currency.thousandsSep == "." {
+			mark = ","
+		}
+		str += mark + frac
+	}
+	return str
+}
+
+// currencyString returns the currency's name, formatted based on the amount
+// which is being described. -1 can be given if the amount is not known.
+//
+// If emojiOk is given and the app was configured with an emoji for the currency
+// which replaces its name, then that will be returned instead.
+func (a *app) currencyString(amount int, emojiOk bool) string {
+	singular := a.currency.singular
+	if singular == "" {
+		singular = a.currencyName
+	}
+	plural := a.currency.plural
+	if plural == "" {
+		plural = singular + "s"
+	}
+
+	placement := a.currency.emojiPlacement
+	if placement == "" {
+		placement = emojiPlacementReplace
+	}
+
+	if emoji := a.emoji(); emojiOk && emoji != "" && placement == emojiPlacementReplace {
+		return emoji
+	} else if amount == 1 || (amount == -1 && a.currency.plural != "") {
+		// if the plural was given explicitly then there's no way to write
+		// "(s)", so an unknown amount is treated as singular.
+		return singular
+	} else if amount == -1 {
+		return singular + "(s)"
+	}
+	return plural
+}
+
+// emoji returns the currency's emoji, or empty string if it doesn't have one.
+func (a *app) emoji() string {
+	a.settingsL.RLock()
+	defer a.settingsL.RUnlock()
+	return a.currencyEmoji
+}
+
+// formatAmount returns the given amount of the currency from the bank,
+// formatted according to the currency's format, e.g. "1,234 BUCKs". If emojiOk
+// is given then the currency's emoji will be included, if it has one.
+func (a *app) formatAmount(amount int, emojiOk bool) string {
+	// only exactly one whole unit is singular, e.g. "1.5 BUCKs".
+	n := 2
+	if unit := a.currency.unit(); amount == unit || amount == -unit {
+		n = 1
+	}
+	str := a.formatNumber(amount) + " " + a.currencyString(n, emojiOk)
+
+	emoji := a.emoji()
+	if !emojiOk || emoji == "" {
+		return str
+	}
+	switch a.currency.emojiPlacement {
+	case emojiPlacementBefore:
+		return emoji + " " + str
+	case emojiPlacementAfter:
+		return str + " " + emoji
+	}
+	return str
+}
+
+// currencyCodeRegex matches the codes which stellar allows for assets.
+var currencyCodeRegex = regexp.MustCompile(`^[A-Z][A-Z0-9]{0,11}$`)
+
+// parseExtraCurrencies parses a comma separated list of the codes of currencies
+// which are issued alongside the currency with the given name.
+func parseExtraCurrencies(str, currencyName string) ([]string, error) {
+	var currencies []string
+	seen := map[string]bool{currencyName: true}
+	for _, code := range strings.Split(str, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code == "" {
+			continue
+		} else if !currencyCodeRegex.MatchString(code) {
+			return nil, fmt.Errorf("extra currency %q must be a letter followed by up to 11 letters or digits", code)
+		} else if seen[code] {
+			return nil, fmt.Errorf("extra currency %q is given more than once", code)
+		}
+		seen[code] = true
+		currencies = append(currencies, code)
+	}
+	return currencies, nil
+}
+
+// extraCurrency returns the code of the extra currency which the given command
+// argument names, or false if it doesn't name one.
+func (a *app) extraCurrency(arg string) (string, bool) {
+	for _, currency := range a.extraCurrencies {
+		if strings.EqualFold(arg, currency) {
+			return currency, true
+		}
+	}
+	return "", false
+}
+
+// currencyStringIn is like currencyString, but for the given currency, which is
+// either bank.DefaultCurrency or one of the extra currencies. Extra currencies
+// don't have a format of their own, so are always written as their code.
+func (a *app) currencyStringIn(currency string, amount int, emojiOk bool) string {
+	if currency == bank.DefaultCurrency {
+		return a.currencyString(amount, emojiOk)
+	}
+	return currency
+}
+
+// formatAmountIn is like formatAmount, but for the given currency, see
+// currencyStringIn.
+func (a *app) formatAmountIn(currency string, amount int, emojiOk bool) string {
+	if currency == bank.DefaultCurrency {
+		return a.formatAmount(amount, emojiOk)
+	}
+	return a.formatNumber(amount) + " " + currency
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+)
+
+func TestFormatInt(t *T) {
+	massert.Require(t,
+		massert.Equal("0", formatInt(0, ",")),
+		massert.Equal("999", formatInt(999, ",")),
+		massert.Equal("1,000", formatInt(1000, ",")),
+		massert.Equal("1,234,567", formatInt(1234567, ",")),
+		massert.Equal("-12,345", formatInt(-12345, ",")),
+		massert.Equal("1.234", formatInt(1234, ".")),
+		massert.Equal("1234", formatInt(1234, "")),
+	)
+}
+
+func TestFormatAmount(t *T) {
+	a := &app{currencyName: "BUCK"}
+	massert.Require(t,
+		massert.Equal("1 BUCK", a.formatAmount(1, true)),
+		massert.Equal("0 BUCKs", a.formatAmount(0, true)),
+		massert.Equal("1234 BUCKs", a.formatAmount(1234, true)),
+	)
+
+	a.currency = currencyFormat{singular: "Peso", plural: "Pesos", thousandsSep: ","}
+	massert.Require(t,
+		massert.Equal("1 Peso", a.formatAmount(1, true)),
+		massert.Equal("1,234 Pesos", a.formatAmount(1234, true)),
+	)
+
+	a.currency = currencyFormat{singular: "cactus", plural: "cacti"}
+	a.currencyEmoji = ":cactus:"
+	massert.Require(t,
+		massert.Equal("2 :cactus:", a.formatAmount(2, true)),
+		massert.Equal("2 cacti", a.formatAmount(2, false)),
+	)
+
+	a.currency.emojiPlacement = emojiPlacementBefore
+	massert.Require(t, massert.Equal(":cactus: 2 cacti", a.formatAmount(2, true)))
+	a.currency.emojiPlacement = emojiPlacementAfter
+	massert.Require(t,
+		massert.Equal("1 cactus :cactus:", a.formatAmount(1, true)),
+		massert.Equal("1 cactus", a.formatAmount(1, false)),
+	)
+}
+
+func TestParseExtraCurrencies(t *T) {
+	currencies, err := parseExtraCurrencies(" season, Gold2 ,", "BUCK")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal([]string{"SEASON", "GOLD2"}, currencies),
+	)
+
+	for _, str := range []string{"BUCK", "A,a", "2X", "WAYTOOLONGCODE", "NO-DASH"} {
+		_, err := parseExtraCurrencies(str, "BUCK")
+		massert.Require(t, massert.Equal(true, err != nil))
+	}
+
+	a := &app{currencyName: "BUCK", extraCurrencies: currencies}
+	currency, ok := a.extraCurrency("Season")
+	massert.Require(t,
+		massert.Equal("SEASON", currency),
+		massert.Equal(true, ok),
+		massert.Equal("3 SEASON", a.formatAmountIn(currency, 3, true)),
+		massert.Equal("3 BUCKs", a.formatAmountIn(bank.DefaultCurrency, 3, true)),
+	)
+	_, ok = a.extraCurrency("BUCK")
+	massert.Require(t, massert.Equal(false, ok))
+}
+
+func TestDecimalAmounts(t *T) {
+	a := &app{currencyName: "BUCK"}
+	a.currency = currencyFormat{thousandsSep: ",", decimals: 2}
+	massert.Require(t,
+		massert.Equal("1 BUCK", a.formatAmount(100, true)),
+		massert.Equal("1.5 BUCKs", a.formatAmount(150, true)),
+		massert.Equal("0.01 BUCKs", a.formatAmount(1, true)),
+		massert.Equal("-1,234.05 BUCKs", a.formatAmount(-123405, true)),
+	)
+
+	a.currency.thousandsSep = "."
+	massert.Require(t, massert.Equal("1.234,5", a.formatNumber(123450)))
+
+	amount, err := a.parseAmount("1.25")
+	massert.Require(t, massert.Nil(err), massert.Equal(125, amount))
+	for _, str := range []string{"1.255", "0", "-1", "abc"} {
+		_, err := a.parseAmount(str)
+		massert.Require(t, massert.Equal(true, err != nil))
+	}
+}
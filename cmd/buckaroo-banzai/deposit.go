@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stellar/go/protocols/horizon/operations"
+
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// federationUserName returns the slack username which the given federation
+// address, or deposit memo, refers to.
+func (a *app) federationUserName(addr string) string {
+	return strings.TrimSuffix(addr, "*"+a.stellar.domain)
+}
+
+// accountIDByMemo returns the account which a deposit with the given memo is
+// for. The memo is the slack username of the user, optionally with the
+// federation domain on the end, the same as the federation server hands out.
+//
+// With keybase compatibility enabled the memo may also have been typed by
+// hand, so surrounding whitespace and a leading @ are ignored. The memo still
+// takes precedence over the sending address, which is only used if the memo
+// doesn't belong to anyone.
+func (a *app) accountIDByMemo(memo string) (string, bool, error) {
+	if a.keybaseCompat {
+		memo = strings.TrimPrefix(strings.TrimSpace(memo), "@")
+	}
+	if memo == "" {
+		return "", false, nil
+	}
+
+	user, err := a.slack.GetUserByName(a.federationUserName(memo))
+	if err != nil || user == nil {
+		return "", false, nil
+	}
+	accountID, err := a.accountID(user)
+	return accountID, err == nil, err
+}
+
+// depositHint returns a hint for the sender of a deposit which couldn't be
+// credited for the given reason, on what to do differently.
+func (a *app) depositHint(reason error) string {
+	switch {
+	case errors.Is(reason, economy.ErrDepositAsset):
+		return fmt.Sprintf("only %s can be deposited", a.acceptedDepositAssets())
+	case errors.Is(reason, economy.ErrDepositRecipient):
+		hint := fmt.Sprintf("the memo must be the slack username of who the deposit is for, or send it to `<username>*%s`", a.stellar.domain)
+		if a.keybaseCompat {
+			hint += ". if your wallet sets the memo itself, `link` the address you're sending from and deposits from it will be credited to you"
+		}
+		return hint
+	case errors.Is(reason, economy.ErrDepositFractional) && a.currency.decimals > 0:
+		return fmt.Sprintf("send an amount which is worth a multiple of %s, %s don't go any smaller than that", a.formatAmount(1, false), a.currencyString(2, false))
+	case errors.Is(reason, economy.ErrDepositFractional):
+		return fmt.Sprintf("send an amount which is worth a whole number of %s, there's no such thing as a fraction of one", a.currencyString(2, false))
+	case errors.Is(reason, economy.ErrDepositTooSmall) && a.currency.decimals > 0:
+		return fmt.Sprintf("send an amount which is worth at least %s", a.formatAmount(1, false))
+	case errors.Is(reason, economy.ErrDepositTooSmall):
+		return fmt.Sprintf("send an amount which is worth at least one %s", a.currencyString(1, false))
+	default:
+		return "if you think this is a mistake, ask an admin"
+	}
+}
+
+// acceptedDepositAssets returns a human readable list of the assets which can
+// be deposited.
+func (a *app) acceptedDepositAssets() string {
+	assets := append([]string{a.currencyName}, a.extraCurrencies...)
+	for key := range a.depositRates {
+		assets = append(assets, strings.SplitN(key, ":", 2)[0])
+	}
+	sort.Strings(assets[1:])
+	return strings.Join(assets, ", ")
+}
+
+// dmDepositRejected tells the user who linked the address a deposit came from
+// that it couldn't be credited. If nobody has linked the address then nothing
+// is sent.
+func (a *app) dmDepositRejected(payment operations.Payment, reason error, refunded bool) error {
+	accountID, ok, err := a.accountIDByLinkedAddress(payment.From)
+	if err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	assetName := payment.Asset.Code
+	if payment.Asset.Type == "native" {
+		assetName = "XLM"
+	}
+
+	msg := slackbot.NewMessage("your deposit of %s %s from `%s` couldn't be credited :warning:", payment.Amount, assetName, payment.From).
+		Fields("Reason", reason.Error(), "What to do", a.depositHint(reason))
+	if refunded {
+		msg.Context("It's been refunded to the sending address")
+	} else {
+		msg.Context("It has not been refunded")
+	}
+	return a.notify(userIDFromAccountID(accountID), msg)
+}
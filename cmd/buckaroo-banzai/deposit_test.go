@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/protocols/horizon/base"
+	"github.com/stellar/go/protocols/horizon/operations"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestDMDepositRejected(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		currencyName: "BUCK",
+	}
+
+	mtest.Run(cmp, t, func() {
+		user := fs.AddUser(mrand.Hex(8), "a", "T1")
+		addr := "G" + mrand.Hex(8)
+
+		var payment operations.Payment
+		payment.Asset = base.Asset{Type: "native"}
+		payment.From = addr
+		payment.Amount = "1.5"
+		reason := fmt.Errorf("payment amount %q is %w", payment.Amount, economy.ErrDepositFractional)
+
+		// nobody has linked the address, so nobody is told
+		massert.Require(t,
+			massert.Nil(a.dmDepositRejected(payment, reason, true)),
+			massert.Equal(0, len(fs.Flush())),
+		)
+
+		massert.Require(t, massert.Nil(a.bank.SetMeta(user.ID, linkedAddressMetaKey, addr)))
+		massert.Require(t,
+			massert.Nil(a.dmDepositRejected(payment, reason, true)),
+			massert.Equal([]slackbottest.Msg{
+				{ChannelID: "IM-" + user.ID, Text: "your deposit of 1.5 XLM from `" + addr + "` couldn't be credited :warning:"},
+			}, fs.Flush()),
+		)
+
+		// if the address is linked by more than one user there's no telling
+		// who it really belongs to.
+		other := fs.AddUser(mrand.Hex(8), "b", "T1")
+		massert.Require(t, massert.Nil(a.bank.SetMeta(other.ID, linkedAddressMetaKey, addr)))
+		massert.Require(t,
+			massert.Nil(a.dmDepositRejected(payment, reason, true)),
+			massert.Equal(0, len(fs.Flush())),
+		)
+	})
+}
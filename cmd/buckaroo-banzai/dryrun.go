@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/stellar"
+)
+
+// dryRunStellar wraps a stellar.API such that transactions are never actually
+// submitted, only logged. Everything else, including reads and constructing
+// transactions, goes through as normal, so the rest of the flow still gets
+// exercised.
+type dryRunStellar struct {
+	stellar.API
+	cmp *mcmp.Component
+}
+
+func (d dryRunStellar) SubmitTransactionXDR(ctx context.Context, txXDR string) (stellar.TransactionResult, error) {
+	mlog.From(d.cmp).Info("dry run, not submitting transaction", mctx.Annotate(ctx, "txXDR", txXDR))
+	return stellar.TransactionResult{}, nil
+}
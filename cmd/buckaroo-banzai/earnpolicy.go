@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+)
+
+// Possible values of --earn-bot-messages.
+const (
+	earnBotMessagesNone  = "none"
+	earnBotMessagesSelf  = "self"
+	earnBotMessagesOwner = "owner"
+)
+
+// earnPolicy decides who, if anyone, earns when a reaction is added to or
+// removed from an item.
+type earnPolicy struct {
+	// held while any of the fields are read or written, as some can be
+	// changed at runtime, see setupSettings.
+	l sync.RWMutex
+
+	// whether a user reacting to their own item earns them anything.
+	selfReactions bool
+
+	// how reactions to items authored by bots are handled, and the users who
+	// earn on behalf of each bot when using earnBotMessagesOwner.
+	botMessages string
+	botOwners   map[string]string
+
+	// users who never earn anything.
+	bannedUserIDs map[string]bool
+
+	// if greater than zero, the most any one user can earn for an item's
+	// author by reacting to it multiple times, and how long that's tracked
+	// for.
+	maxPerReactor int
+	capTTL        time.Duration
+
+	// if greater than zero, the most the author of an item can earn from
+	// reactions to it, and the most any one user can earn from reactions
+	// within a single hour.
+	maxPerItem int
+	maxPerHour int
+}
+
+func instEarnPolicy(parent *mcmp.Component) *earnPolicy {
+	cmp := parent.Child("earn")
+	p := new(earnPolicy)
+
+	selfReactions := mcfg.Bool(cmp, "self-reactions",
+		mcfg.ParamUsage("If set then users earn from reacting to their own messages"))
+	botMessages := mcfg.String(cmp, "bot-messages",
+		mcfg.ParamDefault(earnBotMessagesNone),
+		mcfg.ParamUsage("How reactions to messages from bots are handled. \""+earnBotMessagesNone+"\" means nobody earns, \""+earnBotMessagesSelf+"\" means the bot earns, \""+earnBotMessagesOwner+"\" means the bot's owner, as given by --earn-bot-owners, earns"))
+	botOwners := mcfg.String(cmp, "bot-owners",
+		mcfg.ParamUsage("Comma separated list of bot user IDs and the user IDs of their owners, e.g. \"<botID>=<ownerID>,...\""))
+	bannedUserIDs := mcfg.String(cmp, "banned-user-ids",
+		mcfg.ParamUsage("Comma separated list of slack user IDs which never earn from reactions"))
+
+	maxPerReactor := mcfg.Int(cmp, "max-per-reactor",
+		mcfg.ParamUsage("If greater than zero, the most a single user can earn for a message's author by adding multiple reactions to it"))
+	capTTL := mcfg.String(cmp, "cap-ttl",
+		mcfg.ParamDefault("168h"),
+		mcfg.ParamUsage("How long reactions are remembered for, for the purpose of --earn-max-per-reactor and --earn-max-per-message"))
+	maxPerItem := mcfg.Int(cmp, "max-per-message",
+		mcfg.ParamUsage("If greater than zero, the most a message's author can earn from reactions to it"))
+	maxPerHour := mcfg.Int(cmp, "max-per-hour",
+		mcfg.ParamUsage("If greater than zero, the most a single user can earn from reactions in any one hour. Reactions past the limit earn nothing, even once the hour is up"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		p.selfReactions = *selfReactions
+		p.maxPerReactor = *maxPerReactor
+		p.maxPerItem = *maxPerItem
+		p.maxPerHour = *maxPerHour
+
+		var err error
+		if p.capTTL, err = time.ParseDuration(*capTTL); err != nil {
+			return fmt.Errorf("parsing --earn-cap-ttl: %w", err)
+		} else if p.capTTL < time.Second {
+			return errors.New("--earn-cap-ttl must be at least 1s")
+		}
+
+		switch p.botMessages = *botMessages; p.botMessages {
+		case earnBotMessagesNone, earnBotMessagesSelf, earnBotMessagesOwner:
+		default:
+			return fmt.Errorf("unknown --earn-bot-messages %q", p.botMessages)
+		}
+
+		if p.botOwners, err = parseBotOwners(*botOwners); err != nil {
+			return fmt.Errorf("parsing --earn-bot-owners: %w", err)
+		}
+
+		p.bannedUserIDs = map[string]bool{}
+		for _, userID := range strings.Split(*bannedUserIDs, ",") {
+			if userID = strings.TrimSpace(userID); userID != "" {
+				p.bannedUserIDs[userID] = true
+			}
+		}
+		return nil
+	})
+
+	return p
+}
+
+func parseBotOwners(str string) (map[string]string, error) {
+	owners := map[string]string{}
+	for _, ownerStr := range strings.Split(str, ",") {
+		if ownerStr = strings.TrimSpace(ownerStr); ownerStr == "" {
+			continue
+		}
+		parts := strings.SplitN(ownerStr, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed bot owner %q", ownerStr)
+		}
+		owners[parts[0]] = parts[1]
+	}
+	return owners, nil
+}
+
+// earner returns the ID of the user who should earn from the given user's
+// reaction to an item authored by author, or empty string and the reason why
+// nobody should.
+func (p *earnPolicy) earner(reactorID string, author *slack.User) (string, string) {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	earnerID := author.ID
+	if author.IsBot {
+		switch p.botMessages {
+		case earnBotMessagesSelf:
+		case earnBotMessagesOwner:
+			if earnerID = p.botOwners[author.ID]; earnerID == "" {
+				return "", "bot has no owner"
+			}
+		default:
+			return "", "item is from a bot"
+		}
+	}
+
+	if earnerID == reactorID && !p.selfReactions {
+		return "", "self reaction"
+	} else if p.bannedUserIDs[earnerID] {
+		return "", "user is banned from earning"
+	}
+	return earnerID, ""
+}
+
+// earnCaps returns the EarnCaps which should be used for a reaction by the
+// given user to the given item, which earns for the given account. now is when
+// the reaction was made.
+func (p *earnPolicy) earnCaps(reactorID, itemID, reaction, accountID string, now time.Time) []bank.EarnCap {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	var caps []bank.EarnCap
+	if p.maxPerReactor > 0 {
+		caps = append(caps, bank.EarnCap{
+			Key:   reactorID + ":" + itemID,
+			Token: reaction,
+			Max:   p.maxPerReactor,
+			TTL:   p.capTTL,
+		})
+	}
+
+	// the hourly cap doesn't stop a reaction being taken back if it was
+	// counted in an earlier hour, so the item's cap is what stops a reaction
+	// which was never counted from being taken back. It's used even if there's
+	// no limit per item for that reason.
+	if p.maxPerItem > 0 || p.maxPerHour > 0 {
+		max := p.maxPerItem
+		if max <= 0 {
+			max = math.MaxInt32
+		}
+		caps = append(caps, bank.EarnCap{
+			Key:   "item:" + itemID,
+			Token: reactorID + ":" + reaction,
+			Max:   max,
+			TTL:   p.capTTL,
+		})
+	}
+
+	if p.maxPerHour > 0 {
+		hour := now.UTC().Truncate(time.Hour)
+		caps = append(caps, bank.EarnCap{
+			Key:            "hour:" + accountID + ":" + hour.Format("2006-01-02T15"),
+			Token:          reactorID + ":" + itemID + ":" + reaction,
+			Max:            p.maxPerHour,
+			TTL:            time.Hour,
+			IgnoreNegative: true,
+		})
+	}
+	return caps
+}
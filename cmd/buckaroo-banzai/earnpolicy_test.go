@@ -0,0 +1,87 @@
+package main
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+)
+
+func TestEarnPolicy(t *T) {
+	user := &slack.User{ID: "U1"}
+	bot := &slack.User{ID: "B1", IsBot: true}
+	ownerlessBot := &slack.User{ID: "B2", IsBot: true}
+
+	type test struct {
+		policy    earnPolicy
+		reactorID string
+		author    *slack.User
+		exp       string
+	}
+	tests := []test{
+		{policy: earnPolicy{}, reactorID: "U2", author: user, exp: "U1"},
+		{policy: earnPolicy{}, reactorID: "U1", author: user, exp: ""},
+		{policy: earnPolicy{selfReactions: true}, reactorID: "U1", author: user, exp: "U1"},
+		{policy: earnPolicy{bannedUserIDs: map[string]bool{"U1": true}}, reactorID: "U2", author: user, exp: ""},
+
+		{policy: earnPolicy{botMessages: earnBotMessagesNone}, reactorID: "U2", author: bot, exp: ""},
+		{policy: earnPolicy{botMessages: earnBotMessagesSelf}, reactorID: "U2", author: bot, exp: "B1"},
+		{
+			policy:    earnPolicy{botMessages: earnBotMessagesOwner, botOwners: map[string]string{"B1": "U1"}},
+			reactorID: "U2", author: bot, exp: "U1",
+		},
+		{
+			policy:    earnPolicy{botMessages: earnBotMessagesOwner, botOwners: map[string]string{"B1": "U1"}},
+			reactorID: "U1", author: bot, exp: "",
+		},
+		{
+			policy:    earnPolicy{botMessages: earnBotMessagesOwner, botOwners: map[string]string{"B1": "U1"}},
+			reactorID: "U2", author: ownerlessBot, exp: "",
+		},
+	}
+
+	for i := range tests {
+		test := &tests[i]
+		earnerID, _ := test.policy.earner(test.reactorID, test.author)
+		massert.Require(t, massert.Comment(massert.Equal(test.exp, earnerID), "test:%d", i))
+	}
+}
+
+func TestEarnPolicyCaps(t *T) {
+	p := earnPolicy{capTTL: time.Hour, maxPerItem: 2, maxPerHour: 3}
+	b := bank.NewInMem()
+	hour := time.Now().Truncate(time.Hour)
+
+	react := func(reactorID, itemID string, amount int, now time.Time) error {
+		_, err := b.SubmitEarn(bank.Earn{
+			EventID: mrand.Hex(8),
+			UserID:  "U1",
+			Amount:  amount,
+			Caps:    p.earnCaps(reactorID, itemID, "+1", "U1", now),
+		})
+		return err
+	}
+
+	massert.Require(t,
+		massert.Nil(react("U2", "item1", 1, hour)),
+		massert.Nil(react("U3", "item1", 1, hour)),
+		// the item has earned all it can.
+		massert.Equal(bank.ErrEarnCapped, react("U4", "item1", 1, hour)),
+
+		massert.Nil(react("U2", "item2", 1, hour)),
+		// the author has earned all they can this hour.
+		massert.Equal(bank.ErrEarnCapped, react("U3", "item2", 1, hour)),
+		// a reaction which was capped can't be taken back.
+		massert.Equal(bank.ErrEarnCapped, react("U3", "item2", -1, hour)),
+
+		// but in the next hour the author can earn again, and reactions from
+		// the hour before can still be taken back.
+		massert.Nil(react("U3", "item2", 1, hour.Add(time.Hour))),
+		massert.Nil(react("U2", "item1", -1, hour.Add(time.Hour))),
+		massert.Nil(react("U4", "item1", 1, hour.Add(time.Hour))),
+	)
+}
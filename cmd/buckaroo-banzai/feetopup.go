@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/stellar"
+)
+
+// feeTopUpMemo is the memo of the payments which top up fees.
+const feeTopUpMemo = "fee top-up"
+
+// feeTopUp keeps buckaroo's stellar account supplied with the XLM it pays
+// fees with, by sending some from a funding account whenever it runs low.
+// Only a limited number of top-ups are sent per day, so that something going
+// wrong can't drain the funding account.
+type feeTopUp struct {
+	cmp *mcmp.Component
+
+	// nil if topping up is disabled.
+	kp        *keypair.Full
+	below     float64
+	amount    float64
+	maxPerDay int
+	interval  time.Duration
+
+	// times of the top-ups sent within the last day, oldest first. These
+	// aren't persisted, so a restart resets the limit.
+	l    sync.Mutex
+	sent []time.Time
+}
+
+func instFeeTopUp(parent *mcmp.Component) *feeTopUp {
+	cmp := parent.Child("fee-top-up")
+	ft := &feeTopUp{cmp: cmp}
+
+	seed := mcfg.String(cmp, "seed",
+		mcfg.ParamUsage("Optional seed of an account which sends XLM to buckaroo's stellar account whenever it runs low on XLM for fees"))
+	below := mcfg.Float64(cmp, "below",
+		mcfg.ParamDefault(10),
+		mcfg.ParamUsage("A top-up is sent when buckaroo's stellar account holds less than this much XLM above its reserve"))
+	amount := mcfg.Float64(cmp, "amount",
+		mcfg.ParamDefault(20),
+		mcfg.ParamUsage("Amount of XLM sent in each top-up"))
+	maxPerDay := mcfg.Int(cmp, "max-per-day",
+		mcfg.ParamDefault(3),
+		mcfg.ParamUsage("Maximum number of top-ups sent within any 24 hours. Once reached an alert is posted instead."))
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("How often to check whether a top-up is needed"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		if *seed == "" {
+			return nil
+		} else if *amount <= 0 {
+			return errors.New("--fee-top-up-amount must be greater than zero")
+		} else if *maxPerDay <= 0 {
+			return errors.New("--fee-top-up-max-per-day must be greater than zero")
+		}
+
+		var err error
+		if ft.kp, err = stellar.LoadKeyPair(*seed); err != nil {
+			return fmt.Errorf("could not load fee top-up key pair: %w", err)
+		} else if ft.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --fee-top-up-interval: %w", err)
+		} else if ft.interval <= 0 {
+			return errors.New("--fee-top-up-interval must be greater than zero")
+		}
+
+		ft.below = *below
+		ft.amount = *amount
+		ft.maxPerDay = *maxPerDay
+		cmp.Annotate("fundingAddress", ft.kp.Address())
+		mlog.From(cmp).Info("fee top-ups are enabled", ctx)
+		return nil
+	})
+
+	return ft
+}
+
+// reserve returns true, recording a top-up as having been sent at the given
+// time, if another top-up can be sent without exceeding the daily limit.
+func (ft *feeTopUp) reserve(now time.Time) bool {
+	ft.l.Lock()
+	defer ft.l.Unlock()
+
+	for len(ft.sent) > 0 && now.Sub(ft.sent[0]) >= 24*time.Hour {
+		ft.sent = ft.sent[1:]
+	}
+	if len(ft.sent) >= ft.maxPerDay {
+		return false
+	}
+	ft.sent = append(ft.sent, now)
+	return true
+}
+
+// topUpFees sends a top-up from the funding account if buckaroo's stellar
+// account is running low on XLM, returning whether one was sent.
+func (a *app) topUpFees(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	defer cancel()
+
+	addr := a.stellar.kp.Address()
+	account, err := a.stellar.client.Account(ctx, addr)
+	if err != nil {
+		return false, fmt.Errorf("getting account %s: %w", addr, err)
+	}
+
+	available := availableXLM(account)
+	if available >= a.feeTopUp.below {
+		return false, nil
+	}
+	ctx = mctx.Annotate(ctx, "availableXLM", formatPrice(available))
+
+	if !a.feeTopUp.reserve(time.Now()) {
+		mlog.From(a.cmp).Warn("fee top-up limit reached", ctx)
+		a.alerts.alert(ctx, alertFeeTopUp, nil,
+			"stellar account %s has %s XLM available for fees, but %d top-ups have already been sent today, so no more will be until tomorrow",
+			addr, formatPrice(available), a.feeTopUp.maxPerDay)
+		return false, nil
+	}
+
+	op := &txnbuild.Payment{
+		Destination: addr,
+		Amount:      formatPrice(a.feeTopUp.amount),
+		Asset:       txnbuild.NativeAsset{},
+	}
+
+	mlog.From(a.cmp).Info("sending fee top-up", ctx)
+	txXDR, err := a.stellar.client.MakeOpsXDR(ctx, a.feeTopUp.kp, feeTopUpMemo, op)
+	if err != nil {
+		return false, fmt.Errorf("making fee top-up tx: %w", err)
+	}
+	res, err := a.stellar.client.SubmitTransactionXDR(ctx, txXDR)
+	if err != nil {
+		return false, fmt.Errorf("submitting fee top-up tx: %w", err)
+	}
+
+	mlog.From(a.cmp).Info("fee top-up sent",
+		mctx.Annotate(ctx, "stellarTXLink", res.Links.Transaction.Href))
+	return true, nil
+}
+
+// runFeeTopUps checks whether a top-up is needed every
+// --fee-top-up-interval, until the Context is canceled.
+func (a *app) runFeeTopUps(ctx context.Context) {
+	check := func() {
+		if _, err := a.topUpFees(ctx); err != nil {
+			mlog.From(a.cmp).Error("error topping up fees", ctx, merr.Context(err))
+			a.alerts.alert(ctx, alertFeeTopUp, err,
+				"failed to top up buckaroo's stellar account with XLM for fees from %s",
+				a.feeTopUp.kp.Address())
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(a.feeTopUp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
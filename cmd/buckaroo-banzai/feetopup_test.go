@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestTopUpFees(t *T) {
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+	fundingKP, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+
+	xlm := "20.0000000"
+	var payments []*txnbuild.Payment
+	mock := &stellartest.Mock{
+		AccountFn: func(_ context.Context, addr string) (horizon.Account, error) {
+			var b horizon.Balance
+			b.Asset.Type = "native"
+			b.Balance = xlm
+			return horizon.Account{AccountID: addr, Balances: []horizon.Balance{b}}, nil
+		},
+		MakeOpsXDRFn: func(_ context.Context, from *keypair.Full, memo string, ops ...txnbuild.Operation) (string, error) {
+			massert.Require(t,
+				massert.Equal(fundingKP.Address(), from.Address()),
+				massert.Equal(feeTopUpMemo, memo),
+			)
+			payments = append(payments, ops[0].(*txnbuild.Payment))
+			return "top-up", nil
+		},
+		SubmitTransactionXDRFn: func(context.Context, string) (stellar.TransactionResult, error) {
+			return stellar.TransactionResult{}, nil
+		},
+	}
+
+	a := &app{
+		cmp: mtest.Component(),
+		stellar: &stellarServer{
+			kp:      kp,
+			timeout: time.Second,
+			client:  mock,
+		},
+		feeTopUp: &feeTopUp{
+			kp:        fundingKP,
+			below:     10,
+			amount:    25,
+			maxPerDay: 2,
+		},
+	}
+
+	ctx := context.Background()
+	topUp := func() bool {
+		sent, err := a.topUpFees(ctx)
+		massert.Require(t, massert.Nil(err))
+		return sent
+	}
+
+	// the reserve is 1 XLM, for the account itself.
+	massert.Require(t, massert.Equal(false, topUp()))
+	xlm = "10.9999999"
+	massert.Require(t,
+		massert.Equal(true, topUp()),
+		massert.Length(payments, 1),
+		massert.Equal(kp.Address(), payments[0].Destination),
+		massert.Equal("25.0000000", payments[0].Amount),
+	)
+
+	// once the limit is reached no more are sent until a day has passed.
+	massert.Require(t,
+		massert.Equal(true, topUp()),
+		massert.Equal(false, topUp()),
+		massert.Length(payments, 2),
+	)
+	a.feeTopUp.sent[0] = a.feeTopUp.sent[0].Add(-24 * time.Hour)
+	massert.Require(t,
+		massert.Equal(true, topUp()),
+		massert.Length(payments, 3),
+	)
+}
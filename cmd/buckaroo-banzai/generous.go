@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// generousLeaderboardSize is how many users the generous command lists.
+const generousLeaderboardSize = 10
+
+func (a *app) cmdGenerous(ctx context.Context, req commandReq) error {
+	now := time.Now().UTC()
+	mlog.From(a.cmp).Info("getting top givers", ctx)
+	totals, err := a.bank.TopGivers(now, generousLeaderboardSize)
+	if err != nil {
+		return err
+	}
+
+	if len(totals) == 0 {
+		a.reply(req, "nobody has given anyone anything yet this month :cold_face: be the first with `give`!")
+		return nil
+	}
+
+	strb := new(strings.Builder)
+	for i, total := range totals {
+		gives := "gives"
+		if total.NumGives == 1 {
+			gives = "give"
+		}
+		fmt.Fprintf(strb, "%d. <@%s> gave %s over %s %s\n",
+			i+1, userIDFromAccountID(total.UserID),
+			a.formatAmount(total.Amount, false),
+			formatInt(total.NumGives, a.currency.thousandsSep), gives)
+	}
+
+	msg := slackbot.NewMessage(":gift: the most generous people this month\n%s", strb.String())
+	msg.Context("Only counts `give`, since the start of %s (UTC)", now.Format("January"))
+	a.replyMsg(req, msg)
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Gift cards are escrowed in their own bank account until they're redeemed or
+// expire, so that whoever created one can't spend what's on it in the
+// meantime. Each gift card is stored under giftcardMetaKey, keyed by a hash of
+// its code, so the codes themselves can't be recovered from the bank.
+const (
+	giftcardEscrowAccountID = "giftcard-escrow"
+	giftcardMetaKey         = "giftcard"
+)
+
+// giftcardJournalSource is what moving funds in and out of escrow is recorded
+// as in the bank's journal.
+const giftcardJournalSource = "giftcard"
+
+// giftcardRefundInterval is how often expired gift cards are refunded.
+const giftcardRefundInterval = time.Hour
+
+const giftcardUsage = "usage: `giftcard create <amount>` or `giftcard redeem <code>`"
+
+// giftcard is a one-time code which anyone can redeem for the amount on it.
+type giftcard struct {
+	// Hint is the first few characters of the code, so the creator can be
+	// told which of their gift cards was redeemed or refunded.
+	Hint      string    `json:"hint"`
+	CreatedBy string    `json:"createdBy"`
+	Amount    int       `json:"amount"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (a *app) getGiftcard(code string) (giftcard, bool, error) {
+	str, err := a.bank.GetMeta(hashString(code), giftcardMetaKey)
+	if err != nil {
+		return giftcard{}, false, fmt.Errorf("getting gift card: %w", err)
+	} else if str == "" {
+		return giftcard{}, false, nil
+	}
+	var gc giftcard
+	if err := json.Unmarshal([]byte(str), &gc); err != nil {
+		return giftcard{}, false, fmt.Errorf("unmarshaling gift card: %w", err)
+	}
+	return gc, true, nil
+}
+
+func (a *app) setGiftcard(field string, gc giftcard) error {
+	b, err := json.Marshal(gc)
+	if err != nil {
+		return err
+	} else if err := a.bank.SetMeta(field, giftcardMetaKey, string(b)); err != nil {
+		return fmt.Errorf("storing gift card: %w", err)
+	}
+	return nil
+}
+
+// createGiftcard escrows the amount from the account, and returns the code of
+// a new gift card for it.
+func (a *app) createGiftcard(ctx context.Context, accountID string, amount int) (giftcard, string, error) {
+	code, err := randHex(8)
+	if err != nil {
+		return giftcard{}, "", fmt.Errorf("generating gift card code: %w", err)
+	}
+	gc := giftcard{
+		Hint:      code[:4],
+		CreatedBy: accountID,
+		Amount:    amount,
+		ExpiresAt: time.Now().Add(a.giftcardTTL).UTC(),
+	}
+
+	a.giftcardL.Lock()
+	defer a.giftcardL.Unlock()
+
+	if _, _, err := a.bank.TransferAs(giftcardEscrowAccountID, accountID, amount, giftcardJournalSource); err != nil {
+		return giftcard{}, "", err
+	} else if err := a.setGiftcard(hashString(code), gc); err != nil {
+		if _, _, refundErr := a.bank.TransferAs(accountID, giftcardEscrowAccountID, amount, giftcardJournalSource); refundErr != nil {
+			mlog.From(a.cmp).Error("error refunding gift card which couldn't be stored", ctx, merr.Context(refundErr))
+		}
+		return giftcard{}, "", err
+	}
+	a.audit(mctx.Annotate(ctx, "giftcardHint", gc.Hint, "amount", amount), "gift card created")
+	return gc, code, nil
+}
+
+// redeemGiftcard moves the amount on the gift card with the given code into
+// the account. False is returned if there's no such gift card, or it has
+// already been redeemed.
+func (a *app) redeemGiftcard(ctx context.Context, accountID, code string) (giftcard, int, bool, error) {
+	a.giftcardL.Lock()
+	defer a.giftcardL.Unlock()
+
+	gc, ok, err := a.getGiftcard(code)
+	if err != nil || !ok {
+		return giftcard{}, 0, false, err
+	} else if time.Now().After(gc.ExpiresAt) {
+		return giftcard{}, 0, false, inputErrorf("that gift card has expired, whoever gave it to you has been refunded")
+	}
+
+	// the gift card is removed first, so that if something goes wrong it
+	// can't be redeemed twice. If the transfer fails it's put back.
+	field := hashString(code)
+	if err := a.bank.SetMeta(field, giftcardMetaKey, ""); err != nil {
+		return giftcard{}, 0, false, fmt.Errorf("removing gift card: %w", err)
+	}
+	newBalance, _, err := a.bank.TransferAs(accountID, giftcardEscrowAccountID, gc.Amount, giftcardJournalSource)
+	if err != nil {
+		if restoreErr := a.setGiftcard(field, gc); restoreErr != nil {
+			mlog.From(a.cmp).Error("error restoring gift card which couldn't be redeemed", ctx, merr.Context(restoreErr))
+		}
+		return giftcard{}, 0, false, err
+	}
+	a.audit(mctx.Annotate(ctx, "giftcardHint", gc.Hint, "amount", gc.Amount, "createdBy", gc.CreatedBy), "gift card redeemed")
+	return gc, newBalance, true, nil
+}
+
+// refundExpiredGiftcards refunds gift cards which have expired to whoever
+// created them, once an interval, until the context is canceled.
+func (a *app) refundExpiredGiftcards(ctx context.Context) {
+	refund := func() {
+		if err := a.refundExpiredGiftcardsOnce(ctx); err != nil {
+			mlog.From(a.cmp).Error("error refunding expired gift cards", ctx, merr.Context(err))
+			a.alerts.alert(ctx, alertRedisError, err, "failed to refund expired gift cards")
+		}
+	}
+
+	refund()
+	ticker := time.NewTicker(giftcardRefundInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			refund()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *app) refundExpiredGiftcardsOnce(ctx context.Context) error {
+	a.giftcardL.Lock()
+	defer a.giftcardL.Unlock()
+
+	all, err := a.bank.AllMeta(giftcardMetaKey)
+	if err != nil {
+		return fmt.Errorf("getting all gift cards: %w", err)
+	}
+
+	now := time.Now()
+	for field, str := range all {
+		var gc giftcard
+		if err := json.Unmarshal([]byte(str), &gc); err != nil {
+			return fmt.Errorf("unmarshaling gift card: %w", err)
+		} else if now.Before(gc.ExpiresAt) {
+			continue
+		}
+
+		ctx := mctx.Annotate(ctx, "giftcardHint", gc.Hint, "amount", gc.Amount, "createdBy", gc.CreatedBy)
+		if err := a.bank.SetMeta(field, giftcardMetaKey, ""); err != nil {
+			return fmt.Errorf("removing expired gift card: %w", err)
+		}
+		balance, _, err := a.bank.TransferAs(gc.CreatedBy, giftcardEscrowAccountID, gc.Amount, giftcardJournalSource)
+		if err != nil {
+			if restoreErr := a.setGiftcard(field, gc); restoreErr != nil {
+				mlog.From(a.cmp).Error("error restoring gift card which couldn't be refunded", ctx, merr.Context(restoreErr))
+			}
+			return fmt.Errorf("refunding expired gift card: %w", err)
+		}
+		a.audit(ctx, "gift card refunded")
+
+		msg := slackbot.NewMessage("your gift card `%s...` expired without being redeemed, so I've refunded the %s on it :leftwards_arrow_with_hook:", gc.Hint, a.formatAmount(gc.Amount, true)).
+			Context("Your balance is now %s", a.formatAmount(balance, true))
+		if err := a.notifyOnce(userIDFromAccountID(gc.CreatedBy), "giftcard-refund:"+field, msg); err != nil {
+			mlog.From(a.cmp).Warn("error notifying user of gift card refund", ctx, merr.Context(err))
+		}
+	}
+	return nil
+}
+
+func (a *app) cmdGiftcard(ctx context.Context, req commandReq) error {
+	if len(req.args) < 2 {
+		a.reply(req, giftcardUsage)
+		return nil
+	}
+
+	switch strings.ToLower(req.args[0]) {
+	case "create":
+		amount, err := a.parseAmount(req.args[1])
+		if err != nil {
+			return err
+		}
+		gc, code, err := a.createGiftcard(ctx, req.accountID, amount)
+		if err != nil {
+			return err
+		}
+		msg := slackbot.NewMessage("here's a gift card for %s: `%s` :gift:", a.formatAmount(amount, true), code).
+			Context("Anyone can redeem it once with `giftcard redeem %s`. If nobody has by %s then you'll get it back.", code, gc.ExpiresAt.Format("Jan 2 2006"))
+		if req.channel != nil && req.channel.IsIM {
+			a.replyMsg(req, msg)
+			return nil
+		}
+		// anyone who sees the code can redeem it, so it shouldn't be shown
+		// to a whole channel.
+		if err := a.dm(req.user.ID, msg); err != nil {
+			return err
+		}
+		a.reply(req, "I've DM'd you the gift card's code :shushing_face:")
+
+	case "redeem":
+		gc, balance, ok, err := a.redeemGiftcard(ctx, req.accountID, req.args[1])
+		if err != nil {
+			return err
+		} else if !ok {
+			return inputErrorf("that isn't a gift card, or it's already been redeemed")
+		}
+		a.replyMsg(req, slackbot.NewMessage("you redeemed a gift card from <@%s> for %s :gift:", userIDFromAccountID(gc.CreatedBy), a.formatAmount(gc.Amount, true)).
+			Context("Your balance is now %s", a.formatAmount(balance, true)))
+
+		if gc.CreatedBy != req.accountID {
+			msg := slackbot.NewMessage("<@%s> redeemed your gift card `%s...` for %s :gift:", req.user.ID, gc.Hint, a.formatAmount(gc.Amount, true))
+			if err := a.notifyOnce(userIDFromAccountID(gc.CreatedBy), "giftcard-redeem:"+hashString(req.args[1]), msg); err != nil {
+				mlog.From(a.cmp).Warn("error notifying user of gift card redemption", ctx, merr.Context(err))
+			}
+		}
+
+	default:
+		a.reply(req, giftcardUsage)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestGiftcards(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:         cmp,
+		bank:        bank.NewInMem(),
+		slack:       fs,
+		giftcardTTL: time.Hour,
+	}
+
+	mtest.Run(cmp, t, func() {
+		fs.AddUser("U1", "u1", "T1")
+		fs.AddUser("U2", "u2", "T1")
+		_, err := a.bank.Incr("U1", 10)
+		massert.Require(t, massert.Nil(err))
+
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+
+		ctx := context.Background()
+		_, _, err = a.createGiftcard(ctx, "U1", 11)
+		massert.Require(t, massert.Equal(bank.ErrNotEnoughFunds, err))
+
+		_, code, err := a.createGiftcard(ctx, "U1", 4)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(6, balanceOf("U1")),
+			massert.Equal(4, balanceOf(giftcardEscrowAccountID)),
+		)
+
+		gc, balance, ok, err := a.redeemGiftcard(ctx, "U2", code)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(true, ok),
+			massert.Equal("U1", gc.CreatedBy),
+			massert.Equal(4, balance),
+			massert.Equal(0, balanceOf(giftcardEscrowAccountID)),
+		)
+
+		// codes can only be redeemed once.
+		_, _, ok, err = a.redeemGiftcard(ctx, "U2", code)
+		massert.Require(t, massert.Nil(err), massert.Equal(false, ok))
+
+		// expired gift cards are refunded, and can't be redeemed.
+		a.giftcardTTL = -time.Minute
+		_, code, err = a.createGiftcard(ctx, "U1", 5)
+		massert.Require(t, massert.Nil(err), massert.Equal(1, balanceOf("U1")))
+		_, _, _, err = a.redeemGiftcard(ctx, "U2", code)
+		massert.Require(t, massert.Not(massert.Nil(err)))
+
+		massert.Require(t,
+			massert.Nil(a.refundExpiredGiftcardsOnce(ctx)),
+			massert.Equal(6, balanceOf("U1")),
+			massert.Equal(4, balanceOf("U2")),
+			massert.Equal(0, balanceOf(giftcardEscrowAccountID)),
+			massert.Equal(1, len(fs.Flush())),
+		)
+	})
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+const githubWebhookPath = "/api/v1/github"
+
+// Bank metadata keys which GitHub logins are stored under. A user's login is
+// only stored under githubLoginMetaKey once they've proven they own it, until
+// then it's stored under githubPendingMetaKey along with the code they need to
+// prove it with, as "<login>:<code>".
+const (
+	githubLoginMetaKey   = "githubLogin"
+	githubPendingMetaKey = "githubPendingLogin"
+)
+
+// githubVerifyPrefix is what users comment on GitHub, followed by their code,
+// to prove that they own a login.
+const githubVerifyPrefix = "buckaroo-verify"
+
+// gitHub rewards users for contributions on GitHub, by way of GitHub's
+// webhooks. It's disabled unless a webhook secret is configured.
+type gitHub struct {
+	webhookSecret string
+
+	// how many whole units of the currency are earned for getting a PR merged,
+	// and for reviewing one. Zero disables either.
+	prMergedAmount, reviewAmount int
+}
+
+func instGitHub(parent *mcmp.Component) *gitHub {
+	cmp := parent.Child("github")
+	gh := new(gitHub)
+
+	webhookSecret := mcfg.String(cmp, "webhook-secret",
+		mcfg.ParamUsage("Secret of the GitHub webhook which sends events to "+githubWebhookPath+". If not set then the GitHub integration is disabled."))
+	prMergedAmount := mcfg.Int(cmp, "pr-merged-amount",
+		mcfg.ParamDefault(5),
+		mcfg.ParamUsage("How much the author of a pull request earns when it's merged. 0 disables."))
+	reviewAmount := mcfg.Int(cmp, "review-amount",
+		mcfg.ParamDefault(1),
+		mcfg.ParamUsage("How much a user earns for submitting a review of someone else's pull request. 0 disables."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		gh.webhookSecret = *webhookSecret
+		if gh.prMergedAmount = *prMergedAmount; gh.prMergedAmount < 0 {
+			return errors.New("--github-pr-merged-amount can't be negative")
+		} else if gh.reviewAmount = *reviewAmount; gh.reviewAmount < 0 {
+			return errors.New("--github-review-amount can't be negative")
+		}
+		return nil
+	})
+
+	return gh
+}
+
+// checkSignature returns whether the body was signed using the webhook secret,
+// as given by the X-Hub-Signature-256 header.
+func (gh *gitHub) checkSignature(body []byte, sig string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+	sigB, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(gh.webhookSecret))
+	mac.Write(body)
+	return hmac.Equal(sigB, mac.Sum(nil))
+}
+
+// The parts of GitHub's webhook payloads which are used.
+type (
+	githubUser struct {
+		Login string `json:"login"`
+	}
+
+	githubPR struct {
+		Number  int        `json:"number"`
+		Title   string     `json:"title"`
+		HTMLURL string     `json:"html_url"`
+		Merged  bool       `json:"merged"`
+		User    githubUser `json:"user"`
+	}
+
+	githubEvent struct {
+		Action     string `json:"action"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		PullRequest githubPR `json:"pull_request"`
+		Review      struct {
+			ID   int64      `json:"id"`
+			User githubUser `json:"user"`
+		} `json:"review"`
+		Comment struct {
+			Body string     `json:"body"`
+			User githubUser `json:"user"`
+		} `json:"comment"`
+	}
+)
+
+func (a *app) githubWebhookHandler(rw http.ResponseWriter, r *http.Request) {
+	if a.github.webhookSecret == "" {
+		http.NotFound(rw, r)
+		return
+	} else if r.Method != "POST" {
+		apiError(rw, http.StatusMethodNotAllowed, "method must be POST")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, 1<<20))
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, fmt.Sprintf("reading body: %s", err))
+		return
+	} else if !a.github.checkSignature(body, r.Header.Get("X-Hub-Signature-256")) {
+		apiError(rw, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	var event githubEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		apiError(rw, http.StatusBadRequest, fmt.Sprintf("decoding body: %s", err))
+		return
+	}
+
+	eventType := r.Header.Get("X-GitHub-Event")
+	ctx := mctx.Annotate(r.Context(),
+		"githubEvent", eventType,
+		"githubAction", event.Action,
+		"githubDelivery", r.Header.Get("X-GitHub-Delivery"),
+		"githubRepo", event.Repository.FullName)
+	mlog.From(a.cmp).Debug("received GitHub webhook", ctx)
+
+	// errors are returned to GitHub as 500s, so that the delivery shows up as
+	// failed and can be redelivered. Earns are deduplicated, so redelivering
+	// is safe.
+	if err := a.handleGitHubEvent(ctx, eventType, event); err != nil {
+		mlog.From(a.cmp).Error("error handling GitHub webhook", ctx, merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *app) handleGitHubEvent(ctx context.Context, eventType string, event githubEvent) error {
+	pr := event.PullRequest
+	prName := fmt.Sprintf("%s#%d", event.Repository.FullName, pr.Number)
+	switch {
+	case eventType == "pull_request" && event.Action == "closed" && pr.Merged:
+		return a.githubEarn(ctx, pr.User.Login, bank.Earn{
+			EventID: "github:pr-merged:" + prName,
+			Amount:  a.github.prMergedAmount * a.currency.unit(),
+		}, slackbot.NewMessage("you earned %s for getting <%s|%s> merged :rocket:",
+			a.formatAmount(a.github.prMergedAmount*a.currency.unit(), true), pr.HTMLURL, prName))
+
+	case eventType == "pull_request_review" && event.Action == "submitted":
+		if strings.EqualFold(event.Review.User.Login, pr.User.Login) {
+			return nil
+		}
+		return a.githubEarn(ctx, event.Review.User.Login, bank.Earn{
+			EventID: fmt.Sprintf("github:review:%d", event.Review.ID),
+			Amount:  a.github.reviewAmount * a.currency.unit(),
+		}, slackbot.NewMessage("you earned %s for reviewing <%s|%s> :eyes:",
+			a.formatAmount(a.github.reviewAmount*a.currency.unit(), true), pr.HTMLURL, prName))
+
+	case eventType == "issue_comment" && event.Action == "created":
+		return a.githubVerify(ctx, event.Comment.User.Login, event.Comment.Body)
+
+	default:
+		return nil
+	}
+}
+
+// githubEarn submits the Earn for the user with the given GitHub login, and
+// tells them about it with the given message. If nobody has linked the login
+// then nothing happens.
+func (a *app) githubEarn(ctx context.Context, login string, earn bank.Earn, msg *slackbot.Message) error {
+	if earn.Amount == 0 || login == "" {
+		return nil
+	}
+	ctx = mctx.Annotate(ctx, "githubLogin", login)
+
+	accountID, ok, err := a.accountIDByGitHubLogin(login)
+	if err != nil {
+		return err
+	} else if !ok {
+		mlog.From(a.cmp).Debug("GitHub login isn't linked to anyone, not rewarding", ctx)
+		return nil
+	}
+
+	earn.UserID = accountID
+	ctx = earn.Annotate(ctx)
+	// the earn is submitted directly, rather than through the economy, so
+	// that the user isn't told about duplicates.
+	if _, err := a.bank.SubmitEarn(earn); errors.Is(err, bank.ErrDuplicateEarn) {
+		mlog.From(a.cmp).Debug("ignoring duplicate GitHub earn", ctx)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("submitting earn: %w", err)
+	}
+
+	mlog.From(a.cmp).Info("rewarding GitHub contribution", ctx)
+	if err := a.notify(userIDFromAccountID(accountID), msg); err != nil {
+		mlog.From(a.cmp).Warn("could not tell user about GitHub reward", ctx, merr.Context(err))
+	}
+	return nil
+}
+
+// accountIDByGitHubLogin returns the account ID of the user who has linked the
+// given GitHub login, or false if nobody has.
+func (a *app) accountIDByGitHubLogin(login string) (string, bool, error) {
+	linked, err := a.bank.AllMeta(githubLoginMetaKey)
+	if err != nil {
+		return "", false, fmt.Errorf("getting all linked GitHub logins: %w", err)
+	}
+	for accountID, linkedLogin := range linked {
+		// GitHub logins are case insensitive.
+		if strings.EqualFold(linkedLogin, login) {
+			return accountID, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// setGitHubLogin links the GitHub login to the account, unlinking it from
+// anyone else who had it.
+func (a *app) setGitHubLogin(accountID, login string) error {
+	if prevAccountID, ok, err := a.accountIDByGitHubLogin(login); err != nil {
+		return err
+	} else if ok && prevAccountID != accountID {
+		if err := a.bank.SetMeta(prevAccountID, githubLoginMetaKey, ""); err != nil {
+			return fmt.Errorf("unlinking GitHub login from %q: %w", prevAccountID, err)
+		}
+	}
+	if err := a.bank.SetMeta(accountID, githubLoginMetaKey, login); err != nil {
+		return fmt.Errorf("linking GitHub login: %w", err)
+	}
+	return a.bank.SetMeta(accountID, githubPendingMetaKey, "")
+}
+
+// githubVerify checks whether a comment made on GitHub proves that a user owns
+// the login which made it, and links the login to them if so.
+func (a *app) githubVerify(ctx context.Context, login, comment string) error {
+	if !strings.Contains(comment, githubVerifyPrefix) {
+		return nil
+	}
+
+	pending, err := a.bank.AllMeta(githubPendingMetaKey)
+	if err != nil {
+		return fmt.Errorf("getting all pending GitHub logins: %w", err)
+	}
+	for accountID, pendingStr := range pending {
+		parts := strings.SplitN(pendingStr, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], login) ||
+			!strings.Contains(comment, githubVerifyPrefix+" "+parts[1]) {
+			continue
+		}
+
+		if err := a.setGitHubLogin(accountID, login); err != nil {
+			return err
+		}
+		ctx = mctx.Annotate(ctx, "accountID", accountID, "githubLogin", login)
+		mlog.From(a.cmp).Info("GitHub login verified", ctx)
+		msg := slackbot.NewMessage("you're now linked to GitHub as `%s`, you'll earn %s for contributions there :handshake:", login, a.currencyString(2, true))
+		if err := a.notify(userIDFromAccountID(accountID), msg); err != nil {
+			mlog.From(a.cmp).Warn("could not tell user about GitHub link", ctx, merr.Context(err))
+		}
+	}
+	return nil
+}
+
+const githubUsage = "usage: `github link <GitHub login>` or `github unlink`"
+
+func (a *app) cmdGitHub(ctx context.Context, req commandReq) error {
+	if a.github.webhookSecret == "" {
+		a.reply(req, "the GitHub integration isn't set up")
+		return nil
+	}
+
+	if len(req.args) < 1 {
+		login, err := a.bank.GetMeta(req.accountID, githubLoginMetaKey)
+		if err != nil {
+			return err
+		} else if login == "" {
+			a.reply(req, "you haven't linked a GitHub login. %s", githubUsage)
+		} else {
+			a.reply(req, "you're linked to GitHub as `%s`", login)
+		}
+		return nil
+	}
+
+	switch strings.ToLower(req.args[0]) {
+	case "link":
+		if len(req.args) < 2 {
+			a.reply(req, githubUsage)
+			return nil
+		}
+		login := strings.TrimPrefix(req.args[1], "@")
+		ctx = mctx.Annotate(ctx, "githubLogin", login)
+
+		// admins can link anyone without them having to prove anything.
+		if len(req.args) > 2 && req.role >= roleAdmin {
+			dstAccountID, err := a.accountIDByUserID(req.args[2])
+			if err != nil {
+				return err
+			} else if err := a.setGitHubLogin(dstAccountID, login); err != nil {
+				return err
+			}
+			a.audit(mctx.Annotate(ctx, "dstAccountID", dstAccountID), "GitHub login linked")
+			a.reply(req, "<@%s> is now linked to GitHub as `%s`", userIDFromAccountID(dstAccountID), login)
+			return nil
+		}
+
+		code, err := randHex(4)
+		if err != nil {
+			return err
+		} else if err := a.bank.SetMeta(req.accountID, githubPendingMetaKey, login+":"+code); err != nil {
+			return err
+		}
+		mlog.From(a.cmp).Info("GitHub login pending verification", ctx)
+		a.reply(req, "to prove that you're `%s`, comment `%s %s` on any issue or pull request in a repo which I'm watching. Once I see it you'll be linked :mag:",
+			login, githubVerifyPrefix, code)
+
+	case "unlink":
+		mlog.From(a.cmp).Info("unlinking GitHub login", ctx)
+		if err := a.bank.SetMeta(req.accountID, githubLoginMetaKey, ""); err != nil {
+			return err
+		} else if err := a.bank.SetMeta(req.accountID, githubPendingMetaKey, ""); err != nil {
+			return err
+		}
+		a.reply(req, "your GitHub login has been unlinked")
+
+	default:
+		a.reply(req, githubUsage)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestGitHubCheckSignature(t *T) {
+	gh := &gitHub{webhookSecret: "shh"}
+	body := []byte(`{"action":"closed"}`)
+
+	mac := hmac.New(sha256.New, []byte(gh.webhookSecret))
+	mac.Write(body)
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	massert.Require(t,
+		massert.Equal(true, gh.checkSignature(body, sig)),
+		massert.Equal(false, gh.checkSignature([]byte(`{"action":"opened"}`), sig)),
+		massert.Equal(false, gh.checkSignature(body, "sha256=nothex")),
+		massert.Equal(false, gh.checkSignature(body, "")),
+		massert.Equal(false, (&gitHub{webhookSecret: "other"}).checkSignature(body, sig)),
+	)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// exportTrimInterval is how often exports older than the retention period are
+// trimmed from the bank.
+const exportTrimInterval = time.Hour
+
+// trimExports trims exports older than the retention period from the bank,
+// once an interval, until the context is canceled.
+func (a *app) trimExports(ctx context.Context) {
+	ctx = mctx.Annotate(ctx, "exportRetention", a.exportRetention.String())
+	trim := func() {
+		before := time.Now().Add(-a.exportRetention)
+		n, err := a.bank.TrimExports(before)
+		if err != nil {
+			mlog.From(a.cmp).Error("error trimming exports", ctx, merr.Context(err))
+			a.alerts.alert(ctx, alertRedisError, err, "failed to trim old withdrawals")
+		} else if n > 0 {
+			mlog.From(a.cmp).Info("trimmed old exports", mctx.Annotate(ctx, "numTrimmed", n))
+		}
+	}
+
+	trim()
+	ticker := time.NewTicker(exportTrimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			trim()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+const apiExportsPath = "/api/v1/exports"
+
+// apiExportsMaxRange is the longest range of history which can be requested
+// at once.
+const apiExportsMaxRange = 31 * 24 * time.Hour
+
+// apiExportsHandler returns the history of withdrawals between the start and
+// end query parameters (RFC3339), optionally only those of a single user. It
+// includes withdrawals which have been trimmed from redis into the archive.
+func (a *app) apiExportsHandler(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, err := time.Parse(time.RFC3339, q.Get("start"))
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, fmt.Sprintf("invalid start parameter: %s", err))
+		return
+	}
+	end, err := time.Parse(time.RFC3339, q.Get("end"))
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, fmt.Sprintf("invalid end parameter: %s", err))
+		return
+	} else if !start.Before(end) {
+		apiError(rw, http.StatusBadRequest, "start must be before end")
+		return
+	} else if end.Sub(start) > apiExportsMaxRange {
+		apiError(rw, http.StatusBadRequest, fmt.Sprintf("range can't be longer than %s", apiExportsMaxRange))
+		return
+	}
+
+	var accountID string
+	if userID := q.Get("user"); userID != "" {
+		accountID, err = a.accountIDByUserID(userID)
+		if errors.Is(err, slackbot.ErrUserNotFound) || errors.Is(err, errForeignTeam) {
+			apiError(rw, http.StatusNotFound, fmt.Sprintf("user %q: %s", userID, err))
+			return
+		} else if err != nil {
+			mlog.From(a.cmp).Error("error getting account for API request", r.Context(), merr.Context(err))
+			apiError(rw, http.StatusInternalServerError, "internal error")
+			return
+		}
+	}
+
+	records, err := a.bank.ExportHistory(start, end)
+	if errors.Is(err, bank.ErrUnavailable) {
+		apiError(rw, http.StatusServiceUnavailable, "bank is unavailable")
+		return
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error getting export history for API request", r.Context(), merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	type exportJSON struct {
+		ID       string             `json:"id"`
+		Time     time.Time          `json:"time"`
+		UserID   string             `json:"userID"`
+		UserName string             `json:"userName,omitempty"`
+		Amount   int                `json:"amount"`
+		Protocol string             `json:"protocol"`
+		Payload  bank.ExportPayload `json:"payload,omitempty"`
+	}
+	aliases, err := a.bank.AllMeta(bank.AliasMetaKey)
+	if err != nil {
+		mlog.From(a.cmp).Error("error getting aliases for API request", r.Context(), merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	exports := []exportJSON{}
+	for _, record := range records {
+		if accountID != "" && record.Export.FromUserID != accountID {
+			continue
+		}
+		exports = append(exports, exportJSON{
+			ID:       record.ID,
+			Time:     record.Time,
+			UserID:   userIDFromAccountID(record.Export.FromUserID),
+			UserName: lookupAlias(aliases, record.Export.FromUserID),
+			Amount:   record.Export.Amount,
+			Protocol: record.Export.Protocol(),
+			Payload:  record.Export.Payload,
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		Exports []exportJSON `json:"exports"`
+	}{exports})
+}
+
+// historyPageSize is how many entries the history command shows at a time.
+const historyPageSize = 15
+
+const historyUsage = "usage: `history [<cursor>]`"
+
+// describeHistoryEntry returns what happened in a history entry, from the point
+// of view of the user whose history it's in.
+func describeHistoryEntry(e bank.HistoryEntry) string {
+	in := e.Amount > 0
+	other := "<@" + userIDFromAccountID(e.Counterparty) + ">"
+	switch e.Source {
+	case bank.JournalSourceEarn:
+		if in {
+			return "earned from reactions"
+		}
+		return "taken back from reactions"
+	case bank.JournalSourceGive, bank.JournalSourceTransfer:
+		if in {
+			return "from " + other
+		}
+		return "to " + other
+	case splitJournalSource:
+		if in {
+			return "split bill paid by " + other
+		}
+		return "split bill paid to " + other
+	case giftcardJournalSource:
+		return "gift card"
+	case allowanceJournalSource:
+		return "allowance"
+	case bank.JournalSourceInterest:
+		if in {
+			return "interest"
+		}
+		return "demurrage"
+	case bank.JournalSourceExport:
+		return "withdrawal"
+	case bank.JournalSourceDeposit:
+		return "deposit"
+	case bank.JournalSourceMint:
+		if in {
+			return "minted"
+		}
+		return "burned"
+	default:
+		return e.Source
+	}
+}
+
+func (a *app) cmdHistory(ctx context.Context, req commandReq) error {
+	accountID, args := req.accountID, req.args
+	if len(args) > 0 && strings.HasPrefix(args[0], "<@") {
+		// looking at someone else's history is for settling disputes.
+		if req.role < roleAdmin {
+			return inputErrorf("only admins can see other users' history")
+		}
+		var err error
+		if accountID, err = a.accountIDByUserID(args[0]); err != nil {
+			return err
+		}
+		args = args[1:]
+	}
+	if len(args) > 1 {
+		a.reply(req, historyUsage)
+		return nil
+	}
+
+	var cursor string
+	if len(args) > 0 {
+		cursor = args[0]
+	}
+	ctx = mctx.Annotate(ctx, "historyAccountID", accountID, "cursor", cursor)
+
+	mlog.From(a.cmp).Info("getting history", ctx)
+	entries, nextCursor, err := a.bank.History(accountID, cursor, historyPageSize)
+	if err != nil {
+		return err
+	}
+
+	var loc *time.Location
+	if loc = a.userLocation(req.user.ID); loc == nil {
+		loc = time.UTC
+	}
+
+	strb := new(strings.Builder)
+	for _, e := range entries {
+		sign, amount := "+", e.Amount
+		if amount < 0 {
+			sign, amount = "-", -amount
+		}
+		desc := describeHistoryEntry(e)
+		if e.Reason != "" {
+			desc += ": _" + e.Reason + "_"
+		}
+		fmt.Fprintf(strb, "`%s` %s%s %s\n",
+			e.Time.In(loc).Format("Jan 2 15:04"),
+			sign, a.formatNumber(amount), desc)
+	}
+	if len(entries) == 0 {
+		strb.WriteString("nothing to see here\n")
+	}
+
+	msg := slackbot.NewMessage("%s", strb.String())
+	if nextCursor != "" {
+		next := nextCursor
+		if accountID != req.accountID {
+			next = "<@" + userIDFromAccountID(accountID) + "> " + next
+		}
+		msg.Context("There's more, use `history %s` to see the next page", next)
+	} else {
+		msg.Context("That's everything")
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
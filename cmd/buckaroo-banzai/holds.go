@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+)
+
+// holdReaperBatch is how many expired holds are read from the bank at a time.
+const holdReaperBatch = 100
+
+// holdReaper periodically releases holds which have expired, so that funds
+// held for something which was abandoned, e.g. a confirmation nobody answered,
+// go back to their owner rather than being stranded. Releasing is atomic, so
+// it's safe for every instance to run it at once.
+type holdReaper struct {
+	cmp      *mcmp.Component
+	interval time.Duration
+}
+
+func instHoldReaper(parent *mcmp.Component) *holdReaper {
+	cmp := parent.Child("hold-reaper")
+	hr := &holdReaper{cmp: cmp}
+
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("How often to release held funds whose hold has expired. 0 disables releasing them."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if hr.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --hold-reaper-interval: %w", err)
+		}
+		return nil
+	})
+
+	return hr
+}
+
+// releaseExpiredHolds releases every hold which has expired as of now,
+// returning how many were released.
+func (a *app) releaseExpiredHolds(ctx context.Context) (int, error) {
+	var released int
+	for {
+		holds, err := a.bank.ExpiredHolds(time.Now(), holdReaperBatch)
+		if err != nil {
+			return released, fmt.Errorf("getting expired holds: %w", err)
+		}
+
+		for _, hold := range holds {
+			_, newBalance, err := a.bank.Release(hold.ID)
+			if errors.Is(err, bank.ErrHoldNotFound) {
+				// captured or released since it was read.
+				continue
+			} else if err != nil {
+				return released, fmt.Errorf("releasing hold %q: %w", hold.ID, err)
+			}
+			mlog.From(a.cmp).Info("released expired hold", mctx.Annotate(ctx,
+				"holdID", hold.ID,
+				"userID", hold.UserID,
+				"amount", hold.Amount,
+				"expires", hold.Expires.String(),
+				"newBalance", newBalance))
+			released++
+		}
+
+		if len(holds) < holdReaperBatch {
+			return released, nil
+		}
+	}
+}
+
+// runHoldReaper releases expired holds every --hold-reaper-interval, until the
+// Context is canceled.
+func (a *app) runHoldReaper(ctx context.Context) {
+	reap := func() {
+		if _, err := a.releaseExpiredHolds(ctx); err != nil {
+			mlog.From(a.cmp).Error("error releasing expired holds", ctx, merr.Context(err))
+		}
+	}
+
+	reap()
+	ticker := time.NewTicker(a.holdReaper.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reap()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+)
+
+func TestReleaseExpiredHolds(t *T) {
+	a := &app{
+		cmp:  mtest.Component(),
+		bank: bank.NewInMem(),
+	}
+	_, err := a.bank.Incr("U1", 10)
+	massert.Require(t, massert.Nil(err))
+
+	hold := func(amount int, ttl time.Duration) string {
+		holdID, _, err := a.bank.Hold("U1", amount, ttl)
+		massert.Require(t, massert.Nil(err))
+		return holdID
+	}
+	expiredID := hold(1, time.Millisecond)
+	hold(2, time.Millisecond)
+	keptID := hold(3, 0)
+	hold(4, time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, err = a.bank.Capture(expiredID, "U2")
+	massert.Require(t, massert.Equal(true, errors.Is(err, bank.ErrHoldExpired)))
+
+	released, err := a.releaseExpiredHolds(context.Background())
+	massert.Require(t, massert.Nil(err), massert.Equal(2, released))
+	balance, err := a.bank.Balance("U1")
+	massert.Require(t, massert.Nil(err), massert.Equal(3, balance))
+
+	// holds which haven't expired, or never will, are left alone.
+	released, err = a.releaseExpiredHolds(context.Background())
+	massert.Require(t, massert.Nil(err), massert.Equal(0, released))
+	_, newDstBalance, err := a.bank.Capture(keptID, "U2")
+	massert.Require(t, massert.Nil(err), massert.Equal(3, newDstBalance))
+}
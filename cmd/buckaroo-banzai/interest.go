@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+)
+
+// When interest is next due is stored under interestNextMetaKey, for the
+// interestMetaID rather than a user, as an RFC3339 time.
+const (
+	interestMetaID      = "interest"
+	interestNextMetaKey = "interestNext"
+)
+
+// interestEngine periodically pays interest on every positive balance, or
+// takes demurrage from them if its rate is negative, so that operators can
+// reward saving, or keep the economy circulating by making hoarding cost
+// something. Each period's interest is applied to every account in one atomic
+// operation, see bank.Bank.ApplyInterest.
+type interestEngine struct {
+	cmp *mcmp.Component
+
+	// rate is out of bank.InterestRateScale, and is zero if interest is
+	// disabled.
+	rate       int
+	period     string
+	interval   time.Duration
+	maxCatchUp int
+}
+
+func instInterestEngine(parent *mcmp.Component) *interestEngine {
+	cmp := parent.Child("interest")
+	ie := &interestEngine{cmp: cmp}
+
+	rate := mcfg.Float64(cmp, "rate",
+		mcfg.ParamDefault(0),
+		mcfg.ParamUsage("Percent of each positive balance which is paid as interest every period, or taken as demurrage if negative. 0 disables interest."))
+	period := mcfg.String(cmp, "period",
+		mcfg.ParamDefault(allowanceMonthly),
+		mcfg.ParamUsage("How often interest is applied, one of daily, weekly or monthly."))
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("How often to check whether interest is due."))
+	maxCatchUp := mcfg.Int(cmp, "max-catch-up",
+		mcfg.ParamDefault(4),
+		mcfg.ParamUsage("Most periods of interest which are applied at once, when catching up on those which were missed while buckaroo was down. Any missed before those are skipped."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		ie.rate = int(math.Round(*rate * bank.InterestRateScale / 100))
+		if *rate != 0 && ie.rate == 0 {
+			return fmt.Errorf("--interest-rate %v is too small, it must be at least %v", *rate, 100.0/bank.InterestRateScale)
+		} else if ie.rate <= -bank.InterestRateScale {
+			return errors.New("--interest-rate must be more than -100")
+		}
+
+		switch ie.period = *period; ie.period {
+		case allowanceDaily, allowanceWeekly, allowanceMonthly:
+		default:
+			return fmt.Errorf("--interest-period must be daily, weekly or monthly, not %q", ie.period)
+		}
+
+		var err error
+		if ie.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --interest-interval: %w", err)
+		} else if ie.maxCatchUp = *maxCatchUp; ie.maxCatchUp < 1 {
+			return errors.New("--interest-max-catch-up must be at least 1")
+		}
+		return nil
+	})
+
+	return ie
+}
+
+// interestNext returns when interest is next due, or the zero time if it's
+// never been scheduled.
+func (a *app) interestNext() (time.Time, error) {
+	str, err := a.bank.GetMeta(interestMetaID, interestNextMetaKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("getting when interest is next due: %w", err)
+	} else if str == "" {
+		return time.Time{}, nil
+	}
+	next, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing when interest is next due: %w", err)
+	}
+	return next, nil
+}
+
+func (a *app) setInterestNext(next time.Time) error {
+	if err := a.bank.SetMeta(interestMetaID, interestNextMetaKey, next.UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("storing when interest is next due: %w", err)
+	}
+	return nil
+}
+
+// applyInterest applies the period of interest which was due at the given
+// time. It's done with an idempotency key of the period, so that if it was
+// applied but moving on to the next period failed then it isn't applied again.
+// Demurrage isn't taken from users who were away when it was due.
+func (a *app) applyInterest(ctx context.Context, due time.Time) error {
+	exclude := []string{giftcardEscrowAccountID}
+	if a.interest.rate < 0 {
+		awayAccountIDs, err := a.awayAccountIDs(due)
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, awayAccountIDs...)
+		ctx = mctx.Annotate(ctx, "awayAccounts", len(awayAccountIDs))
+	}
+
+	changes, err := a.bank.ApplyInterest(
+		"interest:"+strconv.FormatInt(due.Unix(), 10),
+		bank.DefaultCurrency, a.interest.rate, exclude...,
+	)
+	if errors.Is(err, bank.ErrDuplicate) {
+		mlog.From(a.cmp).Warn("interest was already applied for period", ctx)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("applying interest: %w", err)
+	}
+
+	var total int
+	for _, change := range changes {
+		total += change
+	}
+	a.audit(mctx.Annotate(ctx, "accounts", len(changes), "total", total), "interest applied")
+	return nil
+}
+
+// applyDueInterest applies interest for every period which is due as of now,
+// including any which were missed while buckaroo was down, up to
+// --interest-max-catch-up of them. The first period is scheduled to end a
+// period after interest is first enabled, rather than applying any straight
+// away.
+func (a *app) applyDueInterest(ctx context.Context, now time.Time) error {
+	ctx = mctx.Annotate(ctx, "rate", a.interest.rate, "period", a.interest.period)
+
+	next, err := a.interestNext()
+	if err != nil {
+		return err
+	} else if next.IsZero() {
+		next = allowanceNext(now, a.interest.period)
+		mlog.From(a.cmp).Info("scheduling first period of interest", mctx.Annotate(ctx, "next", next.String()))
+		return a.setInterestNext(next)
+	}
+
+	var due []time.Time
+	for ; !next.After(now); next = allowanceNext(next, a.interest.period) {
+		due = append(due, next)
+	}
+	if skip := len(due) - a.interest.maxCatchUp; skip > 0 {
+		mlog.From(a.cmp).Warn("too many periods of interest were missed, skipping the oldest", mctx.Annotate(ctx,
+			"skipped", skip, "skippedFrom", due[0].String()))
+		due = due[skip:]
+	}
+
+	for _, dueAt := range due {
+		if err := a.applyInterest(mctx.Annotate(ctx, "due", dueAt.String()), dueAt); err != nil {
+			return err
+		} else if err := a.setInterestNext(allowanceNext(dueAt, a.interest.period)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runInterest applies due interest every --interest-interval, until the
+// Context is canceled.
+func (a *app) runInterest(ctx context.Context) {
+	apply := func() {
+		if err := a.applyDueInterest(ctx, time.Now()); err != nil {
+			mlog.From(a.cmp).Error("error applying interest", ctx, merr.Context(err))
+		}
+	}
+
+	apply()
+	ticker := time.NewTicker(a.interest.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			apply()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+)
+
+func TestInterest(t *T) {
+	cmp := mtest.Component()
+	a := &app{
+		cmp:  cmp,
+		bank: bank.NewInMem(),
+		interest: &interestEngine{
+			rate:       bank.InterestRateScale / 100,
+			period:     allowanceDaily,
+			maxCatchUp: 2,
+		},
+	}
+
+	mtest.Run(cmp, t, func() {
+		_, err := a.bank.Incr("U1", 1000)
+		massert.Require(t, massert.Nil(err))
+		_, err = a.bank.Incr(giftcardEscrowAccountID, 1000)
+		massert.Require(t, massert.Nil(err))
+
+		ctx := context.Background()
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		apply := func(now time.Time) {
+			massert.Require(t, massert.Nil(a.applyDueInterest(ctx, now)))
+		}
+
+		// the first period only ends a period after interest is enabled.
+		start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+		apply(start)
+		next, err := a.interestNext()
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(true, next.Equal(start.AddDate(0, 0, 1))),
+			massert.Equal(1000, balanceOf("U1")),
+		)
+
+		// it's applied once the period ends, and only once.
+		apply(next)
+		apply(next)
+		massert.Require(t,
+			massert.Equal(1010, balanceOf("U1")),
+			massert.Equal(1000, balanceOf(giftcardEscrowAccountID)),
+		)
+
+		// after being down for 5 days only the last 2 are caught up on.
+		apply(next.AddDate(0, 0, 5))
+		massert.Require(t, massert.Equal(1030, balanceOf("U1")))
+		next, err = a.interestNext()
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(true, next.Equal(start.AddDate(0, 0, 7))),
+		)
+
+		// demurrage takes from balances instead, except from those of users
+		// who are away.
+		_, err = a.bank.Incr("U2", 1000)
+		massert.Require(t, massert.Nil(err))
+		massert.Require(t, massert.Nil(a.bank.SetMeta("U2", awayMetaKey, next.AddDate(0, 0, 14).Format(time.RFC3339))))
+		a.interest.rate = -bank.InterestRateScale / 10
+		apply(next)
+		massert.Require(t,
+			massert.Equal(927, balanceOf("U1")),
+			massert.Equal(1000, balanceOf("U2")),
+		)
+
+		// once they're back it's taken from them too.
+		massert.Require(t, massert.Nil(a.bank.SetMeta("U2", awayMetaKey, next.Format(time.RFC3339))))
+		apply(next.AddDate(0, 0, 1))
+		massert.Require(t,
+			massert.Equal(835, balanceOf("U1")),
+			massert.Equal(900, balanceOf("U2")),
+		)
+	})
+}
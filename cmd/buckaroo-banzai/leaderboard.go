@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// leaderboardSize is how many accounts the leaderboard command lists.
+const leaderboardSize = 10
+
+// systemAccountIDs are the accounts which funds are kept in on behalf of
+// buckaroo, rather than of a user, and so are left off the leaderboard.
+var systemAccountIDs = map[string]bool{
+	giftcardEscrowAccountID: true,
+}
+
+func (a *app) cmdLeaderboard(ctx context.Context, req commandReq) error {
+	// the bank doesn't know which accounts are system accounts, so enough are
+	// asked for that there's still a full leaderboard without them.
+	mlog.From(a.cmp).Info("getting top balances", ctx)
+	top, err := a.bank.Top(leaderboardSize + len(systemAccountIDs))
+	if err != nil {
+		return err
+	}
+	accounts := top[:0]
+	for _, account := range top {
+		if !systemAccountIDs[account.UserID] && len(accounts) < leaderboardSize {
+			accounts = append(accounts, account)
+		}
+	}
+
+	if len(accounts) == 0 {
+		a.reply(req, "nobody has any %s yet :cold_face:", a.currencyString(2, false))
+		return nil
+	}
+
+	strb := new(strings.Builder)
+	for i, account := range accounts {
+		// the place is still shown, so that it's clear someone is there.
+		if ok, err := a.canSeeBalance(req, account.UserID); err != nil {
+			return err
+		} else if !ok {
+			fmt.Fprintf(strb, "%d. _someone who keeps their balance private_\n", i+1)
+			continue
+		}
+		fmt.Fprintf(strb, "%d. <@%s> has %s\n",
+			i+1, userIDFromAccountID(account.UserID),
+			a.formatAmount(account.Balance, false))
+	}
+
+	msg := slackbot.NewMessage(":moneybag: who has the most %s\n%s", a.currencyString(2, false), strb.String())
+	msg.Context("Only balances you're allowed to see are shown, see `privacy`")
+	a.replyMsg(req, msg)
+	return nil
+}
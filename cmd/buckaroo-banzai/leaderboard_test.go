@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"strings"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestLeaderboard(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		currencyName: "BUCK",
+	}
+
+	mtest.Run(cmp, t, func() {
+		user := fs.AddUser("U1", "u1", "T1")
+		channel := fs.AddChannel("C1", false)
+		for accountID, amount := range map[string]int{"U1": 5, giftcardEscrowAccountID: 10} {
+			_, err := a.bank.Incr(accountID, amount)
+			massert.Require(t, massert.Nil(err))
+		}
+
+		// system accounts aren't users, so aren't on the leaderboard, even
+		// when they'd be at the top of it.
+		err := a.cmdLeaderboard(context.Background(), commandReq{
+			channelID: channel.ID,
+			channel:   channel,
+			user:      user,
+			accountID: user.ID,
+		})
+		massert.Require(t, massert.Nil(err))
+		sent := fs.Flush()
+		massert.Require(t, massert.Length(sent, 1))
+		massert.Require(t,
+			massert.Equal(true, strings.Contains(sent[0].Text, "1. <@U1>")),
+			massert.Equal(false, strings.Contains(sent[0].Text, giftcardEscrowAccountID)),
+			massert.Equal(false, strings.Contains(sent[0].Text, "2.")),
+		)
+	})
+}
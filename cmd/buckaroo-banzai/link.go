@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/strkey"
+)
+
+// linkedAddressMetaKey is the bank metadata key which a user's linked stellar
+// address is stored under. Linking an address lets buckaroo tell the user
+// about things which happen with it, like deposits from it failing.
+const linkedAddressMetaKey = "stellarAddress"
+
+// accountIDByLinkedAddress returns the account ID of the user who has linked
+// the given stellar address, or false if nobody has. If more than one user has
+// linked the address then nobody is considered to have linked it, since
+// there's no way to tell who it really belongs to.
+func (a *app) accountIDByLinkedAddress(addr string) (string, bool, error) {
+	linked, err := a.bank.AllMeta(linkedAddressMetaKey)
+	if err != nil {
+		return "", false, fmt.Errorf("getting all linked addresses: %w", err)
+	}
+
+	var accountID string
+	for linkedAccountID, linkedAddr := range linked {
+		if linkedAddr != addr {
+			continue
+		} else if accountID != "" {
+			return "", false, nil
+		}
+		accountID = linkedAccountID
+	}
+	return accountID, accountID != "", nil
+}
+
+func (a *app) cmdLink(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		addr, err := a.bank.GetMeta(req.accountID, linkedAddressMetaKey)
+		if err != nil {
+			return err
+		} else if addr == "" {
+			a.reply(req, "you haven't linked a stellar address. usage: `link <stellar address>`")
+		} else {
+			a.reply(req, "your linked stellar address is `%s`", addr)
+		}
+		return nil
+	}
+
+	addr := req.args[0]
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, addr); err != nil {
+		a.reply(req, "`%s` isn't a stellar address, it should look like `G...`", addr)
+		return nil
+	}
+
+	mlog.From(a.cmp).Info("linking stellar address", mctx.Annotate(ctx, "addr", addr))
+	if err := a.bank.SetMeta(req.accountID, linkedAddressMetaKey, addr); err != nil {
+		return err
+	}
+	if a.keybaseCompat {
+		a.reply(req, "linked `%s`, deposits from it which don't have your username as the memo will still be credited to you, and I'll DM you if they run into trouble :link:", addr)
+	} else {
+		a.reply(req, "linked `%s`, I'll DM you if deposits from it run into trouble :link:", addr)
+	}
+	return nil
+}
+
+func (a *app) cmdUnlink(ctx context.Context, req commandReq) error {
+	mlog.From(a.cmp).Info("unlinking stellar address", ctx)
+	if err := a.bank.SetMeta(req.accountID, linkedAddressMetaKey, ""); err != nil {
+		return err
+	}
+	a.reply(req, "your stellar address has been unlinked")
+	return nil
+}
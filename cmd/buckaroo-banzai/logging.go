@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonLogHandler returns an mlog.Handler which writes each message to w as a
+// single line of JSON, with all of the message's annotations flattened into
+// one object.
+func jsonLogHandler(w io.Writer) mlog.Handler {
+	var l sync.Mutex
+	return func(msg mlog.Message) error {
+		var aa mctx.AnnotationSet
+		if len(msg.Contexts) > 0 {
+			aa = mctx.Annotations(mctx.MergeAnnotations(msg.Contexts...))
+		}
+
+		b, err := json.Marshal(struct {
+			Time        string            `json:"time"`
+			Level       string            `json:"level"`
+			Description string            `json:"descr"`
+			Annotations map[string]string `json:"annotations,omitempty"`
+		}{
+			Time:        time.Now().UTC().Format(time.RFC3339Nano),
+			Level:       strings.ToLower(msg.Level.String()),
+			Description: msg.Description,
+			Annotations: aa.StringMap(),
+		})
+		if err != nil {
+			return err
+		}
+
+		l.Lock()
+		defer l.Unlock()
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+}
+
+// parseLogLevels parses a comma separated list of "component=level" pairs,
+// where component is the component's path joined with dashes, the same as
+// its params are prefixed with (e.g. "stellar" or "stellar-redis").
+func parseLogLevels(str string) (map[string]mlog.Level, error) {
+	levels := map[string]mlog.Level{}
+	for _, pair := range strings.Split(str, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed pair %q, should be \"component=level\"", pair)
+		}
+		level := mlog.LevelFromString(parts[1])
+		if level == nil {
+			return nil, fmt.Errorf("unknown log level %q", parts[1])
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+// modifyLogger sets a copy of the Logger inherited by cmp onto it, after fn has
+// modified the copy.
+func modifyLogger(cmp *mcmp.Component, fn func(*mlog.Logger)) {
+	l := mlog.GetLogger(cmp).Clone()
+	fn(l)
+	mlog.SetLogger(cmp, l)
+}
+
+// componentsByPath returns all components in the tree rooted at cmp, keyed by
+// their path joined with dashes. The root itself isn't included.
+func componentsByPath(cmp *mcmp.Component) map[string]*mcmp.Component {
+	cmps := map[string]*mcmp.Component{}
+	var walk func(*mcmp.Component)
+	walk = func(cmp *mcmp.Component) {
+		for _, child := range cmp.Children() {
+			cmps[strings.Join(child.Path(), "-")] = child
+			walk(child)
+		}
+	}
+	walk(cmp)
+	return cmps
+}
+
+// instLogging sets up the log format and per-component log levels for every
+// component under root. It should be instantiated before any other components,
+// so that it's initialized first and their init logs come out as configured.
+//
+// The global log level is still set using --log-level, which components
+// without a level of their own are subject to. If a profile is in use then its
+// log level is applied to every component first, and --log-levels overrides it.
+func instLogging(root *mcmp.Component, prof *profile) {
+	cmp := root.Child("log")
+	format := mcfg.String(cmp, "format",
+		mcfg.ParamDefault(logFormatText),
+		mcfg.ParamUsage("Format logs are written in, either \""+logFormatText+"\" or \""+logFormatJSON+"\""))
+	levels := mcfg.String(cmp, "levels",
+		mcfg.ParamUsage("Comma separated list of components and the maximum log level they'll log at, e.g. \"stellar=warn,bank=debug\". Components are named the same as their params are prefixed."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		switch *format {
+		case logFormatText:
+		case logFormatJSON:
+			modifyLogger(root, func(l *mlog.Logger) { l.SetHandler(jsonLogHandler(os.Stderr)) })
+		default:
+			return fmt.Errorf("unknown --log-format %q", *format)
+		}
+
+		if prof.logLevel != "" {
+			modifyLogger(root, func(l *mlog.Logger) { l.SetMaxLevel(mlog.LevelFromString(prof.logLevel)) })
+		}
+
+		levelsByPath, err := parseLogLevels(*levels)
+		if err != nil {
+			return fmt.Errorf("parsing --log-levels: %w", err)
+		}
+		cmps := componentsByPath(root)
+		for path, level := range levelsByPath {
+			levelCmp, ok := cmps[path]
+			if !ok {
+				return fmt.Errorf("parsing --log-levels: unknown component %q", path)
+			}
+			modifyLogger(levelCmp, func(l *mlog.Logger) { l.SetMaxLevel(level) })
+		}
+		mlog.From(cmp).Info("logging configured", mctx.Annotate(ctx,
+			"logFormat", *format, "logLevels", *levels))
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestJSONLogHandler(t *T) {
+	buf := new(bytes.Buffer)
+	h := jsonLogHandler(buf)
+
+	ctxA := mctx.Annotate(context.Background(), "a", 1)
+	ctxB := mctx.Annotate(context.Background(), "b", "two")
+	massert.Require(t, massert.Nil(h(mlog.Message{
+		Level:       mlog.WarnLevel,
+		Description: "something happened",
+		Contexts:    []context.Context{ctxA, ctxB},
+	})))
+
+	var line map[string]interface{}
+	massert.Require(t, massert.Nil(json.Unmarshal(buf.Bytes(), &line)))
+	massert.Require(t,
+		massert.Equal("warn", line["level"]),
+		massert.Equal("something happened", line["descr"]),
+		massert.Equal(map[string]interface{}{"a": "1", "b": "two"}, line["annotations"]),
+	)
+}
+
+func TestParseLogLevels(t *T) {
+	levels, err := parseLogLevels(" stellar=warn, bank=debug,")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(map[string]mlog.Level{
+			"stellar": mlog.WarnLevel,
+			"bank":    mlog.DebugLevel,
+		}, levels),
+	)
+
+	_, err = parseLogLevels("stellar")
+	massert.Require(t, massert.Equal(true, err != nil))
+	_, err = parseLogLevels("stellar=loud")
+	massert.Require(t, massert.Equal(true, err != nil))
+}
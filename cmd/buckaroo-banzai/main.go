@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/m"
@@ -21,39 +24,208 @@ import (
 	"github.com/stellar/go/protocols/horizon/operations"
 
 	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/analytics"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
 	"buckaroo-banzai/stellar"
 )
 
-const exportProtocolStellar = "stellar"
-
-var gitRef string
-
 type app struct {
 	cmp *mcmp.Component
 
 	bank                        bank.ExportingBank
-	slackClient                 *slackClient
+	economy                     *economy.Economy
+	slackClient                 *slackbot.Client
 	stellar                     *stellarServer
+	marketMaker                 *marketMaker
+	stellarHealth               *stellarHealth
+	feeTopUp                    *feeTopUp
+	holdReaper                  *holdReaper
+	scheduledPayments           *paymentScheduler
+	allowances                  *allowanceWorker
+	interest                    *interestEngine
+	suspicious                  *suspiciousActivity
+	chaos                       *chaos
+	alerts                      *alerts
+	earnPolicy                  *earnPolicy
+	github                      *gitHub
+	autoReact                   *autoReact
+	quietHours                  *quietHours
+	scheduler                   *scheduler
+	analytics                   *analytics.Exporter
+	metrics                     *metrics
 	currencyName, currencyEmoji string
+	currency                    currencyFormat
+
+	// codes of other currencies, e.g. seasonal tokens, which are issued
+	// alongside the currency. See bank.CurrencyAccountID.
+	extraCurrencies []string
+
+	// guards settings which admins can change at runtime, see setupSettings,
+	// and the values they had before any were changed.
+	settingsL     sync.RWMutex
+	setupDefaults map[string]string
+
+	// all slack API calls go through this, which is usually just slackClient.
+	slack slackbot.API
+
+	// turns incoming slack events into commands and reactions.
+	bot *slackbot.Bot
+
+	// if set then this wraps bank, and needs to be synced periodically.
+	balanceCache             *bank.BalanceCache
+	balanceCacheSyncInterval time.Duration
+
+	// if set then notifications are DM'd through this, see notify.
+	dmDigest *slackbot.Digest
+
+	// if set then notifications which fail to be DM'd are retried through
+	// this, and those it gives up on are shown the next time the user runs a
+	// command.
+	dmRetry *slackbot.DMRetry
 
 	// if true then buckaroo won't speak or listen to anyone speaking to him.
 	ghost bool
+
+	// true if the stellar client is connected to testnet, which enables the
+	// faucet command.
+	testNet bool
+
+	// roles given to slack user IDs via configuration, see roles.go.
+	configRoles map[string]role
+
+	// deposits made with this memo are burned rather than credited to anyone.
+	burnMemo string
+
+	// optional channel which announcements are made into.
+	announceChannelID string
+
+	// conversion rates for assets other than the currency which are accepted
+	// as deposits, and whether to refund those deposits when they can't be
+	// credited.
+	depositRates   map[string]float64
+	refundDeposits bool
+
+	// if set then deposits are handled in a way which works with wallets, like
+	// keybase, which set the memo themselves. See accountIDByMemo.
+	keybaseCompat bool
+
+	// how users from other slack teams are handled, see teams.go.
+	foreignTeamPolicy string
+
+	// number of exports which can be processed concurrently.
+	exportWorkers int
+
+	// the bank consumer group which exports are consumed as part of.
+	exportGroup string
+
+	// once exhausted, export consumption is paused for a while.
+	exportBudget *errorBudget
+
+	// exports older than this are trimmed from the bank. 0 disables.
+	exportRetention time.Duration
+
+	// see configFingerprint.
+	configFingerprint string
+
+	// number of slack events which can be processed concurrently, and how many
+	// can be waiting on each worker before new ones get dropped.
+	slackEventWorkers, slackEventQueueSize int
+
+	// the most each API key can credit per day, in whole units of the
+	// currency, unless the key has its own quota. See credit.go.
+	apiCreditQuota int
+
+	// a lock which allowances are created, deleted and paid under. See
+	// allowance.go.
+	allowancesL sync.Mutex
+
+	// held while the IDs of notifications sent to a user are being checked
+	// and recorded. See notifyOnce.
+	notifiedL sync.Mutex
+
+	// how long gift cards can be redeemed for before they're refunded, and a
+	// lock which gift cards are created, redeemed and refunded under. See
+	// giftcard.go.
+	giftcardTTL time.Duration
+	giftcardL   sync.Mutex
+
+	// withdrawals of more than withdrawDelayAbove, in whole units of the
+	// currency, are delayed for withdrawDelay before they're submitted, and a
+	// lock which delayed withdrawals are created, canceled and submitted
+	// under. See withdrawdelay.go.
+	withdrawDelayAbove int
+	withdrawDelay      time.Duration
+	withdrawDelayL     sync.Mutex
+
+	// a lock which withdrawals asked for outside of DMs are stored and
+	// confirmed under. See withdrawconfirm.go.
+	withdrawConfirmL sync.Mutex
+
+	// mints and buybacks of more than approvalAbove, in whole units of the
+	// currency, need a second admin to approve them, and a lock which they're
+	// requested, approved and rejected under. See adminapproval.go.
+	approvalAbove int
+	approvalL     sync.Mutex
+
+	// how long a split request waits to be answered before its payer is
+	// reminded of it, and a lock which split requests are answered and
+	// reminded about under. See split.go.
+	splitRemindInterval time.Duration
+	splitL              sync.Mutex
+
+	// the most recently published proof of reserves, and a lock which it's
+	// generated and read under. See reserves.go.
+	reserves  *signedReserves
+	reservesL sync.Mutex
+
+	// the aliases which have been recorded for accounts by this process, and
+	// a lock which they're recorded under. See alias.go.
+	aliases  map[string]string
+	aliasesL sync.Mutex
+}
+
+// asset returns the stellar asset which represents the currency on-chain.
+func (a *app) asset() stellar.Asset {
+	return stellar.Asset{Code: a.currencyName, Issuer: a.stellar.issuer()}
 }
 
-// currencyString returns the currency's name, formatted based on the amount
-// which is being described. -1 can be given if the amount is not known.
-//
-// If emojiOk is given and the app was configured with an emoji for the currency
-// then that will be returned instead.
-func (a *app) currencyString(amount int, emojiOk bool) string {
-	if emojiOk && a.currencyEmoji != "" {
-		return a.currencyEmoji
-	} else if amount == 0 || amount > 1 {
-		return a.currencyName + "s"
-	} else if amount == 1 {
-		return a.currencyName
-	}
-	return a.currencyName + "(s)"
+// assetIn is like asset, but for the given currency, which is either
+// bank.DefaultCurrency or one of the extra currencies.
+func (a *app) assetIn(currency string) stellar.Asset {
+	if currency == bank.DefaultCurrency {
+		return a.asset()
+	}
+	return stellar.Asset{Code: currency, Issuer: a.stellar.issuer()}
+}
+
+// economyOpts returns the options which the app's economy is created with,
+// based on the app's configuration.
+func (a *app) economyOpts() economy.Opts {
+	opts := economy.Opts{
+		Bank:            a.bank,
+		Stellar:         a.stellar.client,
+		KeyPair:         a.stellar.kp,
+		Asset:           a.asset(),
+		Decimals:        a.currency.decimals,
+		Currencies:      a.extraCurrencies,
+		Timeout:         a.stellar.timeout,
+		DepositRates:    a.depositRates,
+		RefundDeposits:  a.refundDeposits,
+		AccountIDByMemo: a.accountIDByMemo,
+	}
+	if a.feeTopUp != nil && a.feeTopUp.kp != nil {
+		opts.FeeFundingAddress = a.feeTopUp.kp.Address()
+	}
+	if a.keybaseCompat {
+		opts.AccountIDByAddress = a.accountIDByLinkedAddress
+	}
+	if !a.stellar.isAnchor() {
+		// an anchor receives deposits into its distribution account, so
+		// sending it the currency doesn't burn anything.
+		opts.BurnMemo = a.burnMemo
+	}
+	return opts
 }
 
 const helpMsg = "you appear to be lost, try DM'ing me with the message `help` and I'll try to hook you up."
@@ -61,8 +233,8 @@ const helpMsg = "you appear to be lost, try DM'ing me with the message `help` an
 func (a *app) fullHelpMsg() string {
 
 	emojiHelp := ""
-	if a.currencyEmoji != "" {
-		emojiHelp = " (" + a.currencyEmoji + ")"
+	if emoji := a.emoji(); emoji != "" {
+		emojiHelp = " (" + emoji + ")"
 	}
 
 	strb := new(strings.Builder)
@@ -75,24 +247,86 @@ func (a *app) fullHelpMsg() string {
 // prints this message
 @%s help
 
-// I will respond with your bank balance
-@%s balance
+// I will respond with your bank balance, or someone else's if they let you
+@%s balance [@<user>]
+
+// I will list what's been added to and taken from your balance, most recent first
+@%s history
+
+// choose who can see your balance. friends are added with friend/unfriend
+@%s privacy [private|friends|public]
+@%s friend @<user>
+
+// link your stellar address, so I can tell you if deposits from it fail
+@%s link <stellar address>
+
+// hold your notifications while you're away, e.g. for 2w or 3d
+@%s away <duration>
+@%s back
 
 // transfer your %s to another user's slack bank
-@%s give <amount> @<user>
+@%s give <amount> @<user> [<reason>]
+
+// see who's given away the most this month
+@%s generous
+
+// see who has the most %s
+@%s leaderboard
 
-// withdraw %s to <stellar/federated address>
+// see how much has been minted, burned and withdrawn lately
+@%s economy
+
+// create a one-time code which anyone can redeem for <amount>
+@%s giftcard create <amount>
+@%s giftcard redeem <code>
+
+// ask each <user> to pay you their share of <amount>, or see pending requests
+@%s split <amount> between @<user> @<user>...
+@%s split
+
+// pay <user> <amount> later, e.g. tomorrow, in 3d or on 2024-01-31, or see and cancel those you've scheduled
+@%s pay @<user> <amount> <when>
+@%s payments [cancel <id>]
+
+// withdraw %s to <stellar/federated address>. outside of DMs, I'll DM you to confirm it first
 @%s withdraw <amount> <stellar/federated address> [<memo>]
-`, a.slackClient.botUser, a.slackClient.botUser, a.currencyString(2, false),
-		a.slackClient.botUser, a.currencyString(2, false), a.slackClient.botUser,
+
+// see or cancel large withdrawals which are waiting to be sent
+@%s withdrawals [cancel <id>]
+`, a.slackClient.BotUser, a.slackClient.BotUser, a.slackClient.BotUser,
+		a.slackClient.BotUser, a.slackClient.BotUser, a.slackClient.BotUser,
+		a.slackClient.BotUser, a.slackClient.BotUser,
+		a.currencyString(2, false),
+		a.slackClient.BotUser, a.slackClient.BotUser,
+		a.currencyString(2, false), a.slackClient.BotUser,
+		a.slackClient.BotUser, a.slackClient.BotUser,
+		a.slackClient.BotUser, a.slackClient.BotUser, a.slackClient.BotUser,
+		a.slackClient.BotUser, a.slackClient.BotUser,
+		a.currencyString(2, false), a.slackClient.BotUser,
+		a.slackClient.BotUser,
 	)
+	if a.testNet {
+		fmt.Fprintf(strb, `
+// get some testnet XLM sent to <stellar address>, to try out withdrawing
+@%s faucet <stellar address>
+`, a.slackClient.BotUser)
+	}
 	fmt.Fprintf(strb, "```\n")
 
 	fmt.Fprintf(strb, "-----\n*Withdrawing*\n")
-	fmt.Fprintf(strb, "to withdraw %s into your own stellar wallet (e.g. keybase) you must first add a trustline with the issuer `%s` and the asset `%s` to your wallet. once done, use the `withdraw` command to send yourself those sweet sweet cryptos.\n", a.currencyString(2, true), a.stellar.kp.Address(), a.currencyName)
+	fmt.Fprintf(strb, "use the `withdraw` command to send yourself those sweet sweet cryptos. your stellar wallet needs a trustline for %s first, if it doesn't have one I'll DM you how to add it.\n", a.currencyString(2, true))
 
 	fmt.Fprintf(strb, "-----\n*Depositing*\n")
 	fmt.Fprintf(strb, "to deposit %s from your stellar wallet back into a slack account simply send the tokens to the stellar address `<username>*%s`. The username _must_ be the same as the slack username (the one used when you @ someone).", a.currencyString(2, true), a.stellar.domain)
+	if a.burnMemo != "" && !a.stellar.isAnchor() {
+		fmt.Fprintf(strb, " tokens sent to `%s` with the memo `%s` will be burned instead of deposited.", a.stellar.kp.Address(), a.burnMemo)
+	}
+
+	if len(a.extraCurrencies) > 0 {
+		fmt.Fprintf(strb, "\n-----\n*Other currencies*\n")
+		fmt.Fprintf(strb, "I also bank %s, which are kept separate from your %s. put one of their codes after the amount when giving or withdrawing to use it instead, e.g. `give 5 %s @<user>`, and your `balance` will list any you have. they're deposited the same way as %s.",
+			strings.Join(a.extraCurrencies, ", "), a.currencyString(2, false), a.extraCurrencies[0], a.currencyString(2, false))
+	}
 
 	return strb.String()
 }
@@ -100,250 +334,227 @@ func (a *app) fullHelpMsg() string {
 // wow, regexes are fucking ugly
 var slackUnFormatRegex = regexp.MustCompile(`([^*]+)\*<[^|]+\|([^>]+)>`)
 
-func (a *app) processSlackMsg(ctx context.Context, channelID, userID, msg string) error {
-	if userID == a.slackClient.botUserID {
-		// ignore messages sent by the bot itself. Can happen during testing
-		// when there's two running bots
-		return nil
-	}
-
-	ctx = mctx.Annotate(ctx, "channelID", channelID)
-	channel, err := a.slackClient.getChannel(channelID)
-	if err != nil {
-		return fmt.Errorf("couldn't get slack channel %v: %w", channelID, err)
+// handleCommand handles a command which was directed at buckaroo, replying to
+// the user with the result.
+func (a *app) handleCommand(ctx context.Context, cmd slackbot.Command) error {
+	req := commandReq{
+		channelID: cmd.Channel.ID,
+		channel:   cmd.Channel,
+		user:      cmd.User,
+		args:      cmd.Args,
+		messageTS: cmd.Timestamp,
 	}
-	isIM := channel.IsIM
-	ctx = mctx.Annotate(ctx, "userID", userID, "channel", channel.Name, "isIM", isIM)
 
-	user, err := a.slackClient.getUser(userID)
-	if err != nil {
-		return fmt.Errorf("couldn't get slack user %v: %w", userID, err)
-	}
-	ctx = mctx.Annotate(ctx, "user", user.Name)
-
-	msg = strings.TrimSpace(msg)
-	prefix := "<@" + a.slackClient.botUserID + ">"
-	if !strings.HasPrefix(msg, prefix) && !isIM {
+	accountID, err := a.accountID(cmd.User)
+	if errors.Is(err, errForeignTeam) {
+		a.reply(req, err.Error())
 		return nil
+	} else if err != nil {
+		return err
 	}
-	msg = strings.TrimPrefix(msg, prefix)
-	fields := strings.Fields(msg)
-
-	sendMsg := func(channelID string, str string, args ...interface{}) {
-		str = fmt.Sprintf(str, args...)
-		if !channel.IsIM {
-			str = fmt.Sprintf("<@%s> %s", userID, str)
-		}
-		outMsg := a.slackClient.RTM.NewOutgoingMessage(str, channelID)
-		a.slackClient.RTM.SendMessage(outMsg)
+	req.accountID = accountID
+	ctx = mctx.Annotate(ctx, "accountID", accountID)
+	if err := a.recordAlias(accountID, cmd.User); err != nil {
+		mlog.From(a.cmp).Warn("error recording alias", ctx, merr.Context(err))
 	}
+	a.replyUndelivered(req)
 
-	if len(fields) < 1 {
-		sendMsg(channelID, helpMsg)
+	if cmd.Name == "" {
+		a.reply(req, helpMsg)
 		return nil
 	}
 
-	var outErr error
-	switch strings.ToLower(fields[0]) {
-	case "ref":
-		sendMsg(channelID, "Current git ref is `%s`", gitRef)
-
-	case "help":
-		sendMsg(channelID, a.fullHelpMsg())
+	if req.role, err = a.roleOf(accountID); err != nil {
+		return err
+	}
 
-	case "balance":
-		ctx = mctx.Annotate(ctx, "command", "balance")
-		mlog.From(a.cmp).Info("getting user balance", ctx)
-		balance, err := a.bank.Balance(userID)
-		if err != nil {
-			outErr = err
-			break
-		}
-		if balance == 0 {
-			sendMsg(channelID, "sorry champ, you don't have any %s :( if you're having trouble getting %s, try being cool!", a.currencyString(2, false), a.currencyString(2, false))
-		} else if balance < 0 {
-			sendMsg(channelID, "you have %d %s... that's not even possible :face_with_monocle:", balance, a.currencyString(balance, true))
+	c, ok := commands[cmd.Name]
+	if !ok {
+		if suggestion, ok := suggestCommand(cmd.Name, req.role); ok {
+			a.reply(req, "I don't know `%s`, did you mean `%s`?", cmd.Name, suggestion)
 		} else {
-			sendMsg(channelID, "you have %d %s !", balance, a.currencyString(balance, true))
+			a.reply(req, helpMsg)
 		}
+		return nil
+	}
+	ctx = mctx.Annotate(ctx, "command", cmd.Name)
 
-	case "give":
-		if len(fields) < 3 {
-			sendMsg(channelID, helpMsg)
-			break
-		}
-		ctx = mctx.Annotate(ctx, "amount", fields[1])
-		amount, err := strconv.Atoi(fields[1])
-		if err != nil {
-			outErr = err
-			break
-		} else if amount <= 0 {
-			outErr = errors.New("amount must be greater than 0")
-			break
-		}
-
-		ctx = mctx.Annotate(ctx, "command", "give", "dstUserID", fields[2])
-		dstUser, err := a.slackClient.getUser(fields[2])
-		if err != nil {
-			outErr = err
-			break
-		}
-		ctx = mctx.Annotate(ctx, "dstUser", dstUser.Name, "dstUserID", dstUser.ID)
-
-		if dstUser.ID == userID {
-			sendMsg(channelID, "quit playing with yourself, kid")
-			break
-		}
-
-		mlog.From(a.cmp).Info("giving bucks", ctx)
-		dstBalance, _, err := a.bank.Transfer(dstUser.ID, user.ID, amount)
-		if err != nil {
-			outErr = err
-			break
-		}
-
-		sendMsg(channelID, "you gave <@%s> %d %s :money_with_wings:", dstUser.ID, amount, a.currencyString(amount, true))
-
-		// don't dm a bot, it errors out
-		if dstUser.IsBot {
-			break
-		}
+	if req.role < c.role {
+		mlog.From(a.cmp).Warn("user attempted command without required role",
+			mctx.Annotate(ctx, "role", req.role.String()))
+		a.reply(req, "nice try, kid")
+		return nil
+	}
+	ctx = mctx.Annotate(ctx, "role", req.role.String())
+
+	ctx, horizonBudget := stellar.WithCallBudget(ctx, horizonBudgets[cmd.Name])
+	start := time.Now()
+	err = c.fn(a, ctx, req)
+	if errors.Is(err, bank.ErrDuplicate) {
+		// the message was delivered more than once, and the first delivery
+		// already did what it asked and replied to it.
+		mlog.From(a.cmp).Info("ignoring command which was already done", ctx)
+		err = nil
+	}
+	a.metrics.command(cmd.Name, time.Since(start), err)
+	a.metrics.commandHorizon(cmd.Name, horizonBudget.Used(), errors.Is(err, stellar.ErrBudgetExceeded))
+	if errors.Is(err, stellar.ErrBudgetExceeded) {
+		mlog.From(a.cmp).Warn("command exceeded its horizon budget",
+			mctx.Annotate(ctx, "horizonCalls", horizonBudget.Used()))
+	}
+	if err != nil {
+		a.reply(req, "%s", a.userErrMsg(err, req.role))
+		return err
+	}
+	return nil
+}
 
-		imChannelID, err := a.slackClient.getIMChannel(dstUser.ID)
-		if err != nil {
-			outErr = err
-			break
-		}
-		// this is hacky, cause sendMsg automatically prefixes everything with
-		// the sender's name, which happens to work here with the sentence.
-		sendMsg(imChannelID, "gave you %d %s, giving you a total of %d", amount, a.currencyString(amount, true), dstBalance)
+const slackInteractionsPath = "/api/v1/slack/interactions"
 
-	case "withdraw":
-		if l := len(fields); l < 3 {
-			sendMsg(channelID, helpMsg)
-			break
-		}
+// slackInteractionsHandler handles clicks on buttons in buckaroo's messages,
+// which slack sends if the slack app's interactivity is pointed here.
+func (a *app) slackInteractionsHandler(rw http.ResponseWriter, r *http.Request) {
+	if a.bot == nil {
+		http.NotFound(rw, r)
+		return
+	}
+	a.bot.ServeInteraction(rw, r)
+}
 
-		amount, err := strconv.Atoi(fields[1])
-		if err != nil {
-			outErr = err
-			break
-		} else if amount <= 0 {
-			outErr = errors.New("amount must be greater than 0")
-			break
-		}
-		amountStr := strconv.Itoa(amount)
-		ctx = mctx.Annotate(ctx, "command", "send", "amount", amount)
+// handleReaction submits an Earn for an added or removed reaction.
+func (a *app) handleReaction(ctx context.Context, r slackbot.Reaction) {
+	a.submitReactionEarn(ctx, r.Type, r.ReactionAddedEvent, r.Delta)
+}
 
-		addr := fields[2]
-		addr = slackUnFormatRegex.ReplaceAllString(addr, `${1}*${2}`)
+// reactionEventID returns an ID which uniquely identifies a reaction event, so
+// that duplicate deliveries of it can be ignored.
+func reactionEventID(eventType string, data slack.ReactionAddedEvent) string {
+	return strings.Join([]string{
+		eventType, data.User, data.Reaction, reactionItemID(data), data.EventTimestamp,
+	}, ":")
+}
 
-		var memo string
-		if len(fields) == 4 {
-			memo = fields[3]
-			ctx = mctx.Annotate(ctx, "memo", memo)
-		}
+// reactionItemID returns an ID which uniquely identifies the item which was
+// reacted to.
+func reactionItemID(data slack.ReactionAddedEvent) string {
+	return strings.Join([]string{
+		data.Item.Channel, data.Item.Timestamp, data.Item.File, data.Item.FileComment,
+	}, ":")
+}
 
-		mlog.From(a.cmp).Info("constructing send XDR", ctx)
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		defer cancel()
-		var txXDR string
-		txXDR, outErr = a.stellar.client.MakeSendXDR(ctx, stellar.SendOpts{
-			From:        a.stellar.kp,
-			To:          addr,
-			Memo:        memo,
-			AssetCode:   a.currencyName,
-			AssetIssuer: a.stellar.kp.Address(),
-			Amount:      amountStr,
-		})
-		if outErr != nil {
-			break
-		}
+// submitReactionEarn submits an Earn to the bank's journal for the author of
+// the item which was reacted to. The Earn is applied to their balance by
+// processEarns. The removed reaction event has the same fields as the added
+// one, so both are handled using ReactionAddedEvent, with a delta of 1 or -1
+// whole unit of the currency respectively.
+func (a *app) submitReactionEarn(ctx context.Context, eventType string, data slack.ReactionAddedEvent, delta int) {
+	ctx = mctx.Annotate(ctx, "itemType", data.Item.Type)
+	itemUser, err := a.reactionItemUser(data)
+	if err != nil {
+		mlog.From(a.cmp).Warn("error resolving author of reacted to item", ctx, merr.Context(err))
+		return
+	} else if itemUser == "" {
+		return
+	}
 
-		mlog.From(a.cmp).Info("submitting XDR to the bank", ctx)
-		var txID string
-		txID, outErr = a.bank.SubmitExport(bank.Export{
-			FromUserID:      userID,
-			Amount:          amount,
-			Protocol:        exportProtocolStellar,
-			ProtocolPayload: txXDR,
-		})
-		if outErr != nil {
-			break
-		}
+	ctx = mctx.Annotate(ctx, "itemUser", itemUser)
+	author, err := a.slack.GetUser(itemUser)
+	if err != nil {
+		mlog.From(a.cmp).Warn("error getting author of reacted to item", ctx, merr.Context(err))
+		return
+	}
+	earnerID, reason := a.earnPolicy.earner(data.User, author)
+	if earnerID == "" {
+		mlog.From(a.cmp).Debug("reaction doesn't earn anything", mctx.Annotate(ctx, "reason", reason))
+		return
+	}
 
-		ctx = mctx.Annotate(ctx, "txID", txID)
-		mlog.From(a.cmp).Info("XDR successfully submitted", ctx)
+	ctx = mctx.Annotate(ctx, "user", earnerID)
+	accountID, ok := a.reactionAccountID(ctx, earnerID)
+	if !ok {
+		return
+	}
 
-		sendMsg(channelID, "you withdrew `%s` %d %s :money_with_wings: :money_with_wings: You'll get a DM when the transaction has been successfully submitted to the network", addr, amount, a.currencyString(amount, true))
+	earn := bank.Earn{
+		EventID: reactionEventID(eventType, data),
+		UserID:  accountID,
+		Amount:  delta * a.currency.unit(),
+		Caps:    a.earnPolicy.earnCaps(data.User, reactionItemID(data), data.Reaction, accountID, time.Now()),
+	}
+	if err := a.economy.Earn(ctx, earn); err != nil {
+		ctx = earn.Annotate(ctx)
+		mlog.From(a.cmp).Error("error submitting earn", ctx, merr.Context(err))
+		a.alerts.alert(ctx, alertRedisError, err, "failed to journal earnings")
+		return
+	}
+	a.trackAutoReact(ctx, data, delta)
+}
 
+// reactionItemUser returns the ID of the user who authored the item which was
+// reacted to. Slack usually includes this in the event, but leaves it out in
+// some cases, e.g. for file comments and some thread replies, in which case
+// the item is looked up.
+func (a *app) reactionItemUser(data slack.ReactionAddedEvent) (string, error) {
+	if data.ItemUser != "" {
+		return data.ItemUser, nil
+	}
+	switch data.Item.Type {
+	case "message":
+		return a.slack.GetMessageUser(data.Item.Channel, data.Item.Timestamp)
+	case "file":
+		return a.slack.GetFileUser(data.Item.File, "")
+	case "file_comment":
+		return a.slack.GetFileUser(data.Item.File, data.Item.FileComment)
 	default:
-		sendMsg(channelID, helpMsg)
+		// nothing to look up, so nobody gets anything.
+		return "", nil
 	}
+}
 
-	if outErr != nil {
-		sendMsg(channelID, "what a bummer: %s", outErr)
-		return outErr
+// reactionAccountID returns the bank account ID of a user whose message has had
+// a reaction added or removed, or false if the user can't earn anything.
+func (a *app) reactionAccountID(ctx context.Context, userID string) (string, bool) {
+	accountID, err := a.accountIDByUserID(userID)
+	if errors.Is(err, errForeignTeam) {
+		mlog.From(a.cmp).Debug("ignoring reaction to message from foreign team user", ctx)
+		return "", false
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error determining user's account", ctx, merr.Context(err))
+		return "", false
 	}
-
-	return nil
+	return accountID, true
 }
 
-func (a *app) processSlackEvent(e slack.RTMEvent) {
-	ctx := context.Background()
-	//{
-	//	b, err := json.MarshalIndent(e, "", "  ")
-	//	if err != nil {
-	//		panic(err)
-	//	}
-	//	fmt.Printf("got message: %s\n", string(b))
-	//}
-
-	switch e.Type {
-	case "reaction_added":
-		data, ok := e.Data.(*slack.ReactionAddedEvent)
-		if !ok || data.User == data.ItemUser || data.ItemUser == "" {
-			return
-		}
-		ctx = mctx.Annotate(ctx, "user", data.ItemUser)
-		mlog.From(a.cmp).Info("incrementing user's balance", ctx)
-		if _, err := a.bank.Incr(data.ItemUser, 1); err != nil {
-			mlog.From(a.cmp).Error("error incrementing user's balance", ctx, merr.Context(err))
-		}
-	case "reaction_removed":
-		data, ok := e.Data.(*slack.ReactionRemovedEvent)
-		if !ok || data.User == data.ItemUser || data.ItemUser == "" {
-			return
-		}
-		ctx = mctx.Annotate(ctx, "user", data.ItemUser)
-		mlog.From(a.cmp).Info("decrementing user's balance", ctx)
+// processSlackEvents processes slack events read off the given channel using a
+// pool of workers. Events are sharded across the workers by user, so each
+// user's events are processed in order. If a worker falls too far behind then
+// new events for it are dropped, rather than holding up everyone else's.
+func (a *app) processSlackEvents(ctx context.Context, events <-chan slack.RTMEvent) {
+	workers := newShardedWorkers(a.slackEventWorkers, a.slackEventQueueSize)
+	defer workers.stop()
 
-		// it's possible for the user to not have enough funds to decrement, for
-		// example if they received a reaction, gave the earned buck to someone
-		// else, then the reaction was removed. I guess this is fine?
-		if _, err := a.bank.Incr(data.ItemUser, -1); err != nil && !errors.Is(err, bank.ErrNotEnoughFunds) {
-			mlog.From(a.cmp).Error("error decrementing user's balance", ctx, merr.Context(err))
-		}
-	case "message":
-		if a.ghost {
-			return
-		}
-		data, ok := e.Data.(*slack.MessageEvent)
-		if !ok || data.User == a.slackClient.botUserID || data.Text == "" {
+	for {
+		select {
+		case e := <-events:
+			if !workers.trySubmit(slackbot.EventKey(e), func() { a.bot.HandleEvent(e) }) {
+				a.metrics.droppedSlackEvent(e.Type)
+				mlog.From(a.cmp).Warn("slack event queue is full, dropping event",
+					mctx.Annotate(ctx, "eventType", e.Type, "user", slackbot.EventKey(e)))
+			}
+		case <-ctx.Done():
 			return
-		} else if err := a.processSlackMsg(ctx, data.Channel, data.User, data.Text); err != nil {
-			ctx = mctx.Annotate(ctx, "text", data.Text)
-			mlog.From(a.cmp).Warn("error processing message", ctx, merr.Context(err))
 		}
 	}
 }
 
-func (a *app) processSlackEvents(ctx context.Context) {
-
+func (a *app) processEarns(ctx context.Context, ch chan bank.EarnInProgress) {
 	for {
 		select {
-		case e := <-a.slackClient.RTM.IncomingEvents:
-			a.processSlackEvent(e)
+		case earnInProg := <-ch:
+			if err := a.economy.ApplyEarn(ctx, earnInProg); err != nil {
+				mlog.From(a.cmp).Error("error encountered processing earn", ctx, merr.Context(err))
+				a.alerts.alert(ctx, alertRedisError, err, "failed to apply earnings")
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -355,55 +566,41 @@ func (a *app) processSlackEvents(ctx context.Context) {
 func (a *app) processStellarPayment(ctx context.Context, payment operations.Payment) error {
 	mlog.From(a.cmp).Info("processing incoming stellar transaction", ctx)
 
-	if payment.Code != a.currencyName || payment.Issuer != a.stellar.kp.Address() {
-		return fmt.Errorf("payment %+v is not in buckaroo's currency", payment)
-	}
-
-	txHash := payment.GetTransactionHash()
-	tx, err := a.stellar.client.TransactionDetail(txHash)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve tx detail for %q: %w",
-			txHash, stellar.HorizonErr(err))
-	}
-
-	ctx = mctx.Annotate(ctx, "memo", tx.Memo)
-	userName := strings.TrimSuffix(tx.Memo, "*"+a.stellar.domain)
-	user, err := a.slackClient.getUserByName(userName)
-	if err != nil {
-		return fmt.Errorf("couldn't get slack user %q: %w", userName, err)
-	} else if user == nil { // not sure if this happens, but whatevs
-		return fmt.Errorf("incoming stellar transaction destined for invalid user %q", tx.Memo)
-	}
-
-	amount, err := strconv.ParseFloat(payment.Amount, 64)
-	if err != nil {
-		return fmt.Errorf("could not parse payment amount %q: %w", payment.Amount, err)
-	} else if float64(int(amount)) != amount {
-		return fmt.Errorf("payment amount %q is not a whole number", payment.Amount)
-	}
-
-	// TODO is it possible to reject a stellar tx? If so we should do that for
-	// any of the above cases
-
-	ctx = mctx.Annotate(ctx, "dstUserID", user.ID, "dstUserName", user.Name, "amount", amount)
-	mlog.From(a.cmp).Info("incrementing user's account", ctx)
-	if _, err := a.bank.Incr(user.ID, int(amount)); err != nil {
-		return fmt.Errorf("could not increment account bank user %q by %d: %w",
-			user.ID, int(amount), err)
+	d, err := a.economy.ImportDeposit(ctx, payment)
+	var rejErr *economy.DepositRejectedError
+	if errors.As(err, &rejErr) {
+		if dmErr := a.dmDepositRejected(payment, rejErr.Reason, rejErr.Refunded); dmErr != nil {
+			mlog.From(a.cmp).Warn("could not tell sender about rejected deposit", ctx, merr.Context(dmErr))
+		}
+		if rejErr.Refunded {
+			return nil
+		}
+		return err
+	} else if err != nil {
+		return err
+	} else if d.FeeTopUp {
+		return nil
+	} else if d.Burned && d.Duplicate {
+		return nil
+	} else if d.Burned {
+		a.announce(ctx, slackbot.NewMessage("%s %s were burned by `%s` :fire:", payment.Amount, a.currencyStringIn(d.Currency, 2, true), d.From))
+		return nil
 	}
 
-	imChannel, err := a.slackClient.getIMChannel(user.ID)
-	if err != nil {
-		return fmt.Errorf("could not get slack IM channel for user %q: %w", user.ID, err)
+	fields := []string{"Sending address", "`" + d.From + "`", "Memo", memoOrNone(d.Memo)}
+	if d.ConvertedFrom != "" {
+		fields = append(fields, "Converted from", d.ConvertedFrom)
 	}
-
-	msgStr := fmt.Sprintf("%d %s were deposited to your account :moneybag:\n", int(amount), a.currencyString(int(amount), true))
-	if tx.Memo != "" {
-		msgStr += fmt.Sprintf("memo: %q\n", tx.Memo)
+	fields = append(fields, "Balance", a.formatAmountIn(d.Currency, d.Balance, true))
+	msg := slackbot.NewMessage("%s were deposited to your account :moneybag:", a.formatAmountIn(d.Currency, d.Amount, true)).
+		Fields(fields...)
+
+	// if the payment is processed again, e.g. because buckaroo restarted
+	// before recording the cursor, the user isn't told about it twice.
+	userID := userIDFromAccountID(d.AccountID)
+	if err := a.notifyOnce(userID, "deposit:"+payment.ID, msg); err != nil {
+		return fmt.Errorf("could not send deposit message to user %q: %w", userID, err)
 	}
-	msgStr += fmt.Sprintf("sending address: `%s`", tx.Account)
-	outMsg := a.slackClient.RTM.NewOutgoingMessage(msgStr, imChannel)
-	a.slackClient.RTM.SendMessage(outMsg)
 
 	return nil
 }
@@ -411,51 +608,60 @@ func (a *app) processStellarPayment(ctx context.Context, payment operations.Paym
 ///////////////////////////////////////////////////////////////////////////////
 
 func (a *app) processExport(ctx context.Context, e bank.ExportInProgress) error {
-	ctx = e.Annotate(ctx)
-	if e.Protocol != exportProtocolStellar {
-		return fmt.Errorf("unknown export protocol %q", e.Protocol)
-	}
-
-	mlog.From(a.cmp).Info("submitting stellar tx", ctx)
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-	res, err := a.stellar.client.SubmitTransactionXDR(ctx, e.ProtocolPayload)
+	res, err := a.economy.ProcessExport(ctx, e)
 	if err != nil {
-		return fmt.Errorf("could not submit ExportInProgress payload %q as tx XDR: %w",
-			e.ProtocolPayload, err)
+		return err
 	}
 
-	txLink := res.Links.Transaction.Href
-	ctx = mctx.Annotate(ctx, "stellarTXLink", txLink)
-	mlog.From(a.cmp).Info("stellar tx successfully submitted", ctx)
+	_, currency := bank.SplitCurrencyAccountID(e.FromUserID)
+	msg := slackbot.NewMessage("your transaction of %s was successful!", a.formatAmountIn(currency, e.Amount, true)).
+		Button("view_tx", "View transaction", res.Links.Transaction.Href)
 
-	if err := e.Ack(); err != nil {
-		// if there is an error acking, don't message the user, it'll just cause
-		// them to potentially get a duplicate message when the export is
-		// retried later.
-		return fmt.Errorf("error acking ExportInProgress: %w", err)
+	// the tx was successful whether or not the receipt can be made, so the
+	// user still gets told about it.
+	if receipt, err := a.makeReceipt(e, res); err != nil {
+		mlog.From(a.cmp).Warn("could not make export receipt", e.Annotate(ctx), merr.Context(err))
+	} else {
+		msg.Context("Receipt `%s`, signed by `%s`: `%s`", receipt.Receipt, receipt.Signer, receipt.Signature)
 	}
 
-	imChannel, err := a.slackClient.getIMChannel(e.FromUserID)
-	if err != nil {
-		mlog.From(a.cmp).Warn("could not retrieve user IM channel to send tx success msg", ctx, merr.Context(err))
+	if err := a.notify(userIDFromAccountID(e.FromUserID), msg); err != nil {
 		// this isn't a big deal, the tx was successful, just bail
-		return nil
+		mlog.From(a.cmp).Warn("could not send tx success msg", e.Annotate(ctx), merr.Context(err))
 	}
 
-	msgStr := fmt.Sprintf("your transaction of %d %s was successful!\n%s", e.Amount, a.currencyString(e.Amount, true), txLink)
-	outMsg := a.slackClient.RTM.NewOutgoingMessage(msgStr, imChannel)
-	a.slackClient.RTM.SendMessage(outMsg)
-
 	return nil
 }
 
+// exportBackoff is how long processExports waits before processing the next
+// export, if horizon's circuit breaker is open.
+const exportBackoff = 10 * time.Second
+
+// processExports processes exports read off the given channel using a pool of
+// workers. Exports are sharded across workers by user, so that each user's
+// exports are still processed in the order they were submitted.
 func (a *app) processExports(ctx context.Context, ch chan bank.ExportInProgress) {
+	workers := newShardedWorkers(a.exportWorkers, 0)
+	defer workers.stop()
+
 	for {
 		select {
 		case exportInProg := <-ch:
-			if err := a.processExport(ctx, exportInProg); err != nil {
-				mlog.From(a.cmp).Error("error encountered processing export", ctx, merr.Context(err))
+			// holding on to the export, rather than nacking it, stops the bank
+			// from consuming more until the pause is over.
+			if paused := a.exportBudget.pausedFor(); paused > 0 {
+				mlog.From(a.cmp).Warn("export error budget is exhausted, pausing exports",
+					mctx.Annotate(ctx, "pausedFor", paused.String()))
+				select {
+				case <-time.After(paused):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !workers.submit(ctx, exportInProg.FromUserID, func() {
+				a.processExportWithBackoff(ctx, exportInProg)
+			}) {
+				return
 			}
 		case <-ctx.Done():
 			return
@@ -463,49 +669,366 @@ func (a *app) processExports(ctx context.Context, ch chan bank.ExportInProgress)
 	}
 }
 
+// processExportWithBackoff processes the export, logging any errors. If
+// horizon is unavailable then the export is nacked, and the call blocks for
+// exportBackoff so that the worker doesn't pick up more exports in the
+// meantime.
+func (a *app) processExportWithBackoff(ctx context.Context, exportInProg bank.ExportInProgress) {
+	if ctx.Err() != nil {
+		// leave it un-acked, it'll get picked up again on the next run.
+		return
+	}
+
+	err := a.processExport(ctx, exportInProg)
+	if errors.Is(err, stellar.ErrCircuitOpen) {
+		// no point in hammering on the rest of the exports, they'll all fail
+		// the same way.
+		mlog.From(a.cmp).Warn("horizon is unavailable, backing off of exports", ctx)
+		if nackErr := exportInProg.Nack(); nackErr != nil {
+			mlog.From(a.cmp).Error("error nacking export", ctx, merr.Context(nackErr))
+		}
+		select {
+		case <-time.After(exportBackoff):
+		case <-ctx.Done():
+		}
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error encountered processing export", ctx, merr.Context(err))
+		a.alerts.alert(exportInProg.Annotate(ctx), alertExportFailed, err,
+			"withdrawal of %s by <@%s> failed", a.formatAmount(exportInProg.Amount, false), userIDFromAccountID(exportInProg.FromUserID))
+		if a.exportBudget.fail() {
+			a.alerts.alert(ctx, alertExportsPaused, nil,
+				"more than %d withdrawals failed within %s, pausing withdrawals for %s",
+				a.exportBudget.max, a.exportBudget.window, a.exportBudget.cooldown)
+		}
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
+// instBank instantiates the bank. Other backends are swapped in by build tags,
+// see postgres.go and sqlite.go.
+var instBank = bank.Inst
+
 func main() {
 	cmp := m.RootServiceComponent()
+	prof := instProfile(cmp)
+	instLogging(cmp, prof)
 	a := app{
 		cmp:         cmp,
-		bank:        bank.Inst(cmp),
+		bank:        instBank(cmp),
 		stellar:     instStellarServer(cmp),
-		slackClient: instSlackClient(cmp),
+		slackClient: slackbot.InstClient(cmp),
 	}
+	a.marketMaker = instMarketMaker(cmp, a.stellar.client)
+	a.stellarHealth = instStellarHealth(cmp)
+	a.feeTopUp = instFeeTopUp(cmp)
+	a.holdReaper = instHoldReaper(cmp)
+	a.scheduledPayments = instPaymentScheduler(cmp)
+	a.allowances = instAllowanceWorker(cmp)
+	a.interest = instInterestEngine(cmp)
+	a.suspicious = instSuspiciousActivity(cmp)
+	a.chaos = instChaos(cmp)
+	a.earnPolicy = instEarnPolicy(cmp)
+	a.github = instGitHub(cmp)
+	a.autoReact = instAutoReact(cmp)
+	a.quietHours = instQuietHours(cmp)
+	a.scheduler = newScheduler()
+	analyticsExporter := instAnalytics(cmp)
+	a.alerts = instAlerts(cmp)
+	a.stellar.ServeMux.HandleFunc(versionPath, a.versionHandler)
+	a.stellar.ServeMux.Handle(apiBalancePath, a.requireScope(scopeReadBalances, http.HandlerFunc(a.apiBalanceHandler)))
+	a.stellar.ServeMux.Handle(apiExportsPath, a.requireScope(scopeReadHistory, http.HandlerFunc(a.apiExportsHandler)))
+	a.stellar.ServeMux.Handle(apiReceiptPath, a.requireScope(scopeReadHistory, http.HandlerFunc(a.apiReceiptHandler)))
+	a.stellar.ServeMux.Handle(apiCreditPath, a.requireAnyScope(
+		[]string{scopeWriteMint, scopeWriteTransfers}, http.HandlerFunc(a.apiCreditHandler)))
+	a.stellar.ServeMux.Handle(apiAllowancesPath, a.requireScope(scopeWriteMint, http.HandlerFunc(a.apiAllowancesHandler)))
+	a.stellar.ServeMux.HandleFunc(reservesPath, a.reservesHandler)
+	a.stellar.ServeMux.HandleFunc(githubWebhookPath, a.githubWebhookHandler)
+	a.stellar.ServeMux.HandleFunc(slackInteractionsPath, a.slackInteractionsHandler)
+	a.metrics = instMetrics(cmp)
 
 	currencyName := mcfg.String(cmp, "currency-name",
 		mcfg.ParamRequired(),
 		mcfg.ParamUsage("Name of the currency which buckaroo will be printing."))
 	currencyEmoji := mcfg.String(cmp, "currency-emoji",
 		mcfg.ParamUsage("Optional emoji string which can be used when writing slack messages."))
+	currencyFormat := instCurrencyFormat(cmp)
+	extraCurrencies := mcfg.String(cmp, "extra-currencies",
+		mcfg.ParamUsage("Comma separated list of the codes of other currencies, e.g. seasonal tokens, which buckaroo will bank and issue alongside the main one. Each has its own balances, and can be given, withdrawn, deposited and minted."))
 	ghost := mcfg.Bool(cmp, "ghost",
 		mcfg.ParamUsage("if set then buckaroo will ignore all messages directed at him"))
+	dryRun := mcfg.Bool(cmp, "dry-run",
+		mcfg.ParamUsage("If set then transactions will be logged rather than submitted to stellar. Balances still change as normal."))
+	adminUserIDs := mcfg.String(cmp, "admin-user-ids",
+		mcfg.ParamUsage("Comma separated list of slack user IDs which are always admins"))
+	moderatorUserIDs := mcfg.String(cmp, "moderator-user-ids",
+		mcfg.ParamUsage("Comma separated list of slack user IDs which are always moderators"))
+	burnMemo := mcfg.String(cmp, "burn-memo",
+		mcfg.ParamDefault("!burn"),
+		mcfg.ParamUsage("Deposits made with this memo will be burned rather than credited to a user. It mustn't be something which could be a slack username. Empty disables."))
+	depositRates := mcfg.String(cmp, "deposit-rates",
+		mcfg.ParamUsage("Comma separated list of other assets which are accepted as deposits, along with how much currency each unit is worth, e.g. \"XLM=10,USD:<issuer>=2\""))
+	noRefundDeposits := mcfg.Bool(cmp, "no-refund-deposits",
+		mcfg.ParamUsage("If set then deposits of other assets which can't be credited will be kept, rather than refunded to the sender"))
+	keybaseCompat := mcfg.Bool(cmp, "keybase-compat",
+		mcfg.ParamUsage("If set then deposit memos are matched more loosely, and deposits whose memo doesn't belong to anyone are credited to whoever linked the sending address. Needed for wallets, like keybase, which set the memo themselves."))
+	foreignTeamPolicy := mcfg.String(cmp, "foreign-team-policy",
+		mcfg.ParamDefault(foreignTeamPolicyRefuse),
+		mcfg.ParamUsage("How to handle users from other slack teams, e.g. in shared channels. \""+foreignTeamPolicyRefuse+"\" refuses their commands and earnings, \""+foreignTeamPolicyNamespace+"\" gives them their own accounts namespaced by team ID"))
+	exportGroup := mcfg.String(cmp, "export-consumer-group",
+		mcfg.ParamDefault(bank.DefaultExportsGroup),
+		mcfg.ParamUsage("Bank consumer group which withdrawals are consumed as part of. Every group gets every withdrawal, so only change this if you know what you're doing, e.g. to submit withdrawals to a different network."))
+	exportWorkers := mcfg.Int(cmp, "export-workers",
+		mcfg.ParamDefault(4),
+		mcfg.ParamUsage("Number of withdrawals which can be submitted to stellar concurrently. A single user's withdrawals are always submitted one at a time, in order."))
+	slackEventWorkers := mcfg.Int(cmp, "slack-event-workers",
+		mcfg.ParamDefault(4),
+		mcfg.ParamUsage("Number of slack events (reactions, commands) which can be processed concurrently. A single user's events are always processed one at a time, in order."))
+	slackEventQueueSize := mcfg.Int(cmp, "slack-event-queue-size",
+		mcfg.ParamDefault(100),
+		mcfg.ParamUsage("Number of slack events which can be waiting on each worker. Events beyond this are dropped."))
+	exportErrorBudget := mcfg.Int(cmp, "export-error-budget",
+		mcfg.ParamDefault(10),
+		mcfg.ParamUsage("If more than this many withdrawals fail within --export-error-window then withdrawals are paused for --export-error-cooldown. 0 disables."))
+	exportErrorWindow := mcfg.String(cmp, "export-error-window",
+		mcfg.ParamDefault("5m"),
+		mcfg.ParamUsage("See --export-error-budget"))
+	exportRetention := mcfg.String(cmp, "export-retention",
+		mcfg.ParamDefault("0"),
+		mcfg.ParamUsage("Withdrawals older than this are trimmed from redis, and archived to --bank-archive-dir if set. Only withdrawals which every consumer group has finished with are trimmed. 0 keeps them forever."))
+	exportErrorCooldown := mcfg.String(cmp, "export-error-cooldown",
+		mcfg.ParamDefault("10m"),
+		mcfg.ParamUsage("See --export-error-budget"))
+	dmDigestWindow := mcfg.String(cmp, "dm-digest-window",
+		mcfg.ParamDefault("5s"),
+		mcfg.ParamUsage("Notifications DM'd to the same user within this long of each other are sent as a single message. 0 disables."))
+	dmRetryBackoff := mcfg.String(cmp, "dm-retry-backoff",
+		mcfg.ParamDefault("30s"),
+		mcfg.ParamUsage("How long to wait before retrying a notification DM which failed to send. Each retry waits twice as long as the last."))
+	dmRetryAttempts := mcfg.Int(cmp, "dm-retry-attempts",
+		mcfg.ParamDefault(5),
+		mcfg.ParamUsage("How many times a notification DM which failed to send is retried, before it's held to be shown the next time the user runs a command. 0 disables retrying."))
+	balanceCacheTTL := mcfg.String(cmp, "balance-cache-ttl",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("Balances are cached in memory for up to this long. Changes made by other buckaroo instances invalidate the cache within --balance-cache-sync-interval, so this is only a backstop. 0 disables the cache."))
+	balanceCacheSyncInterval := mcfg.String(cmp, "balance-cache-sync-interval",
+		mcfg.ParamDefault("1s"),
+		mcfg.ParamUsage("How often the balance cache checks the bank for balances which have changed. See --balance-cache-ttl."))
+	apiCreditQuota := mcfg.Int(cmp, "api-credit-quota",
+		mcfg.ParamDefault(100),
+		mcfg.ParamUsage("The most which each API key can credit to users per day, in whole units of the currency, unless the key was created with its own quota."))
+	giftcardTTL := mcfg.String(cmp, "giftcard-ttl",
+		mcfg.ParamDefault("720h"),
+		mcfg.ParamUsage("How long gift cards can be redeemed for. Once they expire what's on them is refunded to whoever created them."))
+	withdrawDelayAbove := mcfg.Int(cmp, "withdraw-delay-above",
+		mcfg.ParamUsage("Withdrawals of more than this many whole units of a currency are held for --withdraw-delay before they're sent, during which the user or an admin can cancel them. A safety valve against a compromised slack account draining its balance. 0 disables."))
+	withdrawDelay := mcfg.String(cmp, "withdraw-delay",
+		mcfg.ParamDefault("24h"),
+		mcfg.ParamUsage("See --withdraw-delay-above"))
+	approvalAbove := mcfg.Int(cmp, "approval-above",
+		mcfg.ParamUsage("Mints and buybacks of more than this many whole units of a currency aren't done until an admin other than the one who asked for them approves them. 0 disables."))
+	splitRemindInterval := mcfg.String(cmp, "split-remind-interval",
+		mcfg.ParamDefault("24h"),
+		mcfg.ParamUsage("How long users are given to answer a request to pay their share of a split bill before they're reminded of it. After a few reminders the request is dropped."))
+	announceChannelID := mcfg.String(cmp, "announce-channel-id",
+		mcfg.ParamUsage("Optional slack channel ID which buckaroo will make announcements into"))
+	selfTest := mcfg.Bool(cmp, "self-test",
+		mcfg.ParamUsage("If set then buckaroo will check that it can reach all of its dependencies, print a report, and exit non-zero if any check failed. Useful as a deploy gate."))
+	mcfg.Bool(cmp, "validate-config",
+		mcfg.ParamUsage("If set then buckaroo will validate its configuration without connecting to slack, stellar or redis, print a JSON report, and exit non-zero if any check failed. See the README for what's checked."))
+	validateConfigRedis := mcfg.Bool(cmp, "validate-config-redis",
+		mcfg.ParamUsage("If set along with --validate-config then it also checks that every configured redis can be reached."))
 	mrun.InitHook(cmp, func(ctx context.Context) error {
-		a.ghost = *ghost
+		// the profile might switch the network, which replaces the client's
+		// horizon client, so it has to happen before anything wraps that.
+		if client, ok := a.stellar.client.(*stellar.Client); ok {
+			if err := prof.applyNetwork(ctx, cmp, client); err != nil {
+				return err
+			}
+		}
+
+		// chaos needs to wrap the dependencies first, so that injected
+		// faults show up in metrics.
+		a.chaos.wrapStellarClient(a.stellar.client)
+		if client, ok := a.stellar.client.(*stellar.Client); ok {
+			a.testNet = !client.IsLiveNet()
+			client.OnCircuitOpen = func() {
+				a.alerts.alert(a.cmp.Context(), alertHorizonOutage, nil,
+					"horizon is failing, calls to it will fail fast for a while")
+			}
+		}
+		// analytics goes inside of chaos, so that injected faults aren't
+		// recorded as having happened.
+		var err error
+		if a.analytics, err = analyticsExporter(); err != nil {
+			return err
+		}
+		a.bank = a.metrics.wrapBank(a.chaos.wrapBank(wrapAnalyticsBank(a.bank, a.analytics)))
+
+		// the cache goes outside of metrics, so that cache hits aren't counted
+		// as calls to redis.
+		if ttl, err := time.ParseDuration(*balanceCacheTTL); err != nil {
+			return fmt.Errorf("parsing --balance-cache-ttl: %w", err)
+		} else if a.balanceCacheSyncInterval, err = time.ParseDuration(*balanceCacheSyncInterval); err != nil {
+			return fmt.Errorf("parsing --balance-cache-sync-interval: %w", err)
+		} else if a.balanceCacheSyncInterval <= 0 {
+			return errors.New("--balance-cache-sync-interval must be greater than 0")
+		} else if ttl > 0 {
+			a.balanceCache = bank.NewBalanceCache(a.bank, ttl)
+			a.bank = a.balanceCache
+		}
+		if *dryRun || prof.dryRun {
+			mlog.From(cmp).Warn("dry run is enabled, transactions will not be submitted", ctx)
+			a.stellar.client = dryRunStellar{API: a.stellar.client, cmp: cmp}
+		}
+		a.stellar.client = a.metrics.wrapStellar(a.stellar.client)
+		a.marketMaker.client = a.stellar.client
+		a.slack = a.metrics.wrapSlack(a.chaos.wrapSlack(a.slackClient))
+		a.alerts.slack = a.slack
+		a.stellar.alerts = a.alerts
+		a.stellar.metrics = a.metrics
+
+		a.configFingerprint = configFingerprint(cmp)
+		cmp.Annotate("gitRef", orUnknown(gitRef), "configFingerprint", a.configFingerprint)
+
+		a.configRoles = map[string]role{}
+		parseRoleUserIDs(a.configRoles, *moderatorUserIDs, roleModerator)
+		parseRoleUserIDs(a.configRoles, *adminUserIDs, roleAdmin)
+		a.burnMemo = *burnMemo
+		if err := checkBurnMemo(a.burnMemo); err != nil {
+			return fmt.Errorf("checking --burn-memo: %w", err)
+		}
+
+		if a.depositRates, err = economy.ParseDepositRates(*depositRates); err != nil {
+			return fmt.Errorf("parsing --deposit-rates: %w", err)
+		}
+		a.refundDeposits = !*noRefundDeposits
+		a.keybaseCompat = *keybaseCompat
+		a.announceChannelID = *announceChannelID
+
+		if a.exportGroup = *exportGroup; a.exportGroup == "" {
+			return errors.New("--export-consumer-group can't be empty")
+		}
+		if a.exportWorkers = *exportWorkers; a.exportWorkers < 1 {
+			return errors.New("--export-workers must be at least 1")
+		}
+		a.exportBudget = &errorBudget{max: *exportErrorBudget}
+		if a.exportBudget.window, err = time.ParseDuration(*exportErrorWindow); err != nil {
+			return fmt.Errorf("parsing --export-error-window: %w", err)
+		} else if a.exportBudget.cooldown, err = time.ParseDuration(*exportErrorCooldown); err != nil {
+			return fmt.Errorf("parsing --export-error-cooldown: %w", err)
+		}
+		if a.exportRetention, err = time.ParseDuration(*exportRetention); err != nil {
+			return fmt.Errorf("parsing --export-retention: %w", err)
+		} else if a.exportRetention != 0 && a.exportRetention < 24*time.Hour {
+			return errors.New("--export-retention must be at least 24h")
+		}
+
+		if a.apiCreditQuota = *apiCreditQuota; a.apiCreditQuota < 1 {
+			return errors.New("--api-credit-quota must be at least 1")
+		}
+
+		if a.giftcardTTL, err = time.ParseDuration(*giftcardTTL); err != nil {
+			return fmt.Errorf("parsing --giftcard-ttl: %w", err)
+		} else if a.giftcardTTL <= 0 {
+			return errors.New("--giftcard-ttl must be greater than 0")
+		}
+		if a.withdrawDelayAbove = *withdrawDelayAbove; a.withdrawDelayAbove < 0 {
+			return errors.New("--withdraw-delay-above can't be negative")
+		} else if a.withdrawDelay, err = time.ParseDuration(*withdrawDelay); err != nil {
+			return fmt.Errorf("parsing --withdraw-delay: %w", err)
+		} else if a.withdrawDelay <= 0 {
+			return errors.New("--withdraw-delay must be greater than 0")
+		}
+		if a.approvalAbove = *approvalAbove; a.approvalAbove < 0 {
+			return errors.New("--approval-above can't be negative")
+		}
+		if a.splitRemindInterval, err = time.ParseDuration(*splitRemindInterval); err != nil {
+			return fmt.Errorf("parsing --split-remind-interval: %w", err)
+		} else if a.splitRemindInterval <= 0 {
+			return errors.New("--split-remind-interval must be greater than 0")
+		}
+
+		if a.slackEventWorkers = *slackEventWorkers; a.slackEventWorkers < 1 {
+			return errors.New("--slack-event-workers must be at least 1")
+		}
+		if a.slackEventQueueSize = *slackEventQueueSize; a.slackEventQueueSize < 0 {
+			return errors.New("--slack-event-queue-size can't be negative")
+		}
+
+		if a.foreignTeamPolicy = *foreignTeamPolicy; a.foreignTeamPolicy == "" {
+			a.foreignTeamPolicy = foreignTeamPolicyRefuse
+		} else if err := validateForeignTeamPolicy(a.foreignTeamPolicy); err != nil {
+			return err
+		}
+
+		a.ghost = *ghost || prof.ghost
 		if a.ghost {
 			mlog.From(cmp).Info("ghost mode is enabled, wooOOOoOOOOoooOOOOOOoooo", ctx)
 		}
+
+		if backoff, err := time.ParseDuration(*dmRetryBackoff); err != nil {
+			return fmt.Errorf("parsing --dm-retry-backoff: %w", err)
+		} else if backoff <= 0 {
+			return errors.New("--dm-retry-backoff must be greater than 0")
+		} else if *dmRetryAttempts < 0 {
+			return errors.New("--dm-retry-attempts can't be negative")
+		} else if *dmRetryAttempts > 0 {
+			a.dmRetry = slackbot.NewDMRetry(cmp, a.slack, backoff, *dmRetryAttempts)
+		}
+
+		if window, err := time.ParseDuration(*dmDigestWindow); err != nil {
+			return fmt.Errorf("parsing --dm-digest-window: %w", err)
+		} else if window > 0 {
+			a.dmDigest = slackbot.NewDigest(cmp, a.slack, window)
+			a.dmDigest.Retry = a.dmRetry
+		}
+
+		a.bot = slackbot.NewBot(cmp, a.slack, a.slackClient.BotUserID)
+		a.bot.OnCommand = a.handleCommand
+		a.bot.OnReaction = a.handleReaction
+		a.bot.OnUser = a.handleUser
+		a.bot.Ghost = a.ghost
+		a.bot.SigningSecret = a.slackClient.SigningSecret
 		a.currencyName = strings.ToUpper(*currencyName)
 		a.currencyEmoji = *currencyEmoji
-		cmp.Annotate("currencyName", a.currencyName)
-		return nil
+		if a.currency, err = currencyFormat(); err != nil {
+			return err
+		}
+		if a.extraCurrencies, err = parseExtraCurrencies(*extraCurrencies, a.currencyName); err != nil {
+			return err
+		}
+		a.stellar.extraTokenNames = a.extraCurrencies
+		a.stellar.decimals = a.currency.decimals
+		cmp.Annotate("currencyName", a.currencyName, "extraCurrencies", a.extraCurrencies)
+
+		a.economy = economy.New(cmp, a.economyOpts())
+		return a.loadSetup(ctx)
 	})
 
 	runCtx, cancel := context.WithCancel(context.Background())
 	wg := new(sync.WaitGroup)
 	mrun.InitHook(cmp, func(ctx context.Context) error {
-		mlog.From(cmp).Info("refreshing list of slack users")
-		if err := a.slackClient.refreshUsersByName(true); err != nil {
-			mlog.From(a.cmp).Fatal("failed to retrieve full user list", a.cmp.Context(), ctx, merr.Context(err))
+		if *selfTest {
+			// main will run the self-test once init is done, nothing should be
+			// processed in the meantime.
+			return nil
 		}
 
 		mlog.From(cmp).Info("starting main threads")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to warm slack user caches", ctx)
+			a.slackClient.WarmUsers(runCtx)
+			mlog.From(cmp).Info("stopping thread to warm slack user caches", ctx)
+		}()
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			mlog.From(cmp).Info("starting thread to process slack events", ctx)
-			a.processSlackEvents(runCtx)
+			a.processSlackEvents(runCtx, a.slackClient.RTM.IncomingEvents)
 			mlog.From(cmp).Info("stopping thread to process slack events", ctx)
 		}()
 
@@ -517,6 +1040,158 @@ func main() {
 			mlog.From(cmp).Info("stopping thread to process incoming stellar payments", ctx)
 		}()
 
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to maintain market maker offers", ctx)
+			a.runMarketMaker(runCtx, a.asset())
+			mlog.From(cmp).Info("stopping thread to maintain market maker offers", ctx)
+		}()
+
+		if a.stellarHealth.interval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to monitor stellar account health", ctx)
+				a.monitorStellarHealth(runCtx)
+				mlog.From(cmp).Info("stopping thread to monitor stellar account health", ctx)
+			}()
+		}
+
+		if a.feeTopUp.kp != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to top up fees", ctx)
+				a.runFeeTopUps(runCtx)
+				mlog.From(cmp).Info("stopping thread to top up fees", ctx)
+			}()
+		}
+
+		if a.holdReaper.interval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to release expired holds", ctx)
+				a.runHoldReaper(runCtx)
+				mlog.From(cmp).Info("stopping thread to release expired holds", ctx)
+			}()
+		}
+
+		if a.scheduledPayments.interval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to make scheduled payments", ctx)
+				a.runScheduledPayments(runCtx)
+				mlog.From(cmp).Info("stopping thread to make scheduled payments", ctx)
+			}()
+		}
+
+		if a.allowances.interval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to pay allowances", ctx)
+				a.runAllowances(runCtx)
+				mlog.From(cmp).Info("stopping thread to pay allowances", ctx)
+			}()
+		}
+
+		if a.interest.rate != 0 && a.interest.interval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to apply interest", ctx)
+				a.runInterest(runCtx)
+				mlog.From(cmp).Info("stopping thread to apply interest", ctx)
+			}()
+		}
+
+		if a.analytics != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to export analytics events", ctx)
+				a.analytics.Run(runCtx)
+				mlog.From(cmp).Info("stopping thread to export analytics events", ctx)
+			}()
+		}
+
+		if a.exportRetention > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to trim old exports", ctx)
+				a.trimExports(runCtx)
+				mlog.From(cmp).Info("stopping thread to trim old exports", ctx)
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to refund expired gift cards", ctx)
+			a.refundExpiredGiftcards(runCtx)
+			mlog.From(cmp).Info("stopping thread to refund expired gift cards", ctx)
+		}()
+
+		// this runs even if delaying is disabled, so that withdrawals which
+		// were delayed before it was still get sent.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to submit delayed withdrawals", ctx)
+			a.submitDelayedWithdrawals(runCtx)
+			mlog.From(cmp).Info("stopping thread to submit delayed withdrawals", ctx)
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to remind users of split requests", ctx)
+			a.remindSplitRequests(runCtx)
+			mlog.From(cmp).Info("stopping thread to remind users of split requests", ctx)
+		}()
+
+		if a.balanceCache != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mlog.From(cmp).Info("starting thread to sync the balance cache", ctx)
+				a.balanceCache.Run(runCtx, a.balanceCacheSyncInterval, func(err error) {
+					mlog.From(cmp).Warn("error syncing balance cache", ctx, merr.Context(err))
+				})
+				mlog.From(cmp).Info("stopping thread to sync the balance cache", ctx)
+			}()
+		}
+
+		earnCh := make(chan bank.EarnInProgress)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to apply submitted earns", ctx)
+			a.processEarns(runCtx, earnCh)
+			mlog.From(cmp).Info("stopping thread to apply submitted earns", ctx)
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mlog.From(cmp).Info("starting thread to consume submitted earns", ctx)
+			for {
+				err := a.bank.ConsumeEarns(runCtx, earnCh)
+				if errors.Is(err, context.Canceled) {
+					break
+				} else if err != nil {
+					mlog.From(cmp).Error("error consuming earns", ctx, merr.Context(err))
+					a.alerts.alert(ctx, alertRedisError, err, "failed to consume earnings")
+					time.Sleep(1 * time.Second)
+				}
+			}
+			mlog.From(cmp).Info("stopping thread to consume submitted earns", ctx)
+		}()
+
 		exportCh := make(chan bank.ExportInProgress)
 		wg.Add(1)
 		go func() {
@@ -529,13 +1204,15 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			mlog.From(cmp).Info("starting thread to consume submitted exports", ctx)
+			mlog.From(cmp).Info("starting thread to consume submitted exports",
+				mctx.Annotate(ctx, "exportGroup", a.exportGroup))
 			for {
-				err := a.bank.ConsumeExports(runCtx, exportCh)
+				err := a.bank.ConsumeExportsGroup(runCtx, a.exportGroup, exportCh)
 				if errors.Is(err, context.Canceled) {
 					break
 				} else if err != nil {
 					mlog.From(cmp).Error("error consuming exports", ctx, merr.Context(err))
+					a.alerts.alert(ctx, alertRedisError, err, "failed to consume withdrawals")
 					time.Sleep(1 * time.Second)
 				}
 			}
@@ -545,12 +1222,64 @@ func main() {
 		return nil
 	})
 
+	// shutdown hooks are run in reverse, so this happens after the digests
+	// have been flushed, in case any of them fail.
+	mrun.ShutdownHook(cmp, func(ctx context.Context) error {
+		if a.dmRetry != nil {
+			mlog.From(cmp).Info("flushing DM retries", ctx)
+			a.dmRetry.Flush()
+		}
+		return nil
+	})
+
+	// and this happens once the main threads have stopped sending
+	// notifications.
+	mrun.ShutdownHook(cmp, func(ctx context.Context) error {
+		if a.dmDigest != nil {
+			mlog.From(cmp).Info("flushing DM digests", ctx)
+			a.dmDigest.Flush()
+		}
+		return nil
+	})
+
 	mrun.ShutdownHook(cmp, func(ctx context.Context) error {
 		mlog.From(cmp).Info("shutting down main threads", ctx)
 		cancel()
 		wg.Wait()
+
+		// anything being held for quiet hours is sent now, rather than lost.
+		// This happens before the digests are flushed, so it goes out with
+		// them.
+		mlog.From(cmp).Info("flushing scheduled messages", ctx)
+		a.scheduler.flush()
 		return nil
 	})
 
-	m.Exec(cmp)
+	// this has to happen before init, since init is where everything connects.
+	// If the args can't be parsed then init will fail on them anyway.
+	if validate, _ := validateConfigFlag(cmp, configSource); validate {
+		checks := validateConfigChecks(cmp, configSource, validateConfigRedis)
+		if !runValidateConfig(context.Background(), os.Stdout, checks) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	m.MustInit(cmp)
+	ctx := context.Background()
+	if *selfTest {
+		mlog.From(cmp).Info("running self-test", ctx)
+		ok := runSelfTest(ctx, os.Stdout, a.selfTestChecks())
+		m.MustShutdown(cmp)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	mlog.From(cmp).Info("signal received, stopping", mctx.Annotate(ctx, "signal", sig))
+	m.MustShutdown(cmp)
 }
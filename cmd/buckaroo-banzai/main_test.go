@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+	"github.com/stellar/go/keypair"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestProcessExportSubmitErr(t *T) {
+	cmp := mtest.Component()
+	errSubmit := errors.New("horizon is having a moment")
+	mock := &stellartest.Mock{
+		SubmitTransactionXDRFn: func(context.Context, string) (stellar.TransactionResult, error) {
+			return stellar.TransactionResult{}, errSubmit
+		},
+	}
+	a := &app{cmp: cmp, economy: economy.New(cmp, economy.Opts{Stellar: mock, Timeout: time.Second})}
+
+	var acked bool
+	e := bank.ExportInProgress{
+		ID: "1",
+		Export: bank.Export{
+			FromUserID: "U1",
+			Amount:     1,
+			Payload:    economy.StellarPayload{TxXDR: "xdr"},
+		},
+		Ack: func() error { acked = true; return nil },
+	}
+
+	err := a.processExport(context.Background(), e)
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, errSubmit)),
+		massert.Equal(false, acked),
+		massert.Equal([]string{"xdr"}, mock.Submitted()),
+	)
+}
+
+func TestProcessExport(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	fs.AddUser("U1", "u1", "T1")
+	mock := &stellartest.Mock{
+		SubmitTransactionXDRFn: func(context.Context, string) (stellar.TransactionResult, error) {
+			var res stellar.TransactionResult
+			res.Hash = "abc"
+			res.Links.Transaction.Href = "https://horizon/tx/1"
+			return res, nil
+		},
+	}
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		economy:      economy.New(cmp, economy.Opts{Stellar: mock, Timeout: time.Second}),
+		slack:        fs,
+		stellar:      &stellarServer{kp: kp},
+		currencyName: "BUCK",
+	}
+
+	var acked bool
+	e := bank.ExportInProgress{
+		ID: "1",
+		Export: bank.Export{
+			FromUserID: "U1",
+			Amount:     2,
+			Payload:    economy.StellarPayload{TxXDR: "xdr"},
+		},
+		Ack: func() error { acked = true; return nil },
+	}
+
+	err = a.processExport(context.Background(), e)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(true, acked),
+		massert.Equal([]slackbottest.Msg{
+			{ChannelID: "IM-U1", Text: "your transaction of 2 BUCKs was successful!"},
+		}, fs.Flush()),
+	)
+
+	// the receipt can be verified by anyone with buckaroo's address.
+	signed, ok, err := a.getReceipt("1")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(true, ok),
+		massert.Equal(kp.Address(), signed.Signer),
+	)
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(kp.Verify([]byte(signed.Receipt), sig)),
+	)
+
+	var receipt exportReceipt
+	massert.Require(t, massert.Nil(json.Unmarshal([]byte(signed.Receipt), &receipt)))
+	massert.Require(t, massert.Equal(exportReceipt{
+		ExportID: "1", UserID: "U1", Code: "BUCK", Issuer: kp.Address(),
+		Amount: "2", TxHash: "abc", Time: receipt.Time,
+	}, receipt))
+}
+
+func TestProcessExportsOrdering(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	userIDs := []string{"U1", "U2", "U3"}
+	for _, userID := range userIDs {
+		fs.AddUser(userID, userID, "T1")
+	}
+
+	var l sync.Mutex
+	submitted := map[string][]string{}
+	mock := &stellartest.Mock{
+		SubmitTransactionXDRFn: func(_ context.Context, txXDR string) (stellar.TransactionResult, error) {
+			l.Lock()
+			defer l.Unlock()
+			userID := strings.SplitN(txXDR, "-", 2)[0]
+			submitted[userID] = append(submitted[userID], txXDR)
+			return stellar.TransactionResult{}, nil
+		},
+	}
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+	a := &app{
+		cmp:           cmp,
+		bank:          bank.NewInMem(),
+		economy:       economy.New(cmp, economy.Opts{Stellar: mock, Timeout: time.Second}),
+		slack:         fs,
+		stellar:       &stellarServer{kp: kp},
+		exportWorkers: 2,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan bank.ExportInProgress)
+	done := make(chan struct{})
+	go func() {
+		a.processExports(ctx, ch)
+		close(done)
+	}()
+
+	acked := new(sync.WaitGroup)
+	expSubmitted := map[string][]string{}
+	for i := 0; i < 10; i++ {
+		userID := userIDs[i%len(userIDs)]
+		payload := fmt.Sprintf("%s-%d", userID, i)
+		expSubmitted[userID] = append(expSubmitted[userID], payload)
+
+		acked.Add(1)
+		ch <- bank.ExportInProgress{
+			ID: strconv.Itoa(i),
+			Export: bank.Export{
+				FromUserID: userID,
+				Amount:     1,
+				Payload:    economy.StellarPayload{TxXDR: payload},
+			},
+			Ack: func() error { acked.Done(); return nil },
+		}
+	}
+
+	acked.Wait()
+	cancel()
+	<-done
+	massert.Require(t, massert.Equal(expSubmitted, submitted))
+}
+
+func TestReactionItemUser(t *T) {
+	fs := slackbottest.New()
+	fs.MessageUsers["C1:1.2"] = "U1"
+	fs.FileUsers["F1:"] = "U2"
+	fs.FileUsers["F1:Fc1"] = "U3"
+	a := &app{slack: fs}
+
+	event := func(itemUser, itemType, channel, ts, file, comment string) slack.ReactionAddedEvent {
+		var data slack.ReactionAddedEvent
+		data.ItemUser = itemUser
+		data.Item.Type = itemType
+		data.Item.Channel = channel
+		data.Item.Timestamp = ts
+		data.Item.File = file
+		data.Item.FileComment = comment
+		return data
+	}
+
+	type test struct {
+		data   slack.ReactionAddedEvent
+		exp    string
+		expErr bool
+	}
+	tests := []test{
+		{data: event("U9", "message", "C1", "1.2", "", ""), exp: "U9"},
+		{data: event("", "message", "C1", "1.2", "", ""), exp: "U1"},
+		{data: event("", "message", "C1", "3.4", "", ""), expErr: true},
+		{data: event("", "file", "", "", "F1", ""), exp: "U2"},
+		{data: event("", "file_comment", "", "", "F1", "Fc1"), exp: "U3"},
+		{data: event("", "something_new", "", "", "", ""), exp: ""},
+	}
+
+	for i, test := range tests {
+		userID, err := a.reactionItemUser(test.data)
+		massert.Require(t, massert.Comment(massert.All(
+			massert.Equal(test.expErr, err != nil),
+			massert.Equal(test.exp, userID),
+		), "test:%d", i))
+	}
+}
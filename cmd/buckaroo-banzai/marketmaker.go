@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/stellar"
+)
+
+// marketMaker maintains a bid and an ask for the currency against XLM on the
+// stellar DEX, using the funds held by a distribution account.
+type marketMaker struct {
+	cmp    *mcmp.Component
+	client stellar.API
+
+	enabled         bool
+	kp              *keypair.Full
+	price           float64
+	trackMarket     bool
+	spread          float64
+	amount          int
+	refreshInterval time.Duration
+	refreshMove     float64
+
+	// the reference price which the currently placed offers were based on.
+	lastPrice float64
+}
+
+func instMarketMaker(parent *mcmp.Component, client stellar.API) *marketMaker {
+	cmp := parent.Child("market-maker")
+	mm := &marketMaker{cmp: cmp, client: client}
+
+	enabled := mcfg.Bool(cmp, "enabled",
+		mcfg.ParamUsage("If set then buckaroo will maintain offers for the currency on the stellar DEX"))
+	seed := mcfg.String(cmp, "seed",
+		mcfg.ParamUsage("Seed of the distribution account which holds the XLM and currency used to make offers. Required if market making is enabled."))
+	price := mcfg.Float64(cmp, "price",
+		mcfg.ParamUsage("Reference price of the currency, in XLM. Required if market making is enabled."))
+	trackMarket := mcfg.Bool(cmp, "track-market",
+		mcfg.ParamUsage("If set then the reference price will follow the midpoint of the DEX order book, using --market-maker-price only when one side of the book is empty"))
+	spread := mcfg.Float64(cmp, "spread",
+		mcfg.ParamDefault(0.1),
+		mcfg.ParamUsage("Total spread between the bid and ask, as a fraction of the reference price"))
+	amount := mcfg.Int(cmp, "amount",
+		mcfg.ParamDefault(100),
+		mcfg.ParamUsage("Amount of currency to offer on each side of the book"))
+	refreshInterval := mcfg.String(cmp, "refresh-interval",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("How often to check whether offers need to be refreshed"))
+	refreshMove := mcfg.Float64(cmp, "refresh-move",
+		mcfg.ParamDefault(0.02),
+		mcfg.ParamUsage("Fraction which the reference price must move by before offers are refreshed"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		if mm.enabled = *enabled; !mm.enabled {
+			return nil
+		}
+
+		if *seed == "" {
+			return errors.New("--market-maker-seed is required when market making is enabled")
+		} else if *price <= 0 {
+			return errors.New("--market-maker-price must be greater than zero")
+		} else if *spread <= 0 || *spread >= 2 {
+			return errors.New("--market-maker-spread must be between 0 and 2")
+		} else if *amount <= 0 {
+			return errors.New("--market-maker-amount must be greater than zero")
+		} else if *refreshMove <= 0 {
+			return errors.New("--market-maker-refresh-move must be greater than zero")
+		}
+
+		var err error
+		if mm.kp, err = stellar.LoadKeyPair(*seed); err != nil {
+			return fmt.Errorf("could not load market maker key pair: %w", err)
+		} else if mm.refreshInterval, err = time.ParseDuration(*refreshInterval); err != nil {
+			return fmt.Errorf("parsing --market-maker-refresh-interval: %w", err)
+		} else if mm.refreshInterval <= 0 {
+			// time.NewTicker panics on anything else.
+			return errors.New("--market-maker-refresh-interval must be greater than zero")
+		}
+
+		mm.price = *price
+		mm.trackMarket = *trackMarket
+		mm.spread = *spread
+		mm.amount = *amount
+		mm.refreshMove = *refreshMove
+		cmp.Annotate("distributionAddress", mm.kp.Address())
+		mlog.From(cmp).Info("market making is enabled", ctx)
+		return nil
+	})
+
+	return mm
+}
+
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', 7, 64)
+}
+
+func isAsset(a stellar.Asset, code, issuer string) bool {
+	return a.Code == code && a.Issuer == issuer
+}
+
+// ourOffers returns the offers held open by the distribution account which are
+// between the given asset and XLM, split by side.
+func (mm *marketMaker) ourOffers(ctx context.Context, asset stellar.Asset) (bids, asks []horizon.Offer, err error) {
+	offers, err := mm.client.AccountOffers(ctx, mm.kp.Address())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, offer := range offers {
+		if offer.Buying.Type == "native" && isAsset(asset, offer.Selling.Code, offer.Selling.Issuer) {
+			asks = append(asks, offer)
+		} else if offer.Selling.Type == "native" && isAsset(asset, offer.Buying.Code, offer.Buying.Issuer) {
+			bids = append(bids, offer)
+		}
+	}
+	return bids, asks, nil
+}
+
+func (mm *marketMaker) referencePrice(ctx context.Context, asset stellar.Asset) (float64, error) {
+	if !mm.trackMarket {
+		return mm.price, nil
+	}
+
+	mid, ok, err := mm.client.MidPrice(ctx, asset)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return mm.price, nil
+	}
+	return mid, nil
+}
+
+// refreshMarketMaker replaces the market maker's offers if the reference price
+// has moved by --market-maker-refresh-move since they were placed, or if they
+// aren't one bid and one ask. Replacing them is audited.
+func (a *app) refreshMarketMaker(ctx context.Context, asset stellar.Asset) error {
+	mm := a.marketMaker
+	ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	defer cancel()
+
+	bids, asks, err := mm.ourOffers(ctx, asset)
+	if err != nil {
+		return fmt.Errorf("retrieving current offers: %w", err)
+	}
+
+	price, err := mm.referencePrice(ctx, asset)
+	if err != nil {
+		return fmt.Errorf("determining reference price: %w", err)
+	}
+	ctx = mctx.Annotate(ctx,
+		"referencePrice", formatPrice(price),
+		"lastReferencePrice", formatPrice(mm.lastPrice),
+		"numBids", len(bids),
+		"numAsks", len(asks),
+	)
+
+	moved := mm.lastPrice == 0 ||
+		math.Abs(price-mm.lastPrice)/mm.lastPrice >= mm.refreshMove
+	if len(bids) == 1 && len(asks) == 1 && !moved {
+		mlog.From(mm.cmp).Debug("offers are up-to-date", ctx)
+		return nil
+	}
+
+	// all existing offers are removed and the two new ones are created in one
+	// transaction, so the book is never left one-sided by a partial failure.
+	var ops []txnbuild.Operation
+	for _, offer := range append(bids, asks...) {
+		ops = append(ops, &txnbuild.ManageSellOffer{
+			Selling: offerAsset(offer.Selling),
+			Buying:  offerAsset(offer.Buying),
+			Amount:  "0",
+			Price:   offer.Price,
+			OfferID: offer.ID,
+		})
+	}
+
+	askPrice := price * (1 + mm.spread/2)
+	bidPrice := price * (1 - mm.spread/2)
+	ops = append(ops,
+		&txnbuild.ManageSellOffer{
+			Selling: asset.CreditAsset(),
+			Buying:  txnbuild.NativeAsset{},
+			Amount:  strconv.Itoa(mm.amount),
+			Price:   formatPrice(askPrice),
+		},
+		// the bid is expressed as selling XLM, so its amount is in XLM and its
+		// price is in currency per XLM.
+		&txnbuild.ManageSellOffer{
+			Selling: txnbuild.NativeAsset{},
+			Buying:  asset.CreditAsset(),
+			Amount:  formatPrice(float64(mm.amount) * bidPrice),
+			Price:   formatPrice(1 / bidPrice),
+		},
+	)
+	ctx = mctx.Annotate(ctx,
+		"askPrice", formatPrice(askPrice),
+		"bidPrice", formatPrice(bidPrice),
+		"amount", mm.amount,
+	)
+
+	mlog.From(mm.cmp).Info("replacing market maker offers", ctx)
+	txXDR, err := mm.client.MakeOpsXDR(ctx, mm.kp, "", ops...)
+	if err != nil {
+		return fmt.Errorf("making offers tx: %w", err)
+	}
+	res, err := mm.client.SubmitTransactionXDR(ctx, txXDR)
+	if err != nil {
+		return fmt.Errorf("submitting offers tx: %w", err)
+	}
+
+	mm.lastPrice = price
+	a.audit(mctx.Annotate(ctx, "stellarTXLink", res.Links.Transaction.Href), "market maker offers replaced")
+	return nil
+}
+
+func offerAsset(a horizon.Asset) txnbuild.Asset {
+	if a.Type == "native" {
+		return txnbuild.NativeAsset{}
+	}
+	return txnbuild.CreditAsset{Code: a.Code, Issuer: a.Issuer}
+}
+
+// runMarketMaker periodically refreshes the market maker's offers until the
+// given Context is canceled. It does nothing if market making is disabled.
+func (a *app) runMarketMaker(ctx context.Context, asset stellar.Asset) {
+	mm := a.marketMaker
+	if !mm.enabled {
+		return
+	}
+
+	ticker := time.NewTicker(mm.refreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.refreshMarketMaker(ctx, asset); err != nil {
+			mlog.From(mm.cmp).Error("error refreshing market maker offers", ctx, merr.Context(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestMarketMaker(t *T) {
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+	asset := stellar.Asset{Code: "BUCK", Issuer: kp.Address()}
+
+	// offers is the distribution account's offers on the DEX, which placed
+	// offers are added to and deleted ones removed from.
+	var offers []horizon.Offer
+	var nextOfferID int64
+	var txs [][]*txnbuild.ManageSellOffer
+	horizonAsset := func(a txnbuild.Asset) horizon.Asset {
+		if a.IsNative() {
+			return horizon.Asset{Type: "native"}
+		}
+		return horizon.Asset{Type: "credit_alphanum4", Code: a.GetCode(), Issuer: a.GetIssuer()}
+	}
+
+	mid, midOK := 0.0, false
+	mock := &stellartest.Mock{
+		AccountOffersFn: func(ctx context.Context, addr string) ([]horizon.Offer, error) {
+			_, hasDeadline := ctx.Deadline()
+			massert.Require(t,
+				massert.Equal(kp.Address(), addr),
+				massert.Equal(true, hasDeadline),
+			)
+			return offers, nil
+		},
+		MidPriceFn: func(ctx context.Context, _ stellar.Asset) (float64, bool, error) {
+			_, hasDeadline := ctx.Deadline()
+			massert.Require(t, massert.Equal(true, hasDeadline))
+			return mid, midOK, nil
+		},
+		MakeOpsXDRFn: func(_ context.Context, _ *keypair.Full, _ string, ops ...txnbuild.Operation) (string, error) {
+			var tx []*txnbuild.ManageSellOffer
+			for _, op := range ops {
+				tx = append(tx, op.(*txnbuild.ManageSellOffer))
+			}
+			txs = append(txs, tx)
+			return "offers", nil
+		},
+		SubmitTransactionXDRFn: func(ctx context.Context, _ string) (stellar.TransactionResult, error) {
+			_, hasDeadline := ctx.Deadline()
+			massert.Require(t, massert.Equal(true, hasDeadline))
+
+			tx := txs[len(txs)-1]
+			kept := offers[:0]
+			for _, offer := range offers {
+				deleted := false
+				for _, op := range tx {
+					deleted = deleted || (op.OfferID == offer.ID && op.Amount == "0")
+				}
+				if !deleted {
+					kept = append(kept, offer)
+				}
+			}
+			offers = kept
+			for _, op := range tx {
+				if op.OfferID == 0 {
+					nextOfferID++
+					offers = append(offers, horizon.Offer{
+						ID:      nextOfferID,
+						Selling: horizonAsset(op.Selling),
+						Buying:  horizonAsset(op.Buying),
+						Amount:  op.Amount,
+						Price:   op.Price,
+					})
+				}
+			}
+			return stellar.TransactionResult{}, nil
+		},
+	}
+
+	a := &app{
+		cmp:     mtest.Component(),
+		stellar: &stellarServer{timeout: time.Second},
+		marketMaker: &marketMaker{
+			cmp:         mtest.Component(),
+			client:      mock,
+			enabled:     true,
+			kp:          kp,
+			price:       1,
+			spread:      0.1,
+			amount:      100,
+			refreshMove: 0.02,
+		},
+	}
+
+	ctx := context.Background()
+	refresh := func() {
+		massert.Require(t, massert.Nil(a.refreshMarketMaker(ctx, asset)))
+	}
+
+	// with no offers yet a bid and an ask are placed around the price, the
+	// bid being expressed as selling XLM.
+	refresh()
+	massert.Require(t,
+		massert.Length(txs, 1),
+		massert.Length(txs[0], 2),
+		massert.Equal(true, txs[0][0].Buying.IsNative()),
+		massert.Equal("100", txs[0][0].Amount),
+		massert.Equal(formatPrice(1.05), txs[0][0].Price),
+		massert.Equal(true, txs[0][1].Selling.IsNative()),
+		massert.Equal(formatPrice(95), txs[0][1].Amount),
+		massert.Equal(formatPrice(1/0.95), txs[0][1].Price),
+		massert.Length(offers, 2),
+	)
+	refresh()
+	massert.Require(t, massert.Length(txs, 1))
+
+	// when tracking the market, offers are only replaced once the mid price
+	// has moved by the refresh move.
+	a.marketMaker.trackMarket = true
+	mid, midOK = 1.01, true
+	refresh()
+	massert.Require(t, massert.Length(txs, 1))
+	mid = 1.03
+	refresh()
+	massert.Require(t,
+		massert.Length(txs, 2),
+		massert.Length(txs[1], 4),
+		massert.Equal("0", txs[1][0].Amount),
+		massert.Equal("0", txs[1][1].Amount),
+		massert.Equal(formatPrice(1.03*1.05), txs[1][2].Price),
+		massert.Length(offers, 2),
+	)
+
+	// if one side of the DEX's book is empty there's no mid price, so the
+	// configured price is used.
+	midOK = false
+	a.marketMaker.price = 2
+	refresh()
+	massert.Require(t,
+		massert.Length(txs, 3),
+		massert.Equal(formatPrice(2.1), txs[2][2].Price),
+	)
+
+	// if one of the market maker's own offers was taken then both are
+	// replaced, even though the price hasn't moved.
+	for i, offer := range offers {
+		if offer.Selling.Type == "native" {
+			offers = append(offers[:i], offers[i+1:]...)
+			break
+		}
+	}
+	refresh()
+	massert.Require(t,
+		massert.Length(txs, 4),
+		massert.Length(txs[3], 3),
+		massert.Equal("0", txs[3][0].Amount),
+		massert.Equal(false, txs[3][0].Selling.IsNative()),
+		massert.Length(offers, 2),
+	)
+}
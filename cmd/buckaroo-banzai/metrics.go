@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mhttp"
+	"github.com/nlopes/slack"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/operations"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+// histogramBuckets are the upper bounds of the buckets which all histograms
+// use.
+var histogramBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram is an expvar.Var which tracks the distribution of durations. Its
+// buckets are cumulative, e.g. the "500ms" bucket counts all durations which
+// were less than or equal to 500ms.
+type histogram struct {
+	l      sync.Mutex
+	counts []int64 // the last count is for durations beyond all buckets
+	count  int64
+	sum    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(histogramBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBuckets) && d > histogramBuckets[i] {
+		i++
+	}
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) String() string {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	buckets := make(map[string]int64, len(h.counts))
+	var cumulative int64
+	for i, bucket := range histogramBuckets {
+		cumulative += h.counts[i]
+		buckets[bucket.String()] = cumulative
+	}
+	buckets["+Inf"] = h.count
+
+	b, _ := json.Marshal(struct {
+		Count   int64            `json:"count"`
+		SumMS   float64          `json:"sumMS"`
+		Buckets map[string]int64 `json:"buckets"`
+	}{
+		Count:   h.count,
+		SumMS:   h.sum.Seconds() * 1000,
+		Buckets: buckets,
+	})
+	return string(b)
+}
+
+// metrics tracks counts and latencies of commands, as well as the latencies
+// of calls made to each of buckaroo's dependencies. They are exposed as JSON on
+// the metrics http server, under the "buckaroo" key.
+type metrics struct {
+	// counts of commands which were called, and which returned an error, keyed
+	// by command name.
+	commands, commandErrors *expvar.Map
+
+	// histograms of the time it took to run each command, keyed by command
+	// name.
+	commandLatency *expvar.Map
+
+	// counts of the horizon calls made by commands, and of the commands which
+	// went over their horizon budget, keyed by command name.
+	commandHorizonCalls, commandHorizonBudgetExceeded *expvar.Map
+
+	// histograms of the time it took to call each dependency, keyed by
+	// "<dependency>.<method>", e.g. "redis.Transfer" or
+	// "horizon.SubmitTransactionXDR".
+	callLatency *expvar.Map
+
+	// counts of slack events which were dropped because the workers processing
+	// them were backed up, keyed by event type.
+	droppedSlackEvents *expvar.Map
+
+	// counts of restarts of the stream of incoming payments, keyed by why it
+	// was restarted: "stall", "ended" or "error". See receivePayments.
+	paymentStreamRestarts *expvar.Map
+
+	l sync.Mutex
+}
+
+// newMetrics returns a metrics which isn't exposed anywhere, see instMetrics.
+func newMetrics() *metrics {
+	return &metrics{
+		commands:       new(expvar.Map).Init(),
+		commandErrors:  new(expvar.Map).Init(),
+		commandLatency: new(expvar.Map).Init(),
+		callLatency:    new(expvar.Map).Init(),
+
+		commandHorizonCalls:          new(expvar.Map).Init(),
+		commandHorizonBudgetExceeded: new(expvar.Map).Init(),
+
+		droppedSlackEvents:    new(expvar.Map).Init(),
+		paymentStreamRestarts: new(expvar.Map).Init(),
+	}
+}
+
+func instMetrics(parent *mcmp.Component) *metrics {
+	cmp := parent.Child("metrics")
+	m := newMetrics()
+
+	root := new(expvar.Map).Init()
+	root.Set("commands", m.commands)
+	root.Set("commandErrors", m.commandErrors)
+	root.Set("commandLatency", m.commandLatency)
+	root.Set("commandHorizonCalls", m.commandHorizonCalls)
+	root.Set("commandHorizonBudgetExceeded", m.commandHorizonBudgetExceeded)
+	root.Set("callLatency", m.callLatency)
+	root.Set("droppedSlackEvents", m.droppedSlackEvents)
+	root.Set("paymentStreamRestarts", m.paymentStreamRestarts)
+	expvar.Publish("buckaroo", root)
+
+	mhttp.InstListeningServer(cmp, expvar.Handler())
+	return m
+}
+
+func (m *metrics) histogram(in *expvar.Map, key string) *histogram {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if h, ok := in.Get(key).(*histogram); ok {
+		return h
+	}
+	h := newHistogram()
+	in.Set(key, h)
+	return h
+}
+
+// command records that the named command took the given amount of time, and
+// returned the given error.
+func (m *metrics) command(name string, took time.Duration, err error) {
+	m.commands.Add(name, 1)
+	if err != nil {
+		m.commandErrors.Add(name, 1)
+	}
+	m.histogram(m.commandLatency, name).observe(took)
+}
+
+// commandHorizon records that the named command made the given number of
+// calls to horizon, and whether that went over its budget.
+func (m *metrics) commandHorizon(name string, calls int, exceeded bool) {
+	m.commandHorizonCalls.Add(name, int64(calls))
+	if exceeded {
+		m.commandHorizonBudgetExceeded.Add(name, 1)
+	}
+}
+
+// call returns a function which should be deferred at the start of a call to
+// a dependency. It records the latency of the call once it returns.
+func (m *metrics) call(dep, method string) func() {
+	start := time.Now()
+	return func() {
+		m.histogram(m.callLatency, dep+"."+method).observe(time.Since(start))
+	}
+}
+
+// droppedSlackEvent records that a slack event of the given type was dropped.
+func (m *metrics) droppedSlackEvent(eventType string) {
+	m.droppedSlackEvents.Add(eventType, 1)
+}
+
+// paymentStreamRestart records that the stream of incoming payments was
+// restarted for the given reason. It does nothing on a nil metrics, so that
+// the stellar server can be used without one.
+func (m *metrics) paymentStreamRestart(reason string) {
+	if m == nil {
+		return
+	}
+	m.paymentStreamRestarts.Add(reason, 1)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (m *metrics) wrapBank(b bank.ExportingBank) bank.ExportingBank {
+	return metricsBank{ExportingBank: b, m: m}
+}
+
+// metricsBank records the latency of all bank calls, except for
+// ConsumeExports(Group) and ConsumeEarns, which are long-lived.
+type metricsBank struct {
+	bank.ExportingBank
+	m *metrics
+}
+
+func (mb metricsBank) Balance(userID string) (int, error) {
+	defer mb.m.call("redis", "Balance")()
+	return mb.ExportingBank.Balance(userID)
+}
+
+func (mb metricsBank) Incr(userID string, by int) (int, error) {
+	defer mb.m.call("redis", "Incr")()
+	return mb.ExportingBank.Incr(userID, by)
+}
+
+func (mb metricsBank) Transfer(dstUserID, srcUserID string, amount int) (int, int, error) {
+	defer mb.m.call("redis", "Transfer")()
+	return mb.ExportingBank.Transfer(dstUserID, srcUserID, amount)
+}
+
+func (mb metricsBank) IncrAs(userID string, by int, source string) (int, error) {
+	defer mb.m.call("redis", "IncrAs")()
+	return mb.ExportingBank.IncrAs(userID, by, source)
+}
+
+func (mb metricsBank) TransferAs(dstUserID, srcUserID string, amount int, source string) (int, int, error) {
+	defer mb.m.call("redis", "TransferAs")()
+	return mb.ExportingBank.TransferAs(dstUserID, srcUserID, amount, source)
+}
+
+func (mb metricsBank) TransferMulti(srcUserID string, dsts map[string]int) (map[string]int, int, error) {
+	defer mb.m.call("redis", "TransferMulti")()
+	return mb.ExportingBank.TransferMulti(srcUserID, dsts)
+}
+
+func (mb metricsBank) TransferMultiAs(srcUserID string, dsts map[string]int, source string) (map[string]int, int, error) {
+	defer mb.m.call("redis", "TransferMultiAs")()
+	return mb.ExportingBank.TransferMultiAs(srcUserID, dsts, source)
+}
+
+func (mb metricsBank) TransferWithReason(dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	defer mb.m.call("redis", "TransferWithReason")()
+	return mb.ExportingBank.TransferWithReason(dstUserID, srcUserID, amount, source, reason)
+}
+
+func (mb metricsBank) TransferMultiWithReason(srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	defer mb.m.call("redis", "TransferMultiWithReason")()
+	return mb.ExportingBank.TransferMultiWithReason(srcUserID, dsts, source, reason)
+}
+
+func (mb metricsBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	defer mb.m.call("redis", "IncrOnce")()
+	return mb.ExportingBank.IncrOnce(idempotencyKey, userID, by, source)
+}
+
+func (mb metricsBank) TransferOnce(idempotencyKey, dstUserID, srcUserID string, amount int, source, reason string) (int, int, error) {
+	defer mb.m.call("redis", "TransferOnce")()
+	return mb.ExportingBank.TransferOnce(idempotencyKey, dstUserID, srcUserID, amount, source, reason)
+}
+
+func (mb metricsBank) TransferMultiOnce(idempotencyKey, srcUserID string, dsts map[string]int, source, reason string) (map[string]int, int, error) {
+	defer mb.m.call("redis", "TransferMultiOnce")()
+	return mb.ExportingBank.TransferMultiOnce(idempotencyKey, srcUserID, dsts, source, reason)
+}
+
+func (mb metricsBank) Hold(userID string, amount int, ttl time.Duration) (string, int, error) {
+	defer mb.m.call("redis", "Hold")()
+	return mb.ExportingBank.Hold(userID, amount, ttl)
+}
+
+func (mb metricsBank) Capture(holdID, dstUserID string) (bank.Hold, int, error) {
+	defer mb.m.call("redis", "Capture")()
+	return mb.ExportingBank.Capture(holdID, dstUserID)
+}
+
+func (mb metricsBank) Release(holdID string) (bank.Hold, int, error) {
+	defer mb.m.call("redis", "Release")()
+	return mb.ExportingBank.Release(holdID)
+}
+
+func (mb metricsBank) ExpiredHolds(now time.Time, limit int) ([]bank.Hold, error) {
+	defer mb.m.call("redis", "ExpiredHolds")()
+	return mb.ExportingBank.ExpiredHolds(now, limit)
+}
+
+func (mb metricsBank) SchedulePayment(srcUserID, dstUserID string, amount int, at time.Time) (string, error) {
+	defer mb.m.call("redis", "SchedulePayment")()
+	return mb.ExportingBank.SchedulePayment(srcUserID, dstUserID, amount, at)
+}
+
+func (mb metricsBank) ScheduledPayments(srcUserID string) ([]bank.ScheduledPayment, error) {
+	defer mb.m.call("redis", "ScheduledPayments")()
+	return mb.ExportingBank.ScheduledPayments(srcUserID)
+}
+
+func (mb metricsBank) DueScheduledPayments(now time.Time, limit int) ([]bank.ScheduledPayment, error) {
+	defer mb.m.call("redis", "DueScheduledPayments")()
+	return mb.ExportingBank.DueScheduledPayments(now, limit)
+}
+
+func (mb metricsBank) PayScheduledPayment(paymentID string) (bank.ScheduledPayment, int, int, error) {
+	defer mb.m.call("redis", "PayScheduledPayment")()
+	return mb.ExportingBank.PayScheduledPayment(paymentID)
+}
+
+func (mb metricsBank) CancelScheduledPayment(paymentID string) (bank.ScheduledPayment, error) {
+	defer mb.m.call("redis", "CancelScheduledPayment")()
+	return mb.ExportingBank.CancelScheduledPayment(paymentID)
+}
+
+func (mb metricsBank) ApplyInterest(idempotencyKey, currency string, rate int, excludeUserIDs ...string) (map[string]int, error) {
+	defer mb.m.call("redis", "ApplyInterest")()
+	return mb.ExportingBank.ApplyInterest(idempotencyKey, currency, rate, excludeUserIDs...)
+}
+
+func (mb metricsBank) Burn(idempotencyKey, currency string, amount int) error {
+	defer mb.m.call("redis", "Burn")()
+	return mb.ExportingBank.Burn(idempotencyKey, currency, amount)
+}
+
+func (mb metricsBank) UseQuota(key string, amount, max int, ttl time.Duration) (int, error) {
+	defer mb.m.call("redis", "UseQuota")()
+	return mb.ExportingBank.UseQuota(key, amount, max, ttl)
+}
+
+func (mb metricsBank) CanTransfer(dstUserID, srcUserID string, amount int) error {
+	defer mb.m.call("redis", "CanTransfer")()
+	return mb.ExportingBank.CanTransfer(dstUserID, srcUserID, amount)
+}
+
+func (mb metricsBank) GetMeta(userID, key string) (string, error) {
+	defer mb.m.call("redis", "GetMeta")()
+	return mb.ExportingBank.GetMeta(userID, key)
+}
+
+func (mb metricsBank) SetMeta(userID, key, value string) error {
+	defer mb.m.call("redis", "SetMeta")()
+	return mb.ExportingBank.SetMeta(userID, key, value)
+}
+
+func (mb metricsBank) AllMeta(key string) (map[string]string, error) {
+	defer mb.m.call("redis", "AllMeta")()
+	return mb.ExportingBank.AllMeta(key)
+}
+
+func (mb metricsBank) Owed(userID string) (int, error) {
+	defer mb.m.call("redis", "Owed")()
+	return mb.ExportingBank.Owed(userID)
+}
+
+func (mb metricsBank) Overdraft(userID string) (int, error) {
+	defer mb.m.call("redis", "Overdraft")()
+	return mb.ExportingBank.Overdraft(userID)
+}
+
+func (mb metricsBank) SetOverdraft(userID string, overdraft int) error {
+	defer mb.m.call("redis", "SetOverdraft")()
+	return mb.ExportingBank.SetOverdraft(userID, overdraft)
+}
+
+func (mb metricsBank) ListAccounts(cursor string, limit int) ([]bank.Account, string, error) {
+	defer mb.m.call("redis", "ListAccounts")()
+	return mb.ExportingBank.ListAccounts(cursor, limit)
+}
+
+func (mb metricsBank) Top(n int) ([]bank.Account, error) {
+	defer mb.m.call("redis", "Top")()
+	return mb.ExportingBank.Top(n)
+}
+
+func (mb metricsBank) BalanceEvents(cursor string, limit int) ([]string, string, error) {
+	defer mb.m.call("redis", "BalanceEvents")()
+	return mb.ExportingBank.BalanceEvents(cursor, limit)
+}
+
+func (mb metricsBank) Journal(cursor string, limit int) ([]bank.JournalEntry, string, error) {
+	defer mb.m.call("redis", "Journal")()
+	return mb.ExportingBank.Journal(cursor, limit)
+}
+
+func (mb metricsBank) History(userID string, cursor string, limit int) ([]bank.HistoryEntry, string, error) {
+	defer mb.m.call("redis", "History")()
+	return mb.ExportingBank.History(userID, cursor, limit)
+}
+
+func (mb metricsBank) TopGivers(month time.Time, limit int) ([]bank.GiveTotal, error) {
+	defer mb.m.call("redis", "TopGivers")()
+	return mb.ExportingBank.TopGivers(month, limit)
+}
+
+func (mb metricsBank) Supply(since time.Time) ([]bank.SupplyDay, error) {
+	defer mb.m.call("redis", "Supply")()
+	return mb.ExportingBank.Supply(since)
+}
+
+func (mb metricsBank) SubmitEarn(e bank.Earn) (string, error) {
+	defer mb.m.call("redis", "SubmitEarn")()
+	return mb.ExportingBank.SubmitEarn(e)
+}
+
+func (mb metricsBank) ReplayEarns(since time.Time) error {
+	defer mb.m.call("redis", "ReplayEarns")()
+	return mb.ExportingBank.ReplayEarns(since)
+}
+
+func (mb metricsBank) SubmitExport(e bank.Export) (string, error) {
+	defer mb.m.call("redis", "SubmitExport")()
+	return mb.ExportingBank.SubmitExport(e)
+}
+
+func (mb metricsBank) CanExport(e bank.Export) error {
+	defer mb.m.call("redis", "CanExport")()
+	return mb.ExportingBank.CanExport(e)
+}
+
+func (mb metricsBank) TrimExports(before time.Time) (int, error) {
+	defer mb.m.call("redis", "TrimExports")()
+	return mb.ExportingBank.TrimExports(before)
+}
+
+func (mb metricsBank) ExportHistory(start, end time.Time) ([]bank.ExportRecord, error) {
+	defer mb.m.call("redis", "ExportHistory")()
+	return mb.ExportingBank.ExportHistory(start, end)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (m *metrics) wrapStellar(api stellar.API) stellar.API {
+	return metricsStellar{API: api, m: m}
+}
+
+// metricsStellar records the latency of all horizon calls, except for
+// StreamPayments, which is long-lived.
+type metricsStellar struct {
+	stellar.API
+	m *metrics
+}
+
+func (ms metricsStellar) MakeSendXDR(ctx context.Context, opts stellar.SendOpts) (string, error) {
+	defer ms.m.call("horizon", "MakeSendXDR")()
+	return ms.API.MakeSendXDR(ctx, opts)
+}
+
+func (ms metricsStellar) MakeOpsXDR(ctx context.Context, from *keypair.Full, memo string, ops ...txnbuild.Operation) (string, error) {
+	defer ms.m.call("horizon", "MakeOpsXDR")()
+	return ms.API.MakeOpsXDR(ctx, from, memo, ops...)
+}
+
+func (ms metricsStellar) SubmitTransactionXDR(ctx context.Context, txXDR string) (stellar.TransactionResult, error) {
+	defer ms.m.call("horizon", "SubmitTransactionXDR")()
+	return ms.API.SubmitTransactionXDR(ctx, txXDR)
+}
+
+func (ms metricsStellar) TransactionDetail(txHash string) (horizon.Transaction, error) {
+	defer ms.m.call("horizon", "TransactionDetail")()
+	return ms.API.TransactionDetail(txHash)
+}
+
+func (ms metricsStellar) AccountOffers(ctx context.Context, addr string) ([]horizon.Offer, error) {
+	defer ms.m.call("horizon", "AccountOffers")()
+	return ms.API.AccountOffers(ctx, addr)
+}
+
+func (ms metricsStellar) MidPrice(ctx context.Context, asset stellar.Asset) (float64, bool, error) {
+	defer ms.m.call("horizon", "MidPrice")()
+	return ms.API.MidPrice(ctx, asset)
+}
+
+func (ms metricsStellar) ResolveAddr(ctx context.Context, addr string) (string, string, error) {
+	defer ms.m.call("federation", "ResolveAddr")()
+	return ms.API.ResolveAddr(ctx, addr)
+}
+
+func (ms metricsStellar) Root(ctx context.Context) (horizon.Root, error) {
+	defer ms.m.call("horizon", "Root")()
+	return ms.API.Root(ctx)
+}
+
+func (ms metricsStellar) MakeTrustlineXDR(ctx context.Context, addr string, asset stellar.Asset) (string, error) {
+	defer ms.m.call("horizon", "MakeTrustlineXDR")()
+	return ms.API.MakeTrustlineXDR(ctx, addr, asset)
+}
+
+func (ms metricsStellar) Fund(ctx context.Context, addr string) (stellar.TransactionResult, error) {
+	defer ms.m.call("horizon", "Fund")()
+	return ms.API.Fund(ctx, addr)
+}
+
+func (ms metricsStellar) AssetSupply(ctx context.Context, asset stellar.Asset) (string, error) {
+	defer ms.m.call("horizon", "AssetSupply")()
+	return ms.API.AssetSupply(ctx, asset)
+}
+
+func (ms metricsStellar) AccountBalance(ctx context.Context, addr string, asset stellar.Asset) (string, error) {
+	defer ms.m.call("horizon", "AccountBalance")()
+	return ms.API.AccountBalance(ctx, addr, asset)
+}
+
+func (ms metricsStellar) Account(ctx context.Context, addr string) (horizon.Account, error) {
+	defer ms.m.call("horizon", "Account")()
+	return ms.API.Account(ctx, addr)
+}
+
+func (ms metricsStellar) FeeStats(ctx context.Context) (horizon.FeeStats, error) {
+	defer ms.m.call("horizon", "FeeStats")()
+	return ms.API.FeeStats(ctx)
+}
+
+func (ms metricsStellar) ListPayments(ctx context.Context, req horizonclient.OperationRequest) ([]operations.Operation, error) {
+	defer ms.m.call("horizon", "ListPayments")()
+	return ms.API.ListPayments(ctx, req)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func (m *metrics) wrapSlack(s slackbot.API) slackbot.API {
+	return metricsSlack{API: s, m: m}
+}
+
+// metricsSlack records the latency of all slack calls. Most of these are
+// cached by slackbot.Client, so will usually be fast.
+type metricsSlack struct {
+	slackbot.API
+	m *metrics
+}
+
+func (ms metricsSlack) GetChannel(id string) (*slack.Channel, error) {
+	defer ms.m.call("slack", "getChannel")()
+	return ms.API.GetChannel(id)
+}
+
+func (ms metricsSlack) GetUser(id string) (*slack.User, error) {
+	defer ms.m.call("slack", "getUser")()
+	return ms.API.GetUser(id)
+}
+
+func (ms metricsSlack) GetUserByName(name string) (*slack.User, error) {
+	defer ms.m.call("slack", "getUserByName")()
+	return ms.API.GetUserByName(name)
+}
+
+func (ms metricsSlack) GetIMChannel(userID string) (string, error) {
+	defer ms.m.call("slack", "getIMChannel")()
+	return ms.API.GetIMChannel(userID)
+}
+
+func (ms metricsSlack) SendMessage(channelID string, msg *slackbot.Message) error {
+	defer ms.m.call("slack", "sendMessage")()
+	return ms.API.SendMessage(channelID, msg)
+}
+
+func (ms metricsSlack) GetMessageUser(channelID, timestamp string) (string, error) {
+	defer ms.m.call("slack", "getMessageUser")()
+	return ms.API.GetMessageUser(channelID, timestamp)
+}
+
+func (ms metricsSlack) GetFileUser(fileID, commentID string) (string, error) {
+	defer ms.m.call("slack", "getFileUser")()
+	return ms.API.GetFileUser(fileID, commentID)
+}
+
+func (ms metricsSlack) AddReaction(emoji, channelID, timestamp string) error {
+	defer ms.m.call("slack", "addReaction")()
+	return ms.API.AddReaction(emoji, channelID, timestamp)
+}
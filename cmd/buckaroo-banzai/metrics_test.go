@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestHistogram(t *T) {
+	h := newHistogram()
+	h.observe(5 * time.Millisecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(300 * time.Millisecond)
+	h.observe(time.Minute)
+
+	var res struct {
+		Count   int64            `json:"count"`
+		Buckets map[string]int64 `json:"buckets"`
+	}
+	err := json.Unmarshal([]byte(h.String()), &res)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(int64(4), res.Count),
+		massert.Equal(int64(2), res.Buckets["10ms"]),
+		massert.Equal(int64(2), res.Buckets["250ms"]),
+		massert.Equal(int64(3), res.Buckets["500ms"]),
+		massert.Equal(int64(3), res.Buckets["10s"]),
+		massert.Equal(int64(4), res.Buckets["+Inf"]),
+	)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// notifiedMetaKey is the bank metadata key under which the IDs of the most
+// recent notifications sent to each user are stored, as a JSON array. Unlike
+// most metadata it's keyed by slack user ID rather than account ID.
+const notifiedMetaKey = "notified"
+
+// notifiedMaxIDs is how many notification IDs are remembered for each user.
+// Duplicates come from something being retried soon after it first happened,
+// so there's no need to remember them forever.
+const notifiedMaxIDs = 50
+
+// notifyOnce is like notify, but the notification has an ID which is shown at
+// the bottom of it, and which is the same however many times the thing it's
+// about is processed (e.g. a deposit's payment ID). If a notification with the
+// same ID was already sent to the user recently then it's not sent again, so
+// retries don't end up DM'ing the user about the same thing twice.
+//
+// If notificationID is empty then this is the same as notify.
+//
+// The ID is only recorded once the notification has been handed off to
+// notify, so if that fails a retry will try to send it again.
+func (a *app) notifyOnce(userID, notificationID string, msg *slackbot.Message) error {
+	if notificationID == "" {
+		return a.notify(userID, msg)
+	}
+
+	a.notifiedL.Lock()
+	defer a.notifiedL.Unlock()
+
+	var ids []string
+	if idsStr, err := a.bank.GetMeta(userID, notifiedMetaKey); err != nil {
+		return err
+	} else if idsStr != "" {
+		if err := json.Unmarshal([]byte(idsStr), &ids); err != nil {
+			return fmt.Errorf("unmarshaling notification IDs of user %q: %w", userID, err)
+		}
+	}
+
+	for _, id := range ids {
+		if id == notificationID {
+			mlog.From(a.cmp).Info("not sending duplicate notification",
+				mctx.Annotate(a.cmp.Context(), "userID", userID, "notificationID", notificationID))
+			return nil
+		}
+	}
+
+	if err := a.notify(userID, msg.Context("ID: `%s`", notificationID)); err != nil {
+		return err
+	}
+
+	if ids = append(ids, notificationID); len(ids) > notifiedMaxIDs {
+		ids = ids[len(ids)-notifiedMaxIDs:]
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return a.bank.SetMeta(userID, notifiedMetaKey, string(b))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestNotifyOnce(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:   cmp,
+		bank:  bank.NewInMem(),
+		slack: fs,
+	}
+
+	mtest.Run(cmp, t, func() {
+		user := fs.AddUser(mrand.Hex(8), "a", "T1")
+		notify := func(id string) int {
+			massert.Require(t, massert.Nil(a.notifyOnce(user.ID, id, slackbot.NewMessage("hi"))))
+			return len(fs.Flush())
+		}
+
+		massert.Require(t,
+			massert.Equal(1, notify("deposit:1")),
+			massert.Equal(0, notify("deposit:1")),
+			massert.Equal(1, notify("deposit:2")),
+			// notifications without an ID are always sent.
+			massert.Equal(1, notify("")),
+			massert.Equal(1, notify("")),
+		)
+
+		// only the most recent IDs are remembered.
+		for i := 0; i < notifiedMaxIDs; i++ {
+			notify("give:" + strconv.Itoa(i))
+		}
+		massert.Require(t,
+			massert.Equal(1, notify("deposit:1")),
+			massert.Equal(0, notify("give:"+strconv.Itoa(notifiedMaxIDs-1))),
+		)
+	})
+}
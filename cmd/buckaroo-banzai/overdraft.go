@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+
+	"buckaroo-banzai/bank"
+)
+
+const overdraftUsage = "usage: `overdraft @<user> [<amount>|default]`"
+
+// cmdOverdraft shows or sets how far into the red a user's balance can go, see
+// bank.Bank.Overdraft. Setting it to `default` removes the user's own, so that
+// --bank-overdraft applies to them again.
+func (a *app) cmdOverdraft(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		a.reply(req, overdraftUsage)
+		return nil
+	}
+
+	dstAccountID, err := a.accountIDByUserID(req.args[0])
+	if err != nil {
+		return err
+	}
+	dstUserID := userIDFromAccountID(dstAccountID)
+	ctx = mctx.Annotate(ctx, "dstAccountID", dstAccountID)
+
+	if len(req.args) > 1 {
+		overdraft := -1
+		if !strings.EqualFold(req.args[1], "default") {
+			if overdraft, err = bank.ParseDecimal(req.args[1], a.currency.decimals); err != nil || overdraft < 0 {
+				return inputErrorf("`%s` isn't an amount, or `default`. %s", req.args[1], overdraftUsage)
+			}
+		}
+		if err := a.bank.SetOverdraft(dstAccountID, overdraft); err != nil {
+			return err
+		}
+		a.audit(mctx.Annotate(ctx, "overdraft", overdraft), "overdraft set")
+	}
+
+	overdraft, err := a.bank.Overdraft(dstAccountID)
+	if err != nil {
+		return err
+	} else if overdraft == 0 {
+		a.reply(req, "<@%s> can't go into the red", dstUserID)
+		return nil
+	}
+	a.reply(req, "<@%s> can go up to %s into the red", dstUserID, a.formatAmount(overdraft, true))
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+import (
+	_ "github.com/lib/pq"
+
+	"buckaroo-banzai/bank"
+)
+
+// building with the postgres tag keeps the bank in PostgreSQL rather than
+// redis.
+func init() {
+	instBank = bank.InstPostgres
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// privacy describes who is allowed to see a user's balance, besides the user
+// themselves and admins.
+type privacy int
+
+const (
+	privacyPrivate privacy = iota
+	privacyFriends
+	privacyPublic
+)
+
+// Bank metadata keys which privacy settings are stored under. Friends are
+// stored as a comma separated list of account IDs.
+const (
+	privacyMetaKey = "privacy"
+	friendsMetaKey = "friends"
+)
+
+func (p privacy) String() string {
+	switch p {
+	case privacyFriends:
+		return "friends"
+	case privacyPublic:
+		return "public"
+	default:
+		return "private"
+	}
+}
+
+func parsePrivacy(str string) (privacy, error) {
+	switch strings.ToLower(str) {
+	case "", "private":
+		return privacyPrivate, nil
+	case "friends":
+		return privacyFriends, nil
+	case "public":
+		return privacyPublic, nil
+	default:
+		return 0, fmt.Errorf("unknown privacy setting %q", str)
+	}
+}
+
+func (a *app) privacyOf(accountID string) (privacy, error) {
+	privacyStr, err := a.bank.GetMeta(accountID, privacyMetaKey)
+	if err != nil {
+		return 0, fmt.Errorf("getting privacy of %q: %w", accountID, err)
+	}
+	return parsePrivacy(privacyStr)
+}
+
+func (a *app) friendsOf(accountID string) ([]string, error) {
+	friendsStr, err := a.bank.GetMeta(accountID, friendsMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting friends of %q: %w", accountID, err)
+	} else if friendsStr == "" {
+		return nil, nil
+	}
+	return strings.Split(friendsStr, ","), nil
+}
+
+func (a *app) setFriends(accountID string, friends []string) error {
+	if err := a.bank.SetMeta(accountID, friendsMetaKey, strings.Join(friends, ",")); err != nil {
+		return fmt.Errorf("setting friends of %q: %w", accountID, err)
+	}
+	return nil
+}
+
+// canSeeBalance returns whether the user making the request is allowed to see
+// the balance of the given account.
+func (a *app) canSeeBalance(req commandReq, accountID string) (bool, error) {
+	if req.accountID == accountID || req.role >= roleAdmin {
+		return true, nil
+	}
+
+	p, err := a.privacyOf(accountID)
+	if err != nil {
+		return false, err
+	}
+	switch p {
+	case privacyPublic:
+		return true, nil
+	case privacyFriends:
+		friends, err := a.friendsOf(accountID)
+		if err != nil {
+			return false, err
+		}
+		for _, friend := range friends {
+			if friend == req.accountID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (a *app) cmdPrivacy(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		p, err := a.privacyOf(req.accountID)
+		if err != nil {
+			return err
+		}
+		a.reply(req, "your balance is %s. usage: `privacy [private|friends|public]`", p)
+		return nil
+	}
+
+	p, err := parsePrivacy(req.args[0])
+	if err != nil {
+		return err
+	}
+	pStr := p.String()
+	if p == privacyPrivate {
+		pStr = ""
+	}
+	mlog.From(a.cmp).Info("setting privacy", mctx.Annotate(ctx, "privacy", p.String()))
+	if err := a.bank.SetMeta(req.accountID, privacyMetaKey, pStr); err != nil {
+		return fmt.Errorf("setting privacy of %q: %w", req.accountID, err)
+	}
+
+	switch p {
+	case privacyPublic:
+		a.reply(req, "anyone can see your balance now")
+	case privacyFriends:
+		a.reply(req, "only your friends can see your balance now, add them with `friend @<user>`")
+	default:
+		a.reply(req, "nobody can see your balance now :shushing_face:")
+	}
+	return nil
+}
+
+func (a *app) cmdFriend(ctx context.Context, req commandReq) error {
+	return a.changeFriend(ctx, req, true)
+}
+
+func (a *app) cmdUnfriend(ctx context.Context, req commandReq) error {
+	return a.changeFriend(ctx, req, false)
+}
+
+// changeFriend adds or removes the user given in the request as a friend of the
+// user making it.
+func (a *app) changeFriend(ctx context.Context, req commandReq, add bool) error {
+	if len(req.args) < 1 {
+		a.reply(req, "usage: `friend @<user>` or `unfriend @<user>`")
+		return nil
+	}
+
+	friendAccountID, err := a.accountIDByUserID(req.args[0])
+	if err != nil {
+		return err
+	}
+	friendUserID := userIDFromAccountID(friendAccountID)
+	ctx = mctx.Annotate(ctx, "friendAccountID", friendAccountID)
+
+	friends, err := a.friendsOf(req.accountID)
+	if err != nil {
+		return err
+	}
+	newFriends := friends[:0]
+	for _, friend := range friends {
+		if friend != friendAccountID {
+			newFriends = append(newFriends, friend)
+		}
+	}
+	if add {
+		newFriends = append(newFriends, friendAccountID)
+	}
+
+	mlog.From(a.cmp).Info("setting friends", ctx)
+	if err := a.setFriends(req.accountID, newFriends); err != nil {
+		return err
+	}
+
+	if add {
+		a.reply(req, "<@%s> is now your friend :people_hugging:", friendUserID)
+	} else {
+		a.reply(req, "<@%s> is no longer your friend", friendUserID)
+	}
+	return nil
+}
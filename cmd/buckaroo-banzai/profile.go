@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/stellar"
+)
+
+// profile is a named set of defaults for a particular kind of environment, so
+// that getting one flag right gets all of them right.
+type profile struct {
+	name string
+
+	// whether the live network is used. Profiles which don't use it will
+	// refuse to run if --stellar-live-net is given, since that's almost
+	// certainly a mistake.
+	liveNet bool
+
+	// these are turned on by the profile, in addition to if they're given
+	// explicitly.
+	ghost, dryRun bool
+
+	// the maximum level which is logged. Levels given in --log-levels still
+	// apply on top of this.
+	logLevel string
+}
+
+var profiles = map[string]profile{
+	"dev": {
+		dryRun:   true,
+		logLevel: "debug",
+	},
+	"staging": {
+		// a staging bot is usually in the same workspace as the prod one, so
+		// it shouldn't answer commands meant for that.
+		ghost:    true,
+		logLevel: "info",
+	},
+	"prod": {
+		liveNet:  true,
+		logLevel: "info",
+	},
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instProfile declares the --profile param. The returned profile is populated
+// during init, and is the zero value if no profile was given. It should be
+// instantiated before any other components, so that it's initialized first.
+func instProfile(root *mcmp.Component) *profile {
+	p := new(profile)
+	name := mcfg.String(root, "profile",
+		mcfg.ParamUsage("Named set of defaults for the environment buckaroo is running in, one of: "+strings.Join(profileNames(), ", ")+". See the README for what each one sets."))
+
+	mrun.InitHook(root, func(ctx context.Context) error {
+		if *name == "" {
+			return nil
+		}
+		var ok bool
+		if *p, ok = profiles[*name]; !ok {
+			return fmt.Errorf("unknown --profile %q, must be one of: %s", *name, strings.Join(profileNames(), ", "))
+		}
+		p.name = *name
+		root.Annotate("profile", p.name)
+		mlog.From(root).Info("using profile", mctx.Annotate(ctx,
+			"liveNet", p.liveNet, "ghost", p.ghost, "dryRun", p.dryRun, "logLevel", p.logLevel))
+		return nil
+	})
+	return p
+}
+
+// applyNetwork points the client at the profile's network. If the client was
+// configured to use the live network but the profile doesn't, an error is
+// returned instead.
+func (p *profile) applyNetwork(ctx context.Context, cmp *mcmp.Component, client *stellar.Client) error {
+	if p.name == "" {
+		return nil
+	} else if !p.liveNet && client.IsLiveNet() {
+		return fmt.Errorf("the %s profile can't be used with --stellar-live-net", p.name)
+	} else if p.liveNet && !client.IsLiveNet() {
+		mlog.From(cmp).Warn("connecting to live net, as per the profile", ctx)
+		client.SetLiveNet(true)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/stellar"
+)
+
+func TestProfiles(t *T) {
+	for name, p := range profiles {
+		massert.Require(t,
+			massert.Comment(massert.Not(massert.Nil(mlog.LevelFromString(p.logLevel))), "profile %q", name),
+		)
+	}
+}
+
+func TestProfileApplyNetwork(t *T) {
+	cmp := mtest.Component()
+	ctx := context.Background()
+
+	// no profile leaves the client alone
+	client := new(stellar.Client)
+	client.SetLiveNet(true)
+	massert.Require(t,
+		massert.Nil(new(profile).applyNetwork(ctx, cmp, client)),
+		massert.Equal(true, client.IsLiveNet()),
+	)
+
+	prod := profiles["prod"]
+	prod.name = "prod"
+	client.SetLiveNet(false)
+	massert.Require(t,
+		massert.Nil(prod.applyNetwork(ctx, cmp, client)),
+		massert.Equal(true, client.IsLiveNet()),
+	)
+
+	dev := profiles["dev"]
+	dev.name = "dev"
+	massert.Require(t, massert.Not(massert.Nil(dev.applyNetwork(ctx, cmp, client))))
+
+	client.SetLiveNet(false)
+	massert.Require(t,
+		massert.Nil(dev.applyNetwork(ctx, cmp, client)),
+		massert.Equal(false, client.IsLiveNet()),
+	)
+}
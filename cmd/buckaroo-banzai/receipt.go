@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/stellar"
+)
+
+// Each completed withdrawal gets a receipt signed by buckaroo's stellar key, so
+// that users have proof of it which doesn't depend on slack's history. Receipts
+// are stored under receiptMetaKey, keyed by the export's ID.
+const receiptMetaKey = "receipt"
+
+type exportReceipt struct {
+	ExportID string    `json:"exportID"`
+	UserID   string    `json:"userID"`
+	Code     string    `json:"code"`
+	Issuer   string    `json:"issuer"`
+	Amount   string    `json:"amount"`
+	TxHash   string    `json:"txHash"`
+	Time     time.Time `json:"time"`
+}
+
+// signedReceipt is how a receipt is stored and given out. Receipt is the JSON
+// encoded exportReceipt exactly as it was signed, and Signature is the base64
+// encoded ed25519 signature of it by Signer.
+type signedReceipt struct {
+	Receipt   string `json:"receipt"`
+	Signer    string `json:"signer"`
+	Signature string `json:"signature"`
+}
+
+// makeReceipt signs and stores a receipt for the export, which has been
+// submitted to stellar in the given transaction.
+func (a *app) makeReceipt(e bank.ExportInProgress, res stellar.TransactionResult) (signedReceipt, error) {
+	accountID, currency := bank.SplitCurrencyAccountID(e.FromUserID)
+	asset := a.assetIn(currency)
+	receipt := exportReceipt{
+		ExportID: e.ID,
+		UserID:   userIDFromAccountID(accountID),
+		Code:     asset.Code,
+		Issuer:   asset.Issuer,
+		Amount:   bank.FormatDecimal(e.Amount, a.currency.decimals),
+		TxHash:   res.Hash,
+		Time:     time.Now().UTC(),
+	}
+
+	receiptStr, sig, err := a.stellar.signJSON(receipt)
+	if err != nil {
+		return signedReceipt{}, fmt.Errorf("signing receipt: %w", err)
+	}
+	signed := signedReceipt{
+		Receipt:   receiptStr,
+		Signer:    a.stellar.kp.Address(),
+		Signature: sig,
+	}
+
+	b, err := json.Marshal(signed)
+	if err != nil {
+		return signedReceipt{}, err
+	} else if err := a.bank.SetMeta(e.ID, receiptMetaKey, string(b)); err != nil {
+		return signedReceipt{}, fmt.Errorf("storing receipt: %w", err)
+	}
+	return signed, nil
+}
+
+func (a *app) getReceipt(exportID string) (signedReceipt, bool, error) {
+	str, err := a.bank.GetMeta(exportID, receiptMetaKey)
+	if err != nil {
+		return signedReceipt{}, false, fmt.Errorf("getting receipt: %w", err)
+	} else if str == "" {
+		return signedReceipt{}, false, nil
+	}
+	var signed signedReceipt
+	if err := json.Unmarshal([]byte(str), &signed); err != nil {
+		return signedReceipt{}, false, fmt.Errorf("unmarshaling receipt: %w", err)
+	}
+	return signed, true, nil
+}
+
+const apiReceiptPath = "/api/v1/receipt"
+
+// apiReceiptHandler returns the signed receipt of the withdrawal whose export
+// ID is given by the "id" query parameter.
+func (a *app) apiReceiptHandler(rw http.ResponseWriter, r *http.Request) {
+	exportID := r.URL.Query().Get("id")
+	if exportID == "" {
+		apiError(rw, http.StatusBadRequest, "missing id parameter")
+		return
+	}
+
+	signed, ok, err := a.getReceipt(exportID)
+	if errors.Is(err, bank.ErrUnavailable) {
+		apiError(rw, http.StatusServiceUnavailable, "bank is unavailable")
+		return
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error getting receipt for API request", r.Context(), merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	} else if !ok {
+		apiError(rw, http.StatusNotFound, "receipt not found")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(signed)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+)
+
+const reservesPath = "/api/v1/reserves"
+
+// reservesTTL is how long a proof of reserves is published for before a new
+// one is generated. The endpoint is public, so this also limits how often
+// anyone can make buckaroo read every account and call horizon.
+const reservesTTL = time.Minute
+
+// reserve describes, for a single currency, what the bank owes its users and
+// what exists on-chain. All amounts are decimal strings, like stellar's.
+type reserve struct {
+	Code   string `json:"code"`
+	Issuer string `json:"issuer"`
+
+	// Liabilities is the sum of every user's balance in the bank.
+	Liabilities string `json:"liabilities"`
+
+	// Outstanding is how much of the asset is held by accounts other than
+	// its issuer.
+	Outstanding string `json:"outstanding"`
+
+	// Holdings is how much of the asset is held by the distribution account,
+	// and is only set when buckaroo is anchoring an asset issued by someone
+	// else. In that case the bank is fully backed when Holdings is at least
+	// Liabilities.
+	Holdings string `json:"holdings,omitempty"`
+}
+
+type reservesReport struct {
+	Time     time.Time `json:"time"`
+	Reserves []reserve `json:"reserves"`
+}
+
+// signedReserves is what's published at reservesPath. Report is the JSON
+// encoded reservesReport exactly as it was signed, so that it can be verified
+// byte for byte, and Signature is the base64 encoded ed25519 signature of it
+// by Signer.
+type signedReserves struct {
+	Report    string `json:"report"`
+	Signer    string `json:"signer"`
+	Signature string `json:"signature"`
+}
+
+func (a *app) makeReservesReport(ctx context.Context) (reservesReport, error) {
+	liabilities, err := bank.Liabilities(a.bank)
+	if err != nil {
+		return reservesReport{}, fmt.Errorf("summing liabilities: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	defer cancel()
+
+	report := reservesReport{Time: time.Now().UTC()}
+	currencies := append([]string{bank.DefaultCurrency}, a.extraCurrencies...)
+	for _, currency := range currencies {
+		asset := a.assetIn(currency)
+		outstanding, err := a.stellar.client.AssetSupply(ctx, asset)
+		if err != nil {
+			return reservesReport{}, fmt.Errorf("getting supply of %s: %w", asset.Code, err)
+		}
+
+		r := reserve{
+			Code:        asset.Code,
+			Issuer:      asset.Issuer,
+			Liabilities: bank.FormatDecimal(liabilities[currency], a.currency.decimals),
+			Outstanding: outstanding,
+		}
+		if a.stellar.isAnchor() {
+			holdings, err := a.stellar.client.AccountBalance(ctx, a.stellar.kp.Address(), asset)
+			if err != nil {
+				return reservesReport{}, fmt.Errorf("getting holdings of %s: %w", asset.Code, err)
+			}
+			r.Holdings = holdings
+		}
+		report.Reserves = append(report.Reserves, r)
+	}
+	return report, nil
+}
+
+// signedReserves returns the current proof of reserves, generating and
+// signing a new one if the last one is older than reservesTTL.
+func (a *app) signedReserves(ctx context.Context) (signedReserves, error) {
+	a.reservesL.Lock()
+	defer a.reservesL.Unlock()
+
+	if a.reserves != nil {
+		var last reservesReport
+		if err := json.Unmarshal([]byte(a.reserves.Report), &last); err == nil &&
+			time.Since(last.Time) < reservesTTL {
+			return *a.reserves, nil
+		}
+	}
+
+	report, err := a.makeReservesReport(ctx)
+	if err != nil {
+		return signedReserves{}, err
+	}
+	reportStr, sig, err := a.stellar.signJSON(report)
+	if err != nil {
+		return signedReserves{}, fmt.Errorf("signing report: %w", err)
+	}
+
+	a.reserves = &signedReserves{
+		Report:    reportStr,
+		Signer:    a.stellar.kp.Address(),
+		Signature: sig,
+	}
+	return *a.reserves, nil
+}
+
+// reservesHandler publishes a proof of reserves, so that token holders can
+// check that everything the bank owes is backed on-chain. It needs no API key.
+func (a *app) reservesHandler(rw http.ResponseWriter, r *http.Request) {
+	reserves, err := a.signedReserves(r.Context())
+	if errors.Is(err, bank.ErrUnavailable) {
+		apiError(rw, http.StatusServiceUnavailable, "bank is unavailable")
+		return
+	} else if err != nil {
+		mlog.From(a.cmp).Error("error generating proof of reserves", r.Context(), merr.Context(err))
+		apiError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(reserves)
+}
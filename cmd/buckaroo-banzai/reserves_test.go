@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/keypair"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestReserves(t *T) {
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+
+	var supplyCalls int
+	a := &app{
+		cmp:             mtest.Component(),
+		bank:            bank.NewInMem(),
+		currencyName:    "BUCK",
+		currency:        currencyFormat{decimals: 2},
+		extraCurrencies: []string{"SEASON"},
+		stellar: &stellarServer{
+			kp:      kp,
+			timeout: time.Second,
+			client: &stellartest.Mock{
+				AssetSupplyFn: func(_ context.Context, asset stellar.Asset) (string, error) {
+					supplyCalls++
+					if asset.Code == "BUCK" {
+						return "4.5000000", nil
+					}
+					return "0", nil
+				},
+			},
+		},
+	}
+
+	_, err = a.bank.Incr("U1", 150)
+	massert.Require(t, massert.Nil(err))
+	_, err = a.bank.Incr(bank.CurrencyAccountID("U1", "SEASON"), 300)
+	massert.Require(t, massert.Nil(err))
+
+	get := func() signedReserves {
+		rw := httptest.NewRecorder()
+		a.reservesHandler(rw, httptest.NewRequest("GET", reservesPath, nil))
+		massert.Require(t, massert.Equal(http.StatusOK, rw.Code))
+		var res signedReserves
+		massert.Require(t, massert.Nil(json.Unmarshal(rw.Body.Bytes(), &res)))
+		return res
+	}
+
+	res := get()
+	sig, err := base64.StdEncoding.DecodeString(res.Signature)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(kp.Address(), res.Signer),
+		massert.Nil(kp.Verify([]byte(res.Report), sig)),
+	)
+
+	var report reservesReport
+	massert.Require(t, massert.Nil(json.Unmarshal([]byte(res.Report), &report)))
+	massert.Require(t, massert.Equal([]reserve{
+		{Code: "BUCK", Issuer: kp.Address(), Liabilities: "1.5", Outstanding: "4.5000000"},
+		{Code: "SEASON", Issuer: kp.Address(), Liabilities: "3", Outstanding: "0"},
+	}, report.Reserves))
+
+	// a report is published for a while before a new one is generated.
+	_, err = a.bank.Incr("U1", 50)
+	massert.Require(t, massert.Nil(err))
+	massert.Require(t,
+		massert.Equal(res, get()),
+		massert.Equal(2, supplyCalls),
+	)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/analytics"
+)
+
+// role describes what a user is allowed to do. Roles are ordered, each role is
+// allowed to do everything the roles below it can.
+type role int
+
+const (
+	roleUser role = iota
+	roleModerator
+	roleAdmin
+)
+
+// roleMetaKey is the bank metadata key which roles are stored under.
+const roleMetaKey = "role"
+
+func (r role) String() string {
+	switch r {
+	case roleModerator:
+		return "moderator"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "user"
+	}
+}
+
+func parseRole(str string) (role, error) {
+	switch strings.ToLower(str) {
+	case "", "user":
+		return roleUser, nil
+	case "moderator":
+		return roleModerator, nil
+	case "admin":
+		return roleAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown role %q", str)
+	}
+}
+
+// parseRoleUserIDs adds the given comma separated list of user IDs to the
+// roles map with the given role.
+func parseRoleUserIDs(roles map[string]role, userIDs string, r role) {
+	for _, userID := range strings.Split(userIDs, ",") {
+		if userID = strings.TrimSpace(userID); userID != "" && roles[userID] < r {
+			roles[userID] = r
+		}
+	}
+}
+
+// roleOf returns the role of the given account. This is the higher of the role
+// given in the configuration and the role stored in the bank, so that roles
+// given by configuration can't be taken away via commands.
+func (a *app) roleOf(accountID string) (role, error) {
+	roleStr, err := a.bank.GetMeta(accountID, roleMetaKey)
+	if err != nil {
+		return 0, fmt.Errorf("getting role of %q: %w", accountID, err)
+	}
+
+	r, err := parseRole(roleStr)
+	if err != nil {
+		return 0, fmt.Errorf("parsing stored role of %q: %w", accountID, err)
+	}
+
+	if configRole := a.configRoles[accountID]; configRole > r {
+		r = configRole
+	}
+	return r, nil
+}
+
+// setRole stores the role of the given account in the bank.
+func (a *app) setRole(ctx context.Context, accountID string, r role) error {
+	roleStr := r.String()
+	if r == roleUser {
+		roleStr = ""
+	}
+	if err := a.bank.SetMeta(accountID, roleMetaKey, roleStr); err != nil {
+		return fmt.Errorf("setting role of %q: %w", accountID, err)
+	}
+	a.audit(mctx.Annotate(ctx, "roleAccountID", accountID, "role", r.String()), "role changed")
+	return nil
+}
+
+// audit logs a privileged action, and mirrors it to analytics. The context is
+// expected to have been annotated with whoever performed the action, and what
+// they did it to.
+func (a *app) audit(ctx context.Context, action string) {
+	mlog.From(a.cmp).Info(action, mctx.Annotate(ctx, "audit", true))
+	a.analytics.Record(analytics.Event{
+		Kind:   analytics.KindAudit,
+		Action: action,
+		Fields: mctx.Annotations(ctx).StringMap(),
+	})
+}
+
+func (a *app) cmdRole(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		a.reply(req, "usage: `role @<user> [user|moderator|admin]`")
+		return nil
+	}
+
+	dstAccountID, err := a.accountIDByUserID(req.args[0])
+	if err != nil {
+		return err
+	}
+	dstUserID := userIDFromAccountID(dstAccountID)
+	ctx = mctx.Annotate(ctx, "dstAccountID", dstAccountID)
+
+	if len(req.args) == 1 {
+		r, err := a.roleOf(dstAccountID)
+		if err != nil {
+			return err
+		}
+		a.reply(req, "<@%s> is a %s", dstUserID, r)
+		return nil
+	}
+
+	if req.role < roleAdmin {
+		a.reply(req, "nice try, kid")
+		return nil
+	}
+
+	r, err := parseRole(req.args[1])
+	if err != nil {
+		return err
+	} else if err := a.setRole(ctx, dstAccountID, r); err != nil {
+		return err
+	}
+
+	// roles given by configuration can't be taken away, so say what the
+	// user's role actually is now.
+	if r, err = a.roleOf(dstAccountID); err != nil {
+		return err
+	}
+	a.reply(req, "<@%s> is now a %s", dstUserID, r)
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+)
+
+// quietHours is when buckaroo holds off on announcements and notifications, so
+// that nobody gets pinged in the middle of the night or on the weekend.
+//
+// All methods are no-ops on a nil quietHours.
+type quietHours struct {
+	// the default timezone, used for announcements and for users whose
+	// timezone isn't known.
+	loc *time.Location
+
+	// the daily window, as offsets from midnight. If start is after end then
+	// the window wraps around midnight. If they're equal then there's no daily
+	// window.
+	start, end time.Duration
+
+	weekends bool
+}
+
+func instQuietHours(parent *mcmp.Component) *quietHours {
+	cmp := parent.Child("quiet-hours")
+	q := new(quietHours)
+
+	window := mcfg.String(cmp, "window",
+		mcfg.ParamUsage("Daily window, e.g. \"22:00-08:00\", during which announcements and notifications are held until the window ends. Notifications use each user's timezone from their slack profile."))
+	weekends := mcfg.Bool(cmp, "weekends",
+		mcfg.ParamUsage("If set then weekends are also quiet hours"))
+	timezone := mcfg.String(cmp, "timezone",
+		mcfg.ParamDefault("UTC"),
+		mcfg.ParamUsage("Timezone of quiet hours for announcements, and for users whose timezone isn't known, e.g. \"America/New_York\""))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if q.loc, err = time.LoadLocation(*timezone); err != nil {
+			return fmt.Errorf("loading --quiet-hours-timezone: %w", err)
+		} else if q.start, q.end, err = parseQuietWindow(*window); err != nil {
+			return fmt.Errorf("parsing --quiet-hours-window: %w", err)
+		}
+		q.weekends = *weekends
+		return nil
+	})
+
+	return q
+}
+
+// parseQuietWindow parses a window of the form "HH:MM-HH:MM". The empty string
+// is no window.
+func parseQuietWindow(str string) (time.Duration, time.Duration, error) {
+	if str == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New(`must be of the form "HH:MM-HH:MM"`)
+	}
+
+	var offsets [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("parsing %q: %w", part, err)
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if offsets[0] == offsets[1] {
+		return 0, 0, errors.New("start and end can't be the same")
+	}
+	return offsets[0], offsets[1], nil
+}
+
+func (q *quietHours) enabled() bool {
+	return q != nil && (q.start != q.end || q.weekends)
+}
+
+// until returns when the quiet hours which t falls into end, using the given
+// location or the default one if nil. If t isn't in quiet hours then the zero
+// time is returned.
+func (q *quietHours) until(t time.Time, loc *time.Location) time.Time {
+	if !q.enabled() {
+		return time.Time{}
+	} else if loc == nil {
+		loc = q.loc
+	}
+
+	orig := t
+	t = t.In(loc)
+
+	// a night window can end on a saturday morning, and the weekend then ends
+	// in the middle of a night window, so this might take a few goes.
+	for i := 0; i < 4; i++ {
+		y, m, d := t.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		nextMidnight := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		sinceMidnight := t.Sub(midnight)
+
+		if wd := t.Weekday(); q.weekends && (wd == time.Saturday || wd == time.Sunday) {
+			t = nextMidnight
+		} else if q.start < q.end && sinceMidnight >= q.start && sinceMidnight < q.end {
+			t = midnight.Add(q.end)
+		} else if q.start > q.end && sinceMidnight >= q.start {
+			t = nextMidnight.Add(q.end)
+		} else if q.start > q.end && sinceMidnight < q.end {
+			t = midnight.Add(q.end)
+		} else {
+			break
+		}
+	}
+
+	if t.Equal(orig) {
+		return time.Time{}
+	}
+	return t
+}
+
+// userLocation returns the timezone set in the user's slack profile, or nil
+// if it isn't known.
+func (a *app) userLocation(userID string) *time.Location {
+	user, err := a.slack.GetUser(userID)
+	if err != nil || user.TZ == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(user.TZ)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+// scheduler runs functions at some point in the future. Anything still
+// scheduled when it's flushed is run immediately, so that nothing is lost on
+// shutdown. Nothing is persisted, so if buckaroo crashes then whatever was
+// scheduled is lost.
+type scheduler struct {
+	l      sync.Mutex
+	nextID int
+	timers map[int]*time.Timer
+	fns    map[int]func()
+	keys   map[int]string
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		timers: map[int]*time.Timer{},
+		fns:    map[int]func(){},
+		keys:   map[int]string{},
+	}
+}
+
+// at schedules fn to be run at the given time.
+func (s *scheduler) at(t time.Time, fn func()) {
+	s.atKey("", t, fn)
+}
+
+// atKey is like at, but fn can be run early using flushKey with the same key.
+func (s *scheduler) atKey(key string, t time.Time, fn func()) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.fns[id] = fn
+	if key != "" {
+		s.keys[id] = key
+	}
+	s.timers[id] = time.AfterFunc(time.Until(t), func() { s.run(id) })
+}
+
+func (s *scheduler) run(id int) {
+	s.l.Lock()
+	fn, ok := s.fns[id]
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+	}
+	delete(s.fns, id)
+	delete(s.timers, id)
+	delete(s.keys, id)
+	s.l.Unlock()
+
+	if ok {
+		fn()
+	}
+}
+
+// flush runs everything which is scheduled immediately.
+func (s *scheduler) flush() {
+	s.l.Lock()
+	ids := make([]int, 0, len(s.fns))
+	for id := range s.fns {
+		ids = append(ids, id)
+	}
+	s.l.Unlock()
+
+	for _, id := range ids {
+		s.run(id)
+	}
+}
+
+// flushKey runs everything which was scheduled with the given key
+// immediately, in the order it was scheduled.
+func (s *scheduler) flushKey(key string) {
+	s.l.Lock()
+	var ids []int
+	for id, k := range s.keys {
+		if k == key {
+			ids = append(ids, id)
+		}
+	}
+	s.l.Unlock()
+
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.run(id)
+	}
+}
+
+// deferQuiet schedules fn to be run once quiet hours are over, and returns
+// true, or returns false if it isn't quiet hours and fn should be run now. If
+// a user ID is given then quiet hours are in that user's timezone.
+func (a *app) deferQuiet(ctx context.Context, userID string, fn func()) bool {
+	if a.scheduler == nil || !a.quietHours.enabled() {
+		return false
+	}
+	var loc *time.Location
+	if userID != "" {
+		loc = a.userLocation(userID)
+	}
+	until := a.quietHours.until(time.Now(), loc)
+	if until.IsZero() {
+		return false
+	}
+	mlog.From(a.cmp).Debug("deferring until quiet hours are over",
+		mctx.Annotate(ctx, "until", until.Format(time.RFC3339)))
+	a.scheduler.at(until, fn)
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestParseQuietWindow(t *T) {
+	start, end, err := parseQuietWindow("22:00-08:30")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(22*time.Hour, start),
+		massert.Equal(8*time.Hour+30*time.Minute, end),
+	)
+
+	start, end, err = parseQuietWindow("")
+	massert.Require(t, massert.Nil(err), massert.Equal(start, end))
+
+	for _, str := range []string{"22:00", "22:00-08:00-09:00", "9am-5pm", "08:00-08:00"} {
+		_, _, err := parseQuietWindow(str)
+		massert.Require(t, massert.Comment(massert.Not(massert.Nil(err)), "str:%q", str))
+	}
+}
+
+func TestQuietHoursUntil(t *T) {
+	ny, err := time.LoadLocation("America/New_York")
+	massert.Require(t, massert.Nil(err))
+
+	// 2020-01-06 is a monday.
+	at := func(day, hour, min int, loc *time.Location) time.Time {
+		return time.Date(2020, 1, day, hour, min, 0, 0, loc)
+	}
+
+	night := &quietHours{loc: time.UTC, start: 22 * time.Hour, end: 8 * time.Hour}
+	day := &quietHours{loc: time.UTC, start: 12 * time.Hour, end: 13 * time.Hour}
+	nightWeekends := &quietHours{loc: time.UTC, start: 22 * time.Hour, end: 8 * time.Hour, weekends: true}
+	weekends := &quietHours{loc: time.UTC, weekends: true}
+
+	type test struct {
+		q     *quietHours
+		t     time.Time
+		loc   *time.Location
+		until time.Time
+	}
+
+	tests := []test{
+		{q: nil, t: at(6, 23, 0, time.UTC)},
+		{q: &quietHours{loc: time.UTC}, t: at(6, 23, 0, time.UTC)},
+		{q: night, t: at(6, 12, 0, time.UTC)},
+		{q: night, t: at(6, 23, 0, time.UTC), until: at(7, 8, 0, time.UTC)},
+		{q: night, t: at(7, 3, 0, time.UTC), until: at(7, 8, 0, time.UTC)},
+		{q: night, t: at(7, 8, 0, time.UTC)},
+		{q: day, t: at(6, 12, 30, time.UTC), until: at(6, 13, 0, time.UTC)},
+		{q: day, t: at(6, 13, 0, time.UTC)},
+		{q: weekends, t: at(10, 23, 0, time.UTC)},
+		{q: weekends, t: at(11, 9, 0, time.UTC), until: at(13, 0, 0, time.UTC)},
+
+		// friday night runs into the weekend, which runs into sunday night.
+		{q: nightWeekends, t: at(10, 23, 0, time.UTC), until: at(13, 8, 0, time.UTC)},
+		{q: nightWeekends, t: at(12, 9, 0, time.UTC), until: at(13, 8, 0, time.UTC)},
+
+		// 03:00 UTC is 22:00 the night before in new york.
+		{q: night, t: at(7, 3, 0, time.UTC), loc: ny, until: at(7, 8, 0, ny)},
+		{q: night, t: at(7, 1, 0, time.UTC), loc: ny},
+	}
+
+	for i, test := range tests {
+		until := test.q.until(test.t, test.loc)
+		massert.Require(t, massert.Comment(
+			massert.Equal(true, test.until.Equal(until)),
+			"test:%d until:%v expected:%v", i, until, test.until,
+		))
+	}
+}
+
+func TestScheduler(t *T) {
+	s := newScheduler()
+	ranCh := make(chan int, 2)
+	s.at(time.Now().Add(10*time.Millisecond), func() { ranCh <- 1 })
+	s.at(time.Now().Add(time.Hour), func() { ranCh <- 2 })
+
+	massert.Require(t, massert.Equal(1, <-ranCh))
+	s.flush()
+	massert.Require(t, massert.Equal(2, <-ranCh))
+
+	// flushing again doesn't run anything twice.
+	s.flush()
+	massert.Require(t, massert.Equal(0, len(ranCh)))
+}
+
+func TestSchedulerFlushKey(t *T) {
+	s := newScheduler()
+	ranCh := make(chan int, 3)
+	s.atKey("a", time.Now().Add(time.Hour), func() { ranCh <- 1 })
+	s.atKey("b", time.Now().Add(time.Hour), func() { ranCh <- 2 })
+	s.atKey("a", time.Now().Add(time.Hour), func() { ranCh <- 3 })
+
+	s.flushKey("a")
+	massert.Require(t,
+		massert.Equal(2, len(ranCh)),
+		massert.Equal(1, <-ranCh),
+		massert.Equal(3, <-ranCh),
+	)
+	s.flush()
+	massert.Require(t, massert.Equal(2, <-ranCh))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+const payUsage = "usage: `pay @<user> <amount> [<currency>] <when>`, e.g. `pay @someone 5 tomorrow`, `pay @someone 5 in 3d` or `pay @someone 5 2024-01-31`"
+
+const paymentsUsage = "usage: `payments` to list the payments you've scheduled, `payments cancel <id>` to cancel one"
+
+// scheduledPaymentBatch is how many due scheduled payments are read from the
+// bank at a time.
+const scheduledPaymentBatch = 100
+
+// scheduledPaymentsMax is how many payments a user can have scheduled at once,
+// in each currency.
+const scheduledPaymentsMax = 20
+
+// scheduledPaymentMaxAhead is how far into the future a payment can be
+// scheduled.
+const scheduledPaymentMaxAhead = 366 * 24 * time.Hour
+
+// paymentScheduler periodically makes scheduled payments which are due.
+// Making a payment is atomic, so it's safe for every instance to run it at
+// once.
+type paymentScheduler struct {
+	cmp      *mcmp.Component
+	interval time.Duration
+}
+
+func instPaymentScheduler(parent *mcmp.Component) *paymentScheduler {
+	cmp := parent.Child("scheduled-payments")
+	ps := &paymentScheduler{cmp: cmp}
+
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("1m"),
+		mcfg.ParamUsage("How often to make scheduled payments which are due. 0 disables making them."))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if ps.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --scheduled-payments-interval: %w", err)
+		}
+		return nil
+	})
+
+	return ps
+}
+
+// parsePaymentTime parses when a scheduled payment is to be made, relative to
+// now. It can be `tomorrow`, a date (which the payment is made at 9am of, in
+// the given location), or a duration like `3d` or `in 2w`.
+func parsePaymentTime(str string, now time.Time, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var at time.Time
+	if strings.EqualFold(str, "tomorrow") {
+		at = now.Add(24 * time.Hour)
+	} else if date, err := time.ParseInLocation("2006-01-02", str, loc); err == nil {
+		at = date.Add(9 * time.Hour)
+	} else {
+		d, err := parseAwayDuration(strings.TrimPrefix(str, "in "))
+		if err != nil {
+			return time.Time{}, inputErrorf("`%s` isn't a time, it should be like `tomorrow`, `in 3d` or `2024-01-31`", str)
+		}
+		at = now.Add(d)
+	}
+
+	if !at.After(now) {
+		return time.Time{}, inputErrorf("`%s` has already happened", str)
+	} else if at.Sub(now) > scheduledPaymentMaxAhead {
+		return time.Time{}, inputErrorf("payments can't be scheduled more than a year ahead")
+	}
+	return at, nil
+}
+
+// formatPaymentTime formats the time a scheduled payment is made at in the
+// location of the given user.
+func (a *app) formatPaymentTime(userID string, at time.Time) string {
+	if loc := a.userLocation(userID); loc != nil {
+		at = at.In(loc)
+	}
+	return at.Format("Mon Jan 2 15:04 MST")
+}
+
+func (a *app) cmdPay(ctx context.Context, req commandReq) error {
+	// as with give, the currency can go anywhere.
+	currency := bank.DefaultCurrency
+	for i, arg := range req.args {
+		if c, ok := a.extraCurrency(arg); ok {
+			currency = c
+			req.args = append(req.args[:i:i], req.args[i+1:]...)
+			break
+		}
+	}
+
+	if len(req.args) < 2 {
+		a.reply(req, payUsage)
+		return nil
+	}
+
+	amountStr, dstUserIDs, when, ok := splitGiveArgs(req.args)
+	if !ok {
+		a.reply(req, "neither `%s` nor `%s` is an amount. %s", req.args[0], req.args[1], payUsage)
+		return nil
+	} else if len(dstUserIDs) != 1 {
+		return inputErrorf("a payment can only be scheduled to one user at a time. %s", payUsage)
+	} else if when == "" {
+		return inputErrorf("you need to say when to make the payment. %s", payUsage)
+	}
+
+	ctx = mctx.Annotate(ctx, "amount", amountStr, "currency", currency)
+	amount, err := a.parseAmount(amountStr)
+	if err != nil {
+		return err
+	}
+
+	at, err := parsePaymentTime(when, time.Now(), a.userLocation(req.user.ID))
+	if err != nil {
+		return err
+	}
+
+	dstAccountID, err := a.accountIDByUserID(dstUserIDs[0])
+	if err != nil {
+		return err
+	} else if dstAccountID == req.accountID {
+		a.reply(req, "quit playing with yourself, kid")
+		return nil
+	}
+
+	srcAccountID := bank.CurrencyAccountID(req.accountID, currency)
+	if payments, err := a.bank.ScheduledPayments(srcAccountID); err != nil {
+		return err
+	} else if len(payments) >= scheduledPaymentsMax {
+		return inputErrorf("you can't have more than %d payments scheduled at once, `payments cancel` some first", scheduledPaymentsMax)
+	}
+
+	paymentID, err := a.bank.SchedulePayment(srcAccountID, bank.CurrencyAccountID(dstAccountID, currency), amount, at)
+	if err != nil {
+		return err
+	}
+	a.audit(mctx.Annotate(ctx,
+		"paymentID", paymentID,
+		"dstAccountID", dstAccountID,
+		"at", at.String()), "payment scheduled")
+
+	a.replyMsg(req, slackbot.NewMessage("I'll pay <@%s> %s from you on %s :calendar:",
+		userIDFromAccountID(dstAccountID), a.formatAmountIn(currency, amount, true), a.formatPaymentTime(req.user.ID, at)).
+		Context("`payments cancel %s` to cancel it", paymentID))
+	return nil
+}
+
+func (a *app) cmdPayments(ctx context.Context, req commandReq) error {
+	if len(req.args) > 0 {
+		if !strings.EqualFold(req.args[0], "cancel") || len(req.args) < 2 {
+			a.reply(req, paymentsUsage)
+			return nil
+		}
+		return a.cancelScheduledPayment(ctx, req, req.args[1])
+	}
+
+	var payments []bank.ScheduledPayment
+	for _, currency := range append([]string{bank.DefaultCurrency}, a.extraCurrencies...) {
+		currencyPayments, err := a.bank.ScheduledPayments(bank.CurrencyAccountID(req.accountID, currency))
+		if err != nil {
+			return err
+		}
+		payments = append(payments, currencyPayments...)
+	}
+	if len(payments) == 0 {
+		a.reply(req, "you don't have any payments scheduled")
+		return nil
+	}
+	sort.Slice(payments, func(i, j int) bool { return payments[i].At.Before(payments[j].At) })
+
+	strb := new(strings.Builder)
+	fmt.Fprintf(strb, "you have %d payment(s) scheduled:\n", len(payments))
+	for _, p := range payments {
+		dstAccountID, currency := bank.SplitCurrencyAccountID(p.DstUserID)
+		fmt.Fprintf(strb, "• `%s` %s to <@%s> on %s\n", p.ID,
+			a.formatAmountIn(currency, p.Amount, true), userIDFromAccountID(dstAccountID),
+			a.formatPaymentTime(req.user.ID, p.At))
+	}
+	a.replyMsg(req, slackbot.NewMessage("%s", strb.String()).Context("%s", paymentsUsage))
+	return nil
+}
+
+// cancelScheduledPayment cancels one of the user's own scheduled payments.
+func (a *app) cancelScheduledPayment(ctx context.Context, req commandReq, paymentID string) error {
+	ctx = mctx.Annotate(ctx, "paymentID", paymentID)
+
+	// the payment is looked for among the user's own, so that nobody can
+	// cancel someone else's by guessing its ID.
+	var found bool
+	for _, currency := range append([]string{bank.DefaultCurrency}, a.extraCurrencies...) {
+		payments, err := a.bank.ScheduledPayments(bank.CurrencyAccountID(req.accountID, currency))
+		if err != nil {
+			return err
+		}
+		for _, p := range payments {
+			found = found || p.ID == paymentID
+		}
+	}
+	if !found {
+		return inputErrorf("you don't have a payment `%s` scheduled", paymentID)
+	}
+
+	p, err := a.bank.CancelScheduledPayment(paymentID)
+	if errors.Is(err, bank.ErrScheduledPaymentNotFound) {
+		return inputErrorf("payment `%s` has already been made or canceled", paymentID)
+	} else if err != nil {
+		return err
+	}
+	a.audit(ctx, "scheduled payment canceled")
+
+	dstAccountID, currency := bank.SplitCurrencyAccountID(p.DstUserID)
+	a.reply(req, "canceled your payment of %s to <@%s>",
+		a.formatAmountIn(currency, p.Amount, true), userIDFromAccountID(dstAccountID))
+	return nil
+}
+
+// makeDueScheduledPayments makes every scheduled payment which is due as of
+// now, returning how many were made. A payment whose payer can't afford it is
+// canceled, and the payer told so.
+func (a *app) makeDueScheduledPayments(ctx context.Context, now time.Time) (int, error) {
+	var made int
+	for {
+		payments, err := a.bank.DueScheduledPayments(now, scheduledPaymentBatch)
+		if err != nil {
+			return made, fmt.Errorf("getting due scheduled payments: %w", err)
+		}
+
+		var skipped int
+		for _, p := range payments {
+			srcAccountID, currency := bank.SplitCurrencyAccountID(p.SrcUserID)
+			dstAccountID, _ := bank.SplitCurrencyAccountID(p.DstUserID)
+			srcUserID, dstUserID := userIDFromAccountID(srcAccountID), userIDFromAccountID(dstAccountID)
+			ctx := mctx.Annotate(ctx,
+				"paymentID", p.ID,
+				"srcUserID", p.SrcUserID,
+				"dstUserID", p.DstUserID,
+				"amount", p.Amount)
+
+			_, newDstBalance, _, err := a.bank.PayScheduledPayment(p.ID)
+			if errors.Is(err, bank.ErrScheduledPaymentNotFound) {
+				// made or canceled since it was read.
+				continue
+			} else if errors.Is(err, bank.ErrNotEnoughFunds) {
+				if _, err := a.bank.CancelScheduledPayment(p.ID); errors.Is(err, bank.ErrScheduledPaymentNotFound) {
+					continue
+				} else if err != nil {
+					return made, fmt.Errorf("canceling scheduled payment %q: %w", p.ID, err)
+				}
+				mlog.From(a.cmp).Info("canceled scheduled payment which couldn't be afforded", ctx)
+				msg := slackbot.NewMessage("you couldn't afford your scheduled payment of %s to <@%s>, so I've canceled it",
+					a.formatAmountIn(currency, p.Amount, true), dstUserID)
+				if err := a.notifyOnce(srcUserID, "scheduled-payment-failed:"+p.ID, msg); err != nil {
+					mlog.From(a.cmp).Warn("error notifying user of failed scheduled payment", ctx, merr.Context(err))
+				}
+				continue
+			} else if err != nil {
+				// left for the next run, rather than holding up every other
+				// payment.
+				mlog.From(a.cmp).Error("error making scheduled payment", ctx, merr.Context(err))
+				skipped++
+				continue
+			}
+			mlog.From(a.cmp).Info("made scheduled payment", ctx)
+			made++
+
+			notificationID := "scheduled-payment:" + p.ID
+			dstMsg := slackbot.NewMessage("paid you %s, as they scheduled, giving you a total of %s",
+				a.formatAmountIn(currency, p.Amount, true), a.formatNumber(newDstBalance)).Mention(srcUserID)
+			if err := a.notifyOnce(dstUserID, notificationID, dstMsg); err != nil {
+				mlog.From(a.cmp).Warn("error notifying user of scheduled payment", ctx, merr.Context(err))
+			}
+			srcMsg := slackbot.NewMessage("your scheduled payment of %s to <@%s> has been made :money_with_wings:",
+				a.formatAmountIn(currency, p.Amount, true), dstUserID)
+			if err := a.notifyOnce(srcUserID, notificationID, srcMsg); err != nil {
+				mlog.From(a.cmp).Warn("error notifying user of scheduled payment", ctx, merr.Context(err))
+			}
+		}
+
+		// payments which errored are still due, so reading another batch
+		// would only return them again.
+		if len(payments) < scheduledPaymentBatch || skipped == len(payments) {
+			return made, nil
+		}
+	}
+}
+
+// runScheduledPayments makes due scheduled payments every
+// --scheduled-payments-interval, until the Context is canceled.
+func (a *app) runScheduledPayments(ctx context.Context) {
+	pay := func() {
+		if _, err := a.makeDueScheduledPayments(ctx, time.Now()); err != nil {
+			mlog.From(a.cmp).Error("error making scheduled payments", ctx, merr.Context(err))
+		}
+	}
+
+	pay()
+	ticker := time.NewTicker(a.scheduledPayments.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pay()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestParsePaymentTime(t *T) {
+	now := time.Date(2024, 1, 10, 15, 0, 0, 0, time.UTC)
+	for str, exp := range map[string]time.Time{
+		"tomorrow":   now.Add(24 * time.Hour),
+		"in 3d":      now.Add(3 * 24 * time.Hour),
+		"2w":         now.Add(14 * 24 * time.Hour),
+		"2024-01-31": time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC),
+	} {
+		at, err := parsePaymentTime(str, now, nil)
+		massert.Require(t,
+			massert.Comment(massert.Nil(err), "str:%q", str),
+			massert.Comment(massert.Equal(exp, at), "str:%q", str),
+		)
+	}
+
+	for _, str := range []string{"", "soon", "2024-01-01", "in 0d", "2w2", "2026-01-01"} {
+		_, err := parsePaymentTime(str, now, nil)
+		massert.Require(t, massert.Comment(massert.Not(massert.Nil(err)), "str:%q", str))
+	}
+}
+
+func TestScheduledPayments(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		slackClient:  &slackbot.Client{BotTeamID: "T1"},
+		currencyName: "BUCK",
+	}
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser("U1", "u1", "T1")
+		fs.AddUser("U2", "u2", "T1")
+		channel := fs.AddChannel("D1", true)
+
+		ctx := context.Background()
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		scheduled := func() []bank.ScheduledPayment {
+			payments, err := a.bank.ScheduledPayments(userA.ID)
+			massert.Require(t, massert.Nil(err))
+			return payments
+		}
+		req := func(args ...string) commandReq {
+			return commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      userA,
+				accountID: userA.ID,
+				role:      roleUser,
+				args:      args,
+			}
+		}
+
+		_, err := a.bank.Incr(userA.ID, 10)
+		massert.Require(t, massert.Nil(err))
+
+		massert.Require(t,
+			massert.Nil(a.cmdPay(ctx, req("U2", "5", "in", "1h"))),
+			massert.Nil(a.cmdPay(ctx, req("6", "U2", "tomorrow"))),
+			massert.Length(scheduled(), 2),
+		)
+		_, isInputErr := a.cmdPay(ctx, req("U2", "5")).(inputError)
+		massert.Require(t, massert.Equal(true, isInputErr), massert.Length(scheduled(), 2))
+		fs.Flush()
+
+		// nothing is due yet.
+		made, err := a.makeDueScheduledPayments(ctx, time.Now())
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(0, made),
+			massert.Equal(10, balanceOf(userA.ID)),
+		)
+
+		// the first is made, and both users are DM'd. The second can't be
+		// afforded after that, so it's canceled and the payer is told so.
+		made, err = a.makeDueScheduledPayments(ctx, time.Now().Add(48*time.Hour))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(1, made),
+			massert.Equal(5, balanceOf(userA.ID)),
+			massert.Equal(5, balanceOf("U2")),
+			massert.Length(scheduled(), 0),
+			massert.Length(fs.Flush(), 3),
+		)
+
+		// a canceled payment is never made.
+		massert.Require(t, massert.Nil(a.cmdPay(ctx, req("U2", "1", "in", "1h"))))
+		payments := scheduled()
+		massert.Require(t, massert.Length(payments, 1))
+		massert.Require(t,
+			massert.Nil(a.cmdPayments(ctx, req("cancel", payments[0].ID))),
+			massert.Length(scheduled(), 0),
+		)
+		made, err = a.makeDueScheduledPayments(ctx, time.Now().Add(48*time.Hour))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(0, made),
+			massert.Equal(5, balanceOf(userA.ID)),
+		)
+	})
+}
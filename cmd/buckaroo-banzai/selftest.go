@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/radix/v3"
+)
+
+// selfTestTimeout is how long each self-test check gets before it's considered
+// failed.
+const selfTestTimeout = 30 * time.Second
+
+// selfTestCheck is a single check performed by --self-test or
+// --validate-config. fn returns a short description of what it found, which
+// goes into the report.
+type selfTestCheck struct {
+	name string
+	fn   func(ctx context.Context) (string, error)
+}
+
+// selfTestChecks returns the checks which --self-test performs. They're run
+// once all components have been initialized, and each exercises a dependency
+// which buckaroo can't work without.
+func (a *app) selfTestChecks() []selfTestCheck {
+	return []selfTestCheck{
+		{"redis", a.selfTestRedis},
+		{"stellar redis", func(ctx context.Context) (string, error) {
+			var pong string
+			if err := a.stellar.redis.Do(radix.Cmd(&pong, "PING")); err != nil {
+				return "", err
+			}
+			return pong, nil
+		}},
+		{"slack", func(ctx context.Context) (string, error) {
+			res, err := a.slackClient.Client.AuthTest()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("authenticated as %s on %s", res.User, res.Team), nil
+		}},
+		{"horizon", func(ctx context.Context) (string, error) {
+			root, err := a.stellar.client.Root(ctx)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("horizon %s, ledger %d", root.HorizonVersion, root.HorizonSequence), nil
+		}},
+		{"federation", a.selfTestFederation},
+	}
+}
+
+// selfTestRedis does a write/read/delete round-trip through the bank.
+func (a *app) selfTestRedis(ctx context.Context) (string, error) {
+	const userID, key = "self-test", "selfTest"
+	value := mrand.Hex(8)
+	if err := a.bank.SetMeta(userID, key, value); err != nil {
+		return "", err
+	}
+	defer a.bank.SetMeta(userID, key, "")
+
+	if got, err := a.bank.GetMeta(userID, key); err != nil {
+		return "", err
+	} else if got != value {
+		return "", fmt.Errorf("wrote %q but read back %q", value, got)
+	}
+	return "round-trip ok", nil
+}
+
+// selfTestFederation looks up buckaroo's own federation address the same way
+// a wallet would, i.e. via the stellar.toml on the configured domain, which
+// checks that the domain is actually pointed at this instance.
+func (a *app) selfTestFederation(ctx context.Context) (string, error) {
+	fedAddr := a.slackClient.BotUser + "*" + a.stellar.domain
+	addr, memo, err := a.stellar.client.ResolveAddr(ctx, fedAddr)
+	if err != nil {
+		return "", err
+	} else if addr != a.stellar.kp.Address() {
+		return "", fmt.Errorf("%s resolved to %s, expected %s", fedAddr, addr, a.stellar.kp.Address())
+	} else if memo != a.slackClient.BotUser {
+		return "", fmt.Errorf("%s resolved with memo %q, expected %q", fedAddr, memo, a.slackClient.BotUser)
+	}
+	return fmt.Sprintf("%s resolved to %s", fedAddr, addr), nil
+}
+
+// runSelfTest runs all the given checks, writing a report of their results to
+// w, and returns whether they all passed. Every check is run even if an earlier
+// one fails, so the report is complete.
+func runSelfTest(ctx context.Context, w io.Writer, checks []selfTestCheck) bool {
+	ok := true
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		start := time.Now()
+		res, err := check.fn(checkCtx)
+		took := time.Since(start).Round(time.Millisecond)
+		cancel()
+
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL  %-14s %s (%v)\n", check.name, err, took)
+		} else {
+			fmt.Fprintf(w, "ok    %-14s %s (%v)\n", check.name, res, took)
+		}
+	}
+
+	if ok {
+		fmt.Fprintln(w, "self-test passed")
+	} else {
+		fmt.Fprintln(w, "self-test FAILED")
+	}
+	return ok
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestRunSelfTest(t *T) {
+	var ran []string
+	check := func(name string, err error) selfTestCheck {
+		return selfTestCheck{name: name, fn: func(context.Context) (string, error) {
+			ran = append(ran, name)
+			return name + " is fine", err
+		}}
+	}
+
+	buf := new(bytes.Buffer)
+	ok := runSelfTest(context.Background(), buf, []selfTestCheck{
+		check("a", nil), check("b", nil),
+	})
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal([]string{"a", "b"}, ran),
+		massert.Equal(true, strings.HasSuffix(buf.String(), "self-test passed\n")),
+	)
+
+	// a failing check doesn't stop the rest from running
+	ran, buf = nil, new(bytes.Buffer)
+	ok = runSelfTest(context.Background(), buf, []selfTestCheck{
+		check("a", errors.New("a is broken")), check("b", nil),
+	})
+	massert.Require(t,
+		massert.Equal(false, ok),
+		massert.Equal([]string{"a", "b"}, ran),
+		massert.Equal(true, strings.HasPrefix(buf.String(), "FAIL  a ")),
+		massert.Equal(true, strings.HasSuffix(buf.String(), "self-test FAILED\n")),
+	)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Settings changed using the setup command are stored in the bank's metadata
+// for setupMetaID, each under the name of the setting as its key.
+const setupMetaID = "setup"
+
+// setupDefault is given in place of a setting's value to go back to the value
+// it was given by its param.
+const setupDefault = "default"
+
+var emojiRegex = regexp.MustCompile(`^:[a-z0-9_+'-]+:$`)
+
+// setupSetting is a setting which admins can change at runtime using the setup
+// command, rather than by restarting buckaroo with a different param. Each is
+// named after the param it overrides.
+type setupSetting struct {
+	name, usage string
+
+	// get returns the setting's current value, and set validates and applies
+	// a new one.
+	get func(a *app) string
+	set func(a *app, value string) error
+}
+
+// setupSettings are all settings which can be changed using the setup command.
+var setupSettings = []setupSetting{
+	{
+		name:  "currency-emoji",
+		usage: "emoji shown alongside amounts of the currency, e.g. `:moneybag:`, or `none`",
+		get: func(a *app) string {
+			if emoji := a.emoji(); emoji != "" {
+				return emoji
+			}
+			return "none"
+		},
+		set: func(a *app, value string) error {
+			if value == "none" {
+				value = ""
+			} else if !emojiRegex.MatchString(value) {
+				return inputErrorf("`%s` doesn't look like an emoji, it should be like `:moneybag:`", value)
+			}
+			a.settingsL.Lock()
+			defer a.settingsL.Unlock()
+			a.currencyEmoji = value
+			return nil
+		},
+	},
+	{
+		name:  "earn-self-reactions",
+		usage: "whether users earn from reacting to their own messages, `true` or `false`",
+		get: func(a *app) string {
+			a.earnPolicy.l.RLock()
+			defer a.earnPolicy.l.RUnlock()
+			return strconv.FormatBool(a.earnPolicy.selfReactions)
+		},
+		set: func(a *app, value string) error {
+			selfReactions, err := strconv.ParseBool(value)
+			if err != nil {
+				return inputErrorf("`earn-self-reactions` must be `true` or `false`")
+			}
+			a.earnPolicy.l.Lock()
+			defer a.earnPolicy.l.Unlock()
+			a.earnPolicy.selfReactions = selfReactions
+			return nil
+		},
+	},
+	earnCapSetting("earn-max-per-message", "the most a message's author can earn from reactions to it",
+		func(p *earnPolicy) *int { return &p.maxPerItem }),
+	earnCapSetting("earn-max-per-hour", "the most a single user can earn from reactions in any one hour",
+		func(p *earnPolicy) *int { return &p.maxPerHour }),
+	earnCapSetting("earn-max-per-reactor", "the most a single user can earn for a message's author by adding multiple reactions to it",
+		func(p *earnPolicy) *int { return &p.maxPerReactor }),
+}
+
+// earnCapSetting returns a setupSetting for one of the earnPolicy's caps,
+// which are disabled by setting them to zero.
+func earnCapSetting(name, usage string, field func(*earnPolicy) *int) setupSetting {
+	return setupSetting{
+		name:  name,
+		usage: usage + ", or `0` for no limit",
+		get: func(a *app) string {
+			a.earnPolicy.l.RLock()
+			defer a.earnPolicy.l.RUnlock()
+			return strconv.Itoa(*field(a.earnPolicy))
+		},
+		set: func(a *app, value string) error {
+			max, err := strconv.Atoi(value)
+			if err != nil || max < 0 {
+				return inputErrorf("`%s` must be a whole number, or `0` for no limit", name)
+			}
+			a.earnPolicy.l.Lock()
+			defer a.earnPolicy.l.Unlock()
+			*field(a.earnPolicy) = max
+			return nil
+		},
+	}
+}
+
+func setupSettingByName(name string) (setupSetting, bool) {
+	for _, s := range setupSettings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setupSetting{}, false
+}
+
+// loadSetup remembers the value each setting was given by its param, and then
+// applies any which have been changed using the setup command.
+func (a *app) loadSetup(ctx context.Context) error {
+	a.setupDefaults = map[string]string{}
+	for _, s := range setupSettings {
+		a.setupDefaults[s.name] = s.get(a)
+
+		value, err := a.bank.GetMeta(setupMetaID, s.name)
+		if err != nil {
+			return fmt.Errorf("getting setting %q: %w", s.name, err)
+		} else if value == "" {
+			continue
+		} else if err := s.set(a, value); err != nil {
+			return fmt.Errorf("applying stored setting %q: %w", s.name, err)
+		}
+		mlog.From(a.cmp).Info("applying stored setting", mctx.Annotate(ctx, "setting", s.name, "value", value))
+	}
+	return nil
+}
+
+// applySetting validates and applies the given value of the setting, and
+// stores it so it's applied again whenever buckaroo is restarted. If the value
+// is setupDefault then the setting goes back to the value given by its param.
+func (a *app) applySetting(ctx context.Context, s setupSetting, value string) error {
+	stored := value
+	if value == setupDefault {
+		value, stored = a.setupDefaults[s.name], ""
+	}
+	if err := s.set(a, value); err != nil {
+		return err
+	} else if err := a.bank.SetMeta(setupMetaID, s.name, stored); err != nil {
+		return fmt.Errorf("storing setting %q: %w", s.name, err)
+	}
+	a.audit(mctx.Annotate(ctx, "setting", s.name, "value", value), "setting changed")
+	return nil
+}
+
+// setupAdmins returns the user IDs of all admins, whether they were made admins
+// by configuration or using the role command.
+func (a *app) setupAdmins() ([]string, error) {
+	roles, err := a.bank.AllMeta(roleMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting roles: %w", err)
+	}
+
+	admins := map[string]bool{}
+	for accountID, roleStr := range roles {
+		if r, _ := parseRole(roleStr); r == roleAdmin {
+			admins[userIDFromAccountID(accountID)] = true
+		}
+	}
+	for accountID, r := range a.configRoles {
+		if r == roleAdmin {
+			admins[userIDFromAccountID(accountID)] = true
+		}
+	}
+
+	userIDs := make([]string, 0, len(admins))
+	for userID := range admins {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
+
+const setupUsage = "usage: `setup [<setting> <value|default>]`"
+
+func (a *app) cmdSetup(ctx context.Context, req commandReq) error {
+	if len(req.args) == 0 {
+		return a.replySetup(req)
+	} else if len(req.args) < 2 {
+		a.reply(req, setupUsage)
+		return nil
+	}
+
+	name := strings.ToLower(req.args[0])
+	s, ok := setupSettingByName(name)
+	if !ok {
+		return inputErrorf("there's no setting called `%s`, DM me `setup` to see them all", name)
+	} else if err := a.applySetting(ctx, s, req.args[1]); err != nil {
+		return err
+	}
+	a.reply(req, "`%s` is now %s", s.name, s.get(a))
+	return nil
+}
+
+// replySetup replies with the current value of every setting, and who the
+// admins are, along with how to change them.
+func (a *app) replySetup(req commandReq) error {
+	admins, err := a.setupAdmins()
+	if err != nil {
+		return err
+	}
+	adminsStr := "nobody"
+	if len(admins) > 0 {
+		adminsStr = "<@" + strings.Join(admins, ">, <@") + ">"
+	}
+
+	fields := []string{"Admins", adminsStr}
+	for _, s := range setupSettings {
+		value := s.get(a)
+		if value == a.setupDefaults[s.name] {
+			value += " (default)"
+		}
+		fields = append(fields, "`"+s.name+"`", value+"\n_"+s.usage+"_")
+	}
+
+	a.replyMsg(req, slackbot.NewMessage(":gear: here's how I'm set up").
+		Fields(fields...).
+		Context("Change a setting with `setup <setting> <value>`, or put it back with `setup <setting> default`. Admins are added and removed with `role @<user> <admin|user>`."))
+	return nil
+}
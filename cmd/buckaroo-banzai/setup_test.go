@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+)
+
+func TestSetup(t *T) {
+	cmp := mtest.Component()
+	b := bank.NewInMem()
+	newApp := func() *app {
+		return &app{
+			cmp:           cmp,
+			bank:          b,
+			currencyEmoji: ":buck:",
+			earnPolicy:    &earnPolicy{maxPerHour: 10},
+			configRoles:   map[string]role{"U1": roleAdmin},
+		}
+	}
+
+	setting := func(name string) setupSetting {
+		s, ok := setupSettingByName(name)
+		massert.Require(t, massert.Equal(true, ok))
+		return s
+	}
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+		a := newApp()
+		massert.Require(t, massert.Nil(a.loadSetup(ctx)))
+
+		massert.Require(t,
+			massert.Nil(a.applySetting(ctx, setting("currency-emoji"), ":moneybag:")),
+			massert.Nil(a.applySetting(ctx, setting("earn-max-per-hour"), "0")),
+			massert.Nil(a.applySetting(ctx, setting("earn-self-reactions"), "true")),
+			massert.Equal(":moneybag:", a.emoji()),
+			massert.Equal(0, a.earnPolicy.maxPerHour),
+			massert.Equal(true, a.earnPolicy.selfReactions),
+		)
+
+		// invalid values aren't applied or stored.
+		massert.Require(t,
+			massert.Not(massert.Nil(a.applySetting(ctx, setting("currency-emoji"), "moneybag"))),
+			massert.Not(massert.Nil(a.applySetting(ctx, setting("earn-max-per-hour"), "-1"))),
+			massert.Equal(":moneybag:", a.emoji()),
+			massert.Equal(0, a.earnPolicy.maxPerHour),
+		)
+
+		// settings are applied again after a restart, and can be put back to
+		// the value given by their param.
+		a = newApp()
+		massert.Require(t, massert.Nil(a.loadSetup(ctx)))
+		massert.Require(t,
+			massert.Equal(":moneybag:", a.emoji()),
+			massert.Equal(0, a.earnPolicy.maxPerHour),
+			massert.Nil(a.applySetting(ctx, setting("earn-max-per-hour"), setupDefault)),
+			massert.Equal(10, a.earnPolicy.maxPerHour),
+		)
+
+		a = newApp()
+		massert.Require(t, massert.Nil(a.loadSetup(ctx)))
+		massert.Require(t, massert.Equal(10, a.earnPolicy.maxPerHour))
+
+		massert.Require(t, massert.Nil(a.setRole(ctx, "U2", roleAdmin)))
+		admins, err := a.setupAdmins()
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal([]string{"U1", "U2"}, admins),
+		)
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+const (
+	// smokeTestTimeout is how long the smoke test waits for any one thing to
+	// happen, e.g. a withdrawal to land on-chain.
+	smokeTestTimeout = 2 * time.Minute
+
+	// smokeTestPollInterval is how often the smoke test checks if the thing
+	// it's waiting on has happened yet.
+	smokeTestPollInterval = 2 * time.Second
+
+	// smokeTestXLM is how much XLM the smoke test's throwaway account is
+	// created with. It's merged back into buckaroo's account at the end.
+	smokeTestXLM = "5"
+)
+
+// waitFor calls fn every smokeTestPollInterval until it returns true, an error,
+// or smokeTestTimeout has passed.
+func waitFor(ctx context.Context, what string, fn func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, smokeTestTimeout)
+	defer cancel()
+	ticker := time.NewTicker(smokeTestPollInterval)
+	defer ticker.Stop()
+	for {
+		if ok, err := fn(); err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s", what)
+		case <-ticker.C:
+		}
+	}
+}
+
+// smokeTest runs the whole loop of buckaroo's economy against testnet, using
+// the account of the admin who ran it and a throwaway stellar account: the
+// admin is minted some currency, which is withdrawn to the throwaway account,
+// which then deposits it back. Balances are checked along the way, and the
+// mint is undone at the end, so the admin's balance should come out the same
+// as it went in.
+//
+// Each step which completes is written to steps, so that the admin can see how
+// far it got if it fails.
+func (a *app) smokeTest(ctx context.Context, req commandReq, amount int, steps *[]string) error {
+	step := func(str string, args ...interface{}) {
+		str = fmt.Sprintf(str, args...)
+		mlog.From(a.cmp).Info("smoke test: "+str, ctx)
+		*steps = append(*steps, str)
+	}
+	amountStr := bank.FormatDecimal(amount, a.currency.decimals)
+	asset := a.asset()
+
+	stellarCtx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	root, err := a.stellar.client.Root(stellarCtx)
+	cancel()
+	if err != nil {
+		return err
+	} else if root.NetworkPassphrase != network.TestNetworkPassphrase {
+		return errors.New("the smoke test can only be run against testnet")
+	}
+
+	before, err := a.bank.Balance(req.accountID)
+	if err != nil {
+		return err
+	}
+	checkBalance := func(expected int) error {
+		if balance, err := a.bank.Balance(req.accountID); err != nil {
+			return err
+		} else if balance != expected {
+			return fmt.Errorf("expected balance of %s, but it's %s", a.formatNumber(expected), a.formatNumber(balance))
+		}
+		return nil
+	}
+
+	if _, err := a.bank.Incr(req.accountID, amount); err != nil {
+		return err
+	} else if err := checkBalance(before + amount); err != nil {
+		return err
+	}
+	step("minted %s to <@%s>, balance went from %s to %s", a.formatNumber(amount), req.user.ID, a.formatNumber(before), a.formatNumber(before+amount))
+
+	testKP, err := keypair.Random()
+	if err != nil {
+		return fmt.Errorf("generating throwaway keypair: %w", err)
+	}
+	ctx = mctx.Annotate(ctx, "smokeTestAddr", testKP.Address())
+
+	submitOps := func(from *keypair.Full, ops ...txnbuild.Operation) error {
+		ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+		defer cancel()
+		txXDR, err := a.stellar.client.MakeOpsXDR(ctx, from, "", ops...)
+		if err != nil {
+			return err
+		}
+		_, err = a.stellar.client.SubmitTransactionXDR(ctx, txXDR)
+		return err
+	}
+
+	err = submitOps(a.stellar.kp, &txnbuild.CreateAccount{
+		Destination: testKP.Address(),
+		Amount:      smokeTestXLM,
+	})
+	if err != nil {
+		return fmt.Errorf("creating throwaway account: %w", err)
+	} else if err := submitOps(testKP, &txnbuild.ChangeTrust{Line: asset.CreditAsset()}); err != nil {
+		return fmt.Errorf("adding trustline to throwaway account: %w", err)
+	}
+	step("created throwaway account `%s` trusting %s", testKP.Address(), a.currencyName)
+
+	defer func() {
+		// the trustline has to be removed before the account can be merged,
+		// which will fail if the currency never made it back.
+		err := submitOps(testKP,
+			&txnbuild.ChangeTrust{Line: asset.CreditAsset(), Limit: "0"},
+			&txnbuild.AccountMerge{Destination: a.stellar.kp.Address()},
+		)
+		if err != nil {
+			mlog.From(a.cmp).Warn("smoke test: could not merge throwaway account", ctx, merr.Context(err))
+			step("could not merge throwaway account back: %s", err)
+		}
+	}()
+
+	// this goes through the same export path as the withdraw command, so the
+	// export workers are what actually submit it.
+	if _, err := a.economy.Withdraw(ctx, req.accountID, testKP.Address(), "", bank.DefaultCurrency, amount); err != nil {
+		return fmt.Errorf("withdrawing: %w", err)
+	} else if err := checkBalance(before); err != nil {
+		return err
+	}
+	step("withdrew %s to the throwaway account, balance went back to %s", a.formatNumber(amount), a.formatNumber(before))
+
+	// sending the currency back can't succeed until the withdrawal has landed,
+	// so keep trying until it does.
+	var lastErr error
+	err = waitFor(ctx, "withdrawal to land", func() (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+		defer cancel()
+		txXDR, err := a.stellar.client.MakeSendXDR(ctx, stellar.SendOpts{
+			From:        testKP,
+			To:          a.stellar.kp.Address(),
+			Memo:        req.user.Name,
+			AssetCode:   a.currencyName,
+			AssetIssuer: a.stellar.issuer(),
+			Amount:      amountStr,
+		})
+		if err == nil {
+			_, err = a.stellar.client.SubmitTransactionXDR(ctx, txXDR)
+		}
+		lastErr = err
+		return err == nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w, last error depositing back was: %v", err, lastErr)
+	}
+	step("withdrawal landed, deposited %s back with memo %q", a.formatNumber(amount), req.user.Name)
+
+	err = waitFor(ctx, "deposit to be credited", func() (bool, error) {
+		balance, err := a.bank.Balance(req.accountID)
+		return balance == before+amount, err
+	})
+	if err != nil {
+		return err
+	}
+	step("deposit was credited, balance went up to %s", a.formatNumber(before+amount))
+
+	if _, err := a.bank.Incr(req.accountID, -amount); err != nil {
+		return err
+	} else if err := checkBalance(before); err != nil {
+		return err
+	}
+	step("undid the mint, balance is back to %s", a.formatNumber(before))
+	return nil
+}
+
+func (a *app) cmdSmokeTest(ctx context.Context, req commandReq) error {
+	amount := a.currency.unit()
+	if len(req.args) > 0 {
+		var err error
+		if amount, err = a.parseAmount(req.args[0]); err != nil {
+			return err
+		}
+	}
+	ctx = mctx.Annotate(ctx, "amount", amount)
+	a.audit(ctx, "started smoke test")
+	a.reply(req, "running the smoke test with %s, this will take a minute or two :hourglass:", a.formatAmount(amount, true))
+
+	var steps []string
+	err := a.smokeTest(ctx, req, amount, &steps)
+
+	var report string
+	if len(steps) > 0 {
+		report = "• " + strings.Join(steps, "\n• ") + "\n"
+	}
+
+	if err != nil {
+		mlog.From(a.cmp).Warn("smoke test failed", ctx, merr.Context(err))
+		a.replyMsg(req, slackbot.NewMessage("%ssmoke test failed: `%s` :x:", report, err).
+			Context("Balances might need cleaning up, the steps above show how far it got"))
+		return nil
+	}
+	a.replyMsg(req, slackbot.NewMessage("%ssmoke test passed :white_check_mark:", report))
+	return nil
+}
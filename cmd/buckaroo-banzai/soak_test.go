@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+	"github.com/stellar/go/keypair"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+var (
+	soakDuration = flag.Duration("soak", 0,
+		"If set then TestSoak injects synthetic slack events for this long")
+	soakRate = flag.Int("soak-rate", 100,
+		"Slack events injected per second by TestSoak")
+	soakUsers = flag.Int("soak-users", 200,
+		"Number of slack users TestSoak spreads events across")
+	soakHorizonLatency = flag.Duration("soak-horizon-latency", 200*time.Millisecond,
+		"How long the fake horizon used by TestSoak takes to respond")
+)
+
+// soakBotUserID is the ID of the bot's own user during TestSoak.
+const soakBotUserID = "UBOT"
+
+// soakBank wraps the bank used by TestSoak, counting the earns and exports
+// which make it into the bank's streams and the earns which are applied, so
+// that the test can tell when everything has been processed.
+type soakBank struct {
+	bank.ExportingBank
+	earnsSubmitted, earnsApplied, exportsSubmitted int64
+}
+
+func (sb *soakBank) SubmitEarn(earn bank.Earn) (string, error) {
+	id, err := sb.ExportingBank.SubmitEarn(earn)
+	if err == nil {
+		atomic.AddInt64(&sb.earnsSubmitted, 1)
+	}
+	return id, err
+}
+
+// ApplyEarn applies earns with IncrOnce, and acks the earn even if the user
+// doesn't have enough funds or it was already applied.
+func (sb *soakBank) IncrOnce(idempotencyKey, userID string, by int, source string) (int, error) {
+	newBalance, err := sb.ExportingBank.IncrOnce(idempotencyKey, userID, by, source)
+	if !strings.HasPrefix(idempotencyKey, "earn:") {
+		return newBalance, err
+	} else if err == nil || errors.Is(err, bank.ErrNotEnoughFunds) || errors.Is(err, bank.ErrDuplicate) {
+		atomic.AddInt64(&sb.earnsApplied, 1)
+	}
+	return newBalance, err
+}
+
+func (sb *soakBank) SubmitExport(e bank.Export) (string, error) {
+	id, err := sb.ExportingBank.SubmitExport(e)
+	if err == nil {
+		atomic.AddInt64(&sb.exportsSubmitted, 1)
+	}
+	return id, err
+}
+
+// soakEvents generates random slack events. Most are reactions, since that's
+// what real traffic mostly is, the rest are commands.
+type soakEvents struct {
+	rnd     *rand.Rand
+	userIDs []string
+	n       int
+
+	// counts of generated events, keyed by kind.
+	counts map[string]int
+}
+
+func (se *soakEvents) user() string {
+	return se.userIDs[se.rnd.Intn(len(se.userIDs))]
+}
+
+func (se *soakEvents) next() slack.RTMEvent {
+	se.n++
+	var data slack.ReactionAddedEvent
+	data.User = se.user()
+	data.ItemUser = se.user()
+	data.Item.Type = "message"
+	data.Item.Channel = "C1"
+	data.Item.Timestamp = fmt.Sprintf("%d.%d", se.rnd.Intn(1000), se.n)
+	data.Reaction = "+1"
+	data.EventTimestamp = fmt.Sprintf("%d.0", se.n)
+
+	command := func(kind, text string, args ...interface{}) slack.RTMEvent {
+		se.counts[kind]++
+		msg := new(slack.MessageEvent)
+		msg.Channel = "C1"
+		msg.User = se.user()
+		msg.Text = fmt.Sprintf("<@"+soakBotUserID+"> "+text, args...)
+		return slack.RTMEvent{Type: "message", Data: msg}
+	}
+
+	switch r := se.rnd.Intn(100); {
+	case r < 60:
+		se.counts["reaction_added"]++
+		return slack.RTMEvent{Type: "reaction_added", Data: &data}
+	case r < 70:
+		se.counts["reaction_removed"]++
+		removed := slack.ReactionRemovedEvent(data)
+		return slack.RTMEvent{Type: "reaction_removed", Data: &removed}
+	case r < 85:
+		return command("give", "give %d <@%s>", 1+se.rnd.Intn(3), se.user())
+	case r < 95:
+		return command("balance", "balance")
+	default:
+		return command("withdraw", "withdraw %d GSOAKTESTADDRESS", 1+se.rnd.Intn(3))
+	}
+}
+
+// TestSoak injects synthetic slack events at a steady rate, and runs them
+// through the same bot, worker pools and bank stream consumers as main does,
+// against a real redis and a fake horizon. Once it's done it checks that
+// everything which made it into the bank's streams was processed, and logs
+// what was dropped and how long things took. See the "Soak testing" section
+// of the README. It's skipped unless -soak is given.
+func TestSoak(t *T) {
+	if *soakDuration <= 0 {
+		t.Skip("-soak not given")
+	}
+
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	fs.AddChannel("C1", false)
+	userIDs := make([]string, *soakUsers)
+	for i := range userIDs {
+		userIDs[i] = fmt.Sprintf("USOAK%d", i)
+		fs.AddUser(userIDs[i], userIDs[i], "T1")
+	}
+
+	var xdrs int64
+	mock := &stellartest.Mock{
+		MakeSendXDRFn: func(context.Context, stellar.SendOpts) (string, error) {
+			time.Sleep(*soakHorizonLatency)
+			return fmt.Sprintf("xdr-%d", atomic.AddInt64(&xdrs, 1)), nil
+		},
+		SubmitTransactionXDRFn: func(context.Context, string) (stellar.TransactionResult, error) {
+			time.Sleep(*soakHorizonLatency)
+			var res stellar.TransactionResult
+			res.Links.Transaction.Href = "https://horizon/tx/soak"
+			return res, nil
+		},
+	}
+
+	// the bank gets its own key prefix, so that exports left over from other
+	// tests or runs don't get consumed.
+	sb := &soakBank{ExportingBank: bank.InstWithKeyPrefix(cmp, "buckaroo-banzai:soak:"+mrand.Hex(8))}
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+	a := &app{
+		cmp:                 cmp,
+		slackClient:         &slackbot.Client{BotTeamID: "T1", BotUserID: soakBotUserID},
+		stellar:             &stellarServer{kp: kp},
+		earnPolicy:          new(earnPolicy),
+		metrics:             newMetrics(),
+		currencyName:        "BUCK",
+		exportWorkers:       4,
+		exportGroup:         bank.DefaultExportsGroup,
+		exportBudget:        &errorBudget{max: 10, window: time.Minute, cooldown: 10 * time.Second},
+		slackEventWorkers:   4,
+		slackEventQueueSize: 100,
+	}
+	a.bank = a.metrics.wrapBank(sb)
+	a.slack = a.metrics.wrapSlack(fs)
+	a.economy = economy.New(cmp, economy.Opts{
+		Bank:    a.bank,
+		Stellar: a.metrics.wrapStellar(mock),
+		Asset:   stellar.Asset{Code: "BUCK"},
+		Timeout: 10 * time.Second,
+	})
+	a.bot = slackbot.NewBot(cmp, a.slack, soakBotUserID)
+	a.bot.OnCommand = a.handleCommand
+	a.bot.OnReaction = a.handleReaction
+
+	mtest.Run(cmp, t, func() {
+		for _, userID := range userIDs {
+			_, err := sb.ExportingBank.Incr(userID, 100)
+			massert.Require(t, massert.Nil(err))
+		}
+
+		// slack events are processed separately from the bank's streams, so
+		// that the events already queued can be finished and then the streams
+		// drained.
+		runCtx, cancel := context.WithCancel(context.Background())
+		wg := new(sync.WaitGroup)
+		goRun := func(fn func()) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fn()
+			}()
+		}
+
+		earnCh := make(chan bank.EarnInProgress)
+		goRun(func() { a.processEarns(runCtx, earnCh) })
+		goRun(func() { consumeUntilCanceled(t, func() error { return a.bank.ConsumeEarns(runCtx, earnCh) }) })
+
+		exportCh := make(chan bank.ExportInProgress)
+		goRun(func() { a.processExports(runCtx, exportCh) })
+		goRun(func() {
+			consumeUntilCanceled(t, func() error {
+				return a.bank.ConsumeExportsGroup(runCtx, a.exportGroup, exportCh)
+			})
+		})
+
+		eventsCtx, eventsCancel := context.WithTimeout(runCtx, *soakDuration)
+		defer eventsCancel()
+		events := make(chan slack.RTMEvent, 50)
+		eventsDone := make(chan struct{})
+		go func() {
+			a.processSlackEvents(eventsCtx, events)
+			close(eventsDone)
+		}()
+
+		gen := &soakEvents{
+			rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+			userIDs: userIDs,
+			counts:  map[string]int{},
+		}
+		start := time.Now()
+		ticker := time.NewTicker(time.Second / time.Duration(*soakRate))
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+			case <-eventsCtx.Done():
+				break loop
+			}
+			select {
+			case events <- gen.next():
+			case <-eventsCtx.Done():
+				break loop
+			}
+		}
+		ticker.Stop()
+		took := time.Since(start)
+
+		// processSlackEvents finishes all queued events before returning.
+		<-eventsDone
+		drained := func() bool {
+			return atomic.LoadInt64(&sb.earnsApplied) >= atomic.LoadInt64(&sb.earnsSubmitted) &&
+				len(mock.Submitted()) >= int(atomic.LoadInt64(&sb.exportsSubmitted))
+		}
+		for deadline := time.Now().Add(time.Minute); !drained() && time.Now().Before(deadline); {
+			time.Sleep(100 * time.Millisecond)
+		}
+		cancel()
+		wg.Wait()
+
+		t.Logf("injected %d events in %s (%.1f/sec): %v", gen.n, took.Round(time.Millisecond), float64(gen.n)/took.Seconds(), gen.counts)
+		t.Logf("earns submitted:%d applied:%d, exports submitted:%d sent to horizon:%d",
+			sb.earnsSubmitted, sb.earnsApplied, sb.exportsSubmitted, len(mock.Submitted()))
+		t.Logf("dropped slack events: %s", a.metrics.droppedSlackEvents)
+		t.Logf("command latency: %s", a.metrics.commandLatency)
+		t.Logf("command errors: %s", a.metrics.commandErrors)
+		t.Logf("call latency: %s", a.metrics.callLatency)
+
+		massert.Require(t,
+			massert.Comment(massert.Equal(true, drained()), "streams weren't drained within a minute of stopping"),
+			massert.Equal(sb.earnsSubmitted, sb.earnsApplied),
+			massert.Equal(int(sb.exportsSubmitted), len(mock.Submitted())),
+		)
+	})
+}
+
+// consumeUntilCanceled calls fn, which consumes one of the bank's streams,
+// until it returns context.Canceled. Other errors are logged and fn is called
+// again, the same as main does.
+func consumeUntilCanceled(t *T, fn func() error) {
+	for {
+		err := fn()
+		if errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			t.Logf("error consuming: %v", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// splitMetaKey is the bank metadata key which pending split requests are
+// stored under, keyed by the request's ID. Each user who's asked to pay their
+// share of a split gets a request of their own.
+const splitMetaKey = "splitRequest"
+
+// splitJournalSource is what paying a split request is recorded as in the
+// bank's journal.
+const splitJournalSource = "split"
+
+// splitReminderCheckInterval is how often pending split requests are checked
+// for any which are due a reminder.
+const splitReminderCheckInterval = time.Hour
+
+// splitMaxReminders is how many times a user is reminded of a split request
+// before it's dropped.
+const splitMaxReminders = 3
+
+const splitUsage = "usage: `split <amount> between @<user> @<user>...`, or `split` to see your pending requests"
+
+// splitRequest asks a user to pay their share of a split bill to whoever split
+// it.
+type splitRequest struct {
+	Requester string `json:"requester"`
+	Payer     string `json:"payer"`
+	Amount    int    `json:"amount"`
+
+	// the whole amount which was split, and how many ways.
+	Total     int `json:"total"`
+	NumShares int `json:"numShares"`
+
+	CreatedAt    time.Time `json:"createdAt"`
+	RemindedAt   time.Time `json:"remindedAt,omitempty"`
+	NumReminders int       `json:"numReminders,omitempty"`
+}
+
+func (a *app) getSplitRequest(id string) (splitRequest, bool, error) {
+	str, err := a.bank.GetMeta(id, splitMetaKey)
+	if err != nil {
+		return splitRequest{}, false, fmt.Errorf("getting split request: %w", err)
+	} else if str == "" {
+		return splitRequest{}, false, nil
+	}
+	var sr splitRequest
+	if err := json.Unmarshal([]byte(str), &sr); err != nil {
+		return splitRequest{}, false, fmt.Errorf("unmarshaling split request: %w", err)
+	}
+	return sr, true, nil
+}
+
+func (a *app) setSplitRequest(id string, sr splitRequest) error {
+	b, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	} else if err := a.bank.SetMeta(id, splitMetaKey, string(b)); err != nil {
+		return fmt.Errorf("storing split request: %w", err)
+	}
+	return nil
+}
+
+// allSplitRequests returns all pending split requests, keyed by ID.
+func (a *app) allSplitRequests() (map[string]splitRequest, error) {
+	all, err := a.bank.AllMeta(splitMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all split requests: %w", err)
+	}
+	srs := make(map[string]splitRequest, len(all))
+	for id, str := range all {
+		var sr splitRequest
+		if err := json.Unmarshal([]byte(str), &sr); err != nil {
+			return nil, fmt.Errorf("unmarshaling split request %q: %w", id, err)
+		}
+		srs[id] = sr
+	}
+	return srs, nil
+}
+
+// splitRequestMsg returns the message which the payer of a split request is
+// sent, both when it's created and when they're reminded of it.
+func (a *app) splitRequestMsg(id string, sr splitRequest) *slackbot.Message {
+	var msg *slackbot.Message
+	if sr.NumReminders == 0 {
+		msg = slackbot.NewMessage("<@%s> split %s %d ways, and is asking you for your share of %s :receipt:",
+			userIDFromAccountID(sr.Requester), a.formatAmount(sr.Total, true), sr.NumShares, a.formatAmount(sr.Amount, true))
+	} else {
+		msg = slackbot.NewMessage("just a reminder that <@%s> is still waiting on your share of %s from a split bill :receipt:",
+			userIDFromAccountID(sr.Requester), a.formatAmount(sr.Amount, true))
+	}
+	msg.Context("`split accept %s` to pay it, or `split decline %s` if you'd rather not", id, id)
+	if a.slackClient != nil && a.slackClient.SigningSecret != "" {
+		msg.CommandButtons("Accept", "split accept "+id, "Decline", "split decline "+id)
+	}
+	return msg
+}
+
+// createSplitRequest stores a new split request, and asks its payer to pay it.
+func (a *app) createSplitRequest(ctx context.Context, sr splitRequest) (string, error) {
+	id, err := randHex(4)
+	if err != nil {
+		return "", fmt.Errorf("generating split request ID: %w", err)
+	}
+	sr.CreatedAt = time.Now().UTC()
+
+	ctx = mctx.Annotate(ctx, "splitRequestID", id, "payer", sr.Payer, "amount", sr.Amount)
+	if err := a.setSplitRequest(id, sr); err != nil {
+		return "", err
+	} else if err := a.notify(userIDFromAccountID(sr.Payer), a.splitRequestMsg(id, sr)); err != nil {
+		// the payer will still be reminded about it later.
+		mlog.From(a.cmp).Warn("error notifying user of split request", ctx, merr.Context(err))
+	}
+	a.audit(ctx, "split request created")
+	return id, nil
+}
+
+// answerSplitRequest accepts or declines the split request with the given ID,
+// on behalf of the given account, which must be its payer. If it's accepted
+// then the payer's new balance is returned.
+func (a *app) answerSplitRequest(ctx context.Context, accountID, id string, accept bool) (splitRequest, int, error) {
+	a.splitL.Lock()
+	defer a.splitL.Unlock()
+
+	sr, ok, err := a.getSplitRequest(id)
+	if err != nil {
+		return splitRequest{}, 0, err
+	} else if !ok || sr.Payer != accountID {
+		return splitRequest{}, 0, inputErrorf("you don't have a pending split request `%s`, `split` will show you the ones you do", id)
+	}
+
+	// the request is removed first, so that if something goes wrong it
+	// can't be paid twice. If the transfer fails it's put back.
+	if err := a.bank.SetMeta(id, splitMetaKey, ""); err != nil {
+		return splitRequest{}, 0, fmt.Errorf("removing split request: %w", err)
+	}
+
+	ctx = mctx.Annotate(ctx, "splitRequestID", id, "requester", sr.Requester, "amount", sr.Amount)
+	if !accept {
+		a.audit(ctx, "split request declined")
+		return sr, 0, nil
+	}
+
+	_, newBalance, err := a.bank.TransferAs(sr.Requester, accountID, sr.Amount, splitJournalSource)
+	if err != nil {
+		if restoreErr := a.setSplitRequest(id, sr); restoreErr != nil {
+			mlog.From(a.cmp).Error("error restoring split request which couldn't be paid", ctx, merr.Context(restoreErr))
+		}
+		return splitRequest{}, 0, err
+	}
+	a.audit(ctx, "split request accepted")
+	return sr, newBalance, nil
+}
+
+// cancelSplitRequest removes the split request with the given ID on behalf of
+// the given account, which must be its requester.
+func (a *app) cancelSplitRequest(ctx context.Context, accountID, id string) (splitRequest, error) {
+	a.splitL.Lock()
+	defer a.splitL.Unlock()
+
+	sr, ok, err := a.getSplitRequest(id)
+	if err != nil {
+		return splitRequest{}, err
+	} else if !ok || sr.Requester != accountID {
+		return splitRequest{}, inputErrorf("you don't have a pending split request `%s`, `split` will show you the ones you do", id)
+	} else if err := a.bank.SetMeta(id, splitMetaKey, ""); err != nil {
+		return splitRequest{}, fmt.Errorf("removing split request: %w", err)
+	}
+	a.audit(mctx.Annotate(ctx, "splitRequestID", id, "payer", sr.Payer, "amount", sr.Amount), "split request canceled")
+	return sr, nil
+}
+
+// remindSplitRequests reminds users of split requests which they haven't
+// answered, once an interval, until the context is canceled.
+func (a *app) remindSplitRequests(ctx context.Context) {
+	remind := func() {
+		if err := a.remindSplitRequestsOnce(ctx, time.Now()); err != nil {
+			mlog.From(a.cmp).Error("error reminding users of split requests", ctx, merr.Context(err))
+			a.alerts.alert(ctx, alertRedisError, err, "failed to remind users of split requests")
+		}
+	}
+
+	remind()
+	ticker := time.NewTicker(splitReminderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			remind()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// remindSplitRequestsOnce reminds the payer of each split request which hasn't
+// been answered or reminded about in splitRemindInterval. Requests which have
+// already been reminded about splitMaxReminders times are dropped instead, and
+// their requester is told.
+func (a *app) remindSplitRequestsOnce(ctx context.Context, now time.Time) error {
+	a.splitL.Lock()
+	defer a.splitL.Unlock()
+
+	srs, err := a.allSplitRequests()
+	if err != nil {
+		return err
+	}
+
+	for id, sr := range srs {
+		last := sr.CreatedAt
+		if sr.RemindedAt.After(last) {
+			last = sr.RemindedAt
+		}
+		if now.Sub(last) < a.splitRemindInterval {
+			continue
+		}
+
+		ctx := mctx.Annotate(ctx, "splitRequestID", id, "requester", sr.Requester, "payer", sr.Payer)
+		if sr.NumReminders >= splitMaxReminders {
+			if err := a.bank.SetMeta(id, splitMetaKey, ""); err != nil {
+				return fmt.Errorf("removing unanswered split request: %w", err)
+			}
+			a.audit(ctx, "split request dropped")
+			msg := slackbot.NewMessage("<@%s> never answered your request for their share of %s from a split bill, so I've dropped it :shrug:",
+				userIDFromAccountID(sr.Payer), a.formatAmount(sr.Amount, true))
+			if err := a.notify(userIDFromAccountID(sr.Requester), msg); err != nil {
+				mlog.From(a.cmp).Warn("error notifying user of dropped split request", ctx, merr.Context(err))
+			}
+			continue
+		}
+
+		sr.RemindedAt = now.UTC()
+		sr.NumReminders++
+		if err := a.setSplitRequest(id, sr); err != nil {
+			return err
+		} else if err := a.notify(userIDFromAccountID(sr.Payer), a.splitRequestMsg(id, sr)); err != nil {
+			mlog.From(a.cmp).Warn("error reminding user of split request", ctx, merr.Context(err))
+		}
+	}
+	return nil
+}
+
+func (a *app) cmdSplit(ctx context.Context, req commandReq) error {
+	if len(req.args) < 1 {
+		return a.cmdSplitList(ctx, req)
+	}
+
+	switch subCmd := strings.ToLower(req.args[0]); subCmd {
+	case "accept", "decline":
+		if len(req.args) < 2 {
+			a.reply(req, "usage: `split %s <id>`", subCmd)
+			return nil
+		}
+		id := req.args[1]
+		sr, balance, err := a.answerSplitRequest(ctx, req.accountID, id, subCmd == "accept")
+		if err != nil {
+			return err
+		}
+
+		requesterUserID := userIDFromAccountID(sr.Requester)
+		var msg *slackbot.Message
+		if subCmd == "accept" {
+			a.replyMsg(req, slackbot.NewMessage("you paid <@%s> your share of %s :money_with_wings:", requesterUserID, a.formatAmount(sr.Amount, true)).
+				Context("Your balance is now %s", a.formatAmount(balance, true)))
+			msg = slackbot.NewMessage("<@%s> paid you their share of %s from a split bill :money_with_wings:", req.user.ID, a.formatAmount(sr.Amount, true))
+		} else {
+			a.reply(req, "you declined <@%s>'s request for %s", requesterUserID, a.formatAmount(sr.Amount, true))
+			msg = slackbot.NewMessage("<@%s> declined to pay their share of %s from a split bill", req.user.ID, a.formatAmount(sr.Amount, true))
+		}
+		if err := a.notifyOnce(requesterUserID, "split-"+subCmd+":"+id, msg); err != nil {
+			mlog.From(a.cmp).Warn("error notifying user of split request answer", ctx, merr.Context(err))
+		}
+		return nil
+
+	case "cancel":
+		if len(req.args) < 2 {
+			a.reply(req, "usage: `split cancel <id>`")
+			return nil
+		}
+		sr, err := a.cancelSplitRequest(ctx, req.accountID, req.args[1])
+		if err != nil {
+			return err
+		}
+		a.reply(req, "I've canceled your request for <@%s>'s share of %s", userIDFromAccountID(sr.Payer), a.formatAmount(sr.Amount, true))
+		return nil
+	}
+
+	return a.cmdSplitCreate(ctx, req)
+}
+
+func (a *app) cmdSplitCreate(ctx context.Context, req commandReq) error {
+	total, err := a.parseAmount(req.args[0])
+	if err != nil {
+		return err
+	}
+	userArgs := req.args[1:]
+	if len(userArgs) > 0 && strings.EqualFold(userArgs[0], "between") {
+		userArgs = userArgs[1:]
+	}
+	if len(userArgs) == 0 {
+		a.reply(req, splitUsage)
+		return nil
+	}
+
+	// the requester can list themselves, in which case they're one of the
+	// shares, but they aren't asked to pay themselves.
+	var payers []string
+	numShares := 0
+	seen := map[string]bool{}
+	for _, userArg := range userArgs {
+		user, err := a.slack.GetUser(userArg)
+		if err != nil {
+			return err
+		} else if user.IsBot {
+			return inputErrorf("<@%s> is a bot, bots don't pay their share", user.ID)
+		}
+		accountID, err := a.accountID(user)
+		if err != nil {
+			return err
+		} else if seen[accountID] {
+			continue
+		}
+		seen[accountID] = true
+		numShares++
+		if accountID != req.accountID {
+			payers = append(payers, accountID)
+		}
+	}
+	if len(payers) == 0 {
+		return inputErrorf("you need to split it with someone other than yourself")
+	}
+
+	share := total / numShares
+	if share == 0 {
+		return inputErrorf("%s doesn't split %d ways", a.formatAmount(total, true), numShares)
+	}
+	ctx = mctx.Annotate(ctx, "total", total, "numShares", numShares)
+
+	a.splitL.Lock()
+	defer a.splitL.Unlock()
+
+	mentions := make([]string, len(payers))
+	for i, payer := range payers {
+		sr := splitRequest{
+			Requester: req.accountID,
+			Payer:     payer,
+			Amount:    share,
+			Total:     total,
+			NumShares: numShares,
+		}
+		if _, err := a.createSplitRequest(ctx, sr); err != nil {
+			return err
+		}
+		mentions[i] = fmt.Sprintf("<@%s>", userIDFromAccountID(payer))
+	}
+
+	msg := slackbot.NewMessage("I've asked %s for %s each :receipt:", strings.Join(mentions, ", "), a.formatAmount(share, true))
+	if remainder := total - share*numShares; remainder > 0 {
+		msg.Context("%s doesn't split evenly, so the %s left over is on you", a.formatAmount(total, false), a.formatAmount(remainder, false))
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
+
+// cmdSplitList shows the user the split requests which they owe, and which
+// they're owed.
+func (a *app) cmdSplitList(ctx context.Context, req commandReq) error {
+	srs, err := a.allSplitRequests()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(srs))
+	for id := range srs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return srs[ids[i]].CreatedAt.Before(srs[ids[j]].CreatedAt)
+	})
+
+	owes, owed := new(strings.Builder), new(strings.Builder)
+	for _, id := range ids {
+		switch sr := srs[id]; req.accountID {
+		case sr.Payer:
+			fmt.Fprintf(owes, "`%s`: <@%s> is asking you for %s\n", id, userIDFromAccountID(sr.Requester), a.formatAmount(sr.Amount, true))
+		case sr.Requester:
+			fmt.Fprintf(owed, "`%s`: waiting on %s from <@%s>\n", id, a.formatAmount(sr.Amount, true), userIDFromAccountID(sr.Payer))
+		}
+	}
+	if owes.Len() == 0 && owed.Len() == 0 {
+		a.reply(req, "you don't have any pending split requests. %s", splitUsage)
+		return nil
+	}
+
+	msg := slackbot.NewMessage("%s%s", owes.String(), owed.String())
+	if owes.Len() > 0 {
+		msg.Context("`split accept <id>` or `split decline <id>` to answer a request")
+	}
+	if owed.Len() > 0 {
+		msg.Context("`split cancel <id>` to cancel one of yours")
+	}
+	a.replyMsg(req, msg)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestSplitRequests(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	a := &app{
+		cmp:                 cmp,
+		bank:                bank.NewInMem(),
+		slack:               fs,
+		splitRemindInterval: time.Hour,
+	}
+
+	mtest.Run(cmp, t, func() {
+		fs.AddUser("U1", "u1", "T1")
+		fs.AddUser("U2", "u2", "T1")
+		fs.AddUser("U3", "u3", "T1")
+		_, err := a.bank.Incr("U2", 10)
+		massert.Require(t, massert.Nil(err))
+
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		numPending := func() int {
+			srs, err := a.allSplitRequests()
+			massert.Require(t, massert.Nil(err))
+			return len(srs)
+		}
+
+		ctx := context.Background()
+		newRequest := func(payer string) string {
+			id, err := a.createSplitRequest(ctx, splitRequest{
+				Requester: "U1", Payer: payer, Amount: 4, Total: 12, NumShares: 3,
+			})
+			massert.Require(t, massert.Nil(err))
+			return id
+		}
+		idU2, idU3 := newRequest("U2"), newRequest("U3")
+		massert.Require(t, massert.Equal(2, numPending()))
+
+		// only the payer can answer a request.
+		_, _, err = a.answerSplitRequest(ctx, "U3", idU2, true)
+		massert.Require(t, massert.Equal(true, err != nil))
+
+		_, balance, err := a.answerSplitRequest(ctx, "U2", idU2, true)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(6, balance),
+			massert.Equal(4, balanceOf("U1")),
+			massert.Equal(1, numPending()),
+		)
+
+		// a request which can't be paid is still pending afterwards.
+		_, _, err = a.answerSplitRequest(ctx, "U3", idU3, true)
+		massert.Require(t,
+			massert.Equal(bank.ErrNotEnoughFunds, err),
+			massert.Equal(1, numPending()),
+		)
+
+		// the payer is reminded a few times, and then the request is dropped.
+		now := time.Now()
+		for i := 1; i <= splitMaxReminders; i++ {
+			massert.Require(t, massert.Nil(a.remindSplitRequestsOnce(ctx, now.Add(time.Duration(i)*time.Hour))))
+			sr, ok, err := a.getSplitRequest(idU3)
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal(true, ok),
+				massert.Equal(i, sr.NumReminders),
+			)
+		}
+		massert.Require(t,
+			massert.Nil(a.remindSplitRequestsOnce(ctx, now.Add(time.Duration(splitMaxReminders+1)*time.Hour))),
+			massert.Equal(0, numPending()),
+		)
+
+		// declining and canceling both remove the request without paying it.
+		_, _, err = a.answerSplitRequest(ctx, "U3", newRequest("U3"), false)
+		massert.Require(t, massert.Nil(err))
+		_, err = a.cancelSplitRequest(ctx, "U1", newRequest("U3"))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(0, numPending()),
+			massert.Equal(4, balanceOf("U1")),
+		)
+	})
+}
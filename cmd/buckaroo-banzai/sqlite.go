@@ -0,0 +1,16 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+
+	"buckaroo-banzai/bank"
+)
+
+// building with the sqlite tag keeps the bank in a SQLite database file rather
+// than redis.
+func init() {
+	instBank = bank.InstSQLite
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -32,12 +36,39 @@ type stellarServer struct {
 	kp        *keypair.Full
 	tokenName string
 	domain    string
-	client    *stellar.Client
+	client    stellar.API
+
+	// other tokens which are issued alongside tokenName, and how many decimal
+	// places they all have, set by the app from its currency configuration.
+	extraTokenNames []string
+	decimals        int
+
+	// if set then buckaroo is acting as an anchor for an asset issued by this
+	// account, and kp is a distribution account which holds that asset.
+	assetIssuer string
+
+	// timeout applied to operations which call horizon.
+	timeout time.Duration
 
 	// stellar needs its own redis instance in order to store the seen
 	// lastCursor
 	redis *mredis.Redis
 
+	// the most operations which are listed from horizon to fill a gap in the
+	// stream of incoming payments, see missedPayments. 0 disables looking for
+	// gaps.
+	gapBackfillLimit int
+
+	// how long the stream of incoming payments can go without an operation
+	// before it's taken to have stalled and is reconnected, see
+	// streamPayments. 0 disables the check.
+	streamStallTimeout time.Duration
+
+	// set by the app, so that gaps in the stream of incoming payments can be
+	// alerted on, and restarts of it counted.
+	alerts  *alerts
+	metrics *metrics
+
 	*http.ServeMux
 }
 
@@ -60,11 +91,44 @@ func instStellarServer(parent *mcmp.Component) *stellarServer {
 	domain := mcfg.String(s.cmp, "domain",
 		mcfg.ParamRequired(),
 		mcfg.ParamUsage("Domain the server will be served from"))
+	timeout := mcfg.String(s.cmp, "timeout",
+		mcfg.ParamDefault("5s"),
+		mcfg.ParamUsage("Timeout for operations which call horizon, e.g. withdrawals."))
+	assetIssuer := mcfg.String(s.cmp, "asset-issuer",
+		mcfg.ParamUsage("Address which issues an existing asset that buckaroo should act as an anchor for. If set then --stellar-seed must be for a distribution account holding that asset, rather than an issuer."))
+	gapBackfillLimit := mcfg.Int(s.cmp, "gap-backfill-limit",
+		mcfg.ParamDefault(200),
+		mcfg.ParamUsage("Most operations which are listed from horizon to fill in any the stream of incoming payments skipped. Every streamed operation is checked against horizon for a gap before it, so 0 disables the check to save on horizon calls."))
+
+	streamStallTimeout := mcfg.String(s.cmp, "stream-stall-timeout",
+		mcfg.ParamDefault("5m"),
+		mcfg.ParamUsage("How long the stream of incoming payments can go without a payment before it's reconnected, from where it left off, in case it has silently stalled. Horizon's keepalives aren't visible to buckaroo, so a quiet account's stream is reconnected this often too. 0 disables it."))
 
 	mrun.InitHook(s.cmp, func(ctx context.Context) error {
 		s.tokenName = *tokenName
 		s.domain = *domain
 		s.cmp.Annotate("tokenName", s.tokenName, "domain", s.domain)
+
+		var err error
+		if s.timeout, err = time.ParseDuration(*timeout); err != nil {
+			return fmt.Errorf("parsing --stellar-timeout: %w", err)
+		}
+		if s.gapBackfillLimit = *gapBackfillLimit; s.gapBackfillLimit < 0 {
+			return errors.New("--stellar-gap-backfill-limit can't be negative")
+		}
+		if s.streamStallTimeout, err = time.ParseDuration(*streamStallTimeout); err != nil {
+			return fmt.Errorf("parsing --stellar-stream-stall-timeout: %w", err)
+		}
+
+		if s.assetIssuer = *assetIssuer; s.assetIssuer != "" {
+			if _, err := keypair.Parse(s.assetIssuer); err != nil {
+				return fmt.Errorf("parsing --stellar-asset-issuer: %w", err)
+			} else if s.assetIssuer == s.kp.Address() {
+				return errors.New("--stellar-asset-issuer is the same as the address of --stellar-seed")
+			}
+			s.cmp.Annotate("assetIssuer", s.assetIssuer)
+			mlog.From(s.cmp).Info("acting as an anchor for an existing asset", ctx)
+		}
 		return nil
 	})
 
@@ -72,28 +136,75 @@ func instStellarServer(parent *mcmp.Component) *stellarServer {
 	return s
 }
 
+// isAnchor returns true if buckaroo is acting as an anchor for an asset which
+// is issued by some other account.
+func (s *stellarServer) isAnchor() bool {
+	return s.assetIssuer != ""
+}
+
+// issuer returns the address of the account which issues the currency.
+func (s *stellarServer) issuer() string {
+	if s.isAnchor() {
+		return s.assetIssuer
+	}
+	return s.kp.Address()
+}
+
+// signJSON JSON encodes v and signs it with the server's key, so that whoever
+// it's given to can verify it came from buckaroo. The encoding is returned
+// along with the signature, since it's exactly those bytes which were signed,
+// and the signature is base64 encoded.
+func (s *stellarServer) signJSON(v interface{}) (string, string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", "", fmt.Errorf("encoding: %w", err)
+	}
+	sig, err := s.kp.Sign(b)
+	if err != nil {
+		return "", "", fmt.Errorf("signing: %w", err)
+	}
+	return string(b), base64.StdEncoding.EncodeToString(sig), nil
+}
+
 var stellarTOMLTPL = template.Must(template.New("").Parse(`
 ACCOUNTS=["{{.Address}}"]
 FEDERATION_SERVER="https://{{.FederationAddr}}"
 
 [[CURRENCIES]]
 CODE="{{.TokenName}}"
-ISSUER="{{.Address}}"
-DISPLAY_DECIMALS=0
-IS_UNLIMITED=true
+ISSUER="{{.Issuer}}"
+DISPLAY_DECIMALS={{.Decimals}}
+IS_UNLIMITED={{not .IsAnchor}}
 NAME="{{.TokenName}}"
 DESC="{{.TokenName}}s are given to members of the Cryptic group by our resident Token Lord, Buckaroo Bonzai. <script>alert('fix your shit lol');</script>"
 CONDITIONS="{{.TokenName}}s are priceless and anybody trading them is a fool."
-`))
+{{range .ExtraTokenNames}}
+[[CURRENCIES]]
+CODE="{{.}}"
+ISSUER="{{$.Issuer}}"
+DISPLAY_DECIMALS={{$.Decimals}}
+IS_UNLIMITED={{not $.IsAnchor}}
+NAME="{{.}}"
+DESC="{{.}}s are issued alongside {{$.TokenName}}s by Buckaroo Bonzai."
+{{end}}`))
 
 func (s *stellarServer) tomlHandler(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
 	rw.Header().Set("Content-Type", "text/toml")
 
-	err := stellarTOMLTPL.Execute(rw, struct{ TokenName, Address, FederationAddr string }{
-		TokenName:      s.tokenName,
-		Address:        s.kp.Address(),
-		FederationAddr: s.domain + federationPath,
+	err := stellarTOMLTPL.Execute(rw, struct {
+		TokenName, Address, Issuer, FederationAddr string
+		ExtraTokenNames                            []string
+		Decimals                                   int
+		IsAnchor                                   bool
+	}{
+		TokenName:       s.tokenName,
+		ExtraTokenNames: s.extraTokenNames,
+		Decimals:        s.decimals,
+		Address:         s.kp.Address(),
+		Issuer:          s.issuer(),
+		FederationAddr:  s.domain + federationPath,
+		IsAnchor:        s.isAnchor(),
 	})
 	if err != nil {
 		mlog.From(s.cmp).Error("error executing toml template",
@@ -132,6 +243,125 @@ func (s *stellarServer) federationHandler(rw http.ResponseWriter, r *http.Reques
 
 const lastCursorKey = "buckaroo-banzai:stellar:lastCursor"
 
+// cursorLedger returns the sequence of the ledger which the operation with the
+// given paging token is in, which is the token's upper 32 bits. False is
+// returned if the token isn't an operation's.
+func cursorLedger(cursor string) (int64, bool) {
+	id, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id >> 32, true
+}
+
+// cursorBefore returns whether the paging token a comes before b. Operation
+// paging tokens are their IDs, which increase over time.
+func cursorBefore(a, b string) bool {
+	aID, aErr := strconv.ParseInt(a, 10, 64)
+	bID, bErr := strconv.ParseInt(b, 10, 64)
+	return aErr == nil && bErr == nil && aID < bID
+}
+
+// missedPayments returns the operations which horizon has between lastCursor
+// and op, but which the stream skipped, e.g. because it was restarted from
+// further on than it should have been. If there are more than
+// gapBackfillLimit of them then only that many are returned, and false.
+func (s *stellarServer) missedPayments(ctx context.Context, lastCursor string, op operations.Operation) ([]operations.Operation, bool, error) {
+	ops, err := s.client.ListPayments(ctx, horizonclient.OperationRequest{
+		ForAccount: s.kp.Address(),
+		Cursor:     lastCursor,
+		Order:      horizonclient.OrderAsc,
+		Limit:      uint(s.gapBackfillLimit),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i, listedOp := range ops {
+		if !cursorBefore(listedOp.PagingToken(), op.PagingToken()) {
+			return ops[:i], true, nil
+		}
+	}
+	// if horizon ran out of operations before getting to op then it hasn't
+	// caught up with the stream, which is fine.
+	return ops, len(ops) < s.gapBackfillLimit, nil
+}
+
+// handlePayment passes the operation into fn if it's a deposit, i.e. a payment
+// into the account from anyone but the account or its issuer.
+func (s *stellarServer) handlePayment(ctx context.Context, op operations.Operation, fn func(context.Context, operations.Payment) error) {
+	opT, ok := op.(operations.Payment)
+	if pathOpT, isPath := op.(operations.PathPayment); isPath {
+		// path payments are handled based on the asset which was
+		// received, which is what their embedded Payment describes.
+		opT, ok = pathOpT.Payment, true
+	}
+
+	// payments from the issuer to a distribution account are top-ups,
+	// not deposits.
+	if ok && opT.To == s.kp.Address() && opT.From != s.kp.Address() && opT.From != s.issuer() {
+		ctx = mctx.Annotate(ctx,
+			"paymentOpID", opT.ID,
+			"paymentCursor", opT.PT,
+			"paymentFrom", opT.From,
+			"paymentCode", opT.Code,
+			"paymentIssuer", opT.Issuer,
+			"paymentAmount", opT.Amount,
+			"paymentTXHash", opT.GetTransactionHash(),
+		)
+		if err := fn(ctx, opT); err != nil {
+			mlog.From(s.cmp).Warn("error processing Payment", ctx, merr.Context(err))
+		}
+	} else if !ok {
+		mlog.From(s.cmp).Warn("unsupported operation type",
+			mctx.Annotate(ctx, "op", fmt.Sprintf("%#v", op)))
+	}
+}
+
+// backfillPayments handles any payments which the stream skipped between
+// lastCursor and op, see missedPayments, and alerts if there were any. It
+// returns the paging token of the last one handled, or lastCursor.
+func (s *stellarServer) backfillPayments(ctx context.Context, lastCursor string, op operations.Operation, fn func(context.Context, operations.Payment) error) string {
+	if s.gapBackfillLimit == 0 || lastCursor == "" {
+		return lastCursor
+	}
+
+	missed, complete, err := s.missedPayments(ctx, lastCursor, op)
+	if err != nil {
+		// the stream is carried on with regardless, it's better to credit
+		// this payment now and maybe miss a gap than not at all.
+		mlog.From(s.cmp).Warn("error checking payment stream for a gap", ctx, merr.Context(err))
+		return lastCursor
+	} else if len(missed) == 0 {
+		return lastCursor
+	}
+
+	fromLedger, _ := cursorLedger(missed[0].PagingToken())
+	toLedger, _ := cursorLedger(missed[len(missed)-1].PagingToken())
+	ctx = mctx.Annotate(ctx,
+		"missedOps", len(missed),
+		"missedFromLedger", fromLedger,
+		"missedToLedger", toLedger,
+		"backfillComplete", complete)
+	mlog.From(s.cmp).Warn("payment stream skipped operations, backfilling them", ctx)
+
+	for _, missedOp := range missed {
+		s.handlePayment(mctx.Annotate(ctx, "opCursor", missedOp.PagingToken(), "backfill", true), missedOp, fn)
+		lastCursor = missedOp.PagingToken()
+	}
+
+	if complete {
+		s.alerts.alert(ctx, alertDepositGap, nil,
+			"the stream of incoming payments skipped %d operation(s) in ledgers %d to %d, they've been backfilled",
+			len(missed), fromLedger, toLedger)
+	} else {
+		s.alerts.alert(ctx, alertDepositGap, nil,
+			"the stream of incoming payments skipped more than %d operations, from ledger %d. only that many have been backfilled, deposits after cursor `%s` and before `%s` need to be checked by hand",
+			len(missed), fromLedger, lastCursor, op.PagingToken())
+	}
+	return lastCursor
+}
+
 func (s *stellarServer) receivePayments(ctx context.Context, fn func(context.Context, operations.Payment) error) {
 	// TODO this should use a redis stream like withdrawing payments does, so we
 	// can be sure to properly consume all payments
@@ -150,50 +380,126 @@ func (s *stellarServer) receivePayments(ctx context.Context, fn func(context.Con
 	mlog.From(s.cmp).Info("fetched last cursor from redis",
 		mctx.Annotate(ctx, "lastCursor", lastCursor))
 
+	setLastCursor := func(cursor string) {
+		lastCursor = cursor
+		if err := s.redis.Do(radix.Cmd(nil, "SET", lastCursorKey, lastCursor)); err != nil {
+			mlog.From(s.cmp).Error("could not set lastCursorKey to op's cursor", merr.Context(err))
+		}
+	}
+
+	// a stalled stream is abandoned rather than stopped, see streamPayments,
+	// so operations are handled under this lock.
+	var handleL sync.Mutex
+	handleOp := func(op operations.Operation) {
+		ctx := mctx.Annotate(ctx,
+			"lastCursor", lastCursor,
+			"opCursor", op.PagingToken())
+
+		// a stream which was restarted from before where it left off
+		// replays operations which were already handled.
+		if lastCursor != "" && !cursorBefore(lastCursor, op.PagingToken()) {
+			mlog.From(s.cmp).Warn("payment stream went backwards, skipping already handled operation", ctx)
+			return
+		}
+
+		if cursor := s.backfillPayments(ctx, lastCursor, op, fn); cursor != lastCursor {
+			setLastCursor(cursor)
+		}
+		s.handlePayment(ctx, op, fn)
+		setLastCursor(op.PagingToken())
+	}
+
 	for {
 		req := horizonclient.OperationRequest{
 			ForAccount: s.kp.Address(),
 			Cursor:     lastCursor,
 		}
 
-		err := s.client.StreamPayments(ctx, req, func(op operations.Operation) {
-			ctx := mctx.Annotate(ctx,
-				"lastCursor", lastCursor,
-				"opCursor", op.PagingToken())
-
-			var opT operations.Payment
-			var ok bool
-			if opT, ok = op.(operations.Payment); ok && opT.To == s.kp.Address() && opT.From != s.kp.Address() {
-				ctx = mctx.Annotate(ctx,
-					"paymentOpID", opT.ID,
-					"paymentCursor", opT.PT,
-					"paymentFrom", opT.From,
-					"paymentCode", opT.Code,
-					"paymentIssuer", opT.Issuer,
-					"paymentAmount", opT.Amount,
-					"paymentTXHash", opT.GetTransactionHash(),
-				)
-				if err := fn(ctx, opT); err != nil {
-					mlog.From(s.cmp).Warn("error processing Payment", ctx, merr.Context(err))
-				}
-			} else if !ok {
-				mlog.From(s.cmp).Warn("unsupported operation type",
-					mctx.Annotate(ctx, "op", fmt.Sprintf("%#v", op)))
-			}
+		stalled, err := s.streamPayments(ctx, req, &handleL, handleOp)
+		if ctx.Err() != nil {
+			return
+		}
+
+		ctx := mctx.Annotate(ctx, "lastCursor", lastCursor)
+		switch {
+		case stalled:
+			mlog.From(s.cmp).Warn("payment stream stalled, reconnecting", mctx.Annotate(ctx,
+				"stallTimeout", s.streamStallTimeout.String()))
+			s.metrics.paymentStreamRestart("stall")
+		case err == nil:
+			// the stream ends without an error when the connection is
+			// closed, e.g. by a proxy which thinks it's idle.
+			mlog.From(s.cmp).Warn("payment stream ended, reconnecting", ctx)
+			s.metrics.paymentStreamRestart("ended")
+		default:
+			mlog.From(s.cmp).Warn("error while streaming transactions", ctx, merr.Context(err))
+			s.metrics.paymentStreamRestart("error")
+		}
+	}
+}
+
+// streamPayments streams payments into fn, holding handleL while it's called,
+// until the stream ends, or the Context is canceled. If there's a
+// --stellar-stream-stall-timeout and the stream goes that long without an
+// operation then it's taken to have stalled, and true is returned.
+//
+// horizonclient doesn't give the Context to the request it streams from, so
+// canceling it can't interrupt a read from a connection which has silently
+// died. A stalled stream is abandoned instead, to return whenever its
+// connection does, and handleL makes sure that it doesn't call fn again once
+// streamPayments has returned.
+func (s *stellarServer) streamPayments(ctx context.Context, req horizonclient.OperationRequest, handleL *sync.Mutex, fn func(operations.Operation)) (bool, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		handleL.Lock()
+		cancel()
+		handleL.Unlock()
+	}()
 
-			lastCursor = op.PagingToken()
-			if err := s.redis.Do(radix.Cmd(nil, "SET", lastCursorKey, lastCursor)); err != nil {
-				mlog.From(s.cmp).Error("could not set lastCursorKey to op's cursor", merr.Context(err))
+	activity := make(chan struct{}, 1)
+	active := func() {
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.client.StreamPayments(streamCtx, req, func(op operations.Operation) {
+			active()
+			defer active()
+			handleL.Lock()
+			defer handleL.Unlock()
+			if streamCtx.Err() == nil {
+				fn(op)
 			}
 		})
-		if err == context.Canceled || ctx.Err() != nil {
-			return
-		} else if err == nil {
-			// sometimes this happens, I don't know why?
-			mlog.From(s.cmp).Warn("nil error from StreamPayments :shrug:", ctx)
-			continue
+	}()
+
+	if s.streamStallTimeout == 0 {
+		select {
+		case err := <-errCh:
+			return false, err
+		case <-ctx.Done():
+			return false, ctx.Err()
 		}
+	}
 
-		mlog.From(s.cmp).Warn("error while streaming transactions", ctx, merr.Context(err))
+	timer := time.NewTimer(s.streamStallTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-errCh:
+			return false, err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(s.streamStallTimeout)
+		case <-timer.C:
+			return true, nil
+		}
 	}
 }
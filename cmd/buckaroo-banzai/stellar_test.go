@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon/operations"
+
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestBackfillPayments(t *T) {
+	kp, err := keypair.Random()
+	massert.Require(t, massert.Nil(err))
+	payment := func(ledger int64) operations.Operation {
+		var p operations.Payment
+		p.PT = strconv.FormatInt(ledger<<32, 10)
+		p.From, p.To = "GSENDER", kp.Address()
+		return p
+	}
+
+	// horizon has a payment in every ledger from 1 to 10.
+	var listed []operations.Operation
+	for ledger := int64(1); ledger <= 10; ledger++ {
+		listed = append(listed, payment(ledger))
+	}
+	mock := &stellartest.Mock{
+		ListPaymentsFn: func(_ context.Context, req horizonclient.OperationRequest) ([]operations.Operation, error) {
+			var ops []operations.Operation
+			for _, op := range listed {
+				if cursorBefore(req.Cursor, op.PagingToken()) && len(ops) < int(req.Limit) {
+					ops = append(ops, op)
+				}
+			}
+			return ops, nil
+		},
+	}
+	s := &stellarServer{
+		cmp:              mtest.Component(),
+		kp:               kp,
+		client:           mock,
+		gapBackfillLimit: 3,
+	}
+
+	var handled []string
+	fn := func(_ context.Context, p operations.Payment) error {
+		handled = append(handled, p.PT)
+		return nil
+	}
+	backfill := func(lastLedger, opLedger int64) string {
+		handled = nil
+		return s.backfillPayments(context.Background(), payment(lastLedger).PagingToken(), payment(opLedger), fn)
+	}
+
+	// no gap, nothing to backfill.
+	massert.Require(t,
+		massert.Equal(payment(2).PagingToken(), backfill(2, 3)),
+		massert.Length(handled, 0),
+	)
+
+	// the stream jumped from 2 to 5, so 3 and 4 are backfilled.
+	massert.Require(t,
+		massert.Equal(payment(4).PagingToken(), backfill(2, 5)),
+		massert.Equal([]string{payment(3).PagingToken(), payment(4).PagingToken()}, handled),
+	)
+
+	// the stream jumped from 1 to 10, but only 3 are backfilled.
+	massert.Require(t,
+		massert.Equal(payment(4).PagingToken(), backfill(1, 10)),
+		massert.Length(handled, 3),
+	)
+
+	// with no cursor to go from, or the check disabled, there's nothing to
+	// backfill from.
+	handled = nil
+	massert.Require(t,
+		massert.Equal("", s.backfillPayments(context.Background(), "", payment(5), fn)),
+		massert.Length(handled, 0),
+	)
+	s.gapBackfillLimit = 0
+	massert.Require(t,
+		massert.Equal(payment(2).PagingToken(), backfill(2, 5)),
+		massert.Length(handled, 0),
+	)
+}
+
+func TestStreamPaymentsStall(t *T) {
+	payment := func(ledger int64) operations.Operation {
+		var p operations.Payment
+		p.PT = strconv.FormatInt(ledger<<32, 10)
+		return p
+	}
+	newServer := func(stallTimeout time.Duration, fn func(context.Context, horizonclient.OperationHandler) error) *stellarServer {
+		return &stellarServer{
+			cmp: mtest.Component(),
+			client: &stellartest.Mock{
+				StreamPaymentsFn: func(ctx context.Context, _ horizonclient.OperationRequest, handler horizonclient.OperationHandler) error {
+					return fn(ctx, handler)
+				},
+			},
+			streamStallTimeout: stallTimeout,
+		}
+	}
+
+	var handleL sync.Mutex
+	var handled []string
+	fn := func(op operations.Operation) {
+		handled = append(handled, op.PagingToken())
+	}
+
+	// a stream which hangs without regard for its Context is abandoned, and
+	// nothing it streams after that is handled.
+	release, released := make(chan struct{}), make(chan struct{})
+	s := newServer(50*time.Millisecond, func(_ context.Context, handler horizonclient.OperationHandler) error {
+		handler(payment(1))
+		<-release
+		handler(payment(2))
+		close(released)
+		return nil
+	})
+	stalled, err := s.streamPayments(context.Background(), horizonclient.OperationRequest{}, &handleL, fn)
+	massert.Require(t,
+		massert.Equal(true, stalled),
+		massert.Nil(err),
+		massert.Equal([]string{payment(1).PagingToken()}, handled),
+	)
+	close(release)
+	<-released
+	massert.Require(t, massert.Length(handled, 1))
+
+	// a stream which keeps streaming isn't stalled, however long it goes on
+	// for.
+	handled = nil
+	s = newServer(50*time.Millisecond, func(_ context.Context, handler horizonclient.OperationHandler) error {
+		for ledger := int64(1); ledger <= 5; ledger++ {
+			time.Sleep(20 * time.Millisecond)
+			handler(payment(ledger))
+		}
+		return errors.New("stream broke")
+	})
+	stalled, err = s.streamPayments(context.Background(), horizonclient.OperationRequest{}, &handleL, fn)
+	massert.Require(t,
+		massert.Equal(false, stalled),
+		massert.Equal(true, err != nil),
+		massert.Length(handled, 5),
+	)
+
+	// with the check disabled a hung stream is still given up on once the
+	// Context is canceled.
+	hang := make(chan struct{})
+	defer close(hang)
+	s = newServer(0, func(context.Context, horizonclient.OperationHandler) error {
+		<-hang
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stalled, err = s.streamPayments(ctx, horizonclient.OperationRequest{}, &handleL, fn)
+	massert.Require(t,
+		massert.Equal(false, stalled),
+		massert.Equal(context.DeadlineExceeded, err),
+	)
+}
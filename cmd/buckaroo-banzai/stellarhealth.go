@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/stellar/go/protocols/horizon"
+
+	"buckaroo-banzai/stellar"
+)
+
+const (
+	// stellarBaseReserve is the network's base reserve, in XLM. An account
+	// must hold twice it, plus once more for each of its subentries
+	// (trustlines, offers, signers and data entries).
+	stellarBaseReserve = 0.5
+
+	// stellarBaseFee is the fee, in stroops per operation, which buckaroo's
+	// transactions offer. It's txnbuild's default.
+	stellarBaseFee = 100
+
+	// stellarMaxProtocolVersion is the newest stellar protocol version which
+	// the stellar SDK buckaroo is built with is known to work with.
+	stellarMaxProtocolVersion = 11
+
+	// stellarLineFullFraction is how full a trustline can get, as a fraction
+	// of its limit, before it's reported.
+	stellarLineFullFraction = 0.9
+)
+
+// stellarHealth periodically checks the stellar accounts which buckaroo sends
+// from, and the network they're on, for problems which would cause
+// withdrawals or market making to start failing, and alerts about them before
+// they do.
+type stellarHealth struct {
+	cmp      *mcmp.Component
+	interval time.Duration
+	minXLM   float64
+}
+
+func instStellarHealth(parent *mcmp.Component) *stellarHealth {
+	cmp := parent.Child("stellar-health")
+	sh := &stellarHealth{cmp: cmp}
+
+	interval := mcfg.String(cmp, "interval",
+		mcfg.ParamDefault("10m"),
+		mcfg.ParamUsage("How often to check the health of buckaroo's stellar accounts. 0 disables checking."))
+	minXLM := mcfg.Float64(cmp, "min-xlm",
+		mcfg.ParamDefault(5),
+		mcfg.ParamUsage("An alert is posted if an account holds less than this much XLM above its reserve, which is what pays for fees"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if sh.interval, err = time.ParseDuration(*interval); err != nil {
+			return fmt.Errorf("parsing --stellar-health-interval: %w", err)
+		} else if *minXLM < 0 {
+			return errors.New("--stellar-health-min-xlm can't be negative")
+		}
+		sh.minXLM = *minXLM
+		return nil
+	})
+
+	return sh
+}
+
+// parseAmount parses an amount as returned by horizon, treating anything
+// unparseable as zero.
+func parseAmount(str string) float64 {
+	f, _ := strconv.ParseFloat(str, 64)
+	return f
+}
+
+// availableXLM returns how much XLM the account holds above its reserve and
+// what it has offered to sell, which is what's available to pay fees with.
+func availableXLM(account horizon.Account) float64 {
+	reserve := stellarBaseReserve * float64(2+account.SubentryCount)
+	for _, balance := range account.Balances {
+		if balance.Type == "native" {
+			return parseAmount(balance.Balance) - reserve - parseAmount(balance.SellingLiabilities)
+		}
+	}
+	return 0
+}
+
+// accountProblems returns descriptions of what's wrong, or about to go wrong,
+// with the given account, which buckaroo signs transactions for using the
+// account's own key. Each of the given assets must be held by the account,
+// and so needs a trustline with room left in it.
+func accountProblems(name string, account horizon.Account, assets []stellar.Asset, minXLM float64) []string {
+	var problems []string
+
+	if available := availableXLM(account); available < minXLM {
+		problems = append(problems, fmt.Sprintf(
+			"%s account %s has %s XLM available above its reserve, less than %s, withdrawals will start failing with tx_insufficient_balance or op_underfunded",
+			name, account.AccountID, formatPrice(available), formatPrice(minXLM)))
+	}
+
+	var weight int
+	for _, signer := range account.Signers {
+		if signer.Key == account.AccountID {
+			weight = int(signer.Weight)
+		}
+	}
+	if med := int(account.Thresholds.MedThreshold); weight == 0 || weight < med {
+		problems = append(problems, fmt.Sprintf(
+			"%s account %s's key has a weight of %d, but payments need %d, transactions will fail with tx_bad_auth",
+			name, account.AccountID, weight, med))
+	}
+
+	for _, asset := range assets {
+		var found bool
+		for _, balance := range account.Balances {
+			if !isAsset(asset, balance.Code, balance.Issuer) {
+				continue
+			}
+			found = true
+			limit := parseAmount(balance.Limit)
+			if limit > 0 && parseAmount(balance.Balance) >= limit*stellarLineFullFraction {
+				problems = append(problems, fmt.Sprintf(
+					"%s account %s's trustline for %s holds %s of its %s limit, payments into it will fail with op_line_full",
+					name, account.AccountID, asset.Code, balance.Balance, balance.Limit))
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf(
+				"%s account %s has no trustline for %s issued by %s",
+				name, account.AccountID, asset.Code, asset.Issuer))
+		}
+	}
+
+	return problems
+}
+
+// networkProblems returns descriptions of what's wrong, or about to go wrong,
+// with the stellar network which buckaroo is connected to.
+func networkProblems(root horizon.Root, fees horizon.FeeStats) []string {
+	var problems []string
+	if root.CurrentProtocolVersion > stellarMaxProtocolVersion {
+		problems = append(problems, fmt.Sprintf(
+			"the network is on protocol version %d, but buckaroo is only known to work with up to %d",
+			root.CurrentProtocolVersion, stellarMaxProtocolVersion))
+	} else if root.CoreSupportedProtocolVersion > stellarMaxProtocolVersion {
+		problems = append(problems, fmt.Sprintf(
+			"stellar-core supports protocol version %d, which the network may upgrade to, but buckaroo is only known to work with up to %d",
+			root.CoreSupportedProtocolVersion, stellarMaxProtocolVersion))
+	}
+
+	if fees.ModeAcceptedFee > stellarBaseFee {
+		problems = append(problems, fmt.Sprintf(
+			"the network is congested, most transactions are paying a fee of %d stroops but buckaroo offers %d, withdrawals may fail with tx_insufficient_fee",
+			fees.ModeAcceptedFee, stellarBaseFee))
+	}
+	return problems
+}
+
+// stellarHealthProblems checks every account which buckaroo sends from, as
+// well as the network, and returns descriptions of any problems found.
+func (a *app) stellarHealthProblems(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	defer cancel()
+
+	var problems []string
+	check := func(name, addr string, assets []stellar.Asset, minXLM float64) error {
+		account, err := a.stellar.client.Account(ctx, addr)
+		if err != nil {
+			return fmt.Errorf("getting %s account %s: %w", name, addr, err)
+		}
+		problems = append(problems, accountProblems(name, account, assets, minXLM)...)
+		return nil
+	}
+
+	// the issuing account needs no trustlines to send its own assets, a
+	// distribution account does.
+	name, assets := "issuing", []stellar.Asset(nil)
+	if a.stellar.isAnchor() {
+		name, assets = "distribution", []stellar.Asset{a.asset()}
+		for _, currency := range a.extraCurrencies {
+			assets = append(assets, a.assetIn(currency))
+		}
+	}
+	if err := check(name, a.stellar.kp.Address(), assets, a.stellarHealth.minXLM); err != nil {
+		return nil, err
+	}
+
+	if a.marketMaker != nil && a.marketMaker.enabled {
+		if err := check("market maker", a.marketMaker.kp.Address(), []stellar.Asset{a.asset()}, a.stellarHealth.minXLM); err != nil {
+			return nil, err
+		}
+	}
+
+	// the funding account needs to be able to afford at least one more
+	// top-up.
+	if a.feeTopUp != nil && a.feeTopUp.kp != nil {
+		if err := check("fee funding", a.feeTopUp.kp.Address(), nil, a.feeTopUp.amount); err != nil {
+			return nil, err
+		}
+	}
+
+	root, err := a.stellar.client.Root(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting horizon root: %w", err)
+	}
+	fees, err := a.stellar.client.FeeStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, networkProblems(root, fees)...), nil
+}
+
+// monitorStellarHealth checks for stellar problems every
+// --stellar-health-interval, alerting about any which are found, until the
+// Context is canceled.
+func (a *app) monitorStellarHealth(ctx context.Context) {
+	ctx = mctx.Annotate(ctx, "stellarHealthInterval", a.stellarHealth.interval.String())
+	check := func() {
+		problems, err := a.stellarHealthProblems(ctx)
+		if err != nil {
+			// horizon being down is already alerted about by the client.
+			mlog.From(a.cmp).Error("error checking stellar health", ctx, merr.Context(err))
+			return
+		} else if len(problems) == 0 {
+			return
+		}
+		mlog.From(a.cmp).Warn("stellar health problems found", mctx.Annotate(ctx, "problems", problems))
+		// all problems go into one alert, since they're all of the same kind
+		// and any after the first would be suppressed.
+		a.alerts.alert(ctx, alertStellarHealth, nil, "stellar health check found problems:\n• %s",
+			strings.Join(problems, "\n• "))
+	}
+
+	check()
+	ticker := time.NewTicker(a.stellarHealth.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/base"
+
+	"buckaroo-banzai/stellar"
+)
+
+func TestAccountProblems(t *T) {
+	asset := stellar.Asset{Code: "BUCK", Issuer: "GISSUER"}
+	balance := func(typ, code, amount, limit string) horizon.Balance {
+		var b horizon.Balance
+		b.Asset = base.Asset{Type: typ, Code: code, Issuer: "GISSUER"}
+		b.Balance, b.Limit = amount, limit
+		return b
+	}
+	account := func(xlm, buck string, weight int32) horizon.Account {
+		acc := horizon.Account{AccountID: "GDIST", SubentryCount: 2}
+		acc.Balances = []horizon.Balance{balance("native", "", xlm, "")}
+		if buck != "" {
+			acc.Balances = append(acc.Balances, balance("credit_alphanum4", "BUCK", buck, "100.0000000"))
+		}
+		acc.Signers = []horizon.Signer{{Key: "GDIST", Weight: weight}}
+		acc.Thresholds.MedThreshold = 1
+		return acc
+	}
+	problems := func(acc horizon.Account) []string {
+		return accountProblems("distribution", acc, []stellar.Asset{asset}, 5)
+	}
+
+	// the reserve is 2 XLM, for the account and its 2 subentries.
+	massert.Require(t,
+		massert.Length(problems(account("7.0000001", "10.0000000", 1)), 0),
+		massert.Length(problems(account("6.9999999", "10.0000000", 1)), 1),
+		massert.Length(problems(account("20.0000000", "", 1)), 1),
+		massert.Length(problems(account("20.0000000", "95.0000000", 1)), 1),
+		massert.Length(problems(account("20.0000000", "10.0000000", 0)), 1),
+		massert.Length(problems(account("1.0000000", "", 0)), 3),
+	)
+}
+
+func TestNetworkProblems(t *T) {
+	root := horizon.Root{CurrentProtocolVersion: 11, CoreSupportedProtocolVersion: 11}
+	var fees horizon.FeeStats
+	fees.ModeAcceptedFee = 100
+	massert.Require(t, massert.Length(networkProblems(root, fees), 0))
+
+	root.CoreSupportedProtocolVersion = 12
+	massert.Require(t, massert.Length(networkProblems(root, fees), 1))
+
+	root.CurrentProtocolVersion = 12
+	fees.ModeAcceptedFee = 200
+	massert.Require(t, massert.Length(networkProblems(root, fees), 2))
+}
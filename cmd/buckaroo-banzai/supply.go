@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// supplyReportDays is how many days the economy command reports on, the most
+// recent week of which is also reported on separately.
+const supplyReportDays = 30
+
+var sparklineBars = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline returns a bar for each of the values, scaled so the largest one is
+// the tallest bar.
+func sparkline(values []int) string {
+	var max int
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	bars := make([]rune, len(values))
+	for i, v := range values {
+		if v <= 0 || max == 0 {
+			bars[i] = sparklineBars[0]
+			continue
+		}
+		bars[i] = sparklineBars[v*(len(sparklineBars)-1)/max]
+	}
+	return string(bars)
+}
+
+// supplyRow is a single line of the economy command's report, which totals
+// some of what each day's SupplyDay moved.
+type supplyRow struct {
+	name  string
+	total func(bank.SupplyDay) int
+}
+
+// sumExcept returns the sum of the amounts, not including those of the given
+// source.
+func sumExcept(amounts map[string]int, except string) int {
+	var sum int
+	for source, amount := range amounts {
+		if source != except {
+			sum += amount
+		}
+	}
+	return sum
+}
+
+// supplyRows are what the economy command reports on. Deposits and
+// withdrawals move funds between the bank and stellar, while everything else
+// which moves funds into or out of the bank creates or destroys them.
+var supplyRows = []supplyRow{
+	{"minted", func(d bank.SupplyDay) int { return sumExcept(d.In, bank.JournalSourceDeposit) }},
+	{"burned", func(d bank.SupplyDay) int { return sumExcept(d.Out, bank.JournalSourceExport) }},
+	{"deposited", func(d bank.SupplyDay) int { return d.In[bank.JournalSourceDeposit] }},
+	{"withdrawn", func(d bank.SupplyDay) int { return d.Out[bank.JournalSourceExport] }},
+	{"net change", func(d bank.SupplyDay) int { return sumExcept(d.In, "") - sumExcept(d.Out, "") }},
+}
+
+func (a *app) cmdEconomy(ctx context.Context, req commandReq) error {
+	mlog.From(a.cmp).Info("getting supply", ctx)
+	days, err := a.bank.Supply(time.Now().AddDate(0, 0, -(supplyReportDays - 1)))
+	if err != nil {
+		return err
+	}
+
+	strb := new(strings.Builder)
+	fmt.Fprintf(strb, "```\n%-10s  %8s  %8s  %s\n", "", "7 days", "30 days", "daily")
+	for _, row := range supplyRows {
+		values := make([]int, len(days))
+		var week, month int
+		for i, day := range days {
+			values[i] = row.total(day)
+			month += values[i]
+			if i >= len(days)-7 {
+				week += values[i]
+			}
+		}
+		fmt.Fprintf(strb, "%-10s  %8s  %8s  %s\n", row.name,
+			a.formatNumber(week),
+			a.formatNumber(month),
+			sparkline(values))
+	}
+	strb.WriteString("```")
+
+	msg := slackbot.NewMessage(":bank: the %s economy\n%s", a.currencyString(2, false), strb.String())
+	msg.Context("Days are in UTC, ending with today. Only changes since the bank started keeping daily totals are included")
+	a.replyMsg(req, msg)
+	return nil
+}
+
+const supplyUsage = "usage: `supply [<currency code>]`"
+
+// cmdSupply reports on the whole of a currency's supply, by replaying the
+// journal, rather than the daily totals which the economy command uses.
+func (a *app) cmdSupply(ctx context.Context, req commandReq) error {
+	currency := bank.DefaultCurrency
+	if len(req.args) > 1 {
+		a.reply(req, supplyUsage)
+		return nil
+	} else if len(req.args) == 1 {
+		var ok bool
+		if currency, ok = a.extraCurrency(req.args[0]); !ok {
+			return inputErrorf("I don't bank any currency called `%s`", req.args[0])
+		}
+	}
+
+	mlog.From(a.cmp).Info("totaling supply", ctx)
+	totals, err := bank.TotalSupply(a.bank, currency)
+	if err != nil {
+		return err
+	}
+
+	strb := new(strings.Builder)
+	fmt.Fprintf(strb, "```\n")
+	all := bank.SupplyDay{In: totals.In, Out: totals.Out}
+	for _, row := range supplyRows {
+		fmt.Fprintf(strb, "%-10s  %12s\n", row.name, a.formatNumber(row.total(all)))
+	}
+	strb.WriteString("```")
+
+	msg := slackbot.NewMessage(":bank: all the %s there are\n%s", a.currencyStringIn(currency, 2, false), strb.String()).
+		Fields(
+			"In slack", a.formatNumber(totals.Balances),
+			"On stellar", a.formatNumber(totals.Exported()),
+			"Burned", a.formatNumber(totals.Burned),
+		)
+	msg.Context("On stellar is what's been withdrawn, net of what's been deposited or burned. Only changes since the ledger was started are included")
+	a.replyMsg(req, msg)
+	return nil
+}
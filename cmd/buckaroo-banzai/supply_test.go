@@ -0,0 +1,42 @@
+package main
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+)
+
+func TestSparkline(t *T) {
+	massert.Require(t,
+		massert.Equal("", sparkline(nil)),
+		massert.Equal("▁▁▁", sparkline([]int{0, 0, 0})),
+		massert.Equal("▁▄█▁", sparkline([]int{0, 4, 8, -1})),
+	)
+}
+
+func TestSupplyRows(t *T) {
+	day := bank.SupplyDay{
+		In: map[string]int{
+			bank.JournalSourceEarn:    5,
+			bank.JournalSourceMint:    2,
+			bank.JournalSourceDeposit: 3,
+		},
+		Out: map[string]int{
+			bank.JournalSourceEarn:   1,
+			bank.JournalSourceExport: 4,
+		},
+	}
+	totals := map[string]int{}
+	for _, row := range supplyRows {
+		totals[row.name] = row.total(day)
+	}
+	massert.Require(t, massert.Equal(map[string]int{
+		"minted":     7,
+		"burned":     1,
+		"deposited":  3,
+		"withdrawn":  4,
+		"net change": 5,
+	}, totals))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+
+	"buckaroo-banzai/bank"
+)
+
+const (
+	// suspiciousHistoryPage is how many history entries are read from the bank
+	// at a time when checking an account for suspicious activity.
+	suspiciousHistoryPage = 100
+
+	// suspiciousHistoryPages is the most pages of an account's history which
+	// are read, so that checking an account with a lot of recent activity
+	// doesn't hold up its withdrawal for too long.
+	suspiciousHistoryPages = 10
+)
+
+// suspiciousActivity describes the activity which, if an account has had any
+// of it within the last window, causes a withdrawal from that account to be
+// held until an admin has reviewed it. The patterns it looks for are those of
+// funds being funneled into one account to be cashed out, e.g. from other
+// accounts which were compromised or made for the purpose.
+type suspiciousActivity struct {
+	cmp    *mcmp.Component
+	window time.Duration
+
+	// giveTotal is the most, in whole units of the currency, which an account
+	// can be given within the window. 0 disables.
+	giveTotal int
+
+	// newGivers is the most accounts which are newer than newAccountAge which
+	// can give to an account within the window. 0 disables.
+	newGivers     int
+	newAccountAge time.Duration
+}
+
+func instSuspiciousActivity(parent *mcmp.Component) *suspiciousActivity {
+	cmp := parent.Child("suspicious")
+	sa := &suspiciousActivity{cmp: cmp}
+
+	window := mcfg.String(cmp, "window",
+		mcfg.ParamDefault("1h"),
+		mcfg.ParamUsage("How far back to look at what an account has been given when checking its withdrawals for suspicious activity"))
+	giveTotal := mcfg.Int(cmp, "give-total",
+		mcfg.ParamUsage("Withdrawals from an account which has been given at least this many whole units of a currency within --suspicious-window are held until an admin releases or denies them. 0 disables."))
+	newGivers := mcfg.Int(cmp, "new-givers",
+		mcfg.ParamUsage("Withdrawals from an account which has been given to by at least this many new accounts within --suspicious-window are held until an admin releases or denies them. 0 disables."))
+	newAccountAge := mcfg.String(cmp, "new-account-age",
+		mcfg.ParamDefault("168h"),
+		mcfg.ParamUsage("Accounts whose first activity is more recent than this are new, see --suspicious-new-givers"))
+
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		var err error
+		if sa.window, err = time.ParseDuration(*window); err != nil {
+			return fmt.Errorf("parsing --suspicious-window: %w", err)
+		} else if sa.window <= 0 {
+			return errors.New("--suspicious-window must be greater than 0")
+		} else if sa.giveTotal = *giveTotal; sa.giveTotal < 0 {
+			return errors.New("--suspicious-give-total can't be negative")
+		} else if sa.newGivers = *newGivers; sa.newGivers < 0 {
+			return errors.New("--suspicious-new-givers can't be negative")
+		} else if sa.newAccountAge, err = time.ParseDuration(*newAccountAge); err != nil {
+			return fmt.Errorf("parsing --suspicious-new-account-age: %w", err)
+		}
+		return nil
+	})
+
+	return sa
+}
+
+func (sa *suspiciousActivity) enabled() bool {
+	return sa != nil && (sa.giveTotal > 0 || sa.newGivers > 0)
+}
+
+// isReceived returns whether the history entry is of funds which came to the
+// user from someone else, however they were moved, e.g. a give, a scheduled
+// payment, a gift card or a captured hold, as opposed to being created by the
+// bank or given back to the user from their own hold.
+func isReceived(e bank.HistoryEntry) bool {
+	return e.Amount > 0 &&
+		!bank.IsLedgerAccount(e.Counterparty) &&
+		e.Source != bank.JournalSourceRelease
+}
+
+// recentGives returns the total which the given account received from others
+// since the given time, see isReceived, and the accounts which it came from.
+func (a *app) recentGives(accountID string, since time.Time) (int, map[string]bool, error) {
+	var total int
+	givers := map[string]bool{}
+	var cursor string
+	for page := 0; page < suspiciousHistoryPages; page++ {
+		entries, nextCursor, err := a.bank.History(accountID, cursor, suspiciousHistoryPage)
+		if err != nil {
+			return 0, nil, fmt.Errorf("getting history of %q: %w", accountID, err)
+		}
+		for _, e := range entries {
+			if e.Time.Before(since) {
+				return total, givers, nil
+			} else if isReceived(e) {
+				total += e.Amount
+				givers[e.Counterparty] = true
+			}
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	return total, givers, nil
+}
+
+// isNewAccount returns whether the given account's first activity was less than
+// --suspicious-new-account-age ago. An account with more than a page of history
+// is never new.
+func (a *app) isNewAccount(accountID string, now time.Time) (bool, error) {
+	entries, nextCursor, err := a.bank.History(accountID, "", suspiciousHistoryPage)
+	if err != nil {
+		return false, fmt.Errorf("getting history of %q: %w", accountID, err)
+	} else if nextCursor != "" || len(entries) == 0 {
+		return false, nil
+	}
+	return now.Sub(entries[len(entries)-1].Time) < a.suspicious.newAccountAge, nil
+}
+
+// suspiciousWithdrawal returns why a withdrawal of the currency from the given
+// account looks suspicious, or an empty string if it doesn't.
+func (a *app) suspiciousWithdrawal(accountID, currency string, now time.Time) (string, error) {
+	sa := a.suspicious
+	if !sa.enabled() {
+		return "", nil
+	}
+
+	accountID = bank.CurrencyAccountID(accountID, currency)
+	total, givers, err := a.recentGives(accountID, now.Add(-sa.window))
+	if err != nil {
+		return "", err
+	}
+
+	if sa.giveTotal > 0 && total >= sa.giveTotal*a.currency.unit() {
+		return fmt.Sprintf("it was given %s within the last %s",
+			a.formatAmountIn(currency, total, true), sa.window), nil
+	}
+
+	if sa.newGivers > 0 && len(givers) >= sa.newGivers {
+		var newGivers int
+		for giver := range givers {
+			isNew, err := a.isNewAccount(giver, now)
+			if err != nil {
+				return "", err
+			} else if isNew {
+				newGivers++
+			}
+		}
+		if newGivers >= sa.newGivers {
+			return fmt.Sprintf("it was given to by %d accounts newer than %s within the last %s",
+				newGivers, sa.newAccountAge, sa.window), nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestSuspiciousWithdrawals(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	var sends []stellar.SendOpts
+	mock := &stellartest.Mock{
+		MakeSendXDRFn: func(_ context.Context, opts stellar.SendOpts) (string, error) {
+			sends = append(sends, opts)
+			return "xdr", nil
+		},
+	}
+	a := &app{
+		cmp:           cmp,
+		bank:          bank.NewInMem(),
+		slack:         fs,
+		currencyName:  "BUCK",
+		exportBudget:  &errorBudget{},
+		withdrawDelay: time.Hour,
+		giftcardTTL:   time.Hour,
+		suspicious: &suspiciousActivity{
+			window:        time.Hour,
+			giveTotal:     30,
+			newGivers:     2,
+			newAccountAge: time.Hour,
+		},
+	}
+	a.economy = economy.New(cmp, economy.Opts{
+		Bank:    a.bank,
+		Stellar: mock,
+		Asset:   stellar.Asset{Code: "BUCK"},
+		Timeout: time.Second,
+	})
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser("U1", "u1", "T1")
+		admin := fs.AddUser("U2", "u2", "T1")
+		channel := fs.AddChannel("D1", true)
+
+		ctx := context.Background()
+		give := func(from, to string, amount int) {
+			_, err := a.bank.Incr(from, amount)
+			massert.Require(t, massert.Nil(err))
+			_, _, err = a.bank.TransferAs(to, from, amount, bank.JournalSourceGive)
+			massert.Require(t, massert.Nil(err))
+		}
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		withdraw := func(messageTS, amount string) {
+			err := a.cmdWithdraw(ctx, commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      userA,
+				accountID: userA.ID,
+				messageTS: messageTS,
+				args:      []string{amount, "GADDR"},
+			})
+			massert.Require(t, massert.Nil(err))
+		}
+		withdrawals := func(args ...string) error {
+			return a.cmdWithdrawals(ctx, commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      admin,
+				accountID: admin.ID,
+				role:      roleAdmin,
+				args:      args,
+			})
+		}
+		delayed := func() map[string]delayedWithdrawal {
+			dws, err := a.allDelayedWithdrawals()
+			massert.Require(t, massert.Nil(err))
+			return dws
+		}
+		onlyID := func() string {
+			var id string
+			for id = range delayed() {
+			}
+			return id
+		}
+
+		_, err := a.bank.Incr(userA.ID, 50)
+		massert.Require(t, massert.Nil(err))
+		withdraw("1.0", "5")
+		massert.Require(t, massert.Length(sends, 1), massert.Length(delayed(), 0))
+
+		// being given a lot and then withdrawing it is held until an admin
+		// releases it, no matter how long it waits.
+		give("U3", userA.ID, 30)
+		withdraw("2.0", "10")
+		id := onlyID()
+		massert.Require(t,
+			massert.Length(sends, 1),
+			massert.Equal(65, balanceOf(userA.ID)),
+			massert.Equal(10, balanceOf(bank.HoldsAccountID)),
+			massert.Equal(true, delayed()[id].Review != ""),
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now().Add(24*time.Hour))),
+			massert.Length(sends, 1),
+		)
+
+		_, isInputErr := withdrawals("release", "nope").(inputError)
+		massert.Require(t, massert.Equal(true, isInputErr))
+		fs.Flush()
+		massert.Require(t,
+			massert.Nil(withdrawals("release", id)),
+			massert.Length(fs.Flush(), 2),
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now())),
+			massert.Length(sends, 2),
+			massert.Equal("10", sends[1].Amount),
+			massert.Length(delayed(), 0),
+			massert.Equal(0, balanceOf(bank.HoldsAccountID)),
+		)
+
+		// denying gives it back, and only works on those held for review.
+		withdraw("3.0", "10")
+		id = onlyID()
+		massert.Require(t, massert.Equal(55, balanceOf(userA.ID)))
+		fs.Flush()
+		massert.Require(t,
+			massert.Nil(withdrawals("deny", id)),
+			massert.Length(fs.Flush(), 2),
+			massert.Length(delayed(), 0),
+			massert.Equal(65, balanceOf(userA.ID)),
+		)
+		_, isInputErr = withdrawals("deny", id).(inputError)
+		massert.Require(t, massert.Equal(true, isInputErr))
+
+		// being given to by a lot of new accounts is suspicious too, even if
+		// not much is given.
+		userB := fs.AddUser("U4", "u4", "T1")
+		give("U5", userB.ID, 1)
+		review, err := a.suspiciousWithdrawal(userB.ID, bank.DefaultCurrency, time.Now())
+		massert.Require(t, massert.Nil(err), massert.Equal("", review))
+		give("U6", userB.ID, 1)
+		review, err = a.suspiciousWithdrawal(userB.ID, bank.DefaultCurrency, time.Now())
+		massert.Require(t, massert.Nil(err), massert.Equal(true, review != ""))
+
+		// but not once the givers are no longer new, or the gives are old.
+		review, err = a.suspiciousWithdrawal(userB.ID, bank.DefaultCurrency, time.Now().Add(2*time.Hour))
+		massert.Require(t, massert.Nil(err), massert.Equal("", review))
+
+		// funds which come in other ways than gives count too, e.g. a large
+		// gift card.
+		userC := fs.AddUser("U7", "u7", "T1")
+		_, err = a.bank.Incr("U8", 40)
+		massert.Require(t, massert.Nil(err))
+		_, code, err := a.createGiftcard(ctx, "U8", 40)
+		massert.Require(t, massert.Nil(err))
+		_, _, ok, err := a.redeemGiftcard(ctx, userC.ID, code)
+		massert.Require(t, massert.Nil(err), massert.Equal(true, ok))
+		massert.Require(t, massert.Nil(a.cmdWithdraw(ctx, commandReq{
+			channelID: channel.ID,
+			channel:   channel,
+			user:      userC,
+			accountID: userC.ID,
+			messageTS: "4.0",
+			args:      []string{"40", "GADDR"},
+		})))
+		id = onlyID()
+		massert.Require(t,
+			massert.Length(sends, 2),
+			massert.Equal(userC.ID, delayed()[id].AccountID),
+			massert.Equal(true, delayed()[id].Review != ""),
+		)
+	})
+}
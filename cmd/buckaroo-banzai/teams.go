@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// Policies for how users from other slack teams, e.g. those in externally
+// shared channels, are handled.
+const (
+	// foreign users can't use commands or earn anything.
+	foreignTeamPolicyRefuse = "refuse"
+
+	// foreign users get their own bank accounts, namespaced by their team ID.
+	foreignTeamPolicyNamespace = "namespace"
+)
+
+var errForeignTeam = errors.New("sorry pal, I only bank for members of my own workspace")
+
+func validateForeignTeamPolicy(policy string) error {
+	switch policy {
+	case foreignTeamPolicyRefuse, foreignTeamPolicyNamespace:
+		return nil
+	default:
+		return fmt.Errorf("unknown foreign team policy %q", policy)
+	}
+}
+
+// accountID returns the ID of the bank account belonging to the given slack
+// user. Users on the bot's own team use their user ID directly, while users
+// from other teams either get an account namespaced by their team ID or
+// errForeignTeam, depending on the foreign team policy.
+func (a *app) accountID(user *slack.User) (string, error) {
+	if user.TeamID == "" || user.TeamID == a.slackClient.BotTeamID {
+		return user.ID, nil
+	} else if a.foreignTeamPolicy == foreignTeamPolicyNamespace {
+		return user.TeamID + ":" + user.ID, nil
+	}
+	return "", errForeignTeam
+}
+
+// accountIDByUserID is like accountID, but looks up the slack user first.
+func (a *app) accountIDByUserID(userID string) (string, error) {
+	user, err := a.slack.GetUser(userID)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get slack user %v: %w", userID, err)
+	}
+	return a.accountID(user)
+}
+
+// userIDFromAccountID returns the slack user ID which owns the given bank
+// account ID.
+func userIDFromAccountID(accountID string) string {
+	if i := strings.LastIndex(accountID, ":"); i >= 0 {
+		return accountID[i+1:]
+	}
+	return accountID
+}
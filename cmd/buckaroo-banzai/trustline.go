@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/network"
+
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+// trustlineMsg returns a message telling the user how to add a trustline for
+// the given currency to their stellar account, including a SEP-7 link which
+// fills in the transaction for them in wallets which support it.
+func (a *app) trustlineMsg(ctx context.Context, addr, currency string) (*slackbot.Message, error) {
+	asset := a.assetIn(currency)
+	stellarCtx, cancel := context.WithTimeout(ctx, a.stellar.timeout)
+	defer cancel()
+	txXDR, err := a.stellar.client.MakeTrustlineXDR(stellarCtx, addr, asset)
+	if err != nil {
+		return nil, fmt.Errorf("making trustline tx for %q: %w", addr, err)
+	}
+
+	passphrase := network.PublicNetworkPassphrase
+	if a.testNet {
+		passphrase = network.TestNetworkPassphrase
+	}
+	uri := stellar.TxURI(txXDR, passphrase, "Trust "+asset.Code+" so buckaroo can send them to you")
+
+	return slackbot.NewMessage(
+		"before I can send you any %s, your stellar account `%s` needs a trustline for them. if your wallet supports it (e.g. LOBSTR, Solar, StellarTerm) <%s|click here to add it>, otherwise add it by hand using the details below.",
+		a.currencyStringIn(currency, 2, true), addr, uri,
+	).
+		Fields("Asset code", "`"+asset.Code+"`", "Issuer", "`"+asset.Issuer+"`").
+		Context("LOBSTR: Assets → Add asset, then search for the issuer. " +
+			"Solar: Add asset → Custom asset. " +
+			"StellarTerm: Account → Assets → Add trust using the code and issuer. " +
+			"Once the trustline is there just run your withdraw again."), nil
+}
+
+// dmTrustline DMs the user instructions for adding a trustline for the given
+// currency to the given stellar (or federation) address.
+func (a *app) dmTrustline(ctx context.Context, userID, addr, currency string) error {
+	ctx = mctx.Annotate(ctx, "addr", addr, "currency", currency)
+	mlog.From(a.cmp).Info("sending trustline instructions", ctx)
+	msg, err := a.trustlineMsg(ctx, addr, currency)
+	if err != nil {
+		return err
+	}
+	return a.dm(userID, msg)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+// inputError is returned from commands when the user gave them bad arguments.
+// Its message is shown to the user as-is.
+type inputError struct {
+	msg string
+}
+
+func inputErrorf(format string, args ...interface{}) error {
+	return inputError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e inputError) Error() string {
+	return e.msg
+}
+
+// userErrMsg returns what the user is told about an error which was returned
+// from a command. Errors which the user can do something about get a message
+// saying what, everything else gets a generic one so that internal details
+// (redis keys, horizon responses, etc...) don't end up in front of regular
+// users. Moderators and up get the full error, since they're the ones who'll
+// have to deal with it. The full error is logged either way.
+func (a *app) userErrMsg(err error, r role) string {
+	var inputErr inputError
+	switch {
+	case errors.As(err, &inputErr):
+		return inputErr.msg
+	case errors.Is(err, bank.ErrNotEnoughFunds):
+		return fmt.Sprintf("%s. `balance` will tell you what you've got", bank.ErrNotEnoughFunds)
+	case errors.Is(err, stellar.ErrNoTrustline):
+		return fmt.Sprintf("that stellar account doesn't trust %s, `help` has how to fix that", a.currencyString(2, true))
+	case errors.Is(err, slackbot.ErrUserNotFound):
+		return "I don't know who that is, try @-mentioning them"
+	case errors.Is(err, stellar.ErrCircuitOpen):
+		return fmt.Sprintf("%s :zzz:", stellar.ErrCircuitOpen)
+	case errors.Is(err, stellar.ErrBudgetExceeded):
+		return fmt.Sprintf("%s :hourglass:", stellar.ErrBudgetExceeded)
+	case errors.Is(err, bank.ErrUnavailable):
+		return "the vault is locked up tight right now, try again in a bit :lock:"
+	case r >= roleModerator:
+		return fmt.Sprintf("what a bummer: %s", err)
+	default:
+		return "what a bummer, something went wrong on my end. try again in a bit, and if it keeps happening let a moderator know"
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/stellar"
+)
+
+func TestUserErrMsg(t *T) {
+	a := &app{currencyName: "BUCK"}
+	wrap := func(err error) error {
+		return fmt.Errorf("doing the thing: %w", err)
+	}
+	internal := errors.New("ERR wrong number of arguments for 'hget' command")
+
+	massert.Require(t,
+		massert.Equal("amount must be greater than 0", a.userErrMsg(inputErrorf("amount must be greater than 0"), roleUser)),
+		massert.Equal("you aint got that kind of scratch, kid. `balance` will tell you what you've got",
+			a.userErrMsg(wrap(bank.ErrNotEnoughFunds), roleUser)),
+		massert.Equal("that stellar account doesn't trust BUCKs, `help` has how to fix that",
+			a.userErrMsg(wrap(stellar.ErrNoTrustline), roleUser)),
+		massert.Equal("I don't know who that is, try @-mentioning them",
+			a.userErrMsg(wrap(slackbot.ErrUserNotFound), roleUser)),
+		massert.Equal("the vault is locked up tight right now, try again in a bit :lock:",
+			a.userErrMsg(wrap(bank.ErrUnavailable), roleAdmin)),
+
+		// internal details are only shown to those who can do something about
+		// them.
+		massert.Not(massert.Equal("what a bummer: "+internal.Error(), a.userErrMsg(internal, roleUser))),
+		massert.Equal("what a bummer: "+internal.Error(), a.userErrMsg(internal, roleModerator)),
+	)
+}
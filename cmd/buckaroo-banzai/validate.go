@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/radix/v3"
+
+	"buckaroo-banzai/stellar"
+)
+
+// configSource is where params are read from, it's the same as what
+// m.RootServiceComponent populates them from.
+var configSource = mcfg.Sources{
+	new(mcfg.SourceEnv),
+	new(mcfg.SourceCLI),
+}
+
+// validateConfigFlag returns whether --validate-config was given. It's checked
+// before params are populated, since populating fails if a required param
+// isn't set, and that should show up in the report too.
+func validateConfigFlag(cmp *mcmp.Component, src mcfg.Source) (bool, error) {
+	pvs, err := src.Parse(cmp)
+	if err != nil {
+		return false, err
+	}
+	var validate bool
+	for _, pv := range pvs {
+		if len(pv.Path) > 0 || pv.Name != "validate-config" {
+			continue
+		} else if err := json.Unmarshal(pv.Value, &validate); err != nil {
+			return false, fmt.Errorf("parsing --validate-config: %w", err)
+		}
+	}
+	return validate, nil
+}
+
+// stringParams returns the values of all string params on the component and
+// its children, keyed by their full name, e.g. "stellar-seed".
+func stringParams(cmp *mcmp.Component) map[string]string {
+	params := map[string]string{}
+	for _, param := range mcfg.CollectParams(cmp) {
+		if str, ok := param.Into.(*string); ok {
+			path := append(append([]string(nil), param.Component.Path()...), param.Name)
+			params[strings.Join(path, "-")] = *str
+		}
+	}
+	return params
+}
+
+// validateConfigChecks returns the checks which --validate-config performs.
+// Unlike --self-test none of the components are initialized, so nothing
+// connects to slack or horizon, and redis is only checked if withRedis is set
+// once the params are populated.
+//
+// It must be called before the params are populated, see durationParams.
+func validateConfigChecks(cmp *mcmp.Component, src mcfg.Source, withRedis *bool) []selfTestCheck {
+	durations := durationParams(cmp)
+
+	// every check after the first works off the populated params, so there's
+	// no point running them if populating failed.
+	var populateErr error
+	populated := func(fn func(ctx context.Context) (string, error)) func(ctx context.Context) (string, error) {
+		return func(ctx context.Context) (string, error) {
+			if populateErr != nil {
+				return "", errors.New("skipped, params couldn't be populated")
+			}
+			return fn(ctx)
+		}
+	}
+
+	return []selfTestCheck{
+		{"params", func(ctx context.Context) (string, error) {
+			if populateErr = mcfg.Populate(cmp, src); populateErr != nil {
+				return "", populateErr
+			}
+			return fmt.Sprintf("%d params populated", len(mcfg.CollectParams(cmp))), nil
+		}},
+		{"required", populated(func(ctx context.Context) (string, error) {
+			return validateRequiredParams(cmp)
+		})},
+		{"durations", populated(func(ctx context.Context) (string, error) {
+			return validateDurationParams(stringParams(cmp), durations)
+		})},
+		{"profile", populated(func(ctx context.Context) (string, error) {
+			name := stringParams(cmp)["profile"]
+			if name == "" {
+				return "none", nil
+			} else if _, ok := profiles[name]; !ok {
+				return "", fmt.Errorf("unknown --profile %q, must be one of: %s", name, strings.Join(profileNames(), ", "))
+			}
+			return name, nil
+		})},
+		{"seeds", populated(func(ctx context.Context) (string, error) {
+			return validateSeedParams(stringParams(cmp))
+		})},
+		{"domain", populated(func(ctx context.Context) (string, error) {
+			domain := stringParams(cmp)["stellar-domain"]
+			addrs, err := net.DefaultResolver.LookupHost(ctx, domain)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s resolves to %s", domain, strings.Join(addrs, ", ")), nil
+		})},
+		{"redis", populated(func(ctx context.Context) (string, error) {
+			if !*withRedis {
+				return "skipped, --validate-config-redis isn't set", nil
+			}
+			return validateRedisParams(ctx, stringParams(cmp))
+		})},
+	}
+}
+
+// validateRequiredParams checks that no required string param was set to the
+// empty string, which populating doesn't catch.
+func validateRequiredParams(cmp *mcmp.Component) (string, error) {
+	var n int
+	var empty []string
+	for _, param := range mcfg.CollectParams(cmp) {
+		if !param.Required {
+			continue
+		}
+		n++
+		if str, ok := param.Into.(*string); ok && *str == "" {
+			path := append(append([]string(nil), param.Component.Path()...), param.Name)
+			empty = append(empty, "--"+strings.Join(path, "-"))
+		}
+	}
+	if len(empty) > 0 {
+		return "", fmt.Errorf("required params are empty: %s", strings.Join(empty, ", "))
+	}
+	return fmt.Sprintf("%d required params set", n), nil
+}
+
+// durationParams returns the names of the string params whose default is a
+// duration. Params are only ever parsed as durations within init hooks, which
+// --validate-config doesn't run, so this is how it knows which to check. Every
+// duration param has a default, so this has to be called before the params are
+// populated, while they still hold their defaults.
+func durationParams(cmp *mcmp.Component) []string {
+	var names []string
+	for name, value := range stringParams(cmp) {
+		if _, err := time.ParseDuration(value); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateDurationParams(params map[string]string, names []string) (string, error) {
+	var errs []string
+	for _, name := range names {
+		if _, err := time.ParseDuration(params[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("--%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return "", errors.New(strings.Join(errs, "; "))
+	}
+	return fmt.Sprintf("%d durations parsed", len(names)), nil
+}
+
+// validateSeedParams checks that every seed param which is set can be loaded,
+// returning the addresses they're for.
+func validateSeedParams(params map[string]string) (string, error) {
+	var addrs []string
+	for name, value := range params {
+		if !strings.HasSuffix(name, "seed") || value == "" {
+			continue
+		}
+		kp, err := stellar.LoadKeyPair(value)
+		if err != nil {
+			return "", fmt.Errorf("--%s: %w", name, err)
+		}
+		addrs = append(addrs, name+"="+kp.Address())
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ", "), nil
+}
+
+// validateRedisParams pings every redis which buckaroo is configured to use.
+func validateRedisParams(ctx context.Context, params map[string]string) (string, error) {
+	var names []string
+	for name := range params {
+		if strings.HasSuffix(name, "redis-addr") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		timeout := selfTestTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		conn, err := radix.Dial("tcp", params[name], radix.DialTimeout(timeout))
+		if err != nil {
+			return "", fmt.Errorf("--%s: %w", name, err)
+		}
+		err = conn.Do(radix.Cmd(nil, "PING"))
+		conn.Close()
+		if err != nil {
+			return "", fmt.Errorf("--%s: %w", name, err)
+		}
+	}
+	return fmt.Sprintf("%d reachable", len(names)), nil
+}
+
+// validateConfigResult is the result of a single check in the
+// --validate-config report.
+type validateConfigResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// validateConfigReport is written by --validate-config, as a single JSON
+// object, so that it can be read by deploy pipelines.
+type validateConfigReport struct {
+	OK     bool                   `json:"ok"`
+	Checks []validateConfigResult `json:"checks"`
+}
+
+// runValidateConfig runs all the given checks in order, writing a report of
+// their results to w as JSON, and returns whether they all passed.
+func runValidateConfig(ctx context.Context, w io.Writer, checks []selfTestCheck) bool {
+	report := validateConfigReport{OK: true, Checks: []validateConfigResult{}}
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		res, err := check.fn(checkCtx)
+		cancel()
+
+		result := validateConfigResult{Name: check.name, OK: err == nil, Result: res}
+		if err != nil {
+			report.OK = false
+			result.Error = err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(report)
+	return report.OK
+}
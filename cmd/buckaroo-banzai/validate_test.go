@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestValidateConfigChecks(t *T) {
+	withRedis := new(bool)
+	run := func(pvs mcfg.ParamValues) map[string]validateConfigResult {
+		// a fresh component each time, so that previous runs' values aren't
+		// taken as defaults.
+		cmp := new(mcmp.Component)
+		mcfg.String(cmp, "token", mcfg.ParamRequired())
+		mcfg.String(cmp, "quiet-window", mcfg.ParamDefault("22:00-08:00"))
+		mcfg.String(cmp.Child("foo"), "timeout", mcfg.ParamDefault("5s"))
+
+		checks := validateConfigChecks(cmp, pvs, withRedis)
+		buf := new(bytes.Buffer)
+		runValidateConfig(context.Background(), buf, checks)
+		var report validateConfigReport
+		massert.Require(t, massert.Nil(json.Unmarshal(buf.Bytes(), &report)))
+		results := map[string]validateConfigResult{}
+		for _, res := range report.Checks {
+			results[res.Name] = res
+		}
+		return results
+	}
+
+	pv := func(path []string, name, value string) mcfg.ParamValue {
+		b, _ := json.Marshal(value)
+		return mcfg.ParamValue{Path: path, Name: name, Value: b}
+	}
+
+	results := run(mcfg.ParamValues{
+		pv(nil, "token", ""),
+		pv(nil, "quiet-window", "23:00-07:00"),
+		pv([]string{"foo"}, "timeout", "ten seconds"),
+	})
+	massert.Require(t,
+		massert.Equal(true, results["params"].OK),
+		massert.Equal("required params are empty: --token", results["required"].Error),
+		massert.Equal(false, results["durations"].OK),
+		massert.Equal("skipped, --validate-config-redis isn't set", results["redis"].Result),
+	)
+
+	results = run(mcfg.ParamValues{
+		pv(nil, "token", "xoxb"),
+		pv([]string{"foo"}, "timeout", "10s"),
+	})
+	massert.Require(t,
+		massert.Equal(true, results["required"].OK),
+		massert.Equal("1 durations parsed", results["durations"].Result),
+	)
+
+	// if a required param is missing then nothing else is checked.
+	results = run(nil)
+	massert.Require(t,
+		massert.Equal(false, results["params"].OK),
+		massert.Equal("skipped, params couldn't be populated", results["durations"].Error),
+	)
+}
+
+func TestRunValidateConfig(t *T) {
+	buf := new(bytes.Buffer)
+	ok := runValidateConfig(context.Background(), buf, []selfTestCheck{
+		{"a", func(context.Context) (string, error) { return "a is fine", nil }},
+		{"b", func(context.Context) (string, error) { return "", errors.New("b is broken") }},
+	})
+
+	var report validateConfigReport
+	massert.Require(t,
+		massert.Equal(false, ok),
+		massert.Nil(json.Unmarshal(buf.Bytes(), &report)),
+	)
+	massert.Require(t, massert.Equal(validateConfigReport{
+		OK: false,
+		Checks: []validateConfigResult{
+			{Name: "a", OK: true, Result: "a is fine"},
+			{Name: "b", OK: false, Error: "b is broken"},
+		},
+	}, report))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// These are set using ldflags at build time, see the Makefile.
+var (
+	gitRef    string
+	buildTime string
+)
+
+const versionPath = "/api/version"
+
+// version describes what's running. It's served on versionPath, so it must not
+// include anything sensitive.
+type version struct {
+	GitRef            string `json:"gitRef"`
+	BuildTime         string `json:"buildTime"`
+	GoVersion         string `json:"goVersion"`
+	ConfigFingerprint string `json:"configFingerprint"`
+}
+
+func orUnknown(str string) string {
+	if str == "" {
+		return "unknown"
+	}
+	return str
+}
+
+func (a *app) version() version {
+	return version{
+		GitRef:            orUnknown(gitRef),
+		BuildTime:         orUnknown(buildTime),
+		GoVersion:         runtime.Version(),
+		ConfigFingerprint: a.configFingerprint,
+	}
+}
+
+// isSecretParam returns whether the param with the given name holds a secret,
+// whose value should never be shown as-is.
+func isSecretParam(name string) bool {
+	switch name {
+	case "seed", "token", "webhook-url", "webhook-secret", "dsn":
+		return true
+	}
+	return false
+}
+
+func hashString(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+// configFingerprint returns a hash of the values of all params on the given
+// component and its children, so that it can be checked if two instances are
+// configured the same. Secrets are hashed individually before going into the
+// fingerprint.
+func configFingerprint(cmp *mcmp.Component) string {
+	params := mcfg.CollectParams(cmp)
+	lines := make([]string, 0, len(params))
+	for _, param := range params {
+		path := append(append([]string(nil), param.Component.Path()...), param.Name)
+		value := fmt.Sprint(reflect.Indirect(reflect.ValueOf(param.Into)))
+		if isSecretParam(param.Name) {
+			value = "sha256:" + hashString(value)
+		}
+		lines = append(lines, strings.Join(path, "-")+"="+value)
+	}
+	sort.Strings(lines)
+	return hashString(strings.Join(lines, "\n"))[:16]
+}
+
+func (a *app) versionHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(a.version())
+}
+
+func (a *app) cmdVersion(ctx context.Context, req commandReq) error {
+	v := a.version()
+	a.replyMsg(req, slackbot.NewMessage("I'm running `%s`", v.GitRef).Fields(
+		"Built", v.BuildTime,
+		"Go version", v.GoVersion,
+		"Config fingerprint", "`"+v.ConfigFingerprint+"`",
+	))
+	return nil
+}
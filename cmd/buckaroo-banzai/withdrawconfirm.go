@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Withdrawals asked for anywhere but a DM aren't made until the user confirms
+// them in one, so that a withdrawal can't be made by someone who copy-pastes a
+// command into a channel, or by a prankster at an unlocked laptop, without the
+// user seeing it. Until it's confirmed the withdrawal is stored under
+// unconfirmedWithdrawalMetaKey, keyed by the code which confirms it. Nothing
+// is held meanwhile, the withdrawal is checked like any other once it's
+// confirmed.
+const unconfirmedWithdrawalMetaKey = "unconfirmedWithdrawal"
+
+// unconfirmedWithdrawalTTL is how long a withdrawal waits to be confirmed
+// before it's forgotten.
+const unconfirmedWithdrawalTTL = 10 * time.Minute
+
+// unconfirmedWithdrawal is a withdrawal which is waiting to be confirmed.
+type unconfirmedWithdrawal struct {
+	AccountID string `json:"accountID"`
+	To        string `json:"to"`
+	Memo      string `json:"memo,omitempty"`
+	Currency  string `json:"currency"`
+	Amount    int    `json:"amount"`
+
+	// IdempotencyKey is of the command which asked for the withdrawal, so
+	// that the command being delivered twice only asks for confirmation
+	// once, and so that the withdrawal is only made once however many times
+	// it's confirmed.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (a *app) getUnconfirmedWithdrawal(code string) (unconfirmedWithdrawal, bool, error) {
+	str, err := a.bank.GetMeta(code, unconfirmedWithdrawalMetaKey)
+	if err != nil {
+		return unconfirmedWithdrawal{}, false, fmt.Errorf("getting unconfirmed withdrawal: %w", err)
+	} else if str == "" {
+		return unconfirmedWithdrawal{}, false, nil
+	}
+	var uw unconfirmedWithdrawal
+	if err := json.Unmarshal([]byte(str), &uw); err != nil {
+		return unconfirmedWithdrawal{}, false, fmt.Errorf("unmarshaling unconfirmed withdrawal: %w", err)
+	}
+	return uw, true, nil
+}
+
+func (a *app) setUnconfirmedWithdrawal(code string, uw unconfirmedWithdrawal) error {
+	b, err := json.Marshal(uw)
+	if err != nil {
+		return err
+	} else if err := a.bank.SetMeta(code, unconfirmedWithdrawalMetaKey, string(b)); err != nil {
+		return fmt.Errorf("storing unconfirmed withdrawal: %w", err)
+	}
+	return nil
+}
+
+// allUnconfirmedWithdrawals returns all unconfirmed withdrawals, keyed by
+// code.
+func (a *app) allUnconfirmedWithdrawals() (map[string]unconfirmedWithdrawal, error) {
+	all, err := a.bank.AllMeta(unconfirmedWithdrawalMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all unconfirmed withdrawals: %w", err)
+	}
+	uws := make(map[string]unconfirmedWithdrawal, len(all))
+	for code, str := range all {
+		var uw unconfirmedWithdrawal
+		if err := json.Unmarshal([]byte(str), &uw); err != nil {
+			return nil, fmt.Errorf("unmarshaling unconfirmed withdrawal %q: %w", code, err)
+		}
+		uws[code] = uw
+	}
+	return uws, nil
+}
+
+// requestWithdrawalConfirmation stores the withdrawal, and DMs the user who
+// asked for it the code which confirms it. Expired withdrawals are forgotten
+// while it's at it, since nothing else looks at them.
+func (a *app) requestWithdrawalConfirmation(ctx context.Context, req commandReq, addr, memo, currency string, amount int) error {
+	a.withdrawConfirmL.Lock()
+	defer a.withdrawConfirmL.Unlock()
+
+	uws, err := a.allUnconfirmedWithdrawals()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	idempotencyKey := req.idempotencyKey("withdraw")
+	for code, uw := range uws {
+		if now.After(uw.ExpiresAt) {
+			if err := a.bank.SetMeta(code, unconfirmedWithdrawalMetaKey, ""); err != nil {
+				return fmt.Errorf("removing expired unconfirmed withdrawal: %w", err)
+			}
+		} else if idempotencyKey != "" && uw.IdempotencyKey == idempotencyKey {
+			a.reply(req, "I've DM'd you to confirm this withdrawal :lock:")
+			return nil
+		}
+	}
+
+	code, err := randHex(3)
+	if err != nil {
+		return fmt.Errorf("generating withdrawal confirmation code: %w", err)
+	}
+	uw := unconfirmedWithdrawal{
+		AccountID:      req.accountID,
+		To:             addr,
+		Memo:           memo,
+		Currency:       currency,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+		ExpiresAt:      now.Add(unconfirmedWithdrawalTTL),
+	}
+	if err := a.setUnconfirmedWithdrawal(code, uw); err != nil {
+		return err
+	}
+
+	msg := slackbot.NewMessage("you asked to withdraw %s in <#%s>, confirm it here before I send it :lock:",
+		a.formatAmountIn(currency, amount, true), req.channelID).
+		Fields("To", "`"+addr+"`", "Memo", memoOrNone(memo)).
+		Context("`withdraw confirm %s` to send it. If you didn't ask for this, ignore it and it'll be forgotten in %s", code, unconfirmedWithdrawalTTL)
+	if a.slackClient != nil && a.slackClient.SigningSecret != "" {
+		msg.CommandButtons("Confirm", "withdraw confirm "+code)
+	}
+	if err := a.dm(req.user.ID, msg); err != nil {
+		if removeErr := a.bank.SetMeta(code, unconfirmedWithdrawalMetaKey, ""); removeErr != nil {
+			mlog.From(a.cmp).Error("error removing unconfirmed withdrawal which couldn't be DM'd", ctx, merr.Context(removeErr))
+		}
+		return err
+	}
+
+	mlog.From(a.cmp).Info("withdrawal waiting for confirmation", mctx.Annotate(ctx, "amount", amount, "to", addr))
+	a.reply(req, "withdrawals have to be confirmed by DM, so I've DM'd you to confirm this one :lock:")
+	return nil
+}
+
+// confirmWithdrawal makes the unconfirmed withdrawal with the given code. It
+// can only be confirmed by the user who asked for it, from a DM.
+func (a *app) confirmWithdrawal(ctx context.Context, req commandReq, code string) error {
+	if !req.channel.IsIM {
+		return inputErrorf("withdrawals can only be confirmed by DM'ing me")
+	}
+	code = strings.ToLower(code)
+
+	a.withdrawConfirmL.Lock()
+	defer a.withdrawConfirmL.Unlock()
+
+	uw, ok, err := a.getUnconfirmedWithdrawal(code)
+	if err != nil {
+		return err
+	} else if !ok || uw.AccountID != req.accountID {
+		return inputErrorf("you don't have a withdrawal `%s` to confirm, it might have already been confirmed", code)
+	}
+
+	// as with delayed withdrawals, the withdrawal is removed first so that it
+	// can only be confirmed once.
+	if err := a.bank.SetMeta(code, unconfirmedWithdrawalMetaKey, ""); err != nil {
+		return fmt.Errorf("removing unconfirmed withdrawal: %w", err)
+	} else if time.Now().After(uw.ExpiresAt) {
+		return inputErrorf("withdrawal `%s` wasn't confirmed within %s, so it's been forgotten. Ask for it again if you still want it", code, unconfirmedWithdrawalTTL)
+	}
+
+	ctx = mctx.Annotate(ctx, "currency", uw.Currency, "withdrawalCode", code)
+	if err := a.withdraw(ctx, req, uw.IdempotencyKey, uw.To, uw.Memo, uw.Currency, uw.Amount); err != nil {
+		if restoreErr := a.setUnconfirmedWithdrawal(code, uw); restoreErr != nil {
+			mlog.From(a.cmp).Error("error restoring unconfirmed withdrawal which failed", ctx, merr.Context(restoreErr))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestWithdrawalConfirmation(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	var sends []stellar.SendOpts
+	mock := &stellartest.Mock{
+		MakeSendXDRFn: func(_ context.Context, opts stellar.SendOpts) (string, error) {
+			sends = append(sends, opts)
+			return "xdr", nil
+		},
+	}
+	a := &app{
+		cmp:          cmp,
+		bank:         bank.NewInMem(),
+		slack:        fs,
+		currencyName: "BUCK",
+		exportBudget: &errorBudget{},
+	}
+	a.economy = economy.New(cmp, economy.Opts{
+		Bank:    a.bank,
+		Stellar: mock,
+		Asset:   stellar.Asset{Code: "BUCK"},
+		Timeout: time.Second,
+	})
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser("U1", "u1", "T1")
+		userB := fs.AddUser("U2", "u2", "T1")
+		dm := fs.AddChannel("D1", true)
+		public := fs.AddChannel("C1", false)
+		_, err := a.bank.Incr(userA.ID, 50)
+		massert.Require(t, massert.Nil(err))
+
+		ctx := context.Background()
+		unconfirmed := func() map[string]unconfirmedWithdrawal {
+			uws, err := a.allUnconfirmedWithdrawals()
+			massert.Require(t, massert.Nil(err))
+			return uws
+		}
+		onlyCode := func() string {
+			var code string
+			for code = range unconfirmed() {
+			}
+			return code
+		}
+		withdraw := func(channelID, messageTS string, args ...string) error {
+			channel := public
+			if channelID == dm.ID {
+				channel = dm
+			}
+			return a.cmdWithdraw(ctx, commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      userA,
+				accountID: userA.ID,
+				messageTS: messageTS,
+				args:      args,
+			})
+		}
+
+		// withdrawals from a DM go straight through.
+		massert.Require(t,
+			massert.Nil(withdraw(dm.ID, "1.0", "10", "GADDR")),
+			massert.Length(sends, 1),
+			massert.Length(unconfirmed(), 0),
+		)
+
+		// from a channel they wait to be confirmed, and a message delivered
+		// twice only asks once.
+		fs.Flush()
+		massert.Require(t,
+			massert.Nil(withdraw(public.ID, "2.0", "20", "GADDR")),
+			massert.Nil(withdraw(public.ID, "2.0", "20", "GADDR")),
+			massert.Length(sends, 1),
+			massert.Length(unconfirmed(), 1),
+			// a reply to each command, and one DM.
+			massert.Length(fs.Flush(), 3),
+		)
+		code := onlyCode()
+
+		// it can't be confirmed from the channel, or by anyone else.
+		_, isInputErr := withdraw(public.ID, "3.0", "confirm", code).(inputError)
+		massert.Require(t, massert.Equal(true, isInputErr))
+		_, isInputErr = a.cmdWithdraw(ctx, commandReq{
+			channelID: dm.ID,
+			channel:   dm,
+			user:      userB,
+			accountID: userB.ID,
+			messageTS: "4.0",
+			args:      []string{"confirm", code},
+		}).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Length(sends, 1),
+			massert.Length(unconfirmed(), 1),
+		)
+
+		// confirming it makes the withdrawal, once.
+		massert.Require(t,
+			massert.Nil(withdraw(dm.ID, "5.0", "confirm", code)),
+			massert.Length(sends, 2),
+			massert.Equal("20", sends[1].Amount),
+			massert.Length(unconfirmed(), 0),
+		)
+		_, isInputErr = withdraw(dm.ID, "6.0", "confirm", code).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Length(sends, 2),
+		)
+
+		// expired ones can't be confirmed.
+		massert.Require(t, massert.Nil(withdraw(public.ID, "7.0", "5", "GADDR")))
+		code = onlyCode()
+		uw := unconfirmed()[code]
+		uw.ExpiresAt = time.Now().Add(-time.Minute)
+		massert.Require(t, massert.Nil(a.setUnconfirmedWithdrawal(code, uw)))
+		_, isInputErr = withdraw(dm.ID, "8.0", "confirm", code).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Length(sends, 2),
+			massert.Length(unconfirmed(), 0),
+		)
+	})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Withdrawals of more than --withdraw-delay-above are delayed for
+// --withdraw-delay before they're submitted, so that a compromised slack
+// account can't drain its balance before anyone notices. While it's delayed
+// what's being withdrawn is held in the bank, see bank.Bank.Hold, and the
+// withdrawal is stored under delayedWithdrawalMetaKey, keyed by its ID.
+// Withdrawals which look suspicious, see suspiciousActivity, are stored the
+// same way, but wait for an admin to release or deny them rather than for a
+// time.
+const delayedWithdrawalMetaKey = "delayedWithdrawal"
+
+// delayedWithdrawalCheckInterval is how often delayed withdrawals are checked
+// for any which are due to be submitted.
+const delayedWithdrawalCheckInterval = time.Minute
+
+const withdrawalsUsage = "`withdrawals cancel <id>` to cancel one"
+
+const withdrawalsReviewUsage = "`withdrawals release <id>` to send one which is waiting for review, `withdrawals deny <id>` to give it back"
+
+// delayedWithdrawal is a withdrawal which is waiting to be submitted.
+type delayedWithdrawal struct {
+	AccountID string `json:"accountID"`
+	To        string `json:"to"`
+	Memo      string `json:"memo,omitempty"`
+	Currency  string `json:"currency"`
+	Amount    int    `json:"amount"`
+	HoldID    string `json:"holdID"`
+
+	// IdempotencyKey is of the command which made the withdrawal, so that the
+	// command being delivered twice doesn't delay it twice, and so that it's
+	// only ever submitted once.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Review is why the withdrawal looked suspicious, if it did. If it's set
+	// then SubmitAt is zero, and the withdrawal isn't submitted until an admin
+	// releases it.
+	Review string `json:"review,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	SubmitAt  time.Time `json:"submitAt"`
+}
+
+func (a *app) getDelayedWithdrawal(id string) (delayedWithdrawal, bool, error) {
+	str, err := a.bank.GetMeta(id, delayedWithdrawalMetaKey)
+	if err != nil {
+		return delayedWithdrawal{}, false, fmt.Errorf("getting delayed withdrawal: %w", err)
+	} else if str == "" {
+		return delayedWithdrawal{}, false, nil
+	}
+	var dw delayedWithdrawal
+	if err := json.Unmarshal([]byte(str), &dw); err != nil {
+		return delayedWithdrawal{}, false, fmt.Errorf("unmarshaling delayed withdrawal: %w", err)
+	}
+	return dw, true, nil
+}
+
+func (a *app) setDelayedWithdrawal(id string, dw delayedWithdrawal) error {
+	b, err := json.Marshal(dw)
+	if err != nil {
+		return err
+	} else if err := a.bank.SetMeta(id, delayedWithdrawalMetaKey, string(b)); err != nil {
+		return fmt.Errorf("storing delayed withdrawal: %w", err)
+	}
+	return nil
+}
+
+// allDelayedWithdrawals returns all delayed withdrawals, keyed by ID.
+func (a *app) allDelayedWithdrawals() (map[string]delayedWithdrawal, error) {
+	all, err := a.bank.AllMeta(delayedWithdrawalMetaKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting all delayed withdrawals: %w", err)
+	}
+	dws := make(map[string]delayedWithdrawal, len(all))
+	for id, str := range all {
+		var dw delayedWithdrawal
+		if err := json.Unmarshal([]byte(str), &dw); err != nil {
+			return nil, fmt.Errorf("unmarshaling delayed withdrawal %q: %w", id, err)
+		}
+		dws[id] = dw
+	}
+	return dws, nil
+}
+
+// shouldDelayWithdrawal returns whether a withdrawal of the given amount, in
+// the bank's units, needs to be delayed.
+func (a *app) shouldDelayWithdrawal(amount int) bool {
+	return a.withdrawDelayAbove > 0 && amount > a.withdrawDelayAbove*a.currency.unit()
+}
+
+// delayWithdrawal holds the withdrawal's amount, and stores it to be submitted
+// once --withdraw-delay has passed, or once an admin releases it if it's being
+// held for review. If a withdrawal with the same idempotency
+// key has already been delayed then that one is returned instead.
+func (a *app) delayWithdrawal(ctx context.Context, dw delayedWithdrawal) (string, delayedWithdrawal, error) {
+	a.withdrawDelayL.Lock()
+	defer a.withdrawDelayL.Unlock()
+
+	if dw.IdempotencyKey != "" {
+		dws, err := a.allDelayedWithdrawals()
+		if err != nil {
+			return "", delayedWithdrawal{}, err
+		}
+		for id, existing := range dws {
+			if existing.IdempotencyKey == dw.IdempotencyKey {
+				return id, existing, nil
+			}
+		}
+	}
+
+	id, err := randHex(4)
+	if err != nil {
+		return "", delayedWithdrawal{}, fmt.Errorf("generating delayed withdrawal ID: %w", err)
+	}
+	dw.CreatedAt = time.Now().UTC()
+	if dw.Review == "" {
+		dw.SubmitAt = dw.CreatedAt.Add(a.withdrawDelay)
+	}
+
+	srcAccountID := bank.CurrencyAccountID(dw.AccountID, dw.Currency)
+	if dw.HoldID, _, err = a.bank.Hold(srcAccountID, dw.Amount, 0); err != nil {
+		return "", delayedWithdrawal{}, err
+	} else if err := a.setDelayedWithdrawal(id, dw); err != nil {
+		if _, _, releaseErr := a.bank.Release(dw.HoldID); releaseErr != nil {
+			mlog.From(a.cmp).Error("error releasing delayed withdrawal which couldn't be stored", ctx, merr.Context(releaseErr))
+		}
+		return "", delayedWithdrawal{}, err
+	}
+
+	if dw.Review != "" {
+		a.audit(mctx.Annotate(ctx,
+			"delayedWithdrawalID", id,
+			"amount", dw.Amount,
+			"to", dw.To,
+			"review", dw.Review,
+		), "withdrawal held for review")
+		a.alerts.alert(ctx, alertSuspiciousActivity, nil,
+			"withdrawal `%s` of %s by <@%s> to `%s` is being held for review, because %s. %s",
+			id, a.formatAmountIn(dw.Currency, dw.Amount, true), userIDFromAccountID(dw.AccountID), dw.To,
+			dw.Review, withdrawalsReviewUsage)
+		return id, dw, nil
+	}
+
+	a.audit(mctx.Annotate(ctx,
+		"delayedWithdrawalID", id,
+		"amount", dw.Amount,
+		"to", dw.To,
+		"submitAt", dw.SubmitAt.Format(time.RFC3339),
+	), "withdrawal delayed")
+	return id, dw, nil
+}
+
+func errNotUnderReview(id string) error {
+	return inputErrorf("there isn't a withdrawal `%s` waiting for review, `withdrawals all` will show you the ones which are", id)
+}
+
+// cancelDelayedWithdrawal cancels the delayed withdrawal with the given ID,
+// giving what was being withdrawn back to its account. Only admins can cancel
+// withdrawals from accounts other than their own. If deny is given then the
+// withdrawal must be held for review, and is recorded as denied rather than
+// canceled.
+func (a *app) cancelDelayedWithdrawal(ctx context.Context, req commandReq, id string, deny bool) (delayedWithdrawal, int, error) {
+	a.withdrawDelayL.Lock()
+	defer a.withdrawDelayL.Unlock()
+
+	dw, ok, err := a.getDelayedWithdrawal(id)
+	if err != nil {
+		return delayedWithdrawal{}, 0, err
+	} else if deny && (!ok || dw.Review == "" || req.role < roleAdmin) {
+		return delayedWithdrawal{}, 0, errNotUnderReview(id)
+	} else if !ok || (dw.AccountID != req.accountID && req.role < roleAdmin) {
+		return delayedWithdrawal{}, 0, inputErrorf("you don't have a delayed withdrawal `%s`, `withdrawals` will show you the ones you do", id)
+	}
+
+	// as with gift cards, the withdrawal is removed first so that it can't be
+	// both canceled and submitted. If the hold was already released by
+	// another instance then there's nothing to give back.
+	if err := a.bank.SetMeta(id, delayedWithdrawalMetaKey, ""); err != nil {
+		return delayedWithdrawal{}, 0, fmt.Errorf("removing delayed withdrawal: %w", err)
+	}
+	_, balance, err := a.bank.Release(dw.HoldID)
+	if errors.Is(err, bank.ErrHoldNotFound) {
+		return delayedWithdrawal{}, 0, inputErrorf("delayed withdrawal `%s` has already been submitted", id)
+	} else if err != nil {
+		if restoreErr := a.setDelayedWithdrawal(id, dw); restoreErr != nil {
+			mlog.From(a.cmp).Error("error restoring delayed withdrawal which couldn't be canceled", ctx, merr.Context(restoreErr))
+		}
+		return delayedWithdrawal{}, 0, fmt.Errorf("releasing delayed withdrawal: %w", err)
+	}
+
+	action := "delayed withdrawal canceled"
+	if deny {
+		action = "withdrawal denied"
+	}
+	a.audit(mctx.Annotate(ctx,
+		"delayedWithdrawalID", id,
+		"srcAccountID", dw.AccountID,
+		"amount", dw.Amount,
+		"to", dw.To,
+	), action)
+	return dw, balance, nil
+}
+
+// releaseDelayedWithdrawal releases the withdrawal with the given ID, which
+// must be held for review, so that it's submitted the next time delayed
+// withdrawals are checked.
+func (a *app) releaseDelayedWithdrawal(ctx context.Context, id string) (delayedWithdrawal, error) {
+	a.withdrawDelayL.Lock()
+	defer a.withdrawDelayL.Unlock()
+
+	dw, ok, err := a.getDelayedWithdrawal(id)
+	if err != nil {
+		return delayedWithdrawal{}, err
+	} else if !ok || dw.Review == "" {
+		return delayedWithdrawal{}, errNotUnderReview(id)
+	}
+
+	review := dw.Review
+	dw.Review, dw.SubmitAt = "", time.Now().UTC()
+	if err := a.setDelayedWithdrawal(id, dw); err != nil {
+		return delayedWithdrawal{}, err
+	}
+
+	a.audit(mctx.Annotate(ctx,
+		"delayedWithdrawalID", id,
+		"srcAccountID", dw.AccountID,
+		"amount", dw.Amount,
+		"to", dw.To,
+		"review", review,
+	), "withdrawal released")
+	return dw, nil
+}
+
+// submitDelayedWithdrawals submits delayed withdrawals once they're due, once
+// an interval, until the context is canceled.
+func (a *app) submitDelayedWithdrawals(ctx context.Context) {
+	submit := func() {
+		if err := a.submitDelayedWithdrawalsOnce(ctx, time.Now()); err != nil {
+			mlog.From(a.cmp).Error("error submitting delayed withdrawals", ctx, merr.Context(err))
+			a.alerts.alert(ctx, alertRedisError, err, "failed to submit delayed withdrawals")
+		}
+	}
+
+	submit()
+	ticker := time.NewTicker(delayedWithdrawalCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			submit()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *app) submitDelayedWithdrawalsOnce(ctx context.Context, now time.Time) error {
+	a.withdrawDelayL.Lock()
+	defer a.withdrawDelayL.Unlock()
+
+	dws, err := a.allDelayedWithdrawals()
+	if err != nil {
+		return err
+	}
+
+	for id, dw := range dws {
+		if dw.Review != "" || now.Before(dw.SubmitAt) {
+			continue
+		}
+
+		ctx := mctx.Annotate(ctx, "delayedWithdrawalID", id, "srcAccountID", dw.AccountID, "amount", dw.Amount)
+		removeDW := func() error {
+			if err := a.bank.SetMeta(id, delayedWithdrawalMetaKey, ""); err != nil {
+				return fmt.Errorf("removing delayed withdrawal: %w", err)
+			}
+			return nil
+		}
+
+		// the withdrawal is submitted from the held funds, which are released
+		// and exported atomically, so they can't be spent in between, and
+		// only one instance can submit each withdrawal. It's only removed
+		// once it's been submitted, so that if removing it fails it's tried
+		// again, and found to be a duplicate.
+		_, err := a.economy.WithdrawHeldOnce(ctx, dw.IdempotencyKey, dw.HoldID, dw.AccountID, dw.To, dw.Memo, dw.Currency, dw.Amount)
+		if errors.Is(err, bank.ErrHoldNotFound) || errors.Is(err, bank.ErrDuplicate) {
+			// it was canceled, or already submitted.
+			if err := removeDW(); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			mlog.From(a.cmp).Warn("error submitting delayed withdrawal", ctx, merr.Context(err))
+			if _, _, releaseErr := a.bank.Release(dw.HoldID); errors.Is(releaseErr, bank.ErrHoldNotFound) {
+				if err := removeDW(); err != nil {
+					return err
+				}
+				continue
+			} else if releaseErr != nil {
+				return fmt.Errorf("releasing delayed withdrawal which couldn't be submitted: %w", releaseErr)
+			} else if err := removeDW(); err != nil {
+				return err
+			}
+
+			msg := slackbot.NewMessage("your withdrawal of %s to `%s` couldn't be submitted :warning: so it's back in your balance",
+				a.formatAmountIn(dw.Currency, dw.Amount, true), dw.To).
+				Context("%s", a.userErrMsg(err, roleUser))
+			if err := a.notifyOnce(userIDFromAccountID(dw.AccountID), "delayed-withdrawal-failed:"+id, msg); err != nil {
+				mlog.From(a.cmp).Warn("error notifying user of failed delayed withdrawal", ctx, merr.Context(err))
+			}
+			continue
+		} else if err := removeDW(); err != nil {
+			return err
+		}
+		mlog.From(a.cmp).Info("delayed withdrawal submitted", ctx)
+	}
+	return nil
+}
+
+// cmdWithdrawDelayed delays a withdrawal, or holds it for review if review is
+// given, see delayWithdrawal.
+func (a *app) cmdWithdrawDelayed(ctx context.Context, req commandReq, idempotencyKey, addr, memo, currency string, amount int, review string) error {
+	id, dw, err := a.delayWithdrawal(ctx, delayedWithdrawal{
+		AccountID:      req.accountID,
+		To:             addr,
+		Memo:           memo,
+		Currency:       currency,
+		Amount:         amount,
+		Review:         review,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	// why the withdrawal looks suspicious isn't told to the user, so that it
+	// can't be used to work around the checks.
+	if dw.Review != "" {
+		a.replyMsg(req, slackbot.NewMessage("your withdrawal of %s needs to be looked at by an admin before I send it :mag: I'll DM you once they have",
+			a.formatAmountIn(currency, amount, true)).
+			Fields("To", "`"+addr+"`", "Memo", memoOrNone(memo)).
+			Context("If you didn't mean to withdraw this, `withdrawals cancel %s` will cancel it and give it back", id))
+		return nil
+	}
+
+	var loc *time.Location
+	if loc = a.userLocation(req.user.ID); loc == nil {
+		loc = time.UTC
+	}
+	msg := slackbot.NewMessage("your withdrawal of %s is over %s, so I'm holding on to it until %s before sending it :hourglass_flowing_sand:",
+		a.formatAmountIn(currency, amount, true),
+		a.formatAmountIn(currency, a.withdrawDelayAbove*a.currency.unit(), false),
+		dw.SubmitAt.In(loc).Format("Mon Jan 2 15:04 MST")).
+		Fields("To", "`"+addr+"`", "Memo", memoOrNone(memo)).
+		Context("If you didn't mean to withdraw this, `withdrawals cancel %s` will cancel it and give it back", id)
+	a.replyMsg(req, msg)
+	return nil
+}
+
+// cmdWithdrawals lists the user's delayed withdrawals, or everyone's for admins
+// who ask for `all` of them, and cancels them. Admins can also release or deny
+// those which are held for review.
+func (a *app) cmdWithdrawals(ctx context.Context, req commandReq) error {
+	var subCmd string
+	if len(req.args) > 0 {
+		subCmd = strings.ToLower(req.args[0])
+	}
+
+	switch subCmd {
+	case "cancel", "deny":
+		deny := subCmd == "deny"
+		if len(req.args) < 2 {
+			usage := withdrawalsUsage
+			if deny {
+				usage = withdrawalsReviewUsage
+			}
+			a.reply(req, "usage: %s", usage)
+			return nil
+		}
+		id := req.args[1]
+		dw, balance, err := a.cancelDelayedWithdrawal(ctx, req, id, deny)
+		if err != nil {
+			return err
+		}
+
+		desc := a.formatAmountIn(dw.Currency, dw.Amount, true)
+		if dw.AccountID == req.accountID && !deny {
+			a.replyMsg(req, slackbot.NewMessage("I've canceled your withdrawal of %s, it's back in your balance", desc).
+				Context("Your balance is now %s", a.formatAmountIn(dw.Currency, balance, true)))
+			return nil
+		}
+
+		verb := "canceled"
+		if deny {
+			verb = "denied"
+		}
+		userID := userIDFromAccountID(dw.AccountID)
+		a.reply(req, "I've %s <@%s>'s withdrawal of %s, it's back in their balance", verb, userID, desc)
+		msg := slackbot.NewMessage("an admin %s your withdrawal of %s to `%s`, so it's back in your balance", verb, desc, dw.To).
+			Mention(req.user.ID)
+		if err := a.notifyOnce(userID, "delayed-withdrawal-"+verb+":"+id, msg); err != nil {
+			mlog.From(a.cmp).Warn("error notifying user of "+verb+" withdrawal", ctx, merr.Context(err))
+		}
+		return nil
+
+	case "release":
+		if req.role < roleAdmin {
+			return inputErrorf("only admins can release withdrawals")
+		} else if len(req.args) < 2 {
+			a.reply(req, "usage: %s", withdrawalsReviewUsage)
+			return nil
+		}
+		id := req.args[1]
+		dw, err := a.releaseDelayedWithdrawal(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		desc := a.formatAmountIn(dw.Currency, dw.Amount, true)
+		userID := userIDFromAccountID(dw.AccountID)
+		a.reply(req, "I've released <@%s>'s withdrawal of %s, it'll be sent within %s", userID, desc, delayedWithdrawalCheckInterval)
+		msg := slackbot.NewMessage("an admin has looked at your withdrawal of %s to `%s`, and it's on its way :money_with_wings:", desc, dw.To).
+			Mention(req.user.ID).
+			Context("You'll get a DM when the transaction has been successfully submitted to the network")
+		if err := a.notifyOnce(userID, "delayed-withdrawal-released:"+id, msg); err != nil {
+			mlog.From(a.cmp).Warn("error notifying user of released withdrawal", ctx, merr.Context(err))
+		}
+		return nil
+	}
+
+	all := subCmd == "all" && req.role >= roleAdmin
+	dws, err := a.allDelayedWithdrawals()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(dws))
+	for id, dw := range dws {
+		if all || dw.AccountID == req.accountID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		a.reply(req, "there aren't any withdrawals waiting to be sent")
+		return nil
+	}
+
+	// those held for review have no SubmitAt, so they come first.
+	sort.Slice(ids, func(i, j int) bool {
+		return dws[ids[i]].SubmitAt.Before(dws[ids[j]].SubmitAt)
+	})
+
+	var loc *time.Location
+	if loc = a.userLocation(req.user.ID); loc == nil {
+		loc = time.UTC
+	}
+	strb := new(strings.Builder)
+	for _, id := range ids {
+		dw := dws[id]
+		fmt.Fprintf(strb, "`%s`: %s to `%s`", id, a.formatAmountIn(dw.Currency, dw.Amount, true), dw.To)
+		if all {
+			fmt.Fprintf(strb, " from <@%s>", userIDFromAccountID(dw.AccountID))
+		}
+		switch {
+		case dw.Review != "" && all:
+			fmt.Fprintf(strb, ", waiting for review because %s\n", dw.Review)
+		case dw.Review != "":
+			fmt.Fprintf(strb, ", waiting for an admin to look at it\n")
+		default:
+			fmt.Fprintf(strb, ", sending %s\n", dw.SubmitAt.In(loc).Format("Mon Jan 2 15:04 MST"))
+		}
+	}
+	usage := withdrawalsUsage
+	if all {
+		usage += ", " + withdrawalsReviewUsage
+	}
+	a.replyMsg(req, slackbot.NewMessage("%s", strb.String()).Context("%s", usage))
+	return nil
+}
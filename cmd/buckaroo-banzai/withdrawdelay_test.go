@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/internal/economy"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestDelayedWithdrawals(t *T) {
+	cmp := mtest.Component()
+	fs := slackbottest.New()
+	var sends []stellar.SendOpts
+	var sendErr error
+	mock := &stellartest.Mock{
+		MakeSendXDRFn: func(_ context.Context, opts stellar.SendOpts) (string, error) {
+			if sendErr != nil {
+				return "", sendErr
+			}
+			sends = append(sends, opts)
+			return "xdr", nil
+		},
+	}
+	a := &app{
+		cmp:                cmp,
+		bank:               bank.NewInMem(),
+		slack:              fs,
+		currencyName:       "BUCK",
+		exportBudget:       &errorBudget{},
+		withdrawDelayAbove: 10,
+		withdrawDelay:      time.Hour,
+	}
+	a.economy = economy.New(cmp, economy.Opts{
+		Bank:    a.bank,
+		Stellar: mock,
+		Asset:   stellar.Asset{Code: "BUCK"},
+		Timeout: time.Second,
+	})
+
+	mtest.Run(cmp, t, func() {
+		userA := fs.AddUser("U1", "u1", "T1")
+		userB := fs.AddUser("U2", "u2", "T1")
+		channel := fs.AddChannel("D1", true)
+		_, err := a.bank.Incr(userA.ID, 50)
+		massert.Require(t, massert.Nil(err))
+
+		ctx := context.Background()
+		balanceOf := func(accountID string) int {
+			balance, err := a.bank.Balance(accountID)
+			massert.Require(t, massert.Nil(err))
+			return balance
+		}
+		withdraw := func(messageTS, amount string) {
+			err := a.cmdWithdraw(ctx, commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      userA,
+				accountID: userA.ID,
+				messageTS: messageTS,
+				args:      []string{amount, "GADDR"},
+			})
+			massert.Require(t, massert.Nil(err))
+		}
+		delayed := func() map[string]delayedWithdrawal {
+			dws, err := a.allDelayedWithdrawals()
+			massert.Require(t, massert.Nil(err))
+			return dws
+		}
+
+		// small withdrawals go straight through, large ones are held, and a
+		// message delivered twice is only held once.
+		withdraw("1.0", "10")
+		withdraw("2.0", "20")
+		withdraw("2.0", "20")
+		massert.Require(t,
+			massert.Length(sends, 1),
+			massert.Length(delayed(), 1),
+			massert.Equal(20, balanceOf(userA.ID)),
+			massert.Equal(20, balanceOf(bank.HoldsAccountID)),
+		)
+
+		massert.Require(t,
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now())),
+			massert.Length(sends, 1),
+		)
+		massert.Require(t,
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now().Add(2*time.Hour))),
+			massert.Length(sends, 2),
+			massert.Equal("20", sends[1].Amount),
+			massert.Length(delayed(), 0),
+			massert.Equal(20, balanceOf(userA.ID)),
+			massert.Equal(0, balanceOf(bank.HoldsAccountID)),
+		)
+
+		// only the user who made a withdrawal, or an admin, can cancel it.
+		withdraw("3.0", "15")
+		var id string
+		for id = range delayed() {
+			break
+		}
+		fs.Flush()
+
+		cancel := func(user *slack.User, r role) error {
+			return a.cmdWithdrawals(ctx, commandReq{
+				channelID: channel.ID,
+				channel:   channel,
+				user:      user,
+				accountID: user.ID,
+				role:      r,
+				args:      []string{"cancel", id},
+			})
+		}
+		_, isInputErr := cancel(userB, roleUser).(inputError)
+		massert.Require(t,
+			massert.Equal(true, isInputErr),
+			massert.Length(delayed(), 1),
+		)
+		massert.Require(t,
+			massert.Nil(cancel(userB, roleAdmin)),
+			massert.Length(delayed(), 0),
+			massert.Equal(20, balanceOf(userA.ID)),
+			massert.Length(fs.Flush(), 2),
+		)
+		massert.Require(t,
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now().Add(2*time.Hour))),
+			massert.Length(sends, 2),
+		)
+
+		// a withdrawal whose hold was already released, by another instance
+		// canceling it, is only removed, and nothing is exported.
+		withdraw("4.0", "15")
+		for id = range delayed() {
+			break
+		}
+		_, _, err = a.bank.Release(delayed()[id].HoldID)
+		massert.Require(t, massert.Nil(err))
+		massert.Require(t,
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now().Add(2*time.Hour))),
+			massert.Length(delayed(), 0),
+			massert.Equal(20, balanceOf(userA.ID)),
+		)
+
+		// one which can't be submitted is given back, and the user told.
+		withdraw("5.0", "15")
+		fs.Flush()
+		sendErr = errors.New("horizon is down")
+		massert.Require(t,
+			massert.Nil(a.submitDelayedWithdrawalsOnce(ctx, time.Now().Add(2*time.Hour))),
+			massert.Length(delayed(), 0),
+			massert.Equal(20, balanceOf(userA.ID)),
+			massert.Equal(0, balanceOf(bank.HoldsAccountID)),
+			massert.Length(fs.Flush(), 1),
+		)
+	})
+}
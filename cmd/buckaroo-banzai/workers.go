@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// shardedWorkers runs a fixed number of worker goroutines, each with its own
+// bounded queue of jobs. Jobs are sharded across the workers by a key, so that
+// all jobs with the same key (e.g. a user ID) are run one at a time and in the
+// order they were submitted.
+type shardedWorkers struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+// newShardedWorkers starts n workers, each of which can have up to queueSize
+// jobs waiting for it. stop must be called once the workers are no longer
+// needed.
+func newShardedWorkers(n, queueSize int) *shardedWorkers {
+	sw := &shardedWorkers{queues: make([]chan func(), n)}
+	for i := range sw.queues {
+		sw.queues[i] = make(chan func(), queueSize)
+		sw.wg.Add(1)
+		go func(queue chan func()) {
+			defer sw.wg.Done()
+			for fn := range queue {
+				fn()
+			}
+		}(sw.queues[i])
+	}
+	return sw
+}
+
+func (sw *shardedWorkers) queue(key string) chan func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return sw.queues[h.Sum32()%uint32(len(sw.queues))]
+}
+
+// submit queues the job for the worker responsible for the given key, blocking
+// until there's room in its queue or the context is canceled. Returns false if
+// the context was canceled.
+func (sw *shardedWorkers) submit(ctx context.Context, key string, fn func()) bool {
+	select {
+	case sw.queue(key) <- fn:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// trySubmit is like submit, but returns false immediately if the worker's queue
+// is full.
+func (sw *shardedWorkers) trySubmit(key string, fn func()) bool {
+	select {
+	case sw.queue(key) <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop waits for all queued jobs to be run, and then stops the workers. No jobs
+// may be submitted once stop has been called.
+func (sw *shardedWorkers) stop() {
+	for _, queue := range sw.queues {
+		close(queue)
+	}
+	sw.wg.Wait()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestShardedWorkers(t *T) {
+	workers := newShardedWorkers(3, 0)
+
+	var l sync.Mutex
+	got := map[string][]int{}
+	for i := 0; i < 20; i++ {
+		i := i
+		key := []string{"a", "b", "c", "d"}[i%4]
+		workers.submit(context.Background(), key, func() {
+			l.Lock()
+			defer l.Unlock()
+			got[key] = append(got[key], i)
+		})
+	}
+	workers.stop()
+
+	massert.Require(t,
+		massert.Equal([]int{0, 4, 8, 12, 16}, got["a"]),
+		massert.Equal([]int{1, 5, 9, 13, 17}, got["b"]),
+		massert.Equal([]int{2, 6, 10, 14, 18}, got["c"]),
+		massert.Equal([]int{3, 7, 11, 15, 19}, got["d"]),
+	)
+}
+
+func TestShardedWorkersTrySubmit(t *T) {
+	workers := newShardedWorkers(1, 1)
+	defer workers.stop()
+
+	// block the only worker, so that its queue fills up.
+	unblock := make(chan struct{})
+	running := make(chan struct{})
+	workers.trySubmit("a", func() {
+		close(running)
+		<-unblock
+	})
+	<-running
+
+	massert.Require(t,
+		massert.Equal(true, workers.trySubmit("a", func() {})),
+		massert.Equal(false, workers.trySubmit("b", func() {})),
+	)
+	close(unblock)
+}
@@ -89,11 +89,9 @@ func cmdFund(cmp *mcmp.Component) {
 		mcfg.ParamUsage("Addr to fund"))
 	mrun.InitHook(cmp, func(ctx context.Context) error {
 		ctx = mctx.Annotate(ctx, "addr", *addr)
-		mlog.From(cmp).Info("funding account", ctx)
-		res, err := client.Fund(*addr)
+		res, err := client.Fund(ctx, *addr)
 		if err != nil {
-			return fmt.Errorf("error funding account %q: %w",
-				*addr, stellar.HorizonErr(err))
+			return fmt.Errorf("error funding account %q: %w", *addr, err)
 		}
 		jsonDump(res)
 		return nil
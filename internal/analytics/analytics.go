@@ -0,0 +1,299 @@
+// Package analytics mirrors buckaroo's ledger and audit events to an external
+// sink, for long-term analytics and retention beyond what's kept in redis.
+// Events are queued in memory and written to the sink in batches. If the sink
+// falls behind then the queue fills up, at which point recording an event
+// blocks for a while, and the event is dropped if it's still full after that.
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// Kinds of Event.
+const (
+	KindIncr     = "incr"
+	KindTransfer = "transfer"
+	KindExport   = "export"
+	KindAudit    = "audit"
+)
+
+// Event is something which happened, which is mirrored to the sink. Fields
+// which don't apply to the Kind are left empty.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// For incr events UserID's balance changed by Amount. For transfer events
+	// Amount was transferred from SrcUserID to UserID. For export events
+	// UserID submitted an export of Amount using Protocol.
+	UserID    string `json:"userID,omitempty"`
+	SrcUserID string `json:"srcUserID,omitempty"`
+	Amount    int    `json:"amount,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+
+	// For audit events Action is what was done, and Fields describe it.
+	Action string            `json:"action,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// Sink is somewhere which Events are written to. Write is given events in the
+// order they were recorded, and if it returns an error then it will be called
+// again with the same events.
+type Sink interface {
+	Write(ctx context.Context, events []Event) error
+}
+
+// WebhookSink POSTs each batch of events to a URL, as a JSON array.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Write implements the method for the Sink interface.
+func (s WebhookSink) Write(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("posting events: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("posting events: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// FileSink appends events to JSONL files in a directory, one file per day
+// (UTC), named like "events-2006-01-02.jsonl". Files are synced after each
+// batch. Shipping the files elsewhere, e.g. to S3, is left up to the operator.
+type FileSink struct {
+	Dir string
+}
+
+// Write implements the method for the Sink interface.
+func (s FileSink) Write(ctx context.Context, events []Event) error {
+	// events are split by the day they happened on, rather than the day
+	// they're written, so a batch can span two files.
+	for len(events) > 0 {
+		day := events[0].Time.UTC().Format("2006-01-02")
+		n := 1
+		for n < len(events) && events[n].Time.UTC().Format("2006-01-02") == day {
+			n++
+		}
+		if err := s.writeFile("events-"+day+".jsonl", events[:n]); err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+func (s FileSink) writeFile(name string, events []Event) error {
+	path := filepath.Join(s.Dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return fmt.Errorf("writing to %q: %w", path, err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing to %q: %w", path, err)
+	} else if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %q: %w", path, err)
+	}
+	return nil
+}
+
+// Opts are the dependencies and configuration of an Exporter.
+type Opts struct {
+	Sink Sink
+
+	// BatchSize is the most events written to the sink at once, and
+	// FlushInterval is the longest an event waits to be written.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// QueueSize is how many events can be waiting to be written. Once it's
+	// full recording an event blocks for up to BlockTimeout before dropping
+	// it.
+	QueueSize    int
+	BlockTimeout time.Duration
+
+	// RetryBackoff is how long to wait before retrying a batch which failed
+	// to be written. Each retry waits twice as long as the last, up to a
+	// minute.
+	RetryBackoff time.Duration
+}
+
+// Exporter queues events and writes them to a Sink in batches. Run must be
+// called for anything to be written.
+//
+// All methods are no-ops on a nil Exporter.
+type Exporter struct {
+	cmp     *mcmp.Component
+	opts    Opts
+	ch      chan Event
+	dropped int64
+}
+
+// New returns an Exporter using the given Opts.
+func New(cmp *mcmp.Component, opts Opts) *Exporter {
+	return &Exporter{
+		cmp:  cmp,
+		opts: opts,
+		ch:   make(chan Event, opts.QueueSize),
+	}
+}
+
+// Record queues the event to be written to the sink. If Time isn't set it's
+// set to now.
+func (e *Exporter) Record(event Event) {
+	if e == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+
+	select {
+	case e.ch <- event:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(e.opts.BlockTimeout)
+	defer timer.Stop()
+	select {
+	case e.ch <- event:
+	case <-timer.C:
+		if n := atomic.AddInt64(&e.dropped, 1); n == 1 || n%1000 == 0 {
+			mlog.From(e.cmp).Warn("analytics queue is full, dropping events",
+				mctx.Annotate(e.cmp.Context(), "kind", event.Kind, "totalDropped", n))
+		}
+	}
+}
+
+// Dropped returns how many events have been dropped because the queue was
+// full.
+func (e *Exporter) Dropped() int64 {
+	if e == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Run writes queued events to the sink until the context is canceled. It then
+// makes one last attempt at writing whatever is left in the queue before
+// returning.
+func (e *Exporter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, e.opts.BatchSize)
+	for {
+		select {
+		case event := <-e.ch:
+			if batch = append(batch, event); len(batch) < e.opts.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-ctx.Done():
+			e.drain(batch)
+			return
+		}
+
+		if !e.write(ctx, batch) {
+			e.drain(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// write writes the batch to the sink, retrying until it succeeds, or returns
+// false if the context is canceled first.
+func (e *Exporter) write(ctx context.Context, batch []Event) bool {
+	backoff := e.opts.RetryBackoff
+	for {
+		err := e.opts.Sink.Write(ctx, batch)
+		if err == nil {
+			return true
+		}
+		mlog.From(e.cmp).Warn("error writing analytics events, will retry",
+			mctx.Annotate(ctx, "numEvents", len(batch), "retryIn", backoff.String()),
+			merr.Context(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// drain makes one attempt at writing the batch, along with everything left in
+// the queue, using a fresh context since the one given to Run has been
+// canceled.
+func (e *Exporter) drain(batch []Event) {
+loop:
+	for {
+		select {
+		case event := <-e.ch:
+			batch = append(batch, event)
+		default:
+			break loop
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = mctx.Annotate(ctx, "numEvents", len(batch))
+	mlog.From(e.cmp).Info("writing remaining analytics events", ctx)
+	if err := e.opts.Sink.Write(ctx, batch); err != nil {
+		mlog.From(e.cmp).Error("error writing remaining analytics events, they are lost", ctx, merr.Context(err))
+	}
+}
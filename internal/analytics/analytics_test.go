@@ -0,0 +1,134 @@
+package analytics_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/internal/analytics"
+)
+
+// testSink records the batches written to it, failing the first failN writes.
+type testSink struct {
+	l       sync.Mutex
+	failN   int
+	batches [][]analytics.Event
+}
+
+func (s *testSink) Write(_ context.Context, events []analytics.Event) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.failN > 0 {
+		s.failN--
+		return errors.New("failed")
+	}
+	s.batches = append(s.batches, append([]analytics.Event(nil), events...))
+	return nil
+}
+
+func (s *testSink) userIDs() []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	var userIDs []string
+	for _, batch := range s.batches {
+		for _, event := range batch {
+			userIDs = append(userIDs, event.UserID)
+		}
+	}
+	return userIDs
+}
+
+func TestExporter(t *T) {
+	sink := &testSink{failN: 1}
+	e := analytics.New(mtest.Component(), analytics.Opts{
+		Sink:          sink,
+		BatchSize:     2,
+		FlushInterval: 50 * time.Millisecond,
+		QueueSize:     10,
+		BlockTimeout:  time.Millisecond,
+		RetryBackoff:  time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	// the first batch fails once and is retried, the third event is written by
+	// the flush interval.
+	for _, userID := range []string{"U1", "U2", "U3"} {
+		e.Record(analytics.Event{Kind: analytics.KindIncr, UserID: userID, Amount: 1})
+	}
+	time.Sleep(100 * time.Millisecond)
+	massert.Require(t,
+		massert.Equal([]string{"U1", "U2", "U3"}, sink.userIDs()),
+		massert.Length(sink.batches, 2),
+	)
+
+	// whatever is left is written when Run is stopped.
+	e.Record(analytics.Event{Kind: analytics.KindIncr, UserID: "U4", Amount: 1})
+	cancel()
+	<-done
+	massert.Require(t,
+		massert.Equal([]string{"U1", "U2", "U3", "U4"}, sink.userIDs()),
+		massert.Equal(int64(0), e.Dropped()),
+	)
+
+	// once the queue is full events are dropped.
+	full := analytics.New(mtest.Component(), analytics.Opts{QueueSize: 1, BlockTimeout: time.Millisecond})
+	full.Record(analytics.Event{Kind: analytics.KindIncr})
+	full.Record(analytics.Event{Kind: analytics.KindIncr})
+	massert.Require(t, massert.Equal(int64(1), full.Dropped()))
+}
+
+func TestFileSink(t *T) {
+	dir, err := ioutil.TempDir("", "analytics")
+	massert.Require(t, massert.Nil(err))
+	defer os.RemoveAll(dir)
+
+	day1 := time.Date(2020, 1, 6, 23, 59, 0, 0, time.UTC)
+	day2 := day1.Add(time.Hour)
+	sink := analytics.FileSink{Dir: dir}
+	massert.Require(t, massert.Nil(sink.Write(context.Background(), []analytics.Event{
+		{Time: day1, Kind: analytics.KindIncr, UserID: "U1", Amount: 1},
+		{Time: day2, Kind: analytics.KindAudit, Action: "did a thing"},
+	})))
+	massert.Require(t, massert.Nil(sink.Write(context.Background(), []analytics.Event{
+		{Time: day2, Kind: analytics.KindTransfer, UserID: "U1", SrcUserID: "U2", Amount: 2},
+	})))
+
+	read := func(name string) []analytics.Event {
+		f, err := os.Open(filepath.Join(dir, name))
+		massert.Require(t, massert.Nil(err))
+		defer f.Close()
+		var events []analytics.Event
+		for s := bufio.NewScanner(f); s.Scan(); {
+			var event analytics.Event
+			massert.Require(t, massert.Nil(json.Unmarshal(s.Bytes(), &event)))
+			events = append(events, event)
+		}
+		return events
+	}
+
+	massert.Require(t,
+		massert.Equal([]analytics.Event{
+			{Time: day1, Kind: analytics.KindIncr, UserID: "U1", Amount: 1},
+		}, read("events-2020-01-06.jsonl")),
+		massert.Equal([]analytics.Event{
+			{Time: day2, Kind: analytics.KindAudit, Action: "did a thing"},
+			{Time: day2, Kind: analytics.KindTransfer, UserID: "U1", SrcUserID: "U2", Amount: 2},
+		}, read("events-2020-01-07.jsonl")),
+	)
+}
@@ -0,0 +1,338 @@
+package economy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/protocols/horizon/base"
+	"github.com/stellar/go/protocols/horizon/operations"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/stellar"
+)
+
+// Reasons a deposit might be rejected because of something the sender did.
+// The reason given in a DepositRejectedError will wrap one of these, unless
+// something else went wrong.
+var (
+	ErrDepositAsset      = errors.New("not in the currency or an accepted deposit asset")
+	ErrDepositRecipient  = errors.New("doesn't belong to anyone")
+	ErrDepositFractional = errors.New("not worth a whole amount of the currency's smallest unit")
+	ErrDepositTooSmall   = errors.New("worth less than the currency's smallest unit")
+)
+
+// AssetKey returns the string which identifies the given asset in
+// DepositRates, either "XLM" or "CODE:ISSUER".
+func AssetKey(asset base.Asset) string {
+	if asset.Type == "native" {
+		return "XLM"
+	}
+	return asset.Code + ":" + asset.Issuer
+}
+
+func assetFromKey(key string) txnbuild.Asset {
+	if key == "XLM" {
+		return txnbuild.NativeAsset{}
+	}
+	parts := strings.SplitN(key, ":", 2)
+	return txnbuild.CreditAsset{Code: parts[0], Issuer: parts[1]}
+}
+
+// ParseDepositRates parses a string of the form "XLM=10,USD:<issuer>=2" into a
+// map of asset key to the amount of currency one unit of the asset is worth.
+func ParseDepositRates(str string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, rateStr := range strings.Split(str, ",") {
+		if rateStr = strings.TrimSpace(rateStr); rateStr == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rateStr, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed deposit rate %q", rateStr)
+		}
+
+		key := strings.ToUpper(parts[0])
+		if key != "XLM" && !strings.Contains(key, ":") {
+			return nil, fmt.Errorf("deposit rate asset %q must be XLM or CODE:ISSUER", parts[0])
+		} else if i := strings.Index(key, ":"); i >= 0 {
+			// issuers are case sensitive, so use the original
+			key = key[:i] + parts[0][i:]
+		}
+
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing rate of deposit rate %q: %w", rateStr, err)
+		} else if rate <= 0 {
+			return nil, fmt.Errorf("rate of deposit rate %q must be greater than zero", rateStr)
+		}
+		rates[key] = rate
+	}
+	return rates, nil
+}
+
+// IsCurrency returns whether the given asset is the currency.
+func (e *Economy) IsCurrency(asset base.Asset) bool {
+	return asset.Type != "native" && asset.Code == e.opts.Asset.Code && asset.Issuer == e.opts.Asset.Issuer
+}
+
+// currencyOf returns which of the economy's currencies the given asset is,
+// either bank.DefaultCurrency or one of Currencies, or false if it's none of
+// them.
+func (e *Economy) currencyOf(asset base.Asset) (string, bool) {
+	if e.IsCurrency(asset) {
+		return bank.DefaultCurrency, true
+	} else if asset.Type == "native" || asset.Issuer != e.opts.Asset.Issuer {
+		return "", false
+	}
+	for _, currency := range e.opts.Currencies {
+		if asset.Code == currency {
+			return currency, true
+		}
+	}
+	return "", false
+}
+
+// Deposit describes a payment which was made into buckaroo's account.
+type Deposit struct {
+	// From is the account which made the payment, and Memo is the memo of the
+	// transaction it was made in.
+	From, Memo string
+
+	// Currency is which of the economy's currencies the payment was credited
+	// (or burned) in, see bank.CurrencyAccountID. Payments of other assets are
+	// credited in bank.DefaultCurrency.
+	Currency string
+
+	// Burned is true if the payment was made with the burn memo, in which case
+	// it's been burned rather than credited to anyone, see bank.Bank.Burn, and
+	// only Amount and Duplicate of the following fields are set.
+	Burned bool
+
+	// FeeTopUp is true if the payment was XLM sent from FeeFundingAddress, in
+	// which case it isn't credited to anyone, and none of the following fields
+	// are set.
+	FeeTopUp bool
+
+	// AccountID is the account the deposit was credited to, Amount is how
+	// much it was credited with, and Balance is the account's balance once it
+	// was.
+	AccountID string
+	Amount    int
+	Balance   int
+
+	// Duplicate is true if the payment had already been credited, or burned,
+	// e.g. because it was processed again after a restart, in which case it
+	// isn't credited again.
+	Duplicate bool
+
+	// ConvertedFrom is set if the payment wasn't made in the currency, and
+	// describes what it was made in, e.g. "1.5 XLM".
+	ConvertedFrom string
+}
+
+// DepositRejectedError is returned from ImportDeposit when a payment couldn't
+// be credited to anyone.
+type DepositRejectedError struct {
+	// Reason is why the payment couldn't be credited.
+	Reason error
+
+	// Refunded is true if the payment was sent back to where it came from.
+	// If refunding was attempted but failed then RefundErr is set.
+	Refunded  bool
+	RefundErr error
+}
+
+func (e *DepositRejectedError) Error() string {
+	if e.RefundErr != nil {
+		return e.RefundErr.Error()
+	}
+	return e.Reason.Error()
+}
+
+func (e *DepositRejectedError) Unwrap() error {
+	return e.Reason
+}
+
+// ImportDeposit credits a payment which was made into buckaroo's account to
+// the account which its memo belongs to. If it can't be credited then a
+// *DepositRejectedError is returned, and the payment is refunded if possible.
+func (e *Economy) ImportDeposit(ctx context.Context, payment operations.Payment) (Deposit, error) {
+	if e.opts.FeeFundingAddress != "" && payment.From == e.opts.FeeFundingAddress && payment.Asset.Type == "native" {
+		mlog.From(e.cmp).Info("fee top-up received", mctx.Annotate(ctx, "amount", payment.Amount))
+		return Deposit{From: payment.From, FeeTopUp: true}, nil
+	}
+
+	txHash := payment.GetTransactionHash()
+	tx, err := e.opts.Stellar.TransactionDetail(txHash)
+	if err != nil {
+		return Deposit{}, fmt.Errorf("failed to retrieve tx detail for %q: %w",
+			txHash, stellar.HorizonErr(err))
+	}
+
+	d := Deposit{From: tx.Account, Memo: tx.Memo}
+	ctx = mctx.Annotate(ctx, "memo", tx.Memo)
+	var isCurrency bool
+	d.Currency, isCurrency = e.currencyOf(payment.Asset)
+	if isCurrency && e.opts.BurnMemo != "" && tx.Memo == e.opts.BurnMemo {
+		// sending the currency back to its issuer already burns it on-chain,
+		// so there's nothing to credit, it only needs to be journaled.
+		mlog.From(e.cmp).Info("burn deposit received", ctx)
+		d.Burned = true
+		if err := e.journalBurn(ctx, &d, "deposit:"+payment.ID, payment.Amount); err != nil {
+			return Deposit{}, err
+		}
+		return d, nil
+	}
+
+	if d.AccountID, d.Amount, err = e.resolveDeposit(payment, tx.Memo); err != nil {
+		return Deposit{}, e.rejectDeposit(ctx, payment, err)
+	}
+	if !isCurrency {
+		d.ConvertedFrom = payment.Amount + " " + AssetKey(payment.Asset)
+	}
+
+	dstAccountID := bank.CurrencyAccountID(d.AccountID, d.Currency)
+	ctx = mctx.Annotate(ctx, "dstAccountID", dstAccountID, "amount", d.Amount)
+	mlog.From(e.cmp).Info("incrementing user's account", ctx)
+	d.Balance, err = e.opts.Bank.IncrOnce("deposit:"+payment.ID, dstAccountID, d.Amount, bank.JournalSourceDeposit)
+	if errors.Is(err, bank.ErrDuplicate) {
+		mlog.From(e.cmp).Warn("deposit was already credited", ctx)
+		d.Duplicate = true
+		if d.Balance, err = e.opts.Bank.Balance(dstAccountID); err != nil {
+			return Deposit{}, fmt.Errorf("could not get balance of account %q: %w", dstAccountID, err)
+		}
+	} else if err != nil {
+		return Deposit{}, fmt.Errorf("could not increment account %q by %d: %w",
+			dstAccountID, d.Amount, err)
+	}
+	return d, nil
+}
+
+// journalBurn records the burn of the given amount of the deposit's currency in
+// the bank, once for the idempotency key.
+func (e *Economy) journalBurn(ctx context.Context, d *Deposit, idempotencyKey, amountStr string) error {
+	amount, err := bank.ParseDecimal(amountStr, e.opts.Decimals)
+	if errors.Is(err, bank.ErrTooPrecise) {
+		// the bank can't hold an amount this small, so it can't have
+		// exported it either.
+		mlog.From(e.cmp).Warn("burned amount is too precise to journal", ctx)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not parse burned amount %q: %w", amountStr, err)
+	}
+
+	d.Amount = amount
+	err = e.opts.Bank.Burn(idempotencyKey, d.Currency, amount)
+	if errors.Is(err, bank.ErrDuplicate) {
+		mlog.From(e.cmp).Warn("burn was already journaled", ctx)
+		d.Duplicate = true
+	} else if err != nil {
+		return fmt.Errorf("could not journal burn of %d: %w", amount, err)
+	}
+	return nil
+}
+
+// resolveDeposit determines which account an incoming payment is destined for
+// and how much currency it should be credited with.
+func (e *Economy) resolveDeposit(payment operations.Payment, memo string) (string, int, error) {
+	rate := 1.0
+	_, isCurrency := e.currencyOf(payment.Asset)
+	if !isCurrency {
+		var ok bool
+		if rate, ok = e.opts.DepositRates[AssetKey(payment.Asset)]; !ok {
+			return "", 0, fmt.Errorf("payment %+v is %w", payment, ErrDepositAsset)
+		}
+	}
+
+	accountID, ok, err := e.opts.AccountIDByMemo(memo)
+	if err != nil {
+		return "", 0, err
+	} else if !ok && e.opts.AccountIDByAddress != nil {
+		if accountID, ok, err = e.opts.AccountIDByAddress(payment.From); err != nil {
+			return "", 0, err
+		}
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("memo %q %w", memo, ErrDepositRecipient)
+	}
+
+	credit, err := e.depositCredit(payment.Amount, rate, isCurrency)
+	if err != nil {
+		return "", 0, err
+	} else if credit < 1 {
+		return "", 0, fmt.Errorf("payment amount %q is %w", payment.Amount, ErrDepositTooSmall)
+	}
+	return accountID, credit, nil
+}
+
+// depositCredit returns how much a payment of the given amount, at the given
+// rate, should be credited with, in the bank's units. Payments of the
+// currencies themselves are credited exactly.
+func (e *Economy) depositCredit(amountStr string, rate float64, isCurrency bool) (int, error) {
+	if isCurrency {
+		credit, err := bank.ParseDecimal(amountStr, e.opts.Decimals)
+		if errors.Is(err, bank.ErrTooPrecise) {
+			return 0, fmt.Errorf("payment amount %q is %w", amountStr, ErrDepositFractional)
+		} else if err != nil {
+			return 0, fmt.Errorf("could not parse payment amount %q: %w", amountStr, err)
+		}
+		return credit, nil
+	}
+
+	amount, err := strconv.ParseFloat(amountStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse payment amount %q: %w", amountStr, err)
+	}
+
+	// stellar amounts have 7 decimal places, anything beyond what that
+	// allows is float noise from the conversion.
+	credit := amount * rate * float64(bank.Unit(e.opts.Decimals))
+	if math.Abs(credit-math.Round(credit)) > 1e-9*math.Max(1, credit) {
+		return 0, fmt.Errorf("payment amount %q is %w", amountStr, ErrDepositFractional)
+	}
+	return int(math.Round(credit)), nil
+}
+
+// rejectDeposit is called when a deposit can't be credited for the given
+// reason. The deposit is refunded if possible.
+func (e *Economy) rejectDeposit(ctx context.Context, payment operations.Payment, reason error) error {
+	rejErr := &DepositRejectedError{Reason: reason}
+	if _, ok := e.currencyOf(payment.Asset); !e.opts.RefundDeposits || ok {
+		// the currencies themselves are never refunded, since they're always
+		// worth something to the bank.
+		return rejErr
+	}
+
+	ctx = mctx.Annotate(ctx, "refundTo", payment.From, "refundAmount", payment.Amount)
+	mlog.From(e.cmp).Warn("refunding deposit", ctx, merr.Context(reason))
+
+	op := &txnbuild.Payment{
+		Destination: payment.From,
+		Amount:      payment.Amount,
+		Asset:       assetFromKey(AssetKey(payment.Asset)),
+	}
+	txXDR, err := e.opts.Stellar.MakeOpsXDR(ctx, e.opts.KeyPair, "refund", op)
+	if err != nil {
+		rejErr.RefundErr = fmt.Errorf("making refund tx for deposit which failed with %q: %w", reason, err)
+		return rejErr
+	}
+	res, err := e.opts.Stellar.SubmitTransactionXDR(ctx, txXDR)
+	if err != nil {
+		rejErr.RefundErr = fmt.Errorf("submitting refund tx for deposit which failed with %q: %w", reason, err)
+		return rejErr
+	}
+
+	mlog.From(e.cmp).Info("deposit refunded",
+		mctx.Annotate(ctx, "stellarTXLink", res.Links.Transaction.Href))
+	rejErr.Refunded = true
+	return rejErr
+}
@@ -0,0 +1,369 @@
+// Package economy implements the flows by which buckaroo's currency moves
+// around: earning it, giving it to others, withdrawing it to stellar, and
+// depositing it back from stellar. It knows nothing about chat, so that any
+// frontend (slack, an API, etc...) can share the same implementation. Telling
+// users about what happened is left up to the caller.
+package economy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/keypair"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/stellar"
+)
+
+// ExportProtocolStellar is the protocol of Exports which are withdrawals to
+// stellar. Their Payload is a StellarPayload.
+const ExportProtocolStellar = "stellar"
+
+// StellarPayload is the Payload of a withdrawal to stellar.
+type StellarPayload struct {
+	// To is the stellar (or federation) address the withdrawal is to, and
+	// Memo is the memo it was made with, if any. Amount is in the bank's units
+	// of the currency, see Opts.Decimals.
+	To, Memo string
+	Amount   int
+
+	// TxXDR is the signed transaction which carries out the withdrawal.
+	TxXDR string
+}
+
+// ExportProtocol implements the method for bank.ExportPayload.
+func (StellarPayload) ExportProtocol() string {
+	return ExportProtocolStellar
+}
+
+func init() {
+	bank.RegisterExportProtocol(ExportProtocolStellar, bank.ExportProtocol{
+		Unmarshal: func(b []byte) (bank.ExportPayload, error) {
+			var p StellarPayload
+			err := json.Unmarshal(b, &p)
+			return p, err
+		},
+
+		// exports used to only have the tx XDR.
+		UnmarshalLegacy: func(txXDR string) (bank.ExportPayload, error) {
+			return StellarPayload{TxXDR: txXDR}, nil
+		},
+	})
+}
+
+// ErrGiveToSelf is returned from Give when the source and destination accounts
+// are the same, and from GiveMulti when the source is one of the destinations.
+var ErrGiveToSelf = errors.New("can't give to yourself")
+
+// ErrUnknownCurrency is returned when a currency is given which isn't one of
+// the economy's currencies.
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// Opts are the dependencies and configuration of an Economy.
+type Opts struct {
+	Bank    bank.ExportingBank
+	Stellar stellar.API
+
+	// KeyPair is of the account which holds the currency on-chain, which
+	// withdrawals are sent from and deposits are received into.
+	KeyPair *keypair.Full
+
+	// Asset is the currency on-chain.
+	Asset stellar.Asset
+
+	// Decimals is how many decimal places the currencies have, at most
+	// bank.MaxDecimals. Amounts in the bank are in units of the smallest of
+	// them, see bank.Unit. Zero means amounts are always whole.
+	Decimals int
+
+	// Currencies are the codes of any other currencies, e.g. seasonal tokens,
+	// which are issued on-chain by Asset's issuer alongside it. Balances in
+	// them are held in their own accounts, see bank.CurrencyAccountID.
+	Currencies []string
+
+	// Timeout is applied to calls to horizon.
+	Timeout time.Duration
+
+	// DepositRates are other assets which are accepted as deposits, keyed by
+	// AssetKey, along with how much currency one unit of each is worth.
+	DepositRates map[string]float64
+
+	// RefundDeposits causes deposits of assets other than the currency, which
+	// can't be credited to anyone, to be sent back to where they came from.
+	RefundDeposits bool
+
+	// BurnMemo, if set, causes deposits of the currency with this memo to be
+	// burned rather than credited to anyone.
+	BurnMemo string
+
+	// FeeFundingAddress, if set, is an account which sends XLM to KeyPair's
+	// account to pay for its fees. XLM sent from it isn't a deposit, and
+	// isn't credited to anyone or refunded.
+	FeeFundingAddress string
+
+	// AccountIDByMemo returns the ID of the account which a deposit with the
+	// given memo should be credited to, or false if there isn't one.
+	AccountIDByMemo func(memo string) (string, bool, error)
+
+	// AccountIDByAddress is optional, and returns the ID of the account which
+	// a deposit sent from the given stellar address should be credited to, or
+	// false if there isn't one. It's only used for deposits whose memo doesn't
+	// belong to anyone, e.g. because the sender's wallet set the memo itself.
+	AccountIDByAddress func(addr string) (string, bool, error)
+}
+
+// Economy implements the flows of the currency. It's safe to use
+// concurrently.
+type Economy struct {
+	cmp  *mcmp.Component
+	opts Opts
+}
+
+// New returns an Economy which logs to the given component.
+func New(cmp *mcmp.Component, opts Opts) *Economy {
+	return &Economy{cmp: cmp, opts: opts}
+}
+
+// asset returns the on-chain asset of the given currency, which must be
+// bank.DefaultCurrency or one of Currencies, or false if it's neither.
+func (e *Economy) asset(currency string) (stellar.Asset, bool) {
+	if currency == bank.DefaultCurrency {
+		return e.opts.Asset, true
+	}
+	for _, c := range e.opts.Currencies {
+		if c == currency {
+			return stellar.Asset{Code: currency, Issuer: e.opts.Asset.Issuer}, true
+		}
+	}
+	return stellar.Asset{}, false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Earn submits the Earn to the bank's journal, to be applied by ApplyEarn.
+// Earns which are duplicates, or which have hit their cap, are dropped.
+func (e *Economy) Earn(ctx context.Context, earn bank.Earn) error {
+	ctx = earn.Annotate(ctx)
+	if _, err := e.opts.Bank.SubmitEarn(earn); errors.Is(err, bank.ErrDuplicateEarn) {
+		mlog.From(e.cmp).Debug("ignoring duplicate earn", ctx)
+	} else if errors.Is(err, bank.ErrEarnCapped) {
+		mlog.From(e.cmp).Debug("earn is capped", ctx)
+	} else if err != nil {
+		return fmt.Errorf("submitting earn: %w", err)
+	}
+	return nil
+}
+
+// ApplyEarn applies an Earn which was read off the bank's journal to the
+// user's balance. An Earn is only applied once, even if it's read off the
+// journal again, e.g. because acking it failed.
+func (e *Economy) ApplyEarn(ctx context.Context, earn bank.EarnInProgress) error {
+	ctx = earn.Annotate(ctx)
+	if earn.Amount > 0 {
+		mlog.From(e.cmp).Info("incrementing user's balance", ctx)
+	} else {
+		mlog.From(e.cmp).Info("decrementing user's balance", ctx)
+	}
+
+	// it's possible for the user to not have enough funds to decrement, for
+	// example if they received a reaction, gave the earned buck to someone
+	// else, then the reaction was removed. How far below zero that can take
+	// them is up to the bank's overdraft and negative balance policy, past
+	// which the decrement is dropped.
+	_, err := e.opts.Bank.IncrOnce("earn:"+earn.ID, earn.UserID, earn.Amount, bank.JournalSourceEarn)
+	if errors.Is(err, bank.ErrNotEnoughFunds) {
+		mlog.From(e.cmp).Warn("user doesn't have enough to decrement their balance by, dropping it", ctx)
+	} else if errors.Is(err, bank.ErrDuplicate) {
+		mlog.From(e.cmp).Warn("earn has already been applied", ctx)
+	} else if err != nil {
+		if nackErr := earn.Nack(); nackErr != nil {
+			mlog.From(e.cmp).Error("error nacking earn", ctx, merr.Context(nackErr))
+		}
+		return fmt.Errorf("error applying earn to user's balance: %w", err)
+	}
+
+	if err := earn.Ack(); err != nil {
+		return fmt.Errorf("error acking EarnInProgress: %w", err)
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Give transfers the amount of the given currency from one account to another,
+// returning the destination's new balance in it. The reason, which may be
+// empty, is recorded along with the give, see bank.JournalEntry.Reason.
+func (e *Economy) Give(ctx context.Context, fromAccountID, toAccountID, currency string, amount int, reason string) (int, error) {
+	return e.GiveOnce(ctx, "", fromAccountID, toAccountID, currency, amount, reason)
+}
+
+// GiveOnce is like Give, but the give is only done once for the idempotency
+// key, see bank.Bank.IncrOnce.
+func (e *Economy) GiveOnce(ctx context.Context, idempotencyKey, fromAccountID, toAccountID, currency string, amount int, reason string) (int, error) {
+	if fromAccountID == toAccountID {
+		return 0, ErrGiveToSelf
+	} else if _, ok := e.asset(currency); !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+
+	fromAccountID = bank.CurrencyAccountID(fromAccountID, currency)
+	toAccountID = bank.CurrencyAccountID(toAccountID, currency)
+	ctx = mctx.Annotate(ctx, "srcAccountID", fromAccountID, "dstAccountID", toAccountID, "amount", amount)
+	mlog.From(e.cmp).Info("giving bucks", ctx)
+	dstBalance, _, err := e.opts.Bank.TransferOnce(idempotencyKey, toAccountID, fromAccountID, amount, bank.JournalSourceGive, reason)
+	return dstBalance, err
+}
+
+// GiveMulti gives the amount of the given currency from one account to each of
+// the others, returning their new balances in it keyed by the given account
+// IDs. Either every account is given the amount or, e.g. if the source can't
+// afford all of them, none are. The reason is recorded as with Give.
+func (e *Economy) GiveMulti(ctx context.Context, fromAccountID string, toAccountIDs []string, currency string, amount int, reason string) (map[string]int, error) {
+	return e.GiveMultiOnce(ctx, "", fromAccountID, toAccountIDs, currency, amount, reason)
+}
+
+// GiveMultiOnce is like GiveMulti, but the gives are only done once for the
+// idempotency key, see bank.Bank.IncrOnce.
+func (e *Economy) GiveMultiOnce(ctx context.Context, idempotencyKey, fromAccountID string, toAccountIDs []string, currency string, amount int, reason string) (map[string]int, error) {
+	if _, ok := e.asset(currency); !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+
+	dsts := make(map[string]int, len(toAccountIDs))
+	for _, toAccountID := range toAccountIDs {
+		if toAccountID == fromAccountID {
+			return nil, ErrGiveToSelf
+		}
+		dsts[bank.CurrencyAccountID(toAccountID, currency)] = amount
+	}
+
+	fromAccountID = bank.CurrencyAccountID(fromAccountID, currency)
+	ctx = mctx.Annotate(ctx, "srcAccountID", fromAccountID, "numDsts", len(dsts), "amount", amount)
+	mlog.From(e.cmp).Info("giving bucks to multiple accounts", ctx)
+	newBalances, _, err := e.opts.Bank.TransferMultiOnce(idempotencyKey, fromAccountID, dsts, bank.JournalSourceGive, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	dstBalances := make(map[string]int, len(toAccountIDs))
+	for _, toAccountID := range toAccountIDs {
+		dstBalances[toAccountID] = newBalances[bank.CurrencyAccountID(toAccountID, currency)]
+	}
+	return dstBalances, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Withdraw takes the amount of the given currency out of the account and queues
+// it to be sent to the given stellar (or federation) address, returning the ID
+// of the Export. The Export is sent by ProcessExport.
+func (e *Economy) Withdraw(ctx context.Context, fromAccountID, to, memo, currency string, amount int) (string, error) {
+	return e.WithdrawOnce(ctx, "", fromAccountID, to, memo, currency, amount)
+}
+
+// WithdrawOnce is like Withdraw, but the Export is only submitted once for the
+// idempotency key, see bank.Export.IdempotencyKey.
+func (e *Economy) WithdrawOnce(ctx context.Context, idempotencyKey, fromAccountID, to, memo, currency string, amount int) (string, error) {
+	return e.withdraw(ctx, idempotencyKey, "", fromAccountID, to, memo, currency, amount)
+}
+
+// WithdrawHeldOnce is like WithdrawOnce, but what's withdrawn is the hold with
+// the given ID, which must be of the amount of the currency from the account.
+// The hold is released and the Export submitted atomically, so the held funds
+// can't be spent in between, see bank.Export.HoldID. bank.ErrHoldNotFound is
+// returned if the hold has already been captured or released.
+func (e *Economy) WithdrawHeldOnce(ctx context.Context, idempotencyKey, holdID, fromAccountID, to, memo, currency string, amount int) (string, error) {
+	return e.withdraw(ctx, idempotencyKey, holdID, fromAccountID, to, memo, currency, amount)
+}
+
+func (e *Economy) withdraw(ctx context.Context, idempotencyKey, holdID, fromAccountID, to, memo, currency string, amount int) (string, error) {
+	asset, ok := e.asset(currency)
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+
+	fromAccountID = bank.CurrencyAccountID(fromAccountID, currency)
+	ctx = mctx.Annotate(ctx, "srcAccountID", fromAccountID, "to", to, "memo", memo, "amount", amount)
+
+	// constructing the XDR costs horizon calls, so don't bother if the
+	// export's going to be refused anyway. Held funds aren't in the balance
+	// until the export is submitted, so there's nothing to check for them.
+	if holdID == "" {
+		if err := e.opts.Bank.CanExport(bank.Export{FromUserID: fromAccountID, Amount: amount}); err != nil {
+			return "", err
+		}
+	}
+
+	mlog.From(e.cmp).Info("constructing send XDR", ctx)
+	stellarCtx, cancel := context.WithTimeout(ctx, e.opts.Timeout)
+	defer cancel()
+	txXDR, err := e.opts.Stellar.MakeSendXDR(stellarCtx, stellar.SendOpts{
+		From:        e.opts.KeyPair,
+		To:          to,
+		Memo:        memo,
+		AssetCode:   asset.Code,
+		AssetIssuer: asset.Issuer,
+		Amount:      bank.FormatDecimal(amount, e.opts.Decimals),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	mlog.From(e.cmp).Info("submitting XDR to the bank", ctx)
+	txID, err := e.opts.Bank.SubmitExport(bank.Export{
+		FromUserID: fromAccountID,
+		Amount:     amount,
+		Payload: StellarPayload{
+			To:     to,
+			Memo:   memo,
+			Amount: amount,
+			TxXDR:  txXDR,
+		},
+		IdempotencyKey: idempotencyKey,
+		HoldID:         holdID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	mlog.From(e.cmp).Info("XDR successfully submitted", mctx.Annotate(ctx, "txID", txID))
+	return txID, nil
+}
+
+// ProcessExport submits an Export which was read off the bank to stellar, and
+// acks it if that succeeds. It returns the result of the submitted
+// transaction.
+func (e *Economy) ProcessExport(ctx context.Context, export bank.ExportInProgress) (stellar.TransactionResult, error) {
+	ctx = export.Annotate(ctx)
+	payload, ok := export.Payload.(StellarPayload)
+	if !ok {
+		return stellar.TransactionResult{}, fmt.Errorf("unknown export protocol %q", export.Protocol())
+	}
+
+	mlog.From(e.cmp).Info("submitting stellar tx", ctx)
+	stellarCtx, cancel := context.WithTimeout(ctx, e.opts.Timeout)
+	defer cancel()
+	res, err := e.opts.Stellar.SubmitTransactionXDR(stellarCtx, payload.TxXDR)
+	if err != nil {
+		return stellar.TransactionResult{}, fmt.Errorf("could not submit ExportInProgress tx XDR %q: %w",
+			payload.TxXDR, err)
+	}
+
+	ctx = mctx.Annotate(ctx, "stellarTXLink", res.Links.Transaction.Href)
+	mlog.From(e.cmp).Info("stellar tx successfully submitted", ctx)
+
+	if err := export.Ack(); err != nil {
+		// the caller shouldn't tell the user about the tx if this fails, it'll
+		// just cause them to potentially get a duplicate message when the
+		// export is retried later.
+		return stellar.TransactionResult{}, fmt.Errorf("error acking ExportInProgress: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,389 @@
+package economy
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/base"
+	"github.com/stellar/go/protocols/horizon/operations"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/bank"
+	"buckaroo-banzai/stellar"
+	"buckaroo-banzai/stellar/stellartest"
+)
+
+func TestApplyEarn(t *T) {
+	cmp := mtest.Component()
+	e := New(cmp, Opts{Bank: bank.NewInMem()})
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+		var acks int
+		earn := bank.EarnInProgress{
+			ID:   mrand.Hex(8),
+			Earn: bank.Earn{EventID: mrand.Hex(8), UserID: mrand.Hex(8), Amount: 2},
+			Ack:  func() error { acks++; return nil },
+			Nack: func() error { return errors.New("unexpected nack") },
+		}
+
+		// an earn which is read off the journal again, e.g. because the
+		// process died before acking it, is acked without being reapplied.
+		massert.Require(t, massert.Nil(e.ApplyEarn(ctx, earn)))
+		massert.Require(t, massert.Nil(e.ApplyEarn(ctx, earn)))
+		balance, err := e.opts.Bank.Balance(earn.UserID)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(2, balance),
+			massert.Equal(2, acks),
+		)
+	})
+}
+
+func TestGive(t *T) {
+	cmp := mtest.Component()
+	e := New(cmp, Opts{Bank: bank.NewInMem(), Currencies: []string{"SEASON"}})
+
+	mtest.Run(cmp, t, func() {
+		userA, userB := mrand.Hex(8), mrand.Hex(8)
+		_, err := e.opts.Bank.Incr(userA, 3)
+		massert.Require(t, massert.Nil(err))
+
+		dstBalance, err := e.Give(context.Background(), userA, userB, bank.DefaultCurrency, 2, "for lunch")
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(2, dstBalance),
+		)
+		history, _, err := e.opts.Bank.History(userB, "", 1)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Length(history, 1),
+			massert.Equal(bank.JournalSourceGive, history[0].Source),
+			massert.Equal("for lunch", history[0].Reason),
+		)
+
+		_, err = e.Give(context.Background(), userA, userB, bank.DefaultCurrency, 2, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, bank.ErrNotEnoughFunds)))
+
+		_, err = e.Give(context.Background(), userA, userA, bank.DefaultCurrency, 1, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrGiveToSelf)))
+
+		// other currencies are given out of their own accounts.
+		_, err = e.Give(context.Background(), userA, userB, "SEASON", 1, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, bank.ErrNotEnoughFunds)))
+		_, err = e.opts.Bank.Incr(bank.CurrencyAccountID(userA, "SEASON"), 1)
+		massert.Require(t, massert.Nil(err))
+		dstBalance, err = e.Give(context.Background(), userA, userB, "SEASON", 1, "")
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(1, dstBalance),
+		)
+
+		_, err = e.Give(context.Background(), userA, userB, "NOPE", 1, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrUnknownCurrency)))
+	})
+}
+
+func TestGiveMulti(t *T) {
+	cmp := mtest.Component()
+	e := New(cmp, Opts{Bank: bank.NewInMem()})
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+		userA, userB, userC := mrand.Hex(8), mrand.Hex(8), mrand.Hex(8)
+		_, err := e.opts.Bank.Incr(userA, 5)
+		massert.Require(t, massert.Nil(err))
+
+		// nobody is given anything if not everybody can be.
+		_, err = e.GiveMulti(ctx, userA, []string{userB, userC}, bank.DefaultCurrency, 3, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, bank.ErrNotEnoughFunds)))
+		balance, err := e.opts.Bank.Balance(userB)
+		massert.Require(t, massert.Nil(err), massert.Equal(0, balance))
+
+		dstBalances, err := e.GiveMultiOnce(ctx, "msg1", userA, []string{userB, userC}, bank.DefaultCurrency, 2, "")
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(map[string]int{userB: 2, userC: 2}, dstBalances),
+		)
+		_, err = e.GiveMultiOnce(ctx, "msg1", userA, []string{userB, userC}, bank.DefaultCurrency, 2, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, bank.ErrDuplicate)))
+		balance, err = e.opts.Bank.Balance(userA)
+		massert.Require(t, massert.Nil(err), massert.Equal(1, balance))
+
+		_, err = e.GiveMulti(ctx, userA, []string{userB, userA}, bank.DefaultCurrency, 1, "")
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrGiveToSelf)))
+
+		// each give counts towards the generous leaderboard.
+		totals, err := e.opts.Bank.TopGivers(time.Now(), 1)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal([]bank.GiveTotal{{UserID: userA, Amount: 4, NumGives: 2}}, totals),
+		)
+	})
+}
+
+func TestImportDeposit(t *T) {
+	cmp := mtest.Component()
+	issuer := "G" + mrand.Hex(8)
+	memos := map[string]string{}
+	mock := &stellartest.Mock{
+		TransactionDetailFn: func(txHash string) (horizon.Transaction, error) {
+			return horizon.Transaction{Account: "GSENDER", Memo: memos[txHash]}, nil
+		},
+		MakeOpsXDRFn: func(context.Context, *keypair.Full, string, ...txnbuild.Operation) (string, error) {
+			return "refund", nil
+		},
+		SubmitTransactionXDRFn: func(context.Context, string) (stellar.TransactionResult, error) {
+			return stellar.TransactionResult{}, nil
+		},
+	}
+	e := New(cmp, Opts{
+		Bank:              bank.NewInMem(),
+		Stellar:           mock,
+		Asset:             stellar.Asset{Code: "BUCK", Issuer: issuer},
+		Currencies:        []string{"SEASON"},
+		Timeout:           time.Second,
+		DepositRates:      map[string]float64{"XLM": 2},
+		RefundDeposits:    true,
+		BurnMemo:          "!burn",
+		FeeFundingAddress: "GFUNDING",
+		AccountIDByMemo: func(memo string) (string, bool, error) {
+			if memo == "nobody" {
+				return "", false, nil
+			}
+			return "acct-" + memo, true, nil
+		},
+	})
+
+	currency := base.Asset{Type: "credit_alphanum4", Code: "BUCK", Issuer: issuer}
+	native := base.Asset{Type: "native"}
+	payment := func(memo string, asset base.Asset, amount string) operations.Payment {
+		var p operations.Payment
+		p.ID = mrand.Hex(8)
+		p.TransactionHash = mrand.Hex(8)
+		p.Asset = asset
+		p.Amount = amount
+		p.From = "GSENDER"
+		memos[p.TransactionHash] = memo
+		return p
+	}
+
+	mtest.Run(cmp, t, func() {
+		userA := mrand.Hex(8)
+		ctx := context.Background()
+
+		first := payment(userA, currency, "3.0000000")
+		d, err := e.ImportDeposit(ctx, first)
+		balance, _ := e.opts.Bank.Balance("acct-" + userA)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(Deposit{From: "GSENDER", Memo: userA, AccountID: "acct-" + userA, Amount: 3, Balance: 3}, d),
+			massert.Equal(3, balance),
+		)
+
+		// a payment which is processed again isn't credited again.
+		d, err = e.ImportDeposit(ctx, first)
+		balance, _ = e.opts.Bank.Balance("acct-" + userA)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(Deposit{From: "GSENDER", Memo: userA, AccountID: "acct-" + userA, Amount: 3, Balance: 3, Duplicate: true}, d),
+			massert.Equal(3, balance),
+		)
+
+		d, err = e.ImportDeposit(ctx, payment(userA, native, "1.5"))
+		balance, _ = e.opts.Bank.Balance("acct-" + userA)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(3, d.Amount),
+			massert.Equal("1.5 XLM", d.ConvertedFrom),
+			massert.Equal(6, balance),
+		)
+
+		// other currencies are credited to their own accounts, and are never
+		// converted.
+		season := base.Asset{Type: "credit_alphanum12", Code: "SEASON", Issuer: issuer}
+		d, err = e.ImportDeposit(ctx, payment(userA, season, "2"))
+		balance, _ = e.opts.Bank.Balance(bank.CurrencyAccountID("acct-"+userA, "SEASON"))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(Deposit{From: "GSENDER", Memo: userA, Currency: "SEASON", AccountID: "acct-" + userA, Amount: 2, Balance: 2}, d),
+			massert.Equal(2, balance),
+		)
+
+		// burns are journaled, once.
+		burn := payment("!burn", currency, "5")
+		d, err = e.ImportDeposit(ctx, burn)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(Deposit{From: "GSENDER", Memo: "!burn", Burned: true, Amount: 5}, d),
+		)
+		d, err = e.ImportDeposit(ctx, burn)
+		totals, _ := bank.TotalSupply(e.opts.Bank, bank.DefaultCurrency)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(true, d.Duplicate),
+			massert.Equal(5, totals.Burned),
+		)
+
+		// XLM from the fee funding account isn't a deposit, whatever its memo.
+		topUp := payment(userA, native, "10")
+		topUp.From = "GFUNDING"
+		d, err = e.ImportDeposit(ctx, topUp)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(Deposit{From: "GFUNDING", FeeTopUp: true}, d),
+		)
+
+		// the currency is never refunded
+		var rejErr *DepositRejectedError
+		_, err = e.ImportDeposit(ctx, payment("nobody", currency, "1"))
+		massert.Require(t,
+			massert.Equal(true, errors.As(err, &rejErr)),
+			massert.Equal(true, errors.Is(err, ErrDepositRecipient)),
+			massert.Equal(false, rejErr.Refunded),
+		)
+
+		_, err = e.ImportDeposit(ctx, payment(userA, native, "0.25"))
+		massert.Require(t,
+			massert.Equal(true, errors.As(err, &rejErr)),
+			massert.Equal(true, errors.Is(err, ErrDepositFractional)),
+			massert.Equal(true, rejErr.Refunded),
+		)
+
+		_, err = e.ImportDeposit(ctx, payment(userA, base.Asset{Type: "credit_alphanum4", Code: "USD", Issuer: "GUSD"}, "1"))
+		massert.Require(t,
+			massert.Equal(true, errors.Is(err, ErrDepositAsset)),
+			massert.Equal([]string{"refund", "refund"}, mock.Submitted()),
+		)
+	})
+}
+
+func TestImportDepositByAddress(t *T) {
+	cmp := mtest.Component()
+	issuer := "G" + mrand.Hex(8)
+	userA := mrand.Hex(8)
+	mock := &stellartest.Mock{
+		TransactionDetailFn: func(txHash string) (horizon.Transaction, error) {
+			return horizon.Transaction{Account: "GSENDER", Memo: txHash}, nil
+		},
+	}
+	e := New(cmp, Opts{
+		Bank:    bank.NewInMem(),
+		Stellar: mock,
+		Asset:   stellar.Asset{Code: "BUCK", Issuer: issuer},
+		AccountIDByMemo: func(memo string) (string, bool, error) {
+			if memo == "" {
+				return "", false, nil
+			}
+			return "acct-" + memo, true, nil
+		},
+		AccountIDByAddress: func(addr string) (string, bool, error) {
+			if addr != "GLINKED" {
+				return "", false, nil
+			}
+			return "acct-" + userA, true, nil
+		},
+	})
+
+	payment := func(memo, from string) operations.Payment {
+		var p operations.Payment
+		p.ID = mrand.Hex(8)
+		p.TransactionHash = memo
+		p.Asset = base.Asset{Type: "credit_alphanum4", Code: "BUCK", Issuer: issuer}
+		p.Amount = "1"
+		p.From = from
+		return p
+	}
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+
+		// the memo takes precedence
+		d, err := e.ImportDeposit(ctx, payment("other", "GLINKED"))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal("acct-other", d.AccountID),
+		)
+
+		d, err = e.ImportDeposit(ctx, payment("", "GLINKED"))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal("acct-"+userA, d.AccountID),
+		)
+
+		_, err = e.ImportDeposit(ctx, payment("", "GUNLINKED"))
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrDepositRecipient)))
+	})
+}
+
+func TestDecimals(t *T) {
+	cmp := mtest.Component()
+	issuer := "G" + mrand.Hex(8)
+	var sent []string
+	mock := &stellartest.Mock{
+		TransactionDetailFn: func(txHash string) (horizon.Transaction, error) {
+			return horizon.Transaction{Account: "GSENDER", Memo: "user"}, nil
+		},
+		MakeSendXDRFn: func(_ context.Context, opts stellar.SendOpts) (string, error) {
+			sent = append(sent, opts.Amount)
+			return "send", nil
+		},
+	}
+	e := New(cmp, Opts{
+		Bank:         bank.NewInMem(),
+		Stellar:      mock,
+		Asset:        stellar.Asset{Code: "BUCK", Issuer: issuer},
+		Timeout:      time.Second,
+		Decimals:     2,
+		DepositRates: map[string]float64{"XLM": 2},
+		AccountIDByMemo: func(memo string) (string, bool, error) {
+			return "acct-" + memo, true, nil
+		},
+	})
+
+	payment := func(asset base.Asset, amount string) operations.Payment {
+		var p operations.Payment
+		p.ID = mrand.Hex(8)
+		p.TransactionHash = mrand.Hex(8)
+		p.Asset = asset
+		p.Amount = amount
+		return p
+	}
+	currency := base.Asset{Type: "credit_alphanum4", Code: "BUCK", Issuer: issuer}
+	native := base.Asset{Type: "native"}
+
+	mtest.Run(cmp, t, func() {
+		ctx := context.Background()
+
+		d, err := e.ImportDeposit(ctx, payment(currency, "1.2500000"))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(125, d.Amount),
+		)
+
+		d, err = e.ImportDeposit(ctx, payment(native, "0.125"))
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(25, d.Amount),
+			massert.Equal(150, d.Balance),
+		)
+
+		_, err = e.ImportDeposit(ctx, payment(currency, "0.001"))
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrDepositFractional)))
+		_, err = e.ImportDeposit(ctx, payment(native, "0.001"))
+		massert.Require(t, massert.Equal(true, errors.Is(err, ErrDepositFractional)))
+
+		_, err = e.Withdraw(ctx, "acct-user", "GDEST", "", bank.DefaultCurrency, 105)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal([]string{"1.05"}, sent),
+		)
+	})
+}
@@ -0,0 +1,177 @@
+package slackbot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/nlopes/slack"
+)
+
+// Command is a message which was directed at the bot, either by @'ing it or by
+// DM'ing it.
+type Command struct {
+	Channel *slack.Channel
+	User    *slack.User
+
+	// Name is the first whitespace separated field of the message, lowercased,
+	// and Args are the rest. Name is empty if the message was only an @ of the
+	// bot.
+	Name string
+	Args []string
+
+	// Timestamp is the slack timestamp of the message the command was sent in,
+	// which together with the channel uniquely identifies it.
+	Timestamp string
+}
+
+// Reaction is an emoji reaction which was added to or removed from an item
+// (e.g. a message). A removed reaction event has the same fields as an added
+// one, so both are described using ReactionAddedEvent.
+type Reaction struct {
+	// Type is either "reaction_added" or "reaction_removed".
+	Type string
+	slack.ReactionAddedEvent
+
+	// Delta is 1 if the reaction was added and -1 if it was removed.
+	Delta int
+}
+
+// CommandHandler handles a Command. Errors are logged by the Bot, so the
+// handler should tell the user about them itself if it wants to.
+type CommandHandler func(context.Context, Command) error
+
+// ReactionHandler handles a Reaction.
+type ReactionHandler func(context.Context, Reaction)
+
+// UserHandler handles a user joining the team or changing their profile.
+type UserHandler func(context.Context, slack.User)
+
+// Bot turns incoming slack events into Commands and Reactions, and passes them
+// to its handlers.
+type Bot struct {
+	cmp    *mcmp.Component
+	api    API
+	userID string
+
+	// OnCommand and OnReaction are called for each Command and Reaction
+	// respectively. Either may be nil, in which case those events are
+	// ignored.
+	OnCommand  CommandHandler
+	OnReaction ReactionHandler
+
+	// OnUser is called with the user whenever a user joins the team or
+	// changes their profile, including when they're deactivated. It may be
+	// nil, in which case those events are ignored.
+	OnUser UserHandler
+
+	// Ghost causes all messages to be ignored, so that only reactions and
+	// user changes are handled.
+	Ghost bool
+
+	// SigningSecret is the secret which slack signs its interactivity
+	// requests with. See ServeInteraction.
+	SigningSecret string
+}
+
+// NewBot returns a Bot which will use the given API to look up the channels and
+// users which events come from. userID is the ID of the bot's own user.
+func NewBot(cmp *mcmp.Component, api API, userID string) *Bot {
+	return &Bot{cmp: cmp, api: api, userID: userID}
+}
+
+// HandleEvent handles a single slack event, calling the appropriate handler
+// for it. Events which aren't commands, reactions or user changes are
+// ignored.
+func (b *Bot) HandleEvent(e slack.RTMEvent) {
+	ctx := context.Background()
+	switch e.Type {
+	case "reaction_added":
+		// the bot's own reactions, see AddReaction, don't count.
+		data, ok := e.Data.(*slack.ReactionAddedEvent)
+		if !ok || b.OnReaction == nil || data.User == b.userID {
+			return
+		}
+		b.OnReaction(ctx, Reaction{Type: e.Type, ReactionAddedEvent: *data, Delta: 1})
+	case "reaction_removed":
+		data, ok := e.Data.(*slack.ReactionRemovedEvent)
+		if !ok || b.OnReaction == nil || data.User == b.userID {
+			return
+		}
+		b.OnReaction(ctx, Reaction{Type: e.Type, ReactionAddedEvent: slack.ReactionAddedEvent(*data), Delta: -1})
+	case "user_change":
+		if data, ok := e.Data.(*slack.UserChangeEvent); ok && b.OnUser != nil {
+			b.OnUser(ctx, data.User)
+		}
+	case "team_join":
+		if data, ok := e.Data.(*slack.TeamJoinEvent); ok && b.OnUser != nil {
+			b.OnUser(ctx, data.User)
+		}
+	case "message":
+		if b.Ghost || b.OnCommand == nil {
+			return
+		}
+		data, ok := e.Data.(*slack.MessageEvent)
+		if !ok || data.User == b.userID || data.Text == "" {
+			return
+		} else if err := b.handleMsg(ctx, data.Channel, data.User, data.Timestamp, data.Text); err != nil {
+			ctx = mctx.Annotate(ctx, "text", data.Text)
+			mlog.From(b.cmp).Warn("error processing message", ctx, merr.Context(err))
+		}
+	}
+}
+
+func (b *Bot) handleMsg(ctx context.Context, channelID, userID, ts, msg string) error {
+	if userID == b.userID {
+		// ignore messages sent by the bot itself. Can happen during testing
+		// when there's two running bots
+		return nil
+	}
+
+	ctx = mctx.Annotate(ctx, "channelID", channelID)
+	channel, err := b.api.GetChannel(channelID)
+	if err != nil {
+		return fmt.Errorf("couldn't get slack channel %v: %w", channelID, err)
+	}
+	isIM := channel.IsIM
+	ctx = mctx.Annotate(ctx, "userID", userID, "channel", channel.Name, "isIM", isIM)
+
+	user, err := b.api.GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get slack user %v: %w", userID, err)
+	}
+	ctx = mctx.Annotate(ctx, "user", user.Name)
+
+	msg = strings.TrimSpace(msg)
+	prefix := "<@" + b.userID + ">"
+	if !strings.HasPrefix(msg, prefix) && !isIM {
+		return nil
+	}
+	msg = strings.TrimPrefix(msg, prefix)
+
+	cmd := Command{Channel: channel, User: user, Timestamp: ts}
+	if fields := strings.Fields(msg); len(fields) > 0 {
+		cmd.Name = strings.ToLower(fields[0])
+		cmd.Args = fields[1:]
+	}
+	return b.OnCommand(ctx, cmd)
+}
+
+// EventKey returns the ID of the user whose balance or commands the event
+// pertains to, so that events for the same user can be processed in order.
+func EventKey(e slack.RTMEvent) string {
+	switch data := e.Data.(type) {
+	case *slack.ReactionAddedEvent:
+		return data.ItemUser
+	case *slack.ReactionRemovedEvent:
+		return data.ItemUser
+	case *slack.MessageEvent:
+		return data.User
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,102 @@
+package slackbot_test
+
+import (
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestBotHandleEvent(t *T) {
+	fs := slackbottest.New()
+	bot := slackbot.NewBot(mtest.Component(), fs, "BOT")
+	user := fs.AddUser("U1", "alice", "T1")
+	fs.AddChannel("C1", false)
+	fs.AddChannel("D1", true)
+
+	var cmds []slackbot.Command
+	bot.OnCommand = func(_ context.Context, cmd slackbot.Command) error {
+		cmds = append(cmds, cmd)
+		return nil
+	}
+	var reactions []slackbot.Reaction
+	bot.OnReaction = func(_ context.Context, r slackbot.Reaction) {
+		reactions = append(reactions, r)
+	}
+	var users []slack.User
+	bot.OnUser = func(_ context.Context, u slack.User) {
+		users = append(users, u)
+	}
+
+	msgEvent := func(channelID, userID, text string) slack.RTMEvent {
+		return slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{Msg: slack.Msg{
+			Channel: channelID, User: userID, Text: text,
+		}}}
+	}
+	flushCmds := func() []slackbot.Command {
+		defer func() { cmds = nil }()
+		return cmds
+	}
+
+	bot.HandleEvent(msgEvent("C1", user.ID, "<@BOT> Give 5 <@U2>"))
+	bot.HandleEvent(msgEvent("D1", user.ID, "balance"))
+	bot.HandleEvent(msgEvent("C1", user.ID, "<@BOT>"))
+	got := flushCmds()
+	massert.Require(t, massert.Equal(3, len(got)))
+	massert.Require(t,
+		massert.Equal("give", got[0].Name),
+		massert.Equal([]string{"5", "<@U2>"}, got[0].Args),
+		massert.Equal("C1", got[0].Channel.ID),
+		massert.Equal(user, got[0].User),
+		massert.Equal("balance", got[1].Name),
+		massert.Equal("", got[2].Name),
+	)
+
+	// messages which aren't directed at the bot, or which are from the bot
+	// itself, are ignored.
+	bot.HandleEvent(msgEvent("C1", user.ID, "just chatting"))
+	bot.HandleEvent(msgEvent("D1", "BOT", "balance"))
+	massert.Require(t, massert.Equal(0, len(flushCmds())))
+
+	bot.Ghost = true
+	bot.HandleEvent(msgEvent("D1", user.ID, "balance"))
+	massert.Require(t, massert.Equal(0, len(flushCmds())))
+
+	bot.HandleEvent(slack.RTMEvent{Type: "reaction_added", Data: &slack.ReactionAddedEvent{
+		User: "U2", ItemUser: user.ID, Reaction: "fire",
+	}})
+	bot.HandleEvent(slack.RTMEvent{Type: "reaction_removed", Data: &slack.ReactionRemovedEvent{
+		User: "U2", ItemUser: user.ID, Reaction: "fire",
+	}})
+	massert.Require(t, massert.Equal(2, len(reactions)))
+	massert.Require(t,
+		massert.Equal(1, reactions[0].Delta),
+		massert.Equal("reaction_added", reactions[0].Type),
+		massert.Equal(-1, reactions[1].Delta),
+		massert.Equal("fire", reactions[1].Reaction),
+		massert.Equal(user.ID, reactions[1].ItemUser),
+	)
+
+	// the bot's own reactions are ignored.
+	bot.HandleEvent(slack.RTMEvent{Type: "reaction_added", Data: &slack.ReactionAddedEvent{
+		User: "BOT", ItemUser: user.ID, Reaction: "buck",
+	}})
+	massert.Require(t, massert.Equal(2, len(reactions)))
+
+	bot.HandleEvent(slack.RTMEvent{Type: "team_join", Data: &slack.TeamJoinEvent{
+		User: slack.User{ID: "U3", Name: "carol"},
+	}})
+	bot.HandleEvent(slack.RTMEvent{Type: "user_change", Data: &slack.UserChangeEvent{
+		User: slack.User{ID: "U3", Name: "carol", Deleted: true},
+	}})
+	massert.Require(t,
+		massert.Equal(2, len(users)),
+		massert.Equal("carol", users[0].Name),
+		massert.Equal(true, users[1].Deleted),
+	)
+}
@@ -0,0 +1,390 @@
+// Package slackbot implements buckaroo's connection to slack: a client for the
+// parts of the slack API which buckaroo uses, messages which can be sent
+// through it, and a Bot which turns incoming slack events into commands and
+// reactions for the application to handle.
+package slackbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/nlopes/slack"
+)
+
+// ErrUserNotFound is returned from GetUser and GetUserByName when there's no
+// such user in the workspace.
+var ErrUserNotFound = errors.New("user not found")
+
+// API describes the slack functionality used by buckaroo, so that it can be
+// faked in tests. It is implemented by Client.
+type API interface {
+	GetChannel(id string) (*slack.Channel, error)
+
+	// GetUser returns the user with the given ID, which may also be given
+	// as a mention (e.g. "<@ID>").
+	GetUser(id string) (*slack.User, error)
+	GetUserByName(name string) (*slack.User, error)
+	GetIMChannel(userID string) (string, error)
+	SendMessage(channelID string, msg *Message) error
+
+	// GetMessageUser returns the ID of the user who posted the message with
+	// the given timestamp, which may be a thread reply. Returns empty string if
+	// the message wasn't posted by a user, e.g. it was posted by a bot.
+	GetMessageUser(channelID, timestamp string) (string, error)
+
+	// GetFileUser returns the ID of the user who uploaded the given file or,
+	// if a comment ID is given, who made that comment on the file.
+	GetFileUser(fileID, commentID string) (string, error)
+
+	// AddReaction adds a reaction with the given emoji (without colons) by
+	// the bot to the message with the given timestamp. It's not an error if
+	// the bot has already added it.
+	AddReaction(emoji, channelID, timestamp string) error
+}
+
+var _ API = new(Client)
+
+// Client is buckaroo's connection to slack. Lookups of channels and users are
+// cached.
+type Client struct {
+	cmp *mcmp.Component
+
+	Client *slack.Client
+	RTM    *slack.RTM
+
+	// information about buckaroo's own user, filled in during init.
+	BotUserID, BotUser, BotTeamID string
+
+	// SigningSecret is the secret which slack signs its requests to buckaroo
+	// with, or empty if slack hasn't been set up to send any.
+	SigningSecret string
+
+	l        sync.Mutex
+	channels map[string]*slack.Channel
+	users    map[string]*slack.User
+	ims      map[string]string
+
+	// the index of users by name has its own locks, since loading it can take
+	// minutes on big workspaces and nothing else should wait on that.
+	// refreshL is held while the full list is being fetched, so only one fetch
+	// happens at a time.
+	byNameL         sync.Mutex
+	usersByName     map[string]*slack.User
+	usersByNameTime time.Time
+	refreshL        sync.Mutex
+
+	// getUsers fetches the full list of users. It's a field so tests can
+	// replace it.
+	getUsers func() ([]slack.User, error)
+}
+
+// usersByNameMinAge is how long after the full list of users is fetched that
+// GetUserByName won't fetch it again when looking up a name which isn't in it.
+// This stops lookups of names which don't exist from each fetching the list.
+const usersByNameMinAge = time.Minute
+
+// InstClient instantiates a Client, on a child Component called "slack", which
+// will connect to slack when mrun's Init hook is run.
+func InstClient(parent *mcmp.Component) *Client {
+	cmp := parent.Child("slack")
+	client := &Client{
+		cmp:         cmp,
+		channels:    map[string]*slack.Channel{},
+		users:       map[string]*slack.User{},
+		usersByName: map[string]*slack.User{},
+		ims:         map[string]string{},
+	}
+
+	token := mcfg.String(cmp, "token",
+		mcfg.ParamRequired(),
+		mcfg.ParamUsage("API token for the buckaroo bonzai bot"))
+	timeout := mcfg.String(cmp, "timeout",
+		mcfg.ParamDefault("10s"),
+		mcfg.ParamUsage("Timeout for calls to the slack web API"))
+	signingSecret := mcfg.String(cmp, "signing-secret",
+		mcfg.ParamUsage("Signing secret of the slack app, which is needed for buttons on buckaroo's messages to work. If not set then they're left off."))
+	mrun.InitHook(cmp, func(ctx context.Context) error {
+		client.SigningSecret = *signingSecret
+		httpTimeout, err := time.ParseDuration(*timeout)
+		if err != nil {
+			return fmt.Errorf("parsing --slack-timeout: %w", err)
+		}
+
+		mlog.From(cmp).Info("connecting to slack", ctx)
+		client.Client = slack.New(*token, slack.OptionHTTPClient(&http.Client{Timeout: httpTimeout}))
+		client.getUsers = client.Client.GetUsers
+		client.RTM = client.Client.NewRTM()
+		go client.RTM.ManageConnection()
+
+		mlog.From(cmp).Info("getting bot user info", ctx)
+		res, err := client.Client.AuthTest()
+		if err != nil {
+			return err
+		}
+		client.BotUser = res.User
+		client.BotUserID = res.UserID
+		client.BotTeamID = res.TeamID
+		cmp.Annotate("botUser", client.BotUser, "botUserID", client.BotUserID, "botTeamID", client.BotTeamID)
+		mlog.From(cmp).Info("got bot user info", ctx)
+
+		return nil
+	})
+
+	mrun.ShutdownHook(cmp, func(ctx context.Context) error {
+		mlog.From(cmp).Info("shutting down slack", ctx)
+		return client.RTM.Disconnect()
+	})
+
+	return client
+}
+
+func (sc *Client) GetChannel(id string) (*slack.Channel, error) {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+
+	if channel, ok := sc.channels[id]; ok {
+		return channel, nil
+	}
+	channel, err := sc.Client.GetConversationInfo(id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.channels[id] = channel
+	return channel, nil
+}
+
+func (sc *Client) GetUser(id string) (*slack.User, error) {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+
+	id = strings.TrimPrefix(id, "<")
+	id = strings.TrimPrefix(id, "@")
+	id = strings.TrimSuffix(id, ">")
+	if user, ok := sc.users[id]; ok {
+		return user, nil
+	}
+
+	user, err := sc.Client.GetUserInfo(id)
+	if err != nil && err.Error() == "user_not_found" {
+		return nil, fmt.Errorf("getting user %q: %w", id, ErrUserNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	sc.users[id] = user
+	return user, nil
+}
+
+// RefreshUsersByName fetches the full list of users, which GetUserByName looks
+// users up in, and also caches each of them for GetUser. GetUserByName will do
+// this itself if the user it's looking for isn't already known, so this is
+// only needed to warm the caches.
+func (sc *Client) RefreshUsersByName() error {
+	return sc.refreshUsersByName(time.Time{})
+}
+
+// refreshUsersByName fetches the full list of users, unless it's already been
+// fetched since the given time, e.g. by another call which was waiting on
+// refreshL at the same time.
+func (sc *Client) refreshUsersByName(ifNotSince time.Time) error {
+	sc.refreshL.Lock()
+	defer sc.refreshL.Unlock()
+
+	sc.byNameL.Lock()
+	fetchedAt := sc.usersByNameTime
+	sc.byNameL.Unlock()
+	if !ifNotSince.IsZero() && fetchedAt.After(ifNotSince) {
+		return nil
+	}
+
+	users, err := sc.getUsers()
+	if err != nil {
+		return fmt.Errorf("error getting all slack users: %w", err)
+	}
+
+	usersByName := make(map[string]*slack.User, len(users))
+	for i, user := range users {
+		usersByName[user.Name] = &users[i]
+	}
+	sc.byNameL.Lock()
+	sc.usersByName = usersByName
+	sc.usersByNameTime = time.Now()
+	sc.byNameL.Unlock()
+
+	sc.l.Lock()
+	for i := range users {
+		sc.users[users[i].ID] = &users[i]
+	}
+	sc.l.Unlock()
+	return nil
+}
+
+// WarmUsers fetches the full list of users in the background of startup,
+// retrying with backoff if slack is having problems, until it succeeds or the
+// context is canceled. Lookups don't need to wait for it, they'll fall back
+// to fetching what they need themselves.
+func (sc *Client) WarmUsers(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := sc.refreshUsersByName(start.Add(-usersByNameMinAge))
+		if err == nil {
+			sc.byNameL.Lock()
+			n := len(sc.usersByName)
+			sc.byNameL.Unlock()
+			mlog.From(sc.cmp).Info("warmed slack user caches", mctx.Annotate(ctx,
+				"numUsers", n, "took", time.Since(start).String()))
+			return
+		}
+
+		mlog.From(sc.cmp).Warn("error warming slack user caches, will retry",
+			mctx.Annotate(ctx, "retryIn", backoff.String()), merr.Context(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+	}
+}
+
+// userByCachedName looks for the user in the index of users by name, falling
+// back to the users which have been looked up by ID, which is all there is
+// before the full list has been fetched.
+func (sc *Client) userByCachedName(name string) (*slack.User, time.Time, bool) {
+	sc.byNameL.Lock()
+	user, ok := sc.usersByName[name]
+	fetchedAt := sc.usersByNameTime
+	sc.byNameL.Unlock()
+	if ok {
+		return user, fetchedAt, true
+	}
+
+	sc.l.Lock()
+	defer sc.l.Unlock()
+	for _, user := range sc.users {
+		if user.Name == name {
+			return user, fetchedAt, true
+		}
+	}
+	return nil, fetchedAt, false
+}
+
+func (sc *Client) GetUserByName(name string) (*slack.User, error) {
+	user, fetchedAt, ok := sc.userByCachedName(name)
+	if ok {
+		return user, nil
+	} else if time.Since(fetchedAt) < usersByNameMinAge {
+		return nil, ErrUserNotFound
+	}
+
+	if err := sc.refreshUsersByName(time.Now().Add(-usersByNameMinAge)); err != nil {
+		return nil, fmt.Errorf("error refreshing users by name: %w", err)
+	}
+	if user, _, ok = sc.userByCachedName(name); !ok {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (sc *Client) GetIMChannel(userID string) (string, error) {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+
+	channel, ok := sc.ims[userID]
+	if ok {
+		return channel, nil
+	}
+
+	_, _, channel, err := sc.Client.OpenIMChannel(userID)
+	if err != nil {
+		return "", err
+	}
+
+	sc.ims[userID] = channel
+	return channel, nil
+}
+
+// SendMessage sends the given message to the given channel. Plain text
+// messages go over the RTM connection, but the RTM API doesn't support blocks
+// so those are posted using the web API.
+func (sc *Client) SendMessage(channelID string, msg *Message) error {
+	blocks := msg.Blocks()
+	if blocks == nil {
+		outMsg := sc.RTM.NewOutgoingMessage(msg.Text, channelID)
+		sc.RTM.SendMessage(outMsg)
+		return nil
+	}
+
+	_, _, err := sc.Client.PostMessage(channelID,
+		slack.MsgOptionText(msg.Text, false),
+		slack.MsgOptionBlocks(blocks...),
+		slack.MsgOptionAsUser(true),
+	)
+	return err
+}
+
+func (sc *Client) GetMessageUser(channelID, timestamp string) (string, error) {
+	// conversations.replies returns the whole thread which the message is a
+	// part of, or just the message if it's not in a thread.
+	params := &slack.GetConversationRepliesParameters{
+		ChannelID: channelID,
+		Timestamp: timestamp,
+		Limit:     100,
+	}
+	for {
+		msgs, hasMore, cursor, err := sc.Client.GetConversationReplies(params)
+		if err != nil {
+			return "", err
+		}
+		for _, msg := range msgs {
+			if msg.Timestamp == timestamp {
+				return msg.User, nil
+			}
+		}
+		if !hasMore || cursor == "" {
+			return "", errors.New("message not found")
+		}
+		params.Cursor = cursor
+	}
+}
+
+func (sc *Client) GetFileUser(fileID, commentID string) (string, error) {
+	for page := 1; ; page++ {
+		file, comments, paging, err := sc.Client.GetFileInfo(fileID, 100, page)
+		if err != nil {
+			return "", err
+		} else if commentID == "" {
+			return file.User, nil
+		}
+		for _, comment := range comments {
+			if comment.ID == commentID {
+				return comment.User, nil
+			}
+		}
+		if paging == nil || page >= paging.Pages {
+			return "", errors.New("file comment not found")
+		}
+	}
+}
+
+func (sc *Client) AddReaction(emoji, channelID, timestamp string) error {
+	err := sc.Client.AddReaction(emoji, slack.NewRefToMessage(channelID, timestamp))
+	if err != nil && err.Error() == "already_reacted" {
+		return nil
+	}
+	return err
+}
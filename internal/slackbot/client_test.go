@@ -0,0 +1,75 @@
+package slackbot
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/nlopes/slack"
+)
+
+func TestClientGetUserByName(t *T) {
+	var calls int
+	var fail bool
+	sc := &Client{
+		cmp:   mtest.Component(),
+		users: map[string]*slack.User{},
+		getUsers: func() ([]slack.User, error) {
+			calls++
+			if fail {
+				return nil, errors.New("slack is down")
+			}
+			return []slack.User{{ID: "U1", Name: "alice"}, {ID: "U2", Name: "bob"}}, nil
+		},
+	}
+
+	// users already looked up by ID are found without fetching the list.
+	sc.users["U3"] = &slack.User{ID: "U3", Name: "carol"}
+	user, err := sc.GetUserByName("carol")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("U3", user.ID),
+		massert.Equal(0, calls),
+	)
+
+	// a transient error is returned, rather than being fatal, and the next
+	// lookup tries again.
+	fail = true
+	_, err = sc.GetUserByName("alice")
+	massert.Require(t,
+		massert.Not(massert.Nil(err)),
+		massert.Equal(false, errors.Is(err, ErrUserNotFound)),
+		massert.Equal(1, calls),
+	)
+
+	fail = false
+	user, err = sc.GetUserByName("alice")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("U1", user.ID),
+		massert.Equal(2, calls),
+	)
+
+	// the list also warms the cache of users by ID.
+	massert.Require(t, massert.Equal("bob", sc.users["U2"].Name))
+
+	// names which don't exist don't fetch the list again straight away.
+	_, err = sc.GetUserByName("dave")
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, ErrUserNotFound)),
+		massert.Equal(2, calls),
+	)
+	sc.usersByNameTime = time.Now().Add(-usersByNameMinAge)
+	_, err = sc.GetUserByName("dave")
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, ErrUserNotFound)),
+		massert.Equal(3, calls),
+	)
+
+	// warming doesn't fetch the list if it was just fetched by a lookup.
+	sc.WarmUsers(context.Background())
+	massert.Require(t, massert.Equal(3, calls))
+}
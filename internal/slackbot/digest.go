@@ -0,0 +1,132 @@
+package slackbot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// maxDigestBlocks is the most blocks which are sent in one digest message.
+// slack refuses messages with more than 50.
+const maxDigestBlocks = 50
+
+// Digest coalesces DMs to the same user into a single message. The first DM to
+// a user is held for a window, and any others sent to them in that time are
+// sent along with it, so a burst of notifications (e.g. from a popular
+// message) becomes one message rather than a flood of them.
+type Digest struct {
+	cmp    *mcmp.Component
+	api    API
+	window time.Duration
+
+	// Retry is optional, and is given digests which failed to send, rather
+	// than them only being logged.
+	Retry *DMRetry
+
+	l       sync.Mutex
+	pending map[string][]*Message
+	timers  map[string]*time.Timer
+}
+
+// NewDigest returns a Digest which sends DMs using the given API, holding each
+// user's DMs for the given window.
+func NewDigest(cmp *mcmp.Component, api API, window time.Duration) *Digest {
+	return &Digest{
+		cmp:     cmp,
+		api:     api,
+		window:  window,
+		pending: map[string][]*Message{},
+		timers:  map[string]*time.Timer{},
+	}
+}
+
+// Send queues the message to be DM'd to the user. Errors sending it are
+// logged, since by then the caller has moved on.
+func (d *Digest) Send(userID string, msg *Message) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.pending[userID] = append(d.pending[userID], msg)
+	if _, ok := d.timers[userID]; !ok {
+		d.timers[userID] = time.AfterFunc(d.window, func() { d.flush(userID) })
+	}
+}
+
+// Flush sends all queued DMs immediately. It should be called when shutting
+// down, so that nothing is lost.
+func (d *Digest) Flush() {
+	d.l.Lock()
+	userIDs := make([]string, 0, len(d.pending))
+	for userID := range d.pending {
+		userIDs = append(userIDs, userID)
+	}
+	d.l.Unlock()
+
+	for _, userID := range userIDs {
+		d.flush(userID)
+	}
+}
+
+func (d *Digest) flush(userID string) {
+	d.l.Lock()
+	msgs := d.pending[userID]
+	if timer, ok := d.timers[userID]; ok {
+		timer.Stop()
+	}
+	delete(d.pending, userID)
+	delete(d.timers, userID)
+	d.l.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	ctx := mctx.Annotate(d.cmp.Context(), "userID", userID, "numMessages", len(msgs))
+	if len(msgs) > 1 {
+		mlog.From(d.cmp).Debug("sending DM digest", ctx)
+	}
+
+	channelID, imErr := d.api.GetIMChannel(userID)
+	for _, chunk := range digestChunks(msgs) {
+		msg, err := combineMessages(chunk), imErr
+		if err == nil {
+			err = d.api.SendMessage(channelID, msg)
+		}
+		if err == nil {
+			continue
+		}
+		mlog.From(d.cmp).Warn("error sending DM digest", ctx, merr.Context(err))
+		if d.Retry != nil {
+			d.Retry.Retry(userID, msg)
+		}
+	}
+}
+
+// digestChunks splits the messages into groups which can each be combined into
+// a single message without going over maxDigestBlocks.
+func digestChunks(msgs []*Message) [][]*Message {
+	var chunks [][]*Message
+	var chunk []*Message
+	var numBlocks int
+	for _, msg := range msgs {
+		// the message's own blocks, plus a section for its text if it has
+		// none, plus a divider.
+		msgBlocks := len(msg.Blocks()) + 1
+		if msgBlocks == 1 {
+			msgBlocks++
+		}
+		if len(chunk) > 0 && numBlocks+msgBlocks > maxDigestBlocks {
+			chunks = append(chunks, chunk)
+			chunk, numBlocks = nil, 0
+		}
+		chunk = append(chunk, msg)
+		numBlocks += msgBlocks
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
@@ -0,0 +1,39 @@
+package slackbot_test
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestDigest(t *T) {
+	fs := slackbottest.New()
+	fs.AddUser("U1", "alice", "T1")
+	fs.AddUser("U2", "bob", "T1")
+	d := slackbot.NewDigest(mtest.Component(), fs, 50*time.Millisecond)
+
+	d.Send("U1", slackbot.NewMessage("one"))
+	d.Send("U1", slackbot.NewMessage("two"))
+	d.Send("U2", slackbot.NewMessage("three"))
+	massert.Require(t, massert.Length(fs.Flush(), 0))
+
+	time.Sleep(100 * time.Millisecond)
+	msgs := fs.Flush()
+	massert.Require(t,
+		massert.Length(msgs, 2),
+		massert.HasValue(msgs, slackbottest.Msg{ChannelID: "IM-U1", Text: "one\ntwo"}),
+		massert.HasValue(msgs, slackbottest.Msg{ChannelID: "IM-U2", Text: "three"}),
+	)
+
+	// Flush doesn't wait for the window
+	d.Send("U1", slackbot.NewMessage("four"))
+	d.Flush()
+	massert.Require(t, massert.Equal([]slackbottest.Msg{
+		{ChannelID: "IM-U1", Text: "four"},
+	}, fs.Flush()))
+}
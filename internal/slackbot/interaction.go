@@ -0,0 +1,147 @@
+package slackbot
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// commandActionIDPrefix prefixes the action IDs of buttons added by
+// Message.CommandButtons, so that clicks on them can be told apart from any
+// other buttons.
+const commandActionIDPrefix = "command-"
+
+// interactionMaxAge is how old a request from slack can be before it's
+// rejected, so that requests which have been captured can't be replayed later.
+const interactionMaxAge = 5 * time.Minute
+
+// checkSignature returns whether the body was signed by slack using the signing
+// secret at the given unix timestamp, as given by the X-Slack-Signature and
+// X-Slack-Request-Timestamp headers.
+func checkSignature(secret string, body []byte, sig, timestamp string, now time.Time) bool {
+	const prefix = "v0="
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+	sigB, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	} else if age := now.Sub(time.Unix(ts, 0)); age > interactionMaxAge || age < -interactionMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	return hmac.Equal(sigB, mac.Sum(nil))
+}
+
+// The parts of slack's interaction payloads which are used.
+type interactionPayload struct {
+	Type string `json:"type"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+		ActionTS string `json:"action_ts"`
+	} `json:"actions"`
+}
+
+// ServeInteraction handles requests from slack's interactivity, which slack
+// makes when a user clicks a button. Clicks on buttons added by
+// Message.CommandButtons are passed to OnCommand, with the Command's Timestamp
+// being that of the click. Everything else is ignored.
+//
+// Requests must be signed with SigningSecret, and if it isn't set then all
+// requests are treated as not found.
+func (b *Bot) ServeInteraction(rw http.ResponseWriter, r *http.Request) {
+	if b.SigningSecret == "" {
+		http.NotFound(rw, r)
+		return
+	} else if r.Method != "POST" {
+		http.Error(rw, "method must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, 1<<20))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("reading body: %s", err), http.StatusBadRequest)
+		return
+	} else if !checkSignature(b.SigningSecret, body,
+		r.Header.Get("X-Slack-Signature"), r.Header.Get("X-Slack-Request-Timestamp"), time.Now(),
+	) {
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("parsing body: %s", err), http.StatusBadRequest)
+		return
+	}
+	var payload interactionPayload
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(rw, fmt.Sprintf("decoding payload: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// slack wants a response within a few seconds, and doesn't do anything
+	// with it other than retry if it doesn't get one, so respond before
+	// handling anything.
+	rw.WriteHeader(http.StatusOK)
+	if b.Ghost || b.OnCommand == nil || payload.Type != "block_actions" {
+		return
+	}
+
+	ctx := mctx.Annotate(context.Background(), "channelID", payload.Channel.ID, "userID", payload.User.ID)
+	for _, action := range payload.Actions {
+		if !strings.HasPrefix(action.ActionID, commandActionIDPrefix) {
+			continue
+		} else if err := b.handleCommandAction(ctx, payload.Channel.ID, payload.User.ID, action.ActionTS, action.Value); err != nil {
+			ctx := mctx.Annotate(ctx, "command", action.Value)
+			mlog.From(b.cmp).Warn("error processing command button", ctx, merr.Context(err))
+		}
+	}
+}
+
+func (b *Bot) handleCommandAction(ctx context.Context, channelID, userID, ts, command string) error {
+	channel, err := b.api.GetChannel(channelID)
+	if err != nil {
+		return fmt.Errorf("couldn't get slack channel %v: %w", channelID, err)
+	}
+	user, err := b.api.GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get slack user %v: %w", userID, err)
+	}
+	ctx = mctx.Annotate(ctx, "channel", channel.Name, "isIM", channel.IsIM, "user", user.Name)
+
+	cmd := Command{Channel: channel, User: user, Timestamp: ts}
+	if fields := strings.Fields(command); len(fields) > 0 {
+		cmd.Name = strings.ToLower(fields[0])
+		cmd.Args = fields[1:]
+	}
+	return b.OnCommand(ctx, cmd)
+}
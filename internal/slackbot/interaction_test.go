@@ -0,0 +1,74 @@
+package slackbot_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestBotServeInteraction(t *T) {
+	fs := slackbottest.New()
+	bot := slackbot.NewBot(mtest.Component(), fs, "BOT")
+	bot.SigningSecret = "shh"
+	user := fs.AddUser("U1", "alice", "T1")
+	fs.AddChannel("D1", true)
+
+	var cmds []slackbot.Command
+	bot.OnCommand = func(_ context.Context, cmd slackbot.Command) error {
+		cmds = append(cmds, cmd)
+		return nil
+	}
+
+	serve := func(secret, actionID, value string, ts time.Time) int {
+		payload := fmt.Sprintf(`{"type":"block_actions","user":{"id":"U1"},"channel":{"id":"D1"},"actions":[{"action_id":%q,"value":%q,"action_ts":"123.456"}]}`, actionID, value)
+		body := url.Values{"payload": {payload}}.Encode()
+		tsStr := strconv.FormatInt(ts.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "v0:%s:%s", tsStr, body)
+
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("X-Slack-Request-Timestamp", tsStr)
+		r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		rw := httptest.NewRecorder()
+		bot.ServeInteraction(rw, r)
+		return rw.Code
+	}
+
+	msg := slackbot.NewMessage("pay up").CommandButtons("Accept", "split accept abc")
+	massert.Require(t, massert.Length(msg.Blocks(), 2))
+
+	massert.Require(t,
+		massert.Equal(http.StatusOK, serve("shh", "command-0", "split accept abc", time.Now())),
+		massert.Length(cmds, 1),
+		massert.Equal("split", cmds[0].Name),
+		massert.Equal([]string{"accept", "abc"}, cmds[0].Args),
+		massert.Equal(user, cmds[0].User),
+		massert.Equal("D1", cmds[0].Channel.ID),
+		massert.Equal("123.456", cmds[0].Timestamp),
+	)
+
+	// requests which weren't signed with the secret, or were signed too long
+	// ago, are rejected, and buttons which weren't added by CommandButtons are
+	// ignored.
+	massert.Require(t,
+		massert.Equal(http.StatusUnauthorized, serve("nope", "command-0", "balance", time.Now())),
+		massert.Equal(http.StatusUnauthorized, serve("shh", "command-0", "balance", time.Now().Add(-time.Hour))),
+		massert.Equal(http.StatusOK, serve("shh", "txLink", "balance", time.Now())),
+		massert.Length(cmds, 1),
+	)
+}
@@ -0,0 +1,130 @@
+package slackbot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// Message is an outgoing slack message. Every message has plain text, which is
+// all that gets sent if no blocks have been added. If blocks have been added
+// then the message is sent using Block Kit, with the text as its first section
+// and as the fallback for notifications.
+//
+// The methods on Message all return the message itself, so that they can be
+// chained.
+type Message struct {
+	Text   string
+	blocks []slack.Block
+
+	// set if blocks already include the text, see combineMessages.
+	textInBlocks bool
+}
+
+// NewMessage returns a Message whose text is formatted like fmt.Sprintf.
+func NewMessage(str string, args ...interface{}) *Message {
+	return &Message{Text: fmt.Sprintf(str, args...)}
+}
+
+func mrkdwn(str string) *slack.TextBlockObject {
+	return slack.NewTextBlockObject(slack.MarkdownType, str, false, false)
+}
+
+// Mention prefixes the message's text with an @ of the given user.
+func (m *Message) Mention(userID string) *Message {
+	m.Text = fmt.Sprintf("<@%s> %s", userID, m.Text)
+	return m
+}
+
+// Fields adds a section made up of the given key/value pairs, which slack will
+// lay out in two columns.
+func (m *Message) Fields(keyVals ...string) *Message {
+	fields := make([]*slack.TextBlockObject, 0, len(keyVals)/2)
+	for i := 0; i+1 < len(keyVals); i += 2 {
+		fields = append(fields, mrkdwn(fmt.Sprintf("*%s*\n%s", keyVals[i], keyVals[i+1])))
+	}
+	m.blocks = append(m.blocks, slack.NewSectionBlock(nil, fields, nil))
+	return m
+}
+
+// Context adds a line of small, greyed out, text.
+func (m *Message) Context(str string, args ...interface{}) *Message {
+	m.blocks = append(m.blocks, slack.NewContextBlock("", mrkdwn(fmt.Sprintf(str, args...))))
+	return m
+}
+
+// Button adds a button which links to the given url. If url is empty then no
+// button is added, e.g. for transactions which weren't really submitted.
+func (m *Message) Button(actionID, text, url string) *Message {
+	if url == "" {
+		return m
+	}
+	btn := slack.NewButtonBlockElement(actionID, "", slack.NewTextBlockObject(slack.PlainTextType, text, true, false))
+	btn.URL = url
+	m.blocks = append(m.blocks, slack.NewActionBlock("", btn))
+	return m
+}
+
+// CommandButtons adds a row of buttons made up of the given text/command
+// pairs. Clicking a button sends its command to the Bot as though the user who
+// clicked it had DM'd it, see Bot.ServeInteraction. Slack only sends clicks to
+// the Bot if its interactivity has been set up, so the commands should also be
+// given to the user some other way.
+func (m *Message) CommandButtons(textCommands ...string) *Message {
+	elements := make([]slack.BlockElement, 0, len(textCommands)/2)
+	for i := 0; i+1 < len(textCommands); i += 2 {
+		btn := slack.NewButtonBlockElement(
+			fmt.Sprintf("%s%d", commandActionIDPrefix, i/2),
+			textCommands[i+1],
+			slack.NewTextBlockObject(slack.PlainTextType, textCommands[i], true, false),
+		)
+		elements = append(elements, btn)
+	}
+	m.blocks = append(m.blocks, slack.NewActionBlock("", elements...))
+	return m
+}
+
+// Blocks returns the full set of blocks which should be sent for the message,
+// or nil if it should be sent as plain text.
+func (m *Message) Blocks() []slack.Block {
+	if len(m.blocks) == 0 {
+		return nil
+	} else if m.textInBlocks {
+		return m.blocks
+	}
+	blocks := make([]slack.Block, 0, len(m.blocks)+1)
+	blocks = append(blocks, slack.NewSectionBlock(mrkdwn(m.Text), nil, nil))
+	return append(blocks, m.blocks...)
+}
+
+// combineMessages returns a single Message made up of all of the given ones,
+// separated by dividers.
+func combineMessages(msgs []*Message) *Message {
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+
+	texts := make([]string, len(msgs))
+	var blocks []slack.Block
+	var anyBlocks bool
+	for i, msg := range msgs {
+		texts[i] = msg.Text
+		if i > 0 {
+			blocks = append(blocks, slack.NewDividerBlock())
+		}
+		if msgBlocks := msg.Blocks(); msgBlocks != nil {
+			anyBlocks = true
+			blocks = append(blocks, msgBlocks...)
+		} else {
+			blocks = append(blocks, slack.NewSectionBlock(mrkdwn(msg.Text), nil, nil))
+		}
+	}
+
+	combined := &Message{Text: strings.Join(texts, "\n")}
+	if anyBlocks {
+		combined.blocks = blocks
+		combined.textInBlocks = true
+	}
+	return combined
+}
@@ -0,0 +1,139 @@
+package slackbot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcmp"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// maxUndelivered is the most messages which are held for any one user once
+// retrying them has been given up on. Past this the oldest are dropped.
+const maxUndelivered = 20
+
+// DMRetry retries DMs which failed to send, e.g. because of a transient slack
+// error. Each one is retried with exponential backoff, and once it's failed
+// enough times it's held as undelivered, for the application to show the user
+// the next time they interact with it (see TakeUndelivered).
+//
+// Nothing is persisted, so DMs which are waiting to be retried or are
+// undelivered when the process stops are lost.
+type DMRetry struct {
+	cmp         *mcmp.Component
+	api         API
+	backoff     time.Duration
+	maxAttempts int
+
+	l           sync.Mutex
+	undelivered map[string][]*Message
+	pending     map[*time.Timer]pendingDM
+	stopped     bool
+}
+
+type pendingDM struct {
+	userID  string
+	msg     *Message
+	attempt int
+}
+
+// NewDMRetry returns a DMRetry which sends DMs using the given API. The first
+// retry happens after the given backoff, with each one after waiting twice as
+// long as the last, and DMs are retried up to maxAttempts times.
+func NewDMRetry(cmp *mcmp.Component, api API, backoff time.Duration, maxAttempts int) *DMRetry {
+	return &DMRetry{
+		cmp:         cmp,
+		api:         api,
+		backoff:     backoff,
+		maxAttempts: maxAttempts,
+		undelivered: map[string][]*Message{},
+		pending:     map[*time.Timer]pendingDM{},
+	}
+}
+
+// Retry queues a message which failed to be DM'd to the user to be retried.
+func (r *DMRetry) Retry(userID string, msg *Message) {
+	r.schedule(userID, msg, 1)
+}
+
+func (r *DMRetry) schedule(userID string, msg *Message, attempt int) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.stopped || attempt > r.maxAttempts {
+		r.giveUp(userID, msg)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(r.backoff<<uint(attempt-1), func() {
+		r.l.Lock()
+		delete(r.pending, timer)
+		r.l.Unlock()
+		r.attempt(userID, msg, attempt)
+	})
+	r.pending[timer] = pendingDM{userID: userID, msg: msg, attempt: attempt}
+}
+
+func (r *DMRetry) attempt(userID string, msg *Message, attempt int) {
+	ctx := mctx.Annotate(r.cmp.Context(), "userID", userID, "attempt", attempt)
+	channelID, err := r.api.GetIMChannel(userID)
+	if err == nil {
+		err = r.api.SendMessage(channelID, msg)
+	}
+	if err != nil {
+		mlog.From(r.cmp).Warn("error retrying DM", ctx, merr.Context(err))
+		r.schedule(userID, msg, attempt+1)
+		return
+	}
+	mlog.From(r.cmp).Info("DM retry succeeded", ctx)
+}
+
+// giveUp holds the message as undelivered. It expects the lock to be held.
+func (r *DMRetry) giveUp(userID string, msg *Message) {
+	mlog.From(r.cmp).Warn("giving up on DM, holding it until the user is next seen",
+		mctx.Annotate(r.cmp.Context(), "userID", userID))
+	msgs := append(r.undelivered[userID], msg)
+	if len(msgs) > maxUndelivered {
+		msgs = msgs[len(msgs)-maxUndelivered:]
+	}
+	r.undelivered[userID] = msgs
+}
+
+// TakeUndelivered returns all DMs to the user which retrying has been given up
+// on, combined into a single message, and forgets about them. Nil is returned
+// if there aren't any.
+func (r *DMRetry) TakeUndelivered(userID string) *Message {
+	r.l.Lock()
+	msgs := r.undelivered[userID]
+	delete(r.undelivered, userID)
+	r.l.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return combineMessages(msgs)
+}
+
+// Flush makes one last attempt at all DMs which are waiting to be retried,
+// rather than waiting for their backoff, and causes any which fail from then
+// on to be given up on immediately. It should be called when shutting down.
+func (r *DMRetry) Flush() {
+	r.l.Lock()
+	r.stopped = true
+	var dms []pendingDM
+	for timer, dm := range r.pending {
+		// if the timer already fired then its attempt is happening anyway.
+		if timer.Stop() {
+			dms = append(dms, dm)
+		}
+	}
+	r.pending = map[*time.Timer]pendingDM{}
+	r.l.Unlock()
+
+	for _, dm := range dms {
+		r.attempt(dm.userID, dm.msg, dm.attempt)
+	}
+}
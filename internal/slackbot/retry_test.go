@@ -0,0 +1,76 @@
+package slackbot_test
+
+import (
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+
+	"buckaroo-banzai/internal/slackbot"
+	"buckaroo-banzai/internal/slackbot/slackbottest"
+)
+
+func TestDMRetry(t *T) {
+	fs := slackbottest.New()
+	fs.AddUser("U1", "alice", "T1")
+	r := slackbot.NewDMRetry(mtest.Component(), fs, 10*time.Millisecond, 2)
+
+	// succeeds on the first retry
+	r.Retry("U1", slackbot.NewMessage("one"))
+	time.Sleep(30 * time.Millisecond)
+	massert.Require(t, massert.Equal([]slackbottest.Msg{
+		{ChannelID: "IM-U1", Text: "one"},
+	}, fs.Flush()))
+
+	// retries are at 10ms and 20ms after that, so it's given up on by 50ms.
+	fs.FailSends("IM-U1", errors.New("ratelimited"))
+	r.Retry("U1", slackbot.NewMessage("two"))
+	r.Retry("U1", slackbot.NewMessage("three"))
+	time.Sleep(60 * time.Millisecond)
+	massert.Require(t, massert.Length(fs.Flush(), 0))
+
+	undelivered := r.TakeUndelivered("U1")
+	massert.Require(t,
+		massert.Not(massert.Nil(undelivered)),
+		massert.Nil(r.TakeUndelivered("U1")),
+	)
+	massert.Require(t, massert.HasValue([]string{"two\nthree", "three\ntwo"}, undelivered.Text))
+}
+
+func TestDMRetryFlush(t *T) {
+	fs := slackbottest.New()
+	fs.AddUser("U1", "alice", "T1")
+	r := slackbot.NewDMRetry(mtest.Component(), fs, time.Hour, 5)
+
+	r.Retry("U1", slackbot.NewMessage("one"))
+	r.Flush()
+	massert.Require(t, massert.Equal([]slackbottest.Msg{
+		{ChannelID: "IM-U1", Text: "one"},
+	}, fs.Flush()))
+
+	// once flushed, failures are given up on straight away.
+	r.Retry("U1", slackbot.NewMessage("two"))
+	massert.Require(t, massert.Equal("two", r.TakeUndelivered("U1").Text))
+}
+
+func TestDigestRetry(t *T) {
+	fs := slackbottest.New()
+	fs.AddUser("U1", "alice", "T1")
+	r := slackbot.NewDMRetry(mtest.Component(), fs, 10*time.Millisecond, 5)
+	d := slackbot.NewDigest(mtest.Component(), fs, time.Hour)
+	d.Retry = r
+
+	fs.FailSends("IM-U1", errors.New("ratelimited"))
+	d.Send("U1", slackbot.NewMessage("one"))
+	d.Send("U1", slackbot.NewMessage("two"))
+	d.Flush()
+	massert.Require(t, massert.Length(fs.Flush(), 0))
+
+	fs.FailSends("IM-U1", nil)
+	time.Sleep(30 * time.Millisecond)
+	massert.Require(t, massert.Equal([]slackbottest.Msg{
+		{ChannelID: "IM-U1", Text: "one\ntwo"},
+	}, fs.Flush()))
+}
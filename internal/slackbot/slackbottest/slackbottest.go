@@ -0,0 +1,174 @@
+// Package slackbottest provides a fake implementation of slackbot.API, for
+// testing code which interacts with slack.
+package slackbottest
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+
+	"buckaroo-banzai/internal/slackbot"
+)
+
+// Msg is a message which was sent through a Fake.
+type Msg struct {
+	ChannelID, Text string
+}
+
+// Fake implements slackbot.API using in-memory users and channels, and records
+// all messages which are sent through it.
+type Fake struct {
+	users    map[string]*slack.User
+	channels map[string]*slack.Channel
+
+	// MessageUsers and FileUsers are the authors of messages and files, keyed
+	// by "<channelID>:<timestamp>" and "<fileID>:<commentID>" respectively.
+	// Files themselves have an empty commentID.
+	MessageUsers, FileUsers map[string]string
+
+	l         sync.Mutex
+	sent      []Msg
+	sendErrs  map[string]error
+	reactions map[string][]string
+}
+
+var _ slackbot.API = new(Fake)
+
+// New returns an empty Fake.
+func New() *Fake {
+	return &Fake{
+		users:    map[string]*slack.User{},
+		channels: map[string]*slack.Channel{},
+
+		MessageUsers: map[string]string{},
+		FileUsers:    map[string]string{},
+	}
+}
+
+// AddUser adds a user, returning it.
+func (fs *Fake) AddUser(id, name, teamID string) *slack.User {
+	user := &slack.User{ID: id, Name: name, TeamID: teamID}
+	fs.users[id] = user
+	return user
+}
+
+// AddChannel adds a channel, returning it.
+func (fs *Fake) AddChannel(id string, isIM bool) *slack.Channel {
+	channel := new(slack.Channel)
+	channel.ID = id
+	channel.IsIM = isIM
+	fs.channels[id] = channel
+	return channel
+}
+
+// GetChannel implements the method for slackbot.API.
+func (fs *Fake) GetChannel(id string) (*slack.Channel, error) {
+	if channel, ok := fs.channels[id]; ok {
+		return channel, nil
+	}
+	return nil, errors.New("channel_not_found")
+}
+
+// GetUser implements the method for slackbot.API.
+func (fs *Fake) GetUser(id string) (*slack.User, error) {
+	id = strings.TrimPrefix(id, "<")
+	id = strings.TrimPrefix(id, "@")
+	id = strings.TrimSuffix(id, ">")
+	if user, ok := fs.users[id]; ok {
+		return user, nil
+	}
+	return nil, slackbot.ErrUserNotFound
+}
+
+// GetUserByName implements the method for slackbot.API.
+func (fs *Fake) GetUserByName(name string) (*slack.User, error) {
+	for _, user := range fs.users {
+		if user.Name == name {
+			return user, nil
+		}
+	}
+	return nil, slackbot.ErrUserNotFound
+}
+
+// GetIMChannel implements the method for slackbot.API.
+func (fs *Fake) GetIMChannel(userID string) (string, error) {
+	if _, err := fs.GetUser(userID); err != nil {
+		return "", err
+	}
+	return "IM-" + userID, nil
+}
+
+// SendMessage implements the method for slackbot.API. Only the message's text is
+// recorded.
+func (fs *Fake) SendMessage(channelID string, msg *slackbot.Message) error {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	if err := fs.sendErrs[channelID]; err != nil {
+		return err
+	}
+	fs.sent = append(fs.sent, Msg{ChannelID: channelID, Text: msg.Text})
+	return nil
+}
+
+// FailSends causes all messages sent to the channel to fail with the given
+// error, or to succeed again if it's nil.
+func (fs *Fake) FailSends(channelID string, err error) {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	if fs.sendErrs == nil {
+		fs.sendErrs = map[string]error{}
+	}
+	fs.sendErrs[channelID] = err
+}
+
+// GetMessageUser implements the method for slackbot.API.
+func (fs *Fake) GetMessageUser(channelID, timestamp string) (string, error) {
+	if userID, ok := fs.MessageUsers[channelID+":"+timestamp]; ok {
+		return userID, nil
+	}
+	return "", errors.New("message not found")
+}
+
+// GetFileUser implements the method for slackbot.API.
+func (fs *Fake) GetFileUser(fileID, commentID string) (string, error) {
+	if userID, ok := fs.FileUsers[fileID+":"+commentID]; ok {
+		return userID, nil
+	}
+	return "", errors.New("file not found")
+}
+
+// AddReaction implements the method for slackbot.API.
+func (fs *Fake) AddReaction(emoji, channelID, timestamp string) error {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	if fs.reactions == nil {
+		fs.reactions = map[string][]string{}
+	}
+	key := channelID + ":" + timestamp
+	for _, existing := range fs.reactions[key] {
+		if existing == emoji {
+			return nil
+		}
+	}
+	fs.reactions[key] = append(fs.reactions[key], emoji)
+	return nil
+}
+
+// Reactions returns the emoji which have been added as reactions to the
+// message with the given timestamp, in the order they were added.
+func (fs *Fake) Reactions(channelID, timestamp string) []string {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	return fs.reactions[channelID+":"+timestamp]
+}
+
+// Flush returns all messages sent since the last call to Flush.
+func (fs *Fake) Flush() []Msg {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	sent := fs.sent
+	fs.sent = nil
+	return sent
+}
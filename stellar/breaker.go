@@ -0,0 +1,97 @@
+package stellar
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stellar/go/clients/horizonclient"
+)
+
+// ErrCircuitOpen is returned from Client methods when horizon has been failing
+// recently, rather than waiting on yet another request which will likely fail.
+var ErrCircuitOpen = errors.New("stellar is having a moment, try again later")
+
+// breaker is a circuit breaker for calls to horizon. Once threshold calls in a
+// row have failed the breaker opens, and all calls fail immediately with
+// ErrCircuitOpen until cooldown has passed. After that a single call is let
+// through; if it succeeds the breaker closes, otherwise it stays open for
+// another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// optional, called when the breaker first opens after having been closed.
+	onOpen func()
+
+	l        sync.Mutex
+	failures int
+	openedAt time.Time
+	trialing bool
+}
+
+// isOutage returns whether the given error indicates that horizon itself is
+// having trouble, as opposed to it having rejected the request.
+func isOutage(err error) bool {
+	if err == nil {
+		return false
+	}
+	var herr *horizonclient.Error
+	if errors.As(err, &herr) {
+		return herr.Problem.Status >= 500
+	}
+	return true
+}
+
+// allow returns ErrCircuitOpen if a call should not be made.
+func (b *breaker) allow() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	} else if b.trialing || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.trialing = true
+	return nil
+}
+
+// record records the result of a call which allow permitted.
+func (b *breaker) record(err error) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.l.Lock()
+	b.trialing = false
+	if !isOutage(err) {
+		b.failures = 0
+		b.l.Unlock()
+		return
+	}
+	var opened bool
+	if b.failures++; b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		opened = b.failures == b.threshold
+	}
+	b.l.Unlock()
+
+	if opened && b.onOpen != nil {
+		b.onOpen()
+	}
+}
+
+// do calls the given function if the breaker allows it, and records the
+// result.
+func (b *breaker) do(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
@@ -0,0 +1,54 @@
+package stellar
+
+import (
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/clients/horizonclient"
+)
+
+func TestBreaker(t *T) {
+	var opened int
+	b := &breaker{
+		threshold: 2,
+		cooldown:  50 * time.Millisecond,
+		onOpen:    func() { opened++ },
+	}
+	errOutage := errors.New("connection refused")
+	errRejected := new(horizonclient.Error)
+	errRejected.Problem.Status = 400
+
+	do := func(err error) error {
+		return b.do(func() error { return err })
+	}
+
+	massert.Require(t,
+		// rejections from horizon don't count towards opening
+		massert.Equal(errRejected, do(errRejected)),
+		massert.Equal(errRejected, do(errRejected)),
+		massert.Nil(do(nil)),
+
+		massert.Equal(errOutage, do(errOutage)),
+		massert.Equal(errOutage, do(errOutage)),
+		massert.Equal(ErrCircuitOpen, do(nil)),
+	)
+	massert.Require(t, massert.Equal(1, opened))
+
+	// after the cooldown a single trial call is let through, and if it fails
+	// the breaker opens again.
+	time.Sleep(b.cooldown)
+	massert.Require(t,
+		massert.Equal(errOutage, do(errOutage)),
+		massert.Equal(ErrCircuitOpen, do(nil)),
+		// it was already open, so there's nothing new to report
+		massert.Equal(1, opened),
+	)
+
+	time.Sleep(b.cooldown)
+	massert.Require(t,
+		massert.Nil(do(nil)),
+		massert.Nil(do(nil)),
+	)
+}
@@ -0,0 +1,46 @@
+package stellar
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrBudgetExceeded is returned from Client methods when the Context they were
+// given has a CallBudget which has been used up.
+var ErrBudgetExceeded = errors.New("too many calls to stellar, try again later")
+
+// CallBudget counts the calls made to horizon using a Context, and limits them
+// to some maximum. It's used to stop any one request, e.g. a user's command,
+// from eating into horizon's rate limits more than it ought to.
+type CallBudget struct {
+	max  int64
+	used int64
+}
+
+type callBudgetKey struct{}
+
+// WithCallBudget returns a Context which carries a new CallBudget of max calls.
+// If max is zero or less then calls are only counted, not limited.
+func WithCallBudget(ctx context.Context, max int) (context.Context, *CallBudget) {
+	b := &CallBudget{max: int64(max)}
+	return context.WithValue(ctx, callBudgetKey{}, b), b
+}
+
+// Used returns the number of calls which have been made against the budget,
+// including any which were refused for exceeding it.
+func (b *CallBudget) Used() int {
+	return int(atomic.LoadInt64(&b.used))
+}
+
+// spendCallBudget counts a call against the Context's CallBudget, if it has
+// one, returning ErrBudgetExceeded if the budget is used up.
+func spendCallBudget(ctx context.Context) error {
+	b, _ := ctx.Value(callBudgetKey{}).(*CallBudget)
+	if b == nil {
+		return nil
+	} else if used := atomic.AddInt64(&b.used, 1); b.max > 0 && used > b.max {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package stellar
+
+import (
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestCallBudget(t *T) {
+	massert.Require(t, massert.Nil(spendCallBudget(context.Background())))
+
+	ctx, b := WithCallBudget(context.Background(), 2)
+	massert.Require(t,
+		massert.Nil(spendCallBudget(ctx)),
+		massert.Nil(spendCallBudget(ctx)),
+		massert.Equal(ErrBudgetExceeded, spendCallBudget(ctx)),
+		massert.Equal(3, b.Used()),
+	)
+
+	ctx, b = WithCallBudget(context.Background(), 0)
+	for i := 0; i < 5; i++ {
+		massert.Require(t, massert.Nil(spendCallBudget(ctx)))
+	}
+	massert.Require(t, massert.Equal(5, b.Used()))
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/mcfg"
@@ -18,6 +19,7 @@ import (
 	"github.com/stellar/go/keypair"
 	"github.com/stellar/go/network"
 	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/operations"
 	"github.com/stellar/go/strkey"
 	"github.com/stellar/go/txnbuild"
 )
@@ -42,6 +44,29 @@ func (fe horizonErr) Unwrap() error {
 	return fe.err
 }
 
+// Is returns true for ErrNoTrustline if the error is from a transaction which
+// failed because an account didn't trust the asset being sent to it.
+func (fe horizonErr) Is(target error) bool {
+	return target == ErrNoTrustline && fe.hasOpCode("op_no_trust")
+}
+
+// hasOpCode returns whether the error is from a transaction which had an
+// operation fail with the given result code.
+func (fe horizonErr) hasOpCode(code string) bool {
+	herr, ok := fe.Unwrap().(*horizonclient.Error)
+	if !ok {
+		return false
+	}
+	resultCodes, _ := herr.Problem.Extras["result_codes"].(map[string]interface{})
+	opCodes, _ := resultCodes["operations"].([]interface{})
+	for _, opCode := range opCodes {
+		if opCode == code {
+			return true
+		}
+	}
+	return false
+}
+
 func (fe horizonErr) Error() string {
 	err := fe.Unwrap()
 	herr, ok := err.(*horizonclient.Error)
@@ -53,12 +78,42 @@ func (fe horizonErr) Error() string {
 	return fmt.Sprintf("horizon ERR: %q - %s", herr.Problem.Title, b)
 }
 
+// API describes the stellar functionality which buckaroo makes use of. It is
+// implemented by Client, and can be mocked using the stellartest package.
+type API interface {
+	MakeSendXDR(ctx context.Context, opts SendOpts) (string, error)
+	MakeOpsXDR(ctx context.Context, from *keypair.Full, memo string, ops ...txnbuild.Operation) (string, error)
+	SubmitTransactionXDR(ctx context.Context, txXDR string) (TransactionResult, error)
+	TransactionDetail(txHash string) (horizon.Transaction, error)
+	StreamPayments(ctx context.Context, req horizonclient.OperationRequest, fn horizonclient.OperationHandler) error
+	ListPayments(ctx context.Context, req horizonclient.OperationRequest) ([]operations.Operation, error)
+	AccountOffers(ctx context.Context, addr string) ([]horizon.Offer, error)
+	MidPrice(ctx context.Context, asset Asset) (float64, bool, error)
+	ResolveAddr(ctx context.Context, addr string) (string, string, error)
+	Root(ctx context.Context) (horizon.Root, error)
+	Fund(ctx context.Context, addr string) (TransactionResult, error)
+	MakeTrustlineXDR(ctx context.Context, addr string, asset Asset) (string, error)
+	AssetSupply(ctx context.Context, asset Asset) (string, error)
+	AccountBalance(ctx context.Context, addr string, asset Asset) (string, error)
+	Account(ctx context.Context, addr string) (horizon.Account, error)
+	FeeStats(ctx context.Context) (horizon.FeeStats, error)
+}
+
+var _ API = new(Client)
+
 // Client wraps a horizon client for stellar.
 type Client struct {
 	cmp *mcmp.Component
 	*horizonclient.Client
 	FederationClient  *federation.Client
 	NetworkPassphrase string
+
+	// OnCircuitOpen is optional, and is called whenever the circuit breaker
+	// opens due to horizon failing.
+	OnCircuitOpen func()
+
+	breaker *breaker
+	trusted trustCache
 }
 
 // InstClient instantiates a Client which will be intialized and configured by
@@ -76,23 +131,60 @@ func InstClient(parent *mcmp.Component, child bool) *Client {
 
 	live := mcfg.Bool(client.cmp, "live-net",
 		mcfg.ParamUsage("Use the live network."))
+	breakerThreshold := mcfg.Int(client.cmp, "circuit-breaker-threshold",
+		mcfg.ParamDefault(5),
+		mcfg.ParamUsage("Number of failed horizon calls in a row after which calls will fail immediately for a cooldown period. 0 disables."))
+	breakerCooldown := mcfg.String(client.cmp, "circuit-breaker-cooldown",
+		mcfg.ParamDefault("30s"),
+		mcfg.ParamUsage("How long horizon calls will fail immediately for, once the circuit breaker has opened."))
 	mrun.InitHook(client.cmp, func(ctx context.Context) error {
+		cooldown, err := time.ParseDuration(*breakerCooldown)
+		if err != nil {
+			return fmt.Errorf("parsing circuit-breaker-cooldown: %w", err)
+		}
+		client.breaker = &breaker{
+			threshold: *breakerThreshold,
+			cooldown:  cooldown,
+			onOpen: func() {
+				mlog.From(client.cmp).Warn("horizon circuit breaker has opened")
+				if client.OnCircuitOpen != nil {
+					client.OnCircuitOpen()
+				}
+			},
+		}
+
 		if *live {
 			mlog.From(client.cmp).Warn("connecting to live net", ctx)
-			client.Client = horizonclient.DefaultPublicNetClient
-			client.FederationClient = federation.DefaultPublicNetClient
-			client.NetworkPassphrase = network.PublicNetworkPassphrase
 		} else {
 			mlog.From(client.cmp).Info("connecting to test net", ctx)
-			client.Client = horizonclient.DefaultTestNetClient
-			client.FederationClient = federation.DefaultTestNetClient
-			client.NetworkPassphrase = network.TestNetworkPassphrase
 		}
+		client.SetLiveNet(*live)
 		return nil
 	})
 	return client
 }
 
+// SetLiveNet sets whether the Client uses the live network or the test
+// network. It's called during init based on --live-net, but can be called
+// again afterwards to override that, so long as the Client isn't being used
+// yet.
+func (c *Client) SetLiveNet(live bool) {
+	if live {
+		c.Client = horizonclient.DefaultPublicNetClient
+		c.FederationClient = federation.DefaultPublicNetClient
+		c.NetworkPassphrase = network.PublicNetworkPassphrase
+	} else {
+		c.Client = horizonclient.DefaultTestNetClient
+		c.FederationClient = federation.DefaultTestNetClient
+		c.NetworkPassphrase = network.TestNetworkPassphrase
+	}
+}
+
+// IsLiveNet returns whether the Client uses the live network.
+func (c *Client) IsLiveNet() bool {
+	return c.NetworkPassphrase == network.PublicNetworkPassphrase
+}
+
 // ResolveAddr takes in either a stellar address or a federated stellar address,
 // and returns a stellar address and a memo.
 //
@@ -127,6 +219,34 @@ func (c *Client) ResolveAddr(ctx context.Context, addr string) (string, string,
 	return addr, memo, nil
 }
 
+// do calls fn, which should make a single call to horizon, so long as both the
+// Context's CallBudget and the circuit breaker allow it.
+func (c *Client) do(ctx context.Context, fn func() error) error {
+	if err := spendCallBudget(ctx); err != nil {
+		return err
+	}
+	return c.breaker.do(fn)
+}
+
+func (c *Client) accountDetail(ctx context.Context, addr string) (horizon.Account, error) {
+	var account horizon.Account
+	err := c.do(ctx, func() (err error) {
+		account, err = c.AccountDetail(horizonclient.AccountRequest{AccountID: addr})
+		return err
+	})
+	return account, err
+}
+
+// TransactionDetail returns the details of the transaction with the given hash.
+func (c *Client) TransactionDetail(txHash string) (horizon.Transaction, error) {
+	var tx horizon.Transaction
+	err := c.do(context.Background(), func() (err error) {
+		tx, err = c.Client.TransactionDetail(txHash)
+		return err
+	})
+	return tx, err
+}
+
 // TransactionResult is returned from SubmitTransactionXDR and other methods
 // which submit a transaction to the stellar network.
 type TransactionResult = horizon.TransactionSuccess
@@ -136,7 +256,11 @@ type TransactionResult = horizon.TransactionSuccess
 func (c *Client) SubmitTransactionXDR(ctx context.Context, txXDR string) (TransactionResult, error) {
 	ctx = mctx.Annotate(ctx, "txXDR", txXDR)
 	mlog.From(c.cmp).Info("submitting transaction", ctx)
-	txRes, err := c.Client.SubmitTransactionXDR(txXDR)
+	var txRes TransactionResult
+	err := c.do(ctx, func() (err error) {
+		txRes, err = c.Client.SubmitTransactionXDR(txXDR)
+		return err
+	})
 	if err != nil {
 		return txRes, HorizonErr(err)
 	}
@@ -185,22 +309,22 @@ func (c *Client) MakeSendXDR(ctx context.Context, opts SendOpts) (string, error)
 	ctx = opts.annotate(ctx)
 
 	mlog.From(c.cmp).Info("retrieving source account", ctx)
-	sourceAccount, err := c.AccountDetail(horizonclient.AccountRequest{
-		AccountID: opts.From.Address(),
-	})
+	sourceAccount, err := c.accountDetail(ctx, opts.From.Address())
 	if err != nil {
 		return "", fmt.Errorf("error getting account detail: %w", err)
 	}
 
-	asset := txnbuild.CreditAsset{
-		Code:   opts.AssetCode,
-		Issuer: opts.AssetIssuer,
+	// catch this now, rather than when the transaction is submitted, since
+	// it's probably the most common reason for a payment to fail.
+	asset := Asset{Code: opts.AssetCode, Issuer: opts.AssetIssuer}
+	if err := c.checkTrustline(ctx, opts.To, asset); err != nil {
+		return "", err
 	}
 
 	op := txnbuild.Payment{
 		Destination: opts.To,
 		Amount:      opts.Amount,
-		Asset:       asset,
+		Asset:       asset.CreditAsset(),
 	}
 
 	timeout := txnbuild.NewInfiniteTimeout()
@@ -228,6 +352,199 @@ func (c *Client) MakeSendXDR(ctx context.Context, opts SendOpts) (string, error)
 	return txXDR, nil
 }
 
+// MakeOpsXDR constructs a transaction, sourced from the given account, which
+// contains all of the given operations, and returns the XDR encoding of that
+// transaction without submitting it to the stellar network. The memo is
+// optional.
+func (c *Client) MakeOpsXDR(ctx context.Context, from *keypair.Full, memo string, ops ...txnbuild.Operation) (string, error) {
+	ctx = mctx.Annotate(ctx, "opsFrom", from.Address(), "numOps", len(ops))
+	mlog.From(c.cmp).Info("retrieving source account", ctx)
+	sourceAccount, err := c.accountDetail(ctx, from.Address())
+	if err != nil {
+		return "", fmt.Errorf("error getting account detail: %w", HorizonErr(err))
+	}
+
+	tx := txnbuild.Transaction{
+		SourceAccount: &sourceAccount,
+		Operations:    ops,
+		Timebounds:    txnbuild.NewInfiniteTimeout(),
+		Network:       c.NetworkPassphrase,
+	}
+	if memo != "" {
+		tx.Memo = txnbuild.MemoText(memo)
+	}
+
+	txXDR, err := tx.BuildSignEncode(from)
+	if err != nil {
+		return "", fmt.Errorf("error performing BuildSignEncode: %w", err)
+	}
+	return txXDR, nil
+}
+
+// Asset describes a non-native asset on the stellar network.
+type Asset struct {
+	Code, Issuer string
+}
+
+func (a Asset) horizonType() horizonclient.AssetType {
+	if len(a.Code) <= 4 {
+		return horizonclient.AssetType4
+	}
+	return horizonclient.AssetType12
+}
+
+// CreditAsset returns the Asset as a txnbuild.CreditAsset.
+func (a Asset) CreditAsset() txnbuild.CreditAsset {
+	return txnbuild.CreditAsset{Code: a.Code, Issuer: a.Issuer}
+}
+
+// AccountOffers returns all offers on the DEX which are currently held open by
+// the given account.
+func (c *Client) AccountOffers(ctx context.Context, addr string) ([]horizon.Offer, error) {
+	mlog.From(c.cmp).Debug("retrieving account offers", mctx.Annotate(ctx, "addr", addr))
+	var page horizon.OffersPage
+	err := c.do(ctx, func() (err error) {
+		page, err = c.Offers(horizonclient.OfferRequest{
+			ForAccount: addr,
+			Limit:      200,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving offers for %q: %w", addr, HorizonErr(err))
+	}
+	return page.Embedded.Records, nil
+}
+
+// MidPrice returns the price, in XLM per unit of the given Asset, which sits
+// halfway between the best bid and best ask on the DEX. If either side of the
+// order book is empty then false is returned.
+func (c *Client) MidPrice(ctx context.Context, asset Asset) (float64, bool, error) {
+	mlog.From(c.cmp).Debug("retrieving order book", mctx.Annotate(ctx,
+		"assetCode", asset.Code, "assetIssuer", asset.Issuer))
+	var book horizon.OrderBookSummary
+	err := c.do(ctx, func() (err error) {
+		book, err = c.OrderBook(horizonclient.OrderBookRequest{
+			SellingAssetType:   asset.horizonType(),
+			SellingAssetCode:   asset.Code,
+			SellingAssetIssuer: asset.Issuer,
+			BuyingAssetType:    horizonclient.AssetTypeNative,
+			Limit:              1,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("error retrieving order book: %w", HorizonErr(err))
+	} else if len(book.Bids) == 0 || len(book.Asks) == 0 {
+		return 0, false, nil
+	}
+
+	bid, err := strconv.ParseFloat(book.Bids[0].Price, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("parsing bid price %q: %w", book.Bids[0].Price, err)
+	}
+	ask, err := strconv.ParseFloat(book.Asks[0].Price, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("parsing ask price %q: %w", book.Asks[0].Price, err)
+	}
+	return (bid + ask) / 2, true, nil
+}
+
+// AssetSupply returns the amount of the given Asset which is outstanding on the
+// network, i.e. held by every account other than its issuer.
+func (c *Client) AssetSupply(ctx context.Context, asset Asset) (string, error) {
+	mlog.From(c.cmp).Debug("retrieving asset stats", mctx.Annotate(ctx,
+		"assetCode", asset.Code, "assetIssuer", asset.Issuer))
+	var page horizon.AssetsPage
+	err := c.do(ctx, func() (err error) {
+		page, err = c.Assets(horizonclient.AssetRequest{
+			ForAssetCode:   asset.Code,
+			ForAssetIssuer: asset.Issuer,
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error retrieving asset stats: %w", HorizonErr(err))
+	}
+	for _, stat := range page.Embedded.Records {
+		if stat.Code == asset.Code && stat.Issuer == asset.Issuer {
+			return stat.Amount, nil
+		}
+	}
+	// horizon only knows about assets which have been issued at least once.
+	return "0", nil
+}
+
+// AccountBalance returns how much of the given Asset the account at the given
+// stellar address holds, which is zero if it doesn't trust the Asset.
+func (c *Client) AccountBalance(ctx context.Context, addr string, asset Asset) (string, error) {
+	account, err := c.accountDetail(ctx, addr)
+	if err != nil {
+		return "", fmt.Errorf("error getting account detail: %w", HorizonErr(err))
+	}
+	for _, balance := range account.Balances {
+		if balance.Code == asset.Code && balance.Issuer == asset.Issuer {
+			return balance.Balance, nil
+		}
+	}
+	return "0", nil
+}
+
+// Account returns the details of the account at the given stellar address,
+// i.e. its balances, signers and thresholds.
+func (c *Client) Account(ctx context.Context, addr string) (horizon.Account, error) {
+	account, err := c.accountDetail(ctx, addr)
+	if err != nil {
+		return horizon.Account{}, fmt.Errorf("error getting account detail: %w", HorizonErr(err))
+	}
+	return account, nil
+}
+
+// FeeStats returns the fees which were charged for transactions in recent
+// ledgers, which go up when the network is congested.
+func (c *Client) FeeStats(ctx context.Context) (horizon.FeeStats, error) {
+	mlog.From(c.cmp).Debug("retrieving fee stats", ctx)
+	var stats horizon.FeeStats
+	err := c.do(ctx, func() (err error) {
+		stats, err = c.Client.FeeStats()
+		return err
+	})
+	if err != nil {
+		return horizon.FeeStats{}, fmt.Errorf("error retrieving fee stats: %w", HorizonErr(err))
+	}
+	return stats, nil
+}
+
+// Fund asks friendbot to create and fund the given account with testnet XLM.
+// It only works against testnet.
+func (c *Client) Fund(ctx context.Context, addr string) (TransactionResult, error) {
+	mlog.From(c.cmp).Info("funding account via friendbot", mctx.Annotate(ctx, "addr", addr))
+	var txRes TransactionResult
+	err := c.do(ctx, func() (err error) {
+		txRes, err = c.Client.Fund(addr)
+		return err
+	})
+	if err != nil {
+		return txRes, HorizonErr(err)
+	}
+	return txRes, nil
+}
+
+// Root returns horizon's root resource, which describes the horizon instance
+// and the network it's connected to.
+func (c *Client) Root(ctx context.Context) (horizon.Root, error) {
+	mlog.From(c.cmp).Debug("retrieving horizon root", ctx)
+	var root horizon.Root
+	err := c.do(ctx, func() (err error) {
+		root, err = c.Client.Root()
+		return err
+	})
+	if err != nil {
+		return horizon.Root{}, fmt.Errorf("error retrieving horizon root: %w", HorizonErr(err))
+	}
+	return root, nil
+}
+
 // Send is used to send funds from one account to another. It will automatically
 // resolve federated stellar addresses.
 func (c *Client) Send(ctx context.Context, opts SendOpts) (TransactionResult, error) {
@@ -280,3 +597,18 @@ func InstKeyPair(cmp *mcmp.Component) *keypair.Full {
 
 	return kp
 }
+
+// ListPayments returns a single page of the payments which StreamPayments would
+// stream for the same request, e.g. to look for any which a stream skipped.
+func (c *Client) ListPayments(ctx context.Context, req horizonclient.OperationRequest) ([]operations.Operation, error) {
+	mlog.From(c.cmp).Debug("listing payments", mctx.Annotate(ctx, "cursor", req.Cursor))
+	var page operations.OperationsPage
+	err := c.do(ctx, func() (err error) {
+		page, err = c.Client.Payments(req)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing payments: %w", HorizonErr(err))
+	}
+	return page.Embedded.Records, nil
+}
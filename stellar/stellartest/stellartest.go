@@ -0,0 +1,200 @@
+// Package stellartest provides a mock implementation of stellar.API, for
+// testing code which interacts with stellar without needing a live horizon.
+package stellartest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/operations"
+	"github.com/stellar/go/txnbuild"
+
+	"buckaroo-banzai/stellar"
+)
+
+// Mock implements stellar.API. Each method calls the corresponding Fn field,
+// or returns an error if that field isn't set.
+//
+// All transaction XDRs passed into SubmitTransactionXDR are recorded, and can
+// be retrieved using Submitted.
+type Mock struct {
+	MakeSendXDRFn          func(ctx context.Context, opts stellar.SendOpts) (string, error)
+	MakeOpsXDRFn           func(ctx context.Context, from *keypair.Full, memo string, ops ...txnbuild.Operation) (string, error)
+	SubmitTransactionXDRFn func(ctx context.Context, txXDR string) (stellar.TransactionResult, error)
+	TransactionDetailFn    func(txHash string) (horizon.Transaction, error)
+	AccountOffersFn        func(ctx context.Context, addr string) ([]horizon.Offer, error)
+	MidPriceFn             func(ctx context.Context, asset stellar.Asset) (float64, bool, error)
+	ResolveAddrFn          func(ctx context.Context, addr string) (string, string, error)
+	RootFn                 func(ctx context.Context) (horizon.Root, error)
+	FundFn                 func(ctx context.Context, addr string) (stellar.TransactionResult, error)
+	MakeTrustlineXDRFn     func(ctx context.Context, addr string, asset stellar.Asset) (string, error)
+	AssetSupplyFn          func(ctx context.Context, asset stellar.Asset) (string, error)
+	AccountBalanceFn       func(ctx context.Context, addr string, asset stellar.Asset) (string, error)
+	AccountFn              func(ctx context.Context, addr string) (horizon.Account, error)
+	FeeStatsFn             func(ctx context.Context) (horizon.FeeStats, error)
+	ListPaymentsFn         func(ctx context.Context, req horizonclient.OperationRequest) ([]operations.Operation, error)
+
+	// Payments are passed into the handler given to StreamPayments, after
+	// which StreamPayments blocks until its Context is canceled. If
+	// StreamPaymentsFn is set then it's called instead, e.g. to act like a
+	// stream which stalls.
+	Payments         []operations.Operation
+	StreamPaymentsFn func(ctx context.Context, req horizonclient.OperationRequest, fn horizonclient.OperationHandler) error
+
+	l         sync.Mutex
+	submitted []string
+}
+
+var _ stellar.API = new(Mock)
+
+func notMocked(method string) error {
+	return fmt.Errorf("stellartest: %s not mocked", method)
+}
+
+// MakeSendXDR implements the method for stellar.API.
+func (m *Mock) MakeSendXDR(ctx context.Context, opts stellar.SendOpts) (string, error) {
+	if m.MakeSendXDRFn == nil {
+		return "", notMocked("MakeSendXDR")
+	}
+	return m.MakeSendXDRFn(ctx, opts)
+}
+
+// MakeOpsXDR implements the method for stellar.API.
+func (m *Mock) MakeOpsXDR(ctx context.Context, from *keypair.Full, memo string, ops ...txnbuild.Operation) (string, error) {
+	if m.MakeOpsXDRFn == nil {
+		return "", notMocked("MakeOpsXDR")
+	}
+	return m.MakeOpsXDRFn(ctx, from, memo, ops...)
+}
+
+// SubmitTransactionXDR implements the method for stellar.API.
+func (m *Mock) SubmitTransactionXDR(ctx context.Context, txXDR string) (stellar.TransactionResult, error) {
+	m.l.Lock()
+	m.submitted = append(m.submitted, txXDR)
+	m.l.Unlock()
+
+	if m.SubmitTransactionXDRFn == nil {
+		return stellar.TransactionResult{}, notMocked("SubmitTransactionXDR")
+	}
+	return m.SubmitTransactionXDRFn(ctx, txXDR)
+}
+
+// Submitted returns all transaction XDRs which have been passed into
+// SubmitTransactionXDR, in the order they were passed in.
+func (m *Mock) Submitted() []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return append([]string(nil), m.submitted...)
+}
+
+// TransactionDetail implements the method for stellar.API.
+func (m *Mock) TransactionDetail(txHash string) (horizon.Transaction, error) {
+	if m.TransactionDetailFn == nil {
+		return horizon.Transaction{}, notMocked("TransactionDetail")
+	}
+	return m.TransactionDetailFn(txHash)
+}
+
+// StreamPayments implements the method for stellar.API.
+func (m *Mock) StreamPayments(ctx context.Context, req horizonclient.OperationRequest, fn horizonclient.OperationHandler) error {
+	if m.StreamPaymentsFn != nil {
+		return m.StreamPaymentsFn(ctx, req, fn)
+	}
+	for _, op := range m.Payments {
+		fn(op)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// ListPayments implements the method for stellar.API.
+func (m *Mock) ListPayments(ctx context.Context, req horizonclient.OperationRequest) ([]operations.Operation, error) {
+	if m.ListPaymentsFn == nil {
+		return nil, notMocked("ListPayments")
+	}
+	return m.ListPaymentsFn(ctx, req)
+}
+
+// AccountOffers implements the method for stellar.API.
+func (m *Mock) AccountOffers(ctx context.Context, addr string) ([]horizon.Offer, error) {
+	if m.AccountOffersFn == nil {
+		return nil, notMocked("AccountOffers")
+	}
+	return m.AccountOffersFn(ctx, addr)
+}
+
+// MidPrice implements the method for stellar.API.
+func (m *Mock) MidPrice(ctx context.Context, asset stellar.Asset) (float64, bool, error) {
+	if m.MidPriceFn == nil {
+		return 0, false, notMocked("MidPrice")
+	}
+	return m.MidPriceFn(ctx, asset)
+}
+
+// ResolveAddr implements the method for stellar.API.
+func (m *Mock) ResolveAddr(ctx context.Context, addr string) (string, string, error) {
+	if m.ResolveAddrFn == nil {
+		return "", "", notMocked("ResolveAddr")
+	}
+	return m.ResolveAddrFn(ctx, addr)
+}
+
+// Root implements the method for stellar.API.
+func (m *Mock) Root(ctx context.Context) (horizon.Root, error) {
+	if m.RootFn == nil {
+		return horizon.Root{}, notMocked("Root")
+	}
+	return m.RootFn(ctx)
+}
+
+// Fund implements the method for stellar.API.
+func (m *Mock) Fund(ctx context.Context, addr string) (stellar.TransactionResult, error) {
+	if m.FundFn == nil {
+		return stellar.TransactionResult{}, notMocked("Fund")
+	}
+	return m.FundFn(ctx, addr)
+}
+
+// MakeTrustlineXDR implements the method for stellar.API.
+func (m *Mock) MakeTrustlineXDR(ctx context.Context, addr string, asset stellar.Asset) (string, error) {
+	if m.MakeTrustlineXDRFn == nil {
+		return "", notMocked("MakeTrustlineXDR")
+	}
+	return m.MakeTrustlineXDRFn(ctx, addr, asset)
+}
+
+// AssetSupply implements the method for stellar.API.
+func (m *Mock) AssetSupply(ctx context.Context, asset stellar.Asset) (string, error) {
+	if m.AssetSupplyFn == nil {
+		return "", notMocked("AssetSupply")
+	}
+	return m.AssetSupplyFn(ctx, asset)
+}
+
+// AccountBalance implements the method for stellar.API.
+func (m *Mock) AccountBalance(ctx context.Context, addr string, asset stellar.Asset) (string, error) {
+	if m.AccountBalanceFn == nil {
+		return "", notMocked("AccountBalance")
+	}
+	return m.AccountBalanceFn(ctx, addr, asset)
+}
+
+// Account implements the method for stellar.API.
+func (m *Mock) Account(ctx context.Context, addr string) (horizon.Account, error) {
+	if m.AccountFn == nil {
+		return horizon.Account{}, notMocked("Account")
+	}
+	return m.AccountFn(ctx, addr)
+}
+
+// FeeStats implements the method for stellar.API.
+func (m *Mock) FeeStats(ctx context.Context) (horizon.FeeStats, error) {
+	if m.FeeStatsFn == nil {
+		return horizon.FeeStats{}, notMocked("FeeStats")
+	}
+	return m.FeeStatsFn(ctx)
+}
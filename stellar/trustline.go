@@ -0,0 +1,141 @@
+package stellar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+)
+
+// ErrNoTrustline is returned from MakeSendXDR when the destination account
+// doesn't have a trustline for the asset being sent, in which case the payment
+// would fail. Errors from submitting a transaction which failed for that reason
+// also match it, using errors.Is.
+var ErrNoTrustline = errors.New("destination account doesn't trust the asset")
+
+// trustCacheTTL is how long an account is remembered as trusting an asset, so
+// that repeated payments to it don't each need to look it up. Accounts which
+// don't trust the asset aren't remembered, since they're likely to be about to.
+const trustCacheTTL = 10 * time.Minute
+
+// trustCache remembers which accounts have recently been seen to trust which
+// assets. The zero value is ready to use.
+type trustCache struct {
+	l sync.Mutex
+	m map[string]time.Time
+}
+
+func trustCacheKey(addr string, asset Asset) string {
+	return addr + ":" + asset.Code + ":" + asset.Issuer
+}
+
+func (tc *trustCache) get(addr string, asset Asset) bool {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	key := trustCacheKey(addr, asset)
+	if seen, ok := tc.m[key]; !ok {
+		return false
+	} else if time.Since(seen) > trustCacheTTL {
+		delete(tc.m, key)
+		return false
+	}
+	return true
+}
+
+func (tc *trustCache) set(addr string, asset Asset) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	if tc.m == nil {
+		tc.m = map[string]time.Time{}
+	}
+	tc.m[trustCacheKey(addr, asset)] = time.Now()
+}
+
+// trusts returns whether the account has a trustline for the asset. An account
+// always trusts assets which it issues.
+func trusts(account horizon.Account, asset Asset) bool {
+	if account.AccountID == asset.Issuer {
+		return true
+	}
+	for _, balance := range account.Balances {
+		if balance.Code == asset.Code && balance.Issuer == asset.Issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTrustline returns ErrNoTrustline if the account at the given stellar
+// address doesn't trust the asset.
+func (c *Client) checkTrustline(ctx context.Context, addr string, asset Asset) error {
+	if c.trusted.get(addr, asset) {
+		return nil
+	}
+
+	mlog.From(c.cmp).Info("retrieving destination account", ctx)
+	account, err := c.accountDetail(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("error getting destination account detail: %w", HorizonErr(err))
+	} else if !trusts(account, asset) {
+		return fmt.Errorf("account %q: %w", addr, ErrNoTrustline)
+	}
+	c.trusted.set(addr, asset)
+	return nil
+}
+
+// MakeTrustlineXDR constructs a transaction, sourced from the given stellar (or
+// federation) address, which adds a trustline for the asset. The transaction is
+// returned XDR encoded and unsigned, so that the account's owner can sign and
+// submit it themselves, e.g. using TxURI.
+func (c *Client) MakeTrustlineXDR(ctx context.Context, addr string, asset Asset) (string, error) {
+	resolvedAddr, _, err := c.ResolveAddr(ctx, addr)
+	if err != nil {
+		return "", fmt.Errorf("error resolving address %q: %w", addr, err)
+	}
+
+	ctx = mctx.Annotate(ctx, "trustlineAddr", resolvedAddr, "trustlineAssetCode", asset.Code)
+	mlog.From(c.cmp).Info("retrieving trustline source account", ctx)
+	sourceAccount, err := c.accountDetail(ctx, resolvedAddr)
+	if err != nil {
+		return "", fmt.Errorf("error getting account detail: %w", HorizonErr(err))
+	}
+
+	tx := txnbuild.Transaction{
+		SourceAccount: &sourceAccount,
+		Operations:    []txnbuild.Operation{&txnbuild.ChangeTrust{Line: asset.CreditAsset()}},
+		Timebounds:    txnbuild.NewInfiniteTimeout(),
+		Network:       c.NetworkPassphrase,
+	}
+
+	// no keypairs, so it's only built and encoded.
+	txXDR, err := tx.BuildSignEncode()
+	if err != nil {
+		return "", fmt.Errorf("error performing BuildSignEncode: %w", err)
+	}
+	return txXDR, nil
+}
+
+// TxURI returns a SEP-7 "web+stellar:tx" URI for the given unsigned
+// transaction, which wallets supporting SEP-7 can open in order to sign and
+// submit it. msg is optional, and is shown to the user by the wallet.
+func TxURI(txXDR, networkPassphrase, msg string) string {
+	params := url.Values{"xdr": {txXDR}}
+	if networkPassphrase != network.PublicNetworkPassphrase {
+		params.Set("network_passphrase", networkPassphrase)
+	}
+	if msg != "" {
+		params.Set("msg", msg)
+	}
+
+	// SEP-7 expects spaces to be percent encoded.
+	return "web+stellar:tx?" + strings.Replace(params.Encode(), "+", "%20", -1)
+}
@@ -0,0 +1,68 @@
+package stellar
+
+import (
+	"errors"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/base"
+	"github.com/stellar/go/support/render/problem"
+)
+
+func TestTrusts(t *T) {
+	asset := Asset{Code: "BUCK", Issuer: "GISSUER"}
+	balance := func(code, issuer string) horizon.Balance {
+		var b horizon.Balance
+		b.Asset = base.Asset{Type: "credit_alphanum4", Code: code, Issuer: issuer}
+		return b
+	}
+
+	massert.Require(t,
+		massert.Equal(false, trusts(horizon.Account{AccountID: "GA"}, asset)),
+		massert.Equal(true, trusts(horizon.Account{AccountID: "GISSUER"}, asset)),
+		massert.Equal(false, trusts(horizon.Account{
+			AccountID: "GA",
+			Balances:  []horizon.Balance{balance("BUCK", "GOTHER"), balance("USD", "GISSUER")},
+		}, asset)),
+		massert.Equal(true, trusts(horizon.Account{
+			AccountID: "GA",
+			Balances:  []horizon.Balance{balance("USD", "GISSUER"), balance("BUCK", "GISSUER")},
+		}, asset)),
+	)
+}
+
+func TestTxURI(t *T) {
+	massert.Require(t,
+		massert.Equal(
+			"web+stellar:tx?xdr=AAAA%2Bb%2F%3D",
+			TxURI("AAAA+b/=", network.PublicNetworkPassphrase, ""),
+		),
+		massert.Equal(
+			"web+stellar:tx?msg=trust%20me&network_passphrase=Test%20SDF%20Network%20%3B%20September%202015&xdr=AAAA",
+			TxURI("AAAA", network.TestNetworkPassphrase, "trust me"),
+		),
+	)
+}
+
+func TestHorizonErrNoTrustline(t *T) {
+	txErr := func(opCodes ...interface{}) error {
+		return HorizonErr(&horizonclient.Error{Problem: problem.P{
+			Extras: map[string]interface{}{
+				"result_codes": map[string]interface{}{
+					"transaction": "tx_failed",
+					"operations":  opCodes,
+				},
+			},
+		}})
+	}
+
+	massert.Require(t,
+		massert.Equal(true, errors.Is(txErr("op_no_trust"), ErrNoTrustline)),
+		massert.Equal(true, errors.Is(txErr("op_success", "op_no_trust"), ErrNoTrustline)),
+		massert.Equal(false, errors.Is(txErr("op_underfunded"), ErrNoTrustline)),
+		massert.Equal(false, errors.Is(HorizonErr(errors.New("boom")), ErrNoTrustline)),
+	)
+}